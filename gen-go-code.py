@@ -171,6 +171,7 @@ def stringify() -> None:
     for path in (
         'tools/tui/graphics/command.go',
         'tools/rsync/algorithm.go',
+        'tools/rsync/manifest.go',
         'kittens/transfer/ftc.go',
     ):
         stringify_file(path)
@@ -295,7 +296,7 @@ def generate_completions_for_kitty() -> None:
 # rc command wrappers {{{
 json_field_types: Dict[str, str] = {
     'bool': 'bool', 'str': 'escaped_string', 'list.str': '[]escaped_string', 'dict.str': 'map[escaped_string]escaped_string', 'float': 'float64', 'int': 'int',
-    'scroll_amount': 'any', 'spacing': 'any', 'colors': 'any',
+    'scroll_amount': 'any', 'spacing': 'any', 'colors': 'any', 'rc_command': '*utils.RemoteControlCmd',
 }
 
 
@@ -312,10 +313,25 @@ def go_field_type(json_field_type: str) -> str:
     raise TypeError(f'Unknown JSON field type: {json_field_type}')
 
 
+def json_schema_for_field_type(json_field_type: str) -> Dict[str, Any]:
+    simple = {'bool': 'boolean', 'str': 'string', 'int': 'integer', 'float': 'number', 'rc_command': 'object'}
+    if json_field_type in simple:
+        return {'type': simple[json_field_type]}
+    if json_field_type.startswith('choices.'):
+        return {'type': 'string', 'enum': json_field_type.split('.')[1:]}
+    if json_field_type.startswith('list.'):
+        return {'type': 'array', 'items': json_schema_for_field_type(json_field_type[5:])}
+    if json_field_type.startswith('dict.'):
+        return {'type': 'object', 'additionalProperties': json_schema_for_field_type(json_field_type[5:])}
+    # types with special parsing, such as colors, are described in the field description
+    return {}
+
+
 class JSONField:
 
     def __init__(self, line: str) -> None:
-        field_def = line.split(':', 1)[0]
+        field_def, self.description = line.split(':', 1)
+        self.description = ' '.join(self.description.split())
         self.required = False
         self.field, self.field_type = field_def.split('/', 1)
         if self.field.endswith('+'):
@@ -326,6 +342,31 @@ def __init__(self, line: str) -> None:
     def go_declaration(self) -> str:
         return self.struct_field_name + ' ' + go_field_type(self.field_type) + f'`json:"{self.field},omitempty"`'
 
+    def json_schema(self) -> Dict[str, Any]:
+        ans = json_schema_for_field_type(self.field_type)
+        ans['description'] = self.description
+        return ans
+
+
+def protocol_description(cmd: RemoteCommand, json_fields: Sequence[JSONField]) -> str:
+    streams_responses = 'always' if cmd.streams_responses else 'never'
+    if cmd.streams_responses_option:
+        streams_responses = f'with --{cmd.streams_responses_option.replace("_", "-")}'
+    ans = {
+        'payload': {
+            'type': 'object',
+            'properties': {f.field: f.json_schema() for f in json_fields},
+            'required': [f.field for f in json_fields if f.required],
+        },
+        'async': cmd.is_asynchronous,
+        'reads_streaming_data': cmd.reads_streaming_data,
+        'streams_responses': streams_responses,
+        'string_response_is_error': cmd.string_return_is_error,
+    }
+    if cmd.passes_fds_field:
+        ans['passes_fds_field'] = cmd.passes_fds_field
+    return json.dumps(ans, sort_keys=True)
+
 
 def go_code_for_remote_command(name: str, cmd: RemoteCommand, template: str) -> str:
     template = '\n' + template[len('//go:build exclude'):]
@@ -357,7 +398,8 @@ def go_code_for_remote_command(name: str, cmd: RemoteCommand, template: str) ->
     jc.extend(cmd.args.as_go_code(name, field_types, handled_fields))
 
     unhandled = {}
-    used_options = set()
+    # options used only when parsing the args or handling the response
+    used_options = {k for k in option_map if f'options_{name}.{k}' in cmd.args.special_parse + cmd.response_handler}
     for field in json_fields:
         oq = (cmd.field_to_option_map or {}).get(field.field, field.field)
         oq = ''.join(x.capitalize() for x in oq.split('_'))
@@ -370,6 +412,10 @@ def go_code_for_remote_command(name: str, cmd: RemoteCommand, template: str) ->
                 jc.append(f'payload.{field.struct_field_name} = escape_list_of_strings(options_{name}.{o.go_var_name})')
             elif field.field_type == 'dict.str':
                 jc.append(f'payload.{field.struct_field_name} = escape_dict_of_strings(options_{name}.{o.go_var_name})')
+            elif field.field == cmd.passes_fds_field:
+                jc.append(f'payload.{field.struct_field_name}, err = parse_fds_to_pass(options_{name}.{o.go_var_name})')
+                jc.append('if err != nil { return err }')
+                jc.append(f'io_data.fds_to_pass = payload.{field.struct_field_name}')
             else:
                 jc.append(f'payload.{field.struct_field_name} = options_{name}.{o.go_var_name}')
         elif field.field in handled_fields:
@@ -393,6 +439,10 @@ def go_code_for_remote_command(name: str, cmd: RemoteCommand, template: str) ->
         if unused_options:
             raise SystemExit(f'Unused options: {", ".join(unused_options)} for command: {name}')
 
+    STREAMS_RESPONSES = 'true' if cmd.streams_responses else 'false'
+    if cmd.streams_responses_option:
+        STREAMS_RESPONSES = f'options_{name}.{option_map["".join(x.capitalize() for x in cmd.streams_responses_option.split("_"))].go_var_name}'
+
     argspec = cmd.args.spec
     if argspec:
         argspec = ' ' + argspec
@@ -409,6 +459,8 @@ def go_code_for_remote_command(name: str, cmd: RemoteCommand, template: str) ->
         JSON_INIT_CODE='\n'.join(jc), ARGSPEC=argspec,
         STRING_RESPONSE_IS_ERROR='true' if cmd.string_return_is_error else 'false',
         STREAM_WANTED='true' if cmd.reads_streaming_data else 'false',
+        STREAMS_RESPONSES=STREAMS_RESPONSES, RESPONSE_HANDLER=cmd.response_handler or 'nil',
+        PROTOCOL_DESCRIPTION=serialize_as_go_string(protocol_description(cmd, json_fields)),
     )
     return ans
 # }}}
@@ -734,6 +786,7 @@ def generate_readline_actions() -> str:
         ActionTerminateHistorySearchAndRestore
         ActionClearScreen
         ActionAddText
+        ActionInsertNewline
         ActionAbortCurrentLine
 
         ActionStartKillActions
@@ -760,6 +813,13 @@ def generate_readline_actions() -> str:
 
         ActionCompleteForward
         ActionCompleteBackward
+        ActionCompleteDown
+        ActionCompleteUp
+        ActionAcceptCompletion
+        ActionCancelCompletion
+
+        ActionUndo
+        ActionRedo
     ''')
 
 
@@ -1,6 +1,7 @@
 module kitty
 
-go 1.20
+// github.com/klauspost/compress, used for zstd compression in rsync, requires go 1.22
+go 1.22
 
 require (
 	github.com/ALTree/bigfloat v0.0.0-20220102081255-38c8b72a9924
@@ -11,13 +12,16 @@ require (
 	github.com/google/go-cmp v0.5.9
 	github.com/google/uuid v1.3.0
 	github.com/jamesruan/go-rfc1924 v0.0.0-20170108144916-2767ca7c638f
+	github.com/klauspost/compress v1.18.0
 	github.com/seancfoley/ipaddress-go v1.5.4
 	github.com/shirou/gopsutil/v3 v3.23.6
 	github.com/zeebo/xxh3 v1.0.2
+	golang.org/x/crypto v0.11.0
 	golang.org/x/exp v0.0.0-20230321023759-10a507213a29
-	golang.org/x/sys v0.10.0
 	golang.org/x/image v0.9.0
+	golang.org/x/sys v0.10.0
 	howett.net/plist v1.0.0
+	lukechampine.com/blake3 v1.1.7
 )
 
 require (
@@ -30,4 +34,5 @@ require (
 	github.com/tklauser/go-sysconf v0.3.11 // indirect
 	github.com/tklauser/numcpus v0.6.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.3 // indirect
+	golang.org/x/text v0.11.0 // indirect
 )
@@ -22,7 +22,7 @@ func get_line(o *Options) (result string, err error) {
 		return
 	}
 	cwd, _ := os.Getwd()
-	ropts := readline.RlInit{Prompt: o.Prompt}
+	ropts := readline.RlInit{Prompt: o.Prompt, MultiLine: o.Multiline}
 	if o.Name != "" {
 		base := filepath.Join(utils.CacheDir(), "ask")
 		ropts.HistoryPath = filepath.Join(base, o.Name+".history.json")
@@ -51,6 +51,13 @@ def option_text() -> str:
 The prompt to use when inputting a line of text or a password.
 
 
+--multiline
+type=bool-set
+When asking for a line of text, allow entering multiple lines of text. The
+:kbd:`Enter` key starts a new line and :kbd:`Ctrl+Enter` or :kbd:`Alt+Enter`
+submits the text.
+
+
 --unhide-key
 default=u
 The key to be pressed to unhide hidden text
@@ -16,6 +16,7 @@ import (
 
 	"kitty/tools/cli"
 	"kitty/tools/utils"
+	"kitty/tools/utils/style"
 
 	"golang.org/x/sys/unix"
 )
@@ -329,11 +330,10 @@ func main(_ *cli.Command, _ *Options, args []string) (rc int, err error) {
 	}
 
 	write_hyperlink := func(url, line, frag string) {
-		write("\033]8;;", url)
 		if frag != "" {
-			write("#", frag)
+			url += "#" + frag
 		}
-		write("\033\\", line, "\n\033]8;;\033\\")
+		write(style.HyperlinkStart(url, ""), line, "\n", style.HyperlinkEnd)
 	}
 
 	buf.process_line = func(line string) {
@@ -0,0 +1,165 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+const (
+	agent_failure      byte = 5
+	agent_sign_request byte = 13
+	// the maximum message size allowed by OpenSSH
+	agent_max_message_size = 256 * 1024
+)
+
+// The socket of the agent that is forwarded to the remote host, from the
+// output of ssh -G, or the empty string if agent forwarding is disabled
+func forwarded_agent_socket(effective_config string) string {
+	val, found := effective_ssh_config_value(effective_config, "forwardagent")
+	switch {
+	case !found || strings.ToLower(val) == "no":
+		return ""
+	case strings.ToLower(val) == "yes":
+		return os.Getenv("SSH_AUTH_SOCK")
+	}
+	return utils.Expanduser(os.ExpandEnv(val))
+}
+
+func read_agent_message(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	sz := binary.BigEndian.Uint32(header[:])
+	if sz < 1 || sz > agent_max_message_size {
+		return nil, fmt.Errorf("Invalid SSH agent message size: %d", sz)
+	}
+	ans := make([]byte, sz)
+	_, err := io.ReadFull(r, ans)
+	return ans, err
+}
+
+func write_agent_message(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint32(make([]byte, 0, len(msg)+4), uint32(len(msg))), msg...))
+	return err
+}
+
+// The type and fingerprint of the key a sign request is for, in the format
+// used by ssh-add -l
+func describe_sign_request(msg []byte) string {
+	blob, _, err := read_ssh_string(msg[1:])
+	if err != nil {
+		return "unknown key"
+	}
+	h := sha256.Sum256(blob)
+	ans := "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
+	if key_type, _, err := read_ssh_string(blob); err == nil {
+		ans = string(key_type) + " " + ans
+	}
+	return ans
+}
+
+// A proxy for the SSH agent that is forwarded to the remote host, that asks
+// the user to confirm each use of a key by the remote host
+type confirming_agent struct {
+	upstream, hostname string
+	tdir, socket_path  string
+	listener           net.Listener
+	// serializes the confirmation prompts
+	prompt_lock sync.Mutex
+	// for testing
+	confirm func(msg string) bool
+}
+
+func start_confirming_agent(upstream, hostname string) (ans *confirming_agent, err error) {
+	ans = &confirming_agent{upstream: upstream, hostname: hostname}
+	ans.confirm = ans.confirm_via_kitty
+	if ans.tdir, err = os.MkdirTemp("", "kssh-agent-"); err != nil {
+		return nil, err
+	}
+	ans.socket_path = filepath.Join(ans.tdir, "agent.sock")
+	if ans.listener, err = net.Listen("unix", ans.socket_path); err != nil {
+		os.RemoveAll(ans.tdir)
+		return nil, fmt.Errorf("Failed to listen on the SSH agent socket with error: %w", err)
+	}
+	go ans.serve()
+	return ans, nil
+}
+
+func (self *confirming_agent) close() {
+	self.listener.Close()
+	os.RemoveAll(self.tdir)
+}
+
+func (self *confirming_agent) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go self.handle(conn)
+	}
+}
+
+func (self *confirming_agent) confirm_via_kitty(msg string) bool {
+	data, err := ask_via_kitty(map[string]any{"message": msg, "type": "confirm"})
+	if err != nil {
+		return false
+	}
+	var ok bool
+	return json.Unmarshal(data, &ok) == nil && ok
+}
+
+// The agent protocol is strictly request-response, so requests are relayed
+// to the upstream agent one at a time
+func (self *confirming_agent) handle(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.Dial("unix", self.upstream)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	for {
+		msg, err := read_agent_message(conn)
+		if err != nil {
+			return
+		}
+		if msg[0] == agent_sign_request {
+			self.prompt_lock.Lock()
+			allowed := self.confirm(fmt.Sprintf(
+				"The remote host %s wants to use your forwarded SSH agent to sign with the key:\n%s\nAllow it?", self.hostname, describe_sign_request(msg)))
+			self.prompt_lock.Unlock()
+			if !allowed {
+				if write_agent_message(conn, []byte{agent_failure}) != nil {
+					return
+				}
+				continue
+			}
+		}
+		if write_agent_message(upstream, msg) != nil {
+			return
+		}
+		if msg, err = read_agent_message(upstream); err != nil || write_agent_message(conn, msg) != nil {
+			return
+		}
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"kitty/tools/cli"
 	"kitty/tools/tty"
+	"kitty/tools/utils"
 	"kitty/tools/utils/shm"
 )
 
@@ -21,40 +23,26 @@ func fatal(err error) {
 	os.Exit(1)
 }
 
-func trigger_ask(name string) {
+func trigger_ask(name string) error {
 	term, err := tty.OpenControllingTerm()
 	if err != nil {
-		fatal(err)
+		return err
 	}
 	defer term.Close()
 	_, err = term.WriteString("\x1bP@kitty-ask|" + name + "\x1b\\")
-	if err != nil {
-		fatal(err)
-	}
-
+	return err
 }
 
-func RunSSHAskpass() {
-	msg := os.Args[len(os.Args)-1]
-	prompt := os.Getenv("SSH_ASKPASS_PROMPT")
-	is_confirm := prompt == "confirm"
-	q_type := "get_line"
-	if is_confirm {
-		q_type = "confirm"
-	}
-	is_fingerprint_check := strings.Contains(msg, "(yes/no/[fingerprint])")
-	q := map[string]any{
-		"message":     msg,
-		"type":        q_type,
-		"is_password": !is_fingerprint_check,
-	}
+// Ask kitty to show the question q in the current window and wait for the
+// response
+func ask_via_kitty(q map[string]any) ([]byte, error) {
 	data, err := json.Marshal(q)
 	if err != nil {
-		fatal(err)
+		return nil, err
 	}
 	data_shm, err := shm.CreateTemp("askpass-*", uint64(len(data)+32))
 	if err != nil {
-		fatal(fmt.Errorf("Failed to create SHM file with error: %w", err))
+		return nil, fmt.Errorf("Failed to create SHM file with error: %w", err)
 	}
 	defer data_shm.Close()
 	defer data_shm.Unlink()
@@ -63,9 +51,11 @@ func RunSSHAskpass() {
 	shm.WriteWithSize(data_shm, data, 1)
 	err = data_shm.Flush()
 	if err != nil {
-		fatal(fmt.Errorf("Failed to flush SHM file with error: %w", err))
+		return nil, fmt.Errorf("Failed to flush SHM file with error: %w", err)
+	}
+	if err = trigger_ask(data_shm.Name()); err != nil {
+		return nil, err
 	}
-	trigger_ask(data_shm.Name())
 	for {
 		time.Sleep(50 * time.Millisecond)
 		if data_shm.Slice()[0] == 1 {
@@ -74,7 +64,50 @@ func RunSSHAskpass() {
 	}
 	data, err = shm.ReadWithSize(data_shm, 1)
 	if err != nil {
-		fatal(fmt.Errorf("Failed to read from SHM file with error: %w", err))
+		return nil, fmt.Errorf("Failed to read from SHM file with error: %w", err)
+	}
+	return data, nil
+}
+
+var otp_prompt_pat = utils.Once(func() *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(verification code|one[- ]time (password|code|pin)|\botp\b|\b2fa\b|two[- ]factor|authenticator|\btotp\b|passcode|token code)`)
+})
+
+// Whether the prompt is for a one time code from a second authentication
+// factor. Such codes are often pasted, so whitespace in them is ignored.
+func is_otp_prompt(msg string) bool {
+	return otp_prompt_pat().MatchString(msg)
+}
+
+// Remove whitespace from a pasted or typed one time code, such as a trailing
+// newline or the spaces used to group digits by authenticator apps
+func normalize_otp(code string) string {
+	return strings.Join(strings.Fields(code), "")
+}
+
+func RunSSHAskpass() {
+	msg := os.Args[len(os.Args)-1]
+	prompt := os.Getenv("SSH_ASKPASS_PROMPT")
+	is_confirm := prompt == "confirm"
+	q_type := "get_line"
+	if is_confirm {
+		q_type = "confirm"
+	}
+	is_fingerprint_check := strings.Contains(msg, "(yes/no/[fingerprint])")
+	is_otp := !is_confirm && !is_fingerprint_check && is_otp_prompt(msg)
+	q := map[string]any{
+		"message":     msg,
+		"type":        q_type,
+		"is_password": !is_fingerprint_check,
+	}
+	var host_key host_key_prompt
+	if is_fingerprint_check {
+		host_key = parse_host_key_prompt(msg)
+		q = host_key_question(host_key, known_host_keys(host_key.host, recorded_known_hosts_files()))
+	}
+	data, err := ask_via_kitty(q)
+	if err != nil {
+		fatal(err)
 	}
 	response := ""
 	if is_confirm {
@@ -92,11 +125,17 @@ func RunSSHAskpass() {
 		if err != nil {
 			fatal(fmt.Errorf("Failed to parse response data: %#v with error: %w", string(data), err))
 		}
+		if is_otp {
+			response = normalize_otp(response)
+		}
 		if is_fingerprint_check {
-			response = strings.ToLower(response)
-			if response == "y" {
+			switch response {
+			case "y":
+				response = "yes"
+			case "o":
 				response = "yes"
-			} else if response == "n" {
+				accept_host_key_once(host_key.host)
+			default:
 				response = "no"
 			}
 		}
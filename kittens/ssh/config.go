@@ -136,7 +136,9 @@ func ParseEnvInstruction(spec string) (ans []*EnvInstruction, err error) {
 
 var paths_ctx *paths.Ctx
 
-func resolve_file_spec(spec string, is_glob bool) ([]string, error) {
+// Returns the matching files and the directory relative to which they are
+// copied when the destination is a directory
+func resolve_file_spec(spec string, is_glob bool) ([]string, string, error) {
 	if paths_ctx == nil {
 		paths_ctx = &paths.Ctx{}
 	}
@@ -147,21 +149,22 @@ func resolve_file_spec(spec string, is_glob bool) ([]string, error) {
 	if is_glob {
 		files, err := doublestar.FilepathGlob(ans)
 		if err != nil {
-			return nil, fmt.Errorf("%s is not a valid glob pattern with error: %w", spec, err)
+			return nil, "", fmt.Errorf("%s is not a valid glob pattern with error: %w", spec, err)
 		}
 		if len(files) == 0 {
-			return nil, fmt.Errorf("%s matches no files", spec)
+			return nil, "", fmt.Errorf("%s matches no files", spec)
 		}
-		return files, nil
+		base, _ := doublestar.SplitPattern(filepath.ToSlash(ans))
+		return files, filepath.FromSlash(base), nil
 	}
 	err := unix.Access(ans, unix.R_OK)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("%s does not exist", spec)
+			return nil, "", fmt.Errorf("%s does not exist", spec)
 		}
-		return nil, fmt.Errorf("Cannot read from: %s with error: %w", spec, err)
+		return nil, "", fmt.Errorf("Cannot read from: %s with error: %w", spec, err)
 	}
-	return []string{ans}, nil
+	return []string{ans}, filepath.Dir(ans), nil
 }
 
 func get_arcname(loc, dest, home string) (arcname string) {
@@ -192,40 +195,79 @@ func ParseCopyInstruction(spec string) (ans []*CopyInstruction, err error) {
 	if err != nil {
 		return nil, err
 	}
-	locations := make([]string, 0, len(args))
+	type location struct{ path, base string }
+	locations := make([]location, 0, len(args))
+	seen_locations := utils.NewSet[string](len(args))
 	for _, arg := range args {
-		locs, err := resolve_file_spec(arg, opts.Glob)
+		locs, base, err := resolve_file_spec(arg, opts.Glob)
 		if err != nil {
 			return nil, err
 		}
-		locations = append(locations, locs...)
+		for _, loc := range locs {
+			if !seen_locations.Has(loc) && !(opts.Glob && is_excluded_match(loc, base, opts.Exclude)) {
+				seen_locations.Add(loc)
+				locations = append(locations, location{loc, base})
+			}
+		}
 	}
+	// patterns such as dir/** match both directories and the files in them,
+	// which are copied with the directories
+	locations = utils.Filter(locations, func(loc location) bool {
+		for q := filepath.Dir(loc.path); q != loc.base && len(q) > 1 && q != filepath.Dir(q); q = filepath.Dir(q) {
+			if seen_locations.Has(q) {
+				return false
+			}
+		}
+		return true
+	})
 	if len(locations) == 0 {
 		return nil, fmt.Errorf("No files to copy specified")
 	}
-	if len(locations) > 1 && opts.Dest != "" {
-		return nil, fmt.Errorf("Specifying a remote location with more than one file is not supported")
+	dest_is_dir := strings.HasSuffix(opts.Dest, "/")
+	if len(locations) > 1 && opts.Dest != "" && !dest_is_dir {
+		return nil, fmt.Errorf("Specifying a remote location with more than one file is only supported if the remote location ends with a /")
 	}
 	home := paths_ctx.HomePath()
 	ans = make([]*CopyInstruction, 0, len(locations))
 	for _, loc := range locations {
-		ci := CopyInstruction{local_path: loc, exclude_patterns: opts.Exclude}
+		ci := CopyInstruction{local_path: loc.path, exclude_patterns: opts.Exclude}
 		if opts.SymlinkStrategy != "preserve" {
-			ci.local_path, err = filepath.EvalSymlinks(loc)
+			ci.local_path, err = filepath.EvalSymlinks(loc.path)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to resolve symlinks in %#v with error: %w", loc, err)
+				return nil, fmt.Errorf("Failed to resolve symlinks in %#v with error: %w", loc.path, err)
 			}
 		}
+		dest := opts.Dest
+		if dest_is_dir {
+			rel, err := filepath.Rel(loc.base, loc.path)
+			if err != nil {
+				return nil, err
+			}
+			dest = path.Join(dest, filepath.ToSlash(rel))
+		}
 		if opts.SymlinkStrategy == "resolve" {
-			ci.arcname = get_arcname(ci.local_path, opts.Dest, home)
+			ci.arcname = get_arcname(ci.local_path, dest, home)
 		} else {
-			ci.arcname = get_arcname(loc, opts.Dest, home)
+			ci.arcname = get_arcname(loc.path, dest, home)
 		}
 		ans = append(ans, &ci)
 	}
 	return
 }
 
+// Whether a file matched by a glob pattern is excluded, either itself or because
+// one of its parent directories below base is excluded
+func is_excluded_match(loc, base string, exclude_patterns []string) bool {
+	for q := loc; q != base && len(q) > 1 && q != filepath.Dir(q); q = filepath.Dir(q) {
+		for _, pat := range exclude_patterns {
+			if excluded(pat, q) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type file_unique_id struct {
 	dev, inode uint64
 }
@@ -351,25 +393,38 @@ type ConfigSet struct {
 	all_configs []*Config
 }
 
+// Match using the same semantics as the Host directive in the OpenSSH config:
+// patterns are separated by whitespace or commas and a block matches if any of
+// its patterns match and none of its negated patterns, prefixed with !, match.
+// Hostnames are matched case-insensitively.
 func config_for_hostname(hostname_to_match, username_to_match string, cs *ConfigSet) *Config {
+	hostname_to_match = strings.ToLower(hostname_to_match)
 	matcher := func(q *Config) bool {
-		for _, pat := range strings.Split(q.Hostname, " ") {
+		matched := false
+		for _, pat := range strings.FieldsFunc(q.Hostname, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' }) {
+			negated := strings.HasPrefix(pat, "!")
+			if negated {
+				pat = pat[1:]
+			}
 			upat := "*"
 			if strings.Contains(pat, "@") {
 				upat, pat, _ = strings.Cut(pat, "@")
 			}
 			var host_matched, user_matched bool
-			if matched, err := filepath.Match(pat, hostname_to_match); matched && err == nil {
+			if matched, err := filepath.Match(strings.ToLower(pat), hostname_to_match); matched && err == nil {
 				host_matched = true
 			}
 			if matched, err := filepath.Match(upat, username_to_match); matched && err == nil {
 				user_matched = true
 			}
 			if host_matched && user_matched {
-				return true
+				if negated {
+					return false
+				}
+				matched = true
 			}
 		}
-		return false
+		return matched
 	}
 	for _, c := range utils.Reversed(cs.all_configs) {
 		if matcher(c) {
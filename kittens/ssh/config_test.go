@@ -3,13 +3,16 @@
 package ssh
 
 import (
+	"archive/tar"
 	"fmt"
 	"kitty/tools/utils"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/exp/slices"
 )
 
 var _ = fmt.Print
@@ -81,6 +84,18 @@ func TestSSHConfigParsing(t *testing.T) {
 	conf = "env a=b\nhostname 2\ncolor_scheme xyz"
 	hostname = "2"
 	rt()
+	for_python = false
+	conf = "env a=b\nhostname *.example.com,!bastion.example.com\nenv a=c"
+	hostname = "web.Example.com"
+	rt(`export 'a'="c"`)
+	hostname = "bastion.example.com"
+	rt(`export 'a'="b"`)
+	conf = "env a=b\nhostname * !root@*\nenv a=c"
+	hostname, username = "x", "kovid"
+	rt(`export 'a'="c"`)
+	username = "root"
+	rt(`export 'a'="b"`)
+	username = ""
 
 	ci, err := ParseCopyInstruction("--exclude moose --dest=target " + cf)
 	if err != nil {
@@ -111,3 +126,73 @@ func TestSSHConfigParsing(t *testing.T) {
 	}
 
 }
+
+func TestSSHCopyGlobs(t *testing.T) {
+	tdir := t.TempDir()
+	for _, x := range []string{"a/b/x.lua", "a/y.lua", "a/skip/z.lua", "a/w.txt"} {
+		q := filepath.Join(tdir, x)
+		os.MkdirAll(filepath.Dir(q), 0o755)
+		os.WriteFile(q, []byte(x), 0o644)
+	}
+	arcnames := func(spec string) []string {
+		ci, err := ParseCopyInstruction(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans := utils.Map(func(c *CopyInstruction) string { return c.arcname }, ci)
+		slices.Sort(ans)
+		return ans
+	}
+	pat := filepath.Join(tdir, "a", "**", "*.lua")
+	if diff := cmp.Diff([]string{"home/nvim/b/x.lua", "home/nvim/y.lua"}, arcnames("--dest=nvim/ --exclude skip --glob "+pat)); diff != "" {
+		t.Fatalf("Incorrect arcnames:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"home/nvim/a"}, arcnames("--dest=nvim/ --glob "+filepath.Join(tdir, "a*", "**"))); diff != "" {
+		t.Fatalf("Incorrect arcnames:\n%s", diff)
+	}
+	if _, err := ParseCopyInstruction("--dest=nvim --glob " + pat); err == nil {
+		t.Fatalf("No error for multiple files with a non-directory destination")
+	}
+
+	m := open_copy_manifest(filepath.Join(tdir, "manifest.json"))
+	sent := []string{}
+	add := m.filter(func(h *tar.Header, data []byte) error { sent = append(sent, h.Name); return nil })
+	now := time.Now()
+	send := func(size int64) []string {
+		sent = sent[:0]
+		add(&tar.Header{Typeflag: tar.TypeDir, Name: "d", ModTime: now}, nil)
+		add(&tar.Header{Typeflag: tar.TypeReg, Name: "d/f", Size: size, Mode: 0o644, ModTime: now}, nil)
+		return slices.Clone(sent)
+	}
+	if diff := cmp.Diff([]string{"d", "d/f"}, send(1)); diff != "" {
+		t.Fatalf("Incorrect files sent:\n%s", diff)
+	}
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+	m = open_copy_manifest(m.path)
+	add = m.filter(func(h *tar.Header, data []byte) error { sent = append(sent, h.Name); return nil })
+	if diff := cmp.Diff([]string{"d"}, send(1)); diff != "" {
+		t.Fatalf("Incorrect files sent:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"d", "d/f"}, send(2)); diff != "" {
+		t.Fatalf("Incorrect files sent:\n%s", diff)
+	}
+}
+
+func TestEffectiveSSHConfig(t *testing.T) {
+	tdir := t.TempDir()
+	os.WriteFile(filepath.Join(tdir, "included"), []byte("Match host *.example.com\n  User admin\n"), 0o600)
+	cfg := filepath.Join(tdir, "config")
+	os.WriteFile(cfg, []byte("Include "+filepath.Join(tdir, "incl*")+"\nMatch host special\n  User bob\n"), 0o600)
+	for dest, expected := range map[string]string{
+		"special": "bob", "web.example.com": "admin", "kovid@web.example.com": "kovid", "root@other": "root"} {
+		output := get_effective_ssh_config([]string{"-F", cfg}, dest)
+		if output == "" {
+			t.Skip("ssh -G not available")
+		}
+		if actual, _ := effective_ssh_config_value(output, "user"); actual != expected {
+			t.Fatalf("Unexpected user for %s: %#v", dest, actual)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/shm"
+)
+
+var _ = fmt.Print
+
+type copy_manifest_entry struct {
+	Size  int64 `json:"s"`
+	Mtime int64 `json:"m"`
+	Mode  int64 `json:"p"`
+}
+
+// A record of the files copied to a remote host, for copy_only_changed, so
+// that files that are unchanged since they were last sent are not sent again
+type copy_manifest struct {
+	path              string
+	previous, current map[string]copy_manifest_entry
+}
+
+// The name of the file in which state about the remote host is stored locally
+func host_state_filename(username, hostname, remote_dir string) string {
+	h := sha256.Sum256([]byte(username + "@" + hostname + "\x00" + remote_dir))
+	return hex.EncodeToString(h[:16])
+}
+
+func copy_manifest_path(username, hostname, remote_dir string) string {
+	return filepath.Join(utils.CacheDir(), "ssh-copy-manifests", host_state_filename(username, hostname, remote_dir)+".json")
+}
+
+func open_copy_manifest(path string) *copy_manifest {
+	ans := &copy_manifest{path: path, current: make(map[string]copy_manifest_entry)}
+	if raw, err := os.ReadFile(path); err == nil {
+		// a corrupted manifest only means all files are sent
+		_ = json.Unmarshal(raw, &ans.previous)
+	}
+	return ans
+}
+
+// Wrap the callback used to add copied files to the tarfile so that regular
+// files that are unchanged since they were last sent are skipped
+func (self *copy_manifest) filter(callback func(h *tar.Header, data []byte) error) func(h *tar.Header, data []byte) error {
+	return func(h *tar.Header, data []byte) error {
+		switch h.Typeflag {
+		case tar.TypeLink:
+			// the link target may have been skipped, hard links are always
+			// followed by the linked file as a regular file anyway
+			return nil
+		case tar.TypeReg:
+			e := copy_manifest_entry{Size: h.Size, Mtime: h.ModTime.UnixNano(), Mode: h.Mode}
+			self.current[h.Name] = e
+			if prev, found := self.previous[h.Name]; found && prev == e {
+				return nil
+			}
+		}
+		return callback(h, data)
+	}
+}
+
+func (self *copy_manifest) save() error {
+	data, err := json.Marshal(self.current)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(self.path), 0o700); err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(self.path, data, 0o600)
+}
+
+// kitty deletes the SHM file containing the data for the connection when it
+// sends the data to the remote host
+func data_was_sent(shm_name string) bool {
+	if shm_name == "" {
+		return false
+	}
+	m, err := shm.Open(shm_name, 0)
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	m.Close()
+	return false
+}
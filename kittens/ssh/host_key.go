@@ -0,0 +1,252 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The env var pointing to the temporary directory SSH adds the keys of newly
+// accepted hosts to. In it, the askpass records the hosts whose keys were
+// accepted only for the current connection and finds the known hosts files
+// of the user.
+const known_hosts_dir_env_var = "KITTY_SSH_KNOWN_HOSTS_DIR"
+
+type host_key_prompt struct {
+	host, key_type, fingerprint string
+	// the prompt without the trailing question
+	description string
+}
+
+var host_key_prompt_pats = utils.Once(func() [2]*regexp.Regexp {
+	return [2]*regexp.Regexp{
+		regexp.MustCompile(`The authenticity of host '([^' ]+)`),
+		regexp.MustCompile(`(\S+) key fingerprint is (SHA256:[A-Za-z0-9+/]+)`),
+	}
+})
+
+func parse_host_key_prompt(msg string) (ans host_key_prompt) {
+	pats := host_key_prompt_pats()
+	if m := pats[0].FindStringSubmatch(msg); m != nil {
+		ans.host = m[1]
+	}
+	if m := pats[1].FindStringSubmatch(msg); m != nil {
+		ans.key_type, ans.fingerprint = m[1], m[2]
+	}
+	lines := utils.Splitlines(strings.TrimRight(msg, "\n"))
+	if len(lines) > 1 && strings.Contains(lines[len(lines)-1], "(yes/no") {
+		lines = lines[:len(lines)-1]
+	}
+	ans.description = strings.Join(lines, "\n")
+	return
+}
+
+// The randomart visualization of a key fingerprint, as drawn by OpenSSH,
+// using the drunken bishop algorithm
+func randomart(digest []byte, title, footer string) string {
+	const width, height = 17, 9
+	const symbols = " .o+=*BOX@%&#/^SE"
+	var field [width][height]int
+	x, y := width/2, height/2
+	for _, b := range digest {
+		for i := 0; i < 4; i++ {
+			x = max(0, min(x+utils.IfElse(b&1 != 0, 1, -1), width-1))
+			y = max(0, min(y+utils.IfElse(b&2 != 0, 1, -1), height-1))
+			if field[x][y] < len(symbols)-3 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[width/2][height/2] = len(symbols) - 2
+	field[x][y] = len(symbols) - 1
+	border := func(text string) string {
+		if len(text) > width {
+			text = text[:width]
+		}
+		left := (width - len(text)) / 2
+		return "+" + strings.Repeat("-", left) + text + strings.Repeat("-", width-left-len(text)) + "+"
+	}
+	lines := make([]string, 0, height+2)
+	lines = append(lines, border(title))
+	for r := 0; r < height; r++ {
+		row := make([]byte, width)
+		for c := 0; c < width; c++ {
+			row[c] = symbols[field[c][r]]
+		}
+		lines = append(lines, "|"+string(row)+"|")
+	}
+	lines = append(lines, border(footer))
+	return strings.Join(lines, "\n")
+}
+
+type known_host_key struct {
+	key_type, fingerprint, location string
+}
+
+// Parse the output of ssh-keygen -F for the known hosts file path
+func parse_known_host_keys(output, path string) (ans []known_host_key) {
+	line_number := ""
+	for _, line := range utils.Splitlines(output) {
+		if strings.HasPrefix(line, "#") {
+			if _, num, found := strings.Cut(line, "found: line "); found {
+				line_number = strings.TrimSpace(num)
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			// a marker such as @revoked or @cert-authority
+			fields = fields[1:]
+		}
+		if len(fields) < 3 {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		digest := sha256.Sum256(blob)
+		loc := path
+		if line_number != "" {
+			loc += ":" + line_number
+		}
+		ans = append(ans, known_host_key{key_type: fields[1], fingerprint: "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:]), location: loc})
+	}
+	return
+}
+
+// The keys already known for host, in the known hosts files
+func known_host_keys(host string, known_hosts_files []string) (ans []known_host_key) {
+	for _, path := range known_hosts_files {
+		if out, err := exec.Command("ssh-keygen", "-F", host, "-f", path).Output(); err == nil {
+			ans = append(ans, parse_known_host_keys(utils.UnsafeBytesToString(out), path)...)
+		}
+	}
+	return
+}
+
+// The known keys of a host that conflict with its new key, as a diff. SSH
+// asks about new keys for hosts only when the known keys are of different
+// types, or are for a different name or address, it refuses to connect to a
+// host whose key of the same type has changed.
+func host_key_conflict(p host_key_prompt, known []known_host_key) string {
+	lines := []string{"Keys already known for this host:"}
+	for _, k := range known {
+		if k.fingerprint != p.fingerprint {
+			// the key type as SSH shows it, for example ED25519 for ssh-ed25519 and ECDSA for ecdsa-sha2-nistp256
+			key_type, _, _ := strings.Cut(strings.TrimPrefix(strings.ToUpper(k.key_type), "SSH-"), "-")
+			lines = append(lines, fmt.Sprintf("- %s %s (%s)", key_type, k.fingerprint, k.location))
+		}
+	}
+	if len(lines) == 1 {
+		return ""
+	}
+	return strings.Join(append(lines, fmt.Sprintf("+ %s %s", p.key_type, p.fingerprint)), "\n")
+}
+
+// The message and choices to show for the prompt to verify a host key
+func host_key_question(p host_key_prompt, known []known_host_key) map[string]any {
+	msg := p.description
+	if digest, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(p.fingerprint, "SHA256:")); err == nil && p.fingerprint != "" {
+		msg += "\n\n" + randomart(digest, "["+p.key_type+"]", "[SHA256]")
+	}
+	if conflict := host_key_conflict(p, known); conflict != "" {
+		msg += "\n\n" + conflict
+	}
+	return map[string]any{
+		"message": msg, "type": "choose", "default": "n",
+		"choices": []string{"y;green:Accept and remember", "o;yellow:Accept once", "n;red:Abort"},
+	}
+}
+
+// Record that the key of host was accepted only for the current connection
+func accept_host_key_once(host string) {
+	if dir := os.Getenv(known_hosts_dir_env_var); dir != "" && host != "" {
+		if f, err := os.OpenFile(filepath.Join(dir, "accepted_once"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err == nil {
+			fmt.Fprintln(f, host)
+			f.Close()
+		}
+	}
+}
+
+// The known hosts files of the user, as recorded in the temporary directory
+func recorded_known_hosts_files() []string {
+	if dir := os.Getenv(known_hosts_dir_env_var); dir != "" {
+		if raw, err := os.ReadFile(filepath.Join(dir, "user_files")); err == nil {
+			return utils.Splitlines(strings.TrimSpace(utils.UnsafeBytesToString(raw)))
+		}
+	}
+	return nil
+}
+
+// Create the temporary directory SSH adds the keys of newly accepted hosts
+// to and return the ssh arguments to use it. Keys are added to the first of
+// the UserKnownHostsFile files, so it is placed before the files of the
+// user, which are still used to verify keys. That way, keys accepted only
+// once are never added to the files of the user, even if the kitten is
+// killed before it can clean up.
+func use_temporary_known_hosts_file(known_hosts_files []string) (dir string, ssh_args []string, err error) {
+	if dir, err = os.MkdirTemp("", "kssh-known-hosts-"); err != nil {
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dir, "user_files"), []byte(strings.Join(known_hosts_files, "\n")), 0o600); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	quote := func(x string) string { return `"` + x + `"` }
+	files := utils.Map(quote, append([]string{filepath.Join(dir, "known_hosts")}, known_hosts_files...))
+	return dir, []string{"-o", "UserKnownHostsFile=" + strings.Join(files, " ")}, nil
+}
+
+// Add the keys of the hosts accepted during the connection, except the ones
+// accepted only once, to the known hosts file of the user and remove the
+// temporary directory
+func save_accepted_host_keys(dir, known_hosts_file string) {
+	defer os.RemoveAll(dir)
+	keys := filepath.Join(dir, "known_hosts")
+	if raw, err := os.ReadFile(filepath.Join(dir, "accepted_once")); err == nil {
+		seen := utils.NewSet[string]()
+		for _, host := range utils.Splitlines(utils.UnsafeBytesToString(raw)) {
+			if host = strings.TrimSpace(host); host != "" && !seen.Has(host) {
+				seen.Add(host)
+				_ = exec.Command("ssh-keygen", "-q", "-R", host, "-f", keys).Run()
+			}
+		}
+	}
+	raw, err := os.ReadFile(keys)
+	if err != nil || known_hosts_file == "" || len(bytes.TrimSpace(raw)) == 0 {
+		return
+	}
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		raw = append(raw, '\n')
+	}
+	if err = os.MkdirAll(filepath.Dir(known_hosts_file), 0o700); err == nil {
+		if f, err := os.OpenFile(known_hosts_file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err == nil {
+			f.Write(raw)
+			f.Close()
+		}
+	}
+}
+
+// The files SSH verifies the keys of hosts with and adds the keys of accepted
+// hosts to the first of, from the output of ssh -G
+func user_known_hosts_files(effective_config string) []string {
+	val, _ := effective_ssh_config_value(effective_config, "userknownhostsfile")
+	if val == "none" {
+		return nil
+	}
+	return utils.Map(utils.Expanduser, strings.Fields(val))
+}
@@ -119,7 +119,7 @@ func parse_kitten_args(found_extra_args []string, username, hostname_for_match s
 	return
 }
 
-func connection_sharing_args(kitty_pid int) ([]string, error) {
+func connection_sharing_args(kitty_pid int, timeout uint64) ([]string, error) {
 	rd := utils.RuntimeDir()
 	// Bloody OpenSSH generates a 40 char hash and in creating the socket
 	// appends a 27 char temp suffix to it. Socket max path length is approx
@@ -138,7 +138,7 @@ func connection_sharing_args(kitty_pid int) ([]string, error) {
 	return []string{
 		"-o", "ControlMaster=auto",
 		"-o", "ControlPath=" + filepath.Join(rd, cp),
-		"-o", "ControlPersist=yes",
+		"-o", "ControlPersist=" + utils.IfElse(timeout > 0, strconv.FormatUint(timeout, 10)+"s", "yes"),
 		"-o", "ServerAliveInterval=60",
 		"-o", "ServerAliveCountMax=5",
 		"-o", "TCPKeepAlive=no",
@@ -186,6 +186,23 @@ type connection_data struct {
 	replacements     map[string]string
 	request_id       string
 	bootstrap_script string
+	copy_manifest    *copy_manifest
+	// the kitty runtime files installed on the remote host, if nil, all the
+	// runtime files are always sent
+	payload *payload_record
+	// the message the bootstrap script sends to kitty, once it has installed
+	// the runtime files, to confirm their installation, by consuming the
+	// shared memory named payload_confirmation_shm_name
+	payload_confirmation, payload_confirmation_shm_name string
+	// the path, relative to the home directory on the remote host, to upload
+	// the data to via SFTP, if not sending it via the terminal
+	data_file string
+	tarfile   []byte
+	// the address of the forwarded remote control socket on the remote host
+	remote_listen_on string
+	// whether the remote host runs Windows, where the bootstrap script is run
+	// using PowerShell
+	is_windows bool
 }
 
 func get_effective_ksi_env_var(x string) string {
@@ -201,13 +218,15 @@ func get_effective_ksi_env_var(x string) string {
 	return x
 }
 
-func serialize_env(cd *connection_data, get_local_env func(string) (string, bool)) (string, string) {
-	ksi := ""
+func effective_ksi(cd *connection_data) string {
 	if cd.host_opts.Shell_integration == "inherited" {
-		ksi = get_effective_ksi_env_var(RelevantKittyOpts().Shell_integration)
-	} else {
-		ksi = get_effective_ksi_env_var(cd.host_opts.Shell_integration)
+		return get_effective_ksi_env_var(RelevantKittyOpts().Shell_integration)
 	}
+	return get_effective_ksi_env_var(cd.host_opts.Shell_integration)
+}
+
+func serialize_env(cd *connection_data, get_local_env func(string) (string, bool)) (string, string) {
+	ksi := effective_ksi(cd)
 	env := make([]*EnvInstruction, 0, 8)
 	add_env := func(key, val string, fallback ...string) *EnvInstruction {
 		if val == "" && len(fallback) > 0 {
@@ -242,15 +261,36 @@ func serialize_env(cd *connection_data, get_local_env func(string) (string, bool
 	add_non_literal_env("KITTY_SSH_KITTEN_DATA_DIR", cd.host_opts.Remote_dir)
 	add_non_literal_env("KITTY_LOGIN_SHELL", cd.host_opts.Login_shell)
 	add_non_literal_env("KITTY_LOGIN_CWD", cd.host_opts.Cwd)
+	add_env("KITTY_TERMINFO_FALLBACK", cd.host_opts.Terminfo_fallback)
 	if cd.host_opts.Remote_kitty != Remote_kitty_no {
 		add_env("KITTY_REMOTE", cd.host_opts.Remote_kitty.String())
 	}
 	add_env("KITTY_PUBLIC_KEY", os.Getenv("KITTY_PUBLIC_KEY"))
-	return final_env_instructions(cd.script_type == "py", get_local_env, env...), ksi
+	add_env("KITTY_LISTEN_ON", cd.remote_listen_on)
+	if cd.payload != nil {
+		add_env("KITTY_SSH_KITTEN_PAYLOAD_VERSION", cd.payload.base_version())
+		if !cd.payload.skipped() && cd.payload_confirmation != "" {
+			add_env("KITTY_SSH_KITTEN_PAYLOAD_SENT", payload_version(cd.payload.current))
+			add_env("KITTY_SSH_KITTEN_PAYLOAD_CONFIRMATION", cd.payload_confirmation)
+		}
+	}
+	// the PowerShell bootstrap script reads the same format as the Python one
+	return final_env_instructions(cd.script_type != "sh", get_local_env, env...), ksi
 }
 
 func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)) ([]byte, error) {
-	env_script, ksi := serialize_env(cd, get_local_env)
+	payload := runtime_payload(cd, effective_ksi(cd))
+	manifest := payload_manifest(payload)
+	version := payload_version(manifest)
+	// the runtime files are not usable on Windows, which has neither POSIX
+	// shells nor a terminfo database
+	include_payload := !cd.is_windows
+	var to_send *utils.Set[string]
+	if include_payload && cd.payload != nil {
+		to_send = cd.payload.files_to_send(manifest)
+		include_payload = !cd.payload.skipped()
+	}
+	env_script, _ := serialize_env(cd, get_local_env)
 	w := bytes.Buffer{}
 	w.Grow(64 * 1024)
 	gw, err := gzip.NewWriterLevel(&w, gzip.BestCompression)
@@ -276,8 +316,13 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 		}
 		return
 	}
+	add_copied := add
+	if cd.host_opts.Copy_only_changed && len(cd.host_opts.Copy) > 0 {
+		cd.copy_manifest = open_copy_manifest(copy_manifest_path(cd.username, cd.hostname_for_match, rd))
+		add_copied = cd.copy_manifest.filter(add)
+	}
 	for _, ci := range cd.host_opts.Copy {
-		err = ci.get_file_data(add, seen)
+		err = ci.get_file_data(add_copied, seen)
 		if err != nil {
 			return nil, err
 		}
@@ -319,36 +364,21 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 	if cd.script_type == "sh" {
 		add_data(fe{"bootstrap-utils.sh", shell_integration.Data()[path.Join("shell-integration/ssh/bootstrap-utils.sh")].Data})
 	}
-	if ksi != "" {
-		for _, fname := range shell_integration.Data().FilesMatching(
-			"shell-integration/",
-			"shell-integration/ssh/.+",        // bootstrap files are sent as command line args
-			"shell-integration/zsh/kitty.zsh", // backward compat file not needed by ssh kitten
-		) {
-			arcname := path.Join("home/", rd, "/", path.Dir(fname))
-			err = add_entries(arcname, shell_integration.Data()[fname])
-			if err != nil {
-				return nil, err
-			}
+	if include_payload {
+		arcname := path.Join("home/", rd)
+		err = add_data(fe{path.Join(arcname, payload_version_file), utils.UnsafeStringToBytes(version)})
+		if err == nil && cd.host_opts.Remote_kitty != Remote_kitty_no {
+			err = add_data(fe{path.Join(arcname, "kitty", "version"), utils.UnsafeStringToBytes(kitty.VersionString)})
 		}
-	}
-	if cd.host_opts.Remote_kitty != Remote_kitty_no {
-		arcname := path.Join("home/", rd, "/kitty")
-		err = add_data(fe{arcname + "/version", utils.UnsafeStringToBytes(kitty.VersionString)})
-		if err != nil {
-			return nil, err
-		}
-		for _, x := range []string{"kitty", "kitten"} {
-			err = add_entries(path.Join(arcname, "bin"), shell_integration.Data()[path.Join("shell-integration", "ssh", x)])
+		for _, item := range payload {
 			if err != nil {
-				return nil, err
+				break
+			}
+			if to_send == nil || to_send.Has(item.arcname) {
+				err = add_entries(path.Dir(item.arcname), item.entry)
 			}
 		}
 	}
-	err = add_entries(path.Join("home", ".terminfo"), shell_integration.Data()["terminfo/kitty.terminfo"])
-	if err == nil {
-		err = add_entries(path.Join("home", ".terminfo", "x"), shell_integration.Data()["terminfo/x/xterm-kitty"])
-	}
 	if err == nil {
 		err = tw.Close()
 		if err == nil {
@@ -359,7 +389,7 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 }
 
 func prepare_home_command(cd *connection_data) string {
-	is_python := cd.script_type == "py"
+	is_python := cd.script_type != "sh"
 	homevar := ""
 	for _, ei := range cd.host_opts.Env {
 		if ei.key == "HOME" && !ei.delete_on_remote {
@@ -385,7 +415,7 @@ func prepare_exec_cmd(cd *connection_data) string {
 	// ssh simply concatenates multiple commands using a space see
 	// line 1129 of ssh.c and on the remote side sshd.c runs the
 	// concatenated command as shell -c cmd
-	if cd.script_type == "py" {
+	if cd.script_type != "sh" {
 		return base64.RawStdEncoding.EncodeToString(utils.UnsafeStringToBytes(strings.Join(cd.remote_args, " ")))
 	}
 	args := make([]string, len(cd.remote_args))
@@ -425,10 +455,19 @@ func bootstrap_script(cd *connection_data) (err error) {
 	if err != nil {
 		return err
 	}
+	if cd.payload != nil && !cd.is_windows {
+		if err = create_payload_confirmation(cd, pw); err != nil {
+			return err
+		}
+	}
 	tfd, err := make_tarfile(cd, os.LookupEnv)
 	if err != nil {
 		return err
 	}
+	if cd.data_file != "" {
+		cd.tarfile = tfd
+		cd.dont_create_shm = true
+	}
 	data := map[string]string{
 		"tarfile":  base64.StdEncoding.EncodeToString(tfd),
 		"pw":       pw,
@@ -455,6 +494,10 @@ func bootstrap_script(cd *connection_data) (err error) {
 		"EXPORT_HOME_CMD": export_home_cmd,
 		"EXEC_CMD":        exec_cmd,
 		"TEST_SCRIPT":     cd.test_script,
+		"DATA_FILE":       cd.data_file,
+
+		"DATA_TRANSFER_FAILED_EXIT_CODE": strconv.Itoa(data_transfer_failed_exit_code),
+		"PAYLOAD_MISSING_EXIT_CODE":      strconv.Itoa(payload_missing_exit_code),
 	}
 	add_bool := func(ok bool, key string) {
 		if ok {
@@ -487,6 +530,10 @@ func wrap_bootstrap_script(cd *connection_data) {
 	// executing it.
 	encoded_script := ""
 	unwrap_script := ""
+	if cd.script_type == "ps1" {
+		cd.rcmd = powershell_bootstrap_command(cd.host_opts.Interpreter, cd.bootstrap_script)
+		return
+	}
 	if cd.script_type == "py" {
 		encoded_script = base64.StdEncoding.EncodeToString(utils.UnsafeStringToBytes(cd.bootstrap_script))
 		unwrap_script = `"import base64, sys; eval(compile(base64.standard_b64decode(sys.argv[-1]), 'bootstrap.py', 'exec'))"`
@@ -506,7 +553,9 @@ func get_remote_command(cd *connection_data) error {
 	q := strings.ToLower(path.Base(interpreter))
 	is_python := strings.Contains(q, "python")
 	cd.script_type = "sh"
-	if is_python {
+	if cd.is_windows {
+		cd.script_type = "ps1"
+	} else if is_python {
 		cd.script_type = "py"
 	}
 	err := bootstrap_script(cd)
@@ -587,12 +636,7 @@ func change_colors(color_scheme string) (ans string, err error) {
 func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err error) {
 	go shell_integration.Data()
 	go RelevantKittyOpts()
-	defer func() {
-		if data_shm != nil {
-			data_shm.Close()
-			data_shm.Unlink()
-		}
-	}()
+	defer release_data_shm()
 	cmd := append([]string{SSHExe()}, ssh_args...)
 	cd := connection_data{remote_args: server_args[1:]}
 	hostname := server_args[0]
@@ -602,6 +646,13 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 	insertion_point := len(cmd)
 	cmd = append(cmd, "--", hostname)
 	uname, hostname_for_match := get_destination(hostname)
+	effective_ssh_config := utils.Once(func() string { return get_effective_ssh_config(ssh_args, hostname) })
+	// use the user OpenSSH will login as, which can come from the command line
+	// or from User in the OpenSSH config, including in Match blocks and
+	// included files, as evaluated by OpenSSH itself
+	if u, found := effective_ssh_config_value(effective_ssh_config(), "user"); found && u != "" {
+		uname = u
+	}
 	overrides, literal_env, err := parse_kitten_args(found_extra_args, uname, hostname_for_match)
 	if err != nil {
 		return 1, err
@@ -622,23 +673,80 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 		}
 		return 1, unix.Exec(utils.FindExe(delegate_cmd[0]), utils.Concat(delegate_cmd, ssh_args, server_args), os.Environ())
 	}
-	if host_opts.Share_connections {
+	if len(cd.remote_args) == 0 {
+		// reattach to the same session when reconnecting
+		cd.remote_args = session_manager_command(host_opts.Reconnect, "kitty-"+os.Getenv("KITTY_PID")+"-"+os.Getenv("KITTY_WINDOW_ID"))
+	}
+	agent_socket := ""
+	if host_opts.Forward_agent_confirm {
+		agent_socket = forwarded_agent_socket(effective_ssh_config())
+	}
+	use_kitty_askpass := host_opts.Askpass == Askpass_native || (host_opts.Askpass == Askpass_unless_set && os.Getenv("SSH_ASKPASS") == "")
+	var known_hosts_args []string
+	if known_hosts_files := user_known_hosts_files(effective_ssh_config()); use_kitty_askpass && len(known_hosts_files) > 0 {
+		if dir, args, err := use_temporary_known_hosts_file(known_hosts_files); err == nil {
+			os.Setenv(known_hosts_dir_env_var, dir)
+			defer save_accepted_host_keys(dir, known_hosts_files[0])
+			known_hosts_args = args
+			cmd = slices.Insert(cmd, insertion_point, known_hosts_args...)
+		}
+	}
+	// the agent forwarded by a shared connection is the agent of the session
+	// that established it, so such connections cannot be shared
+	if host_opts.Share_connections && agent_socket == "" {
 		kpid, err := strconv.Atoi(os.Getenv("KITTY_PID"))
 		if err != nil {
 			return 1, fmt.Errorf("Invalid KITTY_PID env var not an integer: %#v", os.Getenv("KITTY_PID"))
 		}
-		cpargs, err := connection_sharing_args(kpid)
+		cpargs, err := connection_sharing_args(kpid, host_opts.Share_connections_timeout)
 		if err != nil {
 			return 1, err
 		}
+		if pc := parse_proxy_config(effective_ssh_config()); len(pc.jump_hosts) > 0 && pc.proxy_command == "" {
+			// connect through the jump hosts using a shared connection as well
+			proxy := proxy_command_for_jump_hosts(pc.jump_hosts, utils.Concat(cpargs, known_hosts_args), config_file_from_args(ssh_args))
+			new_args := without_jump_args(ssh_args)
+			cmd = utils.Concat([]string{SSHExe(), "-o", "ProxyCommand=" + proxy}, new_args, cmd[1+len(ssh_args):])
+			insertion_point += 2 + len(new_args) - len(ssh_args)
+		}
 		cmd = slices.Insert(cmd, insertion_point, cpargs...)
 	}
-	use_kitty_askpass := host_opts.Askpass == Askpass_native || (host_opts.Askpass == Askpass_unless_set && os.Getenv("SSH_ASKPASS") == "")
+	if host_opts.Forward_remote_control {
+		rc_args, remote_listen_on, err := remote_control_forwarding(os.Getenv("KITTY_LISTEN_ON"), RelevantKittyOpts())
+		if err != nil {
+			return 1, err
+		}
+		cd.remote_listen_on = remote_listen_on
+		cmd = slices.Insert(cmd, insertion_point, rc_args...)
+	}
+	if agent_socket != "" {
+		if !GetSSHVersion().SupportsForwardAgentSocket() {
+			return 1, fmt.Errorf("The installed version of OpenSSH is too old to confirm uses of the forwarded SSH agent, at least version 8.2 is needed")
+		}
+		agent, err := start_confirming_agent(agent_socket, hostname_for_match)
+		if err != nil {
+			return 1, err
+		}
+		defer agent.close()
+		cmd = slices.Insert(cmd, insertion_point, "-o", "ForwardAgent="+agent.socket_path)
+	}
 	need_to_request_data := true
 	if use_kitty_askpass {
 		need_to_request_data = set_askpass()
 	}
-	if need_to_request_data && host_opts.Share_connections {
+	switch host_opts.Remote_os {
+	case Remote_os_windows:
+		cd.is_windows = true
+	case Remote_os_auto:
+		cd.is_windows = detect_windows(cmd, remote_os_record_path(uname, hostname_for_match))
+	}
+	if cd.is_windows && host_opts.Sftp_bootstrap == Sftp_bootstrap_no {
+		return 1, fmt.Errorf("Connecting to Windows hosts requires sending data via SFTP, set sftp_bootstrap to yes or if-needed")
+	}
+	// a shared connection is lost along with the session, so reconnecting
+	// cannot rely on it
+	need_to_request_data_on_reconnect := need_to_request_data
+	if need_to_request_data && host_opts.Share_connections && agent_socket == "" {
 		check_cmd := slices.Insert(cmd, 1, "-O", "check")
 		err = exec.Command(check_cmd[0], check_cmd[1:]...).Run()
 		if err == nil {
@@ -653,6 +761,7 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 	cd.host_opts, cd.literal_env = host_opts, literal_env
 	cd.request_data = need_to_request_data
 	cd.hostname_for_match, cd.username = hostname_for_match, uname
+	cd.payload = open_payload_record(payload_record_path(uname, hostname_for_match, strings.TrimRight(host_opts.Remote_dir, "/")))
 	escape_codes_to_set_colors, err := change_colors(cd.host_opts.Color_scheme)
 	if err == nil {
 		err = term.WriteAllString(escape_codes_to_set_colors + loop.SAVE_PRIVATE_MODE_VALUES + loop.HANDLE_TERMIOS_SIGNALS.EscapeCodeToSet())
@@ -668,11 +777,115 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 		term.WriteAllString(restore_escape_codes)
 		term.RestoreAndClose()
 	}()
-	err = get_remote_command(&cd)
+	// the bootstrap script for Windows cannot read data from the terminal
+	if cd.host_opts.Sftp_bootstrap == Sftp_bootstrap_yes || cd.is_windows {
+		if err = use_sftp_for_data(&cd); err != nil {
+			return 1, err
+		}
+	}
+	established, failures := false, 0
+	for {
+		started_at := time.Now()
+		rc, err = run_remote_command(&cd, cmd, term)
+		if err == nil && rc == data_transfer_failed_exit_code && cd.data_file == "" && cd.host_opts.Sftp_bootstrap == Sftp_bootstrap_if_needed {
+			fmt.Fprintln(os.Stderr, "Sending data to the remote host via the terminal failed, retrying via SFTP")
+			release_data_shm()
+			if err = use_sftp_for_data(&cd); err != nil {
+				return 1, err
+			}
+			rc, err = run_remote_command(&cd, cmd, term)
+		}
+		if err == nil && rc == payload_missing_exit_code && cd.payload != nil && cd.payload.base_version() != "" {
+			// the runtime files were removed from the remote host, send all
+			// of them again
+			cd.payload.forget()
+			release_data_shm()
+			cd.request_data = need_to_request_data_on_reconnect && cd.data_file == ""
+			rc, err = run_remote_command(&cd, cmd, term)
+		}
+		if time.Since(started_at) >= min_session_duration {
+			established, failures = true, 0
+		} else {
+			failures++
+		}
+		if err != nil || rc != ssh_connection_error_exit_code || cd.host_opts.Reconnect == Reconnect_no || !established || failures > max_reconnect_attempts {
+			return
+		}
+		// the remote programs might have left the terminal in some non-default state
+		term.WriteAllString(loop.RESTORE_PRIVATE_MODE_VALUES + loop.SAVE_PRIVATE_MODE_VALUES + loop.HANDLE_TERMIOS_SIGNALS.EscapeCodeToSet())
+		if !wait_to_reconnect(hostname_for_match, reconnect_delay(failures)) {
+			return
+		}
+		release_data_shm()
+		cd.request_data = need_to_request_data_on_reconnect && cd.data_file == ""
+	}
+}
+
+func release_data_shm() {
+	if data_shm != nil {
+		data_shm.Close()
+		data_shm.Unlink()
+		data_shm = nil
+	}
+	if payload_confirmation_shm != nil {
+		payload_confirmation_shm.Close()
+		payload_confirmation_shm.Unlink()
+		payload_confirmation_shm = nil
+	}
+}
+
+var payload_confirmation_shm shm.MMap
+
+// Create the shared memory that kitty consumes when the bootstrap script
+// confirms that it installed the kitty runtime files, so that they are
+// recorded as installed only when they actually are
+func create_payload_confirmation(cd *connection_data, pw string) (err error) {
+	if payload_confirmation_shm != nil {
+		payload_confirmation_shm.Close()
+		payload_confirmation_shm.Unlink()
+	}
+	encoded_data, _ := json.Marshal(map[string]string{"pw": pw})
+	if payload_confirmation_shm, err = shm.CreateTemp(fmt.Sprintf("kssh-%d-", os.Getpid()), uint64(len(encoded_data)+8)); err != nil {
+		return err
+	}
+	if err = shm.WriteWithSize(payload_confirmation_shm, encoded_data, 0); err == nil {
+		err = payload_confirmation_shm.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	cd.payload_confirmation_shm_name = payload_confirmation_shm.Name()
+	cd.payload_confirmation = fmt.Sprintf("id=%s:pwfile=%s:pw=%s:installed=1", cd.request_id, cd.payload_confirmation_shm_name, pw)
+	return nil
+}
+
+// The exit code of the bootstrap script when it does not receive the data
+// sent to it via the terminal
+const data_transfer_failed_exit_code = 86
+
+// Send the data to the remote host by uploading it via SFTP instead of via the
+// terminal
+func use_sftp_for_data(cd *connection_data) error {
+	suffix, err := secrets.TokenHex(8)
+	if err != nil {
+		return err
+	}
+	cd.data_file = ".kitty-ssh-kitten-data-" + suffix + ".tar.gz"
+	cd.request_data, cd.shm_name = false, ""
+	return nil
+}
+
+func run_remote_command(cd *connection_data, cmd []string, term *tty.Term) (rc int, err error) {
+	err = get_remote_command(cd)
 	if err != nil {
 		return 1, err
 	}
-	cmd = append(cmd, cd.rcmd...)
+	if cd.data_file != "" {
+		if err = upload_via_sftp(cmd, cd.data_file, cd.tarfile); err != nil {
+			return 1, fmt.Errorf("Failed to upload data to the remote host via SFTP with error: %w", err)
+		}
+	}
+	cmd = utils.Concat(cmd, cd.rcmd)
 	c := exec.Command(cmd[0], cmd[1:]...)
 	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
 	err = c.Start()
@@ -682,7 +895,7 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 	sigs := make(chan os.Signal, 8)
 	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
 
-	if !cd.request_data {
+	if !cd.request_data && cd.data_file == "" {
 		rq := fmt.Sprintf("id=%s:pwfile=%s:pw=%s", cd.replacements["REQUEST_ID"], cd.replacements["PASSWORD_FILENAME"], cd.replacements["DATA_PASSWORD"])
 		err := term.ApplyOperations(tty.TCSANOW, tty.SetNoEcho)
 		if err == nil {
@@ -705,6 +918,17 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 	}()
 	err = c.Wait()
 	drain_potential_tty_garbage(term)
+	if cd.copy_manifest != nil && (cd.data_file != "" || data_was_sent(cd.shm_name)) {
+		// the manifest is only updated when the files were actually sent
+		_ = cd.copy_manifest.save()
+	}
+	if cd.payload != nil && data_was_sent(cd.payload_confirmation_shm_name) {
+		// the runtime files are recorded as installed only once the remote
+		// host has confirmed installing them, hosts where they cannot be
+		// installed, for instance, because the home directory is read-only,
+		// always get all of them
+		_ = cd.payload.save()
+	}
 	signal.Reset(unix.SIGINT, unix.SIGTERM)
 	if err != nil {
 		var exit_err *exec.ExitError
@@ -29,13 +29,19 @@ def option_text() -> str:
 relative to HOME on the remote host. When this option is not specified, the
 local file path is used as the remote destination (with the HOME directory
 getting automatically replaced by the remote HOME). Note that environment
-variables and ~ are not expanded.
+variables and ~ are not expanded. If the destination ends with a :code:`/` it
+is a directory into which the files are copied. When copying the files
+matching a glob pattern into a directory, their paths relative to the leading
+part of the pattern that has no wildcards are preserved, so that, for
+example, :code:`--dest=nvim/ --glob .config/nvim/**/*.lua` copies
+:file:`.config/nvim/lua/init.lua` to :file:`nvim/lua/init.lua`.
 
 
 --exclude
 type=list
 A glob pattern. Files with names matching this pattern are excluded from being
-transferred. Only used when copying directories. Can
+transferred. Only used when copying directories or the files matching a
+:code:`--glob` pattern. Can
 be specified multiple times, if any of the patterns match the file will be
 excluded. If the pattern includes a :code:`/` then it will match against the full
 path, not just the filename. In such patterns you can use :code:`/**/` to match zero
@@ -72,10 +78,20 @@ def option_text() -> str:
 opt('hostname', '*', long_text='''
 The hostname that the following options apply to. A glob pattern to match
 multiple hosts can be used. Multiple hostnames can also be specified, separated
-by spaces. The hostname can include an optional username in the form
-:code:`user@host`. When not specified options apply to all hosts, until the
+by spaces or commas. The hostname can include an optional username in the form
+:code:`user@host`. As with the :code:`Host` directive in the OpenSSH config, a
+pattern prefixed with :code:`!` negates the match, so that, for example,
+:code:`hostname *.example.com !bastion.example.com` applies to all hosts in
+:code:`example.com` except :code:`bastion`, and hostnames are matched
+case-insensitively. This allows different groups of hosts to use, for example,
+different :opt:`env <kitten-ssh.env>`, :opt:`shell_integration
+<kitten-ssh.shell_integration>` and :opt:`copy <kitten-ssh.copy>` settings from
+a single config file. When not specified options apply to all hosts, until the
 first hostname specification is found. Note that matching of hostname is done
 against the name you specify on the command line to connect to the remote host.
+The username is matched against the user SSH will login as, which is determined
+by OpenSSH itself, so that a :code:`User` set in the OpenSSH config, including
+inside :code:`Match` blocks and :code:`Include` files, is respected.
 If you wish to include the same basic configuration for many different hosts,
 you can do so with the :ref:`include <include>` directive. In version 0.28.0
 the behavior of this option was changed slightly, now, when a hostname is encountered
@@ -87,7 +103,25 @@ def option_text() -> str:
 opt('interpreter', 'sh', long_text='''
 The interpreter to use on the remote host. Must be either a POSIX complaint
 shell or a :program:`python` executable. If the default :program:`sh` is not
-available or broken, using an alternate interpreter can be useful.
+available or broken, using an alternate interpreter can be useful. For Windows
+hosts, it must be :program:`powershell` or :program:`pwsh`, other values are
+replaced by :program:`powershell`.
+''')
+
+opt('remote_os', 'unix', choices=('unix', 'windows', 'auto'), long_text='''
+The operating system of the remote host. Set it to :code:`windows` in the
+:code:`hostname` section for Windows hosts. A value of :code:`auto` means
+detect it by running a command on the remote host the first time the kitten
+connects to it, remembering the result for later connections. Note that this
+needs an extra connection to the host, which can mean an extra password or host
+key prompt. On Windows hosts, running the Windows OpenSSH server, the bootstrap script is run with
+PowerShell and the data is always sent via SFTP, see :opt:`sftp_bootstrap
+<kitten-ssh.sftp_bootstrap>`. As Windows has no terminfo database, the
+:envvar:`TERM` environment variable is set to the value of :opt:`terminfo_fallback
+<kitten-ssh.terminfo_fallback>` there. Shell integration and :opt:`remote_kitty
+<kitten-ssh.remote_kitty>` are not supported on Windows, to use kittens such as
+the :doc:`transfer kitten </kittens/transfer>`, install the kitten binary on the
+Windows host manually.
 ''')
 
 opt('remote_dir', '.local/share/kitty-ssh-kitten', long_text='''
@@ -95,6 +129,15 @@ def option_text() -> str:
 installed. Relative paths are resolved with respect to :code:`$HOME`.
 ''')
 
+opt('terminfo_fallback', 'xterm-256color', long_text='''
+The value of the :envvar:`TERM` environment variable to use on the remote host
+if kitty's terminfo database entry cannot be installed there, for example,
+because the home directory is read-only or the :program:`tic` program fails.
+Since the :envvar:`COLORTERM` environment variable is still set, programs can
+continue to use true colors. Set to the empty string to instead fail with an
+error if the terminfo cannot be installed.
+''')
+
 opt('+copy', '', add_to_default=False, ctype='CopyInstruction', long_text=f'''
 {copy_message} For example::
 
@@ -115,6 +158,26 @@ def option_text() -> str:
 Files whose remote name matches the exclude pattern will not be copied.
 For more details, see :ref:`ssh_copy_command`.
 ''')
+
+opt('copy_only_changed', 'no', option_type='to_bool', long_text='''
+Only send the files specified with :opt:`copy <kitten-ssh.copy>` that have
+changed since they were last sent to the remote host. kitty remembers the size,
+modification time and permissions of the files it sent to each host, so files
+that are deleted or modified on the remote host are not sent again, unless
+they have changed locally as well. To send all files again, use
+:code:`kitten ssh --kitten copy_only_changed=no ...`.
+''')
+
+opt('sftp_bootstrap', 'if-needed', choices=('if-needed', 'no', 'yes'), long_text='''
+Send the data needed to setup the remote host, such as the shell integration
+scripts and the files specified with :opt:`copy <kitten-ssh.copy>`, by
+uploading it with the SFTP subsystem of the SSH server instead of via the
+terminal. The default of :code:`if-needed` means only do so if sending the data
+via the terminal fails, for example, because the server filters or limits the
+input to the session. The data is uploaded to a temporary file in the home
+directory of the remote user, which is deleted once it is read. Requires the
+SSH server to have SFTP enabled.
+''')
 egr()  # }}}
 
 agr('shell', 'Login shell environment')  # {{{
@@ -186,7 +249,22 @@ def option_text() -> str:
 you have to enter the password only once. Under the hood, it uses SSH
 ControlMasters and these are automatically cleaned up by kitty when it quits.
 You can map a shortcut to :ac:`close_shared_ssh_connections` to disconnect all
-active shared connections.
+active shared connections. When connecting through jump hosts, specified with
+:code:`ProxyJump` either on the command line or in the SSH config, the
+connection to the last jump host is shared as well, even between sessions to
+different servers behind it. A :code:`ProxyCommand` is used as is. The
+:doc:`transfer kitten </kittens/transfer>` needs no connection of its own, as it
+sends files over the terminal of a session, which uses the shared connection.
+Opening remote files by clicking hyperlinks to them re-uses the shared
+connection of the session in the window.
+''')
+
+opt('share_connections_timeout', '0', option_type='positive_int', long_text='''
+The number of seconds a shared connection is kept open after the last session
+using it has ended, so that it can be re-used by later sessions to the same
+server, including sessions started in other windows. The default of zero means
+shared connections are kept open till kitty quits. Only applies when
+:opt:`share_connections <kitten-ssh.share_connections>` is enabled.
 ''')
 
 opt('askpass', 'unless-set', choices=('unless-set', 'ssh', 'native'), long_text='''
@@ -199,7 +277,61 @@ def option_text() -> str:
 using the kitty askpass implementation means that SSH might need to use the
 terminal before the connection is established, so the kitten cannot use the
 terminal to send data without an extra roundtrip, adding to initial connection
-latency.
+latency. With the native implementation, whitespace in one time codes from a
+second authentication factor is ignored, so that they can be pasted as is. The
+codes are hidden as they are typed, like passwords. When connecting to a host
+whose key is not yet known, the native implementation shows the SHA256
+fingerprint of the key along with its randomart visualization and allows
+accepting the key permanently, accepting it only for the current connection or
+aborting the connection. Any other keys already known for the host, which
+conflict with the new key, are shown as well. The keys of accepted hosts are
+added to the known hosts file when the connection ends, so that keys accepted
+only for the current connection are never trusted permanently.
+''')
+
+opt('forward_agent_confirm', 'no', option_type='to_bool', long_text='''
+When forwarding of the SSH agent to the remote host is enabled, for example,
+with :code:`ssh -A` or :code:`ForwardAgent` in the SSH config, ask for
+confirmation in the kitty window whenever the remote host wants to use the
+forwarded agent to sign something, such as when logging in to another server
+from the remote host. The prompt names the remote host and the key to be
+used, so that a compromised remote host cannot silently use your keys. Requires
+OpenSSH 8.2 or newer. Connections with this enabled are not shared, regardless
+of :opt:`share_connections <kitten-ssh.share_connections>`, as the agent
+forwarded by a shared connection is the one from the session that first
+established it.
+''')
+
+opt('reconnect', 'no', choices=('no', 'yes', 'tmux', 'screen', 'shpool'), long_text='''
+Automatically reconnect to the remote host when the connection is lost
+unexpectedly, for example, because of a flaky network. Reconnection is
+attempted repeatedly, with increasing delays between attempts, and the remote
+host is setup again for every new connection. Reconnecting can be aborted by
+pressing :kbd:`Ctrl+C` while waiting for the next attempt. Note that a new
+login session is started on the remote host, so any programs running in the
+lost session are lost too, unless a session manager is used. Setting this to
+:code:`tmux`, :code:`screen` or :code:`shpool` runs that session manager on
+the remote host, in a session named after the kitty window, and reattaches to
+it when reconnecting, so that work is not lost. A session manager is only used
+when no command to run on the remote host is specified. The command line flag
+:code:`--reconnect` is a shortcut for :code:`--kitten reconnect=yes` and
+:code:`--reconnect=tmux` for :code:`--kitten reconnect=tmux`.
+''')
+
+opt('forward_remote_control', 'no', option_type='to_bool', long_text='''
+Forward the socket kitty listens on for :doc:`remote control </remote-control>`
+to the remote host, so that scripts running there can control the local kitty
+with :program:`kitten @`, even when not running in the kitty window. The
+socket is forwarded to a UNIX socket on the remote host that is accessible
+only to the remote user and :envvar:`KITTY_LISTEN_ON` is set to point to it.
+This requires kitty to :opt:`listen on <listen_on>` a UNIX socket on the
+filesystem or a TCP socket. As anything running on the remote host as the
+remote user can use the socket, :opt:`remote_control_password` must be set and
+:opt:`allow_remote_control` must be set to :code:`password` in
+:file:`kitty.conf`, so that only requests with a password are accepted and the
+remote host can perform only the actions allowed for that password. Use the
+:option:`kitty @ --password-env` or :option:`kitty @ --password-file`
+options on the remote host to provide the password.
 ''')
 
 opt('delegate', '', long_text='''
@@ -3,19 +3,31 @@
 package ssh
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
+	"kitty/tools/rsync"
+	"kitty/tools/utils"
 	"kitty/tools/utils/shm"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
@@ -153,3 +165,474 @@ func TestSSHTarfile(t *testing.T) {
 		t.Fatalf("Contents of shell-integration/ssh not excluded")
 	}
 }
+
+func TestConnectionSharingArgs(t *testing.T) {
+	for timeout, expected := range map[uint64]string{0: "ControlPersist=yes", 300: "ControlPersist=300s"} {
+		args, err := connection_sharing_args(1234, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx := slices.Index(args, expected)
+		if idx < 1 || args[idx-1] != "-o" {
+			t.Fatalf("%#v not found in connection sharing args: %#v", expected, args)
+		}
+	}
+}
+
+func TestProxyJump(t *testing.T) {
+	pc := parse_proxy_config("user kovid\nproxyjump a@j1,j2:2222\nport 22\n")
+	if diff := cmp.Diff([]string{"a@j1", "j2:2222"}, pc.jump_hosts); diff != "" || pc.proxy_command != "" {
+		t.Fatalf("Failed to parse jump hosts: %s", diff)
+	}
+	if pc = parse_proxy_config("proxyjump none\nproxycommand nc %h %p\n"); pc.jump_hosts != nil || pc.proxy_command != "nc %h %p" {
+		t.Fatalf("Failed to parse proxy config: %#v", pc)
+	}
+	for spec, expected := range map[string][]string{
+		"j":              {"--", "j"},
+		"u@j:23":         {"-l", "u", "-p", "23", "--", "j"},
+		"[::1]:23":       {"-p", "23", "--", "::1"},
+		"::1":            {"--", "::1"},
+		"ssh://u@j:23":   {"ssh://u@j:23"},
+		"u@[fe80::1]":    {"-l", "u", "--", "fe80::1"},
+		"u@j":            {"-l", "u", "--", "j"},
+		"j:2222":         {"-p", "2222", "--", "j"},
+		"user@host:2222": {"-l", "user", "-p", "2222", "--", "host"},
+	} {
+		if diff := cmp.Diff(expected, jump_host_args(spec)); diff != "" {
+			t.Fatalf("Unexpected args for jump host: %s\n%s", spec, diff)
+		}
+	}
+	cmd := proxy_command_for_jump_hosts([]string{"j1", "u@j2"}, []string{"-o", "ControlPath=/x/%C"}, "/cfg")
+	expected := fmt.Sprintf("'%s' '-F' '/cfg' '-o' 'ControlPath=/x/%%%%C' '-J' 'j1' '-W' '[%%h]:%%p' '-l' 'u' '--' 'j2'", SSHExe())
+	if cmd != expected {
+		t.Fatalf("Unexpected proxy command:\n%s\n%s", expected, cmd)
+	}
+	if diff := cmp.Diff([]string{"-4", "-p", "22", "-o", "User=x"}, without_jump_args([]string{"-4", "-J", "j", "-p", "22", "-o", "ProxyJump=j", "-o", "User=x"})); diff != "" {
+		t.Fatalf("Jump args not removed: %s", diff)
+	}
+}
+
+func TestAskpassOTP(t *testing.T) {
+	for msg, expected := range map[string]bool{
+		"Verification code: ": true,
+		"(kovid@host) One-time password (OATH) for `kovid': ":          true,
+		"Enter passphrase for key '/home/kovid/.ssh/id_ed25519': ":     false,
+		"kovid@host's password: ":                                      false,
+		"Duo two-factor login for kovid\n\nPasscode or option (1-2): ": true,
+	} {
+		if actual := is_otp_prompt(msg); actual != expected {
+			t.Fatalf("Unexpected result for %#v: %v", msg, actual)
+		}
+	}
+	if actual := normalize_otp(" 123 456\r\n"); actual != "123456" {
+		t.Fatalf("Unexpected normalized OTP: %#v", actual)
+	}
+}
+
+func TestSFTPUpload(t *testing.T) {
+	if diff := cmp.Diff([]string{"ssh", "-p", "22", "-T", "-s", "--", "host", "sftp"}, sftp_command([]string{"ssh", "-p", "22", "-t", "--", "host"})); diff != "" {
+		t.Fatalf("Incorrect sftp command: %s", diff)
+	}
+	client_r, server_w := io.Pipe()
+	server_r, client_w := io.Pipe()
+	received := map[string][]byte{}
+	go func() {
+		// a fake SFTP server that keeps all files in memory
+		defer server_w.Close()
+		server := sftp_client{w: server_w, r: bufio.NewReader(server_r)}
+		handles := map[string]string{}
+		for {
+			ptype, payload, err := server.read_packet()
+			if err != nil {
+				return
+			}
+			if ptype == sftp_init {
+				server.send(sftp_version, sftp_packet{}.add_uint32(3))
+				continue
+			}
+			id, payload := payload[:4], payload[4:]
+			status := func(code uint32) {
+				server.send(sftp_status, sftp_packet(id).add_uint32(code).add_string(nil).add_string(nil))
+			}
+			switch ptype {
+			case sftp_open:
+				name, _, _ := read_ssh_string(payload)
+				handles["h"] = string(name)
+				received[string(name)] = nil
+				server.send(sftp_handle, sftp_packet(id).add_string([]byte("h")))
+			case sftp_write:
+				h, rest, _ := read_ssh_string(payload)
+				offset := binary.BigEndian.Uint64(rest)
+				data, _, _ := read_ssh_string(rest[8:])
+				name := handles[string(h)]
+				if uint64(len(received[name])) != offset {
+					status(4)
+					continue
+				}
+				received[name] = append(received[name], data...)
+				status(0)
+			case sftp_close:
+				status(0)
+			default:
+				status(8)
+			}
+		}
+	}()
+	data := make([]byte, 3*sftp_max_write_size+17)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	client := sftp_client{w: client_w, r: bufio.NewReader(client_r)}
+	if err := client.upload("some/file", data); err != nil {
+		t.Fatal(err)
+	}
+	client_w.Close()
+	if diff := cmp.Diff(map[string][]byte{"some/file": data}, received); diff != "" {
+		t.Fatalf("Incorrect data received: %s", diff)
+	}
+}
+
+func TestConfirmingAgent(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/the/agent")
+	for output, expected := range map[string]string{
+		"user x\nforwardagent no\n":     "",
+		"user x\nforwardagent yes\n":    "/the/agent",
+		"forwardagent $SSH_AUTH_SOCK\n": "/the/agent",
+		"user x\n":                      "",
+	} {
+		if actual := forwarded_agent_socket(output); actual != expected {
+			t.Fatalf("Unexpected forwarded agent socket for %#v: %#v", output, actual)
+		}
+	}
+	upstream_path := filepath.Join(t.TempDir(), "upstream.sock")
+	l, err := net.Listen("unix", upstream_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// a fake agent that responds to every request with the request type plus one
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					msg, err := read_agent_message(conn)
+					if err != nil {
+						return
+					}
+					write_agent_message(conn, []byte{msg[0] + 1})
+				}
+			}()
+		}
+	}()
+	agent, err := start_confirming_agent(upstream_path, "remote.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.close()
+	allow, prompt := false, ""
+	agent.confirm = func(msg string) bool { prompt = msg; return allow }
+	conn, err := net.Dial("unix", agent.socket_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	key := sftp_packet{}.add_string([]byte("ssh-ed25519")).add_string([]byte("key"))
+	sign_request := append(sftp_packet{agent_sign_request}.add_string(key).add_string([]byte("data")), 0, 0, 0, 0)
+	rt := func(msg []byte, expected byte) {
+		if err := write_agent_message(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		response, err := read_agent_message(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response[0] != expected {
+			t.Fatalf("Unexpected response to request of type %d: %d", msg[0], response[0])
+		}
+	}
+	rt([]byte{11}, 12)
+	if prompt != "" {
+		t.Fatalf("Prompted for a request that is not a sign request")
+	}
+	rt(sign_request, agent_failure)
+	if !strings.Contains(prompt, "remote.test") || !strings.Contains(prompt, "ssh-ed25519 SHA256:") {
+		t.Fatalf("Unexpected prompt: %s", prompt)
+	}
+	allow = true
+	rt(sign_request, agent_sign_request+1)
+}
+
+func TestReconnect(t *testing.T) {
+	delays := utils.Map(reconnect_delay, []int{0, 1, 2, 4, 5, 100})
+	if diff := cmp.Diff([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 16 * time.Second, max_reconnect_delay, max_reconnect_delay}, delays); diff != "" {
+		t.Fatalf("Unexpected reconnect delays: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"tmux", "new-session", "-A", "-s", "x"}, session_manager_command(Reconnect_tmux, "x")); diff != "" {
+		t.Fatalf("Unexpected session manager command: %s", diff)
+	}
+	if session_manager_command(Reconnect_yes, "x") != nil {
+		t.Fatalf("Unexpected session manager command without a session manager")
+	}
+}
+
+func TestRemoteControlForwarding(t *testing.T) {
+	kopts := KittyOpts{Has_remote_control_password: true, Allow_remote_control: "password"}
+	args, listen_on, err := remote_control_forwarding("unix:/run/kitty-1", kopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote_socket := strings.TrimPrefix(listen_on, "unix:")
+	if diff := cmp.Diff([]string{"-o", "StreamLocalBindMask=0177", "-o", "StreamLocalBindUnlink=yes", "-R", remote_socket + ":/run/kitty-1"}, args); diff != "" {
+		t.Fatalf("Unexpected forwarding args: %s", diff)
+	}
+	if args, _, err = remote_control_forwarding("tcp:localhost:1234", kopts); err != nil || !strings.HasSuffix(args[len(args)-1], ":localhost:1234") {
+		t.Fatalf("Unexpected forwarding args for TCP: %#v %v", args, err)
+	}
+	for _, x := range []string{"unix:@abstract", ""} {
+		if _, _, err = remote_control_forwarding(x, kopts); err == nil {
+			t.Fatalf("No error for listen_on: %#v", x)
+		}
+	}
+	if _, _, err = remote_control_forwarding("unix:/run/kitty-1", KittyOpts{Allow_remote_control: "password"}); err == nil {
+		t.Fatalf("No error for forwarding without a remote control password")
+	}
+	for _, x := range []string{"yes", "socket-only", "socket", "no", ""} {
+		if _, _, err = remote_control_forwarding("unix:/run/kitty-1", KittyOpts{Has_remote_control_password: true, Allow_remote_control: x}); err == nil {
+			t.Fatalf("No error for forwarding with allow_remote_control: %#v", x)
+		}
+	}
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	msg := "The authenticity of host '[h.test]:2222 ([1.2.3.4]:2222)' can't be established.\nED25519 key fingerprint is SHA256:3H1FtJdN5Nvgi3EO9yZkG+8PvIWe4HZKeB/nv+QoUhs.\nThis key is not known by any other names.\nAre you sure you want to continue connecting (yes/no/[fingerprint])? "
+	p := parse_host_key_prompt(msg)
+	if p.host != "[h.test]:2222" || p.key_type != "ED25519" || p.fingerprint != "SHA256:3H1FtJdN5Nvgi3EO9yZkG+8PvIWe4HZKeB/nv+QoUhs" || strings.Contains(p.description, "(yes/no") {
+		t.Fatalf("Incorrectly parsed host key prompt: %#v", p)
+	}
+	// as output by ssh-keygen -lv
+	expected := `+--[ED25519 256]--+
+|               o=|
+|               ++|
+|              .o=|
+|       . . . . o+|
+|        S . + O..|
+|           E % B |
+|          o B X.*|
+|         . *.+=% |
+|          ..++=oO|
++----[SHA256]-----+`
+	digest, _ := base64.RawStdEncoding.DecodeString("3H1FtJdN5Nvgi3EO9yZkG+8PvIWe4HZKeB/nv+QoUhs")
+	if diff := cmp.Diff(expected, randomart(digest, "[ED25519 256]", "[SHA256]")); diff != "" {
+		t.Fatalf("Incorrect randomart: %s", diff)
+	}
+
+	// keys accepted once are never added to the known hosts file of the user
+	tdir := t.TempDir()
+	user_file := filepath.Join(tdir, "ssh", "known_hosts")
+	dir, args, err := use_temporary_known_hosts_file([]string{user_file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"-o", fmt.Sprintf(`UserKnownHostsFile="%s" "%s"`, filepath.Join(dir, "known_hosts"), user_file)}, args); diff != "" {
+		t.Fatalf("Incorrect known hosts args: %s", diff)
+	}
+	t.Setenv(known_hosts_dir_env_var, dir)
+	if diff := cmp.Diff([]string{user_file}, recorded_known_hosts_files()); diff != "" {
+		t.Fatalf("Incorrect recorded known hosts files: %s", diff)
+	}
+	const key = "AAAAC3NzaC1lZDI1NTE5AAAAIA0g1dpjeWJiXkANYwkL+y0ypdLwfAw7ySPFiQLHZWM0"
+	os.WriteFile(filepath.Join(dir, "known_hosts"), []byte("once.test ssh-ed25519 "+key+"\n[kept.test]:2222 ssh-ed25519 "+key), 0o600)
+	accept_host_key_once("once.test")
+	save_accepted_host_keys(dir, user_file)
+	if _, err := os.Stat(dir); err == nil {
+		t.Fatalf("Temporary known hosts directory not removed")
+	}
+	if raw, err := os.ReadFile(user_file); err != nil || string(raw) != "[kept.test]:2222 ssh-ed25519 "+key+"\n" {
+		t.Fatalf("Incorrect keys saved: %#v %v", string(raw), err)
+	}
+	known := known_host_keys("[kept.test]:2222", []string{user_file})
+	blob, _ := base64.StdEncoding.DecodeString(key)
+	fp := sha256.Sum256(blob)
+	old_key := known_host_key{key_type: "ssh-ed25519", fingerprint: "SHA256:" + base64.RawStdEncoding.EncodeToString(fp[:]), location: user_file + ":1"}
+	if diff := cmp.Diff([]known_host_key{old_key}, known, cmp.AllowUnexported(known_host_key{})); diff != "" {
+		t.Fatalf("Incorrect known host keys: %s", diff)
+	}
+	// conflicting keys are shown as a diff
+	if c := host_key_conflict(p, known); c != "Keys already known for this host:\n- ED25519 "+old_key.fingerprint+" ("+user_file+":1)\n+ ED25519 "+p.fingerprint {
+		t.Fatalf("Incorrect host key conflict: %s", c)
+	}
+	if c := host_key_conflict(p, nil); c != "" {
+		t.Fatalf("Unexpected host key conflict: %s", c)
+	}
+}
+
+func TestRuntimePayload(t *testing.T) {
+	list_tarfile := func(cd *connection_data) (names []string, data_sh string) {
+		data, err := make_tarfile(cd, func(key string) (val string, found bool) { return })
+		if err != nil {
+			t.Fatal(err)
+		}
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gr)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, h.Name)
+			if h.Name == "data.sh" {
+				raw, _ := io.ReadAll(tr)
+				data_sh = string(raw)
+			}
+		}
+		return
+	}
+	cd := basic_connection_data()
+	rd := path.Join("home", cd.host_opts.Remote_dir)
+	cd.payload = open_payload_record(filepath.Join(t.TempDir(), "record"))
+	cd.payload_confirmation = "id=1:pwfile=x:pw=y:installed=1"
+	names, data_sh := list_tarfile(cd)
+	if !slices.Contains(names, "home/.terminfo/kitty.terminfo") || !slices.Contains(names, path.Join(rd, payload_version_file)) {
+		t.Fatalf("Runtime files missing from the first connection: %#v", names)
+	}
+	if strings.Contains(data_sh, "KITTY_SSH_KITTEN_PAYLOAD_VERSION") {
+		t.Fatalf("Payload version sent when all the runtime files were sent")
+	}
+	version := payload_version(cd.payload.current)
+	if !strings.Contains(data_sh, "KITTY_SSH_KITTEN_PAYLOAD_SENT") || !strings.Contains(data_sh, version) || !strings.Contains(data_sh, cd.payload_confirmation) {
+		t.Fatalf("Payload confirmation not requested in data.sh: %s", data_sh)
+	}
+	if err := cd.payload.save(); err != nil {
+		t.Fatal(err)
+	}
+	if q := open_payload_record(cd.payload.path); payload_version(q.installed) != version {
+		t.Fatalf("Installed version not recorded: %#v != %#v", payload_version(q.installed), version)
+	}
+	names, data_sh = list_tarfile(cd)
+	for _, x := range names {
+		if strings.HasPrefix(x, "home/") {
+			t.Fatalf("%s sent even though the runtime files are installed", x)
+		}
+	}
+	if !strings.Contains(data_sh, version) || strings.Contains(data_sh, "KITTY_SSH_KITTEN_PAYLOAD_CONFIRMATION") {
+		t.Fatalf("Incorrect payload version in data.sh: %s", data_sh)
+	}
+	// only the changed runtime files are sent, along with the version that
+	// must already be installed
+	cd.host_opts.Remote_kitty = Remote_kitty_no
+	cd.host_opts.Shell_integration = "disabled"
+	names, data_sh = list_tarfile(cd)
+	if payload_version(cd.payload.current) == version || !slices.Contains(names, path.Join(rd, payload_version_file)) || !strings.Contains(data_sh, version) {
+		t.Fatalf("Changed runtime files not sent: %#v", names)
+	}
+	for _, x := range names {
+		if strings.HasPrefix(x, "home/.terminfo") {
+			t.Fatalf("%s sent even though it is unchanged", x)
+		}
+	}
+	entries := make([]*rsync.ManifestEntry, 0, len(cd.payload.current.Entries))
+	for _, e := range cd.payload.current.Entries {
+		q := *e
+		if q.Path == "home/.terminfo/kitty.terminfo" {
+			q.ContentHash = make([]byte, len(q.ContentHash))
+		}
+		entries = append(entries, &q)
+	}
+	cd.payload.installed = rsync.NewManifest(entries...)
+	names, _ = list_tarfile(cd)
+	if !slices.Contains(names, "home/.terminfo/kitty.terminfo") || slices.Contains(names, "home/.terminfo/x/xterm-kitty") {
+		t.Fatalf("Only the changed runtime file not sent: %#v", names)
+	}
+	cd.payload.forget()
+	if _, err := os.Stat(cd.payload.path); err == nil || cd.payload.installed != nil {
+		t.Fatalf("Installed version not forgotten")
+	}
+	// records in the old format are ignored
+	os.WriteFile(cd.payload.path, []byte(version), 0o600)
+	if open_payload_record(cd.payload.path).installed != nil {
+		t.Fatalf("Old format record not ignored")
+	}
+}
+
+func TestWindowsHosts(t *testing.T) {
+	for output, expected := range map[string]bool{
+		"Windows_NT $env:OS\r\n": true, "%OS%\r\nWindows_NT\r\n": true, "%OS% :OS\n": false, "": false,
+	} {
+		if actual := is_windows_probe_output(output); actual != expected {
+			t.Fatalf("Incorrect detection of Windows from: %#v", output)
+		}
+	}
+	record := filepath.Join(t.TempDir(), "record")
+	for _, x := range []string{"windows", "unix"} {
+		os.WriteFile(record, []byte(x), 0o600)
+		if detect_windows([]string{"/non-existent-ssh", "--", "host"}, record) != (x == "windows") {
+			t.Fatalf("Remembered OS of the remote host not used: %s", x)
+		}
+	}
+
+	cd := basic_connection_data("interpreter python3")
+	cd.is_windows = true
+	if err := get_remote_command(cd); err != nil {
+		t.Fatal(err)
+	}
+	if cd.script_type != "ps1" || cd.rcmd[0] != "powershell" {
+		t.Fatalf("PowerShell not used for Windows: %#v", cd.rcmd[:2])
+	}
+	unwrap := cd.rcmd[len(cd.rcmd)-1]
+	if strings.Contains(unwrap, "$") || len(strings.Join(cd.rcmd, " ")) > 8000 {
+		t.Fatalf("Bootstrap command not runnable by cmd.exe: %s", unwrap)
+	}
+	_, encoded, _ := strings.Cut(unwrap, "FromBase64String('")
+	encoded, _, _ = strings.Cut(encoded, "'")
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script, _ := io.ReadAll(gr); string(script) != cd.bootstrap_script {
+		t.Fatalf("Bootstrap script not recovered from the command")
+	}
+	if q := powershell_bootstrap_command(`C:\Program Files\PowerShell\7\pwsh.exe`, ""); q[0] != `C:\Program Files\PowerShell\7\pwsh.exe` {
+		t.Fatalf("PowerShell interpreter not used: %s", q[0])
+	}
+
+	data, err := make_tarfile(cd, func(key string) (val string, found bool) { return })
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err = gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != "data.sh" {
+			t.Fatalf("%s sent to a Windows host", h.Name)
+		}
+		raw, _ := io.ReadAll(tr)
+		if !strings.Contains(string(raw), `export ["TERM",`) {
+			t.Fatalf("Environment not serialized for PowerShell: %s", raw)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"kitty"
+	"kitty/tools/rsync"
+	"kitty/tools/tui/shell_integration"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+const (
+	// The exit code of the bootstrap script when the kitty runtime files that
+	// were not sent, as they were already installed, are missing
+	payload_missing_exit_code = 87
+	// The file in the data directory on the remote host recording the
+	// version of the installed kitty runtime files
+	payload_version_file = "payload-version"
+)
+
+type payload_item struct {
+	arcname string
+	entry   shell_integration.Entry
+}
+
+// The kitty runtime files, the shell integration scripts, the kitty launcher
+// and the terminfo, installed on the remote host. These are the same for every
+// connection to a host, so they need only be sent when they change.
+func runtime_payload(cd *connection_data, ksi string) (ans []payload_item) {
+	rd := strings.TrimRight(cd.host_opts.Remote_dir, "/")
+	add := func(prefix string, e shell_integration.Entry) {
+		ans = append(ans, payload_item{path.Join(prefix, path.Base(e.Metadata.Name)), e})
+	}
+	if ksi != "" {
+		for _, fname := range shell_integration.Data().FilesMatching(
+			"shell-integration/",
+			"shell-integration/ssh/.+",        // bootstrap files are sent as command line args
+			"shell-integration/zsh/kitty.zsh", // backward compat file not needed by ssh kitten
+		) {
+			add(path.Join("home/", rd, "/", path.Dir(fname)), shell_integration.Data()[fname])
+		}
+	}
+	if cd.host_opts.Remote_kitty != Remote_kitty_no {
+		arcname := path.Join("home/", rd, "/kitty")
+		for _, x := range []string{"kitty", "kitten"} {
+			add(path.Join(arcname, "bin"), shell_integration.Data()[path.Join("shell-integration", "ssh", x)])
+		}
+	}
+	add(path.Join("home", ".terminfo"), shell_integration.Data()["terminfo/kitty.terminfo"])
+	add(path.Join("home", ".terminfo", "x"), shell_integration.Data()["terminfo/x/xterm-kitty"])
+	return
+}
+
+// The manifest of the kitty runtime files, which includes the version of kitty,
+// so that the runtime files are sent again when kitty is updated
+func payload_manifest(items []payload_item) *rsync.Manifest {
+	entries := make([]*rsync.ManifestEntry, 0, len(items)+1)
+	add := func(name string, data []byte) {
+		h := sha256.Sum256(data)
+		entries = append(entries, &rsync.ManifestEntry{Path: name, Size: int64(len(data)), ContentHash: h[:]})
+	}
+	add("version", utils.UnsafeStringToBytes(kitty.VersionString))
+	for _, item := range items {
+		add(item.arcname, item.entry.Data)
+	}
+	return rsync.NewManifest(entries...)
+}
+
+// The version of the kitty runtime files is the hash of the tree they form
+func payload_version(m *rsync.Manifest) string {
+	if m == nil {
+		return ""
+	}
+	return hex.EncodeToString(m.TreeHash()[:16])
+}
+
+// A record of the kitty runtime files installed on a remote host, so that
+// only the files that have changed are sent
+type payload_record struct {
+	path string
+	// the manifest of the runtime files installed on the remote host, as far
+	// as is known
+	installed *rsync.Manifest
+	// the manifest of the runtime files in the last generated data
+	current *rsync.Manifest
+	// the paths of the runtime files in the last generated data, nil if all
+	// of them are in it
+	sent *utils.Set[string]
+}
+
+func payload_record_path(username, hostname, remote_dir string) string {
+	return filepath.Join(utils.CacheDir(), "ssh-payload-versions", host_state_filename(username, hostname, remote_dir))
+}
+
+func open_payload_record(path string) *payload_record {
+	ans := &payload_record{path: path}
+	if f, err := os.Open(path); err == nil {
+		// records in an older format are not manifests, so all runtime files
+		// are sent again
+		ans.installed, _ = rsync.ReadManifest(bufio.NewReader(f))
+		f.Close()
+	}
+	return ans
+}
+
+// Called when the runtime files are about to be added to the data for the
+// remote host, returns the paths of the runtime files that are new or have
+// changed since the installed version and so need to be sent. Returns nil
+// when all of them need to be sent. Files that are no longer part of the
+// runtime files are left on the remote host.
+func (self *payload_record) files_to_send(current *rsync.Manifest) *utils.Set[string] {
+	self.current, self.sent = current, nil
+	if self.installed == nil {
+		return nil
+	}
+	self.sent = utils.NewSet[string]()
+	for _, c := range rsync.DiffManifests(current, self.installed) {
+		if c.Action == rsync.ManifestFullTransfer || c.Action == rsync.ManifestDeltaTransfer {
+			self.sent.Add(c.Path)
+		}
+	}
+	return self.sent
+}
+
+// Whether none of the runtime files were in the last generated data, as they
+// are all installed
+func (self *payload_record) skipped() bool {
+	return self.installed != nil && payload_version(self.installed) == payload_version(self.current)
+}
+
+// The version the remote host must have installed for the runtime files in
+// the last generated data to be usable, empty when all of them are in it
+func (self *payload_record) base_version() string {
+	if self.sent == nil {
+		return ""
+	}
+	return payload_version(self.installed)
+}
+
+// Record the runtime files in the last generated data as installed, called
+// only once the remote host has confirmed that it installed them
+func (self *payload_record) save() error {
+	if self.current == nil || self.skipped() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(self.path), 0o700); err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	if err := self.current.Serialize(&buf); err != nil {
+		return err
+	}
+	if err := utils.AtomicWriteFile(self.path, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	self.installed = self.current
+	return nil
+}
+
+// Forget the installed runtime files, so that all of them are sent again
+func (self *payload_record) forget() {
+	self.installed = nil
+	os.Remove(self.path)
+}
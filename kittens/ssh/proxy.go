@@ -0,0 +1,154 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+type proxy_config struct {
+	jump_hosts    []string
+	proxy_command string
+}
+
+// Parse the output of ssh -G for the ProxyJump and ProxyCommand settings
+func parse_proxy_config(output string) (ans proxy_config) {
+	for _, line := range utils.Splitlines(output) {
+		key, val, found := strings.Cut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if strings.ToLower(val) == "none" {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "proxyjump":
+			for _, x := range strings.Split(val, ",") {
+				if x = strings.TrimSpace(x); x != "" {
+					ans.jump_hosts = append(ans.jump_hosts, x)
+				}
+			}
+		case "proxycommand":
+			ans.proxy_command = val
+		}
+	}
+	return
+}
+
+// Get the effective settings for the connection, from both the command line
+// and the users' SSH config, using ssh -G
+func get_effective_ssh_config(ssh_args []string, hostname string) string {
+	cmd := utils.Concat([]string{"-G"}, ssh_args, []string{"--", hostname})
+	output, err := exec.Command(SSHExe(), cmd...).Output()
+	if err != nil {
+		return ""
+	}
+	return utils.UnsafeBytesToString(output)
+}
+
+// The value of the specified setting in the output of ssh -G
+func effective_ssh_config_value(output, key string) (string, bool) {
+	for _, line := range utils.Splitlines(output) {
+		k, val, found := strings.Cut(strings.TrimSpace(line), " ")
+		if found && strings.EqualFold(k, key) {
+			return strings.TrimSpace(val), true
+		}
+	}
+	return "", false
+}
+
+// The arguments to connect to a jump host specified as [user@]host[:port] or
+// as an ssh:// URI
+func jump_host_args(spec string) []string {
+	if strings.HasPrefix(spec, "ssh://") {
+		return []string{spec}
+	}
+	host := spec
+	user, rest, found := strings.Cut(spec, "@")
+	if !found {
+		user, rest = "", spec
+	}
+	port := ""
+	if strings.HasPrefix(rest, "[") {
+		if idx := strings.Index(rest, "]"); idx > -1 {
+			host = rest[1:idx]
+			port = strings.TrimPrefix(rest[idx+1:], ":")
+		}
+	} else if strings.Count(rest, ":") == 1 {
+		host, port, _ = strings.Cut(rest, ":")
+	} else {
+		host = rest
+	}
+	ans := []string{}
+	if user != "" {
+		ans = append(ans, "-l", user)
+	}
+	if port != "" {
+		ans = append(ans, "-p", port)
+	}
+	return append(ans, "--", host)
+}
+
+// A ProxyCommand equivalent to ProxyJump with the specified jump hosts, that
+// uses the connection sharing arguments for the last jump host. This means
+// that the connection to the jump host is shared by all connections through
+// it, even to different destination hosts, so that the jump hosts do not
+// need to be connected to and authenticated against for every session.
+// config_file is the SSH config file specified on the command line, if any.
+func proxy_command_for_jump_hosts(jump_hosts []string, sharing_args []string, config_file string) string {
+	escape := func(x string) string { return strings.ReplaceAll(x, "%", "%%") }
+	args := []string{SSHExe()}
+	if config_file != "" {
+		args = append(args, "-F", config_file)
+	}
+	args = append(args, sharing_args...)
+	if len(jump_hosts) > 1 {
+		args = append(args, "-J", strings.Join(jump_hosts[:len(jump_hosts)-1], ","))
+	}
+	args = append(args, "-W", "[%h]:%p")
+	args = append(args, jump_host_args(jump_hosts[len(jump_hosts)-1])...)
+	for i, x := range args {
+		if x != "[%h]:%p" {
+			x = escape(x)
+		}
+		args[i] = utils.QuoteStringForSH(x)
+	}
+	return strings.Join(args, " ")
+}
+
+// The SSH config file specified on the command line, if any
+func config_file_from_args(ssh_args []string) string {
+	for i, x := range ssh_args {
+		if x == "-F" && i+1 < len(ssh_args) {
+			return ssh_args[i+1]
+		}
+	}
+	return ""
+}
+
+// Remove the ProxyJump settings from ssh_args
+func without_jump_args(ssh_args []string) []string {
+	ans := make([]string, 0, len(ssh_args))
+	for i := 0; i < len(ssh_args); i++ {
+		x := ssh_args[i]
+		if i+1 < len(ssh_args) {
+			if x == "-J" {
+				i++
+				continue
+			}
+			if x == "-o" && strings.HasPrefix(strings.ToLower(strings.TrimSpace(ssh_args[i+1])), "proxyjump") {
+				i++
+				continue
+			}
+		}
+		ans = append(ans, x)
+	}
+	return ans
+}
@@ -0,0 +1,59 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+const (
+	// the exit code of ssh when the connection fails or is lost
+	ssh_connection_error_exit_code = 255
+	// sessions that ended with a connection error sooner than this after
+	// they started are assumed to have failed to connect at all
+	min_session_duration   = 5 * time.Second
+	max_reconnect_attempts = 10
+	max_reconnect_delay    = 30 * time.Second
+)
+
+// The command to run on the remote host to attach to the session named name
+// of the specified session manager, creating it if it does not exist
+func session_manager_command(manager Reconnect_Choice_Type, name string) []string {
+	switch manager {
+	case Reconnect_tmux:
+		return []string{"tmux", "new-session", "-A", "-s", name}
+	case Reconnect_screen:
+		return []string{"screen", "-D", "-R", "-S", name}
+	case Reconnect_shpool:
+		return []string{"shpool", "attach", name}
+	}
+	return nil
+}
+
+// The delay before the specified reconnection attempt, doubling with every
+// attempt, starting from one second
+func reconnect_delay(attempt int) time.Duration {
+	return min(time.Second<<min(attempt, 8), max_reconnect_delay)
+}
+
+// Wait for the specified delay before reconnecting, returning false if the
+// user aborts reconnecting by pressing Ctrl+C
+func wait_to_reconnect(hostname string, delay time.Duration) bool {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	defer signal.Reset(unix.SIGINT, unix.SIGTERM)
+	fmt.Fprintf(os.Stderr, "\r\nThe connection to %s was lost, reconnecting in %s. Press Ctrl+C to abort.\r\n", hostname, delay)
+	select {
+	case <-sigs:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
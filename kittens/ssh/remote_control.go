@@ -0,0 +1,54 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/secrets"
+)
+
+var _ = fmt.Print
+
+// The ssh arguments to forward the socket kitty listens on for remote control,
+// listen_on, to a UNIX socket on the remote host, that is only accessible to
+// the remote user, and the address of that socket for KITTY_LISTEN_ON on the
+// remote host.
+func remote_control_forwarding(listen_on string, kopts KittyOpts) (ssh_args []string, remote_listen_on string, err error) {
+	if !kopts.Has_remote_control_password {
+		return nil, "", fmt.Errorf("Forwarding remote control to the remote host requires remote_control_password to be set in kitty.conf, to limit what the remote host can do")
+	}
+	// with other values requests without a password are accepted, allowing
+	// the remote host to do anything
+	if kopts.Allow_remote_control != "password" {
+		return nil, "", fmt.Errorf("Forwarding remote control to the remote host requires allow_remote_control to be set to password in kitty.conf, to limit what the remote host can do")
+	}
+	if listen_on == "" {
+		return nil, "", fmt.Errorf("Forwarding remote control to the remote host requires kitty to listen on a socket, set listen_on in kitty.conf")
+	}
+	network, addr, err := utils.ParseSocketAddress(listen_on)
+	if err != nil {
+		return nil, "", err
+	}
+	switch network {
+	case "unix":
+		if strings.HasPrefix(addr, "@") {
+			return nil, "", fmt.Errorf("Abstract UNIX sockets cannot be forwarded over SSH, use a UNIX socket on the filesystem for listen_on in kitty.conf")
+		}
+	case "tcp", "tcp4", "tcp6", "ip", "ip4", "ip6":
+	default:
+		return nil, "", fmt.Errorf("Cannot forward the socket: %s over SSH", listen_on)
+	}
+	suffix, err := secrets.TokenHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	// the socket is in /tmp as the home directory on the remote host is not
+	// known, its name is random and it is only accessible to the remote user
+	remote_socket := "/tmp/kitty-rc-" + suffix + ".sock"
+	return []string{
+		"-o", "StreamLocalBindMask=0177", "-o", "StreamLocalBindUnlink=yes", "-R", remote_socket + ":" + addr,
+	}, "unix:" + remote_socket, nil
+}
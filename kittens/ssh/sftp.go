@@ -0,0 +1,194 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The minimal subset of version 3 of the SFTP protocol needed to upload a
+// file, see https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+
+const (
+	sftp_init    byte = 1
+	sftp_version byte = 2
+	sftp_open    byte = 3
+	sftp_close   byte = 4
+	sftp_write   byte = 6
+	sftp_status  byte = 101
+	sftp_handle  byte = 102
+
+	sftp_flag_write       uint32 = 0x02
+	sftp_flag_create      uint32 = 0x08
+	sftp_flag_truncate    uint32 = 0x10
+	sftp_attr_permissions uint32 = 0x04
+
+	// servers must support at least this much data per packet
+	sftp_max_write_size = 32 * 1024
+)
+
+type sftp_packet []byte
+
+func (self sftp_packet) add_uint32(x uint32) sftp_packet {
+	return binary.BigEndian.AppendUint32(self, x)
+}
+
+func (self sftp_packet) add_uint64(x uint64) sftp_packet {
+	return binary.BigEndian.AppendUint64(self, x)
+}
+
+func (self sftp_packet) add_string(x []byte) sftp_packet {
+	return append(self.add_uint32(uint32(len(x))), x...)
+}
+
+type sftp_client struct {
+	w       io.Writer
+	r       *bufio.Reader
+	next_id uint32
+}
+
+func (self *sftp_client) send(ptype byte, payload sftp_packet) error {
+	p := make(sftp_packet, 0, len(payload)+16).add_uint32(uint32(len(payload) + 1))
+	p = append(p, ptype)
+	_, err := self.w.Write(append(p, payload...))
+	return err
+}
+
+func (self *sftp_client) read_packet() (ptype byte, payload []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(self.r, header[:]); err != nil {
+		return 0, nil, fmt.Errorf("Failed to read from the SFTP server with error: %w", err)
+	}
+	sz := binary.BigEndian.Uint32(header[:4])
+	if sz < 1 || sz > 1024*1024 {
+		return 0, nil, fmt.Errorf("The SFTP server sent a packet with invalid size: %d", sz)
+	}
+	payload = make([]byte, sz-1)
+	if _, err = io.ReadFull(self.r, payload); err != nil {
+		return 0, nil, fmt.Errorf("Failed to read from the SFTP server with error: %w", err)
+	}
+	return header[4], payload, nil
+}
+
+// Read a string in the SSH wire format, returning it and the remaining data
+func read_ssh_string(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < 4 {
+		return nil, nil, fmt.Errorf("Truncated SSH protocol packet")
+	}
+	sz := binary.BigEndian.Uint32(payload)
+	if uint64(len(payload)-4) < uint64(sz) {
+		return nil, nil, fmt.Errorf("Truncated SSH protocol packet")
+	}
+	return payload[4 : 4+sz], payload[4+sz:], nil
+}
+
+// Send a request and wait for its response, returning the payload of the
+// response after the request id
+func (self *sftp_client) request(ptype byte, payload sftp_packet) (byte, []byte, error) {
+	self.next_id++
+	id := self.next_id
+	if err := self.send(ptype, append(make(sftp_packet, 0, len(payload)+4).add_uint32(id), payload...)); err != nil {
+		return 0, nil, err
+	}
+	rtype, rpayload, err := self.read_packet()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(rpayload) < 4 || binary.BigEndian.Uint32(rpayload) != id {
+		return 0, nil, fmt.Errorf("The SFTP server sent a response with an unexpected id")
+	}
+	rpayload = rpayload[4:]
+	if rtype == sftp_status {
+		if len(rpayload) < 4 {
+			return 0, nil, fmt.Errorf("The SFTP server sent a truncated packet")
+		}
+		if code := binary.BigEndian.Uint32(rpayload); code != 0 {
+			msg, _, _ := read_ssh_string(rpayload[4:])
+			return 0, nil, fmt.Errorf("The SFTP server failed with error code: %d and message: %s", code, string(msg))
+		}
+	}
+	return rtype, rpayload, nil
+}
+
+func (self *sftp_client) upload(remote_path string, data []byte) error {
+	if err := self.send(sftp_init, make(sftp_packet, 0, 4).add_uint32(3)); err != nil {
+		return err
+	}
+	ptype, _, err := self.read_packet()
+	if err != nil {
+		return err
+	}
+	if ptype != sftp_version {
+		return fmt.Errorf("The SFTP server did not respond to the init request")
+	}
+	open := sftp_packet{}.add_string([]byte(remote_path)).add_uint32(sftp_flag_write | sftp_flag_create | sftp_flag_truncate)
+	ptype, payload, err := self.request(sftp_open, open.add_uint32(sftp_attr_permissions).add_uint32(0o600))
+	if err != nil {
+		return err
+	}
+	if ptype != sftp_handle {
+		return fmt.Errorf("The SFTP server did not respond to the open request with a handle")
+	}
+	handle, _, err := read_ssh_string(payload)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += sftp_max_write_size {
+		chunk := data[offset:min(offset+sftp_max_write_size, len(data))]
+		if _, _, err = self.request(sftp_write, sftp_packet{}.add_string(handle).add_uint64(uint64(offset)).add_string(chunk)); err != nil {
+			return err
+		}
+	}
+	_, _, err = self.request(sftp_close, sftp_packet{}.add_string(handle))
+	return err
+}
+
+// The ssh command to run remote_cmd on the remote host without a terminal,
+// from the command used for the interactive session, cmd, which must end
+// with: -- hostname
+func non_interactive_command(cmd []string, ssh_opts []string, remote_cmd ...string) []string {
+	ans := utils.Filter(cmd[:len(cmd)-2], func(x string) bool { return x != "-t" })
+	return utils.Concat(ans, ssh_opts, []string{"--", cmd[len(cmd)-1]}, remote_cmd)
+}
+
+// The ssh command to connect to the SFTP subsystem
+func sftp_command(cmd []string) []string {
+	return non_interactive_command(cmd, []string{"-T", "-s"}, "sftp")
+}
+
+// Upload data to remote_path on the remote host using the SFTP subsystem of
+// the SSH server. Relative paths are resolved with respect to the directory
+// the SFTP server starts in, which is usually the home directory of the user.
+func upload_via_sftp(cmd []string, remote_path string, data []byte) (err error) {
+	cmd = sftp_command(cmd)
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Stderr = os.Stderr
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = c.Start(); err != nil {
+		return err
+	}
+	client := sftp_client{w: stdin, r: bufio.NewReader(stdout)}
+	err = client.upload(remote_path, data)
+	stdin.Close()
+	if werr := c.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("Running %s failed with error: %w", strings.Join(cmd, " "), werr)
+	}
+	return
+}
@@ -13,6 +13,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"golang.org/x/exp/slices"
 )
 
 var _ = fmt.Print
@@ -104,6 +106,10 @@ func is_extra_arg(arg string, extra_args []string) string {
 	return ""
 }
 
+// Flags that are shortcuts for --kitten settings, --flag meaning setting=yes
+// and --flag=val meaning setting=val
+var shortcut_args = map[string]string{"--reconnect": "reconnect"}
+
 type ErrInvalidSSHArgs struct {
 	Msg string
 }
@@ -140,6 +146,10 @@ func ParseSSHArgs(args []string, extra_args ...string) (ssh_args []string, serve
 				stop_option_processing = true
 				continue
 			}
+			if name, val, found := strings.Cut(argument, "="); shortcut_args[name] != "" && slices.Contains(extra_args, "--kitten") {
+				found_extra_args = append(found_extra_args, "--kitten", shortcut_args[name]+"="+utils.IfElse(found, val, "yes"))
+				continue
+			}
 			if len(extra_args) > 0 {
 				matching_ex := is_extra_arg(argument, extra_args)
 				if matching_ex != "" {
@@ -201,6 +211,10 @@ func (self SSHVersion) SupportsAskpassRequire() bool {
 	return self.Major > 8 || (self.Major == 8 && self.Minor >= 4)
 }
 
+func (self SSHVersion) SupportsForwardAgentSocket() bool {
+	return self.Major > 8 || (self.Major == 8 && self.Minor >= 2)
+}
+
 var GetSSHVersion = utils.Once(func() SSHVersion {
 	b, err := exec.Command(SSHExe(), "-V").CombinedOutput()
 	if err != nil {
@@ -216,7 +230,8 @@ var GetSSHVersion = utils.Once(func() SSHVersion {
 })
 
 type KittyOpts struct {
-	Term, Shell_integration string
+	Term, Shell_integration, Allow_remote_control string
+	Has_remote_control_password                   bool
 }
 
 func read_relevant_kitty_opts(path string) KittyOpts {
@@ -227,6 +242,12 @@ func read_relevant_kitty_opts(path string) KittyOpts {
 			ans.Term = strings.TrimSpace(val)
 		case "shell_integration":
 			ans.Shell_integration = strings.TrimSpace(val)
+		case "allow_remote_control":
+			ans.Allow_remote_control = strings.TrimSpace(val)
+		case "remote_control_password":
+			if strings.TrimSpace(val) != "" {
+				ans.Has_remote_control_password = true
+			}
 		}
 		return nil
 	}
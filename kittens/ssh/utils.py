@@ -114,7 +114,6 @@ def read_data_from_shared_memory(shm_name: str) -> Any:
 
 def get_ssh_data(msg: str, request_id: str) -> Iterator[bytes]:
     from base64 import standard_b64decode
-    yield b'\nKITTY_DATA_START\n'  # to discard leading data
     try:
         msg = standard_b64decode(msg).decode('utf-8')
         md = dict(x.split('=', 1) for x in msg.split(':'))
@@ -123,29 +122,41 @@ def get_ssh_data(msg: str, request_id: str) -> Iterator[bytes]:
         rq_id = md['id']
     except Exception:
         traceback.print_exc()
+        yield b'\nKITTY_DATA_START\n'
         yield b'invalid ssh data request message\n'
-    else:
+        return
+    if md.get('installed'):
+        # the remote host confirms that it installed the kitty runtime files,
+        # which the kitten sees as the shared memory being consumed, nothing
+        # is sent back
         try:
-            env_data = read_data_from_shared_memory(pwfilename)
-            if pw != env_data['pw']:
-                raise ValueError('Incorrect password')
-            if rq_id != request_id:
-                raise ValueError(f'Incorrect request id: {rq_id!r} expecting the KITTY_PID-KITTY_WINDOW_ID for the current kitty window')
-        except Exception as e:
+            if read_data_from_shared_memory(pwfilename)['pw'] != pw or rq_id != request_id:
+                raise ValueError('Incorrect password or request id')
+        except Exception:
             traceback.print_exc()
-            yield f'{e}\n'.encode('utf-8')
-        else:
-            yield b'OK\n'
-            encoded_data = memoryview(env_data['tarfile'].encode('ascii'))
-            # macOS has a 255 byte limit on its input queue as per man stty.
-            # Not clear if that applies to canonical mode input as well, but
-            # better to be safe.
-            line_sz = 254
-            while encoded_data:
-                yield encoded_data[:line_sz]
-                yield b'\n'
-                encoded_data = encoded_data[line_sz:]
-            yield b'KITTY_DATA_END\n'
+        return
+    yield b'\nKITTY_DATA_START\n'  # to discard leading data
+    try:
+        env_data = read_data_from_shared_memory(pwfilename)
+        if pw != env_data['pw']:
+            raise ValueError('Incorrect password')
+        if rq_id != request_id:
+            raise ValueError(f'Incorrect request id: {rq_id!r} expecting the KITTY_PID-KITTY_WINDOW_ID for the current kitty window')
+    except Exception as e:
+        traceback.print_exc()
+        yield f'{e}\n'.encode('utf-8')
+    else:
+        yield b'OK\n'
+        encoded_data = memoryview(env_data['tarfile'].encode('ascii'))
+        # macOS has a 255 byte limit on its input queue as per man stty.
+        # Not clear if that applies to canonical mode input as well, but
+        # better to be safe.
+        line_sz = 254
+        while encoded_data:
+            yield encoded_data[:line_sz]
+            yield b'\n'
+            encoded_data = encoded_data[line_sz:]
+        yield b'KITTY_DATA_END\n'
 
 
 def set_env_in_cmdline(env: Dict[str, str], argv: List[str], clone: bool = True) -> None:
@@ -52,6 +52,7 @@ func TestParseSSHArgs(t *testing.T) {
 	p(`-46p23 localhost sh -c "a b"`, `-4 -6 -p 23`, `localhost sh -c "a b"`, ``, false)
 	p(`-46p23 -S/moose -W x:6 -- localhost sh -c "a b"`, `-4 -6 -p 23 -S /moose -W x:6`, `localhost sh -c "a b"`, ``, false)
 	p(`--kitten=abc -np23 --kitten xyz host`, `-n -p 23`, `host`, `--kitten abc --kitten xyz`, true)
+	p(`--reconnect -p23 --reconnect=tmux host cmd --reconnect`, `-p 23`, `host cmd --reconnect`, `--kitten reconnect=yes --kitten reconnect=tmux`, false)
 }
 
 func TestRelevantKittyOpts(t *testing.T) {
@@ -65,4 +66,11 @@ func TestRelevantKittyOpts(t *testing.T) {
 	if rko.Shell_integration != "changed" {
 		t.Fatalf("Unexpected shell_integration: %s", RelevantKittyOpts().Shell_integration)
 	}
+	if rko.Has_remote_control_password {
+		t.Fatalf("Unexpected remote control password")
+	}
+	os.WriteFile(path, []byte("remote_control_password abc ls\nallow_remote_control yes\nallow_remote_control password"), 0o600)
+	if rko = read_relevant_kitty_opts(path); !rko.Has_remote_control_password || rko.Allow_remote_control != "password" {
+		t.Fatalf("Remote control password not detected: %#v", rko)
+	}
 }
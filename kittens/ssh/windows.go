@@ -0,0 +1,74 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// A command that prints Windows_NT when run by either of the shells used by
+// the Windows OpenSSH server, cmd.exe and PowerShell, and never when run by a
+// POSIX shell
+const windows_probe_command = "echo %OS% $env:OS"
+
+func remote_os_record_path(username, hostname string) string {
+	return filepath.Join(utils.CacheDir(), "ssh-remote-os", host_state_filename(username, hostname, ""))
+}
+
+func is_windows_probe_output(output string) bool {
+	return strings.Contains(output, "Windows_NT")
+}
+
+// Detect whether the remote host runs Windows by running a command on it,
+// using the command for the interactive session, cmd. The result is
+// remembered in record_path, so that this is done only once per host.
+func detect_windows(cmd []string, record_path string) bool {
+	if raw, err := os.ReadFile(record_path); err == nil {
+		return strings.TrimSpace(utils.UnsafeBytesToString(raw)) == "windows"
+	}
+	probe := non_interactive_command(cmd, []string{"-T"}, windows_probe_command)
+	c := exec.Command(probe[0], probe[1:]...)
+	c.Stderr = os.Stderr
+	output, err := c.Output()
+	var exit_err *exec.ExitError
+	if err != nil && (!errors.As(err, &exit_err) || exit_err.ExitCode() == ssh_connection_error_exit_code) {
+		// could not connect, let the interactive session report the error
+		return false
+	}
+	ans := is_windows_probe_output(utils.UnsafeBytesToString(output))
+	if os.MkdirAll(filepath.Dir(record_path), 0o700) == nil {
+		_ = utils.AtomicWriteFile(record_path, utils.UnsafeStringToBytes(utils.IfElse(ans, "windows", "unix")), 0o600)
+	}
+	return ans
+}
+
+// The command to run the bootstrap script with PowerShell. The default shell
+// of the Windows OpenSSH server is cmd.exe, which limits commands to 8191
+// characters, so the script is sent compressed. The command is quoted with
+// double quotes and contains no $ so that it is passed unchanged by both
+// cmd.exe and PowerShell.
+func powershell_bootstrap_command(interpreter, script string) []string {
+	if q := strings.ToLower(path.Base(strings.ReplaceAll(interpreter, `\`, "/"))); !strings.Contains(q, "powershell") && !strings.Contains(q, "pwsh") {
+		interpreter = "powershell"
+	}
+	b := bytes.Buffer{}
+	w, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	w.Write(utils.UnsafeStringToBytes(script))
+	w.Close()
+	unwrap_script := `"iex ([IO.StreamReader]::new([IO.Compression.GZipStream]::new([IO.MemoryStream]::new([Convert]::FromBase64String('` +
+		base64.StdEncoding.EncodeToString(b.Bytes()) + `')),0))).ReadToEnd()"`
+	return []string{interpreter, "-NoLogo", "-NoProfile", "-Command", unwrap_script}
+}
@@ -4,96 +4,87 @@ package themes
 
 import (
 	"fmt"
+	"strings"
 
 	"kitty/tools/themes"
+	"kitty/tools/tui"
+	"kitty/tools/tui/subseq"
 	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
 )
 
 var _ = fmt.Print
 
+const max_name_width = 32
+
 type ThemesList struct {
-	themes, all_themes     *themes.Themes
-	current_search         string
-	display_strings        []string
-	widths                 []int
-	max_width, current_idx int
+	themes    *themes.Themes
+	list      *tui.List
+	max_width int
+}
+
+func NewThemesList() *ThemesList {
+	ans := &ThemesList{list: tui.NewList()}
+	ans.list.MatchOptions = subseq.Options{Level1: " "}
+	ans.list.MatchStyle = "fg=yellow"
+	ans.list.RenderItem = ans.render_item
+	return ans
 }
 
 func (self *ThemesList) Len() int {
 	if self.themes == nil {
 		return 0
 	}
-	return self.themes.Len()
+	return self.list.NumMatches()
 }
 
 func (self *ThemesList) Next(delta int, allow_wrapping bool) bool {
-	if len(self.display_strings) == 0 {
-		return false
-	}
-	idx := self.current_idx + delta
-	if !allow_wrapping && (idx < 0 || idx > self.Len()) {
-		return false
-	}
-	for idx < 0 {
-		idx += self.Len()
-	}
-	self.current_idx = idx % self.Len()
-	return true
-}
-
-func limit_lengths(text string) string {
-	t, x := wcswidth.TruncateToVisualLengthWithWidth(text, 31)
-	if x >= len(text) {
-		return text
-	}
-	return t + "…"
+	return self.list.MoveCurrent(delta, allow_wrapping)
 }
 
 func (self *ThemesList) UpdateThemes(themes *themes.Themes) {
-	self.themes, self.all_themes = themes, themes
-	if self.current_search != "" {
-		self.themes = self.all_themes.Copy()
-		self.display_strings = utils.Map(limit_lengths, self.themes.ApplySearch(self.current_search))
-	} else {
-		self.display_strings = utils.Map(limit_lengths, self.themes.Names())
+	self.themes = themes
+	// the current search, if any, is applied to the new themes
+	self.list.SetItems(themes.Names())
+	if self.list.Query() == "" {
+		self.list.SetCurrentItem(0)
 	}
-	self.widths = utils.Map(wcswidth.Stringwidth, self.display_strings)
-	self.max_width = utils.Max(0, self.widths...)
-	self.current_idx = 0
+	self.max_width = utils.Min(max_name_width, utils.Max(0, utils.Map(wcswidth.Stringwidth, themes.Names())...))
 }
 
+func (self *ThemesList) CurrentSearch() string { return self.list.Query() }
+
 func (self *ThemesList) UpdateSearch(query string) bool {
-	if query == self.current_search || self.all_themes == nil {
+	if self.themes == nil {
 		return false
 	}
-	self.current_search = query
-	self.UpdateThemes(self.all_themes)
-	return true
+	return self.list.SetQuery(query)
 }
 
-type Line struct {
-	text       string
-	width      int
-	is_current bool
+func (self *ThemesList) render_item(idx int, text string, positions []int, width int, is_current, is_selected bool, sprint_styled func(style string, args ...any) string) string {
+	text = tui.HighlightPositions(text, positions, width-2, self.list.MatchStyle, sprint_styled)
+	if !is_current {
+		return sprint_styled("fg=green", " ") + text + " "
+	}
+	// restore the color of the current item after every highlighted character
+	green_fg, _, _ := strings.Cut(sprint_styled("fg=green", "|"), "|")
+	_, default_fg, _ := strings.Cut(sprint_styled("fg=yellow", "|"), "|")
+	return sprint_styled("fg=green", ">") + sprint_styled("fg=green bold", strings.ReplaceAll(text, default_fg, green_fg)) + " "
 }
 
-func (self *ThemesList) Lines(num_rows int) []Line {
-	if num_rows < 1 {
+// The lines of text representing the visible themes, each with the width of
+// the longest theme name plus two cells for the marker and padding
+func (self *ThemesList) Lines(num_rows int, sprint_styled func(style string, args ...any) string) []string {
+	if num_rows < 1 || self.themes == nil {
 		return nil
 	}
-	ans := make([]Line, 0, len(self.display_strings))
-	before_num := utils.Min(self.current_idx, num_rows-1)
-	start := self.current_idx - before_num
-	for i := start; i < utils.Min(start+num_rows, len(self.display_strings)); i++ {
-		ans = append(ans, Line{self.display_strings[i], self.widths[i], i == self.current_idx})
-	}
-	return ans
+	self.list.SetGeometry(0, 0, self.max_width+2, num_rows)
+	return self.list.Lines(sprint_styled)
 }
 
 func (self *ThemesList) CurrentTheme() *themes.Theme {
 	if self.themes == nil {
 		return nil
 	}
-	return self.themes.At(self.current_idx)
+	return self.themes.At(self.list.CurrentItem())
 }
@@ -119,7 +119,7 @@ func (self *handler) finalize() {
 func (self *handler) initialize() {
 	self.tabs = strings.Split("all dark light recent user", " ")
 	self.rl = readline.New(self.lp, readline.RlInit{DontMarkPrompts: true, Prompt: "/"})
-	self.themes_list = &ThemesList{}
+	self.themes_list = NewThemesList()
 	self.fetch_result = make(chan fetch_data)
 	self.category_filters = make(map[string]func(*themes.Theme) bool, len(category_filters)+1)
 	maps.Copy(self.category_filters, category_filters)
@@ -302,7 +302,7 @@ func (self *handler) on_browsing_key_event(ev *loop.KeyEvent) error {
 
 func (self *handler) start_search() {
 	self.state = SEARCHING
-	self.rl.SetText(self.themes_list.current_search)
+	self.rl.SetText(self.themes_list.CurrentSearch())
 	self.draw_screen()
 }
 
@@ -313,19 +313,8 @@ func (self *handler) draw_browsing_screen() {
 		return
 	}
 	num_rows := int(sz.HeightCells) - 2
-	mw := self.themes_list.max_width + 1
-	green_fg, _, _ := strings.Cut(self.lp.SprintStyled("fg=green", "|"), "|")
-	for _, l := range self.themes_list.Lines(num_rows) {
-		line := l.text
-		if l.is_current {
-			line = strings.ReplaceAll(line, themes.MARK_AFTER, green_fg)
-			self.lp.PrintStyled("fg=green", ">")
-			self.lp.PrintStyled("fg=green bold", line)
-		} else {
-			self.lp.PrintStyled("fg=green", " ")
-			self.lp.QueueWriteString(line)
-		}
-		self.lp.MoveCursorHorizontally(mw - l.width)
+	for _, line := range self.themes_list.Lines(num_rows, self.lp.SprintStyled) {
+		self.lp.QueueWriteString(line)
 		self.lp.Println(SEPARATOR)
 	}
 	if self.themes_list != nil && self.themes_list.Len() > 0 {
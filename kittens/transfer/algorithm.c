@@ -261,10 +261,11 @@ sign_block(Patcher *self, PyObject *args) {
     return PyLong_FromSize_t(signature_block_size);
 }
 
-typedef enum { OpBlock, OpData, OpHash, OpBlockRange } OpType;
+typedef enum { OpBlock, OpData, OpHash, OpBlockRange, OpReferenceRange=6 } OpType;
 
 typedef struct Operation {
     OpType type;
+    uint32_t reference;
     uint64_t block_index, block_index_end;
     struct { uint8_t *buf; size_t len; } data;
 } Operation;
@@ -300,6 +301,13 @@ unserialize_op(uint8_t *data, size_t len, Operation *op) {
             op->data.buf = data + 5;
             consumed += op->data.len;
             break;
+        case OpReferenceRange:
+            // reference files are only supported when patching with the kitten
+            PyErr_SetString(RsyncError, "reference ranges are not supported by this patcher");
+            return 0;
+        default:
+            PyErr_Format(RsyncError, "Unknown operation type in delta data: %u", data[0]);
+            return 0;
     }
     if (consumed) op->type = data[0];
     return consumed;
@@ -365,6 +373,7 @@ apply_op(Patcher *self, Operation op, PyObject *read, PyObject *write) {
             }
             self->checksum_done = true;
         } return true;
+        case OpReferenceRange: break;
     }
     PyErr_SetString(RsyncError, "Unknown operation type");
     return false;
@@ -380,7 +389,10 @@ apply_delta_data(Patcher *self, PyObject *args) {
     Operation op = {0};
     while (pos < self->buf.len) {
         size_t consumed = unserialize_op(self->buf.data + pos, self->buf.len - pos, &op);
-        if (!consumed) { break; }
+        if (!consumed) {
+            if (PyErr_Occurred()) return NULL;
+            break;
+        }
         pos += consumed;
         if (!apply_op(self, op, read, write)) break;
     }
@@ -441,6 +453,15 @@ typedef struct SignatureMap {
     UT_hash_handle hh;
 } SignatureMap;
 
+typedef struct ReferenceBlock { uint32_t reference; uint64_t index, strong_hash; } ReferenceBlock;
+
+typedef struct ReferenceMap {
+    int weak_hash;
+    ReferenceBlock *blocks;
+    size_t len, cap;
+    UT_hash_handle hh;
+} ReferenceMap;
+
 typedef struct Differ {
     PyObject_HEAD
     rolling_checksum rc;
@@ -449,6 +470,7 @@ typedef struct Differ {
     bool signature_header_parsed;
     buffer buf;
     SignatureMap *signature_map;
+    ReferenceMap *reference_map;
 
     PyObject *read, *write;
     bool written, finished;
@@ -477,12 +499,23 @@ free_sigmap(SignatureMap *map) {
     }
 }
 
+static void
+free_refmap(ReferenceMap *map) {
+    ReferenceMap *current, *tmp;
+    HASH_ITER(hh, map, current, tmp) {
+        HASH_DEL(map, current);
+        free(current->blocks);
+        free(current);
+    }
+}
+
 static void
 Differ_dealloc(PyObject *self) {
     Differ *p = (Differ*)self;
     if (p->buf.data) free(p->buf.data);
     free_rsync(&p->rsync);
     if (p->signature_map) free_sigmap(p->signature_map);
+    if (p->reference_map) free_refmap(p->reference_map);
     Py_TYPE(self)->tp_free(self);
 }
 
@@ -554,7 +587,10 @@ add_signature_data(Differ *self, PyObject *args) {
     size_t pos = 0;
     while (pos < self->buf.len) {
         size_t consumed = parse_signature_block(self, self->buf.data + pos, self->buf.len - pos);
-        if (!consumed) { break; }
+        if (!consumed) {
+            if (PyErr_Occurred()) return NULL;
+            break;
+        }
         pos += consumed;
     }
     shift_left(&self->buf, pos);
@@ -572,6 +608,53 @@ finish_signature_data(Differ *self, PyObject *args UNUSED) {
     Py_RETURN_NONE;
 }
 
+static bool
+add_reference_block(Differ *self, uint32_t reference, uint8_t *data) {
+    int weak_hash = le32dec(data + 8);
+    ReferenceMap *rm = NULL;
+    HASH_FIND_INT(self->reference_map, &weak_hash, rm);
+    if (rm == NULL) {
+        rm = calloc(1, sizeof(ReferenceMap));
+        if (rm == NULL) { PyErr_NoMemory(); return false; }
+        rm->weak_hash = weak_hash;
+        HASH_ADD_INT(self->reference_map, weak_hash, rm);
+    }
+    if (rm->cap < rm->len + 1) {
+        size_t new_cap = MAX(rm->cap * 2, 4u);
+        rm->blocks = realloc(rm->blocks, new_cap * sizeof(rm->blocks[0]));
+        if (!rm->blocks) { PyErr_NoMemory(); return false; }
+        rm->cap = new_cap;
+    }
+    rm->blocks[rm->len++] = (ReferenceBlock){.reference=reference, .index=le64dec(data), .strong_hash=le64dec(data+12)};
+    return true;
+}
+
+static PyObject*
+add_reference_signature(Differ *self, PyObject *args) {
+    // The signature of a reference file, a file already present on the
+    // receiving side, blocks from which are sent as OpReferenceRange operations
+    unsigned long reference;
+    FREE_BUFFER_AFTER_FUNCTION Py_buffer data = {0};
+    if (!PyArg_ParseTuple(args, "ky*", &reference, &data)) return NULL;
+    if (!self->signature_header_parsed) { PyErr_SetString(RsyncError, "Cannot add reference signatures before the signature header"); return NULL; }
+    if (reference > UINT32_MAX) { PyErr_Format(RsyncError, "Invalid reference file id: %lu", reference); return NULL; }
+    uint8_t *p = data.buf;
+    if (data.len < 12 || le16dec(p) != 0 || le16dec(p + 2) != 0 || le16dec(p + 4) != 0 || le16dec(p + 6) != 0) {
+        PyErr_Format(RsyncError, "Invalid signature header for the reference file: %lu", reference); return NULL;
+    }
+    if (le32dec(p + 8) != self->rsync.block_size) {
+        PyErr_Format(RsyncError, "The signature of the reference file: %lu has block size: %u which does not match the block size: %zu of the signature", reference, le32dec(p + 8), self->rsync.block_size);
+        return NULL;
+    }
+    if ((data.len - 12) % signature_block_size != 0) {
+        PyErr_Format(RsyncError, "The signature of the reference file: %lu is truncated", reference); return NULL;
+    }
+    for (p += 12; p < (uint8_t*)data.buf + data.len; p += signature_block_size) {
+        if (!add_reference_block(self, reference, p)) return NULL;
+    }
+    Py_RETURN_NONE;
+}
+
 static bool
 send_op(Differ *self, Operation *op) {
     uint8_t metadata[32];
@@ -587,6 +670,12 @@ send_op(Differ *self, Operation *op) {
             le32enc(metadata + 9, op->block_index_end - op->block_index);
             len = 13;
             break;
+        case OpReferenceRange:
+            le32enc(metadata + 1, op->reference);
+            le64enc(metadata + 5, op->block_index);
+            le32enc(metadata + 13, op->block_index_end - op->block_index);
+            len = 17;
+            break;
         case OpHash:
             le16enc(metadata + 1, op->data.len);
             memcpy(metadata + 3, op->data.buf, op->data.len);
@@ -668,6 +757,14 @@ find_strong_hash(SignatureMap *sm, uint64_t q, uint64_t *block_index) {
     return false;
 }
 
+static bool
+find_reference_hash(ReferenceMap *rm, uint64_t q, uint32_t *reference, uint64_t *block_index) {
+    for (size_t i = 0; i < rm->len; i++) {
+        if (rm->blocks[i].strong_hash == q) { *reference = rm->blocks[i].reference; *block_index = rm->blocks[i].index; return true; }
+    }
+    return false;
+}
+
 static bool
 enqueue(Differ *self, Operation op) {
     switch (op.type) {
@@ -686,7 +783,18 @@ enqueue(Differ *self, Operation op) {
                             self->pending_op.block_index_end = op.block_index;
                             return true;
                         }
-                    case OpHash: case OpData: break;
+                    case OpHash: case OpData: case OpReferenceRange: break;
+                }
+                if (!send_pending(self)) return false;
+            }
+            self->pending_op = op;
+            self->has_pending = true;
+            return true;
+        case OpReferenceRange:
+            if (self->has_pending) {
+                if (self->pending_op.type == OpReferenceRange && self->pending_op.reference == op.reference && self->pending_op.block_index_end+1 == op.block_index) {
+                    self->pending_op.block_index_end = op.block_index;
+                    return true;
                 }
                 if (!send_pending(self)) return false;
             }
@@ -697,7 +805,7 @@ enqueue(Differ *self, Operation op) {
             if (!send_pending(self)) return false;
             return send_op(self, &op);
         case OpBlockRange: case OpData:
-            PyErr_SetString(RsyncError, "enqueue() must never be called with anything other than OpHash and OpBlock");
+            PyErr_SetString(RsyncError, "enqueue() must never be called with anything other than OpHash, OpBlock and OpReferenceRange");
             return false;
     }
     return false;
@@ -736,12 +844,24 @@ read_next(Differ *self) {
         rolling_checksum_full(&self->rc, self->buf.data + self->window.pos, self->window.sz);
     }
     SignatureMap *sm = NULL;
+    ReferenceMap *rm = NULL;
     int weak_hash = self->rc.val;
-    uint64_t block_index = 0;
+    Operation op = {.type=OpBlock};
+    bool found = false;
     HASH_FIND_INT(self->signature_map, &weak_hash, sm);
-    if (sm != NULL && find_strong_hash(sm, self->rsync.hasher.oneshot64(self->buf.data + self->window.pos, self->window.sz), &block_index)) {
+    HASH_FIND_INT(self->reference_map, &weak_hash, rm);
+    if (sm != NULL || rm != NULL) {
+        uint64_t strong_hash = self->rsync.hasher.oneshot64(self->buf.data + self->window.pos, self->window.sz);
+        if (sm != NULL) found = find_strong_hash(sm, strong_hash, &op.block_index);
+        if (!found && rm != NULL) {
+            op.type = OpReferenceRange;
+            found = find_reference_hash(rm, strong_hash, &op.reference, &op.block_index);
+            op.block_index_end = op.block_index;
+        }
+    }
+    if (found) {
         if (!send_data(self)) return false;
-        if (!enqueue(self, (Operation){.type=OpBlock, .block_index=block_index})) return false;
+        if (!enqueue(self, op)) return false;
 		self->window.pos += self->window.sz;
 		self->data.pos = self->window.pos;
 		self->window.sz = 0;
@@ -768,6 +888,7 @@ next_op(Differ *self, PyObject *args) {
 static PyMethodDef Differ_methods[] = {
     METHODB(add_signature_data, METH_VARARGS),
     METHODB(finish_signature_data, METH_NOARGS),
+    METHODB(add_reference_signature, METH_VARARGS),
     METHODB(next_op, METH_VARARGS),
     {NULL}  /* Sentinel */
 };
@@ -0,0 +1,127 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"kitty/tools/utils/humanize"
+)
+
+var _ = fmt.Print
+
+// Parse a size such as 2MB, 512k or 1.5MiB into bytes. Units without an i
+// are SI units, so k is 1000 and Ki is 1024. The trailing B is optional.
+func parse_size(raw string) (int64, bool) {
+	q := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(raw)), "b")
+	mult := float64(humanize.Byte)
+	if strings.HasSuffix(q, "i") {
+		q = q[:len(q)-1]
+		mult = 0
+		if len(q) > 0 {
+			switch q[len(q)-1] {
+			case 'k':
+				mult = humanize.KiByte
+			case 'm':
+				mult = humanize.MiByte
+			case 'g':
+				mult = humanize.GiByte
+			case 't':
+				mult = humanize.TiByte
+			}
+		}
+		if mult == 0 {
+			return 0, false
+		}
+		q = q[:len(q)-1]
+	} else if len(q) > 0 {
+		switch q[len(q)-1] {
+		case 'k':
+			mult = humanize.KByte
+		case 'm':
+			mult = humanize.MByte
+		case 'g':
+			mult = humanize.GByte
+		case 't':
+			mult = humanize.TByte
+		}
+		if mult != humanize.Byte {
+			q = q[:len(q)-1]
+		}
+	}
+	val, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+	if err != nil || val < 0 || math.IsInf(val, 0) || math.IsNaN(val) {
+		return 0, false
+	}
+	return int64(val * mult), true
+}
+
+// Parse a rate such as 2MB/s, 512k or 1.5MiB into bytes per second, see
+// parse_size(). A rate of zero or an empty string means no limit.
+func parse_rate(raw string) (int64, error) {
+	q := strings.TrimSpace(raw)
+	if q == "" {
+		return 0, nil
+	}
+	ans, ok := parse_size(strings.TrimSuffix(strings.ToLower(q), "/s"))
+	if !ok {
+		return 0, fmt.Errorf("The rate %#v is not valid, it must be a number followed by an optional unit such as 2MB/s", raw)
+	}
+	return ans, nil
+}
+
+// A token bucket limiting the rate at which data is written to the terminal,
+// shared by all the files being transferred in a session. Up to one second
+// worth of data can be sent in a burst.
+type token_bucket struct {
+	rate, tokens float64
+	last         time.Time
+}
+
+// Returns nil if rate is not positive, which means no limit
+func new_token_bucket(rate int64) *token_bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &token_bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Record that amt bytes were sent, returning how long to wait before sending
+// more data. Can be called on a nil bucket.
+func (self *token_bucket) consume(amt int64, now time.Time) time.Duration {
+	if self == nil {
+		return 0
+	}
+	if elapsed := now.Sub(self.last).Seconds(); elapsed > 0 {
+		self.tokens = math.Min(self.rate, self.tokens+elapsed*self.rate)
+	}
+	self.last = now
+	self.tokens -= float64(amt)
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
+
+// The limited rate in bytes per second, zero for no limit. Can be called on a
+// nil bucket.
+func (self *token_bucket) limit() int64 {
+	if self == nil {
+		return 0
+	}
+	return int64(self.rate)
+}
+
+// The size of the chunks files are read in, small enough that a chunk does
+// not take more than a fraction of a second to send at the limited rate
+func (self *token_bucket) chunk_size() int {
+	const max_chunk_size = 1024 * 1024
+	if self == nil {
+		return max_chunk_size
+	}
+	return int(math.Max(4096, math.Min(max_chunk_size, self.rate/4)))
+}
@@ -0,0 +1,275 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"kitty/tools/rsync"
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The maximum number of received files remembered by the dedup cache
+const max_dedup_entries = 16 * 1024
+
+// The block size used for all deltas when deduplicating, so that blocks from
+// the reference files can be used in the delta of any file
+const dedup_block_size = rsync.DefaultBlockSize
+
+// Limits on the previously received files used as reference files in a
+// single transfer, as their signatures are sent to the terminal
+const max_reference_files = 64
+const max_reference_size = 256 * 1024 * 1024
+
+type dedup_entry struct {
+	Path  string `json:"p"`
+	Size  int64  `json:"s"`
+	Mtime int64  `json:"m"`
+}
+
+// Whether the file at the path of the entry is unchanged since it was received
+func (self dedup_entry) is_valid() bool {
+	s, err := os.Stat(self.Path)
+	if err != nil || !s.Mode().IsRegular() || s.Size() != self.Size {
+		return false
+	}
+	// filesystems can store modification times with less precision
+	d := self.Mtime - s.ModTime().UnixNano()
+	return d >= 0 && d < int64(2*time.Second)
+}
+
+// A previously received file whose blocks can be used in the deltas of all
+// files in a transfer
+type reference_file struct {
+	id        uint32
+	path      string
+	f         *os.File
+	signature []byte
+}
+
+// A cache of the blocks of files previously received, for --dedup. Some of the
+// previously received files are used as reference files, whose signatures are
+// sent to the terminal, so that any block of a file being received that is
+// present in a reference file is copied from it, instead of being sent again.
+// Files with the same size and modification time as a file being received,
+// which are preserved when files are renamed or copied on the sending
+// computer, are preferred, followed by the most recently received files. The
+// signatures of the cached files are stored as well, so that they are
+// calculated only once.
+type dedup_cache struct {
+	index_path string
+	entries    []dedup_entry
+	by_key     map[string][]int
+	received   []dedup_entry
+	signatures *rsync.SignatureCache
+	references []*reference_file
+}
+
+func dedup_key(size, mtime int64) string {
+	return fmt.Sprintf("%d:%d", size, mtime)
+}
+
+func open_dedup_cache(dir string) (ans *dedup_cache, err error) {
+	if dir == "" {
+		dir = filepath.Join(utils.CacheDir(), "transfer-dedup")
+	}
+	ans = &dedup_cache{
+		index_path: filepath.Join(dir, "index.json"), by_key: make(map[string][]int),
+		signatures: rsync.NewSignatureCache(filepath.Join(dir, "signatures")),
+	}
+	if err = ans.read_index(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (self *dedup_cache) read_index() error {
+	self.entries, self.by_key = nil, make(map[string][]int)
+	raw, err := os.ReadFile(self.index_path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = json.Unmarshal(raw, &self.entries); err != nil {
+		// a corrupted index only means files are not deduplicated
+		self.entries = nil
+	}
+	for i, e := range self.entries {
+		k := dedup_key(e.Size, e.Mtime)
+		self.by_key[k] = append(self.by_key[k], i)
+	}
+	return nil
+}
+
+// Choose the previously received files to use as reference files for
+// receiving files, other than the files themselves, as they are overwritten
+func (self *dedup_cache) reference_candidates(files []*remote_file) (ans []dedup_entry) {
+	exclude := utils.NewSet[string](len(files))
+	wanted := utils.NewSet[string](len(files))
+	for _, f := range files {
+		exclude.Add(f.expanded_local_path)
+		if f.ftype == FileType_regular {
+			wanted.Add(dedup_key(f.expected_size, int64(f.mtime)))
+		}
+	}
+	var total int64
+	add := func(e dedup_entry) {
+		if len(ans) < max_reference_files && total+e.Size <= max_reference_size && e.Size >= dedup_block_size && !exclude.Has(e.Path) && e.is_valid() {
+			exclude.Add(e.Path)
+			ans = append(ans, e)
+			total += e.Size
+		}
+	}
+	// newest entries first
+	for i := len(self.entries) - 1; i >= 0; i-- {
+		if e := self.entries[i]; wanted.Has(dedup_key(e.Size, e.Mtime)) {
+			add(e)
+		}
+	}
+	for i := len(self.entries) - 1; i >= 0; i-- {
+		add(self.entries[i])
+	}
+	return
+}
+
+// Open the reference files for receiving files and calculate their
+// signatures, using next_id to allocate ids for them
+func (self *dedup_cache) open_references(files []*remote_file, next_id func() uint32) {
+	if self == nil {
+		return
+	}
+	p := self.new_patcher(0)
+	for _, e := range self.reference_candidates(files) {
+		f, err := os.Open(e.Path)
+		if err != nil {
+			continue
+		}
+		// a file that changes after its signature is calculated only causes
+		// the verification of the deltas using it to fail
+		sig, err := self.signature_for(e.Path, p)
+		if err != nil {
+			f.Close()
+			continue
+		}
+		self.references = append(self.references, &reference_file{id: next_id(), path: e.Path, f: f, signature: sig})
+	}
+}
+
+// Close the reference files
+func (self *dedup_cache) close() {
+	if self != nil {
+		for _, r := range self.references {
+			r.f.Close()
+		}
+		self.references = nil
+	}
+}
+
+// A Patcher that can apply deltas using blocks from the reference files
+func (self *dedup_cache) new_patcher(expected_size int64) *rsync.Patcher {
+	p := rsync.NewPatcher(expected_size, nil)
+	_ = p.SetBlockSize(dedup_block_size)
+	for _, r := range self.references {
+		p.AddReferenceFile(r.id, r.f)
+	}
+	return p
+}
+
+// Remember a file that was received successfully
+func (self *dedup_cache) add(path string, size int64, mtime time.Duration) {
+	if self != nil {
+		self.received = append(self.received, dedup_entry{Path: path, Size: size, Mtime: int64(mtime)})
+	}
+}
+
+// The signature of the file at path, created with p, from the cache if the
+// file is unchanged since the signature was created
+func (self *dedup_cache) signature_for(path string, p *rsync.Patcher) ([]byte, error) {
+	return self.signatures.SignatureFor(path, p)
+}
+
+// Write the index, with the files received in this session, dropping entries
+// for files that have changed since they were received. The index is read
+// again first, as other sessions may have updated it.
+func (self *dedup_cache) save() error {
+	if self == nil || len(self.received) == 0 {
+		return nil
+	}
+	if err := self.read_index(); err != nil {
+		return err
+	}
+	seen := utils.NewSet[string](len(self.entries) + len(self.received))
+	entries := make([]dedup_entry, 0, len(self.entries)+len(self.received))
+	// newest entries first, so that they are kept when trimming
+	all := append(self.entries, self.received...)
+	for i := len(all) - 1; i >= 0 && len(entries) < max_dedup_entries; i-- {
+		if e := all[i]; !seen.Has(e.Path) {
+			seen.Add(e.Path)
+			if e.is_valid() {
+				entries = append(entries, e)
+			} else {
+				// the signature of a changed file is useless
+				self.signatures.Invalidate(e.Path)
+			}
+		}
+	}
+	utils.Reverse(entries)
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(self.index_path), 0o700); err != nil {
+		return err
+	}
+	self.received = nil
+	return utils.AtomicWriteFile(self.index_path, data, 0o600)
+}
+
+// The local file the delta for f is applied to, if any
+func (self *remote_file) delta_base() string {
+	if self.resume_basis != "" {
+		return self.resume_basis
+	}
+	return utils.IfElse(self.empty_basis, "", self.expanded_local_path)
+}
+
+// Use the reference files for the deltas of all files that are large enough
+// to contain a block, those that would otherwise be transferred in full are
+// transferred as deltas against an empty file
+func (self *manager) use_references() {
+	if self.dedup == nil || !self.references_supported {
+		return
+	}
+	self.dedup.open_references(self.files, func() uint32 {
+		self.file_id_counter++
+		return uint32(self.file_id_counter)
+	})
+	if len(self.dedup.references) == 0 {
+		return
+	}
+	for _, f := range self.files {
+		if f.ftype == FileType_regular && f.stream == nil && !f.already_transferred && f.expected_size >= dedup_block_size {
+			f.empty_basis = !self.wants_signature(f)
+			f.use_references = true
+		}
+	}
+}
+
+// Send the signature of a reference file to the terminal
+func (self *manager) send_reference(r *reference_file, queue_write func(string) loop.IdType) loop.IdType {
+	fid := strconv.FormatUint(uint64(r.id), 10)
+	self.send(FileTransmissionCommand{Action: Action_file, File_id: fid, Ttype: TransmissionType_reference}, queue_write)
+	output := sigwriter{q: queue_write, file_id: fid, prefix: self.prefix, suffix: self.suffix}
+	output.Write(r.signature)
+	return self.send(FileTransmissionCommand{Action: Action_end_data, File_id: fid}, queue_write)
+}
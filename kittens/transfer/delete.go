@@ -0,0 +1,101 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Check that path, after resolving symlinks, is inside root so that a
+// symlink in the destination cannot cause files outside it to be deleted
+func is_inside(root, path string) bool {
+	rr, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	rp, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(rr, rp)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Return the paths of the files in the received directories that are not
+// present on the sending computer. Files excluded by the filter rules or
+// the size and modification time limits are not returned.
+func (self *manager) extraneous_files() (ans []string, err error) {
+	filter, err := new_file_filter(self.cli_opts)
+	if err != nil {
+		return nil, err
+	}
+	rid_map := make(map[string]*remote_file, len(self.files))
+	expected := utils.NewSet[string](len(self.files))
+	for _, f := range self.files {
+		rid_map[f.remote_id] = f
+		expected.Add(f.expanded_local_path)
+	}
+	for _, f := range self.excluded_files {
+		expected.Add(f.expanded_local_path)
+	}
+	for _, d := range self.files {
+		if d.ftype != FileType_directory {
+			continue
+		}
+		entries, err := os.ReadDir(d.expanded_local_path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("Failed to read the directory %s with error: %w", d.expanded_local_path, err)
+		}
+		root := d
+		for root.parent != "" && rid_map[root.parent] != nil {
+			root = rid_map[root.parent]
+		}
+		if !is_inside(root.expanded_local_path, d.expanded_local_path) {
+			return nil, fmt.Errorf("Refusing to delete files in %s as it is outside the destination directory %s", d.expanded_local_path, root.expanded_local_path)
+		}
+		base := filepath.Dir(root.expanded_local_path)
+		for _, e := range entries {
+			path := filepath.Join(d.expanded_local_path, e.Name())
+			if expected.Has(path) {
+				continue
+			}
+			if rel, err := filepath.Rel(base, path); err == nil && filter.is_excluded_with_ancestors(filepath.ToSlash(rel), e.IsDir()) {
+				continue
+			}
+			ans = append(ans, path)
+		}
+	}
+	slices.Sort(ans)
+	return
+}
+
+// Delete the files in the received directories that are not present on the
+// sending computer
+func (self *manager) delete_extraneous_files() (err error) {
+	paths, err := self.extraneous_files()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		// RemoveAll does not follow symlinks
+		if err = os.RemoveAll(path); err != nil {
+			return fmt.Errorf("Failed to delete %s with error: %w", path, err)
+		}
+		self.deleted = append(self.deleted, path)
+	}
+	return
+}
@@ -0,0 +1,75 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var _ = fmt.Print
+
+// Writes newline delimited JSON events describing the progress of a
+// transfer to STDERR, for --output-format=json
+type event_writer struct {
+	enc           *json.Encoder
+	started_at    time.Time
+	last_progress time.Time
+}
+
+const progress_event_interval = 100 * time.Millisecond
+
+func new_event_writer_to(w io.Writer) *event_writer {
+	return &event_writer{enc: json.NewEncoder(w), started_at: time.Now()}
+}
+
+// Returns nil, which discards all events, unless JSON output was requested
+func new_event_writer(opts *Options) *event_writer {
+	if opts == nil || opts.OutputFormat != "json" {
+		return nil
+	}
+	return new_event_writer_to(os.Stderr)
+}
+
+func (self *event_writer) emit(event string, fields map[string]any) {
+	if self == nil {
+		return
+	}
+	fields["event"] = event
+	fields["elapsed"] = time.Since(self.started_at).Seconds()
+	self.enc.Encode(fields)
+}
+
+func (self *event_writer) file_started(name string, size int64) {
+	self.emit("file_started", map[string]any{"name": name, "size": size})
+}
+
+// Progress events are sent at most once every progress_event_interval
+func (self *event_writer) file_progress(name string, transferred, size int64) {
+	if self == nil {
+		return
+	}
+	if now := time.Now(); now.Sub(self.last_progress) >= progress_event_interval {
+		self.last_progress = now
+		self.emit("progress", map[string]any{"name": name, "transferred": transferred, "size": size})
+	}
+}
+
+func (self *event_writer) file_done(name string, size int64, err_msg string) {
+	ev := map[string]any{"name": name, "size": size, "ok": err_msg == ""}
+	if err_msg != "" {
+		ev["error"] = err_msg
+	}
+	self.emit("file_done", ev)
+}
+
+func (self *event_writer) error(err error) {
+	self.emit("error", map[string]any{"message": err.Error()})
+}
+
+func (self *event_writer) totals(num_of_files, num_failed int, transferred int64) {
+	self.emit("totals", map[string]any{"files": num_of_files, "failed": num_failed, "transferred": transferred})
+}
@@ -0,0 +1,32 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+func file_flags(st fs.FileInfo) int64 {
+	if s, ok := st.Sys().(*syscall.Stat_t); ok {
+		return int64(s.Flags)
+	}
+	return 0
+}
+
+func set_file_flags(path string, flags int64, is_symlink bool) error {
+	if is_symlink {
+		// changing the flags of a symlink itself is not supported on all
+		// platforms
+		return errors.ErrUnsupported
+	}
+	return unix.Chflags(path, int(flags))
+}
@@ -0,0 +1,22 @@
+//go:build !(darwin || freebsd || netbsd || openbsd || dragonfly)
+
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+var _ = fmt.Print
+
+// Linux file attributes, as set by chattr, are not preserved
+func file_flags(st fs.FileInfo) int64 {
+	return 0
+}
+
+func set_file_flags(path string, flags int64, is_symlink bool) error {
+	return errors.ErrUnsupported
+}
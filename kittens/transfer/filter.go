@@ -0,0 +1,260 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = fmt.Print
+
+type filter_rule struct {
+	include, dir_only bool
+	pattern           string
+	pat               *regexp.Regexp
+}
+
+// Rules to include or exclude files, similar to the filter rules of rsync.
+// The first rule matching a path decides whether it is included, paths that
+// match no rule are included.
+type file_filter struct {
+	rules []filter_rule
+	// Regular files smaller or larger than these are excluded, negative
+	// values mean no limit
+	min_size, max_size int64
+	// Regular files not modified after this time are excluded, unless it is zero
+	newer_than time.Time
+}
+
+// Convert a glob pattern to a regular expression. * and ? do not match /
+// while ** matches anything, including /.
+func glob_to_regexp(pat string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; c {
+		case '*':
+			if i+1 < len(pat) && pat[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(pat) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		case '[':
+			start := i + 1
+			if start < len(pat) && pat[start] == '!' {
+				start++
+			}
+			// a ] immediately after the opening bracket is part of the class
+			end := -1
+			if start < len(pat) {
+				if idx := strings.IndexByte(pat[start+1:], ']'); idx > -1 {
+					end = start + 1 + idx
+				}
+			}
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteByte('[')
+			if start > i+1 {
+				b.WriteByte('^')
+			}
+			b.WriteString(strings.ReplaceAll(pat[start:end], `\`, `\\`))
+			b.WriteByte(']')
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+func parse_filter_rule(include bool, pattern string) (ans filter_rule, err error) {
+	ans = filter_rule{include: include, pattern: pattern}
+	q := pattern
+	if strings.HasSuffix(q, "/") {
+		ans.dir_only = true
+		q = strings.TrimRight(q, "/")
+	}
+	if q == "" {
+		return ans, fmt.Errorf("The filter pattern %#v is empty", pattern)
+	}
+	// patterns starting with / are anchored to the root of the transfer,
+	// others can match at any level
+	prefix := "(^|/)"
+	if strings.HasPrefix(q, "/") {
+		prefix = "^"
+		q = q[1:]
+	}
+	if ans.pat, err = regexp.Compile(prefix + glob_to_regexp(q) + "$"); err != nil {
+		return ans, fmt.Errorf("The filter pattern %#v is invalid with error: %w", pattern, err)
+	}
+	return
+}
+
+// Read rules from a file with one rule per line, a rule being + or -
+// followed by a space and the pattern. Blank lines and lines starting with #
+// are ignored.
+func (self *file_filter) read_rules(path string) (err error) {
+	f, err := os.Open(expand_home(path))
+	if err != nil {
+		return fmt.Errorf("Failed to open the filter file %s with error: %w", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lnum := 0
+	for scanner.Scan() {
+		lnum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var include bool
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			include = true
+		case strings.HasPrefix(line, "- "):
+		default:
+			return fmt.Errorf("Line %d of the filter file %s is not a valid rule, rules must start with + or -", lnum, path)
+		}
+		r, err := parse_filter_rule(include, line[2:])
+		if err != nil {
+			return fmt.Errorf("Line %d of the filter file %s: %w", lnum, path, err)
+		}
+		self.rules = append(self.rules, r)
+	}
+	return scanner.Err()
+}
+
+// Create the filter specified by the command line options. Includes are
+// checked first, then excludes and finally the rules from the filter file.
+// Returns nil if there are no rules.
+func new_file_filter(opts *Options) (ans *file_filter, err error) {
+	ans = &file_filter{}
+	for _, x := range opts.Include {
+		r, err := parse_filter_rule(true, x)
+		if err != nil {
+			return nil, err
+		}
+		ans.rules = append(ans.rules, r)
+	}
+	for _, x := range opts.Exclude {
+		r, err := parse_filter_rule(false, x)
+		if err != nil {
+			return nil, err
+		}
+		ans.rules = append(ans.rules, r)
+	}
+	if opts.FilterFrom != "" {
+		if err = ans.read_rules(opts.FilterFrom); err != nil {
+			return nil, err
+		}
+	}
+	ans.min_size, ans.max_size = -1, -1
+	for _, x := range []struct {
+		val, name string
+		limit     *int64
+	}{{opts.MinSize, "--min-size", &ans.min_size}, {opts.MaxSize, "--max-size", &ans.max_size}} {
+		if x.val != "" {
+			var ok bool
+			if *x.limit, ok = parse_size(x.val); !ok {
+				return nil, fmt.Errorf("The value %#v for %s is not valid, it must be a number followed by an optional unit such as 10MB", x.val, x.name)
+			}
+		}
+	}
+	if opts.NewerThan != "" {
+		if ans.newer_than, err = parse_newer_than(opts.NewerThan, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if len(ans.rules) == 0 && ans.min_size < 0 && ans.max_size < 0 && ans.newer_than.IsZero() {
+		return nil, nil
+	}
+	return
+}
+
+// Parse the value of --newer-than, either a duration before now, such as 2h,
+// 3d or 1w, or a date and optional time, such as 2023-07-01 or
+// 2023-07-01T14:30, in the local timezone
+func parse_newer_than(raw string, now time.Time) (time.Time, error) {
+	q := strings.TrimSpace(raw)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, q, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	var unit time.Duration
+	if len(q) > 0 {
+		switch q[len(q)-1] {
+		case 's':
+			unit = time.Second
+		case 'm':
+			unit = time.Minute
+		case 'h':
+			unit = time.Hour
+		case 'd':
+			unit = 24 * time.Hour
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		}
+	}
+	if unit > 0 {
+		if val, err := strconv.ParseFloat(q[:len(q)-1], 64); err == nil && val >= 0 && !math.IsInf(val, 0) {
+			return now.Add(-time.Duration(val * float64(unit))), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("The value %#v for --newer-than is not valid, it must be a duration such as 3d or a date such as 2023-07-01", raw)
+}
+
+// Whether the path, relative to the root of the transfer and using / as the
+// separator, is excluded. Can be called on a nil filter.
+func (self *file_filter) is_excluded(rel_path string, is_dir bool) bool {
+	if self == nil {
+		return false
+	}
+	for _, r := range self.rules {
+		if (!r.dir_only || is_dir) && r.pat.MatchString(rel_path) {
+			return !r.include
+		}
+	}
+	return false
+}
+
+// Whether a regular file is excluded because of its size or modification
+// time. Can be called on a nil filter.
+func (self *file_filter) is_excluded_file(size int64, mtime time.Time) bool {
+	if self == nil {
+		return false
+	}
+	return (self.min_size > -1 && size < self.min_size) || (self.max_size > -1 && size > self.max_size) ||
+		(!self.newer_than.IsZero() && !mtime.After(self.newer_than))
+}
+
+// Like is_excluded() but also excludes the path if any of its parent
+// directories are excluded
+func (self *file_filter) is_excluded_with_ancestors(rel_path string, is_dir bool) bool {
+	if self == nil {
+		return false
+	}
+	for p := path.Dir(rel_path); p != "." && p != "/"; p = path.Dir(p) {
+		if self.is_excluded(p, true) {
+			return true
+		}
+	}
+	return self.is_excluded(rel_path, is_dir)
+}
@@ -53,6 +53,7 @@ var _ Unserializable = (*Compression)(nil)
 const (
 	Compression_none Compression = iota
 	Compression_zlib
+	Compression_zstd
 )
 
 type FileType int // enum
@@ -103,6 +104,7 @@ var _ Unserializable = (*TransmissionType)(nil)
 const (
 	TransmissionType_simple TransmissionType = iota
 	TransmissionType_rsync
+	TransmissionType_reference
 )
 
 type QuietLevel int // enum
@@ -132,6 +134,34 @@ type FileTransmissionCommand struct {
 	Mtime       time.Duration `json:"mod,omitempty"`
 	Permissions fs.FileMode   `json:"prm,omitempty"`
 	Size        int64         `json:"sz,omitempty" default:"-1"`
+	Checksum    string        `json:"ck,omitempty"`
+	// Comma separated list of supported compression algorithms, in order of preference
+	Compressions string `json:"zc,omitempty" encoding:"base64"`
+	// Comma separated list of the optional file properties to preserve, sent
+	// with requests, xattrs and sparse. The terminal responds with the ones it
+	// supports.
+	Preserve string `json:"pm,omitempty" encoding:"base64"`
+	// Extended attributes of the file, a JSON object mapping names to base64
+	// encoded values
+	Xattrs string `json:"xa,omitempty" encoding:"base64"`
+	// BSD file flags
+	Flags int64 `json:"fl,omitempty"`
+	// Comma separated list of the extended metadata that could not be read or
+	// applied
+	Unpreserved string `json:"up,omitempty" encoding:"base64"`
+	// The hole map of a sparse file: its size followed by the offset:length of
+	// each of its data extents, comma separated. Only the data in the extents
+	// is transmitted.
+	Extents string `json:"ex,omitempty" encoding:"base64"`
+	// How the terminal should handle symlinks when sending files, follow
+	// to send the files they point to instead
+	Links string `json:"ln,omitempty"`
+	// Comma separated list of optional protocol features supported by the
+	// client, the terminal responds with the ones it supports
+	Features string `json:"fe,omitempty" encoding:"base64"`
+	// The maximum rate, in bytes per second, at which the terminal should send
+	// the data of files, sent with receive requests
+	Rate int64 `json:"rt,omitempty"`
 
 	Data []byte `json:"d,omitempty"`
 }
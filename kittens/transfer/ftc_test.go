@@ -43,6 +43,13 @@ func TestFTCSerialization(t *testing.T) {
 		t.Fatal(err)
 	}
 	q(n.Serialize())
+	ftc = FileTransmissionCommand{Compressions: supported_compressions}
+	if n, err = NewFileTransmissionCommand(ftc.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if n.Compressions != supported_compressions {
+		t.Fatalf("Failed to round trip compressions: %#v != %#v", n.Compressions, supported_compressions)
+	}
 
 	unsafe := "moo\x1b;;[?*.-se1"
 	if safe_string(unsafe) != "moo.-se1" {
@@ -0,0 +1,221 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/shlex"
+)
+
+var _ = fmt.Print
+
+// The metadata of a transferred file passed to the --on-file-complete command
+type hook_file struct {
+	Path        string `json:"path"`
+	Remote_path string `json:"remote_path"`
+	Size        int64  `json:"size"`
+	Ok          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+}
+
+type hook_failure struct {
+	path string
+	err  error
+}
+
+// Runs the commands specified by --on-file-complete and --on-session-complete.
+// The commands for files are run one at a time in a separate goroutine, in
+// the order in which the files complete, so that they do not block the transfer.
+type hook_runner struct {
+	direction                             string
+	on_file_complete, on_session_complete []string
+	files                                 []hook_file
+
+	mutex       sync.Mutex
+	pending     []hook_file
+	wake        chan bool
+	worker_done chan bool
+	failures    []hook_failure
+}
+
+func parse_hook(opt, cmdline string) ([]string, error) {
+	if cmdline == "" {
+		return nil, nil
+	}
+	argv, err := shlex.Split(cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("The %s command %#v is invalid with error: %w", opt, cmdline, err)
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("The %s command must not be empty", opt)
+	}
+	return argv, nil
+}
+
+// Returns nil, which runs no commands, unless some hook commands were specified
+func new_hook_runner(opts *Options, direction string) (ans *hook_runner, err error) {
+	if opts == nil || (opts.OnFileComplete == "" && opts.OnSessionComplete == "") {
+		return nil, nil
+	}
+	ans = &hook_runner{direction: direction}
+	if ans.on_file_complete, err = parse_hook("--on-file-complete", opts.OnFileComplete); err != nil {
+		return nil, err
+	}
+	if ans.on_session_complete, err = parse_hook("--on-session-complete", opts.OnSessionComplete); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+func run_hook(argv []string, env map[string]string, input any, output *bytes.Buffer) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	c := exec.Command(argv[0], argv[1:]...)
+	c.Env = os.Environ()
+	for k, v := range env {
+		c.Env = append(c.Env, k+"="+v)
+	}
+	c.Stdin = bytes.NewReader(data)
+	if output != nil {
+		c.Stdout, c.Stderr = output, output
+	} else {
+		// STDOUT can be the data of a file being received
+		c.Stdout, c.Stderr = os.Stderr, os.Stderr
+	}
+	return c.Run()
+}
+
+func (self *hook_runner) run_file_hook(f hook_file) {
+	env := map[string]string{
+		"KITTY_TRANSFER_DIRECTION": self.direction, "KITTY_TRANSFER_PATH": f.Path, "KITTY_TRANSFER_REMOTE_PATH": f.Remote_path,
+		"KITTY_TRANSFER_SIZE": strconv.FormatInt(f.Size, 10), "KITTY_TRANSFER_STATUS": "OK",
+	}
+	if !f.Ok {
+		env["KITTY_TRANSFER_STATUS"] = f.Error
+	}
+	input := struct {
+		hook_file
+		Direction string `json:"direction"`
+	}{f, self.direction}
+	var output bytes.Buffer
+	if err := run_hook(self.on_file_complete, env, input, &output); err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		self.mutex.Lock()
+		self.failures = append(self.failures, hook_failure{f.Path, err})
+		self.mutex.Unlock()
+	}
+}
+
+func (self *hook_runner) run_pending() {
+	for {
+		self.mutex.Lock()
+		pending := self.pending
+		self.pending = nil
+		self.mutex.Unlock()
+		if len(pending) == 0 {
+			return
+		}
+		for _, f := range pending {
+			self.run_file_hook(f)
+		}
+	}
+}
+
+func (self *hook_runner) worker() {
+	defer close(self.worker_done)
+	for range self.wake {
+		self.run_pending()
+	}
+	self.run_pending()
+}
+
+// Called when a regular file has been completely transferred or has failed
+func (self *hook_runner) file_done(path, remote_path string, size int64, err_msg string) {
+	if self == nil {
+		return
+	}
+	f := hook_file{Path: path, Remote_path: remote_path, Size: size, Ok: err_msg == "", Error: err_msg}
+	self.files = append(self.files, f)
+	if len(self.on_file_complete) == 0 {
+		return
+	}
+	if self.wake == nil {
+		self.wake, self.worker_done = make(chan bool, 1), make(chan bool)
+		go self.worker()
+	}
+	self.mutex.Lock()
+	self.pending = append(self.pending, f)
+	self.mutex.Unlock()
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+// Wait for the commands for all completed files to finish, then run the
+// command for the session. Returns the number of commands that failed.
+func (self *hook_runner) finish(transferred int64) (num_failed int) {
+	if self == nil {
+		return
+	}
+	if self.wake != nil {
+		close(self.wake)
+		<-self.worker_done
+		self.wake = nil
+	}
+	if n := len(self.failures); n > 0 {
+		fmt.Fprintf(os.Stderr, "The --on-file-complete command failed for %d out of %d files\n", n, len(self.files))
+		for _, x := range self.failures {
+			fmt.Fprintln(os.Stderr, x.path)
+			fmt.Fprintln(os.Stderr, ` `, x.err)
+		}
+		num_failed += n
+	}
+	if len(self.on_session_complete) > 0 {
+		failed := 0
+		for _, f := range self.files {
+			if !f.Ok {
+				failed++
+			}
+		}
+		env := map[string]string{
+			"KITTY_TRANSFER_DIRECTION": self.direction, "KITTY_TRANSFER_FILES": strconv.Itoa(len(self.files)),
+			"KITTY_TRANSFER_FAILED": strconv.Itoa(failed), "KITTY_TRANSFER_BYTES": strconv.FormatInt(transferred, 10),
+		}
+		files := self.files
+		if files == nil {
+			files = []hook_file{}
+		}
+		input := map[string]any{"direction": self.direction, "files": files, "failed": failed, "transferred": transferred}
+		if err := run_hook(self.on_session_complete, env, input, nil); err != nil {
+			fmt.Fprintln(os.Stderr, "The --on-session-complete command failed with error:", err)
+			num_failed++
+		}
+	}
+	return
+}
+
+func (self *SendManager) on_file_hook(f *File) {
+	if f.file_type == FileType_regular {
+		self.hooks.file_done(f.expanded_local_path, utils.IfElse(f.remote_final_path != "", f.remote_final_path, f.remote_path), f.file_size, f.err_msg)
+	}
+}
+
+func (self *manager) on_file_hook(f *remote_file, err_msg string) {
+	if f.ftype == FileType_regular {
+		self.hooks.file_done(f.expanded_local_path, f.remote_path, f.expected_size, err_msg)
+	}
+}
@@ -0,0 +1,40 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// The prefix added to the targets of unsafe symlinks, the same as used by rsync
+const munged_symlink_prefix = "/rsyncd-munged/"
+
+// Whether the symlink at rel_path, relative to the parent of the root of the
+// transfer and using / as the separator, is absolute or points outside the
+// transferred tree
+func is_unsafe_symlink(rel_path, link_dest string) bool {
+	link_dest = filepath.ToSlash(link_dest)
+	if path.IsAbs(link_dest) || filepath.IsAbs(link_dest) {
+		return true
+	}
+	q := path.Join(path.Dir(rel_path), link_dest)
+	root, _, is_nested := strings.Cut(rel_path, "/")
+	if !is_nested {
+		// the symlink is itself the root of the transfer
+		return q == ".." || strings.HasPrefix(q, "../")
+	}
+	return q != root && !strings.HasPrefix(q, root+"/")
+}
+
+// Return the target for the symlink with --links=munge-unsafe
+func munged_symlink_target(rel_path, link_dest string) string {
+	if is_unsafe_symlink(rel_path, link_dest) {
+		return munged_symlink_prefix + strings.TrimLeft(link_dest, "/")
+	}
+	return link_dest
+}
@@ -9,6 +9,8 @@ import (
 	"strconv"
 	"strings"
 
+	"golang.org/x/exp/slices"
+
 	"kitty/tools/cli"
 	"kitty/tools/utils"
 )
@@ -44,6 +46,9 @@ func read_bypass(loc string) (string, error) {
 }
 
 func main(cmd *cli.Command, opts *Options, args []string) (rc int, err error) {
+	if opts.PermissionsBypass == "-" && (opts.Direction == "send" || opts.Direction == "download") && slices.Contains(args, stdio_path) {
+		return 1, fmt.Errorf("Cannot read both the password and the data to send from STDIN")
+	}
 	if opts.PermissionsBypass != "" {
 		val, err := read_bypass(opts.PermissionsBypass)
 		if err != nil {
@@ -54,13 +59,29 @@ func main(cmd *cli.Command, opts *Options, args []string) (rc int, err error) {
 	if len(args) == 0 {
 		return 1, fmt.Errorf("Must specify at least one file to transfer")
 	}
+	if _, err = parse_rate(opts.Bwlimit); err != nil {
+		return 1, err
+	}
+	if _, err = new_file_filter(opts); err != nil {
+		return 1, err
+	}
+	if _, err = new_hook_runner(opts, ""); err != nil {
+		return 1, err
+	}
 	switch opts.Direction {
 	case "send", "download":
+		if opts.Delete || opts.DryRun {
+			return 1, fmt.Errorf("The --delete and --dry-run options are only supported when receiving files, with --direction=upload")
+		}
+		if opts.Dedup {
+			return 1, fmt.Errorf("The --dedup option is only supported when receiving files, with --direction=upload")
+		}
 		err, rc = send_main(opts, args)
 	default:
 		err, rc = receive_main(opts, args)
 	}
 	if err != nil {
+		new_event_writer(opts).error(err)
 		rc = 1
 	}
 	return
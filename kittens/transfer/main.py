@@ -62,6 +62,17 @@
 running the kitten and the home directory on the other computer. It is
 a good idea to use the :option:`--confirm-paths` command line flag to verify
 the kitten will copy the files you expect it to.
+
+Data can also be streamed through the kitten, without needing temporary files.
+Use :code:`-` as the source to send the data read from STDIN and as the
+destination to write the received data to STDOUT, for example:
+
+.. code::
+
+    $ tar cz mydir | kitten transfer - /path/to/local/mydir.tar.gz
+    $ kitten transfer --direction=upload /path/to/local/dump.sql - | psql mydb
+
+Only a single file can be streamed at a time.
 '''
 
 
@@ -91,8 +102,10 @@ def option_text() -> str:
 default=auto
 choices=auto,never,always
 Whether to compress data being sent. By default compression is enabled based on the
-type of file being sent. For files recognized as being already compressed, compression
-is turned off as it just wastes CPU cycles.
+type of file being sent. For files recognized as being already compressed, either by their
+extension or by sniffing their contents, compression is turned off as it just wastes CPU cycles.
+The compression algorithm is negotiated with the terminal, zstd is used when the terminal
+supports it, otherwise zlib.
 
 
 --permissions-bypass -p
@@ -118,6 +131,215 @@ def option_text() -> str:
 update it to match the file on the sending side, potentially saving lots of
 bandwidth and also automatically resuming partial transfers. Note that this will
 actually degrade performance on fast links or with small files, so use with care.
+
+
+--resume -r
+type=bool-set
+Resume a previous transfer of the same files that was interrupted. Files that
+were completely transferred and have not changed since, on either computer, are
+skipped. Partially transferred files are updated using the rsync algorithm, so
+that only the missing data is sent, and any data already written is verified.
+When receiving, the progress of files is recorded as they are written, so
+transfers of files that were updated using deltas also continue from where
+they stopped.
+
+
+--jobs -j
+type=int
+default=0
+The number of files to transfer concurrently. When greater than one, the
+signatures and deltas for several files are calculated in parallel and the data
+of the files is interleaved. Useful when transferring many files with
+:option:`--transmit-deltas` as it hides the latency of exchanging signatures.
+By default, when the terminal supports multiplexing, the data of up to four
+files is interleaved so that small files are not stuck waiting for large ones,
+otherwise files are transferred one at a time.
+
+
+--bwlimit
+Limit the rate at which data is written to the terminal, for example:
+:code:`2MB/s` or :code:`512KiB/s`. The limit is shared by all files being
+transferred, so that large transfers over a slow link do not make interactive
+use of the terminal sluggish. When receiving files, the terminal is asked to
+limit the rate at which it sends data, which works only with terminals that
+support it.
+
+
+--exclude
+type=list
+Exclude files matching the specified glob pattern. Can be specified multiple
+times. Patterns are matched against paths relative to the parent of the
+directories being transferred, with :code:`/` as the separator. A pattern
+without a leading :code:`/` matches at any level, for example, :code:`.git` or
+:code:`*.o`. A pattern starting with :code:`/` matches only starting at the
+top level, for example, :code:`/mydir/build`. A pattern ending with :code:`/`
+matches only directories. :code:`*` and :code:`?` do not match :code:`/` while
+:code:`**` matches anything. When a directory is excluded, all its contents are
+excluded as well. The patterns are evaluated on the computer sending the files.
+
+
+--include
+type=list
+Include files matching the specified glob pattern, even if they match an
+:option:`--exclude` pattern. Can be specified multiple times. Uses the same
+syntax as :option:`--exclude`. For example, to transfer only Python files use:
+:code:`--include '*.py' --include '*/' --exclude '*'`.
+
+
+--filter-from
+Read include and exclude rules from the specified file. Every line in the file
+is a rule, starting with either :code:`+` for include or :code:`-` for exclude
+followed by a space and a pattern. Blank lines and lines starting with
+:code:`#` are ignored. The first rule matching a file decides whether it is
+transferred. Rules from :option:`--include` and :option:`--exclude` are checked
+before the rules in this file.
+
+
+--min-size
+Do not transfer files smaller than the specified size, for example:
+:code:`10KB` or :code:`1.5MiB`. Units without an :code:`i` are SI units, so
+:code:`k` is 1000 and :code:`Ki` is 1024. Only applies to regular files,
+files excluded this way are not deleted by :option:`--delete`.
+
+
+--max-size
+Do not transfer files larger than the specified size, for example:
+:code:`100MB`. Uses the same syntax as :option:`--min-size`.
+
+
+--newer-than
+Only transfer files modified after the specified time. Either a duration before
+now, with one of the units :code:`s`, :code:`m`, :code:`h`, :code:`d` or
+:code:`w`, for example, :code:`3d` for files modified in the last three days,
+or a date with an optional time in the local timezone, for example,
+:code:`2023-07-01` or :code:`2023-07-01T14:30`. Only applies to regular files.
+
+
+--delete
+type=bool-set
+After transferring directories, delete files in the destination directories
+that are not present in the source directories, making the destination an
+exact copy of the source. Files excluded by :option:`--exclude` are not deleted.
+Files are never deleted outside the destination directories, even if they
+contain symlinks to other locations. Use :option:`--dry-run` to see what would
+be deleted. Only supported when receiving files, with
+:code:`--direction=upload`.
+
+
+--dry-run -n
+type=bool-set
+Show what would be transferred and deleted, without actually changing anything.
+Only supported when receiving files, with :code:`--direction=upload`.
+
+
+--dedup
+type=bool-set
+Remember the files received, so that blocks of data already present in them
+are not sent again, for example, when files are renamed or copied on the
+sending computer or when they share data with previously received files.
+Some previously received files, preferring those with the same size and
+modification time as the files being received, followed by the most
+recently received ones, are used as reference files, that blocks in all
+files are copied from. The signatures of remembered files are cached, so
+they are calculated only once. The data is always verified. Only supported
+when receiving files, with :code:`--direction=upload`, from a terminal that
+supports reference files.
+
+
+--verify
+type=bool-set
+After each file is transferred, calculate a SHA-256 checksum of the file on
+both computers and report any files whose checksums do not match, exiting with
+a non-zero exit code. Useful when transferring irreplaceable data. Requires
+the terminal to support sending checksums.
+
+
+--xattrs -X
+type=bool-set
+Preserve extended attributes and file flags. On Linux this includes ACLs, as
+they are stored as extended attributes. Metadata that cannot be read or applied,
+for example because the filesystem does not support it or it needs elevated
+privileges, is skipped and a summary of what could not be preserved is printed
+at the end of the transfer. Note that when the terminal is running on macOS it
+cannot read or apply extended attributes, only file flags.
+
+
+--sparse -S
+type=bool-set
+Preserve the holes in sparse files, such as disk images and virtual machine
+drives, instead of filling them with zeros. Only the data in sparse files is
+transmitted, saving bandwidth as well as disk space. Requires the terminal to
+support sparse files. Does not apply to files transferred using deltas, see
+:option:`--transmit-deltas`.
+
+
+--links
+default=preserve
+choices=preserve,follow,skip,munge-unsafe
+How to handle symbolic links. With :code:`preserve` they are recreated as
+symbolic links. With :code:`follow` the files and directories they point to
+are transferred in their place, dangling links and links that would cause a
+directory to be transferred inside itself are ignored. Following links when
+receiving files requires the terminal to support it. With :code:`skip`
+symbolic links are not transferred at all. With :code:`munge-unsafe` links are
+preserved, but links that are absolute or point outside the transferred tree
+have their targets prefixed with :file:`/rsyncd-munged/`, the same as
+rsync does, so that they cannot be used to access files outside the
+destination.
+
+
+--queue -Q
+type=bool-set
+When sending files, show an interactive list of the queued, active and
+completed files with the progress of each file. Use the arrow keys to select a
+file, :kbd:`p` to pause or resume it, :kbd:`t` to send it next, :kbd:`+` and
+:kbd:`-` to move it up or down the queue and :kbd:`x` to cancel it, without
+aborting the rest of the transfer. Cancelling a file whose data has started
+being sent requires the terminal to support it.
+
+
+--max-retries
+type=int
+default=0
+The number of times to retry sending a file that the terminal failed to write,
+for example, because of a transient error on the receiving computer, instead of
+reporting it as failed. The delay before each retry doubles, starting at one
+second. Files are retried using the rsync algorithm, so that the data already
+written is not sent again. Only supported when sending files and requires the
+terminal to support it.
+
+
+--on-file-complete
+A command to run on the computer running the kitten, after each regular file is
+transferred or fails. The command is split into words the same way as a shell
+would, but is not run by a shell. The metadata of the file is passed in the
+environment variables :code:`KITTY_TRANSFER_PATH` (the local path),
+:code:`KITTY_TRANSFER_REMOTE_PATH`, :code:`KITTY_TRANSFER_SIZE`,
+:code:`KITTY_TRANSFER_DIRECTION` (:code:`send` or :code:`receive`) and
+:code:`KITTY_TRANSFER_STATUS` (:code:`OK` or an error message), and as a JSON
+object on STDIN. The commands are run one at a time, in the order the files
+complete, without blocking the transfer. Their output is shown only if they
+fail, in which case the kitten exits with a non-zero exit code.
+
+
+--on-session-complete
+A command to run on the computer running the kitten, after the transfer is
+complete and all the :option:`--on-file-complete` commands have finished. The
+environment variables :code:`KITTY_TRANSFER_FILES`,
+:code:`KITTY_TRANSFER_FAILED`, :code:`KITTY_TRANSFER_BYTES` and
+:code:`KITTY_TRANSFER_DIRECTION` are set, and a JSON object with the same
+information and a list of the transferred regular files is passed on STDIN.
+The output of the command is written to STDERR.
+
+
+--output-format
+default=text
+choices=text,json
+The format for reporting progress. With :code:`json`, newline delimited JSON
+objects describing the transfer are written to STDERR, so that scripts can
+monitor it. Every object has an :code:`event` key, one of :code:`file_started`,
+:code:`progress`, :code:`file_done`, :code:`error` and :code:`totals`, and an
+:code:`elapsed` key with the number of seconds since the transfer started.
 '''
 
 
@@ -0,0 +1,276 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"kitty/tools/tui"
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// The files that have data, in the order in which they will be sent
+func (self *SendManager) queued_files() []*File {
+	return utils.Filter(self.files, func(f *File) bool { return f.file_type == FileType_regular })
+}
+
+// Whether the sending of the data of the file has not yet started
+func (self *SendManager) is_pending(f *File) bool {
+	return f.state != ACKNOWLEDGED && !f.data_sent && !slices.Contains(self.active_files, f)
+}
+
+// Move the file to the specified position in the queue of files with data,
+// shifting the files in between by one place
+func (self *SendManager) move_in_queue(f *File, pos int) {
+	q := self.queued_files()
+	idx := slices.Index(q, f)
+	pos = utils.Max(0, utils.Min(pos, len(q)-1))
+	if idx < 0 || pos == idx {
+		return
+	}
+	lo, hi := utils.Min(idx, pos), utils.Max(idx, pos)
+	positions := make([]int, 0, hi-lo+1)
+	for i, x := range self.files {
+		if len(positions) <= hi-lo && x == q[lo+len(positions)] {
+			positions = append(positions, i)
+		}
+	}
+	moved := slices.Clone(q[lo : hi+1])
+	if pos < idx {
+		moved = append([]*File{f}, moved[:len(moved)-1]...)
+	} else {
+		moved = append(moved[1:], f)
+	}
+	for i, x := range moved {
+		self.files[positions[i]] = x
+	}
+}
+
+// Move the file ahead of all other files that have not started being sent
+func (self *SendManager) send_next(f *File) {
+	q := self.queued_files()
+	pos := slices.Index(q, f)
+	for pos > 0 && self.is_pending(q[pos-1]) {
+		pos--
+	}
+	self.move_in_queue(f, pos)
+}
+
+// Pause or resume sending the data of the file
+func (self *SendManager) toggle_pause(f *File) {
+	if f.state == ACKNOWLEDGED || f.state == FINISHED {
+		return
+	}
+	f.paused = !f.paused
+	if f.paused {
+		self.deactivate_file(f)
+	}
+}
+
+// Cancel the transfer of a single file, leaving the rest of the transfer
+// unaffected. Files whose data has started being sent can only be canceled if
+// the terminal supports it, as it has to discard the partially written file.
+func (self *SendManager) cancel_file(f *File, send func(string)) error {
+	switch f.state {
+	case ACKNOWLEDGED:
+		return nil
+	case FINISHED:
+		return fmt.Errorf("All the data of %s has already been sent", f.display_name)
+	}
+	if f.data_sent {
+		if !self.cancel_file_supported {
+			return fmt.Errorf("The terminal does not support cancelling files whose data has started being sent")
+		}
+		send(FileTransmissionCommand{Action: Action_cancel, File_id: f.file_id}.Serialize())
+	}
+	f.canceled = true
+	f.err_msg = "Canceled"
+	f.state = ACKNOWLEDGED
+	f.stop_reading()
+	self.events.file_done(f.expanded_local_path, f.file_size, f.err_msg)
+	self.on_file_hook(f)
+	self.progress_tracker.on_file_done(f)
+	self.file_done(f)
+	self.deactivate_file(f)
+	self.update_collective_statuses()
+	return nil
+}
+
+// An interactive view of the queue of files being sent, for --queue
+type queue_view struct {
+	selected *File
+	// the index of the first displayed file
+	scroll  int
+	message string
+}
+
+func (self *SendHandler) draw_queue() {
+	self.lp.StartAtomicUpdate()
+	defer self.lp.EndAtomicUpdate()
+	self.lp.AllowLineWrapping(false)
+	defer self.lp.AllowLineWrapping(true)
+	self.lp.ClearScreen()
+	m, qv := self.manager, self.queue
+	files := m.queued_files()
+	if len(files) > 0 && !slices.Contains(files, qv.selected) {
+		qv.selected = files[0]
+	}
+	var num_done, num_failed, num_active, num_paused int
+	for _, f := range files {
+		switch {
+		case f.state == ACKNOWLEDGED && f.err_msg != "":
+			num_failed++
+		case f.state == ACKNOWLEDGED:
+			num_done++
+		case f.paused:
+			num_paused++
+		case !m.is_pending(f):
+			num_active++
+		}
+	}
+	sz, _ := self.lp.ScreenSize()
+	width, height := int(sz.WidthCells), int(sz.HeightCells)
+	self.lp.Println(self.ctx.Bold(fmt.Sprintf("Sending %d files:", len(files))), fmt.Sprintf(
+		"%d done, %d failed, %d active, %d paused, %d queued", num_done, num_failed, num_active, num_paused,
+		len(files)-num_done-num_failed-num_active-num_paused))
+	sc := self.spinner.Tick()
+	is_complete := self.quit_after_write_code > -1
+	if p := m.progress_tracker; p.total_reported_progress > 0 {
+		self.render_progress(`Total`, Progress{
+			spinner_char: sc, bytes_so_far: p.total_reported_progress, total_bytes: p.total_bytes_to_transfer,
+			secs_so_far: time.Since(p.started_at).Seconds(), is_complete: is_complete,
+			bytes_per_sec: safe_divide(p.transfered_stats_amt, p.transfered_stats_interval.Abs().Seconds()),
+		})
+	} else {
+		self.lp.QueueWriteString(`File data transfer has not yet started`)
+	}
+	self.lp.Println()
+	self.lp.Println(tui.RepeatChar(`─`, width))
+
+	num_rows := utils.Max(1, height-5)
+	sel := slices.Index(files, qv.selected)
+	if sel < qv.scroll {
+		qv.scroll = sel
+	} else if sel >= qv.scroll+num_rows {
+		qv.scroll = sel - num_rows + 1
+	}
+	qv.scroll = utils.Max(0, utils.Min(qv.scroll, len(files)-num_rows))
+	for i := qv.scroll; i < len(files) && i < qv.scroll+num_rows; i++ {
+		f := files[i]
+		self.lp.QueueWriteString(utils.IfElse(f == qv.selected, self.ctx.Cyan(`❯ `), `  `))
+		self.lp.QueueWriteString(self.render_queued_file(f, sc, width-2))
+		self.lp.Println()
+	}
+
+	self.lp.MoveCursorTo(1, height-1)
+	if qv.message != "" {
+		self.lp.QueueWriteString(self.ctx.BrightRed(qv.message))
+	}
+	self.lp.MoveCursorTo(1, height)
+	self.lp.QueueWriteString(self.ctx.Dim(wcswidth.TruncateToVisualLength(
+		"↑↓ select  p pause/resume  t send next  +/- move  x cancel file  Esc cancel all", width)))
+	self.schedule_progress_update(self.spinner.Interval())
+	self.progress_drawn = true
+}
+
+func (self *SendHandler) render_queued_file(f *File, spinner_char string, width int) string {
+	status := func(sc, msg string) string {
+		name := render_path_in_width(f.display_name, utils.Max(1, width-wcswidth.Stringwidth(msg)-3))
+		return sc + ` ` + name + ` ` + msg
+	}
+	switch {
+	case f.state == ACKNOWLEDGED && f.err_msg != "":
+		return status(self.ctx.Err(`✘`), self.ctx.Red(f.err_msg))
+	case f.state == ACKNOWLEDGED:
+		return render_progress_in_width(f.display_name, self.progress_for_file(f, self.ctx.Green(`✔`), true), width, self.ctx)
+	case f.paused && f.data_sent:
+		return render_progress_in_width(f.display_name, self.progress_for_file(f, `‖`, false), width, self.ctx)
+	case f.paused:
+		return status(`‖`, self.ctx.Dim(`paused`))
+	case self.manager.is_pending(f):
+		return status(self.ctx.Dim(`·`), self.ctx.Dim(humanize.Size(f.file_size)+` queued`))
+	}
+	return render_progress_in_width(f.display_name, self.progress_for_file(f, spinner_char, false), width, self.ctx)
+}
+
+// Move the selection by amt files
+func (self *SendHandler) move_queue_selection(amt int) {
+	files := self.manager.queued_files()
+	if idx := slices.Index(files, self.queue.selected); idx > -1 {
+		self.queue.selected = files[utils.Max(0, utils.Min(idx+amt, len(files)-1))]
+	}
+}
+
+// Handle the keys that act on the queue, returns true if the key was handled
+func (self *SendHandler) on_queue_key_event(ev *loop.KeyEvent) bool {
+	sz, _ := self.lp.ScreenSize()
+	page := utils.Max(1, int(sz.HeightCells)-6)
+	num := len(self.manager.files)
+	switch {
+	case ev.MatchesPressOrRepeat("up"):
+		self.move_queue_selection(-1)
+	case ev.MatchesPressOrRepeat("down"):
+		self.move_queue_selection(1)
+	case ev.MatchesPressOrRepeat("page_up"):
+		self.move_queue_selection(-page)
+	case ev.MatchesPressOrRepeat("page_down"):
+		self.move_queue_selection(page)
+	case ev.MatchesPressOrRepeat("home"):
+		self.move_queue_selection(-num)
+	case ev.MatchesPressOrRepeat("end"):
+		self.move_queue_selection(num)
+	case ev.MatchesPressOrRepeat("delete"):
+		self.on_queue_text("x")
+		return true
+	default:
+		return false
+	}
+	self.queue.message = ""
+	self.refresh_progress(0)
+	return true
+}
+
+// Handle the text keys that act on the queue
+func (self *SendHandler) on_queue_text(text string) {
+	qv, m := self.queue, self.manager
+	f := qv.selected
+	if f == nil {
+		return
+	}
+	qv.message = ""
+	files := m.queued_files()
+	switch text {
+	case "k":
+		self.move_queue_selection(-1)
+	case "j":
+		self.move_queue_selection(1)
+	case "p", " ":
+		m.toggle_pause(f)
+	case "t":
+		m.send_next(f)
+	case "+":
+		m.move_in_queue(f, slices.Index(files, f)-1)
+	case "-":
+		m.move_in_queue(f, slices.Index(files, f)+1)
+	case "x":
+		if err := m.cancel_file(f, self.send_payload); err != nil {
+			qv.message = err.Error()
+		}
+	default:
+		return
+	}
+	self.refresh_progress(0)
+	// resuming or cancelling a file can make data available to send or
+	// complete the transfer
+	if self.transmit_started && m.current_chunk_uncompressed_sz < 0 && self.throttle_timer == 0 {
+		self.lp.CallSoon(self.loop_tick)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -86,10 +87,12 @@ func (pf *patch_file) close() (err error) {
 		return
 	}
 	err = pf.p.FinishDelta()
-	pf.src.Close()
+	if pf.src != nil {
+		pf.src.Close()
+	}
 	pf.temp.Close()
 	if err == nil {
-		err = os.Rename(pf.temp.Name(), pf.src.Name())
+		err = os.Rename(pf.temp.Name(), pf.path)
 	}
 	pf.src = nil
 	pf.temp = nil
@@ -105,21 +108,28 @@ func (pf *patch_file) write(data []byte) (int, error) {
 	}
 }
 
-func new_patch_file(path string, p *rsync.Patcher) (ans *patch_file, err error) {
+// Apply the delta to base, which can be empty when the delta does not copy
+// blocks from it
+func new_patch_file(path, base string, p *rsync.Patcher) (ans *patch_file, err error) {
 	ans = &patch_file{p: p, path: path}
 	var f *os.File
-	if f, err = os.Open(path); err != nil {
-		return
-	} else {
-		ans.src = f
+	var src io.ReadSeeker = strings.NewReader("")
+	if base != "" {
+		if f, err = os.Open(base); err != nil {
+			return
+		}
+		ans.src, src = f, f
 	}
 	if f, err = os.CreateTemp(filepath.Dir(path), ""); err != nil {
-		ans.src.Close()
+		if ans.src != nil {
+			ans.src.Close()
+		}
 		return
 	} else {
 		ans.temp = f
 	}
-	ans.p.StartDelta(ans.temp, ans.src)
+	ans.p.SetSparseOutput(true)
+	ans.p.StartDelta(ans.temp, src)
 	return
 }
 
@@ -146,6 +156,81 @@ type remote_file struct {
 	remote_symlink_value         string
 	actual_file                  output_file
 	patch_file                   patch_file
+	// Set when the file was transferred by a previous, interrupted session
+	already_transferred bool
+	xattrs              extended_metadata
+	// Set for sparse files, only the data in the extents is received
+	hole_map *hole_map
+	// Set when the data is written to STDOUT instead of a local file
+	stream *stream_file
+	// Set when the data is received as a delta that can copy blocks from the
+	// reference files, see --dedup
+	use_references bool
+	// Set when there is no local file to apply the delta to, so the delta
+	// consists only of data and blocks from the reference files
+	empty_basis bool
+	// Set when resuming a delta that was partially applied by a previous,
+	// interrupted session. The file the delta is applied to, consisting of
+	// the output written by that session followed by the original file.
+	resume_basis string
+	// The number of bytes written when the progress of the file was last
+	// recorded in the journal
+	journaled_bytes int64
+}
+
+func (self *remote_file) journal_key() string {
+	return journal_key(self.remote_path, self.expanded_local_path)
+}
+
+func (self *remote_file) is_already_transferred(journal *transfer_journal) bool {
+	if self.ftype != FileType_regular || !journal.is_done(self.journal_key(), self.expected_size, time.Unix(0, int64(self.mtime))) {
+		return false
+	}
+	s, err := os.Stat(self.expanded_local_path)
+	return err == nil && s.Size() == self.expected_size
+}
+
+// Continue a transfer interrupted by a previous session. Data written directly
+// to the local file is used by the rsync algorithm without needing anything
+// further. Data written to the temporary file of a delta is combined with the
+// original file to form the basis for the new delta.
+func (self *remote_file) resume_partial_transfer(journal *transfer_journal) {
+	e, found := journal.partial(self.journal_key(), self.expected_size, time.Unix(0, int64(self.mtime)))
+	if !found {
+		if e, found = journal.entries[self.journal_key()]; found && e.Temp != "" {
+			// the file changed since the previous session
+			os.Remove(e.Temp)
+		}
+		return
+	}
+	if e.Temp == "" {
+		return
+	}
+	err := func() error {
+		f, err := os.OpenFile(e.Temp, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err = f.Truncate(e.Partial); err != nil {
+			return err
+		}
+		if _, err = f.Seek(e.Partial, io.SeekStart); err != nil {
+			return err
+		}
+		if src, err := os.Open(self.expanded_local_path); err == nil {
+			defer src.Close()
+			if _, err = io.Copy(f, src); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err == nil {
+		self.resume_basis = e.Temp
+	} else {
+		os.Remove(e.Temp)
+	}
 }
 
 func (self *remote_file) close() (err error) {
@@ -173,13 +258,15 @@ func (self *remote_file) Write(data []byte) (n int, err error) {
 		self.remote_symlink_value += string(data)
 		return len(data), nil
 	case FileType_regular:
-		if self.actual_file == nil {
+		if self.actual_file == nil && self.stream != nil {
+			self.actual_file = self.stream
+		} else if self.actual_file == nil {
 			parent := filepath.Dir(self.expanded_local_path)
 			if parent != "" {
 				os.MkdirAll(parent, 0o755)
 			}
 			if self.expect_diff {
-				if pf, err := new_patch_file(self.expanded_local_path, self.patcher); err != nil {
+				if pf, err := new_patch_file(self.expanded_local_path, self.delta_base(), self.patcher); err != nil {
 					return 0, err
 				} else {
 					self.actual_file = pf
@@ -187,6 +274,8 @@ func (self *remote_file) Write(data []byte) (n int, err error) {
 			} else {
 				if ff, err := os.Create(self.expanded_local_path); err != nil {
 					return 0, err
+				} else if self.hole_map != nil {
+					self.actual_file = &sparse_file{f: ff, hm: self.hole_map}
 				} else {
 					f := filesystem_file{f: ff}
 					self.actual_file = &f
@@ -214,6 +303,10 @@ func (self *remote_file) write_data(data []byte, is_last bool) (amt_written int6
 	err = self.decompressor(data, is_last)
 	if is_last {
 		self.decompressor = nil
+		if err == nil && self.actual_file == nil && self.hole_map != nil {
+			// a file that is entirely a hole has no data
+			_, err = self.Write(nil)
+		}
 	}
 	if self.actual_file != nil && err == nil {
 		pos, err = self.actual_file.tell()
@@ -230,6 +323,23 @@ func (self *remote_file) write_data(data []byte, is_last bool) (amt_written int6
 			err = cerr
 		}
 		self.actual_file = nil
+		if err == nil && self.resume_basis != "" {
+			os.Remove(self.resume_basis)
+			self.resume_basis = ""
+		}
+	}
+	return
+}
+
+// The number of bytes of output written to the local file and the
+// temporary file the output is written to, if any
+func (self *remote_file) progress() (written int64, temp string) {
+	if self.actual_file == nil {
+		return
+	}
+	written, _ = self.actual_file.tell()
+	if pf, ok := self.actual_file.(*patch_file); ok && pf.temp != nil {
+		temp = pf.temp.Name()
 	}
 	return
 }
@@ -250,6 +360,7 @@ func syscall_mode(i os.FileMode) (o uint32) {
 }
 
 func (self *remote_file) apply_metadata() {
+	self.xattrs.apply_xattrs(self.expanded_local_path, self.ftype == FileType_symlink)
 	t := unix.NsecToTimespec(int64(self.mtime))
 	for {
 		if err := unix.UtimesNanoAt(unix.AT_FDCWD, self.expanded_local_path, []unix.Timespec{t, t}, unix.AT_SYMLINK_NOFOLLOW); err == nil || !(errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN)) {
@@ -267,7 +378,7 @@ func (self *remote_file) apply_metadata() {
 	}
 }
 
-func new_remote_file(opts *Options, ftc *FileTransmissionCommand, file_id uint64) (*remote_file, error) {
+func new_remote_file(opts *Options, ftc *FileTransmissionCommand, file_id uint64, compression Compression) (*remote_file, error) {
 	spec_id, err := strconv.Atoi(ftc.File_id)
 	if err != nil {
 		return nil, err
@@ -277,8 +388,22 @@ func new_remote_file(opts *Options, ftc *FileTransmissionCommand, file_id uint64
 		permissions: ftc.Permissions, remote_path: ftc.Name, display_name: wcswidth.StripEscapeCodes(ftc.Name),
 		remote_id: ftc.Status, remote_target: string(ftc.Data), parent: ftc.Parent,
 	}
+	if ans.xattrs, err = extended_metadata_from_ftc(ftc); err != nil {
+		return nil, err
+	}
+	if ftc.Ftype == FileType_regular {
+		if ans.hole_map, err = parse_hole_map(ftc.Extents); err != nil {
+			return nil, err
+		}
+		if ans.hole_map != nil && ans.hole_map.size != ftc.Size {
+			return nil, fmt.Errorf("The hole map of %s does not match its size", ftc.Name)
+		}
+	}
 	compression_capable := ftc.Ftype == FileType_regular && ftc.Size > 4096 && should_be_compressed(ftc.Name, opts.Compress)
-	if compression_capable {
+	if compression_capable && compression == Compression_zstd {
+		ans.decompressor = utils.NewStreamDecompressor(new_zstd_reader, ans)
+		ans.compression_type = Compression_zstd
+	} else if compression_capable {
 		ans.decompressor = utils.NewStreamDecompressor(zlib.NewReader, ans)
 		ans.compression_type = Compression_zlib
 	} else {
@@ -301,9 +426,11 @@ type receive_progress_tracker struct {
 }
 
 func (self *receive_progress_tracker) change_active_file(nf *remote_file) {
-	now := time.Now()
 	self.active_file = nf
-	nf.transmit_started_at = now
+	if nf.transmit_started_at.IsZero() {
+		// files can be received interleaved, so a file can become active more than once
+		nf.transmit_started_at = time.Now()
+	}
 }
 
 func (self *receive_progress_tracker) start_transfer() {
@@ -351,6 +478,26 @@ type manager struct {
 	files_to_be_transferred map[string]*remote_file
 	state                   state
 	progress_tracker        receive_progress_tracker
+	journal                 *transfer_journal
+	wakeup                  func()
+	bwlimit                 *token_bucket
+	deleted                 []string
+	verification_failures   []verification_failure
+	// Files excluded because of their size or modification time
+	excluded_files []*remote_file
+	// The compression algorithm agreed upon with the terminal
+	compression Compression
+	events      *event_writer
+	hooks       *hook_runner
+	// The cache of previously received files, for --dedup
+	dedup *dedup_cache
+	// Whether the terminal supports reference files
+	references_supported bool
+}
+
+type verification_failure struct {
+	file *remote_file
+	err  error
 }
 
 type transmit_iterator = func(queue_write func(string) loop.IdType) (loop.IdType, error)
@@ -376,51 +523,153 @@ func (self *sigwriter) Write(b []byte) (int, error) {
 
 var files_done error = errors.New("files done")
 
+// Returned by the transmit iterator when the signature of the next file is
+// still being calculated
+var signature_not_ready error = errors.New("signature not ready")
+
+type signature_result struct {
+	patcher *rsync.Patcher
+	data    []byte
+	err     error
+}
+
+func (self *manager) wants_signature(f *remote_file) bool {
+	if f.ftype != FileType_regular || f.stream != nil {
+		return false
+	}
+	if f.use_references || f.resume_basis != "" {
+		return true
+	}
+	if !self.use_rsync {
+		return false
+	}
+	s, err := os.Lstat(f.expanded_local_path)
+	return err == nil && s.Size() > 4096
+}
+
+func create_signature(f *remote_file, output io.Writer, dedup *dedup_cache) (p *rsync.Patcher, err error) {
+	if f.use_references {
+		p = dedup.new_patcher(f.expected_size)
+	} else {
+		p = rsync.NewPatcher(f.expected_size, nil)
+	}
+	var src io.Reader = strings.NewReader("")
+	var size int64
+	if base := f.delta_base(); base != "" {
+		fsf, err := os.Open(base)
+		if err != nil {
+			return nil, err
+		}
+		defer fsf.Close()
+		s, err := fsf.Stat()
+		if err != nil {
+			return nil, err
+		}
+		src, size = fsf, s.Size()
+	}
+	var s_it func() error
+	if size > 8*rsync.ConcurrentSignatureSegmentSize {
+		s_it = p.CreateSignatureIteratorConcurrent(src, output, 0)
+	} else {
+		s_it = p.CreateSignatureIterator(src, output)
+	}
+	for {
+		err = s_it()
+		if err == io.EOF {
+			return p, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Calculate the signatures of all files that need them using jobs worker
+// goroutines, so that they are ready by the time the files are requested
+func (self *manager) calculate_signatures(jobs int) map[string]chan signature_result {
+	ans := make(map[string]chan signature_result)
+	todo := make(chan *remote_file, len(self.files))
+	for _, f := range self.files {
+		if !f.already_transferred && self.wants_signature(f) {
+			ans[f.file_id] = make(chan signature_result, 1)
+			todo <- f
+		}
+	}
+	close(todo)
+	for i := 0; i < utils.Min(jobs, len(ans)); i++ {
+		go func() {
+			for f := range todo {
+				buf := bytes.Buffer{}
+				p, err := create_signature(f, &buf, self.dedup)
+				ans[f.file_id] <- signature_result{patcher: p, data: buf.Bytes(), err: err}
+				self.wakeup()
+			}
+		}()
+	}
+	return ans
+}
+
 func (self *manager) request_files() transmit_iterator {
 	pos := 0
+	self.use_references()
+	var references []*reference_file
+	if self.dedup != nil {
+		references = self.dedup.references
+	}
+	var pending map[string]chan signature_result
+	if self.cli_opts.Jobs > 1 && (self.use_rsync || self.dedup != nil) {
+		pending = self.calculate_signatures(self.cli_opts.Jobs)
+	}
 	return func(queue_write func(string) loop.IdType) (last_write_id loop.IdType, err error) {
-		var f *remote_file
+		// the reference files must be sent before the files using them
+		if len(references) > 0 {
+			last_write_id = self.send_reference(references[0], queue_write)
+			references = references[1:]
+			return
+		}
 		for pos < len(self.files) {
-			f = self.files[pos]
-			pos++
-			if f.ftype == FileType_directory || (f.ftype == FileType_link && f.remote_target != "") {
-				f = nil
+			f := self.files[pos]
+			if f.ftype == FileType_directory || (f.ftype == FileType_link && f.remote_target != "") || f.already_transferred {
+				pos++
 			} else {
 				break
 			}
 		}
-		if f == nil {
+		if pos >= len(self.files) {
 			return 0, files_done
 		}
-		read_signature := self.use_rsync && f.ftype == FileType_regular
-		if read_signature {
-			if s, err := os.Lstat(f.expanded_local_path); err == nil {
-				read_signature = s.Size() > 4096
-			} else {
-				read_signature = false
+		f := self.files[pos]
+		var sig *signature_result
+		if ch := pending[f.file_id]; ch != nil {
+			select {
+			case r := <-ch:
+				sig = &r
+			default:
+				return 0, signature_not_ready
 			}
 		}
+		pos++
+		read_signature := sig != nil || (pending == nil && self.wants_signature(f))
+		if read_signature {
+			// deltas are applied with sparse output instead
+			f.hole_map = nil
+		}
 		last_write_id = self.send(FileTransmissionCommand{
 			Action: Action_file, Name: f.remote_path, File_id: f.file_id, Ttype: utils.IfElse(
 				read_signature, TransmissionType_rsync, TransmissionType_simple), Compression: f.compression_type,
+			Checksum: utils.IfElse(self.cli_opts.Verify && f.ftype == FileType_regular, checksum_algorithm, ""),
+			Extents:  f.hole_map.String(),
 		}, queue_write)
 		if read_signature {
-			fsf, err := os.Open(f.expanded_local_path)
-			if err != nil {
-				return 0, err
-			}
-			defer fsf.Close()
 			f.expect_diff = true
-			f.patcher = rsync.NewPatcher(f.expected_size)
 			output := sigwriter{q: queue_write, file_id: f.file_id, prefix: self.prefix, suffix: self.suffix}
-			s_it := f.patcher.CreateSignatureIterator(fsf, &output)
-			for {
-				err = s_it()
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					return 0, err
+			if sig != nil {
+				if sig.err != nil {
+					return 0, sig.err
 				}
+				f.patcher = sig.patcher
+				output.Write(sig.data)
+			} else if f.patcher, err = create_signature(f, &output, self.dedup); err != nil {
+				return 0, err
 			}
 			f.sent_bytes += output.amt
 			last_write_id = self.send(FileTransmissionCommand{Action: Action_end_data, File_id: f.file_id}, queue_write)
@@ -443,6 +692,8 @@ type handler struct {
 	max_name_length       int
 	transmit_iterator     transmit_iterator
 	last_data_write_id    loop.IdType
+	waiting_for_signature bool
+	throttle              time.Duration
 }
 
 var debugprintln = tty.DebugPrintln
@@ -454,7 +705,27 @@ func (self *manager) send(c FileTransmissionCommand, send func(string) loop.IdTy
 }
 
 func (self *manager) start_transfer(send func(string) loop.IdType) {
-	self.send(FileTransmissionCommand{Action: Action_receive, Bypass: self.bypass, Size: int64(len(self.spec))}, send)
+	ftc := FileTransmissionCommand{
+		Action: Action_receive, Bypass: self.bypass, Size: int64(len(self.spec)), Compressions: supported_compressions,
+		// the data of files can be received interleaved
+		Features: utils.IfElse(self.dedup != nil, "multiplex,references", "multiplex"),
+		// the terminal limits the rate at which it sends the data of files
+		Rate: self.bwlimit.limit(),
+	}
+	if self.cli_opts != nil {
+		preserve := []string{}
+		if self.cli_opts.Xattrs {
+			preserve = append(preserve, "xattrs")
+		}
+		if self.cli_opts.Sparse {
+			preserve = append(preserve, "sparse")
+		}
+		ftc.Preserve = strings.Join(preserve, ",")
+		if self.cli_opts.Links == "follow" {
+			ftc.Links = self.cli_opts.Links
+		}
+	}
+	self.send(ftc, send)
 	for i, x := range self.spec {
 		self.send(FileTransmissionCommand{Action: Action_file, File_id: strconv.Itoa(i), Name: x}, send)
 	}
@@ -462,6 +733,7 @@ func (self *manager) start_transfer(send func(string) loop.IdType) {
 }
 
 func (self *handler) print_err(err error) {
+	self.manager.events.error(err)
 	self.lp.Println(self.ctx.BrightRed(err.Error()))
 }
 
@@ -491,6 +763,10 @@ func (self *manager) finalize_transfer() (err error) {
 		rid_map[f.remote_id] = f
 	}
 	for _, f := range self.files {
+		if f.stream != nil {
+			// STDOUT has no metadata
+			return
+		}
 		switch f.ftype {
 		case FileType_directory:
 			if err = os.MkdirAll(f.expanded_local_path, 0o755); err != nil {
@@ -521,6 +797,13 @@ func (self *manager) finalize_transfer() (err error) {
 						return fmt.Errorf(`Could not make symlink relative with error: %w`, err)
 					}
 				}
+			} else if lt != "" && self.cli_opts != nil && self.cli_opts.Links == "munge-unsafe" {
+				root := f
+				for root.parent != "" && rid_map[root.parent] != nil {
+					root = rid_map[root.parent]
+				}
+				rel, _ := filepath.Rel(filepath.Dir(root.expanded_local_path), f.expanded_local_path)
+				lt = munged_symlink_target(filepath.ToSlash(rel), lt)
 			}
 			if lt == "" {
 				return fmt.Errorf("Symlink %s sent without target", f.expanded_local_path)
@@ -535,6 +818,15 @@ func (self *manager) finalize_transfer() (err error) {
 		}
 		f.apply_metadata()
 	}
+	// flags such as immutable are applied last and to the contents of
+	// directories before the directories themselves
+	for i := len(self.files) - 1; i >= 0; i-- {
+		f := self.files[i]
+		f.xattrs.apply_flags(f.expanded_local_path, f.ftype == FileType_symlink)
+	}
+	if self.cli_opts != nil && self.cli_opts.Delete {
+		err = self.delete_extraneous_files()
+	}
 	return
 }
 
@@ -544,6 +836,8 @@ func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 		if ftc.Action == Action_status {
 			if ftc.Status == `OK` {
 				self.state = state_waiting_for_file_metadata
+				self.compression = negotiated_compression(ftc)
+				self.references_supported = slices.Contains(strings.Split(ftc.Features, ","), "references")
 			} else {
 				return unicode_input.ErrCanceledByUser
 			}
@@ -580,7 +874,7 @@ func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 			}
 			self.spec_counts[fid] += 1
 			self.file_id_counter++
-			if rf, err := new_remote_file(self.cli_opts, ftc, self.file_id_counter); err == nil {
+			if rf, err := new_remote_file(self.cli_opts, ftc, self.file_id_counter, self.compression); err == nil {
 				self.files = append(self.files, rf)
 			} else {
 				return err
@@ -595,11 +889,40 @@ func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 				return fmt.Errorf(`Got data for unknown file id: %s`, ftc.File_id)
 			}
 			is_last := ftc.Action == Action_end_data
+			if f.transmit_started_at.IsZero() {
+				self.events.file_started(f.expanded_local_path, f.expected_size)
+			}
 			if amt_written, err := f.write_data(ftc.Data, is_last); err != nil {
+				self.events.file_done(f.expanded_local_path, f.expected_size, err.Error())
+				self.on_file_hook(f, err.Error())
 				return err
 			} else {
 				self.progress_tracker.file_written(f, amt_written, is_last)
 			}
+			if !is_last && f.written_bytes-f.journaled_bytes >= journal_progress_interval {
+				self.record_progress(f)
+			}
+			verified := true
+			if is_last && f.ftype == FileType_regular && self.cli_opts.Verify {
+				if err := f.verify_checksum(ftc.Checksum); err != nil {
+					verified = false
+					self.verification_failures = append(self.verification_failures, verification_failure{f, err})
+					self.events.file_done(f.expanded_local_path, f.expected_size, err.Error())
+					self.on_file_hook(f, err.Error())
+				}
+			}
+			if !is_last {
+				self.events.file_progress(f.expanded_local_path, f.written_bytes, f.expected_size)
+			} else if verified {
+				self.events.file_done(f.expanded_local_path, f.expected_size, "")
+				self.on_file_hook(f, "")
+			}
+			if is_last && f.ftype == FileType_regular && verified && f.stream == nil {
+				if self.journal != nil {
+					self.journal.record(f.journal_key(), f.expected_size, time.Unix(0, int64(f.mtime)))
+				}
+				self.dedup.add(f.expanded_local_path, f.expected_size, f.mtime)
+			}
 			if is_last {
 				delete(self.files_to_be_transferred, ftc.File_id)
 				if len(self.files_to_be_transferred) == 0 {
@@ -612,6 +935,24 @@ func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 	return
 }
 
+// Record the progress of a file in the journal, so that an interrupted
+// transfer can continue from where it stopped
+func (self *manager) record_progress(f *remote_file) {
+	if self.journal == nil || f.ftype != FileType_regular || f.stream != nil {
+		return
+	}
+	f.journaled_bytes = f.written_bytes
+	if written, temp := f.progress(); written > 0 {
+		self.journal.record_partial(f.journal_key(), f.expected_size, time.Unix(0, int64(f.mtime)), written, temp)
+		if f.resume_basis != "" && temp != f.resume_basis {
+			// the progress of the previous session is superseded, the
+			// basis remains readable while it is open
+			os.Remove(f.resume_basis)
+			f.resume_basis = ""
+		}
+	}
+}
+
 type tree_node struct {
 	entry       *remote_file
 	added_files map[string]*tree_node
@@ -688,6 +1029,39 @@ func files_for_receive(opts *Options, dest string, files []*remote_file, remote_
 		slices.SortStableFunc(spec_map[i], func(a, b *remote_file) bool { return len(a.remote_path) < len(b.remote_path) })
 		spec_paths[i] = spec_map[i][0].remote_path
 	}
+	filter, err := new_file_filter(opts)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		// the filter rules match paths relative to the parent of the spec
+		for spec_id, files_for_spec := range spec_map {
+			root := path.Dir(spec_paths[spec_id])
+			spec_map[spec_id] = utils.Filter(files_for_spec, func(f *remote_file) bool {
+				rel := strings.TrimPrefix(strings.TrimPrefix(f.remote_path, root), "/")
+				return !filter.is_excluded_with_ancestors(rel, f.ftype == FileType_directory)
+			})
+			if len(spec_map[spec_id]) == 0 {
+				delete(spec_map, spec_id)
+			}
+		}
+	}
+	if opts.Links == "skip" {
+		for spec_id, files_for_spec := range spec_map {
+			spec_map[spec_id] = utils.Filter(files_for_spec, func(f *remote_file) bool { return f.ftype != FileType_symlink })
+			if len(spec_map[spec_id]) == 0 {
+				delete(spec_map, spec_id)
+			}
+		}
+	} else if opts.Links == "follow" {
+		for _, files_for_spec := range spec_map {
+			for _, f := range files_for_spec {
+				if f.ftype == FileType_symlink {
+					return nil, fmt.Errorf("The terminal does not support following symbolic links, %s was sent as a symbolic link", f.remote_path)
+				}
+			}
+		}
+	}
 	if opts.Mode == "mirror" {
 		common_path := utils.Commonpath(spec_paths...)
 		home := strings.TrimRight(remote_home, "/")
@@ -732,12 +1106,46 @@ func files_for_receive(opts *Options, dest string, files []*remote_file, remote_
 	return
 }
 
+// Exclude the regular files outside the size and modification time limits,
+// and links to them
+func (self *manager) exclude_files_by_limits() error {
+	filter, err := new_file_filter(self.cli_opts)
+	if err != nil {
+		return err
+	}
+	excluded := utils.NewSet[string]()
+	self.files = utils.Filter(self.files, func(f *remote_file) bool {
+		if (f.ftype == FileType_regular && filter.is_excluded_file(f.expected_size, time.Unix(0, int64(f.mtime)))) || (f.remote_target != "" && excluded.Has(f.remote_target)) {
+			excluded.Add(f.remote_id)
+			self.excluded_files = append(self.excluded_files, f)
+			return false
+		}
+		return true
+	})
+	return nil
+}
+
 func (self *manager) collect_files() (err error) {
 	if self.files, err = files_for_receive(self.cli_opts, self.dest, self.files, self.remote_home, self.spec); err != nil {
 		return err
 	}
+	if err = self.exclude_files_by_limits(); err != nil {
+		return err
+	}
+	if self.dest == stdio_path {
+		if err = self.stream_to(os.Stdout); err != nil {
+			return err
+		}
+	}
 	self.progress_tracker.total_size_of_all_files = 0
 	for _, f := range self.files {
+		if self.cli_opts.Resume && f.is_already_transferred(self.journal) {
+			f.already_transferred = true
+			continue
+		}
+		if self.cli_opts.Resume && f.ftype == FileType_regular && f.stream == nil {
+			f.resume_partial_transfer(self.journal)
+		}
 		if f.ftype != FileType_directory && f.ftype != FileType_link {
 			self.files_to_be_transferred[f.file_id] = f
 			self.progress_tracker.total_size_of_all_files += utils.Max(0, f.expected_size)
@@ -756,12 +1164,7 @@ func lexists(path string) bool {
 	return err == nil
 }
 
-func (self *handler) print_check_paths() {
-	if self.check_paths_printed {
-		return
-	}
-	self.check_paths_printed = true
-	self.lp.Println(`The following file transfers will be performed. A red destination means an existing file will be overwritten.`)
+func (self *handler) print_transfers() {
 	for _, df := range self.manager.files {
 		self.lp.QueueWriteString(self.ctx.Prettify(fmt.Sprintf(":%s:`%s` ", df.ftype.Color(), df.ftype.ShortText())))
 		self.lp.QueueWriteString(" ")
@@ -772,9 +1175,40 @@ func (self *handler) print_check_paths() {
 		self.lp.Println(df.display_name, "→", lpath)
 	}
 	self.lp.Println(fmt.Sprintf(`Transferring %d file(s) of total size: %s`, len(self.manager.files), humanize.Size(self.manager.progress_tracker.total_size_of_all_files)))
+}
+
+func (self *handler) print_check_paths() {
+	if self.check_paths_printed {
+		return
+	}
+	self.check_paths_printed = true
+	self.lp.Println(`The following file transfers will be performed. A red destination means an existing file will be overwritten.`)
+	self.print_transfers()
 	self.print_continue_msg()
 }
 
+// Print the transfers and deletions that would be performed and cancel the transfer
+func (self *handler) dry_run() {
+	self.lp.Println(`The following file transfers would be performed. A red destination means an existing file would be overwritten.`)
+	self.print_transfers()
+	if self.cli_opts.Delete {
+		paths, err := self.manager.extraneous_files()
+		if err != nil {
+			self.abort_with_error(err)
+			return
+		}
+		if len(paths) > 0 {
+			self.lp.Println(`The following files would be deleted:`)
+			for _, path := range paths {
+				self.lp.Println(` `, self.ctx.BrightRed(path))
+			}
+		}
+	}
+	self.manager.send(FileTransmissionCommand{Action: Action_cancel}, self.lp.QueueWriteString)
+	self.manager.state = state_canceled
+	self.quit_after_write_code = 0
+}
+
 func (self *handler) confirm_paths() {
 	self.print_check_paths()
 }
@@ -783,10 +1217,17 @@ func (self *handler) transmit_one() {
 	if self.transmit_iterator == nil {
 		return
 	}
-	wid, err := self.transmit_iterator(self.lp.QueueWriteString)
+	var amt int64
+	wid, err := self.transmit_iterator(func(data string) loop.IdType {
+		amt += int64(len(data))
+		return self.lp.QueueWriteString(data)
+	})
+	self.throttle = self.manager.bwlimit.consume(amt, time.Now())
 	if err != nil {
 		if err == files_done {
 			self.transmit_iterator = nil
+		} else if err == signature_not_ready {
+			self.waiting_for_signature = true
 		} else {
 			self.abort_with_error(err)
 			return
@@ -814,6 +1255,16 @@ func (self *handler) start_transfer() {
 	for _, f := range self.manager.files {
 		self.max_name_length = utils.Max(6, self.max_name_length, wcswidth.Stringwidth(f.display_name))
 	}
+	if len(self.manager.files_to_be_transferred) == 0 {
+		// all files were transferred by a previous session
+		if err := self.manager.finalize_transfer(); err != nil {
+			self.abort_with_error(err)
+			return
+		}
+		self.manager.send(FileTransmissionCommand{Action: Action_finish}, self.lp.QueueWriteString)
+		self.quit_after_write_code = 0
+		return
+	}
 	self.transmit_iterator = self.manager.request_files()
 	self.transmit_one()
 }
@@ -823,7 +1274,7 @@ func (self *handler) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 		return
 	}
 	if ftc.Action == Action_status && ftc.Status == "CANCELED" {
-		self.lp.Quit(1)
+		self.lp.Quit(utils.IfElse(self.quit_after_write_code > -1, self.quit_after_write_code, 1))
 		return
 	}
 	if self.quit_after_write_code > -1 || self.manager.state == state_canceled {
@@ -865,7 +1316,9 @@ func (self *handler) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 			self.abort_with_error(merr)
 			return
 		}
-		if self.cli_opts.ConfirmPaths {
+		if self.cli_opts.DryRun {
+			self.dry_run()
+		} else if self.cli_opts.ConfirmPaths {
 			self.confirm_paths()
 		} else {
 			self.start_transfer()
@@ -885,7 +1338,15 @@ func (self *handler) on_writing_finished(msg_id loop.IdType) (err error) {
 	if self.quit_after_write_code > -1 {
 		self.lp.Quit(self.quit_after_write_code)
 	} else if msg_id == self.last_data_write_id {
-		self.transmit_one()
+		if self.throttle > 0 {
+			// wait till the token bucket has enough tokens for the next file
+			self.lp.AddTimer(self.throttle, false, func(loop.IdType) error {
+				self.transmit_one()
+				return nil
+			})
+		} else {
+			self.transmit_one()
+		}
 	}
 	return nil
 }
@@ -1048,19 +1509,35 @@ func (self *handler) on_key_event(ev *loop.KeyEvent) error {
 	return nil
 }
 
-func receive_loop(opts *Options, spec []string, dest string) (err error, rc int) {
+func receive_loop(opts *Options, spec []string, dest string, journal *transfer_journal) (err error, rc int) {
 	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors)
 	if err != nil {
 		return err, 1
 	}
+	rate, err := parse_rate(opts.Bwlimit)
+	if err != nil {
+		return err, 1
+	}
+	hooks, err := new_hook_runner(opts, "receive")
+	if err != nil {
+		return err, 1
+	}
+	var dedup *dedup_cache
+	if opts.Dedup && !opts.DryRun {
+		if dedup, err = open_dedup_cache(""); err != nil {
+			return fmt.Errorf("Failed to open the dedup cache with error: %w", err), 1
+		}
+	}
 
 	handler := handler{
 		lp: lp, quit_after_write_code: -1, cli_opts: opts, spinner: tui.NewSpinner("dots"),
 		ctx: markup.New(true),
 		manager: manager{
-			request_id: random_id(), spec: spec, dest: dest, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas,
+			request_id: random_id(), spec: spec, dest: dest, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas || opts.Resume, journal: journal,
 			failed_specs: make(map[int]string, len(spec)), spec_counts: make(map[int]int, len(spec)),
 			suffix: "\x1b\\", cli_opts: opts, files_to_be_transferred: make(map[string]*remote_file),
+			wakeup: func() { lp.WakeupMainThread() }, bwlimit: new_token_bucket(rate), events: new_event_writer(opts),
+			hooks: hooks, dedup: dedup,
 		},
 	}
 	for i := range spec {
@@ -1088,6 +1565,14 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 	lp.OnSIGINT = handler.on_interrupt
 	lp.OnSIGTERM = handler.on_sigterm
 	lp.OnWriteComplete = handler.on_writing_finished
+	lp.OnWakeup = func() error {
+		// a signature calculated in the background is ready
+		if handler.waiting_for_signature {
+			handler.waiting_for_signature = false
+			handler.transmit_one()
+		}
+		return nil
+	}
 	lp.OnText = handler.on_text
 	lp.OnKeyEvent = handler.on_key_event
 	lp.OnResize = func(old_sz, new_sz loop.ScreenSize) error {
@@ -1114,11 +1599,17 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 	}
 
 	err = lp.Run()
+	for _, f := range handler.manager.files_to_be_transferred {
+		handler.manager.record_progress(f)
+	}
 	defer func() {
 		for _, f := range handler.manager.files {
 			f.close()
 		}
 	}()
+	handler.manager.dedup.close()
+	// failing to update the cache only means that files are not deduplicated
+	_ = handler.manager.dedup.save()
 
 	if err != nil {
 		return err, 1
@@ -1147,6 +1638,28 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 	if tsf > 0 && dsz+ssz > 0 && rc == 0 {
 		print_rsync_stats(tsf, dsz, ssz)
 	}
+	if n := len(handler.manager.deleted); n > 0 && rc == 0 {
+		fmt.Printf("Deleted %d files not present on the sending computer\n", n)
+	}
+	unpreserved := []unpreserved_metadata{}
+	for _, f := range handler.manager.files {
+		if len(f.xattrs.unpreserved) > 0 {
+			unpreserved = append(unpreserved, unpreserved_metadata{f.display_name, f.xattrs.unpreserved})
+		}
+	}
+	print_unpreserved_metadata(unpreserved)
+	handler.manager.events.totals(len(handler.manager.files), len(handler.manager.verification_failures), handler.manager.progress_tracker.total_transferred)
+	if !opts.DryRun && handler.manager.hooks.finish(handler.manager.progress_tracker.total_transferred) > 0 {
+		rc = 1
+	}
+	if len(handler.manager.verification_failures) > 0 {
+		fmt.Fprintf(os.Stderr, "Verification of %d out of %d files failed\n", len(handler.manager.verification_failures), len(handler.manager.files))
+		for _, x := range handler.manager.verification_failures {
+			fmt.Fprintln(os.Stderr, handler.ctx.BrightRed(x.file.display_name))
+			fmt.Fprintln(os.Stderr, ` `, x.err)
+		}
+		rc = 1
+	}
 	return
 }
 
@@ -1164,6 +1677,22 @@ func receive_main(opts *Options, args []string) (err error, rc int) {
 		}
 		dest = args[len(args)-1]
 		spec = args[:len(args)-1]
+		if dest == stdio_path {
+			if len(spec) > 1 {
+				return fmt.Errorf("Only a single file can be written to STDOUT"), 1
+			}
+			if opts.Delete || opts.DryRun || opts.Resume {
+				return fmt.Errorf("The --delete, --dry-run and --resume options cannot be used when writing to STDOUT"), 1
+			}
+		}
+	}
+	journal, err := open_journal(opts, args, opts.Resume)
+	if err != nil {
+		return fmt.Errorf("Failed to open the transfer journal with error: %w", err), 1
+	}
+	defer journal.close()
+	if err, rc = receive_loop(opts, spec, dest, journal); err == nil && rc == 0 {
+		journal.remove()
 	}
-	return receive_loop(opts, spec, dest)
+	return
 }
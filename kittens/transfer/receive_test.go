@@ -0,0 +1,320 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"kitty/tools/rsync"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+func TestReceiveDelete(t *testing.T) {
+	tdir := t.TempDir()
+	outside := t.TempDir()
+	for _, x := range []string{"d/a", "d/extra", "d/sub/b", "d/sub/x/y", "d/keep.o", "d/excluded/z"} {
+		p := filepath.Join(tdir, x)
+		os.MkdirAll(filepath.Dir(p), 0o700)
+		os.WriteFile(p, nil, 0o600)
+	}
+	os.WriteFile(filepath.Join(outside, "precious"), nil, 0o600)
+	d := filepath.Join(tdir, "d")
+	m := &manager{cli_opts: &Options{Delete: true, Exclude: []string{"*.o", "/d/excluded/"}}, files: []*remote_file{
+		{remote_id: "1", ftype: FileType_directory, expanded_local_path: d},
+		{remote_id: "2", parent: "1", ftype: FileType_regular, expanded_local_path: filepath.Join(d, "a")},
+		{remote_id: "3", parent: "1", ftype: FileType_directory, expanded_local_path: filepath.Join(d, "sub")},
+		{remote_id: "4", parent: "3", ftype: FileType_regular, expanded_local_path: filepath.Join(d, "sub", "b")},
+	}}
+	paths, err := m.extraneous_files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{filepath.Join(d, "extra"), filepath.Join(d, "sub", "x")}, paths); diff != "" {
+		t.Fatalf("Incorrect files to delete:\n%s", diff)
+	}
+	if err = m.delete_extraneous_files(); err != nil {
+		t.Fatal(err)
+	}
+	if lexists(filepath.Join(d, "extra")) || lexists(filepath.Join(d, "sub", "x")) || !lexists(filepath.Join(d, "keep.o")) || !lexists(filepath.Join(d, "a")) {
+		t.Fatalf("Incorrect files deleted")
+	}
+	// a received directory that is a symlink to outside the destination
+	os.RemoveAll(filepath.Join(d, "sub"))
+	os.Symlink(outside, filepath.Join(d, "sub"))
+	if _, err = m.extraneous_files(); err == nil {
+		t.Fatalf("Deleting files via a symlink to outside the destination not prevented")
+	}
+	if !lexists(filepath.Join(outside, "precious")) {
+		t.Fatalf("File outside destination deleted")
+	}
+}
+
+func TestReceiveExtendedMetadata(t *testing.T) {
+	tdir := t.TempDir()
+	src, dest := filepath.Join(tdir, "src"), filepath.Join(tdir, "dest")
+	os.WriteFile(src, nil, 0o600)
+	os.WriteFile(dest, nil, 0o600)
+	if err := set_xattr(src, "user.kitty.test", []byte("value"), false); err != nil {
+		t.Skipf("Extended attributes not supported: %s", err)
+	}
+	st, err := os.Lstat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	em := read_extended_metadata(src, st)
+	ftc := &FileTransmissionCommand{Action: Action_file, Name: src}
+	em.serialize_to(ftc)
+	ftc.Unpreserved = "security.selinux"
+	if ftc, err = NewFileTransmissionCommand(ftc.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := extended_metadata_from_ftc(ftc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.xattrs["user.kitty.invalid\x00name"] = []byte("x")
+	rf.apply_xattrs(dest, false)
+	xattrs, _ := read_xattrs(dest)
+	if diff := cmp.Diff("value", string(xattrs["user.kitty.test"])); diff != "" {
+		t.Fatalf("Extended attribute not applied:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"security.selinux", "user.kitty.invalid\x00name"}, rf.unpreserved); diff != "" {
+		t.Fatalf("Incorrect unpreserved metadata:\n%s", diff)
+	}
+	ftc.Xattrs = "not json"
+	if _, err = extended_metadata_from_ftc(ftc); err == nil {
+		t.Fatalf("Invalid extended attributes not rejected")
+	}
+}
+
+func TestReceiveStream(t *testing.T) {
+	tdir := t.TempDir()
+	m := &manager{cli_opts: &Options{}, files: []*remote_file{{ftype: FileType_directory}, {ftype: FileType_regular}}}
+	if err := m.stream_to(&bytes.Buffer{}); err == nil {
+		t.Fatalf("Writing multiple files to STDOUT not prevented")
+	}
+	buf := bytes.Buffer{}
+	f := &remote_file{ftype: FileType_regular, expanded_local_path: stdio_path, hole_map: &hole_map{}}
+	m = &manager{cli_opts: &Options{Verify: true}, files: []*remote_file{f}}
+	if err := m.stream_to(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if f.hole_map != nil {
+		t.Fatalf("Holes not disabled when writing to STDOUT")
+	}
+	for _, x := range []string{"abc", "defg"} {
+		if _, err := f.Write([]byte(x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pos, _ := f.actual_file.tell(); buf.String() != "abcdefg" || pos != 7 {
+		t.Fatalf("Incorrect data written to STDOUT: %#v at %d", buf.String(), pos)
+	}
+	if err := m.finalize_transfer(); err != nil || lexists(stdio_path) {
+		t.Fatalf("Metadata applied to STDOUT: %v", err)
+	}
+	os.WriteFile(filepath.Join(tdir, "data"), []byte("abcdefg"), 0o600)
+	expected, _ := file_checksum(filepath.Join(tdir, "data"))
+	if err := f.verify_checksum(expected); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.verify_checksum("x"); err == nil {
+		t.Fatalf("Verification of STDOUT did not fail with mismatched checksum")
+	}
+}
+
+func TestReceiveDedup(t *testing.T) {
+	tdir := t.TempDir()
+	cache_dir := filepath.Join(tdir, "cache")
+	a, b := filepath.Join(tdir, "a"), filepath.Join(tdir, "sub", "b")
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	os.WriteFile(a, data, 0o600)
+	mtime := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(a, mtime, mtime)
+	size, mt := int64(len(data)), time.Duration(mtime.UnixNano())
+
+	cache, err := open_dedup_cache(cache_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.add(a, size, mt)
+	cache.add(filepath.Join(tdir, "missing"), size, mt)
+	if err = cache.save(); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = open_dedup_cache(cache_dir); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.close()
+	if len(cache.entries) != 1 {
+		t.Fatalf("Files that no longer exist not removed from the index: %v", cache.entries)
+	}
+	if x := cache.reference_candidates([]*remote_file{{ftype: FileType_regular, expanded_local_path: a}}); len(x) != 0 {
+		t.Fatalf("The destination used as its own reference file")
+	}
+
+	// a file with some of the blocks of a previously received file is
+	// received as a delta that copies them from it
+	received := append(append([]byte("inserted"), data[:30000]...), data[40000:]...)
+	f := &remote_file{ftype: FileType_regular, expanded_local_path: b, expected_size: int64(len(received)), mtime: mt + 1}
+	m := &manager{cli_opts: &Options{}, files: []*remote_file{f}, dedup: cache}
+	m.use_references()
+	if len(cache.references) != 0 || f.use_references {
+		t.Fatalf("Reference files used without support from the terminal")
+	}
+	m.references_supported = true
+	m.use_references()
+	if len(cache.references) != 1 || cache.references[0].path != a || !f.use_references || !f.empty_basis || !m.wants_signature(f) {
+		t.Fatalf("Previously received file not used as a reference file: %#v", cache.references)
+	}
+	sig := bytes.Buffer{}
+	if f.patcher, err = create_signature(f, &sig, cache); err != nil {
+		t.Fatal(err)
+	}
+	differ := rsync.NewDiffer()
+	if err = differ.AddSignatureData(sig.Bytes()); err == nil {
+		if err = differ.FinishSignatureData(); err == nil {
+			err = differ.AddReferenceSignature(cache.references[0].id, cache.references[0].signature)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := bytes.Buffer{}
+	it := differ.CreateDelta(bytes.NewReader(received), &delta)
+	for err = it(); err == nil; err = it() {
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if delta.Len() > 3*dedup_block_size {
+		t.Fatalf("Delta using the reference file too large: %d", delta.Len())
+	}
+	f.expect_diff = true
+	if _, err = f.Write(delta.Bytes()); err == nil {
+		err = f.actual_file.close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := os.ReadFile(b); !bytes.Equal(actual, received) {
+		t.Fatalf("Incorrect data received using the reference file")
+	}
+	if original, _ := os.ReadFile(a); !bytes.Equal(original, data) {
+		t.Fatalf("The reference file was modified")
+	}
+	id, _ := rsync.FileIdentityFor(a)
+	if cached, found := cache.signatures.Get(id, cache.new_patcher(0)); !found || !bytes.Equal(cached, cache.references[0].signature) {
+		t.Fatalf("Signature of the reference file not cached")
+	}
+
+	// a changed file is no longer used
+	os.WriteFile(a, data[:1024], 0o600)
+	if x := cache.reference_candidates(m.files); len(x) != 0 {
+		t.Fatalf("A changed file used as a reference file")
+	}
+}
+
+func TestReceiveResumePartial(t *testing.T) {
+	tdir := t.TempDir()
+	dest := filepath.Join(tdir, "dest")
+	received := make([]byte, 256*1024)
+	rand.Read(received)
+	original := received[128*1024:]
+	os.WriteFile(dest, original, 0o600)
+	jf, err := os.Create(filepath.Join(tdir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jf.Close()
+	j := &transfer_journal{f: jf, entries: make(map[string]journal_entry)}
+	m := &manager{cli_opts: &Options{}, journal: j}
+	new_file := func() *remote_file {
+		return &remote_file{ftype: FileType_regular, remote_path: "/remote", expanded_local_path: dest, expected_size: int64(len(received)), mtime: 1}
+	}
+	delta_for := func(f *remote_file) []byte {
+		sig := bytes.Buffer{}
+		if f.patcher, err = create_signature(f, &sig, nil); err != nil {
+			t.Fatal(err)
+		}
+		differ := rsync.NewDiffer()
+		if err = differ.AddSignatureData(sig.Bytes()); err == nil {
+			err = differ.FinishSignatureData()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := bytes.Buffer{}
+		it := differ.CreateDelta(bytes.NewReader(received), &delta)
+		for err = it(); err == nil; err = it() {
+		}
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+		f.expect_diff = true
+		return delta.Bytes()
+	}
+
+	// a session interrupted while applying a delta records its progress
+	f := new_file()
+	delta := delta_for(f)
+	if _, err = f.Write(delta[:100*1024]); err != nil {
+		t.Fatal(err)
+	}
+	m.record_progress(f)
+	e, found := j.partial(f.journal_key(), f.expected_size, time.Unix(0, 1))
+	if !found || e.Partial < 64*1024 || e.Temp == "" || j.is_done(f.journal_key(), f.expected_size, time.Unix(0, 1)) {
+		t.Fatalf("Progress of the interrupted transfer not recorded: %#v", e)
+	}
+	if actual, _ := os.ReadFile(dest); !bytes.Equal(actual, original) {
+		t.Fatalf("The original file was modified by the interrupted transfer")
+	}
+
+	// the next session only needs the data that was not already written
+	f = new_file()
+	f.resume_partial_transfer(j)
+	if f.resume_basis != e.Temp || !m.wants_signature(f) {
+		t.Fatalf("Partially written output not used to resume the transfer")
+	}
+	if basis, _ := os.ReadFile(f.resume_basis); !bytes.Equal(basis, append(received[:e.Partial:e.Partial], original...)) {
+		t.Fatalf("Incorrect basis for resuming the transfer")
+	}
+	delta = delta_for(f)
+	if remaining := 128*1024 - int(e.Partial); len(delta) > remaining+4096 {
+		t.Fatalf("Delta for the resumed transfer too large: %d > %d", len(delta), remaining+4096)
+	}
+	f.decompressor = utils.NewStreamDecompressor(nil, f)
+	if _, err = f.write_data(delta, true); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := os.ReadFile(dest); !bytes.Equal(actual, received) {
+		t.Fatalf("Incorrect data received when resuming the transfer")
+	}
+	if _, err = os.Stat(e.Temp); err == nil {
+		t.Fatalf("The output of the interrupted transfer was not removed")
+	}
+
+	// changed files are not resumed
+	j.record_partial(f.journal_key(), f.expected_size, time.Unix(0, 1), 10, filepath.Join(tdir, "temp"))
+	os.WriteFile(filepath.Join(tdir, "temp"), received, 0o600)
+	f = new_file()
+	f.mtime = 2
+	if f.resume_partial_transfer(j); f.resume_basis != "" {
+		t.Fatalf("A changed file was resumed")
+	}
+	if _, err = os.Stat(filepath.Join(tdir, "temp")); err == nil {
+		t.Fatalf("The output of the interrupted transfer of a changed file was not removed")
+	}
+}
@@ -0,0 +1,131 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The progress of files being received is recorded in the journal whenever
+// this many bytes have been written
+const journal_progress_interval = 16 * 1024 * 1024
+
+type journal_entry struct {
+	Key   string `json:"k"`
+	Size  int64  `json:"s"`
+	Mtime int64  `json:"m"`
+	// The number of bytes of output written for a file whose transfer was
+	// interrupted, zero for files that were completely transferred
+	Partial int64 `json:"p,omitempty"`
+	// The temporary file the output of an interrupted delta was written to
+	Temp string `json:"t,omitempty"`
+}
+
+// A record of the files that have been transferred in a session, used to
+// resume the session if it is interrupted. It is an append only file of JSON
+// lines, one per completed file and one per update of the progress of a
+// file, that is deleted when the session completes successfully.
+type transfer_journal struct {
+	path    string
+	f       *os.File
+	entries map[string]journal_entry
+}
+
+func journal_path(opts *Options, args []string) string {
+	direction := utils.IfElse(opts.Direction == "send" || opts.Direction == "download", "send", "receive")
+	h := sha256.New()
+	h.Write([]byte(strings.Join(append([]string{direction, opts.Mode, cwd_path()}, args...), "\x00")))
+	return filepath.Join(utils.CacheDir(), "transfer-journals", hex.EncodeToString(h.Sum(nil)))
+}
+
+// Open the journal for the session specified by opts and args. When resume
+// is false any existing journal is discarded.
+func open_journal(opts *Options, args []string, resume bool) (ans *transfer_journal, err error) {
+	ans = &transfer_journal{path: journal_path(opts, args), entries: make(map[string]journal_entry)}
+	if err = os.MkdirAll(filepath.Dir(ans.path), 0o700); err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if f, err := os.Open(ans.path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := journal_entry{}
+			// ignore partially written lines from an interrupted session
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				ans.entries[e.Key] = e
+			}
+		}
+		f.Close()
+	}
+	if !resume {
+		for _, e := range ans.entries {
+			if e.Temp != "" {
+				os.Remove(e.Temp)
+			}
+		}
+		ans.entries = make(map[string]journal_entry)
+		flags |= os.O_TRUNC
+	}
+	if ans.f, err = os.OpenFile(ans.path, flags, 0o600); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func journal_key(src, dest string) string {
+	return src + "\x00" + dest
+}
+
+// Return true if the file was completely transferred in a previous session
+// and has not changed since
+func (self *transfer_journal) is_done(key string, size int64, mtime time.Time) bool {
+	e, found := self.entries[key]
+	return found && e.Partial == 0 && e.Temp == "" && e.Size == size && e.Mtime == mtime.UnixNano()
+}
+
+// Return the progress of a file whose transfer was interrupted in a previous
+// session, if it has not changed since
+func (self *transfer_journal) partial(key string, size int64, mtime time.Time) (e journal_entry, found bool) {
+	e, found = self.entries[key]
+	return e, found && e.Partial > 0 && e.Size == size && e.Mtime == mtime.UnixNano()
+}
+
+func (self *transfer_journal) record(key string, size int64, mtime time.Time) {
+	self.add(journal_entry{Key: key, Size: size, Mtime: mtime.UnixNano()})
+}
+
+func (self *transfer_journal) record_partial(key string, size int64, mtime time.Time, partial int64, temp string) {
+	self.add(journal_entry{Key: key, Size: size, Mtime: mtime.UnixNano(), Partial: partial, Temp: temp})
+}
+
+func (self *transfer_journal) add(e journal_entry) {
+	self.entries[e.Key] = e
+	if data, err := json.Marshal(e); err == nil {
+		self.f.Write(append(data, '\n'))
+	}
+}
+
+func (self *transfer_journal) close() {
+	if self.f != nil {
+		self.f.Close()
+		self.f = nil
+	}
+}
+
+// Delete the journal, called when the session completes successfully
+func (self *transfer_journal) remove() {
+	self.close()
+	os.Remove(self.path)
+}
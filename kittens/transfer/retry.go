@@ -0,0 +1,75 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"time"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The maximum delay before retrying a file that failed
+const max_retry_delay = 30 * time.Second
+
+// The delay before the specified retry, it doubles with every retry
+func retry_delay(retry int) time.Duration {
+	return utils.Min(time.Second<<utils.Max(0, utils.Min(retry-1, 5)), max_retry_delay)
+}
+
+// Stop reading the data of the file, letting any goroutine producing it exit
+func (self *File) stop_reading() {
+	if self.actual_file != nil {
+		self.actual_file.Close()
+		self.actual_file = nil
+	}
+	if ch := self.delta_chunks; ch != nil {
+		self.delta_chunks = nil
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+	self.delta_loader, self.deltabuf, self.sparse_reader = nil, nil, nil
+}
+
+// Whether a file the terminal failed to write should be retried. Data read
+// from STDIN cannot be read again, so it is never retried.
+func (self *SendManager) can_retry(f *File) bool {
+	return self.retry_file_supported && f.retries < self.max_retries && f.file_type == FileType_regular && f.stream == nil && !f.canceled
+}
+
+// Stop sending the data of a file that failed and schedule it to be sent
+// again, after a delay that increases with every retry
+func (self *SendManager) schedule_retry(f *File) {
+	f.retries++
+	f.stop_reading()
+	self.deactivate_file(f)
+	f.state = WAITING_FOR_START
+	f.data_sent = false
+	// the terminal reports progress from the start of the file again
+	self.progress_tracker.total_reported_progress -= f.reported_progress
+	f.reported_progress = 0
+	self.update_collective_statuses()
+	self.retry_file(f, retry_delay(f.retries))
+}
+
+// Send the metadata of a file being retried. Files with enough data are
+// retried using the rsync algorithm so that the terminal only needs the data
+// it did not write the previous time.
+func (self *SendManager) restart_file(f *File, send func(string)) {
+	if f.canceled || f.state != WAITING_FOR_START {
+		return
+	}
+	send(self.file_metadata_command(f, true).Serialize())
+}
+
+func (self *SendHandler) on_file_retry(f *File, delay time.Duration) {
+	self.lp.AddTimer(delay, false, func(loop.IdType) error {
+		self.manager.restart_file(f, self.send_payload)
+		return nil
+	})
+}
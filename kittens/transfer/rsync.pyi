@@ -39,6 +39,7 @@ class Differ:
 
     def add_signature_data(self, data: ReadOnlyBuffer) -> None: ...
     def finish_signature_data(self) -> None: ...
+    def add_reference_signature(self, reference: int, signature: ReadOnlyBuffer) -> None: ...
     def next_op(self, read: Callable[[WriteBuffer], int], write: Callable[[ReadOnlyBuffer], None]) -> bool: ...
 
 
@@ -7,9 +7,11 @@ import (
 	"compress/zlib"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -17,6 +19,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/exp/constraints"
 	"golang.org/x/exp/slices"
 
@@ -80,6 +83,41 @@ func (self *ZlibCompressor) Flush() []byte {
 	return self.b.Bytes()
 }
 
+type ZstdCompressor struct {
+	b bytes.Buffer
+	w *zstd.Encoder
+}
+
+// The encoder is created lazily as it uses a lot more memory than zlib and
+// compressors are created for all files at the start of a transfer
+func NewZstdCompressor() *ZstdCompressor {
+	return &ZstdCompressor{}
+}
+
+func (self *ZstdCompressor) Compress(data []byte) []byte {
+	if self.w == nil {
+		w, err := zstd.NewWriter(&self.b, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		self.w = w
+	}
+	if _, err := self.w.Write(data); err != nil {
+		panic(err)
+	}
+	defer self.b.Reset()
+	return utils.UnsafeStringToBytes(self.b.String())
+}
+
+func (self *ZstdCompressor) Flush() []byte {
+	if self.w == nil {
+		self.Compress(nil)
+	}
+	self.w.Close()
+	self.w = nil
+	return self.b.Bytes()
+}
+
 type File struct {
 	file_hash                                             FileHash
 	ttype                                                 TransmissionType
@@ -105,7 +143,40 @@ type File struct {
 	differ                                                *rsync.Differ
 	delta_loader                                          func() error
 	deltabuf                                              *bytes.Buffer
-}
+	// Set when the delta is being calculated or the data is being read from
+	// STDIN in a separate goroutine
+	delta_chunks chan delta_chunk
+	// Only read when preserving extended metadata
+	xattrs extended_metadata
+	// Set for sparse files when the terminal supports them
+	hole_map      *hole_map
+	sparse_reader *sparse_reader
+	// the path of symlinks relative to the root of the transfer
+	rel_path string
+	// Set from the interactive queue
+	paused, canceled bool
+	// Whether any of the data of the file has been sent
+	data_sent bool
+	// The number of times the file has been retried after failing
+	retries int
+	// Set when the data of the file is read from STDIN
+	stream      io.Reader
+	stream_hash hash.Hash
+	// Set when the file was transferred by a previous, interrupted session
+	already_transferred bool
+	// Set when the file is not sent as it is unchanged on the computer running
+	// the terminal
+	skipped bool
+}
+
+type delta_chunk struct {
+	data []byte
+	err  error
+}
+
+// Returned by File.next_chunk() when the next chunk of the delta has not yet
+// been calculated
+var delta_not_ready error = errors.New("delta not ready")
 
 func get_remote_path(local_path string, remote_base string) string {
 	if remote_base == "" {
@@ -129,20 +200,43 @@ func NewFile(opts *Options, local_path, expanded_local_path string, file_id int,
 		file_size: stat_result.Size(), bytes_to_transmit: stat_result.Size(),
 		permissions: stat_result.Mode().Perm(), remote_path: filepath.ToSlash(get_remote_path(local_path, remote_base)),
 		rsync_capable:       file_type == FileType_regular && stat_result.Size() > 4096,
-		compression_capable: file_type == FileType_regular && stat_result.Size() > 4096 && should_be_compressed(expanded_local_path, opts.Compress),
+		compression_capable: file_type == FileType_regular && stat_result.Size() > 4096 && local_file_should_be_compressed(expanded_local_path, opts.Compress),
 		remote_initial_size: -1,
 	}
 	return &ans
 }
 
-func process(opts *Options, paths []string, remote_base string, counter *int) (ans []*File, err error) {
+// ancestors holds the identities of the directories currently being walked,
+// so that followed symlinks that form a cycle are not descended into again
+func process(opts *Options, paths []string, remote_base string, counter *int, filter *file_filter, rel_parent string, ancestors map[FileHash]bool) (ans []*File, err error) {
 	for _, x := range paths {
 		expanded := expand_home(x)
 		s, err := os.Lstat(expanded)
 		if err != nil {
 			return ans, fmt.Errorf("Failed to stat %s with error: %w", x, err)
 		}
+		if s.Mode()&fs.ModeSymlink == fs.ModeSymlink {
+			switch opts.Links {
+			case "skip":
+				continue
+			case "follow":
+				// dangling links are ignored, as are links to directories
+				// containing the link, which would recurse forever
+				if s, err = os.Stat(expanded); err != nil || (s.IsDir() && is_inside(expanded, filepath.Dir(expanded))) {
+					continue
+				}
+			}
+		}
+		rel_path := path.Join(rel_parent, filepath.Base(x))
+		if filter.is_excluded(rel_path, s.IsDir()) {
+			continue
+		}
 		if s.IsDir() {
+			stat, _ := s.Sys().(*syscall.Stat_t)
+			dir_hash := FileHash{uint64(stat.Dev), stat.Ino}
+			if ancestors[dir_hash] {
+				continue
+			}
 			*counter += 1
 			ans = append(ans, NewFile(opts, x, expanded, *counter, s, remote_base, FileType_directory))
 			new_remote_base := remote_base
@@ -159,15 +253,19 @@ func process(opts *Options, paths []string, remote_base string, counter *int) (a
 			for i, y := range contents {
 				new_paths[i] = filepath.Join(x, y.Name())
 			}
-			new_ans, err := process(opts, new_paths, new_remote_base, counter)
+			ancestors[dir_hash] = true
+			new_ans, err := process(opts, new_paths, new_remote_base, counter, filter, rel_path, ancestors)
+			delete(ancestors, dir_hash)
 			if err != nil {
 				return ans, err
 			}
 			ans = append(ans, new_ans...)
 		} else if s.Mode()&fs.ModeSymlink == fs.ModeSymlink {
 			*counter += 1
-			ans = append(ans, NewFile(opts, x, expanded, *counter, s, remote_base, FileType_symlink))
-		} else if s.Mode().IsRegular() {
+			f := NewFile(opts, x, expanded, *counter, s, remote_base, FileType_symlink)
+			f.rel_path = rel_path
+			ans = append(ans, f)
+		} else if s.Mode().IsRegular() && !filter.is_excluded_file(s.Size(), s.ModTime()) {
 			*counter += 1
 			ans = append(ans, NewFile(opts, x, expanded, *counter, s, remote_base, FileType_regular))
 		}
@@ -185,8 +283,12 @@ func process_mirrored_files(opts *Options, args []string) (ans []*File, err erro
 		}
 		return path
 	}, paths)
+	filter, err := new_file_filter(opts)
+	if err != nil {
+		return nil, err
+	}
 	counter := 0
-	return process(opts, paths, "", &counter)
+	return process(opts, paths, "", &counter, filter, "", make(map[FileHash]bool))
 }
 
 func process_normal_files(opts *Options, args []string) (ans []*File, err error) {
@@ -196,12 +298,26 @@ func process_normal_files(opts *Options, args []string) (ans []*File, err error)
 	args = slices.Clone(args)
 	remote_base := filepath.ToSlash(args[len(args)-1])
 	args = args[:len(args)-1]
+	if slices.Contains(args, stdio_path) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("When sending STDIN it must be the only source")
+		}
+		f, err := new_stdin_file(opts, os.Stdin, remote_base)
+		if err != nil {
+			return nil, err
+		}
+		return []*File{f}, nil
+	}
 	if len(args) > 1 && !strings.HasSuffix(remote_base, "/") {
 		remote_base += "/"
 	}
 	paths := utils.Map(func(x string) string { return abspath(expand_home(x)) }, args)
+	filter, err := new_file_filter(opts)
+	if err != nil {
+		return nil, err
+	}
 	counter := 0
-	return process(opts, paths, remote_base, &counter)
+	return process(opts, paths, remote_base, &counter, filter, "", make(map[FileHash]bool))
 }
 
 func files_for_send(opts *Options, args []string) (files []*File, err error) {
@@ -222,6 +338,10 @@ func files_for_send(opts *Options, args []string) (files []*File, err error) {
 	for _, group := range groups {
 		if len(group) > 1 {
 			for _, lf := range group[1:] {
+				if lf.file_type == FileType_directory {
+					// a directory reached via a followed symlink
+					continue
+				}
 				lf.file_type = FileType_link
 				lf.hard_link_target = "fid:" + group[0].file_id
 			}
@@ -238,6 +358,9 @@ func files_for_send(opts *Options, args []string) (files []*File, err error) {
 				continue
 			}
 			f.symbolic_link_target = "path:" + link_dest
+			if opts.Links == "munge-unsafe" {
+				f.symbolic_link_target = "path:" + munged_symlink_target(f.rel_path, link_dest)
+			}
 			is_abs := filepath.IsAbs(link_dest)
 			q := link_dest
 			if !is_abs {
@@ -274,6 +397,37 @@ func files_for_send(opts *Options, args []string) (files []*File, err error) {
 	return files, nil
 }
 
+func (self *File) journal_key() string {
+	return journal_key(self.expanded_local_path, self.remote_path)
+}
+
+// Mark regular files that were completely transferred by a previous session
+// and have not changed since. They are skipped only if the terminal reports
+// that the file it has is unchanged as well. Files that are the targets of
+// links are always sent.
+func mark_transferred_files(files []*File, journal *transfer_journal) (num_marked int) {
+	link_targets := utils.NewSet[string]()
+	for _, f := range files {
+		for _, t := range []string{f.hard_link_target, f.symbolic_link_target} {
+			if prefix, fid, found := strings.Cut(t, ":"); found && (prefix == "fid" || prefix == "fid_abs") {
+				link_targets.Add(fid)
+			}
+		}
+	}
+	for _, f := range files {
+		if f.file_type == FileType_regular && !link_targets.Has(f.file_id) && journal.is_done(f.journal_key(), f.file_size, f.mtime) {
+			f.already_transferred = true
+			num_marked++
+		}
+	}
+	return
+}
+
+// Whether the terminal has the same file that a previous session transferred
+func (self *File) is_unchanged_remotely(ftc *FileTransmissionCommand) bool {
+	return self.already_transferred && ftc.Size == self.file_size && ftc.Mtime == time.Duration(self.mtime.UnixNano())
+}
+
 type SendState int
 
 const (
@@ -343,6 +497,14 @@ func (self *ProgressTracker) on_file_done(af *File) {
 	af.done_at = time.Now()
 }
 
+const (
+	// The number of files whose data is interleaved by default, when the
+	// terminal supports multiplexing
+	multiplexed_jobs = 4
+	// The maximum size of chunks when the data of files is interleaved
+	multiplexed_chunk_size = 64 * 1024
+)
+
 type SendManager struct {
 	request_id                                                 string
 	state                                                      SendState
@@ -351,17 +513,50 @@ type SendManager struct {
 	use_rsync                                                  bool
 	file_progress                                              func(*File, int)
 	file_done                                                  func(*File)
+	retry_file                                                 func(*File, time.Duration)
 	fid_map                                                    map[string]*File
 	all_acknowledged, all_started, has_transmitting, has_rsync bool
-	active_idx                                                 int
 	prefix, suffix                                             string
 	last_progress_file                                         *File
 	progress_tracker                                           ProgressTracker
 	current_chunk_uncompressed_sz                              int64
+	journal                                                    *transfer_journal
+
+	// The files whose data is being transmitted, interleaved, at most jobs of them
+	active_files []*File
+	next_active  int
+	jobs         int
+	// Whether the number of jobs is decided by whether the terminal supports
+	// multiplexing
+	auto_jobs bool
+	// Called from other goroutines to wake up the main loop
+	wakeup func()
+	// nil when the bandwidth is not limited
+	bwlimit *token_bucket
+	verify  bool
+	xattrs  bool
+	// Whether to preserve sparse files, set to false if the terminal does not
+	// support them
+	sparse bool
+	events *event_writer
+	hooks  *hook_runner
+	// The compression algorithm agreed upon with the terminal
+	compression Compression
+	// Whether the terminal can cancel a single file whose data has started
+	// being sent
+	cancel_file_supported bool
+	// Whether the terminal can receive a file that failed again
+	retry_file_supported bool
+	max_retries          int
+	// Used to send commands that are not part of the data of a file
+	send_command func(string)
 }
 
 func (self *SendManager) start_transfer() string {
-	return FileTransmissionCommand{Action: Action_send, Bypass: self.bypass}.Serialize()
+	return FileTransmissionCommand{
+		Action: Action_send, Bypass: self.bypass, Compressions: supported_compressions, Preserve: utils.IfElse(self.sparse, "sparse", ""),
+		Features: "cancel_file,retry_file,multiplex",
+	}.Serialize()
 }
 
 func (self *SendManager) initialize() {
@@ -378,7 +573,8 @@ func (self *SendManager) initialize() {
 	for _, f := range self.files {
 		self.fid_map[f.file_id] = f
 	}
-	self.active_idx = -1
+	self.auto_jobs = self.jobs < 1
+	self.jobs = utils.Max(1, self.jobs)
 	self.current_chunk_uncompressed_sz = -1
 	self.prefix = fmt.Sprintf("\x1b]%d;id=%s;", kitty.FileTransferCode, self.request_id)
 	self.suffix = "\x1b\\"
@@ -406,6 +602,10 @@ type SendHandler struct {
 	transmit_ok_checked                  bool
 	progress_update_timer                loop.IdType
 	spinner                              *tui.Spinner
+	throttle                             time.Duration
+	throttle_timer                       loop.IdType
+	// nil unless the interactive queue is shown
+	queue *queue_view
 }
 
 func safe_divide[A constraints.Integer | constraints.Float, B constraints.Integer | constraints.Float](a A, b B) float64 {
@@ -516,6 +716,11 @@ func (self *SendHandler) render_progress(name string, p Progress) {
 }
 
 func (self *SendHandler) draw_progress() {
+	if self.queue != nil {
+		self.done_files = nil
+		self.draw_queue()
+		return
+	}
 	self.lp.StartAtomicUpdate()
 	defer self.lp.EndAtomicUpdate()
 	self.lp.AllowLineWrapping(false)
@@ -575,7 +780,7 @@ func (self *SendHandler) draw_progress() {
 	self.progress_drawn = true
 }
 
-func (self *SendHandler) draw_progress_for_current_file(af *File, spinner_char string, is_complete bool) {
+func (self *SendHandler) progress_for_file(af *File, spinner_char string, is_complete bool) Progress {
 	p := self.manager.progress_tracker
 	var secs_so_far time.Duration
 	empty := File{}
@@ -584,15 +789,23 @@ func (self *SendHandler) draw_progress_for_current_file(af *File, spinner_char s
 	} else {
 		secs_so_far = af.done_at.Sub(af.transmit_started_at)
 	}
-	self.render_progress(af.display_name, Progress{
+	ans := Progress{
 		spinner_char: spinner_char, is_complete: is_complete,
 		bytes_so_far: af.reported_progress, total_bytes: af.bytes_to_transmit,
 		secs_so_far: secs_so_far.Seconds(), bytes_per_sec: safe_divide(p.transfered_stats_amt, p.transfered_stats_interval),
-	})
+	}
+	if is_complete {
+		ans.bytes_so_far = ans.total_bytes
+	}
+	return ans
+}
+
+func (self *SendHandler) draw_progress_for_current_file(af *File, spinner_char string, is_complete bool) {
+	self.render_progress(af.display_name, self.progress_for_file(af, spinner_char, is_complete))
 }
 
 func (self *SendHandler) erase_progress() {
-	if self.progress_drawn {
+	if self.progress_drawn && self.queue == nil {
 		self.progress_drawn = false
 		self.lp.MoveCursorVertically(-2)
 		self.lp.QueueWriteString("\r")
@@ -639,27 +852,44 @@ func (self *SendHandler) send_payload(payload string) {
 	self.lp.QueueWriteString(self.manager.suffix)
 }
 
-func (self *File) metadata_command(use_rsync bool) *FileTransmissionCommand {
+func (self *File) metadata_command(use_rsync, verify bool, compression Compression) *FileTransmissionCommand {
 	if use_rsync && self.rsync_capable {
 		self.ttype = TransmissionType_rsync
 	}
 	if self.compression_capable {
-		self.compression = Compression_zlib
-		self.compressor = NewZlibCompressor()
+		self.compression = compression
+		if compression == Compression_zstd {
+			self.compressor = NewZstdCompressor()
+		} else {
+			self.compression = Compression_zlib
+			self.compressor = NewZlibCompressor()
+		}
 	} else {
 		self.compressor = &IdentityCompressor{}
 	}
 	return &FileTransmissionCommand{
 		Action: Action_file, Compression: self.compression, Ftype: self.file_type,
 		Name: self.remote_path, Permissions: self.permissions, Mtime: time.Duration(self.mtime.UnixNano()),
-		File_id: self.file_id, Ttype: self.ttype,
+		File_id: self.file_id, Ttype: self.ttype, Checksum: utils.IfElse(verify && self.file_type == FileType_regular, checksum_algorithm, ""),
 	}
 }
 
+func (self *SendManager) file_metadata_command(f *File, use_rsync bool) *FileTransmissionCommand {
+	ftc := f.metadata_command(use_rsync, self.verify, self.compression)
+	if self.xattrs && f.stream == nil {
+		f.xattrs = read_extended_metadata(f.expanded_local_path, f.stat_result)
+		f.xattrs.serialize_to(ftc)
+	}
+	if self.sparse && f.file_type == FileType_regular && f.ttype == TransmissionType_simple && f.stream == nil {
+		f.read_hole_map()
+		ftc.Extents = f.hole_map.String()
+	}
+	return ftc
+}
+
 func (self *SendManager) send_file_metadata(send func(string)) {
 	for _, f := range self.files {
-		ftc := f.metadata_command(self.use_rsync)
-		send(ftc.Serialize())
+		send(self.file_metadata_command(f, self.use_rsync).Serialize())
 	}
 }
 
@@ -693,18 +923,23 @@ func (self *SendManager) update_collective_statuses() {
 
 func (self *SendManager) on_file_status_update(ftc *FileTransmissionCommand) error {
 	file := self.fid_map[ftc.File_id]
-	if file == nil {
+	if file == nil || file.canceled {
 		return nil
 	}
 	switch ftc.Status {
 	case `STARTED`:
 		file.remote_final_path = ftc.Name
 		file.remote_initial_size = int64(ftc.Size)
-		if file.file_type == FileType_directory {
+		self.events.file_started(file.expanded_local_path, file.file_size)
+		if file.is_unchanged_remotely(ftc) {
+			self.skip_file(file)
+		} else if file.file_type == FileType_directory {
 			file.state = FINISHED
 		} else {
 			if ftc.Ttype == TransmissionType_rsync {
 				file.state = WAITING_FOR_DATA
+			} else if file.stream != nil {
+				file.start_stream(self.bwlimit.chunk_size(), self.wakeup)
 			} else {
 				file.state = TRANSMITTING
 			}
@@ -719,12 +954,26 @@ func (self *SendManager) on_file_status_update(ftc *FileTransmissionCommand) err
 		file.reported_progress = int64(ftc.Size)
 		self.progress_tracker.on_file_progress(file, change)
 		self.file_progress(file, int(change))
+		self.events.file_progress(file.expanded_local_path, file.reported_progress, file.file_size)
 	default:
 		if ftc.Name != "" && file.remote_final_path == "" {
 			file.remote_final_path = ftc.Name
 		}
+		if ftc.Status == `OK` && self.verify && file.file_type == FileType_regular {
+			if err := file.verify_checksum(ftc.Checksum); err != nil {
+				ftc.Status = err.Error()
+			}
+		}
+		if ftc.Status != `OK` && self.can_retry(file) {
+			self.schedule_retry(file)
+			return nil
+		}
 		file.state = ACKNOWLEDGED
+		file.xattrs.add_unpreserved(ftc.Unpreserved)
 		if ftc.Status == `OK` {
+			if file.file_type == FileType_regular && self.journal != nil && file.stream == nil {
+				self.journal.record(file.journal_key(), file.file_size, file.mtime)
+			}
 			if ftc.Size > 0 {
 				change := int64(ftc.Size) - file.reported_progress
 				file.reported_progress = int64(ftc.Size)
@@ -734,17 +983,44 @@ func (self *SendManager) on_file_status_update(ftc *FileTransmissionCommand) err
 		} else {
 			file.err_msg = ftc.Status
 		}
+		self.events.file_done(file.expanded_local_path, file.file_size, file.err_msg)
+		self.on_file_hook(file)
 		self.progress_tracker.on_file_done(file)
 		self.file_done(file)
-		if self.active_idx > -1 && file == self.files[self.active_idx] {
-			self.active_idx = -1
-		}
+		self.deactivate_file(file)
 		self.update_collective_statuses()
 	}
 	return nil
 }
 
-func (self *File) start_delta_calculation() (err error) {
+// Skip a file that is unchanged on the computer running the terminal. The
+// terminal is told to cancel it, so that it stops sending its signature.
+func (self *SendManager) skip_file(f *File) {
+	if self.cancel_file_supported && self.send_command != nil {
+		self.send_command(FileTransmissionCommand{Action: Action_cancel, File_id: f.file_id}.Serialize())
+	}
+	f.skipped = true
+	f.state = ACKNOWLEDGED
+	change := f.file_size - f.reported_progress
+	f.reported_progress = f.file_size
+	self.progress_tracker.on_file_progress(f, change)
+	self.file_progress(f, int(change))
+	self.events.file_done(f.expanded_local_path, f.file_size, "")
+	self.progress_tracker.on_file_done(f)
+	self.file_done(f)
+	self.deactivate_file(f)
+	self.update_collective_statuses()
+}
+
+// Files whose holes cannot be read are sent in full
+func (self *File) read_hole_map() {
+	if f, err := os.Open(self.expanded_local_path); err == nil {
+		defer f.Close()
+		self.hole_map, _ = read_hole_map(f, self.file_size)
+	}
+}
+
+func (self *File) start_delta_calculation(async bool, wakeup func()) (err error) {
 	self.state = TRANSMITTING
 	if self.actual_file == nil {
 		self.actual_file, err = os.Open(self.expanded_local_path)
@@ -754,6 +1030,24 @@ func (self *File) start_delta_calculation() (err error) {
 	}
 	self.deltabuf = bytes.NewBuffer(make([]byte, 0, 32+rsync.DataSizeMultiple*self.differ.BlockSize()))
 	self.delta_loader = self.differ.CreateDelta(self.actual_file, self.deltabuf)
+	if async {
+		// calculate the delta while other files are being transmitted
+		ch := make(chan delta_chunk, 4)
+		loader, buf := self.delta_loader, self.deltabuf
+		self.delta_chunks, self.delta_loader, self.deltabuf = ch, nil, nil
+		go func() {
+			defer close(ch)
+			for {
+				buf.Reset()
+				err := loader()
+				ch <- delta_chunk{data: slices.Clone(buf.Bytes()), err: err}
+				wakeup()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
 	return nil
 }
 
@@ -773,7 +1067,7 @@ func (self *SendManager) on_signature_data_received(ftc *FileTransmissionCommand
 		if err := file.differ.FinishSignatureData(); err != nil {
 			return err
 		}
-		return file.start_delta_calculation()
+		return file.start_delta_calculation(self.jobs > 1, self.wakeup)
 	}
 	return nil
 }
@@ -786,6 +1080,14 @@ func (self *SendManager) on_file_transfer_response(ftc *FileTransmissionCommand)
 		}
 		if ftc.Status == "OK" {
 			self.state = SEND_PERMISSION_GRANTED
+			self.compression = negotiated_compression(ftc)
+			self.sparse = self.sparse && is_preserved(ftc, "sparse")
+			features := strings.Split(ftc.Features, ",")
+			self.cancel_file_supported = slices.Contains(features, "cancel_file")
+			self.retry_file_supported = slices.Contains(features, "retry_file")
+			if self.auto_jobs && slices.Contains(features, "multiplex") {
+				self.jobs = multiplexed_jobs
+			}
 		} else {
 			self.state = SEND_PERMISSION_DENIED
 		}
@@ -801,7 +1103,7 @@ func (self *SendHandler) on_file_transfer_response(ftc *FileTransmissionCommand)
 	if ftc.Id != self.manager.request_id {
 		return nil
 	}
-	if ftc.Action == Action_status && ftc.Status == "CANCELED" {
+	if ftc.Action == Action_status && ftc.Status == "CANCELED" && ftc.File_id == "" {
 		self.lp.Quit(1)
 		return nil
 	}
@@ -887,32 +1189,31 @@ func (self *SendHandler) print_check_paths() {
 	self.print_continue_msg()
 }
 
-func (self *SendManager) activate_next_ready_file() *File {
-	if self.active_idx > -1 && self.active_idx < len(self.files) {
-		self.files[self.active_idx].transmit_ended_at = time.Now()
-	}
-	for i, f := range self.files {
-		if f.state == TRANSMITTING {
-			self.active_idx = i
-			self.update_collective_statuses()
+// Start transmitting files that are ready, till there are jobs files being transmitted
+func (self *SendManager) activate_ready_files() {
+	for _, f := range self.files {
+		if len(self.active_files) >= self.jobs {
+			break
+		}
+		if f.state == TRANSMITTING && !f.paused && !slices.Contains(self.active_files, f) {
+			self.active_files = append(self.active_files, f)
 			self.progress_tracker.change_active_file(f)
-			return f
 		}
 	}
-	self.active_idx = -1
 	self.update_collective_statuses()
-	return nil
 }
 
-func (self *SendManager) active_file() *File {
-	if self.active_idx > -1 && self.active_idx < len(self.files) {
-		return self.files[self.active_idx]
+func (self *SendManager) deactivate_file(f *File) {
+	if idx := slices.Index(self.active_files, f); idx > -1 {
+		f.transmit_ended_at = time.Now()
+		self.active_files = slices.Delete(self.active_files, idx, idx+1)
+		if self.next_active > idx {
+			self.next_active--
+		}
 	}
-	return nil
 }
 
-func (self *File) next_chunk() (ans string, asz int, err error) {
-	const sz = 1024 * 1024
+func (self *File) next_chunk(sz int) (ans string, asz int, err error) {
 	switch self.file_type {
 	case FileType_symlink:
 		self.state = FINISHED
@@ -925,7 +1226,22 @@ func (self *File) next_chunk() (ans string, asz int, err error) {
 	}
 	is_last := false
 	var chunk []byte
-	if self.delta_loader != nil {
+	if self.delta_chunks != nil {
+		select {
+		case c := <-self.delta_chunks:
+			if c.err != nil {
+				if c.err != io.EOF {
+					err = c.err
+					return
+				}
+				is_last = true
+			}
+			chunk = c.data
+		default:
+			err = delta_not_ready
+			return
+		}
+	} else if self.delta_loader != nil {
 		self.deltabuf.Reset()
 		if err = self.delta_loader(); err != nil {
 			if err == io.EOF {
@@ -945,14 +1261,25 @@ func (self *File) next_chunk() (ans string, asz int, err error) {
 		}
 		chunk = make([]byte, sz)
 		var n int
-		n, err = self.actual_file.Read(chunk)
-		if err != nil && !errors.Is(err, io.EOF) {
-			return
-		}
-		if n <= 0 {
-			is_last = true
-		} else if pos, _ := self.actual_file.Seek(0, os.SEEK_CUR); pos >= self.file_size {
-			is_last = true
+		if self.hole_map != nil {
+			if self.sparse_reader == nil {
+				self.sparse_reader = self.hole_map.reader(self.actual_file)
+			}
+			n, err = io.ReadFull(self.sparse_reader, chunk)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+			is_last = self.sparse_reader.done()
+		} else {
+			n, err = self.actual_file.Read(chunk)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return
+			}
+			if n <= 0 {
+				is_last = true
+			} else if pos, _ := self.actual_file.Seek(0, os.SEEK_CUR); pos >= self.file_size {
+				is_last = true
+			}
 		}
 		chunk = chunk[:n]
 	}
@@ -973,54 +1300,73 @@ func (self *File) next_chunk() (ans string, asz int, err error) {
 		}
 		self.delta_loader = nil
 		self.deltabuf = nil
+		self.delta_chunks = nil
 	}
 	ans, asz = utils.UnsafeBytesToString(cchunk), uncompressed_sz
 	return
 }
 
+// The size of the chunks files are read in. When the data of several files is
+// interleaved the chunks are small so that every file makes progress promptly.
+func (self *SendManager) chunk_size() int {
+	if self.jobs > 1 {
+		return utils.Min(self.bwlimit.chunk_size(), multiplexed_chunk_size)
+	}
+	return self.bwlimit.chunk_size()
+}
+
+// Send the next chunk of one of the active files, cycling through the active
+// files so that their data is interleaved
 func (self *SendManager) next_chunks(callback func(string)) error {
-	for {
-		if self.active_file() == nil {
-			self.activate_next_ready_file()
-		}
-		af := self.active_file()
-		if af == nil {
-			return nil
-		}
-		chunk := ""
-		self.current_chunk_uncompressed_sz = 0
+	self.activate_ready_files()
+	for range self.active_files {
+		self.next_active %= len(self.active_files)
+		af := self.active_files[self.next_active]
+		self.next_active++
+		chunk, usz := "", 0
+		var err error
+		uncompressed_sz := int64(0)
 		for af.state != FINISHED && len(chunk) == 0 {
-			c, usz, err := af.next_chunk()
-			if err != nil {
-				return err
+			if chunk, usz, err = af.next_chunk(self.chunk_size()); err != nil {
+				break
 			}
-			self.current_chunk_uncompressed_sz += int64(usz)
-			chunk = c
+			uncompressed_sz += int64(usz)
+		}
+		if err == delta_not_ready {
+			// skip files whose delta is still being calculated
+			continue
+		} else if err != nil {
+			return err
 		}
+		self.current_chunk_uncompressed_sz = uncompressed_sz
+		self.progress_tracker.active_file = af
 		is_last := af.state == FINISHED
+		af.data_sent = true
 		if len(chunk) > 0 {
 			split_for_transfer(utils.UnsafeStringToBytes(chunk), af.file_id, is_last, func(ftc *FileTransmissionCommand) { callback(ftc.Serialize()) })
 		} else if is_last {
 			callback(FileTransmissionCommand{Action: Action_end_data, File_id: af.file_id}.Serialize())
 		}
 		if is_last {
-			self.activate_next_ready_file()
-			if self.active_file() == nil {
-				return nil
-			}
+			self.deactivate_file(af)
 		}
+		return nil
 	}
+	return nil
 }
 
 func (self *SendHandler) transmit_next_chunk() (err error) {
 	found_chunk := false
+	var amt int64
 	err = self.manager.next_chunks(func(chunk string) {
 		self.send_payload(chunk)
 		found_chunk = true
+		amt += int64(len(self.manager.prefix) + len(chunk) + len(self.manager.suffix))
 	})
 	if err != nil {
 		return err
 	}
+	self.throttle = self.manager.bwlimit.consume(amt, time.Now())
 	if !found_chunk {
 		if self.manager.all_acknowledged {
 			self.transfer_finished()
@@ -1030,10 +1376,8 @@ func (self *SendHandler) transmit_next_chunk() (err error) {
 }
 
 func (self *SendHandler) start_transfer() (err error) {
-	if self.manager.active_file() == nil {
-		self.manager.activate_next_ready_file()
-	}
-	if self.manager.active_file() != nil {
+	self.manager.activate_ready_files()
+	if len(self.manager.active_files) > 0 {
 		self.transmit_started = true
 		self.manager.progress_tracker.start_transfer()
 		if err = self.transmit_next_chunk(); err != nil {
@@ -1049,8 +1393,10 @@ func (self *SendHandler) initialize() error {
 	self.spinner = tui.NewSpinner("dots")
 	self.ctx = markup.New(true)
 	self.send_payload(self.manager.start_transfer())
-	if self.opts.PermissionsBypass != "" {
-		// dont wait for permission, not needed with a bypass and avoids a roundtrip
+	if self.opts.PermissionsBypass != "" && self.opts.Compress == "never" && !self.opts.Sparse {
+		// dont wait for permission, not needed with a bypass and avoids a
+		// roundtrip, unless the response is needed to negotiate compression
+		// or sparse file support
 		self.send_file_metadata()
 	}
 	return nil
@@ -1069,6 +1415,10 @@ func (self *SendHandler) on_text(text string, from_key_event, in_bracketed_paste
 	if self.quit_after_write_code > -1 {
 		return nil
 	}
+	if self.queue != nil && self.transmit_started {
+		self.on_queue_text(text)
+		return nil
+	}
 	if self.check_paths_printed && !self.transmit_started {
 		switch strings.ToLower(text) {
 		case "y":
@@ -1121,7 +1471,9 @@ func (self *SendHandler) on_key_event(ev *loop.KeyEvent) error {
 	if self.quit_after_write_code > -1 {
 		return nil
 	}
-	if ev.MatchesPressOrRepeat("esc") {
+	if self.queue != nil && self.transmit_started && self.on_queue_key_event(ev) {
+		ev.Handled = true
+	} else if ev.MatchesPressOrRepeat("esc") {
 		ev.Handled = true
 		if self.check_paths_printed && !self.transmit_started {
 			self.failed_files = nil
@@ -1149,7 +1501,15 @@ func (self *SendHandler) on_writing_finished(msg_id loop.IdType) (err error) {
 		return
 	}
 	if self.manager.state == SEND_PERMISSION_GRANTED && (!self.transmit_started || chunk_transmitted) {
-		self.lp.CallSoon(self.loop_tick)
+		if chunk_transmitted && self.throttle > 0 {
+			// wait till the token bucket has enough tokens for the next chunk
+			self.throttle_timer, _ = self.lp.AddTimer(self.throttle, false, func(timer_id loop.IdType) error {
+				self.throttle_timer = 0
+				return self.loop_tick(timer_id)
+			})
+		} else {
+			self.lp.CallSoon(self.loop_tick)
+		}
 	}
 	return
 }
@@ -1166,8 +1526,21 @@ func (self *SendHandler) on_interrupt() {
 	self.abort_transfer()
 }
 
-func send_loop(opts *Options, files []*File) (err error, rc int) {
-	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors)
+func send_loop(opts *Options, files []*File, journal *transfer_journal) (err error, rc int) {
+	lp_opts := []func(*loop.Loop){loop.NoRestoreColors}
+	if !opts.Queue {
+		// the interactive queue uses the full screen
+		lp_opts = append(lp_opts, loop.NoAlternateScreen)
+	}
+	lp, err := loop.New(lp_opts...)
+	if err != nil {
+		return err, 1
+	}
+	rate, err := parse_rate(opts.Bwlimit)
+	if err != nil {
+		return err, 1
+	}
+	hooks, err := new_hook_runner(opts, "send")
 	if err != nil {
 		return err, 1
 	}
@@ -1177,11 +1550,19 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 		max_name_length: utils.Max(0, utils.Map(func(f *File) int { return wcswidth.Stringwidth(f.display_name) }, files)...),
 		progress_drawn:  true, done_file_ids: utils.NewSet[string](),
 		manager: &SendManager{
-			request_id: random_id(), files: files, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas,
+			request_id: random_id(), files: files, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas || opts.Resume,
+			journal: journal, jobs: opts.Jobs, wakeup: func() { lp.WakeupMainThread() }, bwlimit: new_token_bucket(rate),
+			verify: opts.Verify, xattrs: opts.Xattrs, sparse: opts.Sparse, events: new_event_writer(opts),
+			max_retries: opts.MaxRetries, hooks: hooks,
 		},
 	}
+	if opts.Queue {
+		handler.queue = &queue_view{}
+	}
 	handler.manager.file_progress = handler.on_file_progress
 	handler.manager.file_done = handler.on_file_done
+	handler.manager.retry_file = handler.on_file_retry
+	handler.manager.send_command = handler.send_payload
 
 	lp.OnInitialize = func() (string, error) {
 		lp.SetCursorVisible(false)
@@ -1210,6 +1591,14 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 	lp.OnKeyEvent = handler.on_key_event
 	lp.OnResize = handler.on_resize
 	lp.OnWriteComplete = handler.on_writing_finished
+	lp.OnWakeup = func() error {
+		// a delta chunk calculated in the background is ready, send it unless
+		// a chunk is already being written
+		if handler.transmit_started && handler.manager.current_chunk_uncompressed_sz < 0 && handler.throttle_timer == 0 {
+			lp.CallSoon(handler.loop_tick)
+		}
+		return nil
+	}
 
 	err = lp.Run()
 	if err != nil {
@@ -1223,7 +1612,7 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 	if handler.manager.has_rsync && p.total_transferred+int64(p.signature_bytes) > 0 {
 		var tsf int64
 		for _, f := range files {
-			if f.ttype == TransmissionType_rsync {
+			if f.ttype == TransmissionType_rsync && !f.skipped {
 				tsf += f.file_size
 			}
 		}
@@ -1231,6 +1620,20 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 			print_rsync_stats(tsf, p.total_transferred, int64(p.signature_bytes))
 		}
 	}
+	if n := len(utils.Filter(files, func(f *File) bool { return f.skipped })); n > 0 {
+		fmt.Printf("Skipped %d files that were already transferred\n", n)
+	}
+	unpreserved := []unpreserved_metadata{}
+	for _, f := range files {
+		if len(f.xattrs.unpreserved) > 0 {
+			unpreserved = append(unpreserved, unpreserved_metadata{f.display_name, f.xattrs.unpreserved})
+		}
+	}
+	print_unpreserved_metadata(unpreserved)
+	handler.manager.events.totals(len(files), len(handler.failed_files), p.total_transferred)
+	if handler.manager.hooks.finish(p.total_transferred) > 0 {
+		rc = 1
+	}
 	if len(handler.failed_files) > 0 {
 		fmt.Fprintf(os.Stderr, "Transfer of %d out of %d files failed\n", len(handler.failed_files), len(handler.manager.files))
 		for _, f := range handler.failed_files {
@@ -1246,14 +1649,26 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 }
 
 func send_main(opts *Options, args []string) (err error, rc int) {
+	journal, err := open_journal(opts, args, opts.Resume)
+	if err != nil {
+		return fmt.Errorf("Failed to open the transfer journal with error: %w", err), 1
+	}
+	defer journal.close()
 	fmt.Println("Scanning files…")
 	files, err := files_for_send(opts, args)
 	if err != nil {
 		return err, 1
 	}
+	if opts.Resume {
+		if n := mark_transferred_files(files, journal); n > 0 {
+			fmt.Printf("%d files were already transferred, they will be skipped if unchanged\n", n)
+		}
+	}
 	fmt.Printf("Found %d files and directories, requesting transfer permission…", len(files))
 	fmt.Println()
-	err, rc = send_loop(opts, files)
-
+	err, rc = send_loop(opts, files, journal)
+	if err == nil && rc == 0 {
+		journal.remove()
+	}
 	return
 }
@@ -3,13 +3,21 @@
 package transfer
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/exp/slices"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
 )
 
 var _ = fmt.Print
@@ -100,3 +108,765 @@ func TestPathMappingSend(t *testing.T) {
 		ae(f.file_type, FileType_link)
 	})
 }
+
+func TestSendResume(t *testing.T) {
+	tdir := t.TempDir()
+	for _, x := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(tdir, x), []byte(x), 0o600)
+	}
+	os.Symlink("c", filepath.Join(tdir, "s"))
+	files, err := files_for_send(&Options{}, []string{filepath.Join(tdir, "a"), filepath.Join(tdir, "b"), filepath.Join(tdir, "c"), filepath.Join(tdir, "s"), "/dest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &transfer_journal{entries: make(map[string]journal_entry)}
+	for _, f := range files {
+		switch filepath.Base(f.expanded_local_path) {
+		case "a", "c":
+			// c is the target of a symlink so must not be skipped
+			j.entries[f.journal_key()] = journal_entry{Key: f.journal_key(), Size: f.file_size, Mtime: f.mtime.UnixNano()}
+		case "b":
+			j.entries[f.journal_key()] = journal_entry{Key: f.journal_key(), Size: f.file_size + 1, Mtime: f.mtime.UnixNano()}
+		}
+	}
+	if n := mark_transferred_files(files, j); n != 1 {
+		t.Fatalf("Incorrect number of files marked as transferred: %d", n)
+	}
+	fm := make(map[string]*File)
+	for _, f := range files {
+		fm[filepath.Base(f.expanded_local_path)] = f
+	}
+	if !fm["a"].already_transferred || fm["b"].already_transferred || fm["c"].already_transferred {
+		t.Fatalf("Incorrect files marked as transferred")
+	}
+	// marked files are skipped only if they are unchanged on the computer running the terminal
+	sent := []string{}
+	m := &SendManager{request_id: "test", files: files, file_progress: func(*File, int) {}, file_done: func(*File) {},
+		send_command: func(x string) { sent = append(sent, x) }}
+	m.initialize()
+	m.on_file_transfer_response(&FileTransmissionCommand{Action: Action_status, Status: "OK", Features: "cancel_file"})
+	a := fm["a"]
+	started := func(f *File, size int64, mtime time.Time) {
+		f.state = WAITING_FOR_START
+		m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "STARTED", Size: size, Mtime: time.Duration(mtime.UnixNano())})
+	}
+	started(a, a.file_size, a.mtime.Add(time.Second))
+	started(a, a.file_size+1, a.mtime)
+	started(fm["b"], fm["b"].file_size, fm["b"].mtime)
+	if a.skipped || fm["b"].skipped || len(sent) > 0 {
+		t.Fatalf("Changed file skipped")
+	}
+	started(a, a.file_size, a.mtime)
+	if !a.skipped || a.state != ACKNOWLEDGED {
+		t.Fatalf("Unchanged file not skipped")
+	}
+	if len(sent) != 1 {
+		t.Fatalf("Skipped file not canceled: %#v", sent)
+	}
+	if c, err := NewFileTransmissionCommand(sent[0]); err != nil || c.Action != Action_cancel || c.File_id != a.file_id {
+		t.Fatalf("Skipped file not canceled: %#v", sent)
+	}
+}
+
+func TestSendJobs(t *testing.T) {
+	tdir := t.TempDir()
+	args := []string{}
+	for _, x := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(tdir, x), []byte(strings.Repeat(x, 1536*1024)), 0o600)
+		args = append(args, filepath.Join(tdir, x))
+	}
+	files, err := files_for_send(&Options{}, append(args, "/dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &SendManager{request_id: "test", files: files, jobs: 2}
+	m.initialize()
+	for _, f := range files {
+		f.compressor = &IdentityCompressor{}
+		f.state = TRANSMITTING
+	}
+	order := []string{}
+	for {
+		sent := false
+		if err = m.next_chunks(func(string) { sent = true }); err != nil {
+			t.Fatal(err)
+		}
+		if !sent {
+			break
+		}
+		order = append(order, filepath.Base(m.progress_tracker.active_file.expanded_local_path))
+	}
+	// the interleaved files are sent in chunks of multiplexed_chunk_size
+	n := 1536 * 1024 / multiplexed_chunk_size
+	expected := append(strings.Split(strings.Repeat("ab", n), ""), strings.Split(strings.Repeat("c", n), "")...)
+	if diff := cmp.Diff(expected, order); diff != "" {
+		t.Fatalf("Chunks not interleaved correctly:\n%s", diff)
+	}
+	// by default files are interleaved only if the terminal supports multiplexing
+	for features, expected := range map[string]int{"": 1, "cancel_file": 1, "cancel_file,multiplex": multiplexed_jobs} {
+		m = &SendManager{request_id: "test", files: files}
+		m.initialize()
+		m.on_file_transfer_response(&FileTransmissionCommand{Action: Action_status, Status: "OK", Features: features})
+		if m.jobs != expected {
+			t.Fatalf("Incorrect number of jobs with features: %#v: %d != %d", features, m.jobs, expected)
+		}
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	for raw, expected := range map[string]int64{
+		"": 0, "0": 0, "100": 100, "2MB/s": 2000000, "512k": 512000, "1.5MiB/s": 1572864, "1 KiB": 1024, "3G": 3000000000,
+	} {
+		if actual, err := parse_rate(raw); err != nil {
+			t.Fatalf("Failed to parse rate: %#v with error: %s", raw, err)
+		} else if actual != expected {
+			t.Fatalf("Rate: %#v parsed to %d != %d", raw, actual, expected)
+		}
+	}
+	for _, raw := range []string{"x", "-1k", "2Xi", "MB"} {
+		if _, err := parse_rate(raw); err == nil {
+			t.Fatalf("Invalid rate: %#v not rejected", raw)
+		}
+	}
+	if new_token_bucket(0).consume(1000, time.Now()) != 0 {
+		t.Fatalf("Nil token bucket limited rate")
+	}
+	b := new_token_bucket(1000)
+	now := b.last
+	if d := b.consume(1000, now); d != 0 {
+		t.Fatalf("Burst of one second of data was throttled for: %s", d)
+	}
+	if d := b.consume(500, now); d != 500*time.Millisecond {
+		t.Fatalf("Incorrect delay: %s", d)
+	}
+	if d := b.consume(500, now.Add(time.Second)); d != 0 {
+		t.Fatalf("Tokens not replenished, delay: %s", d)
+	}
+	// when receiving, the terminal is asked to limit the rate
+	for _, rate := range []int64{0, 1000} {
+		m := &manager{spec: []string{"x"}, bwlimit: new_token_bucket(rate)}
+		requested := int64(-1)
+		m.start_transfer(func(x string) loop.IdType {
+			if ftc, err := NewFileTransmissionCommand(x); err == nil && ftc.Action == Action_receive {
+				requested = ftc.Rate
+			}
+			return 0
+		})
+		if requested != rate {
+			t.Fatalf("Incorrect rate requested from the terminal: %d != %d", requested, rate)
+		}
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	tdir := t.TempDir()
+	ff := filepath.Join(tdir, "filters")
+	os.WriteFile(ff, []byte("# comment\n\n+ keep.o\n- *.o\n- /top/b?ild/\n- **/cache/*.tmp\n"), 0o600)
+	filter, err := new_file_filter(&Options{Exclude: []string{".git"}, Include: []string{"a/.git"}, FilterFrom: ff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, excluded := range map[string]bool{
+		".git": true, "top/.git": true, "top/a/.git": false, "top/x.git": false,
+		"top/x.o": true, "top/keep.o": false, "top/build": true, "top/sub/build": false,
+		"cache/x.tmp": false, "top/a/cache/x.tmp": true, "top/a/cache/x.tmpx": false,
+	} {
+		if actual := filter.is_excluded(rel, true); actual != excluded {
+			t.Fatalf("Incorrect exclusion for: %s (%v != %v)", rel, actual, excluded)
+		}
+	}
+	if filter.is_excluded("top/build", false) {
+		t.Fatalf("Directory only pattern excluded a file")
+	}
+	if !filter.is_excluded_with_ancestors("top/build/x/y", false) {
+		t.Fatalf("File in excluded directory not excluded")
+	}
+	for _, x := range []string{"top/a/.git/config", "top/b/.git/config", "top/b/x", "top/b/x.o", "top/build/y"} {
+		p := filepath.Join(tdir, x)
+		os.MkdirAll(filepath.Dir(p), 0o700)
+		os.WriteFile(p, nil, 0o600)
+	}
+	files, err := files_for_send(&Options{Exclude: []string{".git", "*.o", "/top/build/"}}, []string{filepath.Join(tdir, "top"), "/dest/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := utils.Map(func(f *File) string { return f.remote_path }, files)
+	slices.Sort(actual)
+	if diff := cmp.Diff([]string{"/dest/top", "/dest/top/a", "/dest/top/b", "/dest/top/b/x"}, actual); diff != "" {
+		t.Fatalf("Incorrect files:\n%s", diff)
+	}
+	if _, err = new_file_filter(&Options{FilterFrom: ff + "x"}); err == nil {
+		t.Fatalf("Missing filter file did not cause an error")
+	}
+	os.WriteFile(ff, []byte("x\n"), 0o600)
+	if _, err = new_file_filter(&Options{FilterFrom: ff}); err == nil {
+		t.Fatalf("Invalid filter file did not cause an error")
+	}
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	tdir := t.TempDir()
+	top := filepath.Join(tdir, "top")
+	os.MkdirAll(filepath.Join(top, "d"), 0o700)
+	os.WriteFile(filepath.Join(top, "d", "f"), []byte("f"), 0o600)
+	os.WriteFile(filepath.Join(tdir, "outside"), []byte("o"), 0o600)
+	os.Symlink("d/f", filepath.Join(top, "inside"))
+	os.Symlink("../outside", filepath.Join(top, "escapes"))
+	os.Symlink(filepath.Join(tdir, "outside"), filepath.Join(top, "d", "abs"))
+	os.Symlink("..", filepath.Join(top, "d", "loop"))
+	os.Symlink("missing", filepath.Join(top, "dangling"))
+	os.Symlink("d", filepath.Join(top, "dirlink"))
+
+	gm := func(links string) map[string]string {
+		files, err := files_for_send(&Options{Links: links}, []string{top, "/dest/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id_map := make(map[string]string, len(files))
+		for _, f := range files {
+			id_map[f.file_id] = strings.TrimPrefix(f.remote_path, "/dest/")
+		}
+		// render the ids of link targets as paths as they depend on the
+		// order in which the files are listed
+		target := func(x string) string {
+			if q, id, found := strings.Cut(x, ":"); found && q != "path" {
+				return q + ":" + id_map[id]
+			}
+			return x
+		}
+		ans := make(map[string]string, len(files))
+		for _, f := range files {
+			ans[id_map[f.file_id]] = strings.TrimSpace(f.file_type.ShortText() + " " + target(f.symbolic_link_target) + target(f.hard_link_target))
+		}
+		return ans
+	}
+	for links, expected := range map[string]map[string]string{
+		"preserve": {
+			"top": "dir", "top/d": "dir", "top/d/f": "fil",
+			"top/inside": "sym fid:top/d/f", "top/escapes": "sym path:../outside", "top/d/abs": "sym path:" + filepath.Join(tdir, "outside"),
+			"top/d/loop": "sym fid:top", "top/dangling": "sym path:missing", "top/dirlink": "sym fid:top/d",
+		},
+		"skip": {"top": "dir", "top/d": "dir", "top/d/f": "fil"},
+		"munge-unsafe": {
+			"top": "dir", "top/d": "dir", "top/d/f": "fil",
+			"top/inside": "sym fid:top/d/f", "top/escapes": "sym path:/rsyncd-munged/../outside",
+			"top/d/abs": "sym path:/rsyncd-munged" + filepath.Join(tdir, "outside"), "top/d/loop": "sym fid:top",
+			"top/dangling": "sym path:missing", "top/dirlink": "sym fid:top/d",
+		},
+		"follow": {
+			"top": "dir", "top/d": "dir", "top/d/f": "fil", "top/inside": "lnk fid:top/d/f",
+			"top/d/abs": "fil", "top/escapes": "lnk fid:top/d/abs",
+			"top/dirlink": "dir", "top/dirlink/f": "lnk fid:top/d/f", "top/dirlink/abs": "lnk fid:top/d/abs",
+		},
+	} {
+		if diff := cmp.Diff(expected, gm(links)); diff != "" {
+			t.Fatalf("Incorrect files for --links=%s:\n%s", links, diff)
+		}
+	}
+	// symlinks that form a cycle through directories that do not contain
+	// them must be followed only until they reach a directory being walked
+	cycle := filepath.Join(tdir, "cycle")
+	os.MkdirAll(filepath.Join(cycle, "a"), 0o700)
+	os.MkdirAll(filepath.Join(cycle, "b"), 0o700)
+	os.Symlink("../b", filepath.Join(cycle, "a", "x"))
+	os.Symlink("../a", filepath.Join(cycle, "b", "y"))
+	files, err := files_for_send(&Options{Links: "follow"}, []string{cycle, "/dest/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := utils.Map(func(f *File) string {
+		return f.file_type.ShortText() + " " + strings.TrimPrefix(f.remote_path, "/dest/")
+	}, files)
+	slices.Sort(actual)
+	if diff := cmp.Diff([]string{"dir cycle", "dir cycle/a", "dir cycle/a/x", "dir cycle/b", "dir cycle/b/y"}, actual); diff != "" {
+		t.Fatalf("Incorrect files for a symlink cycle:\n%s", diff)
+	}
+	for _, x := range [][3]string{
+		{"a", "b", ""}, {"a/b/c", "../d", ""}, {"a/b/c", "..", ""}, {"a/b", "./c/../d", ""},
+		{"a", "../b", "u"}, {"a/b", "../c", "u"}, {"a/b/c", "../../d", "u"}, {"a/b", "/c", "u"}, {"a/b/c", "x/../../../d", "u"},
+	} {
+		if actual := is_unsafe_symlink(x[0], x[1]); actual != (x[2] != "") {
+			t.Fatalf("The symlink %s -> %s has incorrect safety: %v", x[0], x[1], actual)
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	tdir := t.TempDir()
+	os.Mkdir(filepath.Join(tdir, "d"), 0o700)
+	args := []string{filepath.Join(tdir, "d")}
+	for _, x := range []string{"a", "b", "c", "e"} {
+		os.WriteFile(filepath.Join(tdir, x), []byte(x), 0o600)
+		args = append(args, filepath.Join(tdir, x))
+	}
+	files, err := files_for_send(&Options{}, append(args, "/dest/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := []string{}
+	m := &SendManager{request_id: "test", files: files, file_done: func(f *File) { done = append(done, f.remote_path) }}
+	m.initialize()
+	order := func() string { return order_of(m.queued_files()) }
+	fm := make(map[string]*File)
+	for _, f := range files {
+		fm[path.Base(f.remote_path)] = f
+	}
+	ae := func(expected, actual string) {
+		t.Helper()
+		if expected != actual {
+			t.Fatalf("%#v != %#v", expected, actual)
+		}
+	}
+	ae("abce", order())
+	m.move_in_queue(fm["e"], 1)
+	ae("aebc", order())
+	m.move_in_queue(fm["a"], 2)
+	ae("ebac", order())
+	m.move_in_queue(fm["e"], -1)
+	ae("ebac", order())
+	if files[0] != fm["d"] {
+		t.Fatalf("Directory moved in the queue")
+	}
+	fm["e"].data_sent = true
+	m.send_next(fm["c"])
+	ae("ecba", order())
+
+	for _, f := range m.queued_files() {
+		f.state = TRANSMITTING
+	}
+	m.toggle_pause(fm["e"])
+	m.activate_ready_files()
+	ae("c", order_of(m.active_files))
+	m.toggle_pause(fm["c"])
+	m.activate_ready_files()
+	ae("b", order_of(m.active_files))
+	m.toggle_pause(fm["e"])
+	m.activate_ready_files()
+	ae("b", order_of(m.active_files))
+	m.toggle_pause(fm["b"])
+	m.activate_ready_files()
+	ae("e", order_of(m.active_files))
+
+	sent := []string{}
+	send := func(x string) { sent = append(sent, x) }
+	if err = m.cancel_file(fm["c"], send); err != nil {
+		t.Fatal(err)
+	}
+	ae("/dest/c", strings.Join(done, ","))
+	if c := fm["c"]; c.state != ACKNOWLEDGED || !c.canceled || c.err_msg != "Canceled" || len(sent) > 0 {
+		t.Fatalf("Cancelling a file whose data was not sent failed: %#v %#v", c.err_msg, sent)
+	}
+	if err = m.cancel_file(fm["e"], send); err == nil {
+		t.Fatalf("Cancelling a partially sent file did not fail without terminal support")
+	}
+	m.cancel_file_supported = true
+	if err = m.cancel_file(fm["e"], send); err != nil {
+		t.Fatal(err)
+	}
+	ae("", order_of(m.active_files))
+	if len(sent) != 1 {
+		t.Fatalf("Incorrect number of commands sent to cancel file: %d", len(sent))
+	}
+	if ftc, err := NewFileTransmissionCommand(sent[0]); err != nil {
+		t.Fatal(err)
+	} else if ftc.Action != Action_cancel || ftc.File_id != fm["e"].file_id {
+		t.Fatalf("Incorrect command sent to cancel file: %s", ftc.String())
+	}
+	// responses from the terminal for canceled files are ignored
+	m.on_file_status_update(&FileTransmissionCommand{Action: Action_status, File_id: fm["e"].file_id, Status: "OK"})
+	ae("Canceled", fm["e"].err_msg)
+}
+
+func order_of(files []*File) string {
+	return strings.Join(utils.Map(func(f *File) string { return path.Base(f.remote_path) }, files), "")
+}
+
+func TestSendVerify(t *testing.T) {
+	tdir := t.TempDir()
+	os.WriteFile(filepath.Join(tdir, "a"), []byte("abcd"), 0o600)
+	files, err := files_for_send(&Options{}, []string{filepath.Join(tdir, "a"), "/dest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := files[0]
+	m := &SendManager{request_id: "test", files: files, verify: true, file_progress: func(*File, int) {}, file_done: func(*File) {}}
+	m.initialize()
+	if ftc := f.metadata_command(false, true, Compression_zlib); ftc.Checksum != checksum_algorithm {
+		t.Fatalf("Checksum not requested: %#v", ftc.Checksum)
+	}
+	const expected = "88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589"
+	m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "OK", Checksum: expected})
+	if f.err_msg != "" {
+		t.Fatalf("Verification failed with matching checksum: %s", f.err_msg)
+	}
+	m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "OK", Checksum: "x"})
+	if f.err_msg == "" {
+		t.Fatalf("Verification did not fail with mismatched checksum")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	data := []byte(strings.Repeat("compressible data ", 4096))
+	c := NewZstdCompressor()
+	compressed := append([]byte{}, c.Compress(data[:1000])...)
+	compressed = append(compressed, c.Compress(data[1000:])...)
+	compressed = append(compressed, c.Flush()...)
+	if len(compressed) >= len(data) {
+		t.Fatalf("zstd compression did not reduce the size of the data: %d >= %d", len(compressed), len(data))
+	}
+	r, err := new_zstd_reader(strings.NewReader(string(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(data), string(decompressed)); diff != "" {
+		t.Fatalf("zstd round trip failed:\n%s", diff)
+	}
+	if !has_compressed_magic(compressed) {
+		t.Fatalf("zstd data not recognized as compressed")
+	}
+	for _, h := range []string{"\x89PNG\r\n\x1a\n", "RIFF\x00\x00\x00\x00WEBPVP8 ", "\x00\x00\x00\x18ftypmp42"} {
+		if !has_compressed_magic([]byte(h)) {
+			t.Fatalf("%#v not recognized as compressed", h)
+		}
+	}
+	for _, h := range []string{"", "plain text file", "RIFF\x00\x00\x00\x00WAVEfmt "} {
+		if has_compressed_magic([]byte(h)) {
+			t.Fatalf("%#v incorrectly recognized as compressed", h)
+		}
+	}
+	tdir := t.TempDir()
+	png := filepath.Join(tdir, "image.dat")
+	if err = os.WriteFile(png, []byte("\x89PNG\r\n\x1a\nrest of the image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if local_file_should_be_compressed(png, "auto") || !local_file_should_be_compressed(png, "always") {
+		t.Fatalf("Content sniffing of %s did not work", png)
+	}
+	if negotiated_compression(&FileTransmissionCommand{}) != Compression_zlib || negotiated_compression(&FileTransmissionCommand{Compression: Compression_zstd}) != Compression_zstd {
+		t.Fatalf("Compression negotiation did not work")
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	tdir := t.TempDir()
+	src, dest := filepath.Join(tdir, "src"), filepath.Join(tdir, "dest")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 8 * 1024 * 1024
+	f.Truncate(size)
+	f.WriteAt([]byte(strings.Repeat("a", 8192)), 1024*1024)
+	f.WriteAt([]byte(strings.Repeat("b", 8192)), 4*1024*1024)
+	hm, err := read_hole_map(f, size)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hm == nil {
+		t.Skip("The filesystem does not support sparse files")
+	}
+	if hm.data_size() >= size {
+		t.Fatalf("Hole map has no holes: %s", hm)
+	}
+	q, err := parse_hole_map(hm.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(hm.String(), q.String()); diff != "" {
+		t.Fatalf("Hole map round trip failed:\n%s", diff)
+	}
+	for _, bad := range []string{"x", "10,5:6", "10,1:2,2:1", "10,0:0", "10,3"} {
+		if _, err = parse_hole_map(bad); err == nil {
+			t.Fatalf("Invalid hole map not rejected: %#v", bad)
+		}
+	}
+	sf, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+	data, err := io.ReadAll(hm.reader(sf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != hm.data_size() {
+		t.Fatalf("Read %d bytes of data from the sparse file instead of %d", len(data), hm.data_size())
+	}
+	df, err := os.Create(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &sparse_file{f: df, hm: q}
+	for len(data) > 0 {
+		n := min(len(data), 3000)
+		if _, err = out.write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if _, err = out.write([]byte("x")); err == nil {
+		t.Fatalf("Writing more data than the extents hold did not fail")
+	}
+	if err = out.close(); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := os.ReadFile(src)
+	actual, _ := os.ReadFile(dest)
+	if !slices.Equal(expected, actual) {
+		t.Fatalf("The sparse file was not reproduced correctly")
+	}
+	if df, err = os.Open(dest); err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	if dhm, err := read_hole_map(df, size); err != nil || dhm.String() != hm.String() {
+		t.Fatalf("The destination does not have the same holes as the source: %s != %s", dhm, hm)
+	}
+}
+
+func TestEventWriter(t *testing.T) {
+	var nilw *event_writer
+	nilw.file_started("x", 1)
+	nilw.file_progress("x", 1, 1)
+	if new_event_writer(&Options{OutputFormat: "text"}) != nil {
+		t.Fatalf("Event writer created for text output")
+	}
+	b := strings.Builder{}
+	w := new_event_writer_to(&b)
+	w.file_started("a", 10)
+	w.file_progress("a", 5, 10)
+	w.file_progress("a", 6, 10) // rate limited
+	w.file_done("a", 10, "")
+	w.file_done("b", 3, "failed")
+	w.error(fmt.Errorf("oops"))
+	w.totals(2, 1, 13)
+	actual := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		ev := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("Invalid JSON event: %#v with error: %s", line, err)
+		}
+		if _, found := ev["elapsed"]; !found {
+			t.Fatalf("Event has no elapsed time: %#v", line)
+		}
+		delete(ev, "elapsed")
+		data, _ := json.Marshal(ev)
+		actual = append(actual, string(data))
+	}
+	expected := []string{
+		`{"event":"file_started","name":"a","size":10}`,
+		`{"event":"progress","name":"a","size":10,"transferred":5}`,
+		`{"event":"file_done","name":"a","ok":true,"size":10}`,
+		`{"error":"failed","event":"file_done","name":"b","ok":false,"size":3}`,
+		`{"event":"error","message":"oops"}`,
+		`{"event":"totals","failed":1,"files":2,"transferred":13}`,
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatalf("Incorrect events:\n%s", diff)
+	}
+}
+
+func TestSendStream(t *testing.T) {
+	tdir := t.TempDir()
+	data := strings.Repeat("streamed data ", 1024)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		w.WriteString(data)
+		w.Close()
+	}()
+	if _, err = process_normal_files(&Options{}, []string{"-", "/dest/"}); err == nil {
+		t.Fatalf("Sending STDIN to a directory not prevented")
+	}
+	if _, err = process_normal_files(&Options{}, []string{"-", "a", "/dest/"}); err == nil {
+		t.Fatalf("Sending STDIN with other files not prevented")
+	}
+	f, err := new_stdin_file(&Options{}, r, "/dest/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.remote_path != "/dest/f" || !f.compression_capable {
+		t.Fatalf("Incorrect file for STDIN: %#v", f)
+	}
+	m := &SendManager{request_id: "test", files: []*File{f}, verify: true, file_progress: func(*File, int) {}, file_done: func(*File) {}}
+	m.initialize()
+	f.compressor = &IdentityCompressor{}
+	m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "STARTED"})
+	received := ""
+	for f.state != FINISHED {
+		chunk, _, err := f.next_chunk(1000)
+		if err == delta_not_ready {
+			time.Sleep(time.Millisecond)
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		received += chunk
+	}
+	if received != data {
+		t.Fatalf("Data read from STDIN incorrect: %d != %d", len(received), len(data))
+	}
+	os.WriteFile(filepath.Join(tdir, "data"), []byte(data), 0o600)
+	expected, _ := file_checksum(filepath.Join(tdir, "data"))
+	m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "OK", Checksum: expected})
+	if f.err_msg != "" {
+		t.Fatalf("Verification of STDIN failed with matching checksum: %s", f.err_msg)
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	for retry, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 5: 16 * time.Second, 6: max_retry_delay, 20: max_retry_delay} {
+		if actual := retry_delay(retry); actual != expected {
+			t.Fatalf("Incorrect delay for retry %d: %s != %s", retry, actual, expected)
+		}
+	}
+	tdir := t.TempDir()
+	os.WriteFile(filepath.Join(tdir, "a"), []byte(strings.Repeat("a", 8192)), 0o600)
+	files, err := files_for_send(&Options{}, []string{filepath.Join(tdir, "a"), "/dest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := files[0]
+	delays := []time.Duration{}
+	m := &SendManager{
+		request_id: "test", files: files, jobs: 1, max_retries: 2, file_progress: func(*File, int) {}, file_done: func(*File) {},
+		retry_file: func(f *File, d time.Duration) { delays = append(delays, d) },
+	}
+	m.initialize()
+	m.on_file_transfer_response(&FileTransmissionCommand{Action: Action_status, Status: "OK", Features: "cancel_file,retry_file"})
+	if !m.retry_file_supported {
+		t.Fatalf("Retrying files not negotiated")
+	}
+	m.send_file_metadata(func(string) {})
+	fail := func() {
+		m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "STARTED"})
+		if err = m.next_chunks(func(string) {}); err != nil {
+			t.Fatal(err)
+		}
+		m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "PROGRESS", Size: 4096})
+		m.on_file_status_update(&FileTransmissionCommand{File_id: f.file_id, Status: "EIO: Disk on fire"})
+	}
+	fail()
+	if f.state != WAITING_FOR_START || f.retries != 1 || len(m.active_files) != 0 || f.data_sent {
+		t.Fatalf("Failed file not scheduled for retry: state: %d retries: %d", f.state, f.retries)
+	}
+	if f.reported_progress != 0 || m.progress_tracker.total_reported_progress != 0 {
+		t.Fatalf("Progress not reset for retried file: %d %d", f.reported_progress, m.progress_tracker.total_reported_progress)
+	}
+	sent := ""
+	m.restart_file(f, func(s string) { sent = s })
+	if ftc, err := NewFileTransmissionCommand(sent); err != nil {
+		t.Fatal(err)
+	} else if ftc.Action != Action_file || ftc.File_id != f.file_id || ftc.Ttype != TransmissionType_rsync {
+		t.Fatalf("Incorrect command to retry file: %s", ftc.String())
+	}
+	fail()
+	m.restart_file(f, func(string) {})
+	fail()
+	if f.state != ACKNOWLEDGED || f.err_msg == "" || f.retries != 2 {
+		t.Fatalf("File not failed after exhausting retries: state: %d retries: %d", f.state, f.retries)
+	}
+	if diff := cmp.Diff([]time.Duration{time.Second, 2 * time.Second}, delays); diff != "" {
+		t.Fatalf("Incorrect retry delays:\n%s", diff)
+	}
+}
+
+func TestSizeAndTimeLimits(t *testing.T) {
+	now := time.Date(2023, 7, 10, 12, 0, 0, 0, time.Local)
+	for raw, expected := range map[string]time.Time{
+		"2h": now.Add(-2 * time.Hour), "1.5d": now.Add(-36 * time.Hour), "1w": now.Add(-7 * 24 * time.Hour),
+		"2023-07-01": time.Date(2023, 7, 1, 0, 0, 0, 0, time.Local), "2023-07-01T14:30": time.Date(2023, 7, 1, 14, 30, 0, 0, time.Local),
+	} {
+		if actual, err := parse_newer_than(raw, now); err != nil {
+			t.Fatal(err)
+		} else if !actual.Equal(expected) {
+			t.Fatalf("--newer-than %#v parsed to %s != %s", raw, actual, expected)
+		}
+	}
+	for _, raw := range []string{"", "2", "2x", "-1d", "2023-13-01"} {
+		if _, err := parse_newer_than(raw, now); err == nil {
+			t.Fatalf("Invalid --newer-than %#v not rejected", raw)
+		}
+	}
+	if _, err := new_file_filter(&Options{MaxSize: "1 furlong"}); err == nil {
+		t.Fatalf("Invalid --max-size not rejected")
+	}
+	tdir := t.TempDir()
+	for name, sz := range map[string]int{"tiny": 10, "medium": 2000, "huge": 5000, "old": 2000} {
+		os.WriteFile(filepath.Join(tdir, name), []byte(strings.Repeat("x", sz)), 0o600)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(filepath.Join(tdir, "old"), old, old)
+	files, err := files_for_send(&Options{MinSize: "1k", MaxSize: "4KiB", NewerThan: "1d"}, []string{tdir, "/dest/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := utils.Map(func(f *File) string { return path.Base(f.remote_path) }, files)
+	if diff := cmp.Diff([]string{filepath.Base(tdir), "medium"}, actual); diff != "" {
+		t.Fatalf("Incorrect files:\n%s", diff)
+	}
+	mtime := time.Duration(time.Now().UnixNano())
+	m := &manager{cli_opts: &Options{MaxSize: "1k"}, files: []*remote_file{
+		{remote_id: "1", ftype: FileType_regular, expected_size: 10, mtime: mtime},
+		{remote_id: "2", ftype: FileType_regular, expected_size: 5000, mtime: mtime},
+		{remote_id: "3", ftype: FileType_link, remote_target: "2"},
+		{remote_id: "4", ftype: FileType_directory},
+	}}
+	if err = m.exclude_files_by_limits(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"1", "4"}, utils.Map(func(f *remote_file) string { return f.remote_id }, m.files)); diff != "" {
+		t.Fatalf("Incorrect files received:\n%s", diff)
+	}
+	if len(m.excluded_files) != 2 {
+		t.Fatalf("Excluded files not recorded: %d", len(m.excluded_files))
+	}
+}
+
+func TestHooks(t *testing.T) {
+	tdir := t.TempDir()
+	out := filepath.Join(tdir, "out")
+	if _, err := new_hook_runner(&Options{OnFileComplete: `"unterminated`}, "send"); err == nil {
+		t.Fatalf("No error for an invalid hook command")
+	}
+	h, err := new_hook_runner(&Options{
+		OnFileComplete:    fmt.Sprintf(`sh -c 'echo "$KITTY_TRANSFER_PATH $KITTY_TRANSFER_SIZE $KITTY_TRANSFER_STATUS" >> %s; test "$KITTY_TRANSFER_STATUS" = OK'`, out),
+		OnSessionComplete: fmt.Sprintf(`sh -c 'cat > %s.json'`, out),
+	}, "send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &SendManager{hooks: h}
+	m.on_file_hook(&File{file_type: FileType_directory, expanded_local_path: "/d"})
+	m.on_file_hook(&File{file_type: FileType_regular, expanded_local_path: "/d/a", remote_path: "a", file_size: 3})
+	m.on_file_hook(&File{file_type: FileType_regular, expanded_local_path: "/d/b", remote_path: "b", remote_final_path: "/x/b", err_msg: "EPERM"})
+	if n := h.finish(3); n != 1 {
+		t.Fatalf("Unexpected number of failed hooks: %d", n)
+	}
+	raw, _ := os.ReadFile(out)
+	if diff := cmp.Diff("/d/a 3 OK\n/d/b 0 EPERM\n", string(raw)); diff != "" {
+		t.Fatalf("Incorrect environment for file hooks:\n%s", diff)
+	}
+	var session struct {
+		Direction   string
+		Failed      int
+		Transferred int64
+		Files       []hook_file
+	}
+	raw, _ = os.ReadFile(out + ".json")
+	if err = json.Unmarshal(raw, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Direction != "send" || session.Failed != 1 || session.Transferred != 3 || len(session.Files) != 2 || session.Files[1].Remote_path != "/x/b" {
+		t.Fatalf("Incorrect session hook input: %s", raw)
+	}
+}
@@ -0,0 +1,183 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var _ = fmt.Print
+
+type extent struct {
+	offset, length int64
+}
+
+// The layout of a sparse file, everything outside the data extents is a hole
+type hole_map struct {
+	size    int64
+	extents []extent
+}
+
+func (self *hole_map) String() string {
+	if self == nil {
+		return ""
+	}
+	b := strings.Builder{}
+	b.WriteString(strconv.FormatInt(self.size, 10))
+	for _, e := range self.extents {
+		fmt.Fprintf(&b, ",%d:%d", e.offset, e.length)
+	}
+	return b.String()
+}
+
+// The number of bytes of data in the file, excluding holes
+func (self *hole_map) data_size() (ans int64) {
+	for _, e := range self.extents {
+		ans += e.length
+	}
+	return
+}
+
+// Parse a hole map, checking that the extents are in order, do not overlap
+// and are inside the file
+func parse_hole_map(raw string) (ans *hole_map, err error) {
+	if raw == "" {
+		return nil, nil
+	}
+	parts := strings.Split(raw, ",")
+	ans = &hole_map{}
+	if ans.size, err = strconv.ParseInt(parts[0], 10, 64); err != nil || ans.size < 0 {
+		return nil, fmt.Errorf("The hole map %#v has an invalid size", raw)
+	}
+	var end int64
+	for _, x := range parts[1:] {
+		o, l, found := strings.Cut(x, ":")
+		e := extent{}
+		if found {
+			if e.offset, err = strconv.ParseInt(o, 10, 64); err == nil {
+				e.length, err = strconv.ParseInt(l, 10, 64)
+			}
+		}
+		if !found || err != nil || e.offset < end || e.length < 1 || e.length > ans.size-e.offset {
+			return nil, fmt.Errorf("The hole map %#v has an invalid extent: %#v", raw, x)
+		}
+		end = e.offset + e.length
+		ans.extents = append(ans.extents, e)
+	}
+	return ans, nil
+}
+
+// Read the hole map of the file, returning nil if it has no holes or the
+// platform or filesystem cannot report them
+func read_hole_map(f *os.File, size int64) (*hole_map, error) {
+	ans := &hole_map{size: size}
+	for pos := int64(0); pos < size; {
+		start, err := seek_data(f, pos)
+		if err != nil {
+			return nil, err
+		}
+		if start < 0 || start >= size {
+			break
+		}
+		end, err := seek_hole(f, start)
+		if err != nil {
+			return nil, err
+		}
+		end = min(end, size)
+		ans.extents = append(ans.extents, extent{start, end - start})
+		pos = end
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if len(ans.extents) == 1 && ans.extents[0].length == size || size == 0 {
+		return nil, nil
+	}
+	return ans, nil
+}
+
+// Read only the data extents of a sparse file
+type sparse_reader struct {
+	f       io.ReaderAt
+	extents []extent
+	pos     int64 // position in the current extent
+}
+
+func (self *hole_map) reader(f io.ReaderAt) *sparse_reader {
+	return &sparse_reader{f: f, extents: self.extents}
+}
+
+func (self *sparse_reader) Read(b []byte) (n int, err error) {
+	for len(self.extents) > 0 && self.pos >= self.extents[0].length {
+		self.extents = self.extents[1:]
+		self.pos = 0
+	}
+	if len(self.extents) == 0 {
+		return 0, io.EOF
+	}
+	e := self.extents[0]
+	b = b[:min(int64(len(b)), e.length-self.pos)]
+	n, err = self.f.ReadAt(b, e.offset+self.pos)
+	self.pos += int64(n)
+	if err == io.EOF {
+		if n < len(b) {
+			return n, fmt.Errorf("The file was truncated while it was being read")
+		}
+		err = nil
+	}
+	return
+}
+
+func (self *sparse_reader) done() bool {
+	return len(self.extents) == 0 || (len(self.extents) == 1 && self.pos >= self.extents[0].length)
+}
+
+// An output file that writes the received data into the data extents of a
+// sparse file, leaving holes everywhere else
+type sparse_file struct {
+	f   *os.File
+	hm  *hole_map
+	idx int
+	pos int64 // position in the current extent
+}
+
+func (self *sparse_file) tell() (int64, error) {
+	if self.idx < len(self.hm.extents) {
+		return self.hm.extents[self.idx].offset + self.pos, nil
+	}
+	return self.hm.size, nil
+}
+
+func (self *sparse_file) write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		if self.idx >= len(self.hm.extents) {
+			return n, fmt.Errorf("Received more data than the %d bytes in the data extents of the sparse file", self.hm.data_size())
+		}
+		e := self.hm.extents[self.idx]
+		amt := min(int64(len(data)), e.length-self.pos)
+		w, err := self.f.WriteAt(data[:amt], e.offset+self.pos)
+		n += w
+		if err != nil {
+			return n, err
+		}
+		data = data[amt:]
+		self.pos += amt
+		if self.pos >= e.length {
+			self.idx++
+			self.pos = 0
+		}
+	}
+	return
+}
+
+func (self *sparse_file) close() error {
+	err := self.f.Truncate(self.hm.size)
+	if cerr := self.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || freebsd)
+
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var _ = fmt.Print
+
+func seek_data(f *os.File, pos int64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func seek_hole(f *os.File, pos int64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+// Returns -1 if there is no more data after pos
+func seek_data(f *os.File, pos int64) (int64, error) {
+	ans, err := f.Seek(pos, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return -1, nil
+	}
+	return ans, err
+}
+
+func seek_hole(f *os.File, pos int64) (int64, error) {
+	return f.Seek(pos, unix.SEEK_HOLE)
+}
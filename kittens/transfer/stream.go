@@ -0,0 +1,130 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = fmt.Print
+
+// The local path that means STDIN when sending and STDOUT when receiving
+const stdio_path = "-"
+
+// Create the file used to send the data read from STDIN to remote_path
+func new_stdin_file(opts *Options, stdin *os.File, remote_path string) (*File, error) {
+	if opts.Resume {
+		return nil, fmt.Errorf("Cannot resume sending STDIN")
+	}
+	if remote_path == "" || strings.HasSuffix(remote_path, "/") {
+		return nil, fmt.Errorf("When sending STDIN the remote path must be the path to a file, not a directory")
+	}
+	s, err := stdin.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Could not stat STDIN with error: %w", err)
+	}
+	size := int64(0)
+	if s.Mode().IsRegular() {
+		// STDIN is redirected from a file so its size is known
+		size = s.Size()
+	}
+	return &File{
+		local_path: stdio_path, expanded_local_path: stdio_path, file_id: "1", stat_result: s,
+		file_type: FileType_regular, display_name: "STDIN", mtime: time.Now(),
+		file_size: size, bytes_to_transmit: size, permissions: 0o644, remote_path: remote_path,
+		compression_capable: should_be_compressed(remote_path, opts.Compress),
+		remote_initial_size: -1, stream: stdin,
+	}, nil
+}
+
+// Read the data of a file being streamed from STDIN in a separate goroutine,
+// as reading can block until more data is available
+func (self *File) start_stream(chunk_size int, wakeup func()) {
+	self.state = TRANSMITTING
+	ch := make(chan delta_chunk, 4)
+	h := sha256.New()
+	r := self.stream
+	self.delta_chunks, self.stream_hash = ch, h
+	go func() {
+		defer close(ch)
+		for {
+			buf := make([]byte, chunk_size)
+			n, err := r.Read(buf)
+			h.Write(buf[:n])
+			ch <- delta_chunk{data: buf[:n], err: err}
+			if wakeup != nil {
+				wakeup()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Compare the checksum sent by the terminal with that of the local file or
+// of the data read from STDIN
+func (self *File) verify_checksum(remote_checksum string) error {
+	if self.stream_hash != nil {
+		return verify_stream_checksum(self.stream_hash, remote_checksum)
+	}
+	return verify_checksum(self.expanded_local_path, remote_checksum)
+}
+
+// An output_file that writes the data of a received file to STDOUT
+type stream_file struct {
+	w   io.Writer
+	h   hash.Hash
+	pos int64
+}
+
+func (sf *stream_file) tell() (int64, error) {
+	return sf.pos, nil
+}
+
+func (sf *stream_file) close() error {
+	// STDOUT is left open, it is not owned by the file
+	return nil
+}
+
+func (sf *stream_file) write(data []byte) (int, error) {
+	n, err := sf.w.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if sf.h != nil {
+		sf.h.Write(data[:n])
+	}
+	sf.pos += int64(n)
+	return n, err
+}
+
+// Compare the checksum sent by the terminal with that of the local file or of
+// the data written to STDOUT
+func (self *remote_file) verify_checksum(remote_checksum string) error {
+	if self.stream != nil {
+		return verify_stream_checksum(self.stream.h, remote_checksum)
+	}
+	return verify_checksum(self.expanded_local_path, remote_checksum)
+}
+
+// Write the data of the only file being received to w, instead of to a local file
+func (self *manager) stream_to(w io.Writer) error {
+	if len(self.files) != 1 || self.files[0].ftype != FileType_regular {
+		return fmt.Errorf("Only a single regular file can be written to STDOUT")
+	}
+	f := self.files[0]
+	f.stream = &stream_file{w: w}
+	if self.cli_opts.Verify {
+		f.stream.h = sha256.New()
+	}
+	// STDOUT cannot be seeked so holes are received as zeros
+	f.hole_map = nil
+	return nil
+}
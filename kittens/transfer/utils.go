@@ -3,13 +3,18 @@
 package transfer
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/exp/slices"
+
 	"kitty/tools/crypto"
 	"kitty/tools/utils"
 	"kitty/tools/utils/humanize"
@@ -95,7 +100,7 @@ func should_be_compressed(path, strategy string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
 	if ext != "" {
 		switch ext[1:] {
-		case "zip", "odt", "odp", "pptx", "docx", "gz", "bz2", "xz", "svgz":
+		case "zip", "odt", "odp", "pptx", "docx", "gz", "bz2", "xz", "svgz", "zst", "tgz", "lz4", "lzma", "7z", "rar", "br":
 			return false
 		}
 	}
@@ -106,6 +111,82 @@ func should_be_compressed(path, strategy string) bool {
 	return true
 }
 
+var compressed_magic = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0},      // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 3, 4},                   // zip and formats based on it
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{'R', 'a', 'r', '!', 0x1a, 0x07},   // rar
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'G', 'I', 'F', '8'},               // gif
+	{0x1a, 0x45, 0xdf, 0xa3},           // matroska and webm
+	{'O', 'g', 'g', 'S'},               // ogg
+	{'f', 'L', 'a', 'C'},               // flac
+	{'I', 'D', '3'},                    // mp3
+}
+
+// Check the first few bytes of data for the signatures of file formats that
+// are already compressed
+func has_compressed_magic(header []byte) bool {
+	for _, m := range compressed_magic {
+		if bytes.HasPrefix(header, m) {
+			return true
+		}
+	}
+	// RIFF containers such as webp and ISO media such as mp4, mov and heic
+	return (bytes.HasPrefix(header, []byte("RIFF")) && len(header) >= 12 && (string(header[8:12]) == "WEBP" || string(header[8:12]) == "AVI ")) || (len(header) >= 8 && string(header[4:8]) == "ftyp")
+}
+
+// Like should_be_compressed() but also sniffs the contents of the local file
+// at path for the signatures of compressed formats
+func local_file_should_be_compressed(path, strategy string) bool {
+	if !should_be_compressed(path, strategy) {
+		return false
+	}
+	if strategy == "always" {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	header := make([]byte, 16)
+	n, _ := io.ReadFull(f, header)
+	return !has_compressed_magic(header[:n])
+}
+
+// The compression algorithms supported by the kitten, in order of preference
+const supported_compressions = "zstd,zlib"
+
+// The compression algorithm to use, given the response from the terminal to
+// the request to start a transfer. Terminals that do not support negotiation
+// do not respond with a compression, and use zlib.
+func negotiated_compression(ftc *FileTransmissionCommand) Compression {
+	if ftc.Compression == Compression_zstd {
+		return Compression_zstd
+	}
+	return Compression_zlib
+}
+
+// Whether the terminal agreed to preserve the specified file property, given
+// its response to the request to start a transfer
+func is_preserved(ftc *FileTransmissionCommand, name string) bool {
+	return slices.Contains(strings.Split(ftc.Preserve, ","), name)
+}
+
+func new_zstd_reader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
 func print_rsync_stats(total_bytes, delta_bytes, signature_bytes int64) {
 	fmt.Println("Rsync stats:")
 	fmt.Printf("  Delta size: %s Signature size: %s\n", humanize.Size(delta_bytes), humanize.Size(signature_bytes))
@@ -3,7 +3,7 @@
 
 import os
 from contextlib import contextmanager
-from typing import Generator
+from typing import Any, Generator
 
 _cwd = _home = ''
 
@@ -58,3 +58,45 @@ def compress(self, data: bytes) -> bytes:
 
     def flush(self) -> bytes:
         return self.c.flush()
+
+
+def zstd_module() -> Any:
+    # zstd is in the stdlib from Python 3.14, on older versions use the
+    # zstandard package if it is installed
+    try:
+        from compression import zstd  # type: ignore
+        return zstd
+    except ImportError:
+        pass
+    try:
+        import zstandard  # type: ignore
+        return zstandard
+    except ImportError:
+        return None
+
+
+def has_zstd() -> bool:
+    return zstd_module() is not None
+
+
+class ZstdCompressor:
+
+    def __init__(self) -> None:
+        m = zstd_module()
+        self.c = m.ZstdCompressor() if m.__name__ == 'compression.zstd' else m.ZstdCompressor().compressobj()
+
+    def compress(self, data: bytes) -> bytes:
+        return self.c.compress(data)
+
+    def flush(self) -> bytes:
+        return self.c.flush()
+
+
+class ZstdDecompressor:
+
+    def __init__(self) -> None:
+        m = zstd_module()
+        self.d = m.ZstdDecompressor() if m.__name__ == 'compression.zstd' else m.ZstdDecompressor().decompressobj()
+
+    def __call__(self, data: bytes, is_last: bool = False) -> bytes:
+        return self.d.decompress(data) if data else b''
@@ -0,0 +1,64 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+var _ = fmt.Print
+
+// The checksum algorithm requested from the terminal when verifying transfers
+const checksum_algorithm = "sha256"
+
+func file_checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Compare the checksum of the local file at path with the checksum of the
+// remote file sent by the terminal, returning a non-nil error describing the
+// failure if they do not match
+func verify_checksum(path, remote_checksum string) error {
+	if remote_checksum == "" {
+		return missing_checksum_error()
+	}
+	local, err := file_checksum(path)
+	if err != nil {
+		return fmt.Errorf("Verification failed, could not calculate the checksum of %s with error: %w", path, err)
+	}
+	return compare_checksums("local file", local, remote_checksum)
+}
+
+// Compare the checksum of data streamed through h with the checksum of the
+// remote file sent by the terminal
+func verify_stream_checksum(h hash.Hash, remote_checksum string) error {
+	if remote_checksum == "" {
+		return missing_checksum_error()
+	}
+	return compare_checksums("streamed data", hex.EncodeToString(h.Sum(nil)), remote_checksum)
+}
+
+func missing_checksum_error() error {
+	return fmt.Errorf("Verification failed, the terminal did not send a checksum, it may not support verification")
+}
+
+func compare_checksums(what, local, remote_checksum string) error {
+	if local != remote_checksum {
+		return fmt.Errorf("Verification failed, the %s checksum of the %s: %s does not match that of the remote file: %s", checksum_algorithm, what, local, remote_checksum)
+	}
+	return nil
+}
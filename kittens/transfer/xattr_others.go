@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var _ = fmt.Print
+
+func read_xattrs(path string) (ans map[string][]byte, unreadable []string) {
+	return
+}
+
+func set_xattr(path, name string, val []byte, is_symlink bool) error {
+	return errors.ErrUnsupported
+}
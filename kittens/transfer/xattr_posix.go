@@ -0,0 +1,65 @@
+//go:build linux || darwin || freebsd || netbsd
+
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+func retry_on_erange(f func([]byte) (int, error)) (ans []byte, err error) {
+	for {
+		sz, err := f(nil)
+		if err != nil || sz == 0 {
+			return nil, err
+		}
+		ans = make([]byte, sz)
+		if sz, err = f(ans); err == nil {
+			return ans[:sz], nil
+		}
+		// the value changed between the two calls
+		if !errors.Is(err, unix.ERANGE) {
+			return nil, err
+		}
+	}
+}
+
+// Read the extended attributes of the file at path, without following
+// symlinks. Returns the names of attributes that could not be read. A
+// filesystem that does not support extended attributes has none.
+func read_xattrs(path string) (ans map[string][]byte, unreadable []string) {
+	names, err := retry_on_erange(func(b []byte) (int, error) { return unix.Llistxattr(path, b) })
+	if err != nil {
+		return
+	}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n := string(name)
+		val, err := retry_on_erange(func(b []byte) (int, error) { return unix.Lgetxattr(path, n, b) })
+		if err != nil || len(val) > max_xattr_size {
+			unreadable = append(unreadable, n)
+			continue
+		}
+		if ans == nil {
+			ans = make(map[string][]byte)
+		}
+		ans[n] = val
+	}
+	return
+}
+
+func set_xattr(path, name string, val []byte, is_symlink bool) error {
+	if is_symlink {
+		return unix.Lsetxattr(path, name, val, 0)
+	}
+	return unix.Setxattr(path, name, val, 0)
+}
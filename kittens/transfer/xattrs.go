@@ -0,0 +1,108 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// Larger extended attributes, such as the resource forks of macOS, are not
+// transmitted
+const max_xattr_size = 64 * 1024
+
+// The name used for file flags in the lists of unpreserved metadata
+const file_flags_name = "flags"
+
+// The extended metadata of a file: its extended attributes, which on Linux
+// includes its ACLs, and its BSD file flags
+type extended_metadata struct {
+	xattrs map[string][]byte
+	flags  int64
+	// The names of the metadata that could not be read or applied
+	unpreserved []string
+}
+
+func read_extended_metadata(path string, st fs.FileInfo) (ans extended_metadata) {
+	ans.xattrs, ans.unpreserved = read_xattrs(path)
+	ans.flags = file_flags(st)
+	return
+}
+
+// Fill in the fields of a file metadata command with the extended metadata
+func (self *extended_metadata) serialize_to(ftc *FileTransmissionCommand) {
+	if len(self.xattrs) > 0 {
+		if data, err := json.Marshal(self.xattrs); err == nil {
+			ftc.Xattrs = string(data)
+		}
+	}
+	ftc.Flags = self.flags
+}
+
+func extended_metadata_from_ftc(ftc *FileTransmissionCommand) (ans extended_metadata, err error) {
+	if ftc.Xattrs != "" {
+		if err = json.Unmarshal([]byte(ftc.Xattrs), &ans.xattrs); err != nil {
+			return ans, fmt.Errorf("The extended attributes of %s are invalid with error: %w", ftc.Name, err)
+		}
+	}
+	ans.flags = ftc.Flags
+	ans.add_unpreserved(ftc.Unpreserved)
+	return
+}
+
+// Add the names from a comma separated list to the unpreserved metadata
+func (self *extended_metadata) add_unpreserved(names string) {
+	for _, x := range strings.Split(names, ",") {
+		if x != "" && !slices.Contains(self.unpreserved, x) {
+			self.unpreserved = append(self.unpreserved, x)
+		}
+	}
+}
+
+// Apply the extended attributes to the file at path, recording the ones that
+// could not be applied. Should be called before changing the permissions of
+// the file, as setting attributes might require write permission.
+func (self *extended_metadata) apply_xattrs(path string, is_symlink bool) {
+	names := maps.Keys(self.xattrs)
+	slices.Sort(names)
+	for _, name := range names {
+		if err := set_xattr(path, name, self.xattrs[name], is_symlink); err != nil {
+			self.add_unpreserved(name)
+		}
+	}
+	self.xattrs = nil
+}
+
+// Apply the file flags to the file at path. Should be called last, as flags
+// such as immutable prevent any other changes to the file.
+func (self *extended_metadata) apply_flags(path string, is_symlink bool) {
+	if self.flags != 0 {
+		if err := set_file_flags(path, self.flags, is_symlink); err != nil {
+			self.add_unpreserved(file_flags_name)
+		}
+		self.flags = 0
+	}
+}
+
+type unpreserved_metadata struct {
+	display_name string
+	names        []string
+}
+
+func print_unpreserved_metadata(items []unpreserved_metadata) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Could not preserve some extended metadata of %d files\n", len(items))
+	for _, x := range items {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", x.display_name, strings.Join(x.names, ", "))
+	}
+}
@@ -97,6 +97,7 @@
     os_window_font_size,
     patch_global_colors,
     redirect_mouse_handling,
+    remove_timer,
     ring_bell,
     run_with_activation_token,
     safe_pipe,
@@ -150,10 +151,11 @@
     startup_notification_handler,
     which,
 )
-from .window import CommandOutput, CwdRequest, Window
+from .window import CommandOutput, CwdRequest, Window, global_event_listeners, notify_global_event_listeners
 
 if TYPE_CHECKING:
     from .rc.base import ResponseType
+    from .remote_control import RCClient
 
 RCResponse = Union[Dict[str, Any], None, AsyncResponse]
 
@@ -332,6 +334,9 @@ def __init__(
         self.encryption_public_key = f'{RC_ENCRYPTION_PROTOCOL_VERSION}:{base64.b85encode(self.encryption_key.public).decode("ascii")}'
         self.clipboard_buffers: Dict[str, str] = {}
         self.update_check_process: Optional['PopenType[bytes]'] = None
+        self.rc_tls_listener_process: Optional['PopenType[bytes]'] = None
+        # called with the exit status of pids registered with monitor_pid()
+        self.monitored_pid_callbacks: Dict[int, Callable[[int], None]] = {}
         self.window_id_map: WeakValueDictionary[int, Window] = WeakValueDictionary()
         self.startup_colors = {k: opts[k] for k in opts if isinstance(opts[k], Color)}
         self.current_visual_select: Optional[VisualSelect] = None
@@ -359,10 +364,12 @@ def __init__(
         if args.listen_on and self.allow_remote_control in ('y', 'socket', 'socket-only', 'password'):
             listen_fd = listen_on(args.listen_on)
             self.listening_on = args.listen_on
+            if opts.remote_control_tls_listen_on != 'none':
+                self.start_rc_tls_listener(opts)
         self.child_monitor = ChildMonitor(
             self.on_child_death,
             DumpCommands(args) if args.dump_commands or args.dump_bytes else None,
-            talk_fd, listen_fd,
+            talk_fd, listen_fd, self.allowed_rc_peers(opts) if listen_fd > -1 else None,
         )
         set_boss(self)
         self.args = args
@@ -576,8 +583,11 @@ def add_child(self, window: Window) -> None:
         self.child_monitor.add_child(window.id, window.child.pid, window.child.child_fd, window.screen)
         self.window_id_map[window.id] = window
 
-    def _handle_remote_command(self, cmd: str, window: Optional[Window] = None, peer_id: int = 0) -> RCResponse:
-        from .remote_control import is_cmd_allowed, parse_cmd
+    def _handle_remote_command(
+        self, cmd: str, window: Optional[Window] = None, peer_id: int = 0, received_fds: Tuple[int, ...] = (),
+        client: Optional['RCClient'] = None,
+    ) -> RCResponse:
+        from .remote_control import RCClient, audit_remote_command, is_cmd_allowed, parse_cmd
         response = None
         window = window or None
         window_has_remote_control = bool(window and window.allow_remote_control)
@@ -604,6 +614,8 @@ def _handle_remote_command(self, cmd: str, window: Optional[Window] = None, peer
             else:
                 if swid > 0:
                     self_window = self.window_id_map.get(swid)
+        if client is None:
+            client = RCClient(f'window:{getattr(window, "id", 0)}')
 
         extra_data: Dict[str, Any] = {}
         try:
@@ -611,15 +623,20 @@ def _handle_remote_command(self, cmd: str, window: Optional[Window] = None, peer
                 self.allow_remote_control == 'y' or (peer_id > 0 and self.allow_remote_control in ('socket-only', 'socket')) or
                 (window and window.remote_control_allowed(pcmd, extra_data)))
         except PermissionError:
+            audit_remote_command(pcmd, client, 'denied')
             return {'ok': False, 'error': 'Remote control disallowed by window specific password'}
         if allowed_unconditionally:
-            return self._execute_remote_command(pcmd, window, peer_id, self_window)
+            return self._execute_authorized_remote_command(pcmd, window, peer_id, self_window, received_fds, client)
         q = is_cmd_allowed(pcmd, window, peer_id > 0, extra_data)
         if q is True:
-            return self._execute_remote_command(pcmd, window, peer_id, self_window)
-        if q is None:
-            if self.ask_if_remote_cmd_is_allowed(pcmd, window, peer_id, self_window):
+            return self._execute_authorized_remote_command(pcmd, window, peer_id, self_window, received_fds, client)
+        # requests from other computers, via the TLS listener, must be authorized
+        # by their password, never by asking the user
+        if q is None and client.name != 'tls':
+            if self.ask_if_remote_cmd_is_allowed(pcmd, window, peer_id, self_window, client, received_fds):
+                audit_remote_command(pcmd, client, 'pending')
                 return AsyncResponse()
+        audit_remote_command(pcmd, client, 'denied')
         response = {'ok': False, 'error': 'Remote control is disabled. Add allow_remote_control to your kitty.conf'}
         if q is False and pcmd.get('password'):
             response['error'] = 'The user rejected this password or it is disallowed by remote_control_password in kitty.conf'
@@ -628,8 +645,28 @@ def _handle_remote_command(self, cmd: str, window: Optional[Window] = None, peer
             return None
         return response
 
+    def _execute_authorized_remote_command(
+        self, pcmd: Dict[str, Any], window: Optional[Window], peer_id: int, self_window: Optional[Window],
+        received_fds: Tuple[int, ...], client: 'RCClient',
+    ) -> RCResponse:
+        from .remote_control import audit_remote_command, is_rate_limited
+        # only authorized requests count towards the limit, every process or,
+        # for peers without credentials, every connection has its own limit
+        if client.pid > -1 and client.name != 'tls':
+            rate_limit_key = f'pid:{client.pid}'
+        else:
+            # the TLS listener forwards the connections of all its clients
+            rate_limit_key = f'peer:{peer_id}' if peer_id > 0 else client.name
+        if is_rate_limited(pcmd, rate_limit_key):
+            audit_remote_command(pcmd, client, 'rate-limited')
+            if pcmd.get('no_response'):
+                return None
+            return {'ok': False, 'error': 'Too many remote control requests, rejected by remote_control_rate_limit in kitty.conf'}
+        return self._execute_remote_command(pcmd, window, peer_id, self_window, received_fds, client)
+
     def ask_if_remote_cmd_is_allowed(
-        self, pcmd: Dict[str, Any], window: Optional[Window] = None, peer_id: int = 0, self_window: Optional[Window] = None
+        self, pcmd: Dict[str, Any], window: Optional[Window] = None, peer_id: int = 0, self_window: Optional[Window] = None,
+        client: Optional['RCClient'] = None, received_fds: Tuple[int, ...] = (),
     ) -> bool:
         from kittens.tui.operations import styled
         in_flight = 0
@@ -641,6 +678,9 @@ def ask_if_remote_cmd_is_allowed(
                     return False
         wid = 0 if window is None else window.id
         hidden_text = styled(pcmd['password'], fg='yellow')
+        # the caller closes received_fds once this returns, so keep copies for
+        # use after the user answers
+        kept_fds = tuple(os.dup(fd) for fd in received_fds)
         overlay_window = self.choose(
             _('A program wishes to control kitty.\n'
               'Action: {1}\n' 'Password: {0}\n\n' '{2}'
@@ -649,30 +689,42 @@ def ask_if_remote_cmd_is_allowed(
                   '\x1b[m' + styled(_(
                       'Note that allowing the password will allow all future actions using the same password, in this kitty instance.'
                   ), dim=True, italic=True)),
-            partial(self.remote_cmd_permission_received, pcmd, wid, peer_id, self_window),
+            partial(self.remote_cmd_permission_received, pcmd, wid, peer_id, self_window, client, kept_fds),
             'a;green:Allow request', 'p;yellow:Allow password', 'r;magenta:Deny request', 'd;red:Deny password',
             window=window, default='a', hidden_text=hidden_text
         )
         if overlay_window is None:
+            for fd in kept_fds:
+                os.close(fd)
             return False
         overlay_window.window_custom_type = 'remote_command_permission_dialog'
         return True
 
-    def remote_cmd_permission_received(self, pcmd: Dict[str, Any], window_id: int, peer_id: int, self_window: Optional[Window], choice: str) -> None:
-        from .remote_control import encode_response_for_peer, set_user_password_allowed
+    def remote_cmd_permission_received(
+        self, pcmd: Dict[str, Any], window_id: int, peer_id: int, self_window: Optional[Window], client: Optional['RCClient'],
+        received_fds: Tuple[int, ...], choice: str
+    ) -> None:
+        from .remote_control import audit_remote_command, encode_response_for_peer, set_user_password_allowed
         response: RCResponse = None
         window = self.window_id_map.get(window_id)
         choice = choice or 'r'
-        if choice in ('r', 'd'):
-            if choice == 'd':
-                set_user_password_allowed(pcmd['password'], False)
-            no_response = pcmd.get('no_response') or False
-            if not no_response:
-                response = {'ok': False, 'error': 'The user rejected this ' + ('request' if choice == 'r' else 'password')}
-        elif choice in ('a', 'p'):
-            if choice == 'p':
-                set_user_password_allowed(pcmd['password'], True)
-            response = self._execute_remote_command(pcmd, window, peer_id, self_window)
+        try:
+            if choice in ('r', 'd'):
+                if client is not None:
+                    audit_remote_command(pcmd, client, 'denied')
+                if choice == 'd':
+                    set_user_password_allowed(pcmd['password'], False)
+                no_response = pcmd.get('no_response') or False
+                if not no_response:
+                    response = {'ok': False, 'error': 'The user rejected this ' + ('request' if choice == 'r' else 'password')}
+            elif choice in ('a', 'p'):
+                if choice == 'p':
+                    set_user_password_allowed(pcmd['password'], True)
+                response = self._execute_remote_command(pcmd, window, peer_id, self_window, received_fds, client)
+        finally:
+            # programs that were passed these fds have their own copies
+            for fd in received_fds:
+                os.close(fd)
         if window is not None and response is not None and not isinstance(response, AsyncResponse):
             window.send_cmd_response(response)
         if peer_id > 0:
@@ -682,16 +734,24 @@ def remote_cmd_permission_received(self, pcmd: Dict[str, Any], window_id: int, p
                 send_data_to_peer(peer_id, encode_response_for_peer(response))
 
     def _execute_remote_command(
-        self, pcmd: Dict[str, Any], window: Optional[Window] = None, peer_id: int = 0, self_window: Optional[Window] = None
+        self, pcmd: Dict[str, Any], window: Optional[Window] = None, peer_id: int = 0, self_window: Optional[Window] = None,
+        received_fds: Tuple[int, ...] = (), client: Optional['RCClient'] = None,
     ) -> RCResponse:
-        from .remote_control import handle_cmd
+        from .remote_control import audit_remote_command, handle_cmd
         try:
-            response = handle_cmd(self, window, pcmd, peer_id, self_window)
+            response = handle_cmd(self, window, pcmd, peer_id, self_window, received_fds)
         except Exception as err:
             import traceback
             response = {'ok': False, 'error': str(err)}
             if not getattr(err, 'hide_traceback', False):
                 response['tb'] = traceback.format_exc()
+        if client is not None:
+            if isinstance(response, AsyncResponse):
+                audit_remote_command(pcmd, client, 'pending')
+            elif isinstance(response, dict) and not response.get('ok'):
+                audit_remote_command(pcmd, client, 'error', str(response.get('error', '')))
+            else:
+                audit_remote_command(pcmd, client, 'ok')
         return response
 
     @ac('misc', '''
@@ -741,12 +801,24 @@ def call_remote_control(self, self_window: Optional[Window], args: Tuple[str, ..
                 return None
             raise
 
-    def peer_message_received(self, msg_bytes: bytes, peer_id: int) -> Union[bytes, bool, None]:
+    def peer_message_received(
+        self, msg_bytes: bytes, peer_id: int, received_fds: Tuple[int, ...] = (), peer_uid: int = -1, peer_pid: int = -1
+    ) -> Union[bytes, bool, None]:
         cmd_prefix = b'\x1bP@kitty-cmd'
         terminator = b'\x1b\\'
         if msg_bytes.startswith(cmd_prefix) and msg_bytes.endswith(terminator):
+            from .remote_control import RCClient
             cmd = msg_bytes[len(cmd_prefix):-len(terminator)].decode('utf-8')
-            response = self._handle_remote_command(cmd, peer_id=peer_id)
+            # peers connected over TCP have no credentials
+            client = RCClient(f'uid:{peer_uid}' if peer_uid > -1 else 'tcp', peer_pid)
+            if peer_pid > -1 and self.rc_tls_listener_process is not None and peer_pid == self.rc_tls_listener_process.pid:
+                client = RCClient('tls', peer_pid)
+            try:
+                response = self._handle_remote_command(cmd, peer_id=peer_id, received_fds=received_fds, client=client)
+            finally:
+                # programs that were passed these fds have their own copies
+                for fd in received_fds:
+                    os.close(fd)
             if response is None:
                 return None
             if isinstance(response, AsyncResponse):
@@ -754,6 +826,8 @@ def peer_message_received(self, msg_bytes: bytes, peer_id: int) -> Union[bytes,
             from kitty.remote_control import encode_response_for_peer
             return encode_response_for_peer(response)
 
+        for fd in received_fds:
+            os.close(fd)
         data:SingleInstanceData = json.loads(msg_bytes.decode('utf-8'))
         if isinstance(data, dict) and data.get('cmd') == 'new_instance':
             from .cli_stub import CLIOptions
@@ -840,6 +914,8 @@ def on_child_death(self, window_id: int) -> None:
                     import traceback
                     traceback.print_exc()
             os_window_id = window.os_window_id
+            if global_event_listeners:
+                notify_global_event_listeners(window, 'child-exited', {})
             window.destroy()
             tm = self.os_window_map.get(os_window_id)
             tab = None
@@ -1438,16 +1514,50 @@ def start_resizing_window(self) -> None:
         if overlay_window is not None:
             overlay_window.allow_remote_control = True
 
-    def resize_layout_window(self, window: Window, increment: float, is_horizontal: bool, reset: bool = False) -> Union[bool, None, str]:
+    def run_in_steps(self, duration: float, step: Callable[[float], bool]) -> bool:
+        # Call step with the fraction of duration that has elapsed, in steps
+        # spread evenly over duration, until it returns False. The first step
+        # is run immediately and its result is returned.
+        num_of_steps = max(1, round(duration * 30))
+        done = 1
+        if not step(done / num_of_steps):
+            return False
+        if num_of_steps > 1:
+            def on_timer(timer_id: Optional[int]) -> None:
+                nonlocal done
+                done += 1
+                if (not step(done / num_of_steps) or done >= num_of_steps) and timer_id is not None:
+                    remove_timer(timer_id)
+            add_timer(on_timer, duration / num_of_steps, True)
+        return True
+
+    def resize_layout_window(
+        self, window: Window, increment: float, is_horizontal: bool, reset: bool = False, duration: float = 0
+    ) -> Union[bool, None, str]:
         tab = window.tabref()
         if tab is None or not increment:
             return False
         if reset:
             tab.reset_window_sizes()
             return None
-        return tab.resize_window_by(window.id, increment, is_horizontal)
+        if duration <= 0:
+            return tab.resize_window_by(window.id, increment, is_horizontal)
+        applied = 0.
 
-    def resize_os_window(self, os_window_id: int, width: int, height: int, unit: str, incremental: bool = False) -> None:
+        def step(fraction: float) -> bool:
+            nonlocal applied
+            tab = window.tabref()
+            if tab is None or window.destroyed:
+                return False
+            delta = increment * fraction - applied
+            applied += delta
+            return tab.resize_window_by(window.id, delta, is_horizontal) is None
+
+        return None if self.run_in_steps(duration, step) else 'Could not resize'
+
+    def resize_os_window(
+        self, os_window_id: int, width: int, height: int, unit: str, incremental: bool = False, duration: float = 0
+    ) -> None:
         if not incremental and (width < 0 or height < 0):
             return
         metrics = get_os_window_size(os_window_id)
@@ -1455,7 +1565,19 @@ def resize_os_window(self, os_window_id: int, width: int, height: int, unit: str
             return
         has_window_scaling = is_macos or is_wayland()
         w, h = get_new_os_window_size(metrics, width, height, unit, incremental, has_window_scaling)
-        set_os_window_size(os_window_id, w, h)
+        if duration <= 0:
+            set_os_window_size(os_window_id, w, h)
+            return
+        start_width, start_height = metrics['width'], metrics['height']
+
+        def step(fraction: float) -> bool:
+            if get_os_window_size(os_window_id) is None:
+                return False
+            set_os_window_size(
+                os_window_id, round(start_width + (w - start_width) * fraction), round(start_height + (h - start_height) * fraction))
+            return True
+
+        self.run_in_steps(duration, step)
 
     def tab_for_id(self, tab_id: int) -> Optional[Tab]:
         for tm in self.os_window_map.values():
@@ -2464,6 +2586,37 @@ def safe_delete_temp_file(self, path: str) -> None:
     def is_ok_to_read_image_file(self, path: str, fd: int) -> bool:
         return is_ok_to_read_image_file(path, fd)
 
+    def allowed_rc_peers(self, opts: Options) -> Optional[Tuple[Tuple[int, ...], Tuple[int, ...]]]:
+        if opts.remote_control_allowed_peers is None:
+            return None
+        uids, gids = opts.remote_control_allowed_peers
+        return (os.geteuid(),) + uids, gids
+
+    def start_rc_tls_listener(self, opts: Options) -> None:
+        # TLS is handled by a kitten that forwards connections to the socket
+        # kitty listens on. It exits when its STDIN is closed by kitty exiting.
+        if not opts.remote_control_tls_certificate:
+            log_error('Not listening for remote control over TLS as remote_control_tls_certificate is not set')
+            return
+        if not opts.remote_control_tls_client_ca and self.allow_remote_control != 'password':
+            log_error(
+                'Not listening for remote control over TLS as neither is remote_control_tls_client_ca set'
+                ' nor is allow_remote_control set to password')
+            return
+        if not self.listening_on.startswith('unix:'):
+            # connections over TCP have no credentials, so requests forwarded
+            # by the listener could not be told apart from local ones
+            log_error('Not listening for remote control over TLS as kitty is not listening on a UNIX socket')
+            return
+        import subprocess
+        cmd = [kitten_exe(), '__rc_tls_proxy__', opts.remote_control_tls_listen_on, self.listening_on, opts.remote_control_tls_certificate]
+        if opts.remote_control_tls_client_ca:
+            cmd.append(opts.remote_control_tls_client_ca)
+        try:
+            self.rc_tls_listener_process = subprocess.Popen(cmd, stdin=subprocess.PIPE, preexec_fn=clear_handled_signals)
+        except OSError as err:
+            log_error(f'Failed to start the remote control TLS listener with error: {err}')
+
     def set_update_check_process(self, process: Optional['PopenType[bytes]'] = None) -> None:
         if self.update_check_process is not None:
             with suppress(Exception):
@@ -2472,6 +2625,9 @@ def set_update_check_process(self, process: Optional['PopenType[bytes]'] = None)
         self.update_check_process = process
 
     def on_monitored_pid_death(self, pid: int, exit_status: int) -> None:
+        callback = self.monitored_pid_callbacks.pop(pid, None)
+        if callback is not None:
+            callback(exit_status)
         update_check_process = self.update_check_process
         if update_check_process is not None and pid == update_check_process.pid:
             self.update_check_process = None
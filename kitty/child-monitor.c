@@ -43,12 +43,25 @@ extern PyTypeObject Screen_Type;
 
 static void (*parse_func)(Screen*, PyObject*, monotonic_t);
 
+// The maximum number of file descriptors that can be passed with a message
+#define MAX_PASSED_FDS 16
+
 typedef struct {
     char *data;
     size_t sz;
     id_type peer_id;
+    // credentials of the peer, -1 when not known
+    long peer_uid, peer_pid;
+    int fds[MAX_PASSED_FDS];
+    size_t num_fds;
 } Message;
 
+static void
+close_fds(int *fds, size_t *num_fds) {
+    for (size_t i = 0; i < *num_fds; i++) safe_close(fds[i], __FILE__, __LINE__);
+    *num_fds = 0;
+}
+
 typedef struct {
     PyObject_HEAD
 
@@ -154,15 +167,47 @@ mask_kitty_signals_process_wide(PyObject *self UNUSED, PyObject *a UNUSED) {
     Py_RETURN_NONE;
 }
 
+// Restrictions on the users and groups of peers connecting to listen_fd
+typedef struct {
+    bool restricted;
+    uid_t *uids;
+    gid_t *gids;
+    size_t num_uids, num_gids;
+} AllowedPeers;
+static AllowedPeers allowed_peers = {0};
+
+static void
+free_allowed_peers(AllowedPeers *p) {
+    free(p->uids); free(p->gids);
+    zero_at_ptr(p);
+}
+
+static bool
+parse_allowed_peers(PyObject *spec, AllowedPeers *ans) {
+    PyObject *uids, *gids;
+    if (!PyArg_ParseTuple(spec, "O!O!", &PyTuple_Type, &uids, &PyTuple_Type, &gids)) return false;
+    ans->num_uids = PyTuple_GET_SIZE(uids); ans->num_gids = PyTuple_GET_SIZE(gids);
+    ans->uids = malloc(MAX(1u, ans->num_uids) * sizeof(uid_t));
+    ans->gids = malloc(MAX(1u, ans->num_gids) * sizeof(gid_t));
+    if (!ans->uids || !ans->gids) { free_allowed_peers(ans); PyErr_NoMemory(); return false; }
+    for (size_t i = 0; i < ans->num_uids; i++) ans->uids[i] = (uid_t)PyLong_AsUnsignedLong(PyTuple_GET_ITEM(uids, i));
+    for (size_t i = 0; i < ans->num_gids; i++) ans->gids[i] = (gid_t)PyLong_AsUnsignedLong(PyTuple_GET_ITEM(gids, i));
+    if (PyErr_Occurred()) { free_allowed_peers(ans); return false; }
+    ans->restricted = true;
+    return true;
+}
+
 static PyObject *
 new(PyTypeObject *type, PyObject *args, PyObject UNUSED *kwds) {
     ChildMonitor *self;
     PyObject *dump_callback, *death_notify;
+    PyObject *allowed = Py_None;
     int talk_fd = -1, listen_fd = -1;
     int ret;
 
     if (the_monitor) { PyErr_SetString(PyExc_RuntimeError, "Can have only a single ChildMonitor instance"); return NULL; }
-    if (!PyArg_ParseTuple(args, "OO|ii", &death_notify, &dump_callback, &talk_fd, &listen_fd)) return NULL;
+    if (!PyArg_ParseTuple(args, "OO|iiO", &death_notify, &dump_callback, &talk_fd, &listen_fd, &allowed)) return NULL;
+    if (allowed != Py_None && !parse_allowed_peers(allowed, &allowed_peers)) return NULL;
     if ((ret = pthread_mutex_init(&children_lock, NULL)) != 0) {
         PyErr_Format(PyExc_RuntimeError, "Failed to create children_lock mutex: %s", strerror(ret));
         return NULL;
@@ -192,7 +237,10 @@ new(PyTypeObject *type, PyObject *args, PyObject UNUSED *kwds) {
 static void
 dealloc(ChildMonitor* self) {
     if (self->messages) {
-        for (size_t i = 0; i < self->messages_count; i++) free(self->messages[i].data);
+        for (size_t i = 0; i < self->messages_count; i++) {
+            free(self->messages[i].data);
+            close_fds(self->messages[i].fds, &self->messages[i].num_fds);
+        }
         free(self->messages); self->messages = NULL;
         self->messages_count = 0; self->messages_capacity = 0;
     }
@@ -209,6 +257,7 @@ dealloc(ChildMonitor* self) {
         FREE_CHILD(add_queue[add_queue_count]);
     }
     free_loop_data(&self->io_loop_data);
+    free_allowed_peers(&allowed_peers);
     Py_TYPE(self)->tp_free((PyObject*)self);
 }
 
@@ -230,7 +279,7 @@ wakeup_io_loop(ChildMonitor *self, bool in_signal_handler) {
 
 static void* io_loop(void *data);
 static void* talk_loop(void *data);
-static void send_response_to_peer(id_type peer_id, const char *msg, size_t msg_sz);
+static bool send_response_to_peer(id_type peer_id, const char *msg, size_t msg_sz);
 static void wakeup_talk_loop(bool);
 static bool talk_thread_started = false;
 
@@ -467,10 +516,18 @@ parse_input(ChildMonitor *self) {
             Message *msg = msgs + i;
             PyObject *resp = NULL;
             if (msg->data) {
-                resp = PyObject_CallMethod(global_state.boss, "peer_message_received", "y#K", msg->data, (int)msg->sz, msg->peer_id);
+                // ownership of the passed fds is transferred to python
+                PyObject *fds = PyTuple_New(msg->num_fds);
+                if (fds) {
+                    for (size_t f = 0; f < msg->num_fds; f++) PyTuple_SET_ITEM(fds, f, PyLong_FromLong(msg->fds[f]));
+                    msg->num_fds = 0;
+                    resp = PyObject_CallMethod(
+                        global_state.boss, "peer_message_received", "y#KNll", msg->data, (int)msg->sz, msg->peer_id, fds, msg->peer_uid, msg->peer_pid);
+                }
                 free(msg->data);
                 if (!resp) PyErr_Print();
             }
+            close_fds(msg->fds, &msg->num_fds);
             if (resp) {
                 if (PyBytes_Check(resp)) send_response_to_peer(msg->peer_id, PyBytes_AS_STRING(resp), PyBytes_GET_SIZE(resp));
                 else if (resp == Py_None) send_response_to_peer(msg->peer_id, NULL, 0);
@@ -1552,10 +1609,15 @@ typedef struct {
     size_t num_of_unresponded_messages_sent_to_main_thread, fd_array_idx;
     bool finished_reading;
     int fd;
+    long uid, pid;
     struct {
         char *data;
         size_t capacity, used, command_end;
         bool finished;
+        // file descriptors passed with SCM_RIGHTS, they are sent to the main
+        // thread with the next complete message
+        int fds[MAX_PASSED_FDS];
+        size_t num_fds;
     } read;
     struct {
         char *data;
@@ -1577,19 +1639,60 @@ typedef struct pollfd PollFD;
 #define nuke_socket(s) { shutdown(s, SHUT_RDWR); safe_close(s, __FILE__, __LINE__); }
 
 static bool
-accept_peer(int listen_fd, bool shutting_down) {
+is_unix_socket(int fd) {
+    struct sockaddr_storage addr;
+    socklen_t len = sizeof(addr);
+    return getsockname(fd, (struct sockaddr*)&addr, &len) == 0 && addr.ss_family == AF_UNIX;
+}
+
+static bool
+get_peer_credentials(int fd, uid_t *euid, gid_t *egid, long *pid) {
+#ifdef __linux__
+    struct ucred cr;
+    socklen_t sz = sizeof(cr);
+    if (getsockopt(fd, SOL_SOCKET, SO_PEERCRED, &cr, &sz) != 0) return false;
+    *euid = cr.uid; *egid = cr.gid; *pid = cr.pid;
+#else
+    if (getpeereid(fd, euid, egid) != 0) return false;
+    *pid = -1;
+#endif
+    return true;
+}
+
+static bool
+is_peer_allowed(int fd, const AllowedPeers *allowed) {
+    // only UNIX sockets can be checked, TCP peers are not restricted
+    if (!is_unix_socket(fd)) return true;
+    uid_t euid; gid_t egid; long pid;
+    if (!get_peer_credentials(fd, &euid, &egid, &pid)) return false;
+    for (size_t i = 0; i < allowed->num_uids; i++) if (allowed->uids[i] == euid) return true;
+    for (size_t i = 0; i < allowed->num_gids; i++) if (allowed->gids[i] == egid) return true;
+    log_error("Refusing remote control connection from a peer with uid: %lu and gid: %lu as it is not in remote_control_allowed_peers",
+            (unsigned long)euid, (unsigned long)egid);
+    return false;
+}
+
+static bool
+accept_peer(int listen_fd, bool shutting_down, bool check_credentials) {
     int peer = accept(listen_fd, NULL, NULL);
     if (UNLIKELY(peer == -1)) {
         if (errno == EINTR) return true;
         if (!shutting_down) perror("accept() on talk socket failed!");
         return false;
     }
+    if (check_credentials && allowed_peers.restricted && !is_peer_allowed(peer, &allowed_peers)) {
+        nuke_socket(peer);
+        return true;
+    }
     if (talk_data.num_peers < PEER_LIMIT) {
         ensure_space_for(&talk_data, peers, Peer, talk_data.num_peers + 8, peers_capacity, 8, false);
         Peer *p = talk_data.peers + talk_data.num_peers++;
         memset(p, 0, sizeof(Peer));
         p->fd = peer; p->id = ++peer_id_counter;
         if (!p->id) p->id = ++peer_id_counter;
+        uid_t euid; gid_t egid;
+        p->uid = -1; p->pid = -1;
+        if (is_unix_socket(peer) && get_peer_credentials(peer, &euid, &egid, &p->pid)) p->uid = euid;
     } else {
         log_error("Too many peers want to talk, ignoring one.");
         nuke_socket(peer);
@@ -1600,6 +1703,7 @@ accept_peer(int listen_fd, bool shutting_down) {
 static void
 free_peer(Peer *peer) {
     free(peer->read.data); peer->read.data = NULL;
+    close_fds(peer->read.fds, &peer->read.num_fds);
     free(peer->write.data); peer->write.data = NULL;
     if (peer->fd > -1) { nuke_socket(peer->fd); peer->fd = -1; }
 }
@@ -1620,6 +1724,9 @@ queue_peer_message(ChildMonitor *self, Peer *peer) {
         }
     }
     m->peer_id = peer->id;
+    m->peer_uid = peer->uid; m->peer_pid = peer->pid;
+    memcpy(m->fds, peer->read.fds, sizeof(m->fds[0]) * peer->read.num_fds);
+    m->num_fds = peer->read.num_fds; peer->read.num_fds = 0;
     peer->num_of_unresponded_messages_sent_to_main_thread++;
     talk_mutex(unlock);
     wakeup_main_loop();
@@ -1655,6 +1762,22 @@ dispatch_peer_command(ChildMonitor *self, Peer *peer) {
     }
 }
 
+static void
+receive_passed_fds(Peer *peer, struct msghdr *msg) {
+    for (struct cmsghdr *cmsg = CMSG_FIRSTHDR(msg); cmsg != NULL; cmsg = CMSG_NXTHDR(msg, cmsg)) {
+        if (cmsg->cmsg_level != SOL_SOCKET || cmsg->cmsg_type != SCM_RIGHTS) continue;
+        size_t num = (cmsg->cmsg_len - CMSG_LEN(0)) / sizeof(int);
+        int *fds = (int*)CMSG_DATA(cmsg);
+        for (size_t i = 0; i < num; i++) {
+#ifndef MSG_CMSG_CLOEXEC
+            fcntl(fds[i], F_SETFD, FD_CLOEXEC);
+#endif
+            if (peer->read.num_fds < MAX_PASSED_FDS) peer->read.fds[peer->read.num_fds++] = fds[i];
+            else safe_close(fds[i], __FILE__, __LINE__);
+        }
+    }
+}
+
 static void
 read_from_peer(ChildMonitor *self, Peer *peer) {
 #define failed(msg) { log_error("Reading from peer failed: %s", msg); shutdown(peer->fd, SHUT_RD); peer->read.finished = true; return; }
@@ -1664,7 +1787,15 @@ read_from_peer(ChildMonitor *self, Peer *peer) {
         peer->read.data = realloc(peer->read.data, peer->read.capacity);
         if (!peer->read.data) failed("Out of memory");
     }
-    ssize_t n = recv(peer->fd, peer->read.data + peer->read.used, peer->read.capacity - peer->read.used, 0);
+    struct iovec iov = {.iov_base=peer->read.data + peer->read.used, .iov_len=peer->read.capacity - peer->read.used};
+    union { char buf[CMSG_SPACE(sizeof(int) * MAX_PASSED_FDS)]; struct cmsghdr align; } control;
+    struct msghdr msg = {.msg_iov=&iov, .msg_iovlen=1, .msg_control=control.buf, .msg_controllen=sizeof(control.buf)};
+#ifdef MSG_CMSG_CLOEXEC
+    ssize_t n = recvmsg(peer->fd, &msg, MSG_CMSG_CLOEXEC);
+#else
+    ssize_t n = recvmsg(peer->fd, &msg, 0);
+#endif
+    if (n >= 0) receive_passed_fds(peer, &msg);
     if (n == 0) {
         peer->read.finished = true;
         shutdown(peer->fd, SHUT_RD);
@@ -1752,7 +1883,7 @@ talk_loop(void *data) {
         if (ret > 0) {
             for (size_t i = 0; i < num_listen_fds - 1; i++) {
                 if (fds[i].revents & POLLIN) {
-                    if (!accept_peer(fds[i].fd, self->shutting_down)) goto end;
+                    if (!accept_peer(fds[i].fd, self->shutting_down, fds[i].fd == self->listen_fd)) goto end;
                 }
             }
             if (fds[num_listen_fds - 1].revents & POLLIN) {
@@ -1779,9 +1910,9 @@ end:
     return 0;
 }
 
-static void
+static bool
 send_response_to_peer(id_type peer_id, const char *msg, size_t msg_sz) {
-    bool wakeup = false;
+    bool wakeup = false, sent = false;
     talk_mutex(lock);
     for (size_t i = 0; i < talk_data.num_peers; i++) {
         Peer *peer = talk_data.peers + i;
@@ -1799,6 +1930,7 @@ send_response_to_peer(id_type peer_id, const char *msg, size_t msg_sz) {
                     memcpy(peer->write.data + peer->write.used, msg, msg_sz);
                     peer->write.used += msg_sz;
                 }
+                sent = true;
             }
             wakeup = true;
             break;
@@ -1806,6 +1938,7 @@ send_response_to_peer(id_type peer_id, const char *msg, size_t msg_sz) {
     }
     talk_mutex(unlock);
     if (wakeup) wakeup_talk_loop(false);
+    return sent;
 }
 
 // }}}
@@ -1863,8 +1996,21 @@ send_data_to_peer(PyObject *self UNUSED, PyObject *args) {
     char * msg; Py_ssize_t sz;
     unsigned long long peer_id;
     if (!PyArg_ParseTuple(args, "Ks#", &peer_id, &msg, &sz)) return NULL;
-    send_response_to_peer(peer_id, msg, sz);
-    Py_RETURN_NONE;
+    if (send_response_to_peer(peer_id, msg, sz)) Py_RETURN_TRUE;
+    Py_RETURN_FALSE;
+}
+
+static PyObject*
+is_rc_peer_allowed(PyObject *self UNUSED, PyObject *args) {
+    // check the peer connected to fd against a remote_control_allowed_peers spec
+    int fd; PyObject *spec;
+    if (!PyArg_ParseTuple(args, "iO", &fd, &spec)) return NULL;
+    AllowedPeers allowed = {0};
+    if (!parse_allowed_peers(spec, &allowed)) return NULL;
+    bool ans = is_peer_allowed(fd, &allowed);
+    free_allowed_peers(&allowed);
+    if (ans) Py_RETURN_TRUE;
+    Py_RETURN_FALSE;
 }
 
 static PyObject *
@@ -1893,6 +2039,7 @@ static PyMethodDef module_methods[] = {
     {"remove_timer", (PyCFunction)remove_python_timer, METH_VARARGS, ""},
     METHODB(monitor_pid, METH_VARARGS),
     METHODB(send_data_to_peer, METH_VARARGS),
+    METHODB(is_rc_peer_allowed, METH_VARARGS),
     METHODB(cocoa_set_menubar_title, METH_VARARGS),
     METHODB(mask_kitty_signals_process_wide, METH_NOARGS),
     {"sigqueue", (PyCFunction)sig_queue, METH_VARARGS, ""},
@@ -79,11 +79,17 @@ wait_for_terminal_ready(int fd) {
 
 static PyObject*
 spawn(PyObject *self UNUSED, PyObject *args) {
-    PyObject *argv_p, *env_p, *handled_signals_p;
+    PyObject *argv_p, *env_p, *handled_signals_p, *pass_fds_p;
     int master, slave, stdin_read_fd, stdin_write_fd, ready_read_fd, ready_write_fd, forward_stdio;
     const char *kitten_exe;
     char *cwd, *exe;
-    if (!PyArg_ParseTuple(args, "ssO!O!iiiiiiO!sp", &exe, &cwd, &PyTuple_Type, &argv_p, &PyTuple_Type, &env_p, &master, &slave, &stdin_read_fd, &stdin_write_fd, &ready_read_fd, &ready_write_fd, &PyTuple_Type, &handled_signals_p, &kitten_exe, &forward_stdio)) return NULL;
+    if (!PyArg_ParseTuple(args, "ssO!O!iiiiiiO!spO!", &exe, &cwd, &PyTuple_Type, &argv_p, &PyTuple_Type, &env_p, &master, &slave, &stdin_read_fd, &stdin_write_fd, &ready_read_fd, &ready_write_fd, &PyTuple_Type, &handled_signals_p, &kitten_exe, &forward_stdio, &PyTuple_Type, &pass_fds_p)) return NULL;
+    // pairs of (fd in kitty, fd number in the child)
+    int pass_fds[16][2] = {{0}}, num_pass_fds = MIN((int)arraysz(pass_fds), PyTuple_GET_SIZE(pass_fds_p));
+    for (int i = 0; i < num_pass_fds; i++) {
+        if (!PyArg_ParseTuple(PyTuple_GET_ITEM(pass_fds_p, i), "ii", &pass_fds[i][0], &pass_fds[i][1])) return NULL;
+        if (pass_fds[i][1] < 0 || pass_fds[i][1] > 200) { PyErr_Format(PyExc_ValueError, "Cannot pass fd to the child as: %d", pass_fds[i][1]); return NULL; }
+    }
     char name[2048] = {0};
     if (ttyname_r(slave, name, sizeof(name) - 1) != 0) { PyErr_SetFromErrno(PyExc_OSError); return NULL; }
     char **argv = serialize_string_tuple(argv_p);
@@ -152,8 +158,23 @@ spawn(PyObject *self UNUSED, PyObject *args) {
             wait_for_terminal_ready(ready_read_fd);
             safe_close(ready_read_fd, __FILE__, __LINE__);
 
+            // Place the passed fds at their numbers in the child, first moving
+            // them out of the way so that they cannot clobber each other
+            for (int i = 0; i < num_pass_fds; i++) {
+                pass_fds[i][0] = fcntl(pass_fds[i][0], F_DUPFD, 201);
+                if (pass_fds[i][0] == -1) exit_on_err("Failed to duplicate passed fd");
+            }
+            for (int i = 0; i < num_pass_fds; i++) {
+                if (safe_dup2(pass_fds[i][0], pass_fds[i][1]) == -1) exit_on_err("dup2() failed for passed fd");
+                safe_close(pass_fds[i][0], __FILE__, __LINE__);
+            }
+
             // Close any extra fds inherited from parent
-            for (int c = min_closed_fd; c < 201; c++) safe_close(c, __FILE__, __LINE__);
+            for (int c = min_closed_fd; c < 201; c++) {
+                bool passed = false;
+                for (int i = 0; i < num_pass_fds && !passed; i++) passed = pass_fds[i][1] == c;
+                if (!passed) safe_close(c, __FILE__, __LINE__);
+            }
 
             environ = env;
             execvp(exe, argv);
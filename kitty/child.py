@@ -200,8 +200,11 @@ def __init__(
         cwd_from: Optional['CwdRequest'] = None,
         is_clone_launch: str = '',
         add_listen_on_env_var: bool = True,
+        pass_fds: Sequence[Tuple[int, int]] = (),
     ):
         self.is_clone_launch = is_clone_launch
+        # pairs of (fd in kitty, fd number in the child), the fds are owned by the caller
+        self.pass_fds = tuple(pass_fds)
         self.add_listen_on_env_var = add_listen_on_env_var
         self.argv = list(argv)
         if cwd_from:
@@ -294,7 +297,8 @@ def fork(self) -> Optional[int]:
         self.final_argv0 = argv[0]
         pid = fast_data_types.spawn(
             self.final_exe, self.cwd, tuple(argv), env, master, slave, stdin_read_fd, stdin_write_fd,
-            ready_read_fd, ready_write_fd, tuple(handled_signals), kitten_exe(), opts.forward_stdio)
+            ready_read_fd, ready_write_fd, tuple(handled_signals), kitten_exe(), opts.forward_stdio, self.pass_fds)
+        self.pass_fds = ()
         os.close(slave)
         self.pid = pid
         self.child_fd = master
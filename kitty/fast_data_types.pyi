@@ -971,6 +971,15 @@ class Line:
     def sprite_at(self, cell: int) -> Tuple[int, int, int]:
         pass
 
+    def cursor_from(self, x: int, y: int = 0) -> 'Cursor':
+        pass
+
+    def width(self, x: int) -> int:
+        pass
+
+    def __getitem__(self, x: int) -> str:
+        pass
+
 
 def test_shape(line: Line,
                path: Optional[str] = None,
@@ -1017,6 +1026,7 @@ def create_test_font_group(sz: float, dpix: float,
 
 
 class HistoryBuf:
+    count: int
 
     def pagerhist_as_text(self, upto_output_start: bool = False) -> str:
         pass
@@ -1039,12 +1049,26 @@ class Cursor:
     y: int
     bg: int
     fg: int
+    decoration_fg: int
+    decoration: int
     bold: bool
     italic: bool
+    reverse: bool
+    strikethrough: bool
+    dim: bool
     blink: bool
     shape: int
 
 
+class GraphicsManager:
+
+    def image_for_internal_id(self, image_id: int) -> Optional[Dict[str, Any]]:
+        pass
+
+    def placements(self) -> List[Dict[str, Any]]:
+        pass
+
+
 class Screen:
 
     color_profile: ColorProfile
@@ -1057,6 +1081,7 @@ class Screen:
     cursor_visible: bool
     scrolled_by: int
     cursor: Cursor
+    grman: GraphicsManager
     disable_ligatures: int
     cursor_key_mode: bool
     auto_repeat_enabled: bool
@@ -1176,6 +1201,9 @@ class Screen:
     def cmd_output(self, which: int, callback: Callable[[str], None], as_ansi: bool, insert_wrap_markers: bool) -> bool:
         pass
 
+    def lines_as_text(self, first: int, num: int, callback: Callable[[str], None], as_ansi: bool, insert_wrap_markers: bool) -> None:
+        pass
+
     def scroll_until_cursor_prompt(self) -> None:
         pass
 
@@ -1231,6 +1259,7 @@ class ChildMonitor:
         dump_callback: Optional[Callable[[bytes], None]],
         talk_fd: int = -1,
         listen_fd: int = -1,
+        allowed_peers: Optional[Tuple[Tuple[int, ...], Tuple[int, ...]]] = None,
     ):
         pass
 
@@ -1323,6 +1352,7 @@ def spawn(
     handled_signals: Tuple[int, ...],
     kitten_exe: str,
     forward_stdio: bool,
+    pass_fds: Tuple[Tuple[int, int], ...],
 ) -> int:
     pass
 
@@ -1400,7 +1430,11 @@ def get_click_interval() -> float:
     pass
 
 
-def send_data_to_peer(peer_id: int, data: Union[str, bytes]) -> None:
+def send_data_to_peer(peer_id: int, data: Union[str, bytes]) -> bool:
+    pass
+
+
+def is_rc_peer_allowed(fd: int, allowed_peers: Tuple[Tuple[int, ...], Tuple[int, ...]]) -> bool:
     pass
 
 
@@ -2,13 +2,16 @@
 # License: GPLv3 Copyright: 2021, Kovid Goyal <kovid at kovidgoyal.net>
 
 import errno
+import fnmatch
+import glob
 import io
 import json
 import os
 import re
+import shlex
 import stat
 import tempfile
-from base64 import b85decode
+from base64 import b85decode, standard_b64decode, standard_b64encode
 from collections import defaultdict, deque
 from contextlib import suppress
 from dataclasses import Field, dataclass, field, fields
@@ -17,9 +20,18 @@
 from gettext import gettext as _
 from itertools import count
 from time import monotonic, time_ns
-from typing import IO, Any, Callable, DefaultDict, Deque, Dict, Iterable, Iterator, List, Optional, Tuple, Union
-
-from kittens.transfer.utils import IdentityCompressor, ZlibCompressor, abspath, expand_home, home_path
+from typing import IO, Any, Callable, DefaultDict, Deque, Dict, FrozenSet, Iterable, Iterator, List, Optional, Tuple, Union
+
+from kittens.transfer.utils import (
+    IdentityCompressor,
+    ZlibCompressor,
+    ZstdCompressor,
+    ZstdDecompressor,
+    abspath,
+    expand_home,
+    has_zstd,
+    home_path,
+)
 from kitty.fast_data_types import FILE_TRANSFER_CODE, OSC, AES256GCMDecrypt, add_timer, base64_decode, base64_encode, get_boss, get_options
 from kitty.types import run_once
 
@@ -27,6 +39,13 @@
 
 EXPIRE_TIME = 10  # minutes
 MAX_ACTIVE_RECEIVES = MAX_ACTIVE_SENDS = 10
+MAX_MULTIPLEXED_FILES = 4
+MULTIPLEXED_CHUNK_SIZE = 64 * 1024
+MAX_XATTR_SIZE = 64 * 1024
+MAX_REFERENCES = 256
+MAX_REFERENCE_SIGNATURES_SIZE = 16 * 1024 * 1024
+# the lowest rate, in bytes per second, that clients can limit sending to
+MIN_RATE = 1024
 ftc_prefix = str(FILE_TRANSFER_CODE)
 
 
@@ -51,6 +70,39 @@ def encode_bypass(request_id: str, bypass: str) -> str:
     return 'sha256:' + hashlib.sha256(q.encode('utf-8', 'replace')).hexdigest()
 
 
+class FileChecksum:
+
+    # calculates the checksum of the data of a file incrementally, as it is
+    # read or written, so that large files are never hashed in one go. Data
+    # must be added in order, gaps, such as the holes in sparse files, are
+    # treated as zeros.
+
+    def __init__(self, algorithm: str):
+        import hashlib
+        if algorithm != 'sha256':
+            raise TransmissionError(msg=f'Unsupported checksum algorithm: {algorithm}')
+        self.hasher = hashlib.sha256()
+        self.pos = 0
+
+    def add_zeros(self, upto: int) -> None:
+        zeros = bytes(min(upto - self.pos, 1024 * 1024))
+        while self.pos < upto:
+            n = min(len(zeros), upto - self.pos)
+            self.hasher.update(zeros[:n])
+            self.pos += n
+
+    def update(self, data: Union[bytes, bytearray, memoryview], offset: int = -1) -> None:
+        if offset > self.pos:
+            self.add_zeros(offset)
+        self.hasher.update(data)
+        self.pos += len(data)
+
+    def hexdigest(self, size: int = -1) -> str:
+        if size > self.pos:
+            self.add_zeros(size)
+        return self.hasher.hexdigest()
+
+
 def split_for_transfer(
     data: Union[bytes, bytearray, memoryview],
     session_id: str = '', file_id: str = '',
@@ -67,7 +119,86 @@ def split_for_transfer(
         data = data[chunk_size:]
 
 
-def iter_file_metadata(file_specs: Iterable[Tuple[str, str]]) -> Iterator[Union['FileTransmissionCommand', 'TransmissionError']]:
+def read_extended_metadata(path: str, sr: os.stat_result) -> Tuple[str, int, List[str]]:
+    # Returns the JSON encoded extended attributes, the file flags and the
+    # names of the attributes that could not be read. Python on macOS cannot
+    # read extended attributes.
+    xattrs: Dict[str, str] = {}
+    unreadable: List[str] = []
+    names: List[str] = []
+    if hasattr(os, 'listxattr'):
+        with suppress(OSError):
+            names = os.listxattr(path, follow_symlinks=False)
+    for name in names:
+        try:
+            val = os.getxattr(path, name, follow_symlinks=False)
+        except OSError:
+            unreadable.append(name)
+            continue
+        if len(val) > MAX_XATTR_SIZE:
+            unreadable.append(name)
+        else:
+            xattrs[name] = standard_b64encode(val).decode('ascii')
+    return (json.dumps(xattrs) if xattrs else ''), getattr(sr, 'st_flags', 0), unreadable
+
+
+HoleMap = Tuple[int, List[Tuple[int, int]]]
+
+
+def read_hole_map(path: str, size: int) -> str:
+    # Returns the serialized hole map of the file: its size followed by the
+    # offset:length of each data extent, or an empty string if the file has
+    # no holes or they cannot be read
+    if not hasattr(os, 'SEEK_DATA') or size < 1:
+        return ''
+    extents: List[Tuple[int, int]] = []
+    try:
+        fd = os.open(path, os.O_RDONLY | getattr(os, 'O_CLOEXEC', 0))
+    except OSError:
+        return ''
+    try:
+        pos = 0
+        while pos < size:
+            try:
+                start = os.lseek(fd, pos, os.SEEK_DATA)
+            except OSError as err:
+                if err.errno == errno.ENXIO:  # no more data
+                    break
+                return ''
+            if start >= size:
+                break
+            end = min(os.lseek(fd, start, os.SEEK_HOLE), size)
+            extents.append((start, end - start))
+            pos = end
+    except OSError:
+        return ''
+    finally:
+        os.close(fd)
+    if extents == [(0, size)]:
+        return ''
+    return ','.join([str(size)] + [f'{offset}:{length}' for offset, length in extents])
+
+
+def parse_hole_map(raw: str) -> HoleMap:
+    parts = raw.split(',')
+    try:
+        size = int(parts[0])
+        extents = [(int(offset), int(length)) for offset, length in (x.split(':') for x in parts[1:])]
+    except ValueError:
+        raise ValueError(f'The hole map {raw} is invalid')
+    end = 0
+    for offset, length in extents:
+        if offset < end or length < 1 or offset + length > size:
+            raise ValueError(f'The hole map {raw} has an invalid extent: {offset}:{length}')
+        end = offset + length
+    if size < 0:
+        raise ValueError(f'The hole map {raw} has an invalid size')
+    return size, extents
+
+
+def iter_file_metadata(
+    file_specs: Iterable[Tuple[str, str]], preserve: FrozenSet[str] = frozenset(), follow_symlinks: bool = False
+) -> Iterator[Union['FileTransmissionCommand', 'TransmissionError']]:
     file_map: DefaultDict[Tuple[int, int], List[FileTransmissionCommand]] = defaultdict(list)
     counter = count()
 
@@ -76,7 +207,7 @@ def skey(sr: os.stat_result) -> Tuple[int, int]:
 
     def make_ftc(path: str, spec_id: str, sr: Optional[os.stat_result] = None, parent: str = '') -> FileTransmissionCommand:
         if sr is None:
-            sr = os.stat(path, follow_symlinks=False)
+            sr = os.stat(path, follow_symlinks=follow_symlinks)
         if stat.S_ISLNK(sr.st_mode):
             ftype = FileType.symlink
         elif stat.S_ISDIR(sr.st_mode):
@@ -89,21 +220,30 @@ def make_ftc(path: str, spec_id: str, sr: Optional[os.stat_result] = None, paren
             action=Action.file, file_id=spec_id, mtime=sr.st_mtime_ns, permissions=stat.S_IMODE(sr.st_mode),
             name=path, status=str(next(counter)), size=sr.st_size, ftype=ftype, parent=parent
         )
+        if 'xattrs' in preserve:
+            ans.xattrs, ans.flags, unreadable = read_extended_metadata(path, sr)
+            ans.unpreserved = ','.join(unreadable)
+        if 'sparse' in preserve and ftype is FileType.regular:
+            ans.extents = read_hole_map(path, sr.st_size)
         file_map[skey(sr)].append(ans)
         return ans
 
-    def add_dir(ftc: FileTransmissionCommand) -> None:
+    def add_dir(ftc: FileTransmissionCommand, ancestors: FrozenSet[Tuple[int, int]]) -> None:
         try:
             lr = os.listdir(ftc.name)
         except OSError:
             return
         for entry in lr:
+            child_path = os.path.join(ftc.name, entry)
             try:
-                child_ftc = make_ftc(os.path.join(ftc.name, entry), spec_id, parent=ftc.status)
+                sr = os.stat(child_path, follow_symlinks=follow_symlinks)
+                if stat.S_ISDIR(sr.st_mode) and skey(sr) in ancestors:
+                    continue  # a followed symlink to a directory containing it
+                child_ftc = make_ftc(child_path, spec_id, sr, parent=ftc.status)
             except (ValueError, OSError):
                 continue
             if child_ftc.ftype is FileType.directory:
-                add_dir(child_ftc)
+                add_dir(child_ftc, ancestors | {skey(sr)})
 
     for spec_id, spec in file_specs:
         path = spec
@@ -112,8 +252,8 @@ def add_dir(ftc: FileTransmissionCommand) -> None:
             if not os.path.isabs(path):
                 path = abspath(path, use_home=True)
         try:
-            sr = os.stat(path, follow_symlinks=False)
-            read_ok = os.access(path, os.R_OK, follow_symlinks=False)
+            sr = os.stat(path, follow_symlinks=follow_symlinks)
+            read_ok = os.access(path, os.R_OK, follow_symlinks=follow_symlinks)
         except OSError as err:
             errname = errno.errorcode.get(err.errno, 'EFAIL')
             yield TransmissionError(file_id=spec_id, code=errname, msg='Failed to read spec')
@@ -127,7 +267,7 @@ def add_dir(ftc: FileTransmissionCommand) -> None:
             yield TransmissionError(file_id=spec_id, code='EINVAL', msg='Not a valid filetype')
             continue
         if ftc.ftype is FileType.directory:
-            add_dir(ftc)
+            add_dir(ftc, frozenset((skey(sr),)))
 
     def resolve_symlink(ftc: FileTransmissionCommand) -> FileTransmissionCommand:
         if ftc.ftype is FileType.symlink:
@@ -155,6 +295,9 @@ def resolve_symlink(ftc: FileTransmissionCommand) -> FileTransmissionCommand:
                     q.ftype = FileType.link
                     q.data = base.status.encode('utf-8', 'replace')
                     yield q
+        elif len(cmds) > 1 and base.ftype is FileType.directory:
+            # the same directory reached via followed symlinks
+            yield from cmds[1:]
 
 
 class NameReprEnum(Enum):
@@ -178,6 +321,22 @@ class Action(NameReprEnum):
 class Compression(NameReprEnum):
     zlib = auto()
     none = auto()
+    zstd = auto()
+
+
+def negotiate_compression(compressions: str) -> Compression:
+    # The client advertises the compression algorithms it supports, zstd is
+    # used if both sides support it, otherwise the client falls back to the
+    # compression it requests per file
+    if 'zstd' in compressions.split(',') and has_zstd():
+        return Compression.zstd
+    return Compression.none
+
+
+def negotiate_preserve(preserve: str, supported: FrozenSet[str]) -> FrozenSet[str]:
+    # The client requests the optional file properties to preserve, the
+    # response lists the ones that are supported
+    return frozenset(preserve.split(',')) & supported
 
 
 class FileType(NameReprEnum):
@@ -198,6 +357,7 @@ def color(self) -> str:
 class TransmissionType(NameReprEnum):
     simple = auto()
     rsync = auto()
+    reference = auto()
 
 
 ErrorCode = Enum('ErrorCode', 'OK STARTED CANCELED PROGRESS EINVAL EPERM EISDIR ENOENT')
@@ -213,6 +373,12 @@ def __init__(
         name: str = '',
         size: int = -1,
         ttype: TransmissionType = TransmissionType.simple,
+        checksum: str = '',
+        compression: Compression = Compression.none,
+        unpreserved: str = '',
+        preserve: FrozenSet[str] = frozenset(),
+        features: FrozenSet[str] = frozenset(),
+        mtime: int = -1,
     ) -> None:
         super().__init__(msg)
         self.transmit = transmit
@@ -222,13 +388,21 @@ def __init__(
         self.name = name
         self.size = size
         self.ttype = ttype
+        self.checksum = checksum
+        self.compression = compression
+        self.unpreserved = unpreserved
+        self.preserve = preserve
+        self.features = features
+        self.mtime = mtime
 
     def as_ftc(self, request_id: str) -> 'FileTransmissionCommand':
         name = self.code if isinstance(self.code, str) else self.code.name
         if self.human_msg:
             name += ':' + self.human_msg
         return FileTransmissionCommand(
-            action=Action.status, id=request_id, file_id=self.file_id, status=name, name=self.name, size=self.size, ttype=self.ttype
+            action=Action.status, id=request_id, file_id=self.file_id, status=name, name=self.name, size=self.size, ttype=self.ttype,
+            checksum=self.checksum, compression=self.compression, unpreserved=self.unpreserved, preserve=','.join(sorted(self.preserve)),
+            features=','.join(sorted(self.features)), mtime=self.mtime,
         )
 
 
@@ -265,6 +439,16 @@ class FileTransmissionCommand:
     name: str = field(default='', metadata={'base64': True, 'sname': 'n'})
     status: str = field(default='', metadata={'base64': True, 'sname': 'st'})
     parent: str = field(default='', metadata={'sname': 'pr'})
+    checksum: str = field(default='', metadata={'sname': 'ck'})
+    compressions: str = field(default='', metadata={'base64': True, 'sname': 'zc'})
+    preserve: str = field(default='', metadata={'base64': True, 'sname': 'pm'})
+    xattrs: str = field(default='', metadata={'base64': True, 'sname': 'xa'})
+    flags: int = field(default=0, metadata={'sname': 'fl'})
+    unpreserved: str = field(default='', metadata={'base64': True, 'sname': 'up'})
+    extents: str = field(default='', metadata={'base64': True, 'sname': 'ex'})
+    links: str = field(default='', metadata={'sname': 'ln'})
+    features: str = field(default='', metadata={'base64': True, 'sname': 'fe'})
+    rate: int = field(default=0, metadata={'sname': 'rt'})
     data: bytes = field(default=b'', repr=False, metadata={'sname': 'd'})
 
     def __repr__(self) -> str:
@@ -385,6 +569,8 @@ def __init__(self, path: str, expected_size: int):
         self.src_file: Optional[io.BufferedReader] = None
         self._dest_file: Optional[IO[bytes]] = None
         self.closed = False
+        # set to calculate the checksum of the output
+        self.output_checksum: Optional[FileChecksum] = None
 
     @property
     def dest_file(self) -> IO[bytes]:
@@ -406,6 +592,18 @@ def close(self) -> None:
         if self.src_file is not None and not self.src_file.closed:
             self.src_file.close()
 
+    def discard(self) -> None:
+        # close without replacing the original file with the patched one
+        if self.closed:
+            return
+        self.closed = True
+        if self._dest_file is not None:
+            self._dest_file.close()
+            with suppress(OSError):
+                os.unlink(self._dest_file.name)
+        if self.src_file is not None and not self.src_file.closed:
+            self.src_file.close()
+
     def tell(self) -> int:
         df = self.dest_file
         if df.closed:
@@ -419,6 +617,8 @@ def read_from_src(self, pos: int, b: Union[bytearray, memoryview]) -> int:
 
     def write_to_dest(self, b: Union[bytes, bytearray, memoryview]) -> None:
         self.dest_file.write(b)
+        if self.output_checksum is not None:
+            self.output_checksum.update(b)
 
     def write(self, b: bytes) -> None:
         self.patcher.apply_delta_data(b, self.read_from_src, self.write_to_dest)
@@ -445,7 +645,7 @@ def next_signature_block(self) -> memoryview:
 class DestFile:
 
     def __init__(self, ftc: FileTransmissionCommand) -> None:
-        self.name = ftc.name
+        self.name = self.requested_name = ftc.name
         if not os.path.isabs(self.name):
             self.name = expand_home(self.name)
             if not os.path.isabs(self.name):
@@ -462,9 +662,32 @@ def __init__(self, ftc: FileTransmissionCommand) -> None:
             self.permissions = stat.S_IMODE(self.permissions)
         self.ftype = ftc.ftype
         self.ttype = ftc.ttype
+        self.checksum = ftc.checksum
+        if self.checksum not in ('', 'sha256'):
+            raise TransmissionError(msg=f'Unsupported checksum algorithm: {self.checksum}', file_id=self.file_id)
+        self.data_checksum = FileChecksum(self.checksum) if self.checksum and self.ftype is FileType.regular else None
+        self.xattrs: Dict[str, bytes] = {}
+        if ftc.xattrs:
+            try:
+                self.xattrs = {str(k): standard_b64decode(v) for k, v in json.loads(ftc.xattrs).items()}
+            except Exception:
+                raise TransmissionError(msg='Invalid extended attributes', file_id=self.file_id)
+        self.flags = ftc.flags
+        self.unpreserved: List[str] = []
+        self.hole_map: Optional[HoleMap] = None
+        if ftc.extents and self.ftype is FileType.regular:
+            try:
+                self.hole_map = parse_hole_map(ftc.extents)
+            except ValueError as err:
+                raise TransmissionError(msg=str(err), file_id=self.file_id)
+        self.sparse_extents: Optional[List[Tuple[int, int]]] = None
         self.link_target = b''
         self.needs_data_sent = self.ttype is not TransmissionType.simple
-        self.decompressor: Union[ZlibDecompressor, IdentityDecompressor] = ZlibDecompressor() if ftc.compression is Compression.zlib else IdentityDecompressor()
+        self.decompressor: Union[ZlibDecompressor, ZstdDecompressor, IdentityDecompressor] = IdentityDecompressor()
+        if ftc.compression is Compression.zlib:
+            self.decompressor = ZlibDecompressor()
+        elif ftc.compression is Compression.zstd:
+            self.decompressor = ZstdDecompressor()
         self.closed = self.ftype is FileType.directory
         self.actual_file: Union[PatchFile, IO[bytes], None] = None
         self.failed = False
@@ -472,6 +695,7 @@ def __init__(self, ftc: FileTransmissionCommand) -> None:
 
     def signature_iterator(self) -> PatchFile:
         self.actual_file = PatchFile(self.name, self.existing_stat.st_size if self.existing_stat is not None else 0)
+        self.actual_file.output_checksum = self.data_checksum
         return self.actual_file
 
     def __repr__(self) -> str:
@@ -484,13 +708,48 @@ def close(self) -> None:
                 self.actual_file.close()
                 self.actual_file = None
 
+    def discard(self, keep_data: bool = False) -> None:
+        # stop receiving data for this file, removing the partially written
+        # file unless keep_data is True, any further data is ignored
+        self.failed = True
+        if not self.closed:
+            self.closed = True
+            af, self.actual_file = self.actual_file, None
+            if isinstance(af, PatchFile):
+                af.discard()
+            elif af is not None:
+                af.close()
+                if not keep_data:
+                    with suppress(OSError):
+                        os.unlink(self.name)
+
     def make_parent_dirs(self) -> str:
         d = os.path.dirname(self.name)
         if d:
             os.makedirs(d, exist_ok=True)
         return d
 
+    def apply_xattrs(self, is_symlink: bool = False) -> None:
+        # must be done before changing permissions as setting attributes can
+        # require write access
+        for name, val in self.xattrs.items():
+            try:
+                os.setxattr(self.name, name, val, follow_symlinks=not is_symlink)
+            except (OSError, AttributeError, NotImplementedError):
+                self.unpreserved.append(name)
+        self.xattrs = {}
+
+    def apply_flags(self, is_symlink: bool = False) -> None:
+        # must be done last as flags such as immutable prevent other changes
+        if self.flags:
+            try:
+                os.chflags(self.name, self.flags, follow_symlinks=not is_symlink)
+            except (OSError, AttributeError, NotImplementedError):
+                self.unpreserved.append('flags')
+            self.flags = 0
+
     def apply_metadata(self, is_symlink: bool = False) -> None:
+        self.apply_xattrs(is_symlink)
         if self.permissions != FileTransmissionCommand.permissions:
             if is_symlink:
                 with suppress(NotImplementedError):
@@ -503,6 +762,7 @@ def apply_metadata(self, is_symlink: bool = False) -> None:
                     os.utime(self.name, ns=(self.mtime, self.mtime), follow_symlinks=False)
             else:
                 os.utime(self.name, ns=(self.mtime, self.mtime))
+        self.apply_flags(is_symlink)
 
     def unlink_existing_if_needed(self, force: bool = False) -> None:
         if force or self.needs_unlink:
@@ -549,14 +809,44 @@ def write_data(self, all_files: Dict[str, 'DestFile'], data: bytes, is_last: boo
                 self.unlink_existing_if_needed()
                 flags = os.O_RDWR | os.O_CREAT | os.O_TRUNC | getattr(os, 'O_CLOEXEC', 0) | getattr(os, 'O_BINARY', 0)
                 self.actual_file = open(os.open(self.name, flags, self.permissions), mode='r+b', closefd=True)
+                if self.hole_map is not None:
+                    self.sparse_extents = list(self.hole_map[1])
             af = self.actual_file
             if decompressed or is_last:
-                af.write(decompressed)
+                if isinstance(af, PatchFile):
+                    af.write(decompressed)
+                elif self.sparse_extents is None:
+                    af.write(decompressed)
+                    if self.data_checksum is not None:
+                        self.data_checksum.update(decompressed)
+                else:
+                    self.write_sparse(af, decompressed)
                 self.bytes_written = af.tell()
             if is_last:
+                if self.hole_map is not None and self.sparse_extents is not None and not isinstance(af, PatchFile):
+                    af.truncate(self.hole_map[0])
+                    self.bytes_written = self.hole_map[0]
                 self.close()
                 self.apply_metadata()
 
+    def write_sparse(self, af: IO[bytes], data: bytes) -> None:
+        # write the received data into the data extents, leaving holes everywhere else
+        mv = memoryview(data)
+        while mv:
+            if not self.sparse_extents:
+                raise TransmissionError(file_id=self.file_id, msg='Received more data than is present in the data extents of the sparse file')
+            offset, length = self.sparse_extents[0]
+            n = min(len(mv), length)
+            af.seek(offset)
+            af.write(mv[:n])
+            if self.data_checksum is not None:
+                self.data_checksum.update(mv[:n], offset)
+            mv = mv[n:]
+            if n < length:
+                self.sparse_extents[0] = offset + n, length - n
+            else:
+                del self.sparse_extents[0]
+
 
 def check_bypass(password: str, request_id: str, bypass_data: str) -> bool:
     protocol, sep, bypass_data = bypass_data.partition(':')
@@ -584,13 +874,130 @@ def check_bypass(password: str, request_id: str, bypass_data: str) -> bool:
     return False
 
 
+def parse_size(raw: str) -> int:
+    m = re.fullmatch(r'(\d+(?:\.\d+)?)\s*([kmgt]?)(i?)b?', raw.strip().lower())
+    if m is None:
+        raise ValueError(f'Invalid size: {raw}')
+    base = 1024 if m.group(3) else 1000
+    return int(float(m.group(1)) * base ** ' kmgt'.index(m.group(2) or ' '))
+
+
+def policy_path(path: str) -> str:
+    # relative paths are relative to the home directory, the same as for the files being received
+    path = home_path() if path == '~' else expand_home(path)
+    return path if os.path.isabs(path) else abspath(path, use_home=True)
+
+
+def path_glob_matches(pattern: Tuple[str, ...], parts: Tuple[str, ...]) -> bool:
+    # wildcards match within a single path component, ** matches any number of components
+    if not pattern:
+        return not parts
+    if pattern[0] == '**':
+        return any(path_glob_matches(pattern[1:], parts[i:]) for i in range(len(parts) + 1))
+    return bool(parts) and fnmatch.fnmatchcase(parts[0], pattern[0]) and path_glob_matches(pattern[1:], parts[1:])
+
+
+def glob_prefix(pattern: Tuple[str, ...]) -> str:
+    # the directory containing everything the pattern can match
+    ans = []
+    for x in pattern[:-1]:
+        if glob.has_magic(x):
+            break
+        ans.append(x)
+    return os.sep.join(ans) or os.sep
+
+
+class TransferPolicy:
+    # restrictions on the files sent to this computer, see file_transfer_policy
+
+    def __init__(self, spec: str = '') -> None:
+        self.roots: List[str] = []
+        self.auto_accept: List[Tuple[str, ...]] = []
+        self.max_size = self.max_files = 0
+        try:
+            items = shlex.split(spec)
+        except ValueError as err:
+            log_error(f'Ignoring invalid file_transfer_policy: {spec} with error: {err}')
+            items = []
+        for item in items:
+            key, sep, val = item.partition('=')
+            try:
+                if not sep or not val:
+                    raise ValueError('Not of the form key=value')
+                if key == 'root':
+                    self.roots.append(os.path.realpath(policy_path(val)))
+                elif key == 'auto_accept':
+                    # symlinks are resolved so that patterns are matched against the real paths of files
+                    self.auto_accept.append(tuple(os.path.realpath(policy_path(val)).split(os.sep)))
+                elif key == 'max_size':
+                    self.max_size = parse_size(val)
+                elif key == 'max_files':
+                    self.max_files = int(val)
+                else:
+                    raise ValueError(f'Unknown key: {key}')
+            except ValueError as err:
+                log_error(f'Ignoring invalid item in file_transfer_policy: {item} with error: {err}')
+        if self.auto_accept and not self.roots:
+            # files accepted without confirmation must never be written outside the directories the patterns are in
+            self.roots = [glob_prefix(pat) for pat in self.auto_accept]
+
+    def check_file(self, df: 'DestFile', num_files: int, auto_accepted: bool) -> None:
+        if self.max_files and num_files > self.max_files:
+            raise TransmissionError(
+                code=ErrorCode.EPERM, file_id=df.file_id, msg=f'The transfer policy allows no more than {self.max_files} files')
+        if self.roots:
+            path = os.path.realpath(df.name)
+            if not any(os.path.commonpath((root, path)) == root for root in self.roots):
+                raise TransmissionError(
+                    code=ErrorCode.EPERM, file_id=df.file_id, msg=f'The transfer policy does not allow writing to {df.name}')
+        if auto_accepted and (
+            '..' in df.requested_name.split('/') or
+            not any(path_glob_matches(pat, tuple(os.path.realpath(os.path.normpath(df.name)).split(os.sep))) for pat in self.auto_accept)
+        ):
+            raise TransmissionError(
+                code=ErrorCode.EPERM, file_id=df.file_id, msg=f'{df.name} does not match the patterns that are accepted without confirmation')
+
+    def check_size(self, df: 'DestFile', total_size: int) -> None:
+        if self.max_size and total_size > self.max_size:
+            df.discard()
+            raise TransmissionError(
+                code='EDQUOT', file_id=df.file_id, msg=f'The transfer policy allows writing no more than {self.max_size} bytes')
+
+
+@run_once
+def transfer_policy_cache() -> Dict[str, TransferPolicy]:
+    return {}
+
+
+def transfer_policy(spec: str) -> TransferPolicy:
+    cache = transfer_policy_cache()
+    ans = cache.get(spec)
+    if ans is None:
+        # the policy is parsed again only when the option changes, so that
+        # errors in it are logged only once
+        cache.clear()
+        ans = cache[spec] = TransferPolicy(spec)
+    return ans
+
+
 class ActiveReceive:
     id: str
     files: Dict[str, DestFile]
     accepted: bool = False
 
-    def __init__(self, request_id: str, quiet: int, bypass: str) -> None:
+    def __init__(
+        self, request_id: str, quiet: int, bypass: str, compressions: str = '', preserve: str = '', features: str = '',
+        policy: Optional[TransferPolicy] = None,
+    ) -> None:
         self.id = request_id
+        self.policy = policy or TransferPolicy()
+        # whether the transfer was accepted without a prompt because of the policy
+        self.auto_accepted = False
+        self.compression = negotiate_compression(compressions)
+        # extended attributes are applied whenever they are sent
+        self.preserve = negotiate_preserve(preserve, frozenset(('sparse',)))
+        # optional protocol features, negotiated the same way
+        self.features = negotiate_preserve(features, frozenset(('cancel_file', 'retry_file', 'multiplex')))
         self.bypass_ok: Optional[bool] = None
         if bypass:
             byp = get_options().file_transfer_confirmation_bypass
@@ -612,14 +1019,28 @@ def close(self) -> None:
     def cancel(self) -> None:
         self.close()
 
+    def cancel_file(self, file_id: str) -> None:
+        # cancel a single file, discarding any data already written for it,
+        # without affecting the rest of the transfer
+        df = self.files.get(file_id)
+        if df is not None:
+            df.discard()
+
     def start_file(self, ftc: FileTransmissionCommand) -> DestFile:
         self.last_activity_at = monotonic()
-        if ftc.file_id in self.files:
-            raise TransmissionError(
-                msg=f'The file_id {ftc.file_id} already exists',
-                file_id=ftc.file_id,
-            )
-        self.files[ftc.file_id] = df = DestFile(ftc)
+        existing = self.files.get(ftc.file_id)
+        if existing is not None:
+            if 'retry_file' not in self.features:
+                raise TransmissionError(
+                    msg=f'The file_id {ftc.file_id} already exists',
+                    file_id=ftc.file_id,
+                )
+            # the client is retrying a file that failed, keep the data already
+            # written so that the retry can use it via the rsync algorithm
+            existing.discard(keep_data=True)
+        df = DestFile(ftc)
+        self.policy.check_file(df, len(self.files) + (0 if existing is not None else 1), self.auto_accepted)
+        self.files[ftc.file_id] = df
         return df
 
     def add_data(self, ftc: FileTransmissionCommand) -> DestFile:
@@ -629,6 +1050,10 @@ def add_data(self, ftc: FileTransmissionCommand) -> DestFile:
             raise TransmissionError(file_id=ftc.file_id, msg='Cannot write to a file without first starting it')
         if df.failed:
             return df
+        if self.policy.max_size:
+            # the size of compressed data is not known till it is decompressed,
+            # so the limit can be exceeded by at most one chunk
+            self.policy.check_size(df, len(ftc.data) + sum(f.bytes_written for f in self.files.values()))
         try:
             df.write_data(self.files, ftc.data, ftc.action is Action.end_data)
         except Exception:
@@ -652,20 +1077,32 @@ def __init__(self, ftc: FileTransmissionCommand):
         self.file_id = ftc.file_id
         self.path = ftc.name
         self.ttype = ftc.ttype
+        self.checksum_algorithm = ftc.checksum
+        if self.checksum_algorithm not in ('', 'sha256'):
+            raise TransmissionError(msg=f'Unsupported checksum algorithm: {self.checksum_algorithm}', file_id=self.file_id)
+        self.data_checksum = FileChecksum(self.checksum_algorithm) if self.checksum_algorithm else None
         self.waiting_for_signature = True if self.ttype is TransmissionType.rsync else False
         self.transmitted = False
         self.stat = os.stat(self.path, follow_symlinks=False)
         if stat.S_ISDIR(self.stat.st_mode):
             raise TransmissionError(ErrorCode.EINVAL, msg='Cannot send a directory', file_id=self.file_id)
-        self.compressor: Union[ZlibCompressor, IdentityCompressor] = IdentityCompressor()
+        self.compressor: Union[ZlibCompressor, ZstdCompressor, IdentityCompressor] = IdentityCompressor()
         self.target = b''
         self.open_file: Optional[io.BufferedReader] = None
+        self.extents: Optional[List[Tuple[int, int]]] = None
         if stat.S_ISLNK(self.stat.st_mode):
             self.target = os.readlink(self.path).encode('utf-8')
         else:
             self.open_file = open(self.path, 'rb')
+            if ftc.extents and self.ttype is TransmissionType.simple:
+                try:
+                    self.extents = parse_hole_map(ftc.extents)[1]
+                except ValueError as err:
+                    raise TransmissionError(msg=str(err), file_id=self.file_id)
             if ftc.compression is Compression.zlib:
                 self.compressor = ZlibCompressor()
+            elif ftc.compression is Compression.zstd:
+                self.compressor = ZstdCompressor()
         from kittens.transfer import rsync
         self.differ = rsync.Differ() if self.waiting_for_signature else None
         self.buf = bytearray()
@@ -675,6 +1112,13 @@ def write(self, b: Union[bytes, bytearray, memoryview]) -> None:
         self.buf[self.write_pos:self.write_pos+len(b)] = b
         self.write_pos += len(b)
 
+    def read_into(self, b: Union[bytearray, memoryview]) -> int:
+        assert self.open_file is not None
+        n = self.open_file.readinto(b)
+        if self.data_checksum is not None:
+            self.data_checksum.update(memoryview(b)[:n])
+        return n
+
     @property
     def ready_to_transmit(self) -> bool:
         return not self.transmitted and not self.waiting_for_signature
@@ -685,6 +1129,26 @@ def close(self) -> None:
             self.open_file = None
         self.differ = None
 
+    def read_extents(self, f: io.BufferedReader, sz: int) -> bytes:
+        # read only the data extents of a sparse file
+        ans = []
+        while sz > 0 and self.extents:
+            offset, length = self.extents[0]
+            n = min(sz, length)
+            f.seek(offset)
+            b = f.read(n)
+            if len(b) < n:
+                raise OSError(errno.EIO, 'The file was truncated while it was being read')
+            if self.data_checksum is not None:
+                self.data_checksum.update(b, offset)
+            ans.append(b)
+            sz -= n
+            if n < length:
+                self.extents[0] = offset + n, length - n
+            else:
+                del self.extents[0]
+        return b''.join(ans)
+
     def next_chunk(self, sz: int = 1024 * 1024) -> Tuple[bytes, int]:
         if self.target:
             self.transmitted = True
@@ -694,13 +1158,19 @@ def next_chunk(self, sz: int = 1024 * 1024) -> Tuple[bytes, int]:
                 self.transmitted = True
                 data = b''
             else:
-                if self.differ is None:
+                if self.extents is not None:
+                    data = self.read_extents(self.open_file, sz)
+                    if not self.extents:
+                        self.transmitted = True
+                elif self.differ is None:
                     data = self.open_file.read(sz)
+                    if self.data_checksum is not None:
+                        self.data_checksum.update(data)
                     if not data or self.open_file.tell() >= self.stat.st_size:
                         self.transmitted = True
                 else:
                     self.write_pos = 0
-                    has_more = self.differ.next_op(self.open_file.readinto, self.write)
+                    has_more = self.differ.next_op(self.read_into, self.write)
                     data = memoryview(self.buf)[:self.write_pos]
                     if not has_more:
                         self.transmitted = True
@@ -715,8 +1185,27 @@ def next_chunk(self, sz: int = 1024 * 1024) -> Tuple[bytes, int]:
 
 class ActiveSend:
 
-    def __init__(self, request_id: str, quiet: int, bypass: str, num_of_args: int) -> None:
+    def __init__(
+        self, request_id: str, quiet: int, bypass: str, num_of_args: int, compressions: str = '', preserve: str = '', links: str = '',
+        features: str = '', rate: int = 0,
+    ) -> None:
         self.id = request_id
+        self.compression = negotiate_compression(compressions)
+        self.preserve = negotiate_preserve(preserve, frozenset(('xattrs', 'sparse')))
+        self.features = negotiate_preserve(features, frozenset(('multiplex', 'references')))
+        # with multiplexing the data of several files is interleaved, in
+        # fixed size chunks, so that small files are not stuck behind large ones
+        self.max_active_files = MAX_MULTIPLEXED_FILES if 'multiplex' in self.features else 1
+        self.chunk_size = MULTIPLEXED_CHUNK_SIZE if 'multiplex' in self.features else 1024 * 1024
+        # the maximum rate at which file data is sent, requested by the client,
+        # enforced with a token bucket allowing bursts of up to one second
+        self.rate = max(MIN_RATE, rate) if rate > 0 else 0
+        if self.rate:
+            # chunks small enough that each takes a fraction of a second to send
+            self.chunk_size = max(4096, min(self.chunk_size, self.rate // 4))
+        self.tokens = float(self.rate)
+        self.tokens_updated_at = monotonic()
+        self.follow_symlinks = links == 'follow'
         self.expected_num_of_args = num_of_args
         self.bypass_ok: Optional[bool] = None
         if bypass:
@@ -729,9 +1218,16 @@ def __init__(self, request_id: str, quiet: int, bypass: str, num_of_args: int) -
         self.last_activity_at = monotonic()
         self.file_specs: List[Tuple[str, str]] = []
         self.queued_files_map: Dict[str, SourceFile] = {}
+        self.active_files: List[SourceFile] = []
+        self.next_active = 0
+        # the file whose data was last read
         self.active_file: Optional[SourceFile] = None
         self.pending_chunks: Deque[FileTransmissionCommand] = deque()
         self.metadata_sent = False
+        # signatures of files already present on the receiving side, blocks
+        # from which are used in the deltas of all files in this transfer
+        self.reference_signatures: Dict[str, bytearray] = {}
+        self.references: Dict[int, bytes] = {}
 
     @property
     def spec_complete(self) -> bool:
@@ -745,12 +1241,35 @@ def add_file_spec(self, cmd: FileTransmissionCommand) -> None:
 
     def add_send_file(self, cmd: FileTransmissionCommand) -> None:
         self.last_activity_at = monotonic()
+        if cmd.ttype is TransmissionType.reference:
+            self.add_reference(cmd)
+            return
         if len(self.queued_files_map) > 32768:
             raise TransmissionError(ErrorCode.EINVAL, 'Too many queued files')
         self.queued_files_map[cmd.file_id] = SourceFile(cmd)
 
+    def add_reference(self, cmd: FileTransmissionCommand) -> None:
+        if 'references' not in self.features:
+            raise TransmissionError(ErrorCode.EINVAL, 'Reference files were not negotiated', file_id=cmd.file_id)
+        if not cmd.file_id.isdigit() or int(cmd.file_id) > 0xffffffff:
+            raise TransmissionError(ErrorCode.EINVAL, f'Invalid reference file id: {cmd.file_id}', file_id=cmd.file_id)
+        if len(self.reference_signatures) >= MAX_REFERENCES:
+            raise TransmissionError(ErrorCode.EINVAL, 'Too many reference files', file_id=cmd.file_id)
+        self.reference_signatures[cmd.file_id] = bytearray()
+
+    def add_reference_signature_data(self, cmd: FileTransmissionCommand, sig: bytearray) -> None:
+        sig.extend(cmd.data)
+        if sum(len(x) for x in self.reference_signatures.values()) > MAX_REFERENCE_SIGNATURES_SIZE:
+            raise TransmissionError(ErrorCode.EINVAL, 'The signatures of the reference files are too large', file_id=cmd.file_id)
+        if cmd.action is Action.end_data:
+            self.references[int(cmd.file_id)] = bytes(sig)
+
     def add_signature_data(self, cmd: FileTransmissionCommand) -> None:
         self.last_activity_at = monotonic()
+        sig = self.reference_signatures.get(cmd.file_id)
+        if sig is not None:
+            self.add_reference_signature_data(cmd, sig)
+            return
         af = self.queued_files_map.get(cmd.file_id)
         if af is None:
             raise TransmissionError(ErrorCode.EINVAL, f'Signature data for unknown file_id: {cmd.file_id}')
@@ -760,6 +1279,9 @@ def add_signature_data(self, cmd: FileTransmissionCommand) -> None:
         sl.add_signature_data(cmd.data)
         if cmd.action is Action.end_data:
             sl.finish_signature_data()
+            # only references sent before the file was requested are used
+            for ref_id, ref_sig in self.references.items():
+                sl.add_reference_signature(ref_id, ref_sig)
             af.waiting_for_signature = False
 
     @property
@@ -767,40 +1289,65 @@ def is_expired(self) -> bool:
         return monotonic() - self.last_activity_at > (60 * EXPIRE_TIME)
 
     def close(self) -> None:
-        if self.active_file is not None:
-            self.active_file.close()
-            self.active_file = None
+        for af in self.active_files:
+            af.close()
+        self.active_files = []
+        self.active_file = None
+
+    def activate_ready_files(self) -> None:
+        if len(self.active_files) < self.max_active_files:
+            for f in tuple(self.queued_files_map.values()):
+                if f.ready_to_transmit:
+                    self.active_files.append(f)
+                    self.queued_files_map.pop(f.file_id, None)
+                    if len(self.active_files) >= self.max_active_files:
+                        break
 
     def next_chunk(self) -> Optional[FileTransmissionCommand]:
         self.last_activity_at = monotonic()
         if self.pending_chunks:
             return self.pending_chunks.popleft()
-        af = self.active_file
-        if af is None:
-            for f in self.queued_files_map.values():
-                if f.ready_to_transmit:
-                    self.active_file = af = f
-                    break
-            if af is None:
-                return None
-            self.queued_files_map.pop(af.file_id, None)
+        self.activate_ready_files()
+        if not self.active_files:
+            return None
+        self.next_active %= len(self.active_files)
+        self.active_file = af = self.active_files[self.next_active]
+        self.next_active += 1
         while True:
-            chunk, uncompressed_sz = af.next_chunk()
+            chunk, uncompressed_sz = af.next_chunk(self.chunk_size)
             if af.transmitted:
-                self.active_file = None
+                self.active_files.remove(af)
+                self.next_active -= 1
                 break
             if chunk:
                 break
         if chunk:
             self.pending_chunks.extend(split_for_transfer(chunk, file_id=af.file_id, mark_last=af.transmitted))
-            return self.pending_chunks.popleft()
         elif af.transmitted:
-            return FileTransmissionCommand(action=Action.end_data, file_id=af.file_id)
-        return None
+            self.pending_chunks.append(FileTransmissionCommand(action=Action.end_data, file_id=af.file_id))
+        else:
+            return None
+        if af.transmitted and af.data_checksum is not None and not af.target:
+            # holes at the end of sparse files are not read
+            self.pending_chunks[-1].checksum = af.data_checksum.hexdigest(af.stat.st_size if af.extents is not None else -1)
+        return self.pending_chunks.popleft()
 
     def return_chunk(self, ftc: FileTransmissionCommand) -> None:
         self.pending_chunks.insert(0, ftc)
 
+    def throttle_delay(self) -> float:
+        # the number of seconds to wait before sending more data
+        if not self.rate:
+            return 0
+        now = monotonic()
+        self.tokens = min(self.rate, self.tokens + (now - self.tokens_updated_at) * self.rate)
+        self.tokens_updated_at = now
+        return 0 if self.tokens >= 0 else -self.tokens / self.rate
+
+    def data_sent(self, amt: int) -> None:
+        if self.rate:
+            self.tokens -= amt
+
 
 class FileTransmission:
 
@@ -929,7 +1476,8 @@ def handle_send_cmd(self, cmd: FileTransmissionCommand) -> None:
             if len(self.active_sends) >= MAX_ACTIVE_SENDS:
                 log_error('New File transmission send with too many active receives, ignoring')
                 return
-            asd = self.active_sends[cmd.id] = ActiveSend(cmd.id, cmd.quiet, cmd.bypass, cmd.size)
+            asd = self.active_sends[cmd.id] = ActiveSend(
+                cmd.id, cmd.quiet, cmd.bypass, cmd.size, cmd.compressions, cmd.preserve, cmd.links, cmd.features, cmd.rate)
             self.start_send(asd.id)
             return
         if cmd.action is Action.cancel:
@@ -939,7 +1487,7 @@ def handle_send_cmd(self, cmd: FileTransmissionCommand) -> None:
 
     def send_metadata_for_send_transfer(self, asd: ActiveSend) -> None:
         sent = False
-        for ftc in iter_file_metadata(asd.file_specs):
+        for ftc in iter_file_metadata(asd.file_specs, asd.preserve, asd.follow_symlinks):
             if isinstance(ftc, TransmissionError):
                 sent = True
                 if asd.send_errors:
@@ -957,6 +1505,10 @@ def send_metadata_for_send_transfer(self, asd: ActiveSend) -> None:
 
     def pump_send_chunks(self, asd: ActiveSend) -> None:
         while True:
+            delay = asd.throttle_delay()
+            if delay > 0:
+                self.callback_after(self.pump_sends, delay)
+                break
             try:
                 ftc = asd.next_chunk()
             except OSError as err:
@@ -971,6 +1523,7 @@ def pump_send_chunks(self, asd: ActiveSend) -> None:
                 asd.return_chunk(ftc)
                 self.callback_after(self.pump_sends, 0.05)
                 break
+            asd.data_sent(len(ftc.data))
 
     def pump_sends(self, timer_id: Optional[int]) -> None:
         for asd in self.active_sends.values():
@@ -996,11 +1549,15 @@ def handle_receive_cmd(self, cmd: FileTransmissionCommand) -> None:
             if len(self.active_receives) >= MAX_ACTIVE_RECEIVES:
                 log_error('New File transmission send with too many active receives, ignoring')
                 return
-            ar = self.active_receives[cmd.id] = ActiveReceive(cmd.id, cmd.quiet, cmd.bypass)
+            ar = self.active_receives[cmd.id] = ActiveReceive(
+                cmd.id, cmd.quiet, cmd.bypass, cmd.compressions, cmd.preserve, cmd.features, self.transfer_policy())
             self.start_receive(ar.id)
             return
 
         if cmd.action is Action.cancel:
+            if cmd.file_id and 'cancel_file' in ar.features:
+                ar.cancel_file(cmd.file_id)
+                return
             self.drop_receive(ar.id)
             if ar.send_acknowledgements:
                 self.send_status_response(ErrorCode.CANCELED, request_id=ar.id)
@@ -1022,13 +1579,16 @@ def handle_receive_cmd(self, cmd: FileTransmissionCommand) -> None:
                     except OSError as err:
                         self.send_fail_on_os_error(err, 'Failed to create directory', ar, df.file_id)
                     else:
-                        self.send_status_response(ErrorCode.OK, ar.id, df.file_id, name=df.name)
+                        df.apply_xattrs()
+                        self.send_status_response(ErrorCode.OK, ar.id, df.file_id, name=df.name, unpreserved=','.join(df.unpreserved))
                 else:
                     if ar.send_acknowledgements:
                         sz = df.existing_stat.st_size if df.existing_stat is not None else -1
+                        mtime = df.existing_stat.st_mtime_ns if df.existing_stat is not None else -1
                         ttype = TransmissionType.rsync \
                             if sz > -1 and df.ttype is TransmissionType.rsync and df.ftype is FileType.regular else TransmissionType.simple
-                        self.send_status_response(code=ErrorCode.STARTED, request_id=ar.id, file_id=df.file_id, name=df.name, size=sz, ttype=ttype)
+                        self.send_status_response(
+                            code=ErrorCode.STARTED, request_id=ar.id, file_id=df.file_id, name=df.name, size=sz, ttype=ttype, mtime=mtime)
                         df.ttype = ttype
                         if ttype is TransmissionType.rsync:
                             try:
@@ -1048,8 +1608,10 @@ def handle_receive_cmd(self, cmd: FileTransmissionCommand) -> None:
                     return
                 if ar.send_acknowledgements:
                     if df.closed:
+                        checksum = df.data_checksum.hexdigest(df.bytes_written) if df.data_checksum is not None else ''
                         self.send_status_response(
-                            code=ErrorCode.OK, request_id=ar.id, file_id=df.file_id, name=df.name, size=df.bytes_written)
+                            code=ErrorCode.OK, request_id=ar.id, file_id=df.file_id, name=df.name, size=df.bytes_written, checksum=checksum,
+                            unpreserved=','.join(df.unpreserved))
                     elif df.bytes_written > before:
                         self.send_status_response(
                             code=ErrorCode.PROGRESS, request_id=ar.id, file_id=df.file_id, size=df.bytes_written)
@@ -1088,6 +1650,10 @@ def transmit_rsync_signature(
         ar = self.active_receives.get(receive_id)
         if ar is None:
             return
+        df = ar.files.get(file_id)
+        if df is None or df.failed:
+            # the client canceled the file, for example, because it is unchanged
+            return
         func = partial(self.transmit_rsync_signature, fs, receive_id, file_id, pending)
         while pending:
             if self.write_ftc_to_child(pending[0], use_pending=False):
@@ -1119,8 +1685,16 @@ def send_status_response(
         request_id: str = '', file_id: str = '', msg: str = '',
         name: str = '', size: int = -1,
         ttype: TransmissionType = TransmissionType.simple,
+        checksum: str = '',
+        compression: Compression = Compression.none,
+        unpreserved: str = '',
+        preserve: FrozenSet[str] = frozenset(),
+        features: FrozenSet[str] = frozenset(),
+        mtime: int = -1,
     ) -> bool:
-        err = TransmissionError(code=code, msg=msg, file_id=file_id, name=name, size=size, ttype=ttype)
+        err = TransmissionError(
+            code=code, msg=msg, file_id=file_id, name=name, size=size, ttype=ttype, checksum=checksum, compression=compression,
+            unpreserved=unpreserved, preserve=preserve, features=features, mtime=mtime)
         return self.write_ftc_to_child(err.as_ftc(request_id))
 
     def send_transmission_error(self, request_id: str, err: TransmissionError) -> bool:
@@ -1167,18 +1741,27 @@ def handle_receive_confirmation(self, confirmed: bool, cmd_id: str) -> None:
             self.drop_send(asd.id)
         if asd.accepted:
             if asd.send_acknowledgements:
-                self.send_status_response(code=ErrorCode.OK, request_id=asd.id)
+                self.send_status_response(
+                    code=ErrorCode.OK, request_id=asd.id, compression=asd.compression, preserve=asd.preserve, features=asd.features)
             if asd.spec_complete:
                 self.send_metadata_for_send_transfer(asd)
         else:
             if asd.send_errors:
                 self.send_status_response(code=ErrorCode.EPERM, request_id=asd.id, msg='User refused the transfer')
 
+    def transfer_policy(self) -> TransferPolicy:
+        return transfer_policy(get_options().file_transfer_policy)
+
     def start_receive(self, ar_id: str) -> None:
         ar = self.active_receives[ar_id]
         if ar.bypass_ok is not None:
             self.handle_send_confirmation(ar.bypass_ok, ar_id)
             return
+        if ar.policy.auto_accept:
+            # every file is checked against the auto accept patterns when it is started
+            ar.auto_accepted = True
+            self.handle_send_confirmation(True, ar_id)
+            return
         boss = get_boss()
         window = boss.window_id_map.get(self.window_id)
         if window is not None:
@@ -1197,7 +1780,8 @@ def handle_send_confirmation(self, confirmed: bool, cmd_id: str) -> None:
             self.drop_receive(ar.id)
         if ar.accepted:
             if ar.send_acknowledgements:
-                self.send_status_response(code=ErrorCode.OK, request_id=ar.id)
+                self.send_status_response(
+                    code=ErrorCode.OK, request_id=ar.id, compression=ar.compression, preserve=ar.preserve, features=ar.features)
         else:
             if ar.send_errors:
                 self.send_status_response(code=ErrorCode.EPERM, request_id=ar.id, msg='User refused the transfer')
@@ -1214,16 +1798,25 @@ def active_file(self, rid: str = '', file_id: str = '') -> DestFile:
 
 class TestFileTransmission(FileTransmission):
 
-    def __init__(self, allow: bool = True) -> None:
+    def __init__(self, allow: bool = True, policy: str = '') -> None:
         super().__init__(0)
         self.test_responses: List[Dict[str, Union[str, int, bytes]]] = []
         self.allow = allow
+        self.policy = policy
+
+    def transfer_policy(self) -> TransferPolicy:
+        return TransferPolicy(self.policy)
 
     def write_ftc_to_child(self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True) -> bool:
         self.test_responses.append(payload.asdict())
         return True
 
     def start_receive(self, aid: str) -> None:
+        ar = self.active_receives[aid]
+        if ar.policy.auto_accept:
+            ar.auto_accepted = True
+            self.handle_send_confirmation(True, aid)
+            return
         self.handle_send_confirmation(self.allow, aid)
 
     def start_send(self, aid: str) -> None:
@@ -1982,6 +1982,36 @@ W(image_for_client_number) {
     return image_as_dict(self, img);
 }
 
+W(image_for_internal_id) {
+    unsigned long long id = PyLong_AsUnsignedLongLong(args);
+    if (PyErr_Occurred()) return NULL;
+    Image *img = img_by_internal_id(self, id);
+    if (!img) Py_RETURN_NONE;
+    return image_as_dict(self, img);
+}
+
+W(placements) {
+    // The placements of images, except virtual ones, with their positions in
+    // cells relative to the top of the screen
+    PyObject *ans = PyList_New(0);
+    if (!ans) return NULL;
+    for (size_t i = 0; i < self->image_count; i++) {
+        Image *img = self->images + i;
+        for (size_t j = 0; j < img->refcnt; j++) {
+            ImageRef *ref = img->refs + j;
+            if (ref->is_virtual_ref) continue;
+            PyObject *p = Py_BuildValue("{sK si si sI sI sI sI sf sf sf sf si}",
+                "image_id", (unsigned long long)img->internal_id, "start_row", ref->start_row, "start_column", ref->start_column,
+                "cell_x_offset", ref->cell_x_offset, "cell_y_offset", ref->cell_y_offset, "num_cols", ref->num_cols, "num_rows", ref->num_rows,
+                "src_x", ref->src_x, "src_y", ref->src_y, "src_width", ref->src_width, "src_height", ref->src_height, "z_index", ref->z_index
+            );
+            if (!p || PyList_Append(ans, p) != 0) { Py_XDECREF(p); Py_DECREF(ans); return NULL; }
+            Py_DECREF(p);
+        }
+    }
+    return ans;
+}
+
 W(shm_write) {
     const char *name, *data;
     Py_ssize_t sz;
@@ -2028,6 +2058,8 @@ W(update_layers) {
 static PyMethodDef methods[] = {
     M(image_for_client_id, METH_O),
     M(image_for_client_number, METH_O),
+    M(image_for_internal_id, METH_O),
+    M(placements, METH_NOARGS),
     M(update_layers, METH_VARARGS),
     {NULL}  /* Sentinel */
 };
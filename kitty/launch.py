@@ -410,6 +410,7 @@ class LaunchKwds(TypedDict):
     cmd: Optional[List[str]]
     overlay_for: Optional[int]
     stdin: Optional[bytes]
+    pass_fds: Sequence[Tuple[int, int]]
 
 
 def apply_colors(window: Window, spec: Sequence[str]) -> None:
@@ -457,6 +458,7 @@ def _launch(
     active: Optional[Window] = None,
     is_clone_launch: str = '',
     rc_from_window: Optional[Window] = None,
+    pass_fds: Sequence[Tuple[int, int]] = (),
 ) -> Optional[Window]:
     active = active or boss.active_window_for_cwd
     if active:
@@ -490,7 +492,8 @@ def _launch(
         'marker': opts.marker or None,
         'cmd': None,
         'overlay_for': None,
-        'stdin': None
+        'stdin': None,
+        'pass_fds': pass_fds,
     }
     spacing = {}
     if opts.spacing:
@@ -634,12 +637,13 @@ def launch(
     active: Optional[Window] = None,
     is_clone_launch: str = '',
     rc_from_window: Optional[Window] = None,
+    pass_fds: Sequence[Tuple[int, int]] = (),
 ) -> Optional[Window]:
     active = active or boss.active_window_for_cwd
     if opts.keep_focus and active:
         orig, active.ignore_focus_changes = active.ignore_focus_changes, True
     try:
-        return _launch(boss, opts, args, target_tab, force_target_tab, active, is_clone_launch, rc_from_window)
+        return _launch(boss, opts, args, target_tab, force_target_tab, active, is_clone_launch, rc_from_window, pass_fds)
     finally:
         if opts.keep_focus and active:
             active.ignore_focus_changes = orig
@@ -2830,6 +2830,17 @@
 
     remote_control_password "my passphrase" set-tab-* resize-*
 
+An action can be further restricted to only act on windows matching an
+expression, by following it with a colon and the expression, using the syntax
+of :option:`kitty @ send-text --match`. For example, to only allow sending text
+to windows that have the user variable :code:`allow_input` set::
+
+    remote_control_password "my passphrase" "send-text:var:allow_input"
+
+Such actions are denied if they act on any window that does not match the
+expression, or if they do not act on particular windows, such as :code:`ls`.
+For actions that act on tabs, all windows in the tabs must match.
+
 To get a list of available actions, run::
 
     kitty @ --help
@@ -2898,6 +2909,102 @@
 '''
     )
 
+opt('remote_control_allowed_peers', 'none',
+    option_type='remote_control_allowed_peers',
+    long_text='''
+Restrict the programs that can connect to the UNIX socket kitty listens on for
+remote control, see :opt:`listen_on`, to those run by the specified users or
+groups. The operating system is asked for the user and group of every program
+that connects, and connections from other users and groups are closed. This is
+useful on computers with multiple users, as abstract UNIX sockets (those whose
+names start with :code:`@`) can be connected to by every user. Specify a space
+separated list of :code:`uid:` and :code:`gid:` entries, with either names or
+numbers, for example::
+
+    remote_control_allowed_peers uid:alice uid:1001 gid:wheel
+
+Groups are matched against the primary group of the connecting program. The user
+running kitty is always allowed. Invalid entries and unknown users and groups
+are ignored with an error, the restriction still applies. The default value of :code:`none` allows
+everyone that can connect to the socket. TCP sockets are not affected. Changing
+this option by reloading the config is not supported.
+'''
+    )
+
+opt('remote_control_tls_listen_on', 'none',
+    long_text='''
+Also listen for remote control connections secured with TLS on the specified TCP
+address, such as :code:`0.0.0.0:8443`, so that kitty can be controlled from
+other computers using :code:`kitten @ --to tls:host:port`. Requires kitty to
+listen on a UNIX socket, see :opt:`listen_on`, and a server certificate, see
+:opt:`remote_control_tls_certificate`. As this makes kitty reachable over the
+network, either clients must authenticate with certificates, see
+:opt:`remote_control_tls_client_ca`, or :opt:`allow_remote_control` must be
+:code:`password`, so that clients authenticate with passwords, see
+:opt:`remote_control_password`. Requests from these clients are never shown to
+the user for confirmation, requests whose password does not allow them are
+denied. Changing this option by reloading the config
+is not supported.
+'''
+    )
+
+opt('remote_control_tls_certificate', 'none',
+    option_type='config_or_absolute_path',
+    long_text='''
+Path to a PEM file containing the certificate and private key used by kitty for
+:opt:`remote_control_tls_listen_on`. Relative paths are resolved from the kitty
+configuration directory.
+'''
+    )
+
+opt('remote_control_tls_client_ca', 'none',
+    option_type='config_or_absolute_path',
+    long_text='''
+Path to a PEM file containing the certificates of the authorities that sign
+client certificates. When set, clients connecting to
+:opt:`remote_control_tls_listen_on` must present a certificate signed by one of
+these authorities, with :code:`kitten @ --tls-certificate`. Relative paths are
+resolved from the kitty configuration directory.
+'''
+    )
+
+opt('remote_control_audit_log', 'none',
+    option_type='config_or_absolute_path',
+    long_text='''
+Path to a file to which a record of every remote control request kitty receives
+is appended, to monitor what programs are doing with remote control. Every
+record is a line containing a JSON object with the time, the command, the
+client that sent it, the expressions used to match windows and tabs and the
+result, which is one of :code:`ok`, :code:`error`, :code:`denied`,
+:code:`rate-limited` or :code:`pending`, for requests whose result is not
+known immediately, such as those waiting for the user to allow them. Clients are
+identified as :code:`window:ID` for requests sent via the TTY of a kitty window,
+:code:`uid:UID` for requests sent over a UNIX socket, along with the process id
+of the client, when available, :code:`tls` for requests received by
+:opt:`remote_control_tls_listen_on` and :code:`tcp` for requests sent over TCP.
+Relative paths are resolved from the kitty configuration directory. The default
+of :code:`none` disables the log.
+'''
+    )
+
+opt('remote_control_rate_limit', 'none',
+    option_type='remote_control_rate_limit',
+    long_text='''
+Limit the number of remote control requests every client can make, to contain
+runaway scripts. Specify the maximum number of requests and the number of
+seconds in which they can be made, for example, to allow at most one hundred
+requests in ten seconds::
+
+    remote_control_rate_limit 100 10
+
+Requests exceeding the limit are rejected with an error. Every process sending
+requests over a UNIX socket, every connection over TCP or TLS and every window
+has its own limit. Only requests that are allowed count towards the limit. The chunks
+of requests that send data in chunks, other than the first, and requests to
+cancel requests are not counted. The default of :code:`none` does not limit requests.
+'''
+    )
+
 opt('+env', '',
     option_type='env',
     add_to_default=False,
@@ -3009,6 +3116,40 @@
 '''
     )
 
+opt('file_transfer_policy', '',
+    long_text='''
+Restrictions on the files the :doc:`file transfer kitten </kittens/transfer>`
+can send to this computer, consulted before asking for confirmation. Useful
+for computers that receive frequent automated transfers. Specified as a space
+separated list of :code:`key=value` items, for example::
+
+    file_transfer_policy root=~/incoming max_size=2GB max_files=1000 auto_accept='~/incoming/**'
+
+The keys are:
+
+:code:`root`
+    Files can only be written inside this directory. Can be specified multiple
+    times to allow several directories. By default, files can be written
+    anywhere.
+
+:code:`max_size`
+    The maximum total amount of data written in a single transfer, for example:
+    :code:`500MB` or :code:`1GiB`.
+
+:code:`max_files`
+    The maximum number of files, directories and links in a single transfer.
+
+:code:`auto_accept`
+    A glob pattern, transfers are accepted without a confirmation prompt and
+    every file in them must match one of these patterns, otherwise it is
+    refused. Can be specified multiple times. Wildcards do not match
+    :code:`/`, use :code:`**` to match any number of directories. Patterns are
+    matched against file paths with symlinks resolved and names containing
+    :code:`..` are refused. When no :code:`root` is specified, files can only
+    be written inside the directories containing the patterns.
+'''
+    )
+
 opt('allow_hyperlinks', 'yes',
     option_type='allow_hyperlinks', ctype='bool',
     long_text='''
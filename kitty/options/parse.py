@@ -13,12 +13,12 @@
     deprecated_hide_window_decorations_aliases, deprecated_macos_show_window_title_in_menubar_alias,
     deprecated_send_text, disable_ligatures, edge_width, env, font_features, hide_window_decorations,
     macos_option_as_alt, macos_titlebar_color, modify_font, narrow_symbols, optional_edge_width,
-    parse_map, parse_mouse_map, paste_actions, remote_control_password, resize_debounce_time,
-    scrollback_lines, scrollback_pager_history_size, shell_integration, store_multiple, symbol_map,
-    tab_activity_symbol, tab_bar_edge, tab_bar_margin_height, tab_bar_min_tabs, tab_fade,
-    tab_font_style, tab_separator, tab_title_template, titlebar_color, to_cursor_shape, to_font_size,
-    to_layout_names, to_modifiers, url_prefixes, url_style, visual_window_select_characters,
-    window_border_width, window_size
+    parse_map, parse_mouse_map, paste_actions, remote_control_allowed_peers, remote_control_password,
+    remote_control_rate_limit, resize_debounce_time, scrollback_lines, scrollback_pager_history_size,
+    shell_integration, store_multiple, symbol_map, tab_activity_symbol, tab_bar_edge,
+    tab_bar_margin_height, tab_bar_min_tabs, tab_fade, tab_font_style, tab_separator,
+    tab_title_template, titlebar_color, to_cursor_shape, to_font_size, to_layout_names, to_modifiers,
+    url_prefixes, url_style, visual_window_select_characters, window_border_width, window_size
 )
 
 
@@ -971,6 +971,9 @@ def exe_search_path(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
     def file_transfer_confirmation_bypass(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
         ans['file_transfer_confirmation_bypass'] = str(val)
 
+    def file_transfer_policy(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['file_transfer_policy'] = str(val)
+
     def focus_follows_mouse(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
         ans['focus_follows_mouse'] = to_bool(val)
 
@@ -1149,10 +1152,28 @@ def pointer_shape_when_grabbed(self, val: str, ans: typing.Dict[str, typing.Any]
     def remember_window_size(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
         ans['remember_window_size'] = to_bool(val)
 
+    def remote_control_allowed_peers(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['remote_control_allowed_peers'] = remote_control_allowed_peers(val)
+
+    def remote_control_audit_log(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['remote_control_audit_log'] = config_or_absolute_path(val)
+
     def remote_control_password(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
         for k, v in remote_control_password(val, ans["remote_control_password"]):
             ans["remote_control_password"][k] = v
 
+    def remote_control_rate_limit(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['remote_control_rate_limit'] = remote_control_rate_limit(val)
+
+    def remote_control_tls_certificate(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['remote_control_tls_certificate'] = config_or_absolute_path(val)
+
+    def remote_control_tls_client_ca(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['remote_control_tls_client_ca'] = config_or_absolute_path(val)
+
+    def remote_control_tls_listen_on(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
+        ans['remote_control_tls_listen_on'] = str(val)
+
     def repaint_delay(self, val: str, ans: typing.Dict[str, typing.Any]) -> None:
         ans['repaint_delay'] = positive_int(val)
 
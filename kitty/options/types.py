@@ -359,6 +359,7 @@
  'env',
  'exe_search_path',
  'file_transfer_confirmation_bypass',
+ 'file_transfer_policy',
  'focus_follows_mouse',
  'font_family',
  'font_features',
@@ -409,7 +410,13 @@
  'pointer_shape_when_dragging',
  'pointer_shape_when_grabbed',
  'remember_window_size',
+ 'remote_control_allowed_peers',
+ 'remote_control_audit_log',
  'remote_control_password',
+ 'remote_control_rate_limit',
+ 'remote_control_tls_certificate',
+ 'remote_control_tls_client_ca',
+ 'remote_control_tls_listen_on',
  'repaint_delay',
  'resize_debounce_time',
  'resize_in_steps',
@@ -522,6 +529,7 @@ class Options:
     enable_audio_bell: bool = True
     enabled_layouts: typing.List[str] = ['fat', 'grid', 'horizontal', 'splits', 'stack', 'tall', 'vertical']
     file_transfer_confirmation_bypass: str = ''
+    file_transfer_policy: str = ''
     focus_follows_mouse: bool = False
     font_family: str = 'monospace'
     font_size: float = 11.0
@@ -566,6 +574,12 @@ class Options:
     pointer_shape_when_dragging: choices_for_pointer_shape_when_dragging = 'beam'
     pointer_shape_when_grabbed: choices_for_pointer_shape_when_grabbed = 'arrow'
     remember_window_size: bool = True
+    remote_control_allowed_peers: typing.Optional[typing.Tuple[typing.Tuple[int, ...], typing.Tuple[int, ...]]] = None
+    remote_control_audit_log: typing.Optional[str] = None
+    remote_control_rate_limit: typing.Optional[typing.Tuple[int, float]] = None
+    remote_control_tls_certificate: typing.Optional[str] = None
+    remote_control_tls_client_ca: typing.Optional[str] = None
+    remote_control_tls_listen_on: str = 'none'
     repaint_delay: int = 10
     resize_debounce_time: typing.Tuple[float, float] = (0.1, 0.5)
     resize_in_steps: bool = False
@@ -706,6 +706,42 @@ def remote_control_password(val: str, current_val: Dict[str, str]) -> Iterable[T
             yield parts[0], tuple(parts[1:])
 
 
+def remote_control_allowed_peers(x: str) -> Optional[Tuple[Tuple[int, ...], Tuple[int, ...]]]:
+    if x.lower() == 'none':
+        return None
+    import grp
+    import pwd
+    uids: List[int] = []
+    gids: List[int] = []
+    # invalid entries are ignored, never lifting the restriction, as that
+    # would allow everyone to connect
+    for spec in x.split():
+        q, sep, name = spec.partition(':')
+        if not sep or not name or q not in ('uid', 'gid'):
+            log_error(f'Ignoring invalid remote control peer: {spec}, must start with uid: or gid:')
+            continue
+        try:
+            if q == 'uid':
+                uids.append(int(name) if name.isdigit() else pwd.getpwnam(name).pw_uid)
+            else:
+                gids.append(int(name) if name.isdigit() else grp.getgrnam(name).gr_gid)
+        except KeyError:
+            log_error(f'Ignoring unknown {"user" if q == "uid" else "group"} in remote control peer: {spec}')
+    return tuple(uids), tuple(gids)
+
+
+def remote_control_rate_limit(x: str) -> Optional[Tuple[int, float]]:
+    if x.lower() == 'none':
+        return None
+    parts = x.split()
+    if len(parts) != 2:
+        raise ValueError(f'Invalid remote control rate limit: {x}, must be the number of requests and the number of seconds')
+    count, seconds = int(parts[0]), float(parts[1])
+    if count < 1 or seconds <= 0:
+        raise ValueError(f'Invalid remote control rate limit: {x}, the number of requests and seconds must be positive')
+    return count, seconds
+
+
 def clipboard_control(x: str) -> Tuple[str, ...]:
     return tuple(x.lower().split())
 
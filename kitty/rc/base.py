@@ -168,9 +168,9 @@ def __init__(self, payload_get: PayloadGetType, window: Optional[Window]) -> Non
         self.peer_id: int = payload_get('peer_id', missing=0)
         self.window_id: int = getattr(window, 'id', 0)
 
-    def send_data(self, data: Any) -> None:
+    def send_data(self, data: Any, more: bool = False) -> bool:
         from kitty.remote_control import send_response_to_client
-        send_response_to_client(data=data, peer_id=self.peer_id, window_id=self.window_id, async_id=self.async_id)
+        return send_response_to_client(data=data, peer_id=self.peer_id, window_id=self.window_id, async_id=self.async_id, more=more)
 
     def send_error(self, error: str) -> None:
         from kitty.remote_control import send_response_to_client
@@ -320,6 +320,16 @@ class RemoteCommand:
     argspec = args_count = args_completion = ArgsHandling()
     field_to_option_map: Optional[Dict[str, str]] = None
     reads_streaming_data: bool = False
+    # Whether the command sends multiple responses, until the request is
+    # cancelled, or the option that makes it do so
+    streams_responses: bool = False
+    streams_responses_option: str = ''
+    # The field listing the numbers of the file descriptors passed with the
+    # command, which are passed over UNIX sockets using SCM_RIGHTS
+    passes_fds_field: str = ''
+    # Go code that evaluates to a function called with the data in the response
+    # from kitty, instead of printing it
+    response_handler: str = ''
 
     def __init__(self) -> None:
         self.desc = self.desc or self.short_desc
@@ -390,6 +400,26 @@ def windows_for_payload(self, boss: 'Boss', window: Optional['Window'], payload_
                     windows += list(tab)
         return windows
 
+    def windows_acted_on(self, boss: 'Boss', window: Optional['Window'], payload_get: PayloadGetType) -> Optional[List['Window']]:
+        ''' The windows this command acts on, used to restrict passwords to
+        windows matching an expression. None if the command does not act on
+        particular windows. '''
+        fields = self.protocol_fields()
+        if 'match_window' in fields or 'match_tab' in fields:
+            return self.windows_for_payload(boss, window, payload_get)
+        if MATCH_WINDOW_OPTION in self.options_spec:
+            return self.windows_for_match_payload(boss, window, payload_get)
+        if MATCH_TAB_OPTION in self.options_spec and 'match' in fields:
+            return [w for tab in self.tabs_for_match_payload(boss, window, payload_get) for w in tab]
+        return None
+
+    def protocol_fields(self) -> FrozenSet[str]:
+        ans: Optional[FrozenSet[str]] = getattr(self, '_protocol_fields', None)
+        if ans is None:
+            names = (line.strip().partition(':')[0] for line in self.protocol_spec.splitlines())
+            ans = self._protocol_fields = frozenset(x.partition('/')[0].rstrip('+') for x in names if '/' in x)
+        return ans
+
     def create_async_responder(self, payload_get: PayloadGetType, window: Optional[Window]) -> AsyncResponder:
         return AsyncResponder(payload_get, window)
 
@@ -429,12 +459,17 @@ def display_subcommand_help(func: RemoteCommand) -> None:
 
 def command_for_name(cmd_name: str) -> RemoteCommand:
     from importlib import import_module
-    cmd_name = cmd_name.replace('-', '_')
+    name = cmd_name.replace('-', '_')
     try:
-        m = import_module(f'kitty.rc.{cmd_name}')
+        m = import_module(f'kitty.rc.{name}')
     except ImportError:
-        raise KeyError(f'Unknown kitty remote control command: {cmd_name}')
-    return cast(RemoteCommand, getattr(m, cmd_name))
+        # commands provided by other programs
+        from kitty.rc_extensions import extension_command
+        ans = extension_command(cmd_name)
+        if ans is None:
+            raise KeyError(f'Unknown kitty remote control command: {name}')
+        return ans
+    return cast(RemoteCommand, getattr(m, name))
 
 
 def all_command_names() -> FrozenSet[str]:
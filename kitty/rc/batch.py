@@ -0,0 +1,114 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+import json
+import shlex
+import sys
+from typing import TYPE_CHECKING, Any, Dict, List, Optional
+
+from .base import (
+    ArgsType,
+    Boss,
+    PayloadGetType,
+    PayloadType,
+    RCOptions,
+    RemoteCommand,
+    ResponseType,
+    Window,
+    command_for_name,
+    parse_subcommand_cli,
+)
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import BatchRCOptions as CLIOptions
+
+
+class BatchFailed(ValueError):
+
+    hide_traceback = True
+
+
+def check_can_be_batched(pcmd: Any) -> RemoteCommand:
+    if not isinstance(pcmd, dict) or not pcmd.get('cmd'):
+        raise BatchFailed('Invalid command in batch')
+    name = str(pcmd['cmd'])
+    if name == 'batch':
+        raise BatchFailed('Batches cannot be nested')
+    c = command_for_name(name)
+    payload = pcmd.get('payload') or {}
+    if c.is_asynchronous or c.reads_streaming_data or c.streams_responses or (
+            c.streams_responses_option and payload.get(c.streams_responses_option)):
+        raise BatchFailed(f'The {name} command cannot be used in a batch')
+    return c
+
+
+class Batch(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    commands+/list.rc_command: The remote control commands to run, in order. Each is an object with the keys cmd,\
+        version, payload and no_response, as for any other remote control command
+    ignore_errors/bool: Boolean indicating whether to run the remaining commands after a command fails
+    '''
+
+    short_desc = 'Run several commands at once'
+    desc = (
+        'Run several remote control commands, one after the other, with no other remote control commands'
+        ' or screen updates in between them. Every argument is a command, as you would specify it after'
+        ' :code:`kitten @`. If no arguments are specified, the commands are read from STDIN, one per line.'
+        ' Prints out a JSON list with the response to every command that was run, which is an object with'
+        ' the key :code:`ok` and :code:`data` or :code:`error`. Running stops at the first command that fails,'
+        ' unless :option:`kitty @ batch --ignore-errors` is used. For example::\n\n'
+        '    kitten @ batch "launch --type=tab --tab-title=Build" "launch --location=vsplit make"\n\n'
+        'Commands that keep running, wait for responses or read data in chunks cannot be batched.'
+        ' When using :opt:`remote_control_password`, a batch is allowed only if every command in it is allowed.'
+    )
+    options_spec = '''\
+--ignore-errors
+type=bool-set
+Run all the commands even if some of them fail.
+'''
+    args = RemoteCommand.Args(spec='[COMMAND ...]', json_field='commands', special_parse='parse_batch_commands(args)')
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        from kitty.remote_control import create_basic_command
+        lines = list(args) if args else sys.stdin.read().splitlines()
+        commands: List[Dict[str, Any]] = []
+        for line in lines:
+            items = shlex.split(line)
+            if not items or items[0].startswith('#'):
+                continue
+            c = command_for_name(items[0])
+            sub_opts, sub_args = parse_subcommand_cli(c, items)
+            payload = c.message_to_kitty(global_opts, sub_opts, sub_args)
+            if not isinstance(payload, (dict, type(None))):
+                self.fatal(f'The {c.name} command cannot be used in a batch')
+            pcmd = create_basic_command(c.name, payload, no_response=getattr(sub_opts, 'no_response', False))
+            try:
+                check_can_be_batched(pcmd)
+            except BatchFailed as e:
+                self.fatal(str(e))
+            commands.append(pcmd)
+        if not commands:
+            self.fatal('No commands specified')
+        return {'commands': commands, 'ignore_errors': opts.ignore_errors}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        from kitty.remote_control import handle_cmd
+        commands = payload_get('commands') or []
+        for pcmd in commands:
+            check_can_be_batched(pcmd)
+        peer_id = payload_get('peer_id') or 0
+        results: List[Dict[str, Any]] = []
+        for i, pcmd in enumerate(commands):
+            pcmd = {k: v for k, v in pcmd.items() if k not in ('async', 'cancel_async', 'stream', 'stream_id')}
+            try:
+                response = handle_cmd(boss, window, pcmd, peer_id, window)
+            except Exception as err:
+                response = {'ok': False, 'error': str(err)}
+            results.append(response if isinstance(response, dict) else {'ok': True})
+            if not results[-1].get('ok') and not payload_get('ignore_errors'):
+                raise BatchFailed(f'Command number {i + 1} ({pcmd["cmd"]}) failed with error: {results[-1].get("error")}')
+        return json.dumps(results, indent=2)
+
+
+batch = Batch()
@@ -0,0 +1,47 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+from typing import TYPE_CHECKING, Optional
+
+from .base import ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import CancelRCOptions as CLIOptions
+
+
+class UnknownRequest(ValueError):
+
+    hide_traceback = True
+
+
+class Cancel(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    ids+/list.str: The ids of the commands to cancel, as specified with the async field of their messages
+    '''
+
+    short_desc = 'Cancel commands that are waiting for a response'
+    desc = (
+        'Abort commands that keep running in kitty while waiting for a response, such as'
+        ' :ref:`kitty @ select-window <at-select-window>`. The command is aborted and the program'
+        ' that ran it gets an error response. The ids of the commands must be specified using'
+        ' :option:`kitty @ --async-id` when running them. For example::\n\n'
+        '    kitten @ --async-id=pick select-window &\n'
+        '    kitten @ cancel pick'
+    )
+    args = RemoteCommand.Args(spec='ID ...', json_field='ids', minimum_count=1)
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        if not args:
+            self.fatal('Must specify at least one id')
+        return {'ids': list(args)}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        from kitty.remote_control import cancel_async_request
+        unknown = [x for x in payload_get('ids') or () if not cancel_async_request(boss, x)]
+        if unknown:
+            raise UnknownRequest(f'No commands are waiting for a response with the ids: {", ".join(unknown)}')
+        return None
+
+
+cancel = Cancel()
@@ -0,0 +1,88 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+import json
+from typing import TYPE_CHECKING, Any, Container, Dict, List, Optional
+
+from .base import MATCH_TAB_OPTION, ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Tab, Window
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import DumpLayoutRCOptions as CLIOptions
+    from kitty.tabs import TabManager
+
+
+LAYOUT_VERSION = 1
+
+
+def serialize_window(window: Window) -> Dict[str, Any]:
+    return {
+        'title': window.override_title,
+        'cwd': window.child.current_cwd or window.child.cwd,
+        'cmdline': list(window.child.unmodified_argv),
+        'user_vars': dict(window.user_vars),
+    }
+
+
+def serialize_tab(tab: Tab) -> Dict[str, Any]:
+    windows = []
+    active_window_idx = 0
+    # overlay windows are not saved, only the windows they are over
+    for i, group in enumerate(tab.windows.groups):
+        if group.windows:
+            if i == tab.windows.active_group_idx:
+                active_window_idx = len(windows)
+            windows.append(serialize_window(group.windows[0]))
+    return {
+        'title': tab.name,
+        'layout': tab.current_layout.name,
+        'enabled_layouts': list(tab.enabled_layouts),
+        'active_window_idx': active_window_idx,
+        'windows': windows,
+    }
+
+
+def serialize_os_window(tm: 'TabManager', allowed_tab_ids: Optional[Container[int]] = None) -> Dict[str, Any]:
+    tabs = []
+    active_tab_idx = 0
+    for tab in tm:
+        if allowed_tab_ids is None or tab.id in allowed_tab_ids:
+            if tab is tm.active_tab:
+                active_tab_idx = len(tabs)
+            tabs.append(serialize_tab(tab))
+    return {'wm_class': tm.wm_class, 'active_tab_idx': active_tab_idx, 'tabs': tabs}
+
+
+class DumpLayout(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    match/str: The tabs to dump, all tabs if empty
+    '''
+
+    short_desc = 'Print out the layout of all OS windows, tabs and windows'
+    desc = (
+        'Print out a JSON description of all OS windows, tabs and windows, that can be used to'
+        ' re-create them with :ref:`kitty @ restore-layout <at-restore-layout>`. It has a list of'
+        ' :italic:`os_windows`, each with a list of :italic:`tabs`. Every tab has a :italic:`title`,'
+        ' a :italic:`layout` and a list of :italic:`windows`. Every window has a :italic:`title`, a'
+        ' :italic:`cwd`, the :italic:`cmdline` of the program running in it and its :italic:`user_vars`.'
+        ' Overlay windows are not included. By default, all tabs are included, use :option:`kitty @ dump-layout --match`'
+        ' to include only some tabs.'
+    )
+    options_spec = MATCH_TAB_OPTION
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        return {'match': opts.match}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        allowed_tab_ids = None
+        if payload_get('match'):
+            allowed_tab_ids = {t.id for t in self.tabs_for_match_payload(boss, window, payload_get) if t}
+        os_windows: List[Dict[str, Any]] = []
+        for tm in boss.all_tab_managers:
+            osw = serialize_os_window(tm, allowed_tab_ids)
+            if osw['tabs']:
+                os_windows.append(osw)
+        return json.dumps({'version': LAYOUT_VERSION, 'os_windows': os_windows}, indent=2)
+
+
+dump_layout = DumpLayout()
@@ -18,6 +18,7 @@ class GetColors(RemoteCommand):
     protocol_spec = __doc__ = '''
     match/str: The window to get the colors for
     configured/bool: Boolean indicating whether to get configured or current colors
+    changed_only/bool: Boolean indicating whether to get only the colors that are different from the configured colors
     '''
 
     short_desc = 'Get terminal colors'
@@ -27,6 +28,8 @@ class GetColors(RemoteCommand):
         '\n\nTo get a single color use:'
         '\n  get-colors | grep "^background " | tr -s | cut -d" " -f2'
         '\n\nChange background above to whatever color you are interested in.'
+        ' Use :option:`kitty @ get-colors --changed-only` to get only the colors that have been'
+        ' changed, for example, by :ref:`kitty @ set-colors <at-set-colors>`.'
     )
     options_spec = '''\
 --configured -c
@@ -34,15 +37,22 @@ class GetColors(RemoteCommand):
 Instead of outputting the colors for the specified window, output the currently
 configured colors.
 
+
+--changed-only
+type=bool-set
+Only output the colors of the specified window that are different from the
+configured colors.
+
 ''' + '\n\n' + MATCH_WINDOW_OPTION
 
     def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
-        return {'configured': opts.configured, 'match': opts.match}
+        return {'configured': opts.configured, 'changed_only': opts.changed_only, 'match': opts.match}
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
         from kitty.fast_data_types import get_options
         opts = get_options()
         ans = {k: getattr(opts, k) for k in opts if isinstance(getattr(opts, k), Color)}
+        configured = ans.copy()
         if not payload_get('configured'):
             windows = self.windows_for_match_payload(boss, window, payload_get)
             if windows and windows[0]:
@@ -55,6 +65,10 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
                 tm = None if tab is None else tab.tab_manager_ref()
                 if tm is not None:
                     ans.update(tm.tab_bar.current_colors)
+        if payload_get('changed_only'):
+            ans = {k: v for k, v in ans.items() if configured.get(k) != v}
+            if not ans:
+                return ''
         all_keys = natsort_ints(ans)
         maxlen = max(map(len, all_keys))
         return '\n'.join(('{:%ds} {}' % maxlen).format(key, color_as_sharp(ans[key])) for key in all_keys)
@@ -0,0 +1,103 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+from typing import TYPE_CHECKING, List, Optional
+
+from .base import MATCH_WINDOW_OPTION, ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import GetScrollbackRCOptions as CLIOptions
+
+
+class GetScrollback(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    match/str: The window to get text from
+    first_line/int: The number of the first line to get, negative numbers count back from the last line
+    lines/int: The maximum number of lines to get
+    ansi/bool: Boolean, if True send ANSI formatting codes
+    wrap_markers/bool: Boolean, if True add wrap markers to output
+    count_lines/bool: Boolean, if True send the total number of lines instead of any text
+    self/bool: Boolean, if True use window the command was run in
+    '''
+
+    short_desc = 'Get some lines of the scrollback of the specified window'
+    desc = (
+        'Get the specified lines from the scrollback and screen of a window, so that large scrollbacks'
+        ' can be fetched a piece at a time. The lines are numbered from zero, starting at the oldest'
+        ' line in the scrollback and ending at the last line of the screen. Use'
+        ' :option:`kitty @ get-scrollback --count-lines` to get the total number of lines. Lines'
+        ' in the scrollback pager history are not included. For example, to get the last hundred lines::\n\n'
+        '    kitten @ get-scrollback --from=-100 --lines=100'
+    )
+    options_spec = MATCH_WINDOW_OPTION + '''\n
+--from
+dest=first_line
+type=int
+default=0
+The number of the first line to get. Negative numbers count back from the last
+line, so :code:`-1` is the last line.
+
+
+--lines
+type=int
+default=100
+The maximum number of lines to get.
+
+
+--ansi
+type=bool-set
+By default, only plain text is returned. With this flag, the text will
+include the ANSI formatting escape codes for colors, bold, italic, etc.
+
+
+--add-wrap-markers
+type=bool-set
+Add carriage returns at every line wrap location (where long lines are wrapped at
+screen edges).
+
+
+--count-lines
+type=bool-set
+Print out the total number of lines in the scrollback and screen, instead of any text.
+
+
+--self
+type=bool-set
+Get text from the window this command is run in, rather than the active window.
+'''
+    field_to_option_map = {'wrap_markers': 'add_wrap_markers'}
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        return {
+            'match': opts.match,
+            'first_line': opts.first_line,
+            'lines': opts.lines,
+            'ansi': opts.ansi,
+            'wrap_markers': opts.add_wrap_markers,
+            'count_lines': opts.count_lines,
+            'self': opts.self,
+        }
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        windows = self.windows_for_match_payload(boss, window, payload_get)
+        if windows and windows[0]:
+            window = windows[0]
+        else:
+            return None
+        screen = window.screen
+        total = screen.historybuf.count + screen.lines
+        if payload_get('count_lines'):
+            return str(total)
+        first = payload_get('first_line') or 0
+        if first < 0:
+            first = max(0, total + first)
+        lines: List[str] = []
+        screen.lines_as_text(first, max(0, payload_get('lines') or 0), lines.append, bool(payload_get('ansi')), bool(payload_get('wrap_markers')))
+        ans = ''.join(lines)
+        if payload_get('ansi'):
+            ans += '\x1b[m'
+        return ans
+
+
+get_scrollback = GetScrollback()
@@ -2,14 +2,77 @@
 # License: GPLv3 Copyright: 2020, Kovid Goyal <kovid at kovidgoyal.net>
 
 
-from typing import TYPE_CHECKING, Optional
+from typing import TYPE_CHECKING, Dict, List, Optional, Sequence
 
-from .base import MATCH_WINDOW_OPTION, ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+from kitty.fast_data_types import add_timer, get_boss, remove_timer
+from kitty.types import AsyncResponse
+
+from .base import MATCH_WINDOW_OPTION, ArgsType, AsyncResponder, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
 
 if TYPE_CHECKING:
     from kitty.cli_stub import GetTextRCOptions as CLIOptions
 
 
+def lines_added(prev_tail: Sequence[str], prev_count: int, lines: Sequence[str]) -> Sequence[str]:
+    ''' Return the lines at the end of lines that come after prev_tail, which
+    were the last lines when there were prev_count lines. Lines may have been
+    removed from the start, as the scrollback is limited in size. '''
+    n = len(prev_tail)
+    if n:
+        for end in range(min(prev_count, len(lines)), n - 1, -1):
+            if lines[end - 1] == prev_tail[-1] and lines[end - n:end] == prev_tail:
+                return lines[end:]
+    # The text was cleared or changed
+    return lines[prev_count:] if len(lines) >= prev_count else lines
+
+
+def completed_lines(window: Window, as_ansi: bool, add_history: bool, add_wrap_markers: bool) -> List[str]:
+    ' The lines in the window above the cursor, which are no longer being written to '
+    screen = window.screen
+    lines = window.as_text(as_ansi=as_ansi, add_history=add_history, add_wrap_markers=add_wrap_markers).split('\n')
+    del lines[max(0, len(lines) - (screen.lines - screen.cursor.y)):]
+    return lines
+
+
+class Follower:
+
+    tail_size = 32
+
+    def __init__(self, window: Window, responder: AsyncResponder, initial_text: str, as_ansi: bool, add_wrap_markers: bool) -> None:
+        self.window_id = window.id
+        self.responder = responder
+        self.as_ansi, self.add_wrap_markers = as_ansi, add_wrap_markers
+        self.pending_text = initial_text
+        self.update(completed_lines(window, as_ansi, True, add_wrap_markers))
+        self.timer_id = add_timer(self.on_timer, 0.2, True)
+
+    def update(self, lines: Sequence[str]) -> None:
+        self.count = len(lines)
+        self.tail = lines[-self.tail_size:]
+
+    def on_timer(self, timer_id: Optional[int]) -> None:
+        w = get_boss().window_id_map.get(self.window_id)
+        if w is None:
+            self.stop()
+            self.responder.send_data('')
+            return
+        if not w.screen.is_using_alternate_linebuf():
+            lines = completed_lines(w, self.as_ansi, True, self.add_wrap_markers)
+            self.pending_text += ''.join(x + '\n' for x in lines_added(self.tail, self.count, lines))
+            self.update(lines)
+        if self.pending_text:
+            text, self.pending_text = self.pending_text, ''
+            if not self.responder.send_data(text, more=True):
+                self.stop()
+
+    def stop(self) -> None:
+        followers.pop(self.responder.async_id, None)
+        remove_timer(self.timer_id)
+
+
+followers: Dict[str, Follower] = {}
+
+
 class GetText(RemoteCommand):
 
     protocol_spec = __doc__ = '''
@@ -22,6 +85,7 @@ class GetText(RemoteCommand):
     wrap_markers/bool: Boolean, if True add wrap markers to output
     clear_selection/bool: Boolean, if True clear the selection in the matched window
     self/bool: Boolean, if True use window the command was run in
+    follow/bool: Boolean, if True keep sending lines as they are added to the window, until the request is cancelled
     '''
 
     short_desc = 'Get text from the specified window'
@@ -64,9 +128,19 @@ class GetText(RemoteCommand):
 --self
 type=bool-set
 Get text from the window this command is run in, rather than the active window.
+
+
+--follow
+type=bool-set
+Keep running, printing lines as they are added to the window, like :code:`tail -f`,
+until interrupted or the window is closed. The text specified by :option:`--extent`
+is printed first, for the :code:`screen` and :code:`all` extents, without the line
+the cursor is on and those below it, as they are printed when complete. Nothing is
+printed while a full screen program is running in the window.
 '''
 
     field_to_option_map = {'wrap_markers': 'add_wrap_markers', 'cursor': 'add_cursor'}
+    streams_responses_option = 'follow'
 
     def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
         return {
@@ -77,10 +151,13 @@ def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: Arg
             'wrap_markers': opts.add_wrap_markers,
             'clear_selection': opts.clear_selection,
             'self': opts.self,
+            'follow': opts.follow,
         }
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
         from kitty.window import CommandOutput
+        follow = bool(payload_get('follow')) and bool(payload_get('async_id'))
+        responder = self.create_async_responder(payload_get, window) if follow else None
         windows = self.windows_for_match_payload(boss, window, payload_get)
         if windows and windows[0]:
             window = windows[0]
@@ -112,6 +189,9 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
                 as_ansi=bool(payload_get('ansi')),
                 add_wrap_markers=bool(payload_get('wrap_markers')),
             )
+        elif follow:
+            ans = ''.join(x + '\n' for x in completed_lines(
+                window, bool(payload_get('ansi')), payload_get('extent') == 'all', bool(payload_get('wrap_markers'))))
         else:
             ans = window.as_text(
                 as_ansi=bool(payload_get('ansi')),
@@ -121,7 +201,18 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
             )
         if payload_get('clear_selection'):
             window.clear_selection()
+        if responder is not None:
+            if ans and not ans.endswith('\n'):
+                ans += '\n'
+            followers[responder.async_id] = Follower(
+                window, responder, ans, bool(payload_get('ansi')), bool(payload_get('wrap_markers')))
+            return AsyncResponse()
         return ans
 
+    def cancel_async_request(self, boss: 'Boss', window: Optional['Window'], payload_get: PayloadGetType) -> None:
+        f = followers.get(payload_get('async_id'))
+        if f is not None:
+            f.stop()
+
 
 get_text = GetText()
@@ -1,20 +1,140 @@
 #!/usr/bin/env python
 # License: GPLv3 Copyright: 2020, Kovid Goyal <kovid at kovidgoyal.net>
 
-
-from typing import TYPE_CHECKING, Optional
+import json
+import os
+import signal
+from time import monotonic
+from typing import TYPE_CHECKING, Any, Dict, Optional
 
 from kitty.cli_stub import LaunchCLIOptions
+from kitty.fast_data_types import add_timer, monitor_pid, remove_timer
 from kitty.launch import launch as do_launch
 from kitty.launch import options_spec as launch_options_spec
-from kitty.launch import parse_launch_args
+from kitty.launch import non_window_launch_types, parse_launch_args
+from kitty.types import AsyncResponse
 
-from .base import MATCH_TAB_OPTION, ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+from .base import (
+    MATCH_TAB_OPTION,
+    ArgsType,
+    AsyncResponder,
+    Boss,
+    PayloadGetType,
+    PayloadType,
+    RCOptions,
+    RemoteCommand,
+    ResponseType,
+    Window,
+)
 
 if TYPE_CHECKING:
     from kitty.cli_stub import LaunchRCOptions as CLIOptions
 
 
+class WaitNotSupported(ValueError):
+
+    hide_traceback = True
+
+
+class PassFdsFailed(ValueError):
+
+    hide_traceback = True
+
+
+def exit_status_as_dict(status: int) -> Dict[str, Any]:
+    if os.WIFSIGNALED(status):
+        sig = os.WTERMSIG(status)
+        try:
+            name = signal.Signals(sig).name
+        except ValueError:
+            name = str(sig)
+        return {'exit_status': -sig, 'signal': name}
+    return {'exit_status': os.WEXITSTATUS(status) if os.WIFEXITED(status) else None, 'signal': None}
+
+
+class Waiter:
+
+    # how long to wait for the window to close after the child exits or vice versa
+    grace_period = 2
+
+    def __init__(self, boss: Boss, window: Window, responder: AsyncResponder, capture_output: bool, capture_limit: int):
+        self.boss, self.window_id, self.responder = boss, window.id, responder
+        self.capture_output, self.capture_limit = capture_output, capture_limit
+        self.start_time = monotonic()
+        self.duration: Optional[float] = None
+        self.status: Optional[int] = None
+        self.output: Optional[str] = None
+        self.timer_id: Optional[int] = None
+        self.pid = window.child.pid or 0
+        self.finished = False
+        window.actions_on_close.append(self.on_window_close)
+        if self.pid:
+            boss.monitored_pid_callbacks[self.pid] = self.on_child_exit
+            monitor_pid(self.pid)
+
+    def on_child_exit(self, status: int) -> None:
+        self.status = status
+        self.duration = monotonic() - self.start_time
+        if self.output is None:
+            w = self.boss.window_id_map.get(self.window_id)
+            if w is not None and not w.destroyed:
+                self.start_grace_timer()
+                return
+        self.finish()
+
+    def on_window_close(self, window: Window) -> None:
+        self.output = window.as_text(add_history=True) if self.capture_output else ''
+        if self.status is None:
+            self.start_grace_timer()
+        else:
+            self.finish()
+
+    def start_grace_timer(self) -> None:
+        if self.timer_id is None:
+            self.timer_id = add_timer(self.on_grace_period_expired, self.grace_period, False)
+
+    def on_grace_period_expired(self, timer_id: Optional[int]) -> None:
+        self.timer_id = None
+        self.finish()
+
+    def finish(self) -> None:
+        if self.finished:
+            return
+        self.stop()
+        ans: Dict[str, Any] = {'window_id': self.window_id}
+        if self.status is None:
+            ans.update({'exit_status': None, 'signal': None})
+        else:
+            ans.update(exit_status_as_dict(self.status))
+        ans['duration'] = monotonic() - self.start_time if self.duration is None else self.duration
+        if self.capture_output:
+            output = self.output
+            if output is None:
+                w = self.boss.window_id_map.get(self.window_id)
+                output = w.as_text(add_history=True) if w is not None else ''
+            raw = output.rstrip().encode('utf-8')
+            ans['output_truncated'] = len(raw) > self.capture_limit
+            if ans['output_truncated']:
+                raw = raw[len(raw) - self.capture_limit:]
+            ans['output'] = raw.decode('utf-8', 'ignore')
+        self.responder.send_data(json.dumps(ans))
+
+    def stop(self) -> None:
+        self.finished = True
+        waiters.pop(self.responder.async_id, None)
+        if self.timer_id is not None:
+            remove_timer(self.timer_id)
+            self.timer_id = None
+        if self.boss.monitored_pid_callbacks.get(self.pid) == self.on_child_exit:
+            del self.boss.monitored_pid_callbacks[self.pid]
+        w = self.boss.window_id_map.get(self.window_id)
+        if w is not None and self.on_window_close in w.actions_on_close:
+            w.actions_on_close.remove(self.on_window_close)
+
+
+waiters: Dict[str, Waiter] = {}
+
+
 class Launch(RemoteCommand):
 
     protocol_spec = __doc__ = '''
@@ -34,6 +154,9 @@ class Launch(RemoteCommand):
     location/choices.first.after.before.neighbor.last.vsplit.hsplit.split.default: Where in the tab to open the new window
     allow_remote_control/bool: Boolean indicating whether to allow remote control from the new window
     remote_control_password/list.str: A list of remote control passwords
+    wait/bool: Boolean indicating whether to wait for the program to exit and respond with its exit status
+    capture_output/bool: Boolean indicating whether to include the text of the window in the response when waiting
+    capture_limit/int: The maximum number of bytes of the text of the window to include in the response
     stdin_source/choices.none.@selection.@screen.@screen_scrollback.@alternate.@alternate_scrollback.\
         @first_cmd_output_on_screen.@last_cmd_output.@last_visited_cmd_output: Where to get stdin for the process from
     stdin_add_formatting/bool: Boolean indicating whether to add formatting codes to stdin
@@ -50,6 +173,8 @@ class Launch(RemoteCommand):
     os_window_state/choices.normal.fullscreen.maximized.minimized: The initial state for OS Window
     color/list.str: list of color specifications such as foreground=red
     watcher/list.str: list of paths to watcher files
+    pass_fds/list.int: The numbers the file descriptors passed with this message using SCM_RIGHTS are to have in the\
+        launched program, in the order they were passed
     '''
 
     short_desc = 'Run an arbitrary process in a new window/tab'
@@ -69,14 +194,62 @@ class Launch(RemoteCommand):
 type=bool-set
 If specified the tab containing the window this command is run in is used
 instead of the active tab
+
+
+--wait
+type=bool-set
+Wait for the program to exit and print out a JSON object with the keys:
+:code:`window_id`, :code:`exit_status`, :code:`signal` and :code:`duration`.
+:code:`exit_status` is the exit code of the program or the negative of the
+number of the signal that killed it, and :code:`signal` is the name of that
+signal. :code:`duration` is the number of seconds the program ran for. Only
+works for programs run in kitty windows, not in the background. Cannot be used
+with :option:`kitty @ launch --hold`.
+
+
+--capture-output
+type=bool-set
+When using :option:`kitty @ launch --wait`, also include the text of the
+window, with its scrollback, in the :code:`output` key. Note that STDOUT and
+STDERR of programs running in a terminal both go to the window, so they are
+captured together. If the output is longer than :option:`kitty @ launch
+--capture-limit` bytes, only its end is kept and the :code:`output_truncated`
+key is set to :code:`true`.
+
+
+--capture-limit
+type=int
+default=65536
+The maximum number of bytes of output to return when using
+:option:`kitty @ launch --capture-output`.
+
+
+--pass-fd
+type=list
+Pass the specified file descriptor of this command to the launched program,
+with the same number. Can be specified multiple times. Passing :code:`0` or
+:code:`1` connects the STDIN or STDOUT of the program to the pipeline this
+command is run in instead of the window, which remains the controlling terminal
+of the program. For example::
+
+    ls | kitten @ launch --no-response --pass-fd 0 --pass-fd 1 fzf | xargs ls -l
+
+Only works when connecting to kitty using a UNIX socket, see
+:option:`kitty @ --to`, and for programs run in kitty windows.
     ''' + '\n\n' + launch_options_spec().replace(':option:`launch', ':option:`kitty @ launch')
+    streams_responses_option = 'wait'
+    field_to_option_map = {'pass_fds': 'pass_fd'}
+    passes_fds_field = 'pass_fds'
     args = RemoteCommand.Args(spec='[CMD ...]', json_field='args', completion=RemoteCommand.CompletionSpec.from_string(
         'type:special group:cli.CompleteExecutableFirstArg'))
 
     def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
         ans = {'args': args or []}
         for attr, val in opts.__dict__.items():
-            ans[attr] = val
+            if attr == 'pass_fd':
+                ans['pass_fds'] = list(map(int, val or ()))
+            else:
+                ans[attr] = val
         return ans
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
@@ -87,14 +260,41 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
             if val is None:
                 val = default_value
             setattr(opts, key, val)
+        wait = bool(payload_get('wait')) and not payload_get('no_response')
+        if wait:
+            if opts.type in ('background', 'clipboard', 'primary'):
+                raise WaitNotSupported(f'Cannot wait for programs launched with --type={opts.type}')
+            if opts.hold:
+                raise WaitNotSupported('Cannot wait for programs launched with --hold')
+            if not payload_get('async_id'):
+                raise WaitNotSupported('Waiting must be done asynchronously, upgrade the kitty client')
+        pass_fds = payload_get('pass_fds') or ()
+        received_fds = payload_get('received_fds') or ()
+        if len(pass_fds) != len(received_fds):
+            raise PassFdsFailed('The file descriptors to pass were not received, they can only be passed over UNIX sockets')
+        if pass_fds and opts.type in non_window_launch_types:
+            raise PassFdsFailed(f'Cannot pass file descriptors to programs launched with --type={opts.type}')
         target_tab = None
         tabs = self.tabs_for_match_payload(boss, window, payload_get)
         if tabs and tabs[0]:
             target_tab = tabs[0]
         elif payload_get('type') not in ('background', 'os-window', 'tab', 'window'):
             return None
-        w = do_launch(boss, opts, payload_get('args') or [], target_tab=target_tab, rc_from_window=window)
+        w = do_launch(
+            boss, opts, payload_get('args') or [], target_tab=target_tab, rc_from_window=window, pass_fds=tuple(zip(received_fds, pass_fds)))
+        if wait and w is not None:
+            capture_limit = payload_get('capture_limit')
+            waiter = Waiter(
+                boss, w, self.create_async_responder(payload_get, window), bool(payload_get('capture_output')),
+                65536 if capture_limit is None else max(0, capture_limit))
+            waiters[waiter.responder.async_id] = waiter
+            return AsyncResponse()
         return None if payload_get('no_response') else str(getattr(w, 'id', 0))
 
+    def cancel_async_request(self, boss: 'Boss', window: Optional['Window'], payload_get: PayloadGetType) -> None:
+        waiter = waiters.get(payload_get('async_id'))
+        if waiter is not None:
+            waiter.stop()
+
 
 launch = Launch()
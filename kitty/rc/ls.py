@@ -2,9 +2,12 @@
 # License: GPLv3 Copyright: 2020, Kovid Goyal <kovid at kovidgoyal.net>
 
 import json
-from typing import TYPE_CHECKING, Dict, List, Optional, Set, Tuple
+import re
+from functools import lru_cache
+from typing import TYPE_CHECKING, Any, Callable, Dict, List, Optional, Set, Tuple
 
 from kitty.constants import appname
+from kitty.search_query_parser import ParseException, Parser, SearchTreeNode, TokenType
 
 from .base import ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
 
@@ -12,9 +15,132 @@
     from kitty.cli_stub import LSRCOptions as CLIOptions
 
 
+class InvalidQuery(ValueError):
+
+    hide_traceback = True
+
+
+class WindowRecord:
+
+    def __init__(self, osw: Dict[str, Any], tab: Dict[str, Any], w: Dict[str, Any]):
+        self.osw, self.tab, self.w = osw, tab, w
+
+    def value(self, field: str) -> Any:
+        kind, sep, name = field.partition(':')
+        if sep:
+            return (self.w.get('user_vars' if kind == 'var' else 'env') or {}).get(name)
+        src, key = query_fields[field]
+        if src == 'tab':
+            return self.tab.get(key)
+        if src == 'os_window':
+            return self.osw.get(key)
+        ans = self.w.get(key)
+        if field == 'cmdline':
+            ans = ' '.join(ans or ())
+        return ans
+
+
+# Query fields and where to get their values from
+query_fields: Dict[str, Tuple[str, str]] = {
+    'id': ('window', 'id'), 'title': ('window', 'title'), 'pid': ('window', 'pid'), 'cwd': ('window', 'cwd'),
+    'cmdline': ('window', 'cmdline'), 'lines': ('window', 'lines'), 'columns': ('window', 'columns'),
+    'focused': ('window', 'is_focused'), 'active': ('window', 'is_active'), 'self': ('window', 'is_self'),
+    'tab_id': ('tab', 'id'), 'tab_title': ('tab', 'title'), 'layout': ('tab', 'layout'),
+    'tab_focused': ('tab', 'is_focused'), 'tab_active': ('tab', 'is_active'),
+    'os_window_id': ('os_window', 'id'), 'wm_class': ('os_window', 'wm_class'), 'wm_name': ('os_window', 'wm_name'),
+    'os_window_focused': ('os_window', 'is_focused'), 'os_window_active': ('os_window', 'is_active'),
+}
+comparison_pat = re.compile(r'^([a-z_]+|(?:var|env):[^=!<>~]+)(~|!~|=|!=|<=|>=|<|>)(.*)$', re.DOTALL)
+numeric_comparisons: Dict[str, Callable[[float, float], bool]] = {
+    '<': float.__lt__, '<=': float.__le__, '>': float.__gt__, '>=': float.__ge__}
+
+
+class ComparisonNode(SearchTreeNode):
+
+    def __init__(self, field: str, op: str, value: str) -> None:
+        self.field, self.op, self.value = field, op, value
+        self.pat: Optional['re.Pattern[str]'] = None
+        self.number = 0.
+        if op in ('~', '!~'):
+            try:
+                self.pat = re.compile(value)
+            except re.error as e:
+                raise ParseException(f'Invalid regular expression {value!r} for {field}: {e}')
+        elif op in numeric_comparisons:
+            try:
+                self.number = float(value)
+            except ValueError:
+                raise ParseException(f'{value!r} is not a number, as needed to compare with {op}')
+
+    def matches(self, val: Any) -> bool:
+        if not self.op:
+            return bool(val) if isinstance(val, bool) else val is not None
+        if self.op in ('!=', '!~'):
+            return not self.positive_match(val)
+        return self.positive_match(val)
+
+    def positive_match(self, val: Any) -> bool:
+        if val is None:
+            return False
+        if isinstance(val, bool):
+            val = 'true' if val else 'false'
+        if self.pat is not None:
+            return self.pat.search(str(val)) is not None
+        if self.op in ('=', '!='):
+            return str(val) == self.value
+        try:
+            return numeric_comparisons[self.op](float(val), self.number)
+        except (TypeError, ValueError):
+            return False
+
+    def __call__(self, candidates: Set[Any], get_matches: Any) -> Set[Any]:
+        return {c for c in candidates if self.matches(c.value(self.field))}
+
+
+class QueryParser(Parser):
+
+    def base_token(self) -> SearchTreeNode:
+        if self.token_type() is TokenType.QUOTED_WORD:
+            raise ParseException(f'Expected a field name instead of: "{self.token()}"')
+        tt = self.token(advance=True) or ''
+        m = comparison_pat.match(tt)
+        field, op, value = m.groups() if m is not None else (tt, '', '')
+        if op and not value and self.token_type() is TokenType.QUOTED_WORD:
+            value = self.token(advance=True) or ''
+        kind, sep, name = field.partition(':')
+        if not (field in query_fields or (sep and kind in ('var', 'env') and name)):
+            raise ParseException(f'Unknown field: {field}')
+        return ComparisonNode(field, op, value)
+
+
+@lru_cache(maxsize=16)
+def parse_query(query: str) -> SearchTreeNode:
+    try:
+        return QueryParser().parse(query, ())
+    except ParseException as e:
+        raise InvalidQuery(f'Invalid query {query!r}: {e.msg}')
+    except RuntimeError:
+        raise InvalidQuery(f'Invalid query {query!r}: too much recursion required')
+
+
+def filter_windows(data: List[Dict[str, Any]], query: str) -> List[Dict[str, Any]]:
+    tree = parse_query(query)
+    records = {WindowRecord(osw, tab, w) for osw in data for tab in osw['tabs'] for w in tab['windows']}
+    matched = {id(r.w) for r in tree.search(records, None)}
+    ans = []
+    for osw in data:
+        for tab in osw['tabs']:
+            tab['windows'] = [w for w in tab['windows'] if id(w) in matched]
+        osw['tabs'] = [tab for tab in osw['tabs'] if tab['windows']]
+        if osw['tabs']:
+            ans.append(osw)
+    return ans
+
+
 class LS(RemoteCommand):
     protocol_spec = __doc__ = '''
     all_env_vars/bool: Whether to send all environment variables for every window rather than just differing ones
+    match_query/str: Only list windows matching this query
     '''
 
     short_desc = 'List all tabs/windows'
@@ -26,18 +152,43 @@ class LS(RemoteCommand):
         ' :italic:`command-line` and :italic:`environment` of the process running in the window. Additionally, when'
         ' running the command inside a kitty window, that window can be identified by the :italic:`is_self` parameter.\n\n'
         'You can use these criteria to select windows/tabs for the other commands.'
+        ' Use :option:`kitty @ ls --match-query` to list only some windows.'
     )
     options_spec = '''\
 --all-env-vars
 type=bool-set
 Show all environment variables in output, not just differing ones.
+
+
+--match-query
+Only list windows matching the specified query, and the tabs and OS windows
+containing them. Queries are comparisons of the form :italic:`field` :italic:`operator`
+:italic:`value`, combined with the Boolean operators :code:`and`, :code:`or` and
+:code:`not` and parentheses, for example::
+
+    title~"ssh" and var:project=foo and not focused
+
+The operators are :code:`~` and :code:`!~` to match or not match a regular
+expression, :code:`=` and :code:`!=` for equality and :code:`<`, :code:`<=`,
+:code:`>` and :code:`>=` to compare numbers. Values can be quoted. A field
+without an operator matches if it is true or, for user variables and
+environment variables, if it is set. The window fields are: :code:`id`,
+:code:`title`, :code:`pid`, :code:`cwd`, :code:`cmdline`, :code:`lines`,
+:code:`columns`, :code:`focused`, :code:`active`, :code:`self`,
+:code:`var:NAME` and :code:`env:NAME`. The fields of the tab and OS window
+containing the window are: :code:`tab_id`, :code:`tab_title`, :code:`layout`,
+:code:`tab_focused`, :code:`tab_active`, :code:`os_window_id`,
+:code:`wm_class`, :code:`wm_name`, :code:`os_window_focused` and
+:code:`os_window_active`.
 '''
 
     def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
-        return {'all_env_vars': opts.all_env_vars}
+        return {'all_env_vars': opts.all_env_vars, 'match_query': opts.match_query}
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
         data = list(boss.list_os_windows(window))
+        if payload_get('match_query'):
+            data = filter_windows(data, payload_get('match_query'))
         if not payload_get('all_env_vars'):
             all_env_blocks: List[Dict[str, str]] = []
             common_env_vars: Set[Tuple[str, str]] = set()
@@ -15,9 +15,10 @@ class ResizeOSWindow(RemoteCommand):
     self/bool: Boolean indicating whether to close the window the command is run in
     incremental/bool: Boolean indicating whether to adjust the size incrementally
     action/choices.resize.toggle-fullscreen.toggle-maximized: One of :code:`resize, toggle-fullscreen` or :code:`toggle-maximized`
-    unit/choices.cells.pixels: One of :code:`cells` or :code:`pixels`
+    unit/choices.cells.pixels.percent: One of :code:`cells`, :code:`pixels` or :code:`percent`
     width/int: Integer indicating desired window width
     height/int: Integer indicating desired window height
+    duration/float: The number of seconds over which to resize the window in steps
     '''
 
     short_desc = 'Resize the specified OS Windows'
@@ -35,8 +36,9 @@ class ResizeOSWindow(RemoteCommand):
 
 --unit
 default=cells
-choices=cells,pixels
-The unit in which to interpret specified sizes.
+choices=cells,pixels,percent
+The unit in which to interpret specified sizes. When :code:`percent`, sizes are
+percentages of the current size of the window.
 
 
 --width
@@ -57,6 +59,13 @@ class ResizeOSWindow(RemoteCommand):
 instead of absolute sizes.
 
 
+--duration
+type=float
+default=0
+Resize the window in steps over the specified number of seconds, rather than
+all at once, for smooth transitions in presentations and demos.
+
+
 --self
 type=bool-set
 Resize the window this command is run in, rather than the active window.
@@ -73,7 +82,7 @@ def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: Arg
         return {
             'match': opts.match, 'action': opts.action, 'unit': opts.unit,
             'width': opts.width, 'height': opts.height, 'self': opts.self,
-            'incremental': opts.incremental
+            'incremental': opts.incremental, 'duration': opts.duration,
         }
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
@@ -84,7 +93,8 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
                 if ac == 'resize':
                     boss.resize_os_window(
                         os_window_id, width=payload_get('width'), height=payload_get('height'),
-                        unit=payload_get('unit'), incremental=payload_get('incremental')
+                        unit=payload_get('unit'), incremental=payload_get('incremental'),
+                        duration=payload_get('duration') or 0
                     )
                 elif ac == 'toggle-fullscreen':
                     boss.toggle_fullscreen(os_window_id)
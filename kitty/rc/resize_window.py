@@ -15,6 +15,8 @@ class ResizeWindow(RemoteCommand):
     self/bool: Boolean indicating whether to resize the window the command is run in
     increment/int: Integer specifying the resize increment
     axis/choices.horizontal.vertical.reset: One of :code:`horizontal, vertical` or :code:`reset`
+    unit/choices.cells.percent: One of :code:`cells` or :code:`percent`
+    duration/float: The number of seconds over which to resize the window in steps
     '''
 
     short_desc = 'Resize the specified windows'
@@ -39,6 +41,20 @@ class ResizeWindow(RemoteCommand):
 The special value :code:`reset` will reset the layout to its default configuration.
 
 
+--unit -u
+choices=cells,percent
+default=cells
+The unit of the increment. When :code:`percent`, the size is changed by the
+specified percentage of the current size of the window along the axis.
+
+
+--duration
+type=float
+default=0
+Resize the window in steps over the specified number of seconds, rather than
+all at once, for smooth transitions in presentations and demos.
+
+
 --self
 type=bool-set
 Resize the window this command is run in, rather than the active window.
@@ -46,15 +62,23 @@ class ResizeWindow(RemoteCommand):
     string_return_is_error = True
 
     def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
-        return {'match': opts.match, 'increment': opts.increment, 'axis': opts.axis, 'self': opts.self}
+        return {
+            'match': opts.match, 'increment': opts.increment, 'axis': opts.axis, 'self': opts.self,
+            'unit': opts.unit, 'duration': opts.duration,
+        }
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
         windows = self.windows_for_match_payload(boss, window, payload_get)
         resized: Union[bool, None, str] = False
         if windows and windows[0]:
+            w = windows[0]
+            is_horizontal = payload_get('axis') == 'horizontal'
+            increment: float = payload_get('increment')
+            if payload_get('unit') == 'percent':
+                increment = increment * (w.screen.columns if is_horizontal else w.screen.lines) / 100
             resized = boss.resize_layout_window(
-                windows[0], increment=payload_get('increment'), is_horizontal=payload_get('axis') == 'horizontal',
-                reset=payload_get('axis') == 'reset'
+                w, increment=increment, is_horizontal=is_horizontal,
+                reset=payload_get('axis') == 'reset', duration=payload_get('duration') or 0
             )
         return resized
 
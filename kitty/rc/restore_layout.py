@@ -0,0 +1,107 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+import json
+import sys
+from typing import TYPE_CHECKING, Any, Dict, List, Optional
+
+from .base import ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+from .dump_layout import LAYOUT_VERSION
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import RestoreLayoutRCOptions as CLIOptions
+    from kitty.session import Session
+
+
+class InvalidLayout(ValueError):
+
+    hide_traceback = True
+
+
+def launch_args_for_window(w: Dict[str, Any]) -> List[str]:
+    ans = []
+    if w.get('cwd'):
+        ans.append(f'--cwd={w["cwd"]}')
+    if w.get('title'):
+        ans.append(f'--title={w["title"]}')
+    for k, v in (w.get('user_vars') or {}).items():
+        ans.append(f'--var={k}={v}')
+    cmdline = w.get('cmdline') or []
+    if cmdline:
+        ans.append('--')
+        ans.extend(cmdline)
+    return ans
+
+
+def session_for_os_window(osw: Dict[str, Any]) -> 'Session':
+    from kitty.fast_data_types import get_options
+    from kitty.session import Session
+    opts = get_options()
+    ans = Session()
+    ans.os_window_class = osw.get('wm_class') or None
+    for t in osw.get('tabs') or ():
+        ans.add_tab(opts, t.get('title') or '')
+        if t.get('enabled_layouts'):
+            ans.set_enabled_layouts(','.join(t['enabled_layouts']))
+        if t.get('layout'):
+            ans.set_layout(t['layout'])
+        for w in t.get('windows') or ():
+            ans.add_window(launch_args_for_window(w))
+        if not ans.tabs[-1].windows:
+            raise InvalidLayout('Tabs in the layout must have at least one window')
+        ans.tabs[-1].active_window_idx = min(max(0, int(t.get('active_window_idx') or 0)), len(ans.tabs[-1].windows) - 1)
+    if not ans.tabs or not ans.tabs[-1].windows:
+        raise InvalidLayout('OS windows in the layout must have at least one tab')
+    ans.active_tab_idx = min(max(0, int(osw.get('active_tab_idx') or 0)), len(ans.tabs) - 1)
+    return ans
+
+
+class RestoreLayout(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    data+/str: The layout to restore as JSON, in the format output by dump-layout
+    '''
+
+    short_desc = 'Re-create OS windows, tabs and windows from a saved layout'
+    desc = (
+        'Re-create OS windows, tabs and windows in the layout saved by :ref:`kitty @ dump-layout <at-dump-layout>`.'
+        ' The programs that were running in the windows are run again, in the same working directories.'
+        ' New OS windows are created, existing windows are not affected. The layout is read from the specified file,'
+        ' or STDIN if no file is specified. For example::\n\n'
+        '    kitten @ dump-layout > layout.json\n'
+        '    kitten @ restore-layout layout.json'
+    )
+    args = RemoteCommand.Args(spec='[PATH_TO_LAYOUT_FILE]', json_field='data', special_parse='read_layout_file(args)',
+                              completion=RemoteCommand.CompletionSpec.from_string('type:file group:"JSON files", ext:json'))
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        if len(args) > 1:
+            self.fatal('Only one layout file can be specified')
+        if args and args[0] != '-':
+            with open(args[0]) as f:
+                data = f.read()
+        else:
+            data = sys.stdin.read()
+        return {'data': data}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        try:
+            layout = json.loads(payload_get('data') or '')
+        except Exception as e:
+            raise InvalidLayout(f'The layout is not valid JSON: {e}')
+        if not isinstance(layout, dict) or 'os_windows' not in layout:
+            raise InvalidLayout('The layout is not in the format output by dump-layout')
+        if layout.get('version', LAYOUT_VERSION) > LAYOUT_VERSION:
+            raise InvalidLayout('The layout was saved by a newer version of kitty')
+        try:
+            sessions = [session_for_os_window(osw) for osw in layout['os_windows']]
+        except InvalidLayout:
+            raise
+        except Exception as e:
+            raise InvalidLayout(f'The layout is not valid: {e}')
+        for session in sessions:
+            boss.add_os_window(session)
+        return None
+
+
+restore_layout = RestoreLayout()
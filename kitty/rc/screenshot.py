@@ -0,0 +1,134 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+import json
+from base64 import standard_b64encode
+from typing import TYPE_CHECKING, Any, Dict, List, Optional
+
+from kitty.fast_data_types import cell_size_for_window
+from kitty.rgb import color_as_sharp, color_from_int
+
+from .base import MATCH_WINDOW_OPTION, ArgsType, Boss, MatchError, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import ScreenshotRCOptions as CLIOptions
+
+
+def screenshot_data(w: Window) -> Dict[str, Any]:
+    screen = w.screen
+    cp = screen.color_profile
+    colors = cp.as_dict()
+    default_fg = color_as_sharp(color_from_int(colors['foreground'] or 0))
+    default_bg = color_as_sharp(color_from_int(colors['background'] or 0))
+
+    def as_sharp(val: int, default: str) -> str:
+        c = cp.as_color(val)
+        return default if c is None else color_as_sharp(c)
+
+    rows: List[List[Dict[str, Any]]] = []
+    for y in range(screen.lines):
+        line = screen.visual_line(y)
+        runs: List[Dict[str, Any]] = []
+        current: Dict[str, Any] = {}
+        current_style: Dict[str, Any] = {}
+        for x in range(screen.columns):
+            width = line.width(x)
+            if width == 0:
+                continue  # the second cell of a wide character
+            c = line.cursor_from(x)
+            fg, bg = as_sharp(c.fg, default_fg), as_sharp(c.bg, default_bg)
+            if c.reverse:
+                fg, bg = bg, fg
+            style: Dict[str, Any] = {'fg': fg, 'bg': bg}
+            for attr in ('bold', 'italic', 'dim', 'strikethrough'):
+                if getattr(c, attr):
+                    style[attr] = True
+            if c.decoration:
+                style['underline'] = c.decoration
+                style['underline_color'] = as_sharp(c.decoration_fg, fg)
+            if width > 1:
+                style['width'] = width
+            text = line[x]
+            if text.startswith('\0'):
+                text = ' '
+            if current and width == 1 and style == current_style:
+                current['cells'].append(text)
+            else:
+                current_style = style
+                current = {'x': x, 'cells': [text]}
+                current.update(style)
+                runs.append(current)
+        rows.append(runs)
+
+    cell_width, cell_height = cell_size_for_window(w.os_window_id)
+    ans: Dict[str, Any] = {
+        'columns': screen.columns, 'lines': screen.lines, 'cell_width': cell_width, 'cell_height': cell_height,
+        'foreground': default_fg, 'background': default_bg, 'rows': rows,
+    }
+    if screen.cursor_visible and not screen.scrolled_by:
+        cc = colors.get('cursor')
+        ans['cursor'] = {
+            'x': screen.cursor.x, 'y': screen.cursor.y, 'color': default_fg if cc is None else color_as_sharp(color_from_int(cc))}
+
+    placements = []
+    images: Dict[str, Dict[str, Any]] = {}
+    for p in screen.grman.placements():
+        # placements are relative to the top of the screen not the scrolled view
+        p['start_row'] += screen.scrolled_by
+        key = str(p['image_id'])
+        if key not in images:
+            img = screen.grman.image_for_internal_id(p['image_id'])
+            if img is None:
+                continue
+            data = img['data']
+            images[key] = {
+                'width': img['width'], 'height': img['height'],
+                'format': 24 if len(data) == 3 * img['width'] * img['height'] else 32,
+                'data': standard_b64encode(data).decode('ascii'),
+            }
+        placements.append(p)
+    if placements:
+        ans['placements'] = placements
+        ans['images'] = images
+    return ans
+
+
+class Screenshot(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    match/str: The window to take a screenshot of
+    self/bool: Boolean indicating whether to take a screenshot of the window the command is run in
+    '''
+
+    short_desc = 'Save a screenshot of a window as a PNG image'
+    desc = (
+        'Save an image of the contents of the specified window, with its text, colors and images, as a PNG file.'
+        ' The image is rendered by this program, rather than captured from the screen, so it does not need the'
+        ' window to be visible and works over SSH. Text is drawn with the Go Mono font, not the fonts configured'
+        ' in :file:`kitty.conf`, in a fixed cell size and images are scaled to match. Images displayed using'
+        ' Unicode placeholders are not drawn. If no window is specified, the active window is used.'
+    )
+    options_spec = MATCH_WINDOW_OPTION + '''\n
+--output -o
+default=screenshot.png
+completion=type:file ext:png kwds:-
+The PNG file to save the screenshot to. Use :code:`-` to write it to STDOUT.
+
+
+--self
+type=bool-set
+Take a screenshot of the window this command is run in, rather than the active window.
+'''
+    response_handler = 'save_screenshot(options_screenshot.Output)'
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        return {'match': opts.match, 'self': opts.self}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        windows = self.windows_for_match_payload(boss, window, payload_get)
+        if not windows or windows[0] is None:
+            raise MatchError(payload_get('match'))
+        return json.dumps(screenshot_data(windows[0]))
+
+
+screenshot = Screenshot()
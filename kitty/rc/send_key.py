@@ -0,0 +1,89 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+from typing import TYPE_CHECKING, List, Optional
+
+from kitty.fast_data_types import GLFW_MOD_SHIFT, GLFW_PRESS, GLFW_RELEASE
+from kitty.fast_data_types import KeyEvent as WindowSystemKeyEvent
+from kitty.options.utils import parse_shortcut
+
+from .base import MATCH_TAB_OPTION, MATCH_WINDOW_OPTION, ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import SendKeyRCOptions as CLIOptions
+
+
+class InvalidKey(ValueError):
+
+    hide_traceback = True
+
+
+def key_events_for(spec: str) -> List[WindowSystemKeyEvent]:
+    try:
+        sk = parse_shortcut(spec)
+    except Exception:
+        sk = None
+    if sk is None or not sk.key:
+        raise InvalidKey(f'{spec} is not a valid key')
+    shifted_key = 0
+    if sk.mods & GLFW_MOD_SHIFT and ord('a') <= sk.key <= ord('z'):
+        shifted_key = ord(chr(sk.key).upper())
+    return [
+        WindowSystemKeyEvent(key=sk.key, shifted_key=shifted_key, mods=sk.mods, action=action)
+        for action in (GLFW_PRESS, GLFW_RELEASE)]
+
+
+class SendKey(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    keys+/list.str: The keys to send, in the same format as keys in mappings in kitty.conf, for example: ctrl+shift+f5
+    match_window/str: Window to send the keys to
+    match_tab/str: Tab to send the keys to
+    all/bool: Boolean indicating send the keys to all windows
+    exclude_active/bool: Boolean indicating do not send the keys to the active window
+    '''
+
+    short_desc = 'Send key presses to the specified windows'
+    desc = (
+        'Send key presses to the programs running in the specified windows, as if the keys had been pressed'
+        ' by the user. The keys are specified using the same syntax as for mapping keys in :file:`kitty.conf`,'
+        ' for example: :code:`ctrl+shift+f5`, and are sent in order, each being pressed and then released. They are'
+        ' encoded according to the keyboard protocol in use by the program in each window, so you do not need to'
+        ' craft escape codes for :ref:`kitty @ send-text <at-send-text>`. Keyboard shortcuts defined in'
+        ' :file:`kitty.conf` are not triggered. For example::\n\n'
+        '    kitten @ send-key --match title:vim escape colon w enter'
+    )
+    options_spec = MATCH_WINDOW_OPTION + '\n\n' + MATCH_TAB_OPTION.replace('--match -m', '--match-tab -t') + '''\n
+--all
+type=bool-set
+Match all windows.
+
+
+--exclude-active
+type=bool-set
+Do not send the keys to the active window, even if it is one of the matched windows.
+'''
+    args = RemoteCommand.Args(spec='KEY ...', json_field='keys', minimum_count=1)
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        if not args:
+            self.fatal('Must specify at least one key to send')
+        return {
+            'keys': args, 'match_window': opts.match, 'match_tab': opts.match_tab,
+            'all': opts.all, 'exclude_active': opts.exclude_active,
+        }
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        events = [ev for spec in payload_get('keys') or () for ev in key_events_for(spec)]
+        windows = self.windows_for_payload(boss, None, payload_get)
+        if payload_get('exclude_active'):
+            windows = [w for w in windows if w is not boss.active_window]
+        for w in windows:
+            if w is not None:
+                data = b''.join(w.encoded_key(ev) for ev in events)
+                if data:
+                    w.write_to_child(data)
+        return None
+
+
+send_key = SendKey()
@@ -176,7 +176,7 @@ def chain() -> CmdGenerator:
                 yield from src
         return chain()
 
-    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+    def windows_to_send_to(self, boss: Boss, payload_get: PayloadGetType) -> List[Window]:
         sid = payload_get('session_id', '')
         if payload_get('all'):
             windows: List[Optional[Window]] = list(boss.all_windows)
@@ -196,6 +196,15 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
                 for tab in tabs:
                     if tab:
                         windows += tuple(tab)
+        exclude_active = payload_get('exclude_active')
+        return [w for w in windows if w is not None and (not exclude_active or w is not boss.active_window)]
+
+    def windows_acted_on(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> Optional[List[Window]]:
+        return self.windows_to_send_to(boss, payload_get)
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        sid = payload_get('session_id', '')
+        actual_windows = self.windows_to_send_to(boss, payload_get)
         pdata: str = payload_get('data')
         encoding, _, q = pdata.partition(':')
         session = ''
@@ -213,8 +222,6 @@ def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get:
             session = q
         else:
             raise TypeError(f'Invalid encoding for send-text data: {encoding}')
-        exclude_active = payload_get('exclude_active')
-        actual_windows = (w for w in windows if w is not None and (not exclude_active or w is not boss.active_window))
 
         def create_or_update_session() -> Session:
             s = sessions_map.setdefault(sid, Session(sid))
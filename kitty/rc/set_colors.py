@@ -3,11 +3,12 @@
 
 
 import os
+import secrets
 from typing import TYPE_CHECKING, Dict, Iterable, Optional
 
 from kitty.cli import emph
 from kitty.config import parse_config
-from kitty.fast_data_types import Color, patch_color_profiles
+from kitty.fast_data_types import Color, get_options, patch_color_profiles
 
 from .base import (
     MATCH_TAB_OPTION,
@@ -42,7 +43,7 @@
 )
 
 
-def parse_colors(args: Iterable[str]) -> Dict[str, Optional[int]]:
+def parse_colors(args: Iterable[str], diff_against: str = '') -> Dict[str, Optional[int]]:
     colors: Dict[str, Optional[Color]] = {}
     nullable_color_map: Dict[str, Optional[int]] = {}
     for spec in args:
@@ -58,9 +59,57 @@ def parse_colors(args: Iterable[str]) -> Dict[str, Optional[int]]:
             nullable_color_map[k] = val
     ans: Dict[str, Optional[int]] = {k: int(v) for k, v in colors.items() if isinstance(v, Color)}
     ans.update(nullable_color_map)
+    if diff_against:
+        base = parse_colors((diff_against,))
+        ans = {k: v for k, v in ans.items() if k not in base or base[k] != v}
     return ans
 
 
+# Maps rollback tokens to the colors that were changed in every window, so they
+# can be restored. Only the most recent tokens are kept.
+rollbacks: Dict[str, Dict[int, Dict[str, Optional[int]]]] = {}
+MAX_ROLLBACKS = 64
+
+
+def colors_before_change(window: Window, keys: Iterable[str]) -> Dict[str, Optional[int]]:
+    opts = get_options()
+    current = window.current_colors
+    if 'cursor_text' in current:
+        current['cursor_text_color'] = current.pop('cursor_text')
+    tab = window.tabref()
+    tm = None if tab is None else tab.tab_manager_ref()
+    if tm is not None:
+        current.update({k: int(v) for k, v in tm.tab_bar.current_colors.items()})
+    ans: Dict[str, Optional[int]] = {}
+    for k in keys:
+        if k in current:
+            ans[k] = current[k]
+        else:
+            q = getattr(opts, k, False)
+            if isinstance(q, Color):
+                ans[k] = int(q)
+            elif q is None and k in nullable_colors:
+                ans[k] = None
+    return ans
+
+
+def apply_colors(boss: Boss, windows: Iterable[Optional[Window]], colors: Dict[str, Optional[int]], configured: bool = False) -> None:
+    windows = tuple(w for w in windows if w)
+    profiles = tuple(w.screen.color_profile for w in windows)
+    patch_color_profiles(colors, profiles, configured)
+    boss.patch_colors(colors, configured)
+    default_bg_changed = 'background' in colors
+    for w in windows:
+        if default_bg_changed:
+            boss.default_bg_changed_for(w.id)
+        w.refresh()
+
+
+class UnknownRollbackToken(ValueError):
+
+    hide_traceback = True
+
+
 class SetColors(RemoteCommand):
 
     protocol_spec = __doc__ = '''
@@ -70,6 +119,9 @@ class SetColors(RemoteCommand):
     all/bool: Boolean indicating change colors everywhere or not
     configured/bool: Boolean indicating whether to change the configured colors. Must be True if reset is True
     reset/bool: Boolean indicating colors should be reset to startup values
+    rollback_token/bool: Boolean indicating whether to respond with a token that can be used to restore the changed colors
+    rollback/str: A token from a previous set-colors command. The colors that command changed are restored in the windows\
+        it changed them in and all other fields are ignored
     '''
 
     short_desc = 'Set terminal colors'
@@ -78,7 +130,14 @@ class SetColors(RemoteCommand):
         ' You can either specify the path to a conf file'
         ' (in the same format as :file:`kitty.conf`) to read the colors from or you can specify individual colors,'
         ' for example::\n\n'
-        '    kitty @ set-colors foreground=red background=white'
+        '    kitty @ set-colors foreground=red background=white\n\n'
+        'To change only the colors that are different from the current ones, use'
+        ' :option:`kitty @ set-colors --diff-against`. To be able to undo the change, use'
+        ' :option:`kitty @ set-colors --rollback-token` and later :option:`kitty @ set-colors --rollback`.'
+        ' For example, to toggle a theme::\n\n'
+        '    kitty @ get-colors > current.conf\n'
+        '    token=$(kitty @ set-colors --rollback-token --diff-against current.conf dark.conf)\n'
+        '    kitty @ set-colors --rollback $token'
     )
     options_spec = '''\
 --all -a
@@ -97,15 +156,34 @@ class SetColors(RemoteCommand):
 type=bool-set
 Restore all colors to the values they had at kitty startup. Note that if you specify
 this option, any color arguments are ignored and :option:`kitty @ set-colors --configured` and :option:`kitty @ set-colors --all` are implied.
+
+
+--diff-against
+completion=type:file ext:conf group:"CONF files"
+Path to a conf file with colors, such as the output of :ref:`kitty @ get-colors <at-get-colors>`.
+Only the colors that are different from the colors in this file are changed.
+
+
+--rollback-token
+type=bool-set
+Print out a token that can be used with :option:`kitty @ set-colors --rollback` to restore
+the colors that were changed in every window to their previous values. Only the most
+recent tokens are remembered.
+
+
+--rollback
+Restore the colors changed by the set-colors command that printed the specified token,
+in the windows they were changed in. Any color arguments and other options are ignored.
+Note that changes to the configured colors are not restored.
 ''' + '\n\n' + MATCH_WINDOW_OPTION + '\n\n' + MATCH_TAB_OPTION.replace('--match -m', '--match-tab -t')
-    args = RemoteCommand.Args(spec='COLOR_OR_FILE ...', json_field='colors', special_parse='parse_colors_and_files(args)',
+    args = RemoteCommand.Args(spec='COLOR_OR_FILE ...', json_field='colors', special_parse='parse_colors_and_files(args, options_set_colors.DiffAgainst)',
                               completion=RemoteCommand.CompletionSpec.from_string('type:file group:"CONF files", ext:conf'))
 
     def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
         final_colors: Dict[str, Optional[int]] = {}
-        if not opts.reset:
+        if not opts.reset and not opts.rollback:
             try:
-                final_colors = parse_colors(args)
+                final_colors = parse_colors(args, opts.diff_against or '')
             except FileNotFoundError as err:
                 raise ParsingOfArgsFailed(f'The colors configuration file {emph(err.filename)} was not found.') from err
             except Exception as err:
@@ -113,26 +191,33 @@ def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: Arg
         ans = {
             'match_window': opts.match, 'match_tab': opts.match_tab,
             'all': opts.all or opts.reset, 'configured': opts.configured or opts.reset,
-            'colors': final_colors, 'reset': opts.reset,
+            'colors': final_colors, 'reset': opts.reset, 'rollback_token': opts.rollback_token, 'rollback': opts.rollback,
         }
         return ans
 
     def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        if payload_get('rollback'):
+            saved = rollbacks.pop(payload_get('rollback'), None)
+            if saved is None:
+                raise UnknownRollbackToken(f'No colors to restore for the rollback token: {payload_get("rollback")}')
+            for window_id, colors in saved.items():
+                w = boss.window_id_map.get(window_id)
+                if w is not None:
+                    apply_colors(boss, (w,), colors)
+            return None
         windows = self.windows_for_payload(boss, window, payload_get)
         colors: Dict[str, Optional[int]] = payload_get('colors')
         if payload_get('reset'):
             colors = {k: int(v) for k, v in boss.startup_colors.items()}
             colors['cursor_text_color'] = None if boss.startup_cursor_text_color is None else int(boss.startup_cursor_text_color)
-        profiles = tuple(w.screen.color_profile for w in windows if w)
-        patch_color_profiles(colors, profiles, payload_get('configured'))
-        boss.patch_colors(colors, payload_get('configured'))
-        default_bg_changed = 'background' in colors
-        for w in windows:
-            if w:
-                if default_bg_changed:
-                    boss.default_bg_changed_for(w.id)
-                w.refresh()
-        return None
+        token = ''
+        if payload_get('rollback_token'):
+            token = secrets.token_hex(8)
+            rollbacks[token] = {w.id: colors_before_change(w, colors) for w in windows if w}
+            while len(rollbacks) > MAX_ROLLBACKS:
+                del rollbacks[next(iter(rollbacks))]
+        apply_colors(boss, windows, colors, payload_get('configured'))
+        return token or None
 
 
 set_colors = SetColors()
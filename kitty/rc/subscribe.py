@@ -0,0 +1,90 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+import json
+from typing import TYPE_CHECKING, Any, Dict, List, Optional
+
+from kitty.types import AsyncResponse
+
+from .base import MATCH_WINDOW_OPTION, ArgsType, Boss, PayloadGetType, PayloadType, RCOptions, RemoteCommand, ResponseType, Window
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import SubscribeRCOptions as CLIOptions
+
+
+all_events = frozenset({'focus', 'resize', 'title', 'child-exited'})
+
+
+class UnknownEvent(ValueError):
+
+    hide_traceback = True
+
+
+class Subscribe(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    events/str: Comma separated list of the events to report, all events if empty
+    match/str: Only report events in the windows matching this expression, all windows if empty
+    '''
+
+    short_desc = 'Report events in windows as they happen'
+    desc = (
+        'Keep running, printing a line of JSON for every event in the windows, until interrupted.'
+        ' Every line is an object with the keys: :code:`event`, :code:`window_id`, :code:`tab_id` and'
+        ' :code:`os_window_id` and keys specific to the event. These are :code:`focused` for the :code:`focus` event,'
+        ' :code:`columns` and :code:`lines` for the :code:`resize` event and :code:`title` for the :code:`title` event.'
+        ' The :code:`child-exited` event is reported when the program running in a window exits and the window is closed.'
+        ' Events for all windows are reported, unless :option:`--match` is used.'
+    )
+    options_spec = '''\
+--events
+default=focus,resize,title,child-exited
+Comma separated list of the events to report. The supported events are:
+:code:`focus`, :code:`resize`, :code:`title` and :code:`child-exited`.
+''' + '\n\n' + MATCH_WINDOW_OPTION
+    streams_responses = True
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        return {'events': opts.events, 'match': opts.match}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        from kitty.window import global_event_listeners
+        events = frozenset(filter(None, (x.strip() for x in (payload_get('events') or '').split(',')))) or all_events
+        unknown = events - all_events
+        if unknown:
+            raise UnknownEvent(f'Unknown events: {", ".join(sorted(unknown))}')
+        async_id = payload_get('async_id')
+        if not async_id:
+            raise ValueError('The subscribe command must be sent asynchronously, upgrade the kitty client')
+        match = payload_get('match') or ''
+        if match:
+            # raise any errors in the match expression immediately
+            tuple(boss.match_windows(match, window))
+        self_window_id = getattr(window, 'id', 0)
+        responder = self.create_async_responder(payload_get, window)
+
+        def on_event(w: Window, event: str, data: Dict[str, Any]) -> None:
+            if event not in events:
+                return
+            if match:
+                self_window = boss.window_id_map.get(self_window_id)
+                if w not in tuple(boss.match_windows(match, self_window)):
+                    return
+            ev = {'event': event, 'window_id': w.id, 'tab_id': w.tab_id, 'os_window_id': w.os_window_id}
+            ev.update(data)
+            if not responder.send_data(json.dumps(ev) + '\n', more=True):
+                global_event_listeners.pop(async_id, None)
+
+        global_event_listeners[async_id] = on_event
+        return AsyncResponse()
+
+    def windows_acted_on(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> Optional[List[Window]]:
+        match = payload_get('match')
+        return list(boss.match_windows(match, window) if match else boss.all_windows)
+
+    def cancel_async_request(self, boss: 'Boss', window: Optional['Window'], payload_get: PayloadGetType) -> None:
+        from kitty.window import global_event_listeners
+        global_event_listeners.pop(payload_get('async_id'), None)
+
+
+subscribe = Subscribe()
@@ -0,0 +1,159 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+# Remote control commands provided by other programs. They are registered by
+# writing a description of the command to the rc-commands directory in the
+# kitty config directory, see tools/cmd/at/extensions.go. The commands are
+# forwarded to the socket the program listens on and the response from the
+# program is sent back to the client.
+
+import json
+import os
+import re
+import socket
+from time import monotonic
+from typing import Any, Dict, Optional
+
+from .constants import config_dir
+from .fast_data_types import add_timer, remove_timer
+from .rc.base import AsyncResponder, Boss, PayloadGetType, RemoteCommand, ResponseType, Window
+from .types import AsyncResponse
+from .utils import log_error, parse_address_spec
+
+valid_name = re.compile(r'^[a-z][a-z0-9-]*$')
+response_pat = re.compile(br'\x1bP@kitty-cmd(.+?)\x1b\\', re.DOTALL)
+MAX_RESPONSE_SIZE = 64 * 1024 * 1024
+
+
+class ExtensionError(ValueError):
+
+    hide_traceback = True
+
+
+class ForwardedRequest:
+
+    def __init__(self, cmd_name: str, address: str, data: bytes, responder: AsyncResponder, timeout: float):
+        self.cmd_name, self.responder = cmd_name, responder
+        self.to_send, self.received = data, b''
+        self.deadline = monotonic() + timeout
+        family, addr = parse_address_spec(address)[:2]
+        self.sock = socket.socket(family)
+        self.sock.setblocking(False)
+        try:
+            self.sock.connect(addr)
+        except BlockingIOError:
+            pass  # the connection will complete in the background
+        except OSError:
+            self.sock.close()
+            raise
+        self.timer_id: Optional[int] = add_timer(self.on_timer, 0.02, True)
+
+    def close(self) -> None:
+        if self.timer_id is not None:
+            remove_timer(self.timer_id)
+            self.timer_id = None
+        self.sock.close()
+        forwarded_requests.pop(self.responder.async_id, None)
+
+    def finish(self, data: Any = None, error: str = '') -> None:
+        self.close()
+        if error:
+            self.responder.send_error(error)
+        else:
+            self.responder.send_data(data)
+
+    def handle_response(self, raw: bytes) -> None:
+        try:
+            response = json.loads(raw)
+        except Exception as e:
+            self.finish(error=f'Invalid response from the program providing the {self.cmd_name} command: {e}')
+            return
+        if not isinstance(response, dict):
+            self.finish(error=f'Invalid response from the program providing the {self.cmd_name} command')
+        elif response.get('ok'):
+            self.finish(response.get('data'))
+        else:
+            self.finish(error=str(response.get('error') or f'The {self.cmd_name} command failed'))
+
+    def on_timer(self, timer_id: Optional[int]) -> None:
+        if monotonic() > self.deadline:
+            self.finish(error=f'Timed out waiting for a response from the program providing the {self.cmd_name} command')
+            return
+        try:
+            while self.to_send:
+                n = self.sock.send(self.to_send)
+                self.to_send = self.to_send[n:]
+                if not self.to_send:
+                    self.sock.shutdown(socket.SHUT_WR)
+            while True:
+                data = self.sock.recv(64 * 1024)
+                if not data:
+                    break
+                self.received += data
+                if len(self.received) > MAX_RESPONSE_SIZE:
+                    self.finish(error=f'The response from the program providing the {self.cmd_name} command is too large')
+                    return
+                m = response_pat.search(self.received)
+                if m is not None:
+                    self.handle_response(m.group(1))
+                    return
+        except BlockingIOError:
+            return
+        except OSError as e:
+            self.finish(error=f'Failed to communicate with the program providing the {self.cmd_name} command: {e}')
+            return
+        self.finish(error=f'The program providing the {self.cmd_name} command closed the connection without responding')
+
+
+forwarded_requests: Dict[str, ForwardedRequest] = {}
+
+
+class ExtensionCommand(RemoteCommand):
+
+    is_asynchronous = True
+
+    def __init__(self, name: str, spec: Dict[str, Any]):
+        super().__init__()
+        self.name = name
+        self.short_desc = str(spec.get('short_description') or '')
+        self.desc = str(spec.get('help_text') or self.short_desc)
+        self.listen_on = str(spec['listen_on'])
+        self.response_timeout = float(spec.get('response_timeout') or self.response_timeout)
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        from .remote_control import encode_send
+        responder = self.create_async_responder(payload_get, window)
+        if not responder.async_id:
+            raise ExtensionError(f'The {self.name} command must be sent with an async id')
+        data = encode_send({
+            'cmd': self.name, 'kitty_window_id': getattr(window, 'id', 0),
+            'payload': {'options': payload_get('options') or {}, 'args': payload_get('args') or []},
+        })
+        try:
+            forwarded_requests[responder.async_id] = ForwardedRequest(self.name, self.listen_on, data, responder, self.response_timeout)
+        except Exception as e:
+            raise ExtensionError(f'Could not connect to the program providing the {self.name} command at {self.listen_on}: {e}')
+        return AsyncResponse()
+
+    def cancel_async_request(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> None:
+        r = forwarded_requests.get(payload_get('async_id') or '')
+        if r is not None:
+            r.close()
+
+
+def extension_command(name: str) -> Optional[ExtensionCommand]:
+    if not valid_name.match(name):
+        return None
+    path = os.path.join(config_dir, 'rc-commands', f'{name}.json')
+    try:
+        with open(path) as f:
+            spec = json.load(f)
+    except FileNotFoundError:
+        return None
+    except Exception as e:
+        log_error(f'Ignoring invalid remote control command description in {path} with error: {e}')
+        return None
+    if not isinstance(spec, dict) or spec.get('name') != name or not isinstance(spec.get('listen_on'), str):
+        log_error(f'Ignoring invalid remote control command description in {path}')
+        return None
+    return ExtensionCommand(name, spec)
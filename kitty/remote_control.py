@@ -6,19 +6,24 @@
 import os
 import re
 import sys
+from collections import deque
 from contextlib import suppress
+from datetime import datetime
 from functools import lru_cache, partial
 from time import monotonic, time_ns
 from types import GeneratorType
 from typing import (
     TYPE_CHECKING,
     Any,
+    Deque,
     Dict,
     FrozenSet,
     Iterable,
     Iterator,
     List,
+    NamedTuple,
     Optional,
+    Set,
     Tuple,
     Union,
     cast,
@@ -41,8 +46,30 @@
 from .typing import BossType, WindowType
 from .utils import TTYIO, log_error, parse_address_spec, resolve_custom_file
 
-active_async_requests: Dict[str, float] = {}
+
+
+class RCClient(NamedTuple):
+    # window:ID for requests sent via the TTY of a window, uid:UID for
+    # requests sent over a UNIX socket, tls for requests forwarded by the
+    # remote_control_tls_listen_on listener and tcp for requests sent over TCP
+    name: str
+    pid: int = -1
+
+
+class ActiveAsyncRequest(NamedTuple):
+    started_at: float
+    cmd_name: str
+    window_id: int
+    payload: Dict[str, Any]
+    compression: str = ''
+
+
+active_async_requests: Dict[str, ActiveAsyncRequest] = {}
+# async requests that send multiple responses, these are never pruned
+streaming_async_requests: Set[str] = set()
 active_streams: Dict[str, str] = {}
+# times of the recent requests of every client, for remote_control_rate_limit
+recent_requests: Dict[str, Deque[float]] = {}
 if TYPE_CHECKING:
     from .window import Window
 
@@ -51,6 +78,51 @@ def encode_response_for_peer(response: Any) -> bytes:
     return b'\x1bP@kitty-cmd' + json.dumps(response).encode('utf-8') + b'\x1b\\'
 
 
+# Payloads and responses larger than this are compressed
+COMPRESSION_THRESHOLD = 16 * 1024
+MAX_DECOMPRESSED_PAYLOAD_SIZE = 256 * 1024 * 1024
+
+
+def decompress_payload(payload: str, compression: str) -> Any:
+    # clients compress large payloads with zlib, once kitty has advertised
+    # that it accepts them, see compress_response()
+    import zlib
+    if compression != 'zlib':
+        raise ValueError(f'Unsupported payload compression: {compression}')
+    d = zlib.decompressobj()
+    data = d.decompress(base64.standard_b64decode(payload), MAX_DECOMPRESSED_PAYLOAD_SIZE)
+    if d.unconsumed_tail:
+        raise ValueError('Decompressed payload is too large')
+    return json.loads(data)
+
+
+def compress_response(response: Dict[str, Any], accepted_compressions: str) -> Dict[str, Any]:
+    # compress large response data with the best algorithm the client accepts
+    if not accepted_compressions:
+        return response
+    # clients that accept compression also compress large payloads, but only
+    # once they know kitty accepts them
+    response = {**response, 'accepts_payload_compression': 'zlib'}
+    if 'data' not in response:
+        return response
+    from kittens.transfer.utils import ZlibCompressor, ZstdCompressor, has_zstd
+    accepted = accepted_compressions.split(',')
+    c: Union[ZlibCompressor, ZstdCompressor]
+    if 'zstd' in accepted and has_zstd():
+        c, name = ZstdCompressor(), 'zstd'
+    elif 'zlib' in accepted:
+        c, name = ZlibCompressor(), 'zlib'
+    else:
+        return response
+    data = json.dumps(response['data']).encode('utf-8')
+    if len(data) < COMPRESSION_THRESHOLD:
+        return response
+    compressed = c.compress(data) + c.flush()
+    if len(compressed) >= len(data):
+        return response
+    return {**response, 'data': base64.standard_b64encode(compressed).decode('ascii'), 'compressed': name}
+
+
 def parse_cmd(serialized_cmd: str, encryption_key: EllipticCurveKey) -> Dict[str, Any]:
     try:
         pcmd = json.loads(serialized_cmd)
@@ -77,6 +149,9 @@ def parse_cmd(serialized_cmd: str, encryption_key: EllipticCurveKey) -> Dict[str
                 f'Ignoring encrypted rc command with timestamp {delta / 1e9:.1f} seconds from now.'
                 ' Could be an attempt at a replay attack or an incorrect clock on a remote machine.')
             return {}
+    compression = pcmd.pop('payload_compression', '')
+    if compression:
+        pcmd['payload'] = decompress_payload(pcmd.get('payload') or '', compression)
     return pcmd
 
 
@@ -104,18 +179,39 @@ def fnmatch_pattern(pat: str) -> 're.Pattern[str]':
     return re.compile(translate(pat))
 
 
+def cmd_acts_only_on_matching_windows(pcmd: Dict[str, Any], window: Optional['Window'], match: str) -> bool:
+    boss = get_boss()
+    self_window = window
+    if self_window is None:
+        with suppress(Exception):
+            self_window = boss.window_id_map.get(int(pcmd.get('kitty_window_id', 0)))
+    try:
+        c = command_for_name(pcmd['cmd'])
+        windows = c.windows_acted_on(boss, self_window, PayloadGetter(c, pcmd.get('payload') or {}))
+        if windows is None:
+            return False
+        allowed = frozenset(w.id for w in boss.match_windows(match, self_window))
+    except Exception:
+        return False
+    return all(w.id in allowed for w in windows)
+
+
 class PasswordAuthorizer:
 
     def __init__(self, auth_items: FrozenSet[str]) -> None:
-        self.command_patterns = []
+        # pairs of command name pattern and an expression the windows the
+        # command acts on must match, if any
+        self.command_patterns: List[Tuple['re.Pattern[str]', str]] = []
         self.function_checkers = []
         self.name = ''
         for item in auth_items:
+            # checked first as paths to checkers can contain colons
             if item.endswith('.py'):
                 path = os.path.abspath(resolve_custom_file(item))
                 self.function_checkers.append(is_cmd_allowed_loader(path))
-            else:
-                self.command_patterns.append(fnmatch_pattern(item))
+                continue
+            pat, _, match = item.partition(':')
+            self.command_patterns.append((fnmatch_pattern(pat), match))
 
     def is_cmd_allowed(self, pcmd: Dict[str, Any], window: Optional['Window'], from_socket: bool, extra_data: Dict[str, Any]) -> bool:
         cmd_name = pcmd.get('cmd')
@@ -123,8 +219,15 @@ def is_cmd_allowed(self, pcmd: Dict[str, Any], window: Optional['Window'], from_
             return False
         if not self.function_checkers and not self.command_patterns:
             return True
-        for x in self.command_patterns:
-            if x.match(cmd_name) is not None:
+        if cmd_name == 'batch':
+            # a batch is allowed only if every command in it is allowed
+            commands = (pcmd.get('payload') or {}).get('commands') or ()
+            return bool(commands) and all(
+                isinstance(x, dict) and x.get('cmd') not in (None, 'batch') and self.is_cmd_allowed(
+                    {**x, 'password': pcmd.get('password', ''), 'kitty_window_id': pcmd.get('kitty_window_id', 0)},
+                    window, from_socket, extra_data) for x in commands)
+        for x, match in self.command_patterns:
+            if x.match(cmd_name) is not None and (not match or cmd_acts_only_on_matching_windows(pcmd, window, match)):
                 return True
         for f in self.function_checkers:
             try:
@@ -183,8 +286,53 @@ def close_active_stream(stream_id: str) -> None:
     active_streams.pop(stream_id, None)
 
 
+def is_rate_limited(pcmd: Dict[str, Any], key: str) -> bool:
+    limit = get_options().remote_control_rate_limit
+    if limit is None:
+        return False
+    sid = pcmd.get('stream_id', '')
+    if (sid and active_streams.get(sid, '') == pcmd['cmd']) or 'cancel_async' in pcmd:
+        return False
+    max_requests, interval = limit
+    now = monotonic()
+    q = recent_requests.get(key)
+    if q is None or q.maxlen != max_requests:
+        q = recent_requests[key] = deque(maxlen=max_requests)
+    if len(q) == max_requests and now - q[0] < interval:
+        return True
+    q.append(now)
+    if len(recent_requests) > 256:
+        for name in tuple(recent_requests):
+            if now - recent_requests[name][-1] > interval:
+                del recent_requests[name]
+    return False
+
+
+def audit_remote_command(pcmd: Dict[str, Any], client: RCClient, result: str, error: str = '') -> None:
+    path = get_options().remote_control_audit_log
+    if not path:
+        return
+    entry: Dict[str, Any] = {'time': datetime.now().astimezone().isoformat(timespec='milliseconds'), 'cmd': pcmd.get('cmd', ''), 'client': client.name}
+    if client.pid > 0:
+        entry['pid'] = client.pid
+    payload = pcmd.get('payload')
+    if isinstance(payload, dict):
+        match = {k: v for k, v in payload.items() if k.startswith('match') and v}
+        if match:
+            entry['match'] = match
+    entry['result'] = result
+    if error:
+        entry['error'] = error
+    try:
+        with open(path, 'a') as f:
+            print(json.dumps(entry), file=f)
+    except OSError as err:
+        log_error(f'Failed to write to the remote control audit log at {path} with error: {err}')
+
+
 def handle_cmd(
-    boss: BossType, window: Optional[WindowType], cmd: Dict[str, Any], peer_id: int, self_window: Optional[WindowType]
+    boss: BossType, window: Optional[WindowType], cmd: Dict[str, Any], peer_id: int, self_window: Optional[WindowType],
+    received_fds: Tuple[int, ...] = (),
 ) -> Union[Dict[str, Any], None, AsyncResponse]:
     v = cmd['version']
     no_response = cmd.get('no_response', False)
@@ -195,6 +343,8 @@ def handle_cmd(
     c = command_for_name(cmd['cmd'])
     payload = cmd.get('payload') or {}
     payload['peer_id'] = peer_id
+    # file descriptors passed with the message over a UNIX socket, owned by the caller
+    payload['received_fds'] = received_fds
     async_id = str(cmd.get('async', ''))
     stream_id = str(cmd.get('stream_id', ''))
     stream = bool(cmd.get('stream', False))
@@ -210,12 +360,14 @@ def handle_cmd(
         payload['async_id'] = async_id
         if 'cancel_async' in cmd:
             active_async_requests.pop(async_id, None)
+            streaming_async_requests.discard(async_id)
             c.cancel_async_request(boss, self_window or window, PayloadGetter(c, payload))
             return None
-        active_async_requests[async_id] = monotonic()
+        active_async_requests[async_id] = ActiveAsyncRequest(
+            monotonic(), c.name, getattr(self_window or window, 'id', 0), payload, str(cmd.get('compression', '')))
         if len(active_async_requests) > 32:
-            oldest = next(iter(active_async_requests))
-            del active_async_requests[oldest]
+            oldest = next((x for x in active_async_requests if x not in streaming_async_requests), '')
+            active_async_requests.pop(oldest, None)
     try:
         ans = c.response_from_kitty(boss, self_window or window, PayloadGetter(c, payload))
     except Exception:
@@ -232,7 +384,7 @@ def handle_cmd(
     if ans is not None:
         response['data'] = ans
     if not no_response:
-        return response
+        return compress_response(response, str(cmd.get('compression', '')))
     return None
 
 
@@ -243,7 +395,9 @@ def handle_cmd(
 :opt:`listen_on` setting in :file:`kitty.conf`. If not specified, the
 environment variable :envvar:`KITTY_LISTEN_ON` is checked. If that is also not
 found, messages are sent to the controlling terminal for this process, i.e.
-they will only work if this process is run within a kitty window.
+they will only work if this process is run within a kitty window. Addresses of
+the form :code:`tls:host:port` connect to the TLS listener of kitty, see
+:opt:`remote_control_tls_listen_on`.
 
 
 --password
@@ -274,6 +428,35 @@ def handle_cmd(
 If no password is available, kitty will usually just send the remote control command
 without a password. This option can be used to force it to :code:`always` or :code:`never` use
 the supplied password.
+
+
+--tls-certificate
+completion=type:file ext:pem
+A PEM file containing the certificate and private key with which to authenticate
+to kitty when connecting to an address of the form :code:`tls:host:port`. Needed
+when kitty is configured with :opt:`remote_control_tls_client_ca`.
+
+
+--tls-ca
+completion=type:file ext:pem
+A PEM file containing the certificates of the authorities with which to verify
+the certificate of kitty when connecting to an address of the form :code:`tls:host:port`.
+Defaults to the certificate authorities of the system.
+
+
+--async-id
+The id to use for commands that keep running in kitty while waiting for a
+response, such as :ref:`select-window <at-select-window>`. By default, a random
+id is used. Specifying it allows the command to be aborted from another program
+by running :code:`kitten @ cancel ID`, so that scripts do not wait forever.
+
+
+--describe-commands
+type=bool-set
+Print out a JSON description of all the commands, their options and the
+remote control protocol messages they use, instead of running any command.
+Useful to generate clients for the :doc:`remote control protocol <rc_protocol>`
+in other languages.
 '''.format, appname=appname)
 
 
@@ -435,19 +618,55 @@ def create_basic_command(name: str, payload: Any = None, no_response: bool = Fal
     return ans
 
 
-def send_response_to_client(data: Any = None, error: str = '', peer_id: int = 0, window_id: int = 0, async_id: str = '') -> None:
-    if active_async_requests.pop(async_id, None) is None:
-        return
+def send_response_to_client(
+    data: Any = None, error: str = '', peer_id: int = 0, window_id: int = 0, async_id: str = '', more: bool = False
+) -> bool:
+    ''' Send the response to an async request. When more is True, the request
+    stays active so that further responses can be sent for it. Returns False
+    if the client is no longer waiting for responses. '''
+    if more:
+        r = active_async_requests.get(async_id)
+        if r is None:
+            return False
+        streaming_async_requests.add(async_id)
+    else:
+        streaming_async_requests.discard(async_id)
+        r = active_async_requests.pop(async_id, None)
+        if r is None:
+            return False
     if error:
-        response: Dict[str, Union[bool, int, str]] = {'ok': False, 'error': error}
+        response: Dict[str, Any] = {'ok': False, 'error': error}
     else:
-        response = {'ok': True, 'data': data}
+        response = compress_response({'ok': True, 'data': data}, r.compression)
+    if more:
+        response['more'] = True
+    sent = False
     if peer_id > 0:
-        send_data_to_peer(peer_id, encode_response_for_peer(response))
+        sent = send_data_to_peer(peer_id, encode_response_for_peer(response))
     elif window_id > 0:
-        w = get_boss().window_id_map[window_id]
+        w = get_boss().window_id_map.get(window_id)
         if w is not None:
             w.send_cmd_response(response)
+            sent = True
+    if not sent and more:
+        # the client has gone away, stop streaming responses to it
+        streaming_async_requests.discard(async_id)
+        active_async_requests.pop(async_id, None)
+    return sent
+
+
+def cancel_async_request(boss: BossType, async_id: str) -> bool:
+    ''' Cancel the async request with the specified id, sending an error
+    response to the client waiting for it. Returns False if no such request
+    is active. '''
+    r = active_async_requests.get(async_id)
+    if r is None:
+        return False
+    c = command_for_name(r.cmd_name)
+    c.cancel_async_request(boss, boss.window_id_map.get(r.window_id), PayloadGetter(c, r.payload))
+    # this is a no-op if cancelling caused the command to send its response
+    send_response_to_client(error='Cancelled', peer_id=r.payload.get('peer_id', 0), window_id=r.window_id, async_id=async_id)
+    return True
 
 
 def get_password(opts: RCOptions) -> str:
@@ -3287,6 +3287,25 @@ cmd_output(Screen *self, PyObject *args) {
     Py_RETURN_FALSE;
 }
 
+static PyObject*
+lines_as_text(Screen *self, PyObject *args) {
+    // lines are numbered from the oldest line in the scrollback, through
+    // the lines of the main screen
+    unsigned int first = 0, num = 0;
+    DECREF_AFTER_FUNCTION PyObject *range_args = PyTuple_GetSlice(args, 0, 2);
+    DECREF_AFTER_FUNCTION PyObject *as_text_args = PyTuple_GetSlice(args, 2, PyTuple_GET_SIZE(args));
+    if (!range_args || !as_text_args) return NULL;
+    if (!PyArg_ParseTuple(range_args, "II", &first, &num)) return NULL;
+    const unsigned int total = self->historybuf->count + self->lines;
+    if (first >= total || !num) Py_RETURN_NONE;
+    OutputOffset oo = {.screen=self, .start=(int)first - (int)self->historybuf->count, .num_lines=MIN(num, total - first)};
+    LineBuf *original = self->linebuf;
+    self->linebuf = self->main_linebuf;
+    PyObject *ans = as_text_generic(as_text_args, &oo, get_line_from_offset, oo.num_lines, &self->as_ansi_buf, false);
+    self->linebuf = original;
+    return ans;
+}
+
 bool
 screen_set_last_visited_prompt(Screen *self, index_type y) {
     if (y >= self->lines) return false;
@@ -4388,6 +4407,7 @@ static PyMethodDef methods[] = {
     MND(as_text_for_history_buf, METH_VARARGS)
     MND(as_text_alternate, METH_VARARGS)
     MND(cmd_output, METH_VARARGS)
+    MND(lines_as_text, METH_VARARGS)
     MND(tab, METH_NOARGS)
     MND(backspace, METH_NOARGS)
     MND(linefeed, METH_NOARGS)
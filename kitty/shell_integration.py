@@ -2,6 +2,7 @@
 # License: GPLv3 Copyright: 2021, Kovid Goyal <kovid at kovidgoyal.net>
 
 
+import json
 import os
 import subprocess
 from contextlib import suppress
@@ -24,6 +25,30 @@ def setup_fish_env(env: Dict[str, str], argv: List[str]) -> None:
         env['XDG_DATA_DIRS'] = os.pathsep.join(dirs)
 
 
+def setup_nu_env(env: Dict[str, str], argv: List[str]) -> None:
+    # nushell loads vendor autoload scripts from XDG_DATA_DIRS/nushell/vendor/autoload
+    val = env.get('XDG_DATA_DIRS')
+    env['KITTY_NU_XDG_DATA_DIR'] = shell_integration_dir
+    dirs = list(filter(None, (val or '').split(os.pathsep)))
+    dirs.insert(0, shell_integration_dir)
+    env['XDG_DATA_DIRS'] = os.pathsep.join(dirs)
+
+
+def setup_xonsh_env(env: Dict[str, str], argv: List[str]) -> None:
+    # xonsh runs the scripts in XONSHRC_DIR after the rc files
+    rc_dir = os.path.join(shell_integration_dir, 'xonsh')
+    if 'XONSHRC_DIR' in env:
+        env['KITTY_XONSH_ORIG_XONSHRC_DIR'] = val = env['XONSHRC_DIR']
+        dirs = list(filter(None, val.split(os.pathsep)))
+    else:
+        # the default value used by xonsh
+        xdg_config_home = env.get('XDG_CONFIG_HOME') or os.path.join(env.get('HOME') or os.path.expanduser('~'), '.config')
+        dirs = ['/etc/xonsh/rc.d', os.path.join(xdg_config_home, 'xonsh', 'rc.d')]
+    dirs.append(rc_dir)
+    env['XONSHRC_DIR'] = os.pathsep.join(dirs)
+    env['KITTY_XONSH_RC_DIR'] = rc_dir
+
+
 def is_new_zsh_install(env: Dict[str, str], zdotdir: Optional[str]) -> bool:
     # if ZDOTDIR is empty, zsh will read user rc files from /
     # if there aren't any, it'll run zsh-newuser-install
@@ -170,16 +195,24 @@ def fish_serialize_env(env: Dict[str, str]) -> str:
     return '\n'.join(ans)
 
 
+def json_serialize_env(env: Dict[str, str]) -> str:
+    return json.dumps(env)
+
+
 ENV_MODIFIERS = {
     'fish': setup_fish_env,
     'zsh': setup_zsh_env,
     'bash': setup_bash_env,
+    'nu': setup_nu_env,
+    'xonsh': setup_xonsh_env,
 }
 
 ENV_SERIALIZERS: Dict[str, Callable[[Dict[str, str]], str]] = {
     'zsh':  posix_serialize_env,
     'bash': posix_serialize_env,
     'fish': fish_serialize_env,
+    'nu': json_serialize_env,
+    'xonsh': json_serialize_env,
 }
 
 
@@ -429,6 +429,7 @@ def launch_child(
         env: Optional[Dict[str, str]] = None,
         is_clone_launch: str = '',
         add_listen_on_env_var: bool = True,
+        pass_fds: Sequence[Tuple[int, int]] = (),
     ) -> Child:
         check_for_suitability = True
         if cmd is None:
@@ -480,7 +481,9 @@ def launch_child(
         pwid = platform_window_id(self.os_window_id)
         if pwid is not None:
             fenv['WINDOWID'] = str(pwid)
-        ans = Child(cmd, cwd or self.cwd, stdin, fenv, cwd_from, is_clone_launch=is_clone_launch, add_listen_on_env_var=add_listen_on_env_var)
+        ans = Child(
+            cmd, cwd or self.cwd, stdin, fenv, cwd_from, is_clone_launch=is_clone_launch, add_listen_on_env_var=add_listen_on_env_var,
+            pass_fds=pass_fds)
         ans.fork()
         return ans
 
@@ -507,10 +510,12 @@ def new_window(
         overlay_behind: bool = False,
         is_clone_launch: str = '',
         remote_control_passwords: Optional[Dict[str, Sequence[str]]] = None,
+        pass_fds: Sequence[Tuple[int, int]] = (),
     ) -> Window:
         child = self.launch_child(
             use_shell=use_shell, cmd=cmd, stdin=stdin, cwd_from=cwd_from, cwd=cwd, env=env,
-            is_clone_launch=is_clone_launch, add_listen_on_env_var=False if allow_remote_control and remote_control_passwords else True
+            is_clone_launch=is_clone_launch, add_listen_on_env_var=False if allow_remote_control and remote_control_passwords else True,
+            pass_fds=pass_fds,
         )
         window = Window(
             self, child, self.args, override_title=override_title,
@@ -955,6 +955,9 @@ def get_new_os_window_size(
         if has_window_scaling:
             width = round(width / metrics['xscale'])
             height = round(height / metrics['yscale'])
+    elif unit == 'percent':
+        width = round(metrics['width'] * width / 100)
+        height = round(metrics['height'] * height / 100)
     if incremental:
         w = metrics['width'] + width
         h = metrics['height'] + height
@@ -294,6 +294,21 @@ def callback(timer_id: Optional[int]) -> None:
     add_timer(callback, 0, False)
 
 
+# Listeners for events in all windows, such as those used by remote control
+# subscriptions. Called with the window, the event name and the event data.
+GlobalEventListener = Callable[['Window', str, Dict[str, Any]], None]
+global_event_listeners: Dict[str, GlobalEventListener] = {}
+
+
+def notify_global_event_listeners(window: 'Window', event: str, data: Dict[str, Any]) -> None:
+    for listener in tuple(global_event_listeners.values()):
+        try:
+            listener(window, event, data)
+        except Exception:
+            import traceback
+            traceback.print_exc()
+
+
 def pagerhist(screen: Screen, as_ansi: bool = False, add_wrap_markers: bool = True, upto_output_start: bool = False) -> str:
     pht = screen.historybuf.pagerhist_as_text(upto_output_start)
     if pht and (not as_ansi or not add_wrap_markers):
@@ -780,6 +795,8 @@ def set_geometry(self, new_geometry: WindowGeometry) -> None:
             self.screen.resize(new_geometry.ynum, new_geometry.xnum)
             self.needs_layout = False
             call_watchers(weakref.ref(self), 'on_resize', {'old_geometry': self.geometry, 'new_geometry': new_geometry})
+            if global_event_listeners:
+                notify_global_event_listeners(self, 'resize', {'columns': new_geometry.xnum, 'lines': new_geometry.ynum})
         current_pty_size = (
             self.screen.lines, self.screen.columns,
             max(0, new_geometry.right - new_geometry.left), max(0, new_geometry.bottom - new_geometry.top))
@@ -843,6 +860,8 @@ def title_updated(self) -> None:
         t = self.tabref()
         if t is not None:
             t.title_changed(self)
+        if global_event_listeners:
+            notify_global_event_listeners(self, 'title', {'title': self.title})
 
     def set_title(self, title: Optional[str]) -> None:
         if title:
@@ -966,6 +985,8 @@ def focus_changed(self, focused: bool) -> None:
             return
         self.is_focused = focused
         call_watchers(weakref.ref(self), 'on_focus_change', {'focused': focused})
+        if global_event_listeners:
+            notify_global_event_listeners(self, 'focus', {'focused': focused})
         for c in self.actions_on_focus_change:
             try:
                 c(self, focused)
@@ -10,7 +10,7 @@
 from contextlib import contextmanager
 from pathlib import Path
 
-from kittens.transfer.rsync import Differ, Hasher, Patcher, decode_utf8_buffer, parse_ftc
+from kittens.transfer.rsync import Differ, Hasher, Patcher, RsyncError, decode_utf8_buffer, parse_ftc
 from kittens.transfer.utils import set_paths
 from kitty.constants import kitten_exe
 from kitty.file_transmission import Action, Compression, FileTransmissionCommand, FileType, TransmissionType, ZlibDecompressor
@@ -157,6 +157,61 @@ def test_rsync_roundtrip(self: 'TestFileTransmission') -> None:
     run_roundtrip_test(self, src_data, changed + b"xyz...", num_of_patches, total_patch_size)
 
 
+def test_rsync_references(self: 'TestFileTransmission') -> None:
+    # blocks not in the signature are copied from reference files
+    reference = generate_data(16, 32)
+    src_data = b'new' + reference[32:160] + b'changed' + reference[300:]
+    buf = memoryview(bytearray(30))
+    main, ref = Patcher(len(reference)), Patcher(len(reference))
+    signature = bytes(buf[:main.signature_header(buf)])
+    bs = main.block_size
+    ref_signature = bytearray(buf[:ref.signature_header(buf)])
+    for i in range(0, len(reference), bs):
+        ref_signature.extend(buf[:ref.sign_block(reference[i:i+bs], buf)])
+    d = Differ()
+    d.add_signature_data(signature)
+    d.finish_signature_data()
+    with self.assertRaises(Exception):
+        d.add_reference_signature(7, ref_signature[:-3])
+    d.add_reference_signature(7, ref_signature)
+    src = memoryview(src_data)
+    delta = bytearray()
+
+    def read_into(b):
+        nonlocal src
+        n = min(len(b), len(src))
+        b[:n] = src[:n]
+        src = src[n:]
+        return n
+
+    while d.next_op(read_into, delta.extend):
+        pass
+    output, num_of_references, pos = bytearray(), 0, 0
+    while pos < len(delta):
+        op = delta[pos]
+        if op == 1:
+            sz = int.from_bytes(delta[pos+1:pos+5], 'little')
+            output.extend(delta[pos+5:pos+5+sz])
+            pos += 5 + sz
+        elif op == 2:
+            pos += 3 + int.from_bytes(delta[pos+1:pos+3], 'little')
+        elif op == 6:
+            self.ae(int.from_bytes(delta[pos+1:pos+5], 'little'), 7)
+            start = int.from_bytes(delta[pos+5:pos+13], 'little')
+            end = start + int.from_bytes(delta[pos+13:pos+17], 'little')
+            output.extend(reference[start*bs:(end+1)*bs])
+            num_of_references += 1
+            pos += 17
+        else:
+            self.fail(f'Unexpected operation type: {op}')
+    self.ae(src_data, bytes(output))
+    self.ae(num_of_references, 2)
+    self.assertLess(len(delta), len(src_data) // 2)
+    # the patcher cannot apply reference ranges and must say so rather than wait for more data
+    with self.assertRaisesRegex(RsyncError, 'reference ranges are not supported'):
+        main.apply_delta_data(bytes(delta), lambda pos, output: 0, lambda b: None)
+
+
 class PtyFileTransmission(FileTransmission):
 
     def __init__(self, pty, allow=True):
@@ -225,6 +280,9 @@ def assertPathEqual(self, a, b):
     def test_rsync_roundtrip(self):
         test_rsync_roundtrip(self)
 
+    def test_rsync_references(self):
+        test_rsync_references(self)
+
     def test_file_get(self):
         # send refusal
         for quiet in (0, 1, 2):
@@ -276,6 +334,16 @@ def test_file_get(self):
             q = files[f.name + 'd/q']
             self.ae(q['ftype'], 'symlink')
             self.assertNotIn('data', q)
+            # following symlinks
+            os.symlink('.', f.name + 'd/loop')
+            ft = FileTransmission()
+            self.responses = []
+            ft.handle_serialized_command(serialized_cmd(action='receive', size=1, links='follow'))
+            self.assertResponses(ft, status='OK')
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='b', name='ad'))
+            files = {r['name']: r for r in ft.test_responses if r['action'] == 'file'}
+            self.ae(set(files), {f.name + 'd', f.name + 'd/b', f.name + 'd/s', f.name + 'd/h'})
+            self.ae(sorted(files[f.name + x].get('ftype', 'regular') for x in ('d/s', 'd/h')), ['link', 'regular'])
         base = os.path.join(self.tdir, 'base')
         os.mkdir(base)
         src = os.path.join(base, 'src.bin')
@@ -301,6 +369,178 @@ def test_file_get(self):
             ft.handle_serialized_command(serialized_cmd(action='file', file_id='sl', name=sl, compression=compress))
             received = b''.join(x['data'] for x in ft.test_responses)
             self.ae(received.decode('utf-8'), src)
+        # the client can limit the rate at which data is sent
+        ft = FileTransmission()
+        delays = []
+        ft.callback_after = lambda callback, timeout=0: delays.append(timeout)
+        ft.handle_serialized_command(serialized_cmd(action='receive', size=1, rate=8192))
+        asd = ft.active_sends['test']
+        self.ae((asd.rate, asd.chunk_size), (8192, 4096))
+        ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src))
+        asd.metadata_sent = True
+        ft.test_responses = []
+        ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src))
+        self.ae(sum(len(x['data']) for x in ft.test_responses), 12 * 1024)
+        self.ae(len(delays), 1)
+        self.assertAlmostEqual(delays[0], 0.5, delta=0.1)
+        # blocks are copied from reference files the client already has
+        buf = memoryview(bytearray(30))
+        p = Patcher(len(data))
+        ref = bytearray(buf[:p.signature_header(buf)])
+        for i in range(0, len(data), p.block_size):
+            ref.extend(buf[:p.sign_block(data[i:i+p.block_size], buf)])
+        for features in ('multiplex', 'references'):
+            ft = FileTransmission()
+            ft.handle_serialized_command(serialized_cmd(action='receive', size=1, features=features))
+            self.ae(ft.test_responses[-1].get('features', ''), 'references' if features == 'references' else 'multiplex')
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src))
+            ft.active_sends['test'].metadata_sent = True
+            ft.test_responses = []
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='7', ttype='reference'))
+            if features != 'references':
+                self.ae(ft.test_responses[-1]['status'], 'EINVAL:Reference files were not negotiated')
+                continue
+            ft.handle_serialized_command(serialized_cmd(action='end_data', file_id='7', data=bytes(ref)))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src, ttype='rsync'))
+            ft.handle_serialized_command(serialized_cmd(action='end_data', file_id='src', data=bytes(buf[:p.signature_header(buf)])))
+            delta = b''.join(x['data'] for x in ft.test_responses if x.get('file_id') == 'src')
+            self.ae(delta[:5], b'\x06\x07\x00\x00\x00')
+            self.assertLess(len(delta), 64)
+
+    def test_transfer_policy(self):
+        home = os.path.join(self.tdir, 'home')
+        inc = os.path.join(home, 'incoming')
+        os.makedirs(inc)
+
+        def start(policy, allow=False):
+            ft = FileTransmission(allow=allow, policy=policy)
+            ft.handle_serialized_command(serialized_cmd(action='send'))
+            return ft
+
+        def statuses(ft):
+            return [r.get('status', '').partition(':')[0] for r in ft.test_responses if r.get('file_id')]
+
+        with set_paths(cwd=home, home=home):
+            # roots restrict where files can be written
+            ft = start('root=~/incoming', allow=True)
+            self.ae(ft.test_responses[-1].get('status'), 'OK')
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='1', name='incoming/a'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='2', name='elsewhere/b'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='3', name=inc + '/../c'))
+            self.ae(statuses(ft), ['STARTED', 'EPERM', 'EPERM'])
+            # auto accept patterns skip the prompt but every file must match
+            ft = FileTransmission(allow=False)
+            ft.handle_serialized_command(serialized_cmd(action='send'))
+            self.ae(ft.test_responses[-1].get('status'), 'EPERM:User refused the transfer')
+            ft = start("auto_accept='~/incoming/*'")
+            self.ae(ft.test_responses[-1].get('status'), 'OK')
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='1', name='incoming/a'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='2', name='b'))
+            # wildcards do not match across directories or escape them via ..
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='3', name='incoming/d/c'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='4', name=inc + '/../c'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='5', name=inc + '/x/../c'))
+            self.ae(statuses(ft), ['STARTED', 'EPERM', 'EPERM', 'EPERM', 'EPERM'])
+            self.ae(ft.active_receives['test'].policy.roots, [inc])
+            # nor via symlinks
+            os.symlink(home, os.path.join(inc, 'link'))
+            ft = start("auto_accept='~/incoming/**'")
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='1', name='incoming/d/c'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='2', name='incoming/link/c'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='3', name='incoming/link'))
+            self.ae(statuses(ft), ['STARTED', 'EPERM', 'EPERM'])
+            os.remove(os.path.join(inc, 'link'))
+            # limits on the number of files and the amount of data
+            ft = start('max_files=1 max_size=10', allow=True)
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='1', name='incoming/a'))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='2', name='incoming/b'))
+            ft.handle_serialized_command(serialized_cmd(action='data', file_id='1', data='12345'))
+            ft.handle_serialized_command(serialized_cmd(action='end_data', file_id='1', data='123456'))
+            self.ae(statuses(ft), ['STARTED', 'EPERM', 'PROGRESS', 'EDQUOT'])
+            self.assertFalse(os.path.exists(os.path.join(inc, 'a')))
+            policy = start('max_size=1.5KiB root=~', allow=True).active_receives['test'].policy
+            self.ae((policy.max_size, policy.roots), (1536, [home]))
+
+    def test_file_put_existing(self):
+        # the size and modification time of existing files are reported so
+        # that clients can skip the ones that are unchanged
+        dest = os.path.join(self.tdir, 'dest')
+        with open(dest, 'wb') as f:
+            f.write(b'x' * 8192)
+        st = os.stat(dest)
+        callbacks = []
+        ft = FileTransmission()
+        ft.callback_after = lambda callback, timeout=0: callbacks.append(callback)
+        ft.handle_serialized_command(serialized_cmd(action='send', features='cancel_file'))
+        ft.handle_serialized_command(serialized_cmd(action='file', file_id='1', name=dest, ttype='rsync'))
+        r = ft.test_responses[-1]
+        self.ae((r['status'], r['size'], r['mtime'], r['ttype']), ('STARTED', st.st_size, st.st_mtime_ns, 'rsync'))
+        # no signature is sent for a file canceled before it is transmitted
+        ft.handle_serialized_command(serialized_cmd(action='cancel', file_id='1'))
+        ft.test_responses = []
+        while callbacks:
+            callbacks.pop(0)(None)
+        self.ae(ft.test_responses, [])
+        with open(dest, 'rb') as f:
+            self.ae(f.read(), b'x' * 8192)
+        ft.handle_serialized_command(serialized_cmd(action='file', file_id='2', name=os.path.join(self.tdir, 'new')))
+        self.assertNotIn('mtime', ft.test_responses[-1])
+
+    def test_checksums(self):
+        import hashlib
+        bs = 64 * 1024
+        data = os.urandom(bs) + bytes(bs) + os.urandom(1000)
+        expected = hashlib.sha256(data).hexdigest()
+        extents = f'{len(data)},0:{bs},{2*bs}:1000'
+        src = os.path.join(self.tdir, 'src')
+        with open(src, 'wb') as f:
+            f.write(data)
+        buf = memoryview(bytearray(30))
+        sig_header = bytes(buf[:Patcher(len(data)).signature_header(buf)])
+
+        # the checksum of the data sent by the terminal
+        for kw in ({}, {'extents': extents}, {'ttype': 'rsync'}):
+            ft = FileTransmission()
+            ft.handle_serialized_command(serialized_cmd(action='receive', size=1))
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src))
+            ft.active_sends['test'].metadata_sent = True
+            ft.test_responses = []
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src, checksum='sha256', **kw))
+            if kw.get('ttype') == 'rsync':
+                ft.handle_serialized_command(serialized_cmd(action='end_data', file_id='src', data=sig_header))
+            self.ae(ft.test_responses[-1].get('checksum'), expected, kw)
+
+        # the checksum of the data written by the terminal
+        dest = os.path.join(self.tdir, 'dest')
+        for kw in ({}, {'extents': extents}, {'ttype': 'rsync'}):
+            ft = FileTransmission()
+            ft.handle_serialized_command(serialized_cmd(action='send'))
+            ft.test_responses = []
+            ft.handle_serialized_command(serialized_cmd(action='file', file_id='1', name=dest, checksum='sha256', **kw))
+            payload = data
+            if 'extents' in kw:
+                payload = data[:bs] + data[2*bs:]
+            elif 'ttype' in kw:
+                d = Differ()
+                d.add_signature_data(b''.join(r.get('data', b'') for r in ft.test_responses if r['action'] != 'status'))
+                d.finish_signature_data()
+                delta, remaining = bytearray(), memoryview(data)
+
+                def read_into(b):
+                    nonlocal remaining
+                    n = min(len(b), len(remaining))
+                    b[:n] = remaining[:n]
+                    remaining = remaining[n:]
+                    return n
+
+                while d.next_op(read_into, delta.extend):
+                    pass
+                payload = bytes(delta)
+            ft.handle_serialized_command(serialized_cmd(action='end_data', file_id='1', data=payload))
+            self.ae(ft.test_responses[-1]['status'], 'OK')
+            self.ae(ft.test_responses[-1].get('checksum'), expected, kw)
+            with open(dest, 'rb') as f:
+                self.ae(f.read(), data)
 
     def test_parse_ftc(self):
         def t(raw, *expected):
@@ -369,6 +609,26 @@ def single_file(*cmd):
         single_file('--compress=never')
         single_file('--compress=always')
         single_file('--transmit-deltas', '--compress=never')
+        single_file('--verify')
+        single_file('--transmit-deltas', '--verify')
+        single_file('--sparse')
+
+        def sparse_file(*cmd):
+            with open(src, 'wb') as s:
+                s.truncate(4 * 1024 * 1024)
+                s.seek(1024 * 1024)
+                s.write(self.src_data)
+            with open(src, 'rb') as s:
+                data = s.read()
+            with self.run_kitten(['--sparse'] + list(cmd) + [src, dest]) as pty:
+                pty.wait_till_child_exits(require_exit_code=0)
+            with open(dest, 'rb') as f:
+                self.assertEqual(data, f.read())
+
+        sparse_file()
+        sparse_file('--compress=always', '--verify')
+        with open(src, 'wb') as s:
+            s.write(self.src_data)
 
         def multiple_files(*cmd):
             src = os.path.join(self.tdir, 'msrc')
@@ -30,6 +30,8 @@ def t(w, h, width=0, height=0, unit='cells', incremental=False):
             t(80 * metrics['cell_width'] + metrics['width'], 100, 80, incremental=True)
             t(1217, 100, 1217, unit='pixels')
             t(1217 + metrics['width'], 100, 1217, unit='pixels', incremental=True)
+            t(100, 150, 50, 150, unit='percent')
+            t(300, 90, 50, -10, unit='percent', incremental=True)
 
         with self.subTest(has_window_scaling=True):
             has_window_scaling = True
@@ -1,6 +1,7 @@
 #!/usr/bin/env python3
 # License: GPL v3 Copyright: 2018, Kovid Goyal <kovid at kovidgoyal.net>
 
+import os
 
 from kitty.fast_data_types import Color
 from kitty.options.utils import DELETE_ENV_VAR
@@ -114,6 +115,23 @@ def ac(which=0):
         self.ae((ac().func, ac(1).func), ('new_window', 'launch'))
         self.ae(ac(1).args, ('--moo', 'XXX'))
 
+        opts = p('remote_control_rate_limit 100 2.5')
+        self.ae(opts.remote_control_rate_limit, (100, 2.5))
+        opts = p('remote_control_rate_limit 0 1', bad_line_num=1)
+        self.assertIsNone(opts.remote_control_rate_limit)
+
+        import pwd
+        me = pwd.getpwuid(os.geteuid()).pw_name
+        opts = p(f'remote_control_allowed_peers uid:{me} uid:1234 gid:5 bad uid:no-such-user-for-kitty gid:no-such-group-for-kitty')
+        self.ae(opts.remote_control_allowed_peers, ((os.geteuid(), 1234), (5,)))
+        self.ae(len(self.error_messages), 3)
+        # invalid entries never lift the restriction
+        opts = p('remote_control_allowed_peers uid:no-such-user-for-kitty')
+        self.ae(opts.remote_control_allowed_peers, ((), ()))
+        opts = p('remote_control_allowed_peers ' + ' '.join(f'uid:{i}' for i in range(1000)))
+        self.ae(len(opts.remote_control_allowed_peers[0]), 1000)
+        self.assertIsNone(p('remote_control_allowed_peers none').remote_control_allowed_peers)
+
         opts = p('kitty_mod alt')
         self.ae(opts.kitty_mod, to_modifiers('alt'))
         self.ae(next(keys_for_func(opts, 'next_layout')).mods, opts.kitty_mod)
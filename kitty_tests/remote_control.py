@@ -0,0 +1,174 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+import os
+import tempfile
+
+from . import BaseTest
+
+
+class Window:
+
+    def __init__(self, window_id):
+        self.id = window_id
+
+
+class Tab(list):
+
+    def __init__(self, tab_id, windows):
+        super().__init__(windows)
+        self.id = tab_id
+
+
+class Boss:
+
+    def __init__(self):
+        self.tabs = [Tab(10, [Window(1)]), Tab(11, [Window(2), Window(3)])]
+        self.all_tabs = list(self.tabs)
+        self.all_windows = [w for t in self.tabs for w in t]
+        self.window_id_map = {w.id: w for w in self.all_windows}
+        self.active_window = self.window_id_map[2]
+        self.active_tab = self.tabs[1]
+
+    def match_windows(self, expr, self_window=None):
+        return [w for w in self.all_windows if expr == f'id:{w.id}']
+
+    def match_tabs(self, expr):
+        return [t for t in self.tabs if expr == f'id:{t.id}']
+
+    def tab_for_window(self, window):
+        for t in self.tabs:
+            if window in t:
+                return t
+
+
+class TestRemoteControl(BaseTest):
+
+    def setUp(self):
+        super().setUp()
+        import kitty.remote_control as rc
+        self.orig_get_boss = rc.get_boss
+        self.boss = Boss()
+        rc.get_boss = lambda: self.boss
+
+    def tearDown(self):
+        import kitty.remote_control as rc
+        rc.get_boss = self.orig_get_boss
+        super().tearDown()
+
+    def test_password_window_restrictions(self):
+        from kitty.remote_control import PasswordAuthorizer
+
+        def allowed(auth_items, cmd, payload=None, kitty_window_id=0):
+            pa = PasswordAuthorizer(frozenset(auth_items))
+            pcmd = {'cmd': cmd, 'payload': payload or {}, 'kitty_window_id': kitty_window_id}
+            return pa.is_cmd_allowed(pcmd, None, True, {})
+
+        items = ('close-window:id:1', 'ls')
+        self.assertTrue(allowed(items, 'close-window', {'match': 'id:1'}))
+        self.assertFalse(allowed(items, 'close-window', {'match': 'id:2'}))
+        self.assertFalse(allowed(items, 'close-window', {'match': 'id:99'}))
+        self.assertFalse(allowed(items, 'close-window', {'all': True}))
+        # without a match, the command acts on the window it is run in or the active window
+        self.assertTrue(allowed(items, 'close-window', {'self': True}, kitty_window_id=1))
+        self.assertFalse(allowed(items, 'close-window', kitty_window_id=1))
+        self.assertFalse(allowed(items, 'close-window'))
+        self.assertFalse(allowed(items, 'close-tab', {'match': 'id:10'}))
+        # commands that do not act on particular windows are never allowed by a restricted pattern
+        self.assertTrue(allowed(items, 'ls'))
+        self.assertFalse(allowed(('ls:id:1',), 'ls'))
+
+        # tab commands act on all the windows in the tabs
+        items = ('close-tab:id:1', 'close-tab:id:3')
+        self.assertTrue(allowed(items, 'close-tab', {'match': 'id:10'}))
+        self.assertFalse(allowed(items, 'close-tab', {'match': 'id:11'}))
+        self.assertTrue(allowed(('close-tab:id:1',), 'close-tab', {'self': True}, kitty_window_id=1))
+        self.assertFalse(allowed(('close-tab:id:1',), 'close-tab'))
+
+        # a batch is allowed only if every command in it is
+        items = ('close-window:id:1', 'ls')
+        ok, bad = {'cmd': 'close-window', 'payload': {'match': 'id:1'}}, {'cmd': 'close-window', 'payload': {'match': 'id:2'}}
+        self.assertTrue(allowed(items, 'batch', {'commands': [ok, {'cmd': 'ls'}]}))
+        self.assertFalse(allowed(items, 'batch', {'commands': [ok, bad]}))
+        self.assertFalse(allowed(items, 'batch', {'commands': []}))
+        self.assertFalse(allowed(items, 'batch', {'commands': [{'cmd': 'batch', 'payload': {'commands': [ok]}}]}))
+        self.assertTrue(allowed(items, 'batch', {'commands': [{'cmd': 'close-window', 'payload': {'self': True}}]}, kitty_window_id=1))
+
+        # paths to checkers can contain colons
+        with tempfile.TemporaryDirectory() as tdir:
+            path = os.path.join(tdir, 'a:b', 'checker.py')
+            os.mkdir(os.path.dirname(path))
+            with open(path, 'w') as f:
+                f.write('def is_cmd_allowed(pcmd, window, from_socket, extra_data):\n    return pcmd["cmd"] == "ls"\n')
+            self.assertTrue(allowed((path,), 'ls'))
+            self.assertFalse(allowed((path,), 'close-window'))
+
+    def test_rate_limit(self):
+        from kitty.remote_control import is_rate_limited, recent_requests
+        recent_requests.clear()
+        self.set_options({'remote_control_rate_limit': (2, 100)})
+        self.assertFalse(is_rate_limited({'cmd': 'ls'}, 'pid:1'))
+        self.assertFalse(is_rate_limited({'cmd': 'ls'}, 'pid:1'))
+        self.assertTrue(is_rate_limited({'cmd': 'ls'}, 'pid:1'))
+        # other clients have their own limits
+        self.assertFalse(is_rate_limited({'cmd': 'ls'}, 'pid:2'))
+        self.assertFalse(is_rate_limited({'cmd': 'ls'}, 'peer:3'))
+        self.assertFalse(is_rate_limited({'cmd': 'ls', 'cancel_async': True}, 'pid:1'))
+        self.set_options({'remote_control_rate_limit': None})
+        self.assertFalse(is_rate_limited({'cmd': 'ls'}, 'pid:1'))
+        recent_requests.clear()
+
+    def test_received_fds_kept_until_approved(self):
+        from kitty.boss import Boss as RealBoss
+
+        class FakeBoss:
+            window_id_map = {}
+
+            def __init__(self):
+                self.callback = None
+                self.executed_with = None
+
+            def choose(self, msg, callback, *choices, **kw):
+                self.callback = callback
+                return Window(99)
+
+            def _execute_remote_command(self, pcmd, window, peer_id, self_window, received_fds, client):
+                # the fds must still be open when the command runs
+                self.executed_with = tuple(os.readlink(f'/proc/self/fd/{fd}') for fd in received_fds)
+                return {'ok': True}
+
+            remote_cmd_permission_received = RealBoss.remote_cmd_permission_received
+
+        def ask(choice):
+            b = FakeBoss()
+            r, w = os.pipe()
+            expected = os.readlink(f'/proc/self/fd/{r}')
+            self.assertTrue(RealBoss.ask_if_remote_cmd_is_allowed(b, {'cmd': 'launch', 'password': 'x'}, None, 0, None, None, (r,)))
+            # the caller closes the fds as soon as the request is pending
+            os.close(r), os.close(w)
+            before = set(os.listdir('/proc/self/fd'))
+            b.callback(choice)
+            self.assertLess(len(set(os.listdir('/proc/self/fd'))), len(before), 'The kept fds were not closed')
+            return b.executed_with, expected
+
+        if not os.path.exists('/proc/self/fd'):
+            self.skipTest('No /proc/self/fd')
+        executed_with, expected = ask('a')
+        self.ae(executed_with, (expected,))
+        executed_with, expected = ask('r')
+        self.assertIsNone(executed_with)
+        executed_with, expected = ask('')
+        self.assertIsNone(executed_with)
+
+    def test_allowed_peers(self):
+        import socket
+
+        from kitty.fast_data_types import is_rc_peer_allowed
+        a, b = socket.socketpair()
+        with a, b:
+            fd, uid, gid = a.fileno(), os.geteuid(), os.getegid()
+            self.assertTrue(is_rc_peer_allowed(fd, ((uid,), ())))
+            self.assertTrue(is_rc_peer_allowed(fd, ((), (gid,))))
+            self.assertTrue(is_rc_peer_allowed(fd, (tuple(range(uid + 1, uid + 1000)) + (uid,), ())))
+            self.assertFalse(is_rc_peer_allowed(fd, ((uid + 1,), (gid + 1,))))
+            self.assertFalse(is_rc_peer_allowed(fd, ((), ())))
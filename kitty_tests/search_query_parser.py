@@ -28,3 +28,27 @@ def t(q, expected=set()):
         t('(id:1 or id:2) and id:1', {1})
         self.assertRaises(ParseException, t, '1')
         self.assertRaises(ParseException, t, '"id:1"')
+
+    def test_ls_match_query(self):
+        from kitty.rc.ls import InvalidQuery, filter_windows
+
+        def w(id, title, focused=False, user_vars=None, pid=100):
+            return {'id': id, 'title': title, 'is_focused': focused, 'is_active': focused, 'is_self': False, 'pid': pid,
+                    'cmdline': ['ssh', 'x'], 'user_vars': user_vars or {}, 'env': {}}
+
+        def t(q, expected=()):
+            data = [{'id': 1, 'is_focused': True, 'tabs': [
+                {'id': 1, 'title': 'a', 'layout': 'tall', 'windows': [w(1, 'ssh host', True, {'project': 'foo'}), w(2, 'ssh x', False, {'project': 'foo'}, 200)]},
+                {'id': 2, 'title': 'b', 'layout': 'stack', 'windows': [w(3, 'vim')]}]}]
+            self.ae([w['id'] for osw in filter_windows(data, q) for t in osw['tabs'] for w in t['windows']], list(expected))
+
+        t('title~"ssh" and var:project=foo and not focused', [2])
+        t('focused', [1])
+        t('not var:project', [3])
+        t('pid>=150 or layout=stack', [2, 3])
+        t('title!~ssh', [3])
+        t('(id=1 or id=3) tab_title=b', [3])
+        t('var:project!=bar', [1, 2, 3])
+        t('id=7')
+        for q in ('bogus', 'title~"("', 'pid>x', '"x"', '(id=1'):
+            self.assertRaises(InvalidQuery, t, q)
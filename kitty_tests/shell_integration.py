@@ -14,7 +14,7 @@
 from kitty.bash import decode_ansi_c_quoted_string
 from kitty.constants import kitten_exe, kitty_base_dir, shell_integration_dir, terminfo_dir
 from kitty.fast_data_types import CURSOR_BEAM, CURSOR_BLOCK, CURSOR_UNDERLINE
-from kitty.shell_integration import setup_bash_env, setup_fish_env, setup_zsh_env
+from kitty.shell_integration import serialize_env, setup_bash_env, setup_fish_env, setup_nu_env, setup_xonsh_env, setup_zsh_env
 
 from . import BaseTest
 
@@ -391,6 +391,23 @@ def run_test(argv, *expected, excluded=(), rc='', wait_string='PROMPT $', assert
             q = q + "'"
             self.ae(decode_ansi_c_quoted_string(q, 0)[0], e, f'Failed to decode: {q!r}')
 
+    def test_nu_and_xonsh_env(self):
+        env = {'XDG_DATA_DIRS': os.pathsep.join(('/a', '/b'))}
+        setup_nu_env(env, ['nu'])
+        self.ae(env['XDG_DATA_DIRS'].split(os.pathsep), [shell_integration_dir, '/a', '/b'])
+        self.ae(env['KITTY_NU_XDG_DATA_DIR'], shell_integration_dir)
+        rc_dir = os.path.join(shell_integration_dir, 'xonsh')
+        env = {'HOME': '/h'}
+        setup_xonsh_env(env, ['xonsh'])
+        self.ae(env['XONSHRC_DIR'].split(os.pathsep), ['/etc/xonsh/rc.d', '/h/.config/xonsh/rc.d', rc_dir])
+        self.assertNotIn('KITTY_XONSH_ORIG_XONSHRC_DIR', env)
+        env = {'XONSHRC_DIR': '/x'}
+        setup_xonsh_env(env, ['xonsh'])
+        self.ae(env['XONSHRC_DIR'].split(os.pathsep), ['/x', rc_dir])
+        self.ae(env['KITTY_XONSH_ORIG_XONSHRC_DIR'], '/x')
+        self.ae(serialize_env('/usr/bin/xonsh', {'a': 'b"c'}), '{"a": "b\\"c"}')
+        self.ae(serialize_env('nu', {'a': 'b'}), '{"a": "b"}')
+
 
 class ShellIntegrationWithKitten(ShellIntegration):
     with_kitten = True
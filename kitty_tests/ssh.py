@@ -216,7 +216,24 @@ def test_ssh_shell_integration(self):
                         self.assertEqual(pty.screen.cursor.shape, 0)
                         self.assertNotIn(b'\x1b]133;', pty.received_bytes)
 
-    def check_bootstrap(self, sh, home_dir, login_shell='', SHELL_INTEGRATION_VALUE='enabled', test_script='', pre_data='', conf='', launcher='sh', home=''):
+    def test_ssh_terminfo_fallback(self):
+        if os.geteuid() == 0:
+            self.skipTest('Cannot make HOME read-only for the root user')
+        for sh in self.all_possible_sh:
+            with self.subTest(sh=sh), tempfile.TemporaryDirectory() as tdir:
+                try:
+                    pty = self.check_bootstrap(
+                        sh, tdir, test_script='env; exit 0', SHELL_INTEGRATION_VALUE='', conf='terminfo_fallback xterm-fallback',
+                        home_is_writable=False)
+                    pty.wait_till(lambda: 'TERM=xterm-fallback' in pty.screen_contents())
+                    self.assertNotIn('TERMINFO=', pty.screen_contents())
+                finally:
+                    os.chmod(tdir, 0o700)
+
+    def check_bootstrap(
+        self, sh, home_dir, login_shell='', SHELL_INTEGRATION_VALUE='enabled', test_script='', pre_data='', conf='', launcher='sh', home='',
+        home_is_writable=True,
+    ):
         if login_shell:
             conf += f'\nlogin_shell {login_shell}'
         if 'python' in sh:
@@ -236,10 +253,13 @@ def check_bootstrap(self, sh, home_dir, login_shell='', SHELL_INTEGRATION_VALUE=
         del cp
         try:
             env = basic_shell_env(home_dir)
-            # Avoid generating unneeded completion scripts
-            os.makedirs(os.path.join(home_dir, '.local', 'share', 'fish', 'generated_completions'), exist_ok=True)
-            # prevent newuser-install from running
-            open(os.path.join(home_dir, '.zshrc'), 'w').close()
+            if home_is_writable:
+                # Avoid generating unneeded completion scripts
+                os.makedirs(os.path.join(home_dir, '.local', 'share', 'fish', 'generated_completions'), exist_ok=True)
+                # prevent newuser-install from running
+                open(os.path.join(home_dir, '.zshrc'), 'w').close()
+            else:
+                os.chmod(home_dir, 0o500)
             pty = self.create_pty([launcher, '-c', ' '.join(self.rdata['cmd'])], cwd=home_dir, env=env)
             pty.turn_off_echo()
             if pre_data:
@@ -251,7 +271,7 @@ def check_untar_or_fail():
                     raise ValueError('Untarring failed with screen contents:\n' + q)
                 return 'UNTAR_DONE' in q
             pty.wait_till(check_untar_or_fail, timeout=30)
-            self.assertTrue(os.path.exists(os.path.join(home_dir, '.terminfo/kitty.terminfo')))
+            self.assertEqual(os.path.exists(os.path.join(home_dir, '.terminfo/kitty.terminfo')), home_is_writable)
             if SHELL_INTEGRATION_VALUE != 'enabled':
                 pty.wait_till(lambda: len(pty.screen_contents().splitlines()) > 1, timeout=30)
                 self.assertEqual(pty.screen.cursor.shape, 0)
@@ -17,6 +17,12 @@ mv_files_and_dirs() {
 
 compile_terminfo() {
     tname=".terminfo"
+    if [ ! -f "$1/$tname/kitty.terminfo" ]; then
+        # the terminfo was not sent as it is already installed
+        [ -e "/usr/share/misc/terminfo.cdb" ] && tname=".terminfo.cdb"
+        export TERMINFO="$HOME/$tname"
+        return
+    fi
     # Ensure the 78 dir is present
     if [ ! -f "$1/$tname/78/xterm-kitty" ]; then
         command mkdir -p "$1/$tname/78"
@@ -42,10 +48,34 @@ compile_terminfo() {
     # compile terminfo for this system
     if [ -x "$(command -v tic)" ]; then
         tic_out=$(command tic -x -o "$1/$tname" "$1/.terminfo/kitty.terminfo" 2>&1)
-        [ $? = 0 ] || die "Failed to compile terminfo with err: $tic_out"
+        [ $? = 0 ] || use_terminfo_fallback || die "Failed to compile terminfo with err: $tic_out"
     fi
 }
 
+use_terminfo_fallback() {
+    [ -z "$terminfo_fallback" ] && return 1
+    unset TERMINFO
+    export TERM="$terminfo_fallback"
+    terminfo_fallback=""
+    return 0
+}
+
+check_terminfo() {
+    # the terminfo could not be installed if, for example, HOME is read-only
+    [ -z "$TERMINFO" ] && return
+    [ -r "$TERMINFO/x/xterm-kitty" -o -f "$TERMINFO" ] && return
+    use_terminfo_fallback || die "Failed to install the kitty terminfo to $TERMINFO"
+}
+
+payload_is_installed() {
+    # the kitty runtime files are not sent when the kitten thinks they are
+    # already installed, with version $1, check that they actually are
+    [ -z "$1" ] && return 0
+    [ "$home_is_writable" = "y" ] || return 1
+    [ "$(command cat "$data_dir/payload-version" 2> /dev/null)" = "$1" ] || return 1
+    [ -r "$TERMINFO/x/xterm-kitty" -o -f "$TERMINFO" ]
+}
+
 parse_passwd_record() {
     printf "%s" "$(command grep -o '[^:]*$')"
 }
@@ -125,6 +155,30 @@ exec_fish_with_integration() {
     exec "$login_shell" "-l"
 }
 
+exec_nu_with_integration() {
+    if [ -z "$XDG_DATA_DIRS" ]; then
+        export XDG_DATA_DIRS="$shell_integration_dir"
+    else
+        export XDG_DATA_DIRS="$shell_integration_dir:$XDG_DATA_DIRS"
+    fi
+    export KITTY_NU_XDG_DATA_DIR="$shell_integration_dir"
+    exec "$login_shell" "-l"
+}
+
+exec_xonsh_with_integration() {
+    if [ -z "${XONSHRC_DIR+x}" ]; then
+        # the default value used by xonsh
+        xdg_config_home="$XDG_CONFIG_HOME"
+        [ -z "$xdg_config_home" ] && xdg_config_home="$HOME/.config"
+        export XONSHRC_DIR="/etc/xonsh/rc.d:$xdg_config_home/xonsh/rc.d:$shell_integration_dir/xonsh"
+    else
+        export KITTY_XONSH_ORIG_XONSHRC_DIR="$XONSHRC_DIR"
+        export XONSHRC_DIR="$XONSHRC_DIR:$shell_integration_dir/xonsh"
+    fi
+    export KITTY_XONSH_RC_DIR="$shell_integration_dir/xonsh"
+    exec "$login_shell" "-l"
+}
+
 exec_bash_with_integration() {
     export ENV="$shell_integration_dir/bash/kitty.bash"
     export KITTY_BASH_INJECT="1"
@@ -147,6 +201,12 @@ exec_with_shell_integration() {
         "bash")
             exec_bash_with_integration
             ;;
+        "nu")
+            exec_nu_with_integration
+            ;;
+        "xonsh")
+            exec_xonsh_with_integration
+            ;;
     esac
 }
 
@@ -0,0 +1,111 @@
+# Copyright (C) 2023 Kovid Goyal <kovid at kovidgoyal.net>
+# Distributed under terms of the GPLv3 license.
+
+# The bootstrap script for Windows hosts running the Windows OpenSSH server.
+# The data is always uploaded via SFTP, as reading it from the terminal is not
+# reliable with the Windows console.
+
+function Die([string]$msg) {
+    [Console]::Error.WriteLine([char]27 + '[31m' + $msg + [char]27 + '[m')
+    exit 1
+}
+
+function ConvertFrom-Base64([string]$x) {
+    if (-not $x) { return '' }
+    # the padding may have been stripped
+    $x = $x.PadRight($x.Length + (4 - $x.Length % 4) % 4, '=')
+    return [Text.Encoding]::UTF8.GetString([Convert]::FromBase64String($x))
+}
+
+function Pop-EnvVar([string]$name) {
+    $ans = [Environment]::GetEnvironmentVariable($name)
+    [Environment]::SetEnvironmentVariable($name, $null)
+    return $ans
+}
+
+function Expand-EnvVars([string]$x) {
+    return [regex]::Replace($x, '\$\{(\w+)\}|\$(\w+)', [Text.RegularExpressions.MatchEvaluator] {
+        param($m)
+        return [Environment]::GetEnvironmentVariable($m.Groups[1].Value + $m.Groups[2].Value)
+    })
+}
+
+function Set-EnvVars([string]$path) {
+    foreach ($line in Get-Content -Encoding UTF8 $path) {
+        $action, $defn = $line.Split(' ', 2)
+        $parts = @(ConvertFrom-Json $defn)
+        if ($action -eq 'unset') {
+            [Environment]::SetEnvironmentVariable($parts[0], $null)
+        } elseif ($action -eq 'export') {
+            $val = ''
+            if ($parts.Count -gt 1) {
+                $val = $parts[1]
+                if (-not $parts[2]) { $val = Expand-EnvVars $val }
+            }
+            [Environment]::SetEnvironmentVariable($parts[0], $val)
+        }
+    }
+}
+
+function Copy-Tree([string]$src, [string]$dest) {
+    if (Test-Path -LiteralPath $src) {
+        Copy-Item -Path (Join-Path $src '*') -Destination $dest -Recurse -Force
+    }
+}
+
+# Data uploaded via SFTP is relative to the directory the session starts in,
+# which is the home directory of the user
+$data_file = Join-Path (Get-Location) 'DATA_FILE'
+
+# If $HOME is configured set it here
+$home_dir = ConvertFrom-Base64 'EXPORT_HOME_CMD'
+if ($home_dir) {
+    $env:HOME = $home_dir
+    Set-Location -LiteralPath $home_dir
+}
+if (-not $env:HOME) { $env:HOME = $env:USERPROFILE }
+
+$tdir = Join-Path ([IO.Path]::GetTempPath()) ('kitty-ssh-kitten-untar-' + [IO.Path]::GetRandomFileName())
+New-Item -ItemType Directory -Path $tdir | Out-Null
+try {
+    # tar is included with Windows since Windows 10 version 1803
+    & tar.exe -xzf $data_file -C $tdir 2>&1 | Out-Null
+    Remove-Item -Force -LiteralPath $data_file -ErrorAction SilentlyContinue
+    $data_sh = Join-Path $tdir 'data.sh'
+    if (-not (Test-Path -LiteralPath $data_sh)) { Die "Failed to read SSH data from $data_file" }
+    Set-EnvVars $data_sh
+    Copy-Tree (Join-Path $tdir 'home') $env:HOME
+    Copy-Tree (Join-Path $tdir 'root') ($env:SystemDrive + '\')
+} finally {
+    Remove-Item -Recurse -Force -LiteralPath $tdir -ErrorAction SilentlyContinue
+}
+
+$login_shell = Pop-EnvVar 'KITTY_LOGIN_SHELL'
+$login_cwd = Pop-EnvVar 'KITTY_LOGIN_CWD'
+$terminfo_fallback = Pop-EnvVar 'KITTY_TERMINFO_FALLBACK'
+# neither the shell integration nor the kitty launcher is installed on Windows
+foreach ($x in 'KITTY_SSH_KITTEN_DATA_DIR', 'KITTY_REMOTE', 'KITTY_SHELL_INTEGRATION') { Pop-EnvVar $x | Out-Null }
+# Windows has no terminfo database
+if ($terminfo_fallback) { $env:TERM = $terminfo_fallback }
+
+if (-not $login_shell) {
+    # the shell the Windows OpenSSH server is configured to use
+    $login_shell = (Get-ItemProperty -Path 'HKLM:\SOFTWARE\OpenSSH' -Name DefaultShell -ErrorAction SilentlyContinue).DefaultShell
+    if (-not $login_shell) { $login_shell = $env:ComSpec }
+}
+if ($login_cwd) { Set-Location -LiteralPath $login_cwd }
+$shell_name = [IO.Path]::GetFileNameWithoutExtension($login_shell).ToLower()
+$is_powershell = $shell_name -eq 'powershell' -or $shell_name -eq 'pwsh'
+$shell_args = @()
+if ($is_powershell) { $shell_args += '-NoLogo' }
+# If a command was passed to SSH execute it here
+$exec_cmd = ConvertFrom-Base64 'EXEC_CMD'
+if ($exec_cmd) {
+    if ($is_powershell) { $shell_args += '-Command', $exec_cmd } else { $shell_args += '/c', $exec_cmd }
+}
+
+# Used in the tests
+TEST_SCRIPT
+
+& $login_shell @shell_args
+exit $LASTEXITCODE
@@ -18,8 +18,13 @@
 
 tty_file_obj = None
 echo_on = int('ECHO_ON')
-data_dir = shell_integration_dir = ''
+data_dir = shell_integration_dir = terminfo_fallback = ''
 request_data = int('REQUEST_DATA')
+# data uploaded via SFTP is relative to the directory the session starts in,
+# which is the home directory of the user
+data_file = 'DATA_FILE'
+if data_file:
+    data_file = os.path.abspath(data_file)
 leading_data = b''
 login_shell = os.environ.get('SHELL') or '/bin/sh'
 try:
@@ -81,8 +86,19 @@ def send_data_request():
     write_all(tty_file_obj.fileno(), dcs_to_kitty('id=REQUEST_ID:pwfile=PASSWORD_FILENAME:pw=DATA_PASSWORD'))
 
 
-def debug(msg):
-    data = dcs_to_kitty('debug: {}'.format(msg), 'print')
+def data_transfer_failed(msg):
+    # use a special exit code so the kitten can retry sending the data via SFTP
+    sys.stderr.write('\033[31m{}\033[m\n\r'.format(msg))
+    sys.stderr.flush()
+    raise SystemExit(int('DATA_TRANSFER_FAILED_EXIT_CODE'))
+
+
+def payload_missing():
+    # use a special exit code so the kitten can send the kitty runtime files again
+    raise SystemExit(int('PAYLOAD_MISSING_EXIT_CODE'))
+
+
+def send_to_kitty(data):
     if tty_file_obj is None:
         with open(os.ctermid(), 'wb') as fl:
             write_all(fl.fileno(), data)
@@ -90,6 +106,10 @@ def debug(msg):
         write_all(tty_file_obj.fileno(), data)
 
 
+def debug(msg):
+    send_to_kitty(dcs_to_kitty('debug: {}'.format(msg), 'print'))
+
+
 def apply_env_vars(raw):
     global login_shell
 
@@ -131,6 +151,11 @@ def move(src, base_dest):
 
 
 def compile_terminfo(base):
+    if not os.path.exists(os.path.join(base, '.terminfo', 'kitty.terminfo')):
+        # the terminfo was not sent as it is already installed
+        tname = '.terminfo.cdb' if os.path.exists('/usr/share/misc/terminfo.cdb') else '.terminfo'
+        os.environ['TERMINFO'] = os.path.join(HOME, tname)
+        return
     try:
         tic = shutil.which('tic')
     except AttributeError:
@@ -163,16 +188,55 @@ def compile_terminfo(base):
         stdout=subprocess.PIPE, stderr=subprocess.STDOUT
     )
     rc = p.wait()
-    if rc != 0:
-        getattr(sys.stderr, 'buffer', sys.stderr).write(p.stdout)
+    if rc != 0 and not use_terminfo_fallback():
+        getattr(sys.stderr, 'buffer', sys.stderr).write(p.stdout.read())
         raise SystemExit('Failed to compile the terminfo database')
 
 
+def use_terminfo_fallback():
+    global terminfo_fallback
+    if not terminfo_fallback:
+        return False
+    os.environ.pop('TERMINFO', None)
+    os.environ['TERM'] = terminfo_fallback
+    terminfo_fallback = ''
+    return True
+
+
+def check_terminfo():
+    # the terminfo could not be installed if, for example, HOME is read-only
+    q = os.environ.get('TERMINFO')
+    if not q or os.access(os.path.join(q, 'x', 'xterm-kitty'), os.R_OK) or os.path.isfile(q):
+        return
+    if not use_terminfo_fallback():
+        raise SystemExit('Failed to install the kitty terminfo to ' + q)
+
+
+def payload_is_installed(version, home_is_writable):
+    # the kitty runtime files are not sent when the kitten thinks they are
+    # already installed, check that they actually are
+    if not version:
+        return True
+    if not home_is_writable:
+        return False
+    try:
+        with open(os.path.join(data_dir, 'payload-version')) as f:
+            if f.read().strip() != version:
+                return False
+    except EnvironmentError:
+        return False
+    q = os.environ.get('TERMINFO', '')
+    return os.access(os.path.join(q, 'x', 'xterm-kitty'), os.R_OK) or os.path.isfile(q)
+
+
 def iter_base64_data(f):
     global leading_data
     started = 0
     while True:
-        line = f.readline().rstrip()
+        line = f.readline()
+        if not line:
+            data_transfer_failed('Failed to read SSH data from tty')
+        line = line.rstrip()
         if started == 0:
             if line == b'KITTY_DATA_START':
                 started = 1
@@ -200,16 +264,32 @@ def temporary_directory(dir, prefix):
 
 
 def get_data():
-    global data_dir, shell_integration_dir, leading_data
-    data = []
-    data = b''.join(iter_base64_data(tty_file_obj))
-    if leading_data:
-        # clear current line as it might have things echoed on it from leading_data
-        # because we only turn off echo in this script whereas the leading bytes could
-        # have been sent before the script had a chance to run
-        sys.stdout.write('\r\033[K')
-    data = base64.standard_b64decode(data)
-    with temporary_directory(dir=HOME, prefix='.kitty-ssh-kitten-untar-') as tdir, tarfile.open(fileobj=io.BytesIO(data)) as tf:
+    global data_dir, shell_integration_dir, leading_data, terminfo_fallback
+    if data_file:
+        try:
+            with open(data_file, 'rb') as f:
+                data = f.read()
+        except OSError as err:
+            raise SystemExit('Failed to read SSH data from {} with error: {}'.format(data_file, err))
+        finally:
+            try:
+                os.remove(data_file)
+            except OSError:
+                pass
+    else:
+        data = b''.join(iter_base64_data(tty_file_obj))
+        if leading_data:
+            # clear current line as it might have things echoed on it from leading_data
+            # because we only turn off echo in this script whereas the leading bytes could
+            # have been sent before the script had a chance to run
+            sys.stdout.write('\r\033[K')
+        data = base64.standard_b64decode(data)
+        if not data:
+            data_transfer_failed('Failed to read SSH data from tty')
+    # if HOME is read-only, the terminfo and shell integration cannot be installed
+    home_is_writable = os.access(HOME, os.W_OK)
+    tdir_parent = HOME if home_is_writable else tempfile.gettempdir()
+    with temporary_directory(dir=tdir_parent, prefix='.kitty-ssh-kitten-untar-') as tdir, tarfile.open(fileobj=io.BytesIO(data)) as tf:
         tf.extractall(tdir)
         with open(tdir + '/data.sh') as f:
             env_vars = f.read()
@@ -219,10 +299,25 @@ def get_data():
                 data_dir = os.path.join(HOME, data_dir)
             data_dir = os.path.abspath(data_dir)
             shell_integration_dir = os.path.join(data_dir, 'shell-integration')
+            terminfo_fallback = os.environ.pop('KITTY_TERMINFO_FALLBACK', '')
+            payload_version = os.environ.pop('KITTY_SSH_KITTEN_PAYLOAD_VERSION', '')
+            payload_sent = os.environ.pop('KITTY_SSH_KITTEN_PAYLOAD_SENT', '')
+            payload_confirmation = os.environ.pop('KITTY_SSH_KITTEN_PAYLOAD_CONFIRMATION', '')
             compile_terminfo(tdir + '/home')
-            move(tdir + '/home', HOME)
+            # only the changed runtime files are sent, check that the rest are
+            # installed before installing them
+            if not payload_is_installed(payload_version, home_is_writable):
+                payload_missing()
+            if home_is_writable and os.path.exists(tdir + '/home'):
+                move(tdir + '/home', HOME)
             if os.path.exists(tdir + '/root'):
                 move(tdir + '/root', '/')
+    if payload_confirmation and payload_is_installed(payload_sent, home_is_writable):
+        # let the kitten know the runtime files were installed, so that they are not sent again
+        send_to_kitty(dcs_to_kitty(payload_confirmation))
+    check_terminfo()
+    if not os.path.isdir(shell_integration_dir):
+        shell_integration_dir = ''
 
 
 def exec_zsh_with_integration():
@@ -249,6 +344,28 @@ def exec_fish_with_integration():
     os.execlp(login_shell, os.path.basename(login_shell), '-l')
 
 
+def exec_nu_with_integration():
+    if not os.environ.get('XDG_DATA_DIRS'):
+        os.environ['XDG_DATA_DIRS'] = shell_integration_dir
+    else:
+        os.environ['XDG_DATA_DIRS'] = shell_integration_dir + ':' + os.environ['XDG_DATA_DIRS']
+    os.environ['KITTY_NU_XDG_DATA_DIR'] = shell_integration_dir
+    os.execlp(login_shell, os.path.basename(login_shell), '-l')
+
+
+def exec_xonsh_with_integration():
+    rc_dir = shell_integration_dir + '/xonsh'
+    if 'XONSHRC_DIR' in os.environ:
+        os.environ['KITTY_XONSH_ORIG_XONSHRC_DIR'] = os.environ['XONSHRC_DIR']
+        os.environ['XONSHRC_DIR'] += ':' + rc_dir
+    else:
+        # the default value used by xonsh
+        xdg_config_home = os.environ.get('XDG_CONFIG_HOME') or os.path.join(HOME, '.config')
+        os.environ['XONSHRC_DIR'] = ':'.join(('/etc/xonsh/rc.d', xdg_config_home + '/xonsh/rc.d', rc_dir))
+    os.environ['KITTY_XONSH_RC_DIR'] = rc_dir
+    os.execlp(login_shell, os.path.basename(login_shell), '-l')
+
+
 def exec_bash_with_integration():
     os.environ['ENV'] = os.path.join(shell_integration_dir, 'bash', 'kitty.bash')
     os.environ['KITTY_BASH_INJECT'] = '1'
@@ -266,6 +383,10 @@ def exec_with_shell_integration():
         exec_fish_with_integration()
     if shell_name == 'bash':
         exec_bash_with_integration()
+    if shell_name == 'nu':
+        exec_nu_with_integration()
+    if shell_name == 'xonsh':
+        exec_xonsh_with_integration()
 
 
 def install_kitty_bootstrap():
@@ -302,7 +423,7 @@ def main():
         cmd = base64.standard_b64decode(exec_cmd).decode('utf-8')
         os.execlp(login_shell, os.path.basename(login_shell), '-c', cmd)
     TEST_SCRIPT  # noqa
-    if ksi and 'no-rc' not in ksi:
+    if ksi and 'no-rc' not in ksi and shell_integration_dir:
         exec_with_shell_integration()
     os.environ.pop('KITTY_SHELL_INTEGRATION', None)
     os.execlp(login_shell, '-' + os.path.basename(login_shell))
@@ -15,6 +15,10 @@ cleanup_on_bootstrap_exit() {
 }
 
 die() { printf "\033[31m%s\033[m\n\r" "$*" > /dev/stderr; cleanup_on_bootstrap_exit; exit 1; }
+# use a special exit code so the kitten can retry sending the data via SFTP
+data_transfer_failed() { printf "\033[31m%s\033[m\n\r" "$*" > /dev/stderr; cleanup_on_bootstrap_exit; exit DATA_TRANSFER_FAILED_EXIT_CODE; }
+# use a special exit code so the kitten can send the kitty runtime files again
+payload_missing() { cleanup_on_bootstrap_exit; exit PAYLOAD_MISSING_EXIT_CODE; }
 
 python_detected="0"
 detect_python() {
@@ -66,6 +70,11 @@ dcs_to_kitty() { printf "\033P@kitty-$1|%s\033\134" "$(printf "%s" "$2" | base64
 debug() { dcs_to_kitty "print" "debug: $1"; }
 echo_via_kitty() { dcs_to_kitty "echo" "$1"; }
 
+# Data uploaded via SFTP is relative to the directory the session starts in,
+# which is the home directory of the user
+data_file="DATA_FILE"
+[ -n "$data_file" ] && data_file="$(pwd)/$data_file"
+
 # If $HOME is configured set it here
 EXPORT_HOME_CMD
 # ensure $HOME is set
@@ -96,12 +105,25 @@ untar_and_read_env() {
     # extract the tar file atomically, in the sense that any file from the
     # tarfile is only put into place after it has been fully written to disk
     command -v tar > /dev/null 2> /dev/null || die "tar is not available on this server. The ssh kitten requires tar."
-    tdir=$(command mktemp -d "$HOME/.kitty-ssh-kitten-untar-XXXXXXXXXXXX")
-    [ $? = 0 ] || die "Creating temp directory failed"
+    home_is_writable="y"
+    tdir=$(command mktemp -d "$HOME/.kitty-ssh-kitten-untar-XXXXXXXXXXXX" 2> /dev/null)
+    if [ $? != 0 ]; then
+        # HOME is read-only, the terminfo and shell integration cannot be installed
+        home_is_writable="n"
+        tdir=$(command mktemp -d "${TMPDIR:-/tmp}/kitty-ssh-kitten-untar-XXXXXXXXXXXX")
+        [ $? = 0 ] || die "Creating temp directory failed"
+    fi
     # suppress STDERR for tar as tar prints various warnings if for instance, timestamps are in the future
     old_umask=$(umask)
     umask 000
-    read_base64_from_tty | base64_decode | command tar "xpzf" "-" "-C" "$tdir" 2> /dev/null
+    if [ -n "$data_file" ]; then
+        command tar "xpzf" "$data_file" "-C" "$tdir" 2> /dev/null
+        command rm -f "$data_file"
+        [ -f "$tdir/data.sh" ] || die "Failed to read SSH data from $data_file"
+    else
+        read_base64_from_tty | base64_decode | command tar "xpzf" "-" "-C" "$tdir" 2> /dev/null
+        [ -f "$tdir/data.sh" ] || data_transfer_failed "Failed to read SSH data from tty"
+    fi
     umask "$old_umask"
     . "$tdir/bootstrap-utils.sh"
     . "$tdir/data.sh"
@@ -118,14 +140,31 @@ untar_and_read_env() {
     unset KITTY_LOGIN_CWD
     kitty_remote="$KITTY_REMOTE"
     unset KITTY_REMOTE
+    terminfo_fallback="$KITTY_TERMINFO_FALLBACK"
+    unset KITTY_TERMINFO_FALLBACK
+    payload_version="$KITTY_SSH_KITTEN_PAYLOAD_VERSION"
+    payload_sent="$KITTY_SSH_KITTEN_PAYLOAD_SENT"
+    payload_confirmation="$KITTY_SSH_KITTEN_PAYLOAD_CONFIRMATION"
+    unset KITTY_SSH_KITTEN_PAYLOAD_VERSION KITTY_SSH_KITTEN_PAYLOAD_SENT KITTY_SSH_KITTEN_PAYLOAD_CONFIRMATION
     compile_terminfo "$tdir/home"
-    mv_files_and_dirs "$tdir/home" "$HOME"
+    # only the changed runtime files are sent, check that the rest are
+    # installed before installing them
+    payload_is_installed "$payload_version" || payload_missing
+    [ "$home_is_writable" = "y" -a -e "$tdir/home" ] && mv_files_and_dirs "$tdir/home" "$HOME"
     [ -e "$tdir/root" ] && mv_files_and_dirs "$tdir/root" ""
     command rm -rf "$tdir"
     tdir=""
+    # let the kitten know the runtime files were installed, so that they are not sent again
+    [ -n "$payload_confirmation" ] && payload_is_installed "$payload_sent" && dcs_to_kitty "ssh" "$payload_confirmation"
+    check_terminfo
+    [ -d "$shell_integration_dir" ] || shell_integration_dir=""
 }
 
 get_data() {
+    if [ -n "$data_file" ]; then
+        untar_and_read_env
+        return
+    fi
     started="n"
     while IFS= read -r line; do
         if [ "$started" = "y" ]; then
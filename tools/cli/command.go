@@ -185,24 +185,31 @@ func (self *Command) CommandStringForUsage() string {
 }
 
 func (self *Command) ParseArgs(args []string) (*Command, error) {
+	cmd, _, err := self.parse_args_with_defaults(args, nil)
+	return cmd, err
+}
+
+// Also returns the errors in option_defaults, the defaults of commands with
+// invalid defaults are ignored
+func (self *Command) parse_args_with_defaults(args []string, option_defaults map[string][]string) (*Command, []error, error) {
 	for ; self.Parent != nil; self = self.Parent {
 	}
 	err := self.Validate()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if args == nil {
 		args = os.Args
 	}
 	if len(args) < 1 {
-		return nil, &ParseError{Message: "At least one arg must be supplied"}
+		return nil, nil, &ParseError{Message: "At least one arg must be supplied"}
 	}
-	ctx := Context{SeenCommands: make([]*Command, 0, 4)}
+	ctx := Context{SeenCommands: make([]*Command, 0, 4), OptionDefaults: option_defaults}
 	err = self.parse_args(&ctx, args[1:])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return ctx.SeenCommands[len(ctx.SeenCommands)-1], nil
+	return ctx.SeenCommands[len(ctx.SeenCommands)-1], ctx.OptionDefaultsErrors, nil
 }
 
 func (self *Command) ResetAfterParseArgs() {
@@ -450,6 +457,10 @@ func (self *Command) FindOption(name_with_hyphens string) *Option {
 
 type Context struct {
 	SeenCommands []*Command
+	// Default options for commands, keyed by section name, from kittens.conf
+	OptionDefaults map[string][]string
+	// Errors in OptionDefaults, they do not prevent the command from running
+	OptionDefaultsErrors []error
 }
 
 func GetOptionValue[T any](self *Command, name string) (ans T, err error) {
@@ -529,7 +540,15 @@ func (self *Command) ExecArgs(args []string) (exit_code int) {
 	for root.Parent != nil {
 		root = root.Parent
 	}
-	cmd, err := root.ParseArgs(args)
+	// a broken kittens.conf must not prevent kittens from running
+	option_defaults, err := load_option_defaults(KittensConfPath())
+	if err != nil {
+		ShowWarning(fmt.Errorf("Not using the default options for kittens: %w", err))
+	}
+	cmd, defaults_errors, err := root.parse_args_with_defaults(args, option_defaults)
+	for _, e := range defaults_errors {
+		ShowWarning(e)
+	}
 	if err != nil {
 		if self.CallbackOnError != nil {
 			return self.CallbackOnError(cmd, err, true, 1)
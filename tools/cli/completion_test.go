@@ -0,0 +1,56 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestCompletionSerializers(t *testing.T) {
+	c := NewCompletions()
+	mg := c.AddMatchGroup("Options")
+	mg.AddMatch("--help", "Show :bold:`help`")
+	mg.AddMatch("--title")
+	mg = c.AddMatchGroup("Files")
+	mg.IsFiles = true
+	mg.AddMatch("it's a file")
+	completions := []*Completions{c}
+
+	out, err := nushell_output_serializer(completions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`[{"value":"--help","description":"Show help"},{"value":"--title"},{"value":"\"it's a file\""}]`, string(out)); diff != "" {
+		t.Fatalf("Unexpected nushell completions:\n%s", diff)
+	}
+	out, err = powershell_output_serializer(completions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "--help\t--help\tParameterValue\tShow help\n--title\t--title\tParameterValue\t--title\n'it''s a file'\tit's a file\tProviderItem\tit's a file\n"
+	if diff := cmp.Diff(expected, string(out)); diff != "" {
+		t.Fatalf("Unexpected PowerShell completions:\n%s", diff)
+	}
+
+	c.Delegate.NumToRemove = 1
+	if out, _ = nushell_output_serializer(completions, nil); string(out) != "null" {
+		t.Fatalf("Delegated nushell completion not null: %#v", string(out))
+	}
+
+	argv, err := input_parsers["powershell"]([]byte("kitty\n--ti\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{"kitty", "--ti"}}, argv); diff != "" {
+		t.Fatalf("Unexpected PowerShell words:\n%s", diff)
+	}
+	argv, _ = input_parsers["powershell"]([]byte("kitty\n\n"), nil)
+	if diff := cmp.Diff([][]string{{"kitty", ""}}, argv); diff != "" {
+		t.Fatalf("Unexpected PowerShell words:\n%s", diff)
+	}
+}
@@ -0,0 +1,124 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/shlex"
+)
+
+var _ = fmt.Print
+
+// The file from which default values for the options of commands are read
+func KittensConfPath() string {
+	return filepath.Join(utils.ConfigDir(), "kittens.conf")
+}
+
+// Parse the default options for commands from a file with one section per
+// command, for example:
+//
+//	[icat]
+//	--scale-up --align=left
+//
+//	[@ launch]
+//	--type=tab
+//
+// Section names are commands without the name of the program. The lines in
+// a section are options, as they would be specified on the command line. Lines
+// starting with # are comments. Returns the options, split into words, for
+// each command.
+func ParseOptionDefaults(data string, path string) (map[string][]string, error) {
+	ans := make(map[string][]string)
+	section := ""
+	for i, line := range utils.Splitlines(data) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if section == "" {
+				return nil, fmt.Errorf("Empty section name at line %d of %s", i+1, path)
+			}
+			continue
+		}
+		if section == "" {
+			return nil, fmt.Errorf("The options at line %d of %s are not in a section", i+1, path)
+		}
+		words, err := shlex.Split(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid line %d in %s with error: %w", i+1, path, err)
+		}
+		ans[section] = append(ans[section], words...)
+	}
+	return ans, nil
+}
+
+func load_option_defaults(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ParseOptionDefaults(utils.UnsafeBytesToString(data), path)
+}
+
+// The name of the section in kittens.conf for this command
+func (self *Command) section_name() string {
+	names := []string{}
+	for p := self; p.Parent != nil; p = p.Parent {
+		names = append(names, p.Name)
+	}
+	return strings.Join(utils.Reverse(names), " ")
+}
+
+// Parse the default options for this command, they are used for options not
+// specified on the command line. Hidden commands, which are run by kitty and
+// kittens themselves, have no defaults. If the defaults are invalid, none of
+// them are used.
+func (self *Command) apply_option_defaults(defaults map[string][]string) error {
+	args := defaults[self.section_name()]
+	if len(args) == 0 || self.Hidden {
+		return nil
+	}
+	opts := self.AllOptions()
+	before := make([]int, len(opts))
+	for i, o := range opts {
+		before[i] = len(o.values_from_cmdline)
+	}
+	saved_args := self.Args
+	self.Args = make([]string, 0, 8)
+	ctx := Context{SeenCommands: make([]*Command, 0, 4)}
+	err := self.parse_args(&ctx, args)
+	if err == nil {
+		if len(ctx.SeenCommands) > 1 {
+			sc := ctx.SeenCommands[1]
+			sc.ResetAfterParseArgs()
+			err = fmt.Errorf("Only options are allowed, not the sub-command: %s", sc.Name)
+		} else if len(self.Args) > 0 {
+			err = fmt.Errorf("Only options are allowed, not: %s", self.Args[0])
+		}
+	}
+	self.Args = saved_args
+	for i, o := range opts {
+		n := before[i]
+		if err == nil {
+			o.values_from_config = append(o.values_from_config, o.values_from_cmdline[n:]...)
+			o.parsed_values_from_config = append(o.parsed_values_from_config, o.parsed_values_from_cmdline[n:]...)
+		}
+		o.values_from_cmdline, o.parsed_values_from_cmdline = o.values_from_cmdline[:n], o.parsed_values_from_cmdline[:n]
+	}
+	if err != nil {
+		return &ParseError{Message: fmt.Sprintf("Ignoring the invalid default options for :yellow:`%s` in %s: %s", self.section_name(), KittensConfPath(), err)}
+	}
+	return nil
+}
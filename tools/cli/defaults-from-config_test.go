@@ -0,0 +1,112 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestOptionDefaultsFromConfig(t *testing.T) {
+	defaults, err := ParseOptionDefaults("# comment\n[icat]\n--scale-up --align 'left'\n\n[  @   launch ]\n--type=tab\n[icat]\n-n", "kittens.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"icat": {"--scale-up", "--align", "left", "-n"}, "@ launch": {"--type=tab"}}
+	if diff := cmp.Diff(expected, defaults); diff != "" {
+		t.Fatalf("Unexpected defaults:\n%s", diff)
+	}
+	if _, err = ParseOptionDefaults("--scale-up\n[icat]", "kittens.conf"); err == nil {
+		t.Fatalf("No error for options outside a section")
+	}
+
+	root := NewRootCommand()
+	root.Name = "kitten"
+	icat := root.AddSubCommand(&Command{Name: "icat"})
+	icat.Add(OptionSpec{Name: "--scale-up", Type: "bool-set"})
+	icat.Add(OptionSpec{Name: "--align", Default: "center", Choices: "center, left, right"})
+	icat.Add(OptionSpec{Name: "--place", Type: "list"})
+	icat.Add(OptionSpec{Name: "-n", Type: "count"})
+	icat.Add(OptionSpec{Name: "--other", Default: "x"})
+
+	type options struct {
+		ScaleUp bool
+		Align   string
+		Place   []string
+		N       int
+		Other   string
+	}
+	parse_with_warnings := func(conf string, args ...string) (ans options, warnings []error, err error) {
+		defer root.ResetAfterParseArgs()
+		d, err := ParseOptionDefaults(conf, "kittens.conf")
+		if err != nil {
+			return
+		}
+		cmd, warnings, err := root.parse_args_with_defaults(append([]string{"kitten", "icat"}, args...), d)
+		if err != nil {
+			return
+		}
+		err = cmd.GetOptionValues(&ans)
+		return
+	}
+	parse := func(conf string, args ...string) (ans options, err error) {
+		ans, warnings, err := parse_with_warnings(conf, args...)
+		if err == nil && len(warnings) > 0 {
+			err = warnings[0]
+		}
+		return
+	}
+	conf := "[icat]\n--scale-up --align left --place a --place b -nn"
+	for _, x := range []struct {
+		conf     string
+		args     []string
+		expected options
+	}{
+		{"", nil, options{Align: "center", Place: []string{}, Other: "x"}},
+		{conf, nil, options{ScaleUp: true, Align: "left", Place: []string{"a", "b"}, N: 2, Other: "x"}},
+		{conf, []string{"--align=right", "--place", "c", "-n", "--other", "y"}, options{ScaleUp: true, Align: "right", Place: []string{"c"}, N: 1, Other: "y"}},
+		{"[other]\n--scale-up", nil, options{Align: "center", Place: []string{}, Other: "x"}},
+	} {
+		actual, err := parse(x.conf, x.args...)
+		if err != nil {
+			t.Fatalf("Failed to parse args: %#v with config: %#v with error: %s", x.args, x.conf, err)
+		}
+		if diff := cmp.Diff(x.expected, actual); diff != "" {
+			t.Fatalf("Unexpected option values for args: %#v with config: %#v\n%s", x.args, x.conf, diff)
+		}
+	}
+	// invalid defaults are ignored with a warning
+	for _, conf := range []string{"[icat]\n--unknown", "[icat]\nsome-file", "[icat]\n--align=top", "[icat]\n--scale-up --align=top"} {
+		actual, warnings, err := parse_with_warnings(conf, "-n")
+		if err != nil {
+			t.Fatalf("Invalid config: %#v prevented parsing with error: %s", conf, err)
+		}
+		if len(warnings) != 1 {
+			t.Fatalf("No warning for invalid config: %#v", conf)
+		}
+		if diff := cmp.Diff(options{Align: "center", Place: []string{}, N: 1, Other: "x"}, actual); diff != "" {
+			t.Fatalf("Invalid config: %#v was not ignored\n%s", conf, diff)
+		}
+	}
+	// hidden commands have no defaults
+	icat.Hidden = true
+	if actual, err := parse(conf); err != nil || actual.ScaleUp {
+		t.Fatalf("Defaults used for a hidden command: %v %#v", err, actual)
+	}
+	icat.Hidden = false
+	// kittens.conf is not used by ParseArgs()
+	if _, err := parse(conf); err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := root.ParseArgs([]string{"kitten", "icat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetOptionValue[bool](cmd, "ScaleUp"); v {
+		t.Fatalf("Defaults from config were not reset")
+	}
+}
@@ -0,0 +1,329 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kitty"
+	"kitty/tools/cli/markup"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+type doc_block_type int
+
+const (
+	paragraph_block doc_block_type = iota
+	list_item_block
+	code_block
+)
+
+type doc_block struct {
+	block_type doc_block_type
+	text       string
+}
+
+// Split RST help text into paragraphs, list items and code blocks. Lines of
+// paragraphs and list items are joined.
+func help_blocks(raw string) []doc_block {
+	ans := []doc_block{}
+	var current []string
+	current_type := paragraph_block
+	code_indent := -1
+	finish := func() {
+		if len(current) == 0 {
+			return
+		}
+		if current_type == code_block {
+			for len(current) > 0 && current[len(current)-1] == "" {
+				current = current[:len(current)-1]
+			}
+			ans = append(ans, doc_block{code_block, strings.Join(current, "\n")})
+		} else {
+			ans = append(ans, doc_block{current_type, strings.Join(current, " ")})
+		}
+		current = nil
+	}
+	start_code_block := false
+	for _, line := range utils.Splitlines(raw) {
+		indent := indent_of_line(line)
+		stripped := strings.TrimSpace(line)
+		if current_type == code_block && code_indent > -1 {
+			if stripped == "" {
+				current = append(current, "")
+				continue
+			}
+			if indent >= code_indent {
+				current = append(current, line[code_indent:])
+				continue
+			}
+			finish()
+			current_type, code_indent = paragraph_block, -1
+		}
+		switch {
+		case stripped == "":
+			finish()
+			if start_code_block {
+				current_type, start_code_block = code_block, false
+			} else {
+				current_type = paragraph_block
+			}
+			continue
+		case current_type == code_block:
+			// the first line of a code block sets its indent
+			code_indent = indent
+			current = append(current, line[code_indent:])
+			continue
+		case strings.HasPrefix(stripped, ".. code::"):
+			finish()
+			start_code_block = true
+			continue
+		case strings.HasPrefix(stripped, "* ") || strings.HasPrefix(stripped, "- ") || strings.HasPrefix(stripped, "#. "):
+			finish()
+			_, stripped, _ = strings.Cut(stripped, " ")
+			current_type = list_item_block
+		}
+		if strings.HasSuffix(stripped, "::") {
+			// In RST, "text::" is displayed as "text:" followed by a code block
+			stripped = strings.TrimSpace(strings.TrimSuffix(stripped, ":"))
+			if stripped == ":" {
+				stripped = ""
+			}
+			start_code_block = true
+		}
+		if stripped != "" {
+			current = append(current, stripped)
+		}
+	}
+	finish()
+	return ans
+}
+
+func (self *Command) doc_name() string {
+	return strings.ReplaceAll(strings.TrimSpace(self.CommandStringForUsage()), " ", "-")
+}
+
+func (self *Command) visible_subcommands() []*Command {
+	ans := []*Command{}
+	for _, g := range self.SubCommandGroups {
+		for _, c := range g.SubCommands {
+			if !c.Hidden {
+				ans = append(ans, c)
+			}
+		}
+	}
+	return ans
+}
+
+// The commands whose documentation is linked to from the documentation of
+// this command, its parent and sub-commands
+func (self *Command) related_commands() []*Command {
+	ans := []*Command{}
+	if self.Parent != nil {
+		ans = append(ans, self.Parent)
+	}
+	return append(ans, self.visible_subcommands()...)
+}
+
+func (self *Command) option_default(opt *Option) string {
+	switch opt.OptionType {
+	case BoolOption, CountOption:
+		return ""
+	case StringOption:
+		if opt.IsList {
+			return ""
+		}
+	}
+	return opt.Default
+}
+
+func (self *Command) help_text() string {
+	if self.HelpText != "" {
+		return self.HelpText
+	}
+	return self.ShortDescription
+}
+
+// The documentation of this command in markdown. Sub-commands and the parent
+// command are linked to as files named after their commands, with the .md
+// extension, as written by GenerateDocs().
+func (self *Command) Markdown() string {
+	buf := strings.Builder{}
+	w := func(format string, args ...any) { fmt.Fprintf(&buf, format+"\n", args...) }
+	w("# %s\n", markup.ToMarkdown(self.CommandStringForUsage()))
+	if self.ShortDescription != "" {
+		w("%s\n", markup.ToMarkdown(self.ShortDescription))
+	}
+	w("## Usage\n")
+	w("```\n%s %s\n```\n", self.CommandStringForUsage(), markup.New(false).Prettify(self.Usage))
+	write_blocks := func(raw string) {
+		in_list := false
+		for _, b := range help_blocks(raw) {
+			if in_list && b.block_type != list_item_block {
+				w("")
+			}
+			in_list = b.block_type == list_item_block
+			switch b.block_type {
+			case code_block:
+				w("```\n%s\n```\n", b.text)
+			case list_item_block:
+				w("* %s", markup.ToMarkdown(b.text))
+			default:
+				w("%s\n", markup.ToMarkdown(b.text))
+			}
+		}
+		if in_list {
+			w("")
+		}
+	}
+	if self.HelpText != "" {
+		w("## Description\n")
+		write_blocks(self.HelpText)
+	}
+	link := func(c *Command) string {
+		return fmt.Sprintf("[%s](%s.md)", markup.MarkdownCodeSpan(c.CommandStringForUsage()), c.doc_name())
+	}
+	if subs := self.visible_subcommands(); len(subs) > 0 {
+		w("## Commands\n")
+		for _, c := range subs {
+			w("* %s: %s", link(c), markup.ToMarkdown(c.ShortDescription))
+		}
+		w("")
+	}
+	group_titles, gmap := self.GetVisibleOptions()
+	if len(group_titles) > 0 {
+		w("## Options\n")
+		for _, title := range group_titles {
+			if title != "" {
+				w("### %s\n", markup.ToMarkdown(title))
+			}
+			for _, opt := range gmap[title] {
+				names := utils.Map(func(a Alias) string { return markup.MarkdownCodeSpan(a.String()) }, opt.Aliases)
+				heading := strings.Join(names, ", ")
+				if d := self.option_default(opt); d != "" {
+					heading += " \\[=" + markup.MarkdownCodeSpan(d) + "\\]"
+				}
+				w("#### %s\n", heading)
+				write_blocks(opt.Help)
+				if opt.Choices != nil {
+					w("Choices: %s\n", strings.Join(utils.Map(markup.MarkdownCodeSpan, opt.Choices), ", "))
+				}
+			}
+		}
+	}
+	if related := self.related_commands(); len(related) > 0 {
+		w("## See also\n")
+		for _, c := range related {
+			w("* %s", link(c))
+		}
+		w("")
+	}
+	return strings.TrimRight(buf.String(), "\n") + "\n"
+}
+
+// The documentation of this command as a man page in section 1. Sub-commands
+// and the parent command are referred to by their man page names.
+func (self *Command) ManPage() string {
+	buf := strings.Builder{}
+	w := func(format string, args ...any) { fmt.Fprintf(&buf, format+"\n", args...) }
+	name := self.doc_name()
+	w(`.TH "%s" "1" "" "%s %s" "%s manual"`, strings.ToUpper(markup.EscapeRoff(name)), self.Root().Name, kitty.VersionString, self.Root().Name)
+	w(".SH NAME")
+	if self.ShortDescription != "" {
+		w(`%s \- %s`, markup.EscapeRoff(name), markup.ToRoff(self.ShortDescription))
+	} else {
+		w(`%s`, markup.EscapeRoff(name))
+	}
+	w(".SH SYNOPSIS")
+	w(`\fB%s\fR %s`, markup.EscapeRoff(self.CommandStringForUsage()), markup.EscapeRoff(markup.New(false).Prettify(self.Usage)))
+	// separator is .PP for top level text and .IP for text that must stay
+	// indented, such as the help for options
+	write_blocks := func(raw, separator string) {
+		for i, b := range help_blocks(raw) {
+			if i > 0 {
+				w(separator)
+			}
+			switch b.block_type {
+			case code_block:
+				w(".nf\n.RS 4\n%s\n.RE\n.fi", markup.EscapeRoff(b.text))
+			case list_item_block:
+				w(`.IP \(bu 2`)
+				w("%s", markup.ToRoff(b.text))
+			default:
+				w("%s", markup.ToRoff(b.text))
+			}
+		}
+	}
+	if help := self.help_text(); help != "" {
+		w(".SH DESCRIPTION")
+		write_blocks(help, ".PP")
+	}
+	if subs := self.visible_subcommands(); len(subs) > 0 {
+		w(".SH COMMANDS")
+		for _, c := range subs {
+			w(".TP\n.B %s", markup.EscapeRoff(c.Name))
+			w(`%s See \fB%s\fR(1).`, markup.ToRoff(c.ShortDescription), markup.EscapeRoff(c.doc_name()))
+		}
+	}
+	group_titles, gmap := self.GetVisibleOptions()
+	if len(group_titles) > 0 {
+		w(".SH OPTIONS")
+		for _, title := range group_titles {
+			if title != "" {
+				w(".SS %s", markup.ToRoff(title))
+			}
+			for _, opt := range gmap[title] {
+				names := utils.Map(func(a Alias) string { return `\fB` + markup.EscapeRoff(a.String()) + `\fR` }, opt.Aliases)
+				heading := strings.Join(names, ", ")
+				if d := self.option_default(opt); d != "" {
+					heading += ` [=\fI` + markup.EscapeRoff(d) + `\fR]`
+				}
+				w(".TP\n%s", heading)
+				write_blocks(opt.Help, ".IP")
+				if opt.Choices != nil {
+					w(".IP\nChoices: %s", markup.EscapeRoff(strings.Join(opt.Choices, ", ")))
+				}
+			}
+		}
+	}
+	if related := self.related_commands(); len(related) > 0 {
+		w(".SH SEE ALSO")
+		refs := utils.Map(func(c *Command) string { return `\fB` + markup.EscapeRoff(c.doc_name()) + `\fR(1)` }, related)
+		w("%s", strings.Join(refs, ", "))
+	}
+	return buf.String()
+}
+
+// Write man pages and markdown documentation for this command and all its
+// visible sub-commands, recursively, into the man1 and markdown
+// sub-directories of output_dir
+func (self *Command) GenerateDocs(output_dir string) error {
+	man_dir, md_dir := filepath.Join(output_dir, "man1"), filepath.Join(output_dir, "markdown")
+	for _, d := range []string{man_dir, md_dir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+	}
+	var write func(c *Command) error
+	write = func(c *Command) error {
+		name := c.doc_name()
+		if err := os.WriteFile(filepath.Join(man_dir, name+".1"), utils.UnsafeStringToBytes(c.ManPage()), 0o644); err != nil {
+			return fmt.Errorf("Failed to write the man page for %s with error: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(md_dir, name+".md"), utils.UnsafeStringToBytes(c.Markdown()), 0o644); err != nil {
+			return fmt.Errorf("Failed to write the markdown documentation for %s with error: %w", name, err)
+		}
+		for _, sc := range c.visible_subcommands() {
+			if err := write(sc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return write(self)
+}
@@ -0,0 +1,63 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestGenerateDocs(t *testing.T) {
+	blocks := help_blocks("First\nparagraph::\n\n    code\n      more\n\n* item\n  one\n* item two\n\nLast :code:`x`.")
+	expected := []doc_block{
+		{paragraph_block, "First paragraph:"}, {code_block, "code\n  more"},
+		{list_item_block, "item one"}, {list_item_block, "item two"}, {paragraph_block, "Last :code:`x`."},
+	}
+	if diff := cmp.Diff(expected, blocks, cmp.AllowUnexported(doc_block{})); diff != "" {
+		t.Fatalf("Unexpected help blocks:\n%s", diff)
+	}
+
+	root := NewRootCommand()
+	root.Name = "tool"
+	child := root.AddSubCommand(&Command{Name: "child", ShortDescription: "A child", HelpText: "Use :option:`tool child --mode` and :code:`*`.", Usage: "[file]"})
+	child.Add(OptionSpec{Name: "--mode -m", Default: "fast", Choices: "fast, slow", Help: "The mode"})
+	root.AddSubCommand(&Command{Name: "secret", Hidden: true})
+	if err := root.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	md := child.Markdown()
+	for _, q := range []string{"# tool child\n", "```\ntool child [file]\n```", "Use `--mode` and `*`.", "#### `--mode`, `-m` \\[=`fast`\\]", "Choices: `fast`, `slow`", "* [`tool`](tool.md)"} {
+		if !strings.Contains(md, q) {
+			t.Fatalf("%#v not found in markdown:\n%s", q, md)
+		}
+	}
+	man := child.ManPage()
+	for _, q := range []string{`.TH "TOOL\-CHILD" "1"`, `tool\-child \- A child`, `Use \fB\-\-mode\fR and \fB*\fR.`, `\fB\-\-mode\fR, \fB\-m\fR [=\fIfast\fR]`, `\fBtool\fR(1)`} {
+		if !strings.Contains(man, q) {
+			t.Fatalf("%#v not found in man page:\n%s", q, man)
+		}
+	}
+
+	tdir := t.TempDir()
+	if err := root.GenerateDocs(tdir); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"man1/tool.1", "man1/tool-child.1", "markdown/tool.md", "markdown/tool-child.md"} {
+		if _, err := os.Stat(filepath.Join(tdir, q)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tdir, "man1", "tool-secret.1")); err == nil {
+		t.Fatalf("Documentation generated for hidden command")
+	}
+	if !strings.Contains(root.Markdown(), "* [`tool child`](tool-child.md): A child") {
+		t.Fatalf("Sub-command not linked to in:\n%s", root.Markdown())
+	}
+}
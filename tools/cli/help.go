@@ -25,6 +25,12 @@ func ShowError(err error) {
 	fmt.Fprintln(os.Stderr, formatter.Err("Error")+":", msg)
 }
 
+func ShowWarning(err error) {
+	formatter := markup.New(tty.IsTerminal(os.Stderr.Fd()))
+	msg := formatter.Prettify(err.Error())
+	fmt.Fprintln(os.Stderr, formatter.Yellow("Warning")+":", msg)
+}
+
 func (self *Command) version_string(formatter *markup.Context) string {
 	return fmt.Sprintln(formatter.Italic(self.CommandStringForUsage()), formatter.Opt(kitty.VersionString), "created by", formatter.Title("Kovid Goyal"))
 }
@@ -0,0 +1,186 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package markup
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The URL on the kitty website for a reference, such as the target of the
+// :ref: or :doc: roles. prefix is the kind of reference: doc-, envvar-,
+// term-, action-, issues-, pull- or discussions-, or empty for :ref:
+func ResolveRef(prefix, target string) string {
+	ref := prefix + target
+	href := kitty.RefMap[ref]
+	if href == "" {
+		switch prefix {
+		case "doc-":
+			href = strings.Trim(target, "/") + "/"
+		case "envvar-", "term-":
+			href = "glossary/#" + ref
+		case "action-":
+			href = "actions/#" + strings.ReplaceAll(target, "_", "-")
+		case "issues-", "pull-", "discussions-":
+			href = "https://github.com/kovidgoyal/kitty/" + strings.TrimSuffix(prefix, "-") + "/" + target
+		default:
+			switch {
+			case strings.HasPrefix(ref, "conf-kitty-"):
+				href = "conf/#" + ref
+			case strings.HasPrefix(ref, "conf-kitten-"):
+				href = "kittens/" + strings.Split(ref, "-")[2] + "/#" + ref
+			case strings.HasPrefix(ref, "at-") || strings.HasPrefix(ref, "at_"):
+				href = "remote-control/#at-" + strings.ReplaceAll(ref[3:], "_", "-")
+			}
+		}
+	}
+	if !strings.HasPrefix(href, "https://") && !strings.HasPrefix(href, "http://") {
+		href = kitty.WebsiteBaseURL + href
+	}
+	return href
+}
+
+var ref_prefixes = map[string]string{
+	"ref": "", "doc": "doc-", "env": "envvar-", "envvar": "envvar-", "term": "term-", "ac": "action-",
+	"iss": "issues-", "pull": "pull-", "disc": "discussions-",
+}
+
+// Call plain for the text between roles and role for each role, returning
+// the concatenation of the results
+func convert_rst_roles(text string, plain func(string) string, role func(rst_format_match) string) string {
+	pat := utils.MustCompile(":(?P<role>[a-z]+):(?:(?:`(?P<payload>[^`]+)`)|(?:'(?P<payload>[^']+)'))")
+	buf := strings.Builder{}
+	buf.Grow(len(text) + 64)
+	prev := 0
+	for _, m := range pat.FindAllStringSubmatchIndex(text, -1) {
+		buf.WriteString(plain(text[prev:m[0]]))
+		r := rst_format_match{role: text[m[2]:m[3]]}
+		if m[4] > -1 {
+			r.payload = text[m[4]:m[5]]
+		} else {
+			r.payload = text[m[6]:m[7]]
+		}
+		buf.WriteString(role(r))
+		prev = m[1]
+	}
+	buf.WriteString(plain(text[prev:]))
+	return buf.String()
+}
+
+// Returns the text and URL for roles that are references
+func ref_for_role(r rst_format_match) (text, url string, is_ref bool) {
+	prefix, is_ref := ref_prefixes[r.role]
+	if !is_ref {
+		return
+	}
+	text, target := text_and_target(r.payload)
+	if r.role == "doc" && text == target {
+		if title, ok := kitty.DocTitleMap[strings.Trim(target, "/")]; ok {
+			text = title
+		}
+	}
+	text = replace_all_rst_roles(text, func(group rst_format_match) string { return group.payload })
+	return text, ResolveRef(prefix, target), true
+}
+
+func option_name_for_role(payload string) string {
+	idx := strings.LastIndex(payload, "--")
+	if idx < 0 {
+		idx = strings.Index(payload, "-")
+	}
+	if idx > -1 {
+		payload = strings.TrimSuffix(payload[idx:], ">")
+	}
+	return payload
+}
+
+func escape_markdown(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "#", `\#`).Replace(text)
+}
+
+// Format text as inline code in markdown
+func MarkdownCodeSpan(text string) string {
+	fence := "`"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+// Convert text containing RST roles, as used in help text, to markdown, with
+// references linked to the kitty website
+func ToMarkdown(text string) string {
+	return convert_rst_roles(text, escape_markdown, func(r rst_format_match) string {
+		if text, url, is_ref := ref_for_role(r); is_ref {
+			return "[" + escape_markdown(text) + "](" + url + ")"
+		}
+		switch r.role {
+		case "link":
+			text, url := text_and_target(r.payload)
+			return "[" + escape_markdown(text) + "](" + url + ")"
+		case "code":
+			return MarkdownCodeSpan(remove_backslash_escapes(r.payload))
+		case "option":
+			return MarkdownCodeSpan(option_name_for_role(r.payload))
+		case "opt":
+			return MarkdownCodeSpan(r.payload)
+		case "file", "emph":
+			return "*" + escape_markdown(r.payload) + "*"
+		default:
+			return escape_markdown(r.payload)
+		}
+	})
+}
+
+var roff_chars = strings.NewReplacer(`\`, `\e`, "-", `\-`)
+
+// lines starting with these characters are roff requests
+func protect_roff_lines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Escape text for use in roff, the format of man pages
+func EscapeRoff(text string) string {
+	return protect_roff_lines(roff_chars.Replace(text))
+}
+
+// Convert text containing RST roles, as used in help text, to roff, the
+// format of man pages, with the URLs of references following their text
+func ToRoff(text string) string {
+	bold := func(x string) string { return `\fB` + roff_chars.Replace(x) + `\fR` }
+	italic := func(x string) string { return `\fI` + roff_chars.Replace(x) + `\fR` }
+	return protect_roff_lines(convert_rst_roles(text, roff_chars.Replace, func(r rst_format_match) string {
+		if text, url, is_ref := ref_for_role(r); is_ref {
+			return roff_chars.Replace(text) + " <" + italic(url) + ">"
+		}
+		switch r.role {
+		case "link":
+			text, url := text_and_target(r.payload)
+			return roff_chars.Replace(text) + " <" + italic(url) + ">"
+		case "code":
+			return bold(remove_backslash_escapes(r.payload))
+		case "option":
+			return bold(option_name_for_role(r.payload))
+		case "opt":
+			return bold(r.payload)
+		case "file", "emph":
+			return italic(r.payload)
+		default:
+			return roff_chars.Replace(r.payload)
+		}
+	}))
+}
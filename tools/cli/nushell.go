@@ -0,0 +1,57 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"kitty/tools/cli/markup"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+func nushell_completion_script(commands []string) (string, error) {
+	// Usage: kitten __complete__ setup nushell | save -f kitty-completions.nu
+	// then: source kitty-completions.nu in config.nu
+	// Completion for other commands is passed on to any previously configured external completer
+	return `let __ksi_previous_completer = ($env.config | get -i completions.external.completer)
+
+$env.config = ($env.config | upsert completions.external.enable true | upsert completions.external.completer {|spans|
+    if ($spans.0 in [kitty kitten clone-in-kitty edit-in-kitty]) {
+        # spans are all words up to the cursor, the last one being the word being completed
+        [$spans] | to json | kitten __complete__ nushell | from json
+    } else if $__ksi_previous_completer != null {
+        do $__ksi_previous_completer $spans
+    }
+})
+`, nil
+}
+
+type nushell_match struct {
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
+}
+
+func nushell_output_serializer(completions []*Completions, shell_state map[string]string) ([]byte, error) {
+	if completions[0].Delegate.NumToRemove > 0 {
+		// null makes nushell fall back to completing file names
+		return []byte("null"), nil
+	}
+	fm := markup.New(false)
+	ans := []nushell_match{}
+	for _, mg := range completions[0].Groups {
+		for _, m := range mg.Matches {
+			ans = append(ans, nushell_match{utils.QuoteStringForNushell(m.Word), strings.ReplaceAll(fm.Prettify(m.Description), "\n", " ")})
+		}
+	}
+	return json.Marshal(ans)
+}
+
+func init() {
+	completion_scripts["nushell"] = nushell_completion_script
+	input_parsers["nushell"] = json_input_parser
+	output_serializers["nushell"] = nushell_output_serializer
+}
@@ -61,6 +61,8 @@ type Option struct {
 
 	values_from_cmdline        []string
 	parsed_values_from_cmdline []any
+	values_from_config         []string
+	parsed_values_from_config  []any
 	parsed_default             any
 	seen_option                string
 }
@@ -68,6 +70,8 @@ type Option struct {
 func (self *Option) reset() {
 	self.values_from_cmdline = self.values_from_cmdline[:0]
 	self.parsed_values_from_cmdline = self.parsed_values_from_cmdline[:0]
+	self.values_from_config = nil
+	self.parsed_values_from_config = nil
 	self.seen_option = ""
 }
 
@@ -104,24 +108,30 @@ func NormalizeOptionName(name string) string {
 	return strings.ReplaceAll(strings.TrimLeft(name, "-"), "_", "-")
 }
 
+// Values specified on the command line override values from kittens.conf
+// which override the default
 func (self *Option) parsed_value() any {
-	if len(self.values_from_cmdline) == 0 {
+	parsed_values := self.parsed_values_from_cmdline
+	if len(parsed_values) == 0 {
+		parsed_values = self.parsed_values_from_config
+	}
+	if len(parsed_values) == 0 {
 		return self.parsed_default
 	}
 	switch self.OptionType {
 	case CountOption:
-		return len(self.parsed_values_from_cmdline)
+		return len(parsed_values)
 	case StringOption:
 		if self.IsList {
-			ans := make([]string, len(self.parsed_values_from_cmdline))
-			for i, x := range self.parsed_values_from_cmdline {
+			ans := make([]string, len(parsed_values))
+			for i, x := range parsed_values {
 				ans[i] = x.(string)
 			}
 			return ans
 		}
 		fallthrough
 	default:
-		return self.parsed_values_from_cmdline[len(self.parsed_values_from_cmdline)-1]
+		return parsed_values[len(parsed_values)-1]
 	}
 }
 
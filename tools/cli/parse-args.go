@@ -17,6 +17,9 @@ func (self *Command) parse_args(ctx *Context, args []string) error {
 		self.Args = args
 		return nil
 	}
+	if err := self.apply_option_defaults(ctx.OptionDefaults); err != nil {
+		ctx.OptionDefaultsErrors = append(ctx.OptionDefaultsErrors, err)
+	}
 
 	var expecting_arg_for *Option
 	options_allowed := true
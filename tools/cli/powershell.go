@@ -0,0 +1,61 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/cli/markup"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+func powershell_completion_script(commands []string) (string, error) {
+	// Usage: kitten __complete__ setup powershell | Out-String | Invoke-Expression
+	return `Register-ArgumentCompleter -Native -CommandName kitty,kitten,clone-in-kitty,edit-in-kitty -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    # Send all words before the cursor and the word being completed, one per line
+    $words = @($commandAst.CommandElements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | ForEach-Object { $_.Extent.Text })
+    $words += $wordToComplete
+    $words | kitten __complete__ powershell | ForEach-Object {
+        $text, $list_text, $kind, $tooltip = $_ -split "` + "`" + `t", 4
+        [System.Management.Automation.CompletionResult]::new($text, $list_text, $kind, $tooltip)
+    }
+}
+`, nil
+}
+
+func powershell_output_serializer(completions []*Completions, shell_state map[string]string) ([]byte, error) {
+	output := strings.Builder{}
+	// no completions makes PowerShell fall back to completing file names,
+	// which is the best that can be done for delegated commands
+	if completions[0].Delegate.NumToRemove > 0 {
+		return nil, nil
+	}
+	fm := markup.New(false)
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	for _, mg := range completions[0].Groups {
+		kind := "ParameterValue"
+		if mg.IsFiles {
+			kind = "ProviderItem"
+		}
+		for _, m := range mg.Matches {
+			word := clean.Replace(m.Word)
+			// the tooltip must not be empty
+			tooltip := clean.Replace(fm.Prettify(m.Description))
+			if tooltip == "" {
+				tooltip = word
+			}
+			fmt.Fprintf(&output, "%s\t%s\t%s\t%s\n", utils.QuoteStringForPowerShell(word), word, kind, tooltip)
+		}
+	}
+	return []byte(output.String()), nil
+}
+
+func init() {
+	completion_scripts["powershell"] = powershell_completion_script
+	input_parsers["powershell"] = shell_input_parser
+	output_serializers["powershell"] = powershell_output_serializer
+}
@@ -0,0 +1,81 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"kitty/tools/cli"
+	"kitty/tools/utils"
+	"kitty/tools/utils/shlex"
+)
+
+var _ = fmt.Print
+
+// When set, send_rc_command hands the command to this function instead of
+// sending it to kitty
+var batch_collector func(io_data *rc_io_data) error
+
+func rc_command_for_batch(line string) (ans *utils.RemoteControlCmd, err error) {
+	words, err := shlex.Split(line)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the command: %s with error: %w", line, err)
+	}
+	if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+		return nil, nil
+	}
+	root := cli.NewRootCommand()
+	at_root_command := EntryPoint(root)
+	cmd, err := root.ParseArgs(append([]string{"kitten", "@"}, words...))
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Parent != at_root_command || cmd.Run == nil {
+		return nil, fmt.Errorf("Not a remote control command: %s", line)
+	}
+	if cmd.Name == "batch" {
+		return nil, fmt.Errorf("Batches cannot be nested")
+	}
+	batch_collector = func(io_data *rc_io_data) error {
+		if io_data.rc.Async != "" || io_data.rc.Stream || io_data.streams_responses || io_data.multiple_payload_generator != nil {
+			return fmt.Errorf("The %s command cannot be used in a batch", cmd.Name)
+		}
+		ans = io_data.rc
+		return nil
+	}
+	defer func() { batch_collector = nil }()
+	if _, err = cmd.Run(cmd, cmd.Args); err != nil {
+		return nil, err
+	}
+	if ans == nil {
+		return nil, fmt.Errorf("The %s command cannot be used in a batch", cmd.Name)
+	}
+	return
+}
+
+func parse_batch_commands(args []string) (ans []*utils.RemoteControlCmd, err error) {
+	lines := args
+	if len(lines) == 0 {
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read commands from STDIN with error: %w", err)
+		}
+		lines = utils.Splitlines(utils.UnsafeBytesToString(raw))
+	}
+	for _, line := range lines {
+		rc, err := rc_command_for_batch(line)
+		if err != nil {
+			return nil, err
+		}
+		if rc != nil {
+			ans = append(ans, rc)
+		}
+	}
+	if len(ans) == 0 {
+		return nil, fmt.Errorf("No commands specified")
+	}
+	return
+}
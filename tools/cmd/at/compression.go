@@ -0,0 +1,98 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// Payloads and responses larger than this are compressed
+const compression_threshold = 16 * 1024
+
+// The compression algorithms accepted for responses, in order of preference
+const supported_compressions = "zstd,zlib"
+
+// The compression algorithms kitty accepts for payloads, as advertised in its
+// responses. Empty until a response is received, since older versions of kitty
+// fail on compressed payloads without responding.
+var kitty_payload_compressions = ""
+
+func note_payload_compressions(r *Response) {
+	if r.AcceptsPayloadCompression != "" {
+		kitty_payload_compressions = r.AcceptsPayloadCompression
+	}
+}
+
+// Return the command to send, with the payload compressed if it is large and
+// kitty has advertised that it accepts compressed payloads
+func compressed_rc(rc *utils.RemoteControlCmd) *utils.RemoteControlCmd {
+	if rc.Payload == nil || rc.PayloadCompression != "" || !slices.Contains(strings.Split(kitty_payload_compressions, ","), "zlib") {
+		return rc
+	}
+	data, err := json.Marshal(rc.Payload)
+	if err != nil || len(data) < compression_threshold {
+		return rc
+	}
+	b := bytes.Buffer{}
+	w := zlib.NewWriter(&b)
+	if _, err = w.Write(data); err != nil {
+		return rc
+	}
+	if err = w.Close(); err != nil || b.Len() >= len(data) {
+		return rc
+	}
+	ans := *rc
+	ans.Payload = base64.StdEncoding.EncodeToString(b.Bytes())
+	ans.PayloadCompression = "zlib"
+	return &ans
+}
+
+func (self *Response) decompress() (err error) {
+	if self.Compressed == "" {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(self.Data.as_str)
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	switch self.Compressed {
+	case "zlib":
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("Unsupported compression in response: %s", self.Compressed)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	self.Compressed = ""
+	self.Data = ResponseData{}
+	return json.Unmarshal(data, &self.Data)
+}
@@ -0,0 +1,118 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"kitty/tools/cli"
+)
+
+var _ = fmt.Print
+
+// JSON descriptions of the payload and responses of every command, set by
+// the generated code
+var protocol_descriptions = map[string]string{}
+
+type option_description struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+	Type    string   `json:"type"`
+	Default any      `json:"default,omitempty"`
+	Choices []string `json:"choices,omitempty"`
+	Help    string   `json:"help"`
+}
+
+type command_description struct {
+	Name             string               `json:"name"`
+	Usage            string               `json:"usage"`
+	ShortDescription string               `json:"short_description"`
+	Help             string               `json:"help"`
+	Options          []option_description `json:"options"`
+	Protocol         json.RawMessage      `json:"protocol"`
+}
+
+type commands_description struct {
+	ProtocolVersion [3]int                `json:"protocol_version"`
+	GlobalOptions   []option_description  `json:"global_options"`
+	Commands        []command_description `json:"commands"`
+}
+
+func describe_option(opt *cli.Option) option_description {
+	ans := option_description{Choices: opt.Choices, Help: opt.Help, Aliases: make([]string, len(opt.Aliases))}
+	for i, a := range opt.Aliases {
+		ans.Aliases[i] = a.String()
+	}
+	if len(ans.Aliases) > 0 {
+		ans.Name = ans.Aliases[0]
+	}
+	switch opt.OptionType {
+	case cli.BoolOption:
+		ans.Type = "bool"
+		ans.Default = opt.Default == "true"
+	case cli.CountOption:
+		ans.Type = "count"
+	case cli.IntegerOption:
+		ans.Type = "int"
+		if v, err := strconv.Atoi(opt.Default); err == nil {
+			ans.Default = v
+		}
+	case cli.FloatOption:
+		ans.Type = "float"
+		if v, err := strconv.ParseFloat(opt.Default, 64); err == nil {
+			ans.Default = v
+		}
+	default:
+		ans.Type = "string"
+		if opt.IsList {
+			ans.Type = "list"
+		}
+		if opt.Default != "" {
+			ans.Default = opt.Default
+		}
+	}
+	return ans
+}
+
+func describe_options(cmd *cli.Command) []option_description {
+	ans := []option_description{}
+	for _, group := range cmd.OptionGroups {
+		for _, opt := range group.Options {
+			if !opt.Hidden && opt.Name != "Help" {
+				ans = append(ans, describe_option(opt))
+			}
+		}
+	}
+	return ans
+}
+
+func describe_commands(at_root_command *cli.Command) (ans commands_description) {
+	ans.ProtocolVersion = ProtocolVersion
+	ans.GlobalOptions = describe_options(at_root_command)
+	ans.Commands = []command_description{}
+	for _, group := range at_root_command.SubCommandGroups {
+		for _, cmd := range group.SubCommands {
+			desc, found := protocol_descriptions[cmd.Name]
+			if cmd.Hidden || !found {
+				continue
+			}
+			ans.Commands = append(ans.Commands, command_description{
+				Name: cmd.Name, Usage: cmd.Usage, ShortDescription: cmd.ShortDescription, Help: cmd.HelpText,
+				Options: describe_options(cmd), Protocol: json.RawMessage(desc),
+			})
+		}
+	}
+	return
+}
+
+func print_commands_description(at_root_command *cli.Command) (int, error) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(describe_commands(at_root_command)); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,283 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"kitty/tools/cli"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Remote control commands provided by programs other than kitty. Programs
+// register a command by writing a description of it to the rc-commands
+// directory in the kitty config directory. kitty forwards the command to the
+// socket the program listens on and sends back the response from it.
+
+type ExtensionOption struct {
+	// The option names, for example: --name -n
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Choices string `json:"choices,omitempty"`
+	Default string `json:"default,omitempty"`
+	Help    string `json:"help,omitempty"`
+}
+
+type ExtensionCommand struct {
+	Name             string            `json:"name"`
+	Usage            string            `json:"usage,omitempty"`
+	ShortDescription string            `json:"short_description"`
+	HelpText         string            `json:"help_text,omitempty"`
+	Options          []ExtensionOption `json:"options,omitempty"`
+	// Names to complete the arguments of the command with
+	ArgsChoices []string `json:"args_choices,omitempty"`
+	// The address the program listens on, in the same format as the --to
+	// option, for example: unix:/path/to/socket
+	ListenOn string `json:"listen_on"`
+	// Seconds to wait for a response, defaults to 10
+	ResponseTimeout float64 `json:"response_timeout,omitempty"`
+}
+
+// The command as forwarded to the program by kitty
+type ExtensionRequest struct {
+	Cmd           string `json:"cmd"`
+	KittyWindowId uint   `json:"kitty_window_id,omitempty"`
+	Payload       struct {
+		Options map[string]any `json:"options"`
+		Args    []string       `json:"args"`
+	} `json:"payload"`
+}
+
+type ExtensionHandler = func(req *ExtensionRequest) (response any, err error)
+
+var valid_extension_name = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+func extension_commands_dir() string {
+	return filepath.Join(utils.ConfigDir(), "rc-commands")
+}
+
+func (self *ExtensionCommand) validate() error {
+	if !valid_extension_name.MatchString(self.Name) {
+		return fmt.Errorf("%#v is not a valid command name, names must contain only lowercase letters, numbers and hyphens", self.Name)
+	}
+	if _, found := protocol_descriptions[self.Name]; found {
+		return fmt.Errorf("The name %s is already used by a builtin command", self.Name)
+	}
+	if network, _, err := utils.ParseSocketAddress(self.ListenOn); err != nil {
+		return fmt.Errorf("The address %#v for the command %s is not valid: %w", self.ListenOn, self.Name, err)
+	} else if network == "tls" {
+		return fmt.Errorf("The address %#v for the command %s is not valid: kitty cannot forward commands over TLS", self.ListenOn, self.Name)
+	}
+	for _, o := range self.Options {
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("The option %#v for the command %s is not valid: %w", o.Name, self.Name, err)
+		}
+	}
+	return nil
+}
+
+func (self *ExtensionOption) spec() cli.OptionSpec {
+	return cli.OptionSpec{Name: self.Name, Type: self.Type, Choices: self.Choices, Default: self.Default, Help: self.Help}
+}
+
+func (self *ExtensionOption) validate() error {
+	if !strings.HasPrefix(self.Name, "--") {
+		return fmt.Errorf("The first name of an option must be a long option")
+	}
+	_, err := (&cli.OptionGroup{}).AddOption(nil, self.spec())
+	return err
+}
+
+// Register a remote control command, so that it can be run with kitten @
+// and is forwarded to the program listening on the address of the command
+func RegisterExtensionCommand(cmd *ExtensionCommand) error {
+	if err := cmd.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cmd, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(extension_commands_dir(), 0o755); err != nil {
+		return err
+	}
+	return utils.AtomicUpdateFile(filepath.Join(extension_commands_dir(), cmd.Name+".json"), data, 0o644)
+}
+
+func UnregisterExtensionCommand(name string) error {
+	err := os.Remove(filepath.Join(extension_commands_dir(), name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+func read_extension_commands() (ans []*ExtensionCommand) {
+	entries, err := os.ReadDir(extension_commands_dir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name, found := strings.CutSuffix(e.Name(), ".json")
+		if !found {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(extension_commands_dir(), e.Name()))
+		if err != nil {
+			continue
+		}
+		cmd := ExtensionCommand{}
+		if json.Unmarshal(data, &cmd) != nil || cmd.Name != name || cmd.validate() != nil {
+			continue
+		}
+		ans = append(ans, &cmd)
+	}
+	return
+}
+
+// option_names maps the names of options in the payload to their names in
+// the command
+func extension_payload(cmd *cli.Command, option_names map[string]string, args []string) map[string]any {
+	options := make(map[string]any, len(option_names))
+	for key, name := range option_names {
+		if val, err := cli.GetOptionValue[any](cmd, name); err == nil {
+			options[key] = val
+		}
+	}
+	if args == nil {
+		args = []string{}
+	}
+	return map[string]any{"options": options, "args": args}
+}
+
+func run_extension_command(ecmd *ExtensionCommand, option_names map[string]string, cmd *cli.Command, args []string) (return_code int, err error) {
+	rc := &utils.RemoteControlCmd{
+		Cmd:     ecmd.Name,
+		Version: ProtocolVersion,
+		Payload: extension_payload(cmd, option_names, args),
+	}
+	// the response comes from the program providing the command, so kitty
+	// sends it asynchronously
+	if rc.Async, err = utils.HumanRandomId(128); err != nil {
+		return
+	}
+	timeout := ecmd.ResponseTimeout
+	if timeout <= 0 {
+		timeout = 10
+	}
+	if rt, err := cli.GetOptionValue[float64](cmd, "ResponseTimeout"); err == nil && rt > 0 {
+		timeout = rt
+	}
+	err = send_rc_command(&rc_io_data{
+		cmd: cmd, rc: rc, timeout: time.Duration(timeout * float64(time.Second)),
+	})
+	return
+}
+
+func add_extension_commands(parent *cli.Command) (ans []*cli.Command) {
+	for _, ecmd := range read_extension_commands() {
+		if parent.FindSubCommand(ecmd.Name) != nil {
+			continue
+		}
+		ecmd := ecmd
+		option_names := make(map[string]string, len(ecmd.Options))
+		c := parent.AddSubCommand(&cli.Command{
+			Name:             ecmd.Name,
+			Usage:            ecmd.Usage,
+			ShortDescription: ecmd.ShortDescription,
+			HelpText:         ecmd.HelpText,
+			Run: func(cmd *cli.Command, args []string) (int, error) {
+				return run_extension_command(ecmd, option_names, cmd, args)
+			},
+		})
+		for _, o := range ecmd.Options {
+			opt := c.Add(o.spec())
+			option_names[strings.ReplaceAll(opt.Aliases[0].NameWithoutHyphens, "-", "_")] = opt.Name
+		}
+		if len(ecmd.ArgsChoices) > 0 {
+			c.ArgCompleter = cli.NamesCompleter("Choices", ecmd.ArgsChoices...)
+		}
+		ans = append(ans, c)
+	}
+	return
+}
+
+func handle_extension_conn(conn net.Conn, handlers map[string]ExtensionHandler) {
+	defer conn.Close()
+	response := map[string]any{"ok": false}
+	send_response := func() {
+		data, err := json.Marshal(response)
+		if err == nil {
+			_ = write_many_to_conn(&conn, []byte(cmd_escape_code_prefix), data, []byte(cmd_escape_code_suffix))
+		}
+	}
+	raw, err := read_response_from_conn(&conn, 10*time.Second)
+	if len(raw) == 0 {
+		if err == nil {
+			err = fmt.Errorf("No command received")
+		}
+		response["error"] = err.Error()
+		send_response()
+		return
+	}
+	req := ExtensionRequest{}
+	if err = json.Unmarshal(raw, &req); err != nil {
+		response["error"] = fmt.Sprintf("Invalid command received: %s", err)
+		send_response()
+		return
+	}
+	handler := handlers[req.Cmd]
+	if handler == nil {
+		response["error"] = fmt.Sprintf("Unknown command: %s", req.Cmd)
+		send_response()
+		return
+	}
+	data, err := handler(&req)
+	if err != nil {
+		response["error"] = err.Error()
+	} else {
+		response["ok"] = true
+		if data != nil {
+			response["data"] = data
+		}
+	}
+	send_response()
+}
+
+// Listen on the specified address for commands forwarded by kitty, calling
+// the handler for each command. Does not return unless there is an error.
+func ServeExtensionCommands(address string, handlers map[string]ExtensionHandler) error {
+	network, addr, err := utils.ParseSocketAddress(address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" && !strings.HasPrefix(addr, "@") {
+		// remove a stale socket left behind by a previous instance
+		_ = os.Remove(addr)
+	}
+	if strings.HasPrefix(network, "ip") {
+		network = "tcp" + network[2:]
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handle_extension_conn(conn, handlers)
+	}
+}
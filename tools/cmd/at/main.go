@@ -200,6 +200,13 @@ type Response struct {
 	Data      ResponseData `json:"data,omitempty"`
 	Error     string       `json:"error,omitempty"`
 	Traceback string       `json:"tb,omitempty"`
+	// Set for all but the last of the responses of commands that send
+	// multiple responses
+	More bool `json:"more,omitempty"`
+	// The compression used for data, which is then base64 encoded
+	Compressed string `json:"compressed,omitempty"`
+	// The compression algorithms kitty accepts for payloads
+	AcceptsPayloadCompression string `json:"accepts_payload_compression,omitempty"`
 }
 
 type rc_io_data struct {
@@ -210,10 +217,46 @@ type rc_io_data struct {
 	string_response_is_err     bool
 	timeout                    time.Duration
 	multiple_payload_generator func(io_data *rc_io_data) (bool, error)
+	// Whether kitty sends multiple responses, the text of all but the last of
+	// which is printed as it arrives
+	streams_responses bool
+	// File descriptors to pass to kitty with the command, only possible
+	// over UNIX sockets
+	fds_to_pass []int
+	// Called with the data in the response, instead of printing it
+	handle_response_data func(data string) error
 
 	chunks_done bool
 }
 
+var interrupted_by_user = errors.New("Interrupted by the user")
+
+// Setup to receive multiple responses, until kitty sends the last one or the
+// user interrupts, for commands that keep running. These are async so that
+// they can be cancelled and have no timeout.
+func enable_streamed_responses(io_data *rc_io_data) error {
+	if io_data.rc.Async == "" {
+		async_id, err := utils.HumanRandomId(128)
+		if err != nil {
+			return err
+		}
+		io_data.rc.Async = async_id
+	}
+	io_data.timeout = 0
+	io_data.streams_responses = true
+	return nil
+}
+
+// Return the text to print for a response that is not the last of the
+// responses to a command
+func parse_partial_response(serialized_response []byte) (text string, is_partial bool) {
+	var response Response
+	if err := json.Unmarshal(serialized_response, &response); err != nil || !response.More || response.decompress() != nil {
+		return "", false
+	}
+	return response.Data.as_str, true
+}
+
 func (self *rc_io_data) next_chunk() (chunk []byte, err error) {
 	if self.chunks_done {
 		return make([]byte, 0), nil
@@ -226,22 +269,28 @@ func (self *rc_io_data) next_chunk() (chunk []byte, err error) {
 		if is_last {
 			self.chunks_done = true
 		}
-		return self.serializer(self.rc)
+		return self.serializer(compressed_rc(self.rc))
 	}
 	self.chunks_done = true
-	return self.serializer(self.rc)
+	return self.serializer(compressed_rc(self.rc))
 }
 
 func get_response(do_io func(io_data *rc_io_data) ([]byte, error), io_data *rc_io_data) (ans *Response, err error) {
 	serialized_response, err := do_io(io_data)
 	if err != nil {
-		if errors.Is(err, os.ErrDeadlineExceeded) && io_data.rc.Async != "" {
+		timed_out, interrupted := errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, interrupted_by_user)
+		if (timed_out || interrupted) && io_data.rc.Async != "" {
 			io_data.rc.Payload = nil
 			io_data.rc.CancelAsync = true
 			io_data.multiple_payload_generator = nil
 			io_data.rc.NoResponse = true
+			io_data.streams_responses = false
+			io_data.fds_to_pass = nil
 			io_data.chunks_done = false
 			do_io(io_data)
+			if interrupted {
+				return nil, nil
+			}
 			err = fmt.Errorf("Timed out waiting for a response from kitty")
 		}
 		return
@@ -257,6 +306,10 @@ func get_response(do_io func(io_data *rc_io_data) ([]byte, error), io_data *rc_i
 	}
 	var response Response
 	err = json.Unmarshal(serialized_response, &response)
+	if err == nil {
+		note_payload_compressions(&response)
+		err = response.decompress()
+	}
 	if err != nil {
 		err = fmt.Errorf("Invalid response received from kitty, unmarshalling error: %w", err)
 		return
@@ -266,10 +319,17 @@ func get_response(do_io func(io_data *rc_io_data) ([]byte, error), io_data *rc_i
 }
 
 func send_rc_command(io_data *rc_io_data) (err error) {
+	if batch_collector != nil {
+		return batch_collector(io_data)
+	}
 	err = setup_global_options(io_data.cmd)
 	if err != nil {
 		return err
 	}
+	if rc_global_opts.AsyncId != "" && io_data.rc.Async != "" {
+		io_data.rc.Async = rc_global_opts.AsyncId
+	}
+	io_data.rc.Compression = supported_compressions
 	wid, err := strconv.Atoi(os.Getenv("KITTY_WINDOW_ID"))
 	if err == nil && wid > 0 {
 		io_data.rc.KittyWindowId = uint(wid)
@@ -278,6 +338,9 @@ func send_rc_command(io_data *rc_io_data) (err error) {
 	if err != nil {
 		return
 	}
+	if len(io_data.fds_to_pass) > 0 && global_options.to_network != "unix" {
+		return fmt.Errorf("File descriptors can only be passed when connecting to kitty with a UNIX socket, see the --to option")
+	}
 	var response *Response
 	if global_options.to_network == "" {
 		response, err = get_response(do_tty_io, io_data)
@@ -302,6 +365,9 @@ func send_rc_command(io_data *rc_io_data) (err error) {
 	if response.Data.is_string && io_data.string_response_is_err {
 		return fmt.Errorf("%s", response.Data.as_str)
 	}
+	if io_data.handle_response_data != nil {
+		return io_data.handle_response_data(response.Data.as_str)
+	}
 	if response.Data.as_str != "" {
 		fmt.Println(strings.TrimRight(response.Data.as_str, "\n \t"))
 	}
@@ -403,11 +469,16 @@ func EntryPoint(tool_root *cli.Command) *cli.Command {
 		Run:              shell_main,
 	})
 	add_rc_global_opts(at_root_command)
+	add_tls_proxy_command(tool_root)
 
 	global_options_group := at_root_command.OptionGroups[0]
 
+	cmds := make([]*cli.Command, 0, len(all_commands))
 	for _, reg_func := range all_commands {
-		c := reg_func(at_root_command)
+		cmds = append(cmds, reg_func(at_root_command))
+	}
+	cmds = append(cmds, add_extension_commands(at_root_command)...)
+	for _, c := range cmds {
 		clone := tool_root.AddClone("", c)
 		clone.Name = "@" + c.Name
 		clone.Hidden = true
@@ -3,11 +3,34 @@
 package at
 
 import (
+	"bytes"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"kitty/tools/cli"
 	"kitty/tools/crypto"
 	"kitty/tools/utils"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
 )
 
 func TestEncodeJSON(t *testing.T) {
@@ -56,6 +79,82 @@ func TestCommandToJSON(t *testing.T) {
 	test(rc, "")
 }
 
+func TestBatchCommands(t *testing.T) {
+	cmds, err := parse_batch_commands([]string{"set-tab-title --match id:1 hello", "# a comment", "", "close-window --no-response"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 2 || cmds[0].Cmd != "set-tab-title" || cmds[1].Cmd != "close-window" || !cmds[1].NoResponse {
+		t.Fatalf("Unexpected batch commands: %#v", cmds)
+	}
+	q, err := json.Marshal(cmds[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"title":"hello","match":"id:1"}`; string(q) != expected {
+		t.Fatalf("Unexpected payload: %s != %s", expected, q)
+	}
+	for _, bad := range []string{"batch ls", "get-text --follow", "not-a-command", "--help"} {
+		if _, err = parse_batch_commands([]string{bad}); err == nil {
+			t.Fatalf("No error for invalid batch command: %s", bad)
+		}
+	}
+	if batch_collector != nil {
+		t.Fatalf("The batch collector was not reset")
+	}
+}
+
+func TestParseColorsDiff(t *testing.T) {
+	tdir := t.TempDir()
+	base := filepath.Join(tdir, "current.conf")
+	if err := os.WriteFile(base, []byte("foreground #ffffff\nbackground #000000\ncursor none\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	colors, err := parse_colors_and_files([]string{"foreground=white", "background=red", "cursor=none", "color1=blue"}, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := json.Marshal(colors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"background":16711680,"color1":255}`; string(q) != expected {
+		t.Fatalf("Unexpected colors: %s != %s", expected, q)
+	}
+	if _, err = parse_colors_and_files([]string{"foreground=white"}, filepath.Join(tdir, "missing.conf")); err == nil {
+		t.Fatalf("No error for missing file to diff against")
+	}
+}
+
+func TestDescribeCommands(t *testing.T) {
+	root := cli.NewRootCommand()
+	d := describe_commands(EntryPoint(root))
+	if len(d.Commands) != len(protocol_descriptions) {
+		t.Fatalf("Described %d commands instead of %d", len(d.Commands), len(protocol_descriptions))
+	}
+	for _, c := range d.Commands {
+		var protocol map[string]any
+		if err := json.Unmarshal(c.Protocol, &protocol); err != nil {
+			t.Fatalf("Invalid protocol description for %s: %s", c.Name, err)
+		}
+		if c.Name == "get-scrollback" {
+			var opt *option_description
+			for i, o := range c.Options {
+				if o.Name == "--lines" {
+					opt = &c.Options[i]
+				}
+			}
+			if opt == nil || opt.Type != "int" || opt.Default != 100 {
+				t.Fatalf("Incorrect description of the --lines option: %#v", opt)
+			}
+			properties := protocol["payload"].(map[string]any)["properties"].(map[string]any)
+			if properties["lines"].(map[string]any)["type"] != "integer" {
+				t.Fatalf("Incorrect description of the lines field: %#v", properties["lines"])
+			}
+		}
+	}
+}
+
 func TestRCSerialization(t *testing.T) {
 	io_data := rc_io_data{}
 	err := create_serializer("", "", &io_data)
@@ -102,3 +201,342 @@ func TestRCSerialization(t *testing.T) {
 		t.Fatal("Incorrect version in encrypted command: ", ec.Version)
 	}
 }
+
+func TestStreamedResponses(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		for _, r := range []string{`{"ok":true,"data":"a\n","more":true}`, `{"ok":true,"data":"b\nc\n","more":true}`, `{"ok":true}`} {
+			server.Write([]byte(cmd_escape_code_prefix + r + cmd_escape_code_suffix))
+		}
+	}()
+	output := strings.Builder{}
+	raw, err := read_streamed_responses_from_conn(&client, 0, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"ok":true}` {
+		t.Fatalf("Incorrect last response: %#v", string(raw))
+	}
+	if output.String() != "a\nb\nc\n" {
+		t.Fatalf("Incorrect output: %#v", output.String())
+	}
+	if _, is_partial := parse_partial_response(raw); is_partial {
+		t.Fatalf("The last response was parsed as partial")
+	}
+}
+
+func TestTLSProxy(t *testing.T) {
+	tdir := t.TempDir()
+	// A self signed certificate used by both the server and the client
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "localhost"}, DNSNames: []string{"localhost"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true,
+		KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert_file := filepath.Join(tdir, "cert.pem")
+	pem_data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key_der})...)
+	if err = os.WriteFile(cert_file, pem_data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, err := net.Listen("unix", filepath.Join(tdir, "kitty.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	server_cfg, err := tls_server_config(cert_file, cert_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "localhost:0", server_cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serve_tls_proxy(listener, "unix", upstream.Addr().String())
+	addr := "localhost:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	echo := func(client_cert string) error {
+		cfg, err := tls_client_config(client_cert, cert_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("Incorrect data received via the proxy: %#v", string(buf))
+		}
+		return nil
+	}
+	if err = echo(cert_file); err != nil {
+		t.Fatal(err)
+	}
+	if err = echo(""); err == nil {
+		t.Fatalf("Connecting without a client certificate did not fail")
+	}
+}
+
+func TestPassFds(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	fds, err := parse_fds_to_pass([]string{strconv.Itoa(int(r.Fd()))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]string{{"x"}, {"-1"}, {"0", "0"}, {"199"}} {
+		if _, err = parse_fds_to_pass(bad); err == nil {
+			t.Fatalf("No error for invalid fds to pass: %#v", bad)
+		}
+	}
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "kitty.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err = write_with_fds(&conn, fds, []byte(cmd_escape_code_prefix)); err != nil {
+		t.Fatal(err)
+	}
+	buf, oob := make([]byte, 64), make([]byte, unix.CmsgSpace(4*max_fds_to_pass))
+	n, oobn, _, _, err := peer.(*net.UnixConn).ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != cmd_escape_code_prefix {
+		t.Fatalf("Unexpected data received: %#v", string(buf[:n]))
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Unexpected control messages: %#v %v", msgs, err)
+	}
+	received, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(received) != 1 {
+		t.Fatalf("Unexpected fds received: %#v %v", received, err)
+	}
+	rf := os.NewFile(uintptr(received[0]), "received")
+	defer rf.Close()
+	w.WriteString("passed")
+	w.Close()
+	if data, err := io.ReadAll(rf); err != nil || string(data) != "passed" {
+		t.Fatalf("Could not read from the received fd: %#v %v", string(data), err)
+	}
+}
+
+func TestExtensionCommands(t *testing.T) {
+	sock := "unix:" + filepath.Join(t.TempDir(), "ext.sock")
+	ecmd := ExtensionCommand{Name: "my-command", ShortDescription: "test", ListenOn: sock, Options: []ExtensionOption{{Name: "--count -c", Type: "int"}}}
+	if err := ecmd.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []ExtensionCommand{
+		{Name: "ls", ListenOn: sock}, {Name: "My command", ListenOn: sock}, {Name: "x", ListenOn: "bad"},
+		{Name: "x", ListenOn: "tls:127.0.0.1:1234"},
+		{Name: "x", ListenOn: sock, Options: []ExtensionOption{{Name: "-c"}}},
+		{Name: "x", ListenOn: sock, Options: []ExtensionOption{{Name: "--c", Type: "bad"}}},
+	} {
+		if bad.validate() == nil {
+			t.Fatalf("No error for invalid command: %#v", bad)
+		}
+	}
+	root := cli.NewRootCommand()
+	option_names := map[string]string{"count": root.Add(ecmd.Options[0].spec()).Name}
+	if _, err := root.ParseArgs([]string{"test", "-c", "3", "a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	payload := extension_payload(root, option_names, root.Args)
+	if diff := cmp.Diff(map[string]any{"options": map[string]any{"count": 3}, "args": []string{"a", "b"}}, payload); diff != "" {
+		t.Fatalf("Unexpected payload:\n%s", diff)
+	}
+
+	handlers := map[string]ExtensionHandler{"my-command": func(req *ExtensionRequest) (any, error) {
+		if len(req.Payload.Args) == 0 {
+			return nil, fmt.Errorf("No args")
+		}
+		return fmt.Sprint(req.Payload.Options["count"], req.Payload.Args), nil
+	}}
+	go ServeExtensionCommands(sock, handlers)
+	dial_network, dial_addr := "unix", strings.TrimPrefix(sock, "unix:")
+	send := func(cmd string) (ans map[string]any) {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial(dial_network, dial_addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err = write_many_to_conn(&conn, []byte(cmd_escape_code_prefix), []byte(cmd), []byte(cmd_escape_code_suffix)); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := read_response_from_conn(&conn, 5*time.Second)
+		if err = json.Unmarshal(raw, &ans); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if diff := cmp.Diff(map[string]any{"ok": true, "data": "2 [x]"}, send(`{"cmd":"my-command","payload":{"options":{"count":2},"args":["x"]}}`)); diff != "" {
+		t.Fatalf("Unexpected response:\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]any{"ok": false, "error": "No args"}, send(`{"cmd":"my-command","payload":{}}`)); diff != "" {
+		t.Fatalf("Unexpected response:\n%s", diff)
+	}
+	if r := send(`{"cmd":"other"}`); r["ok"] != false {
+		t.Fatalf("Unexpected response for unknown command: %#v", r)
+	}
+
+	// serving on TCP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial_network, dial_addr = "tcp", l.Addr().String()
+	l.Close()
+	go ServeExtensionCommands("tcp:"+dial_addr, handlers)
+	if diff := cmp.Diff(map[string]any{"ok": true, "data": "3 [y]"}, send(`{"cmd":"my-command","payload":{"options":{"count":3},"args":["y"]}}`)); diff != "" {
+		t.Fatalf("Unexpected response:\n%s", diff)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	small := &utils.RemoteControlCmd{Cmd: "send-text", Payload: map[string]string{"data": "x"}}
+	if compressed_rc(small) != small {
+		t.Fatalf("Small payload was compressed")
+	}
+	text := strings.Repeat("some text that compresses well ", 2048)
+	large := &utils.RemoteControlCmd{Cmd: "send-text", Payload: map[string]string{"data": text}}
+	// payloads are not compressed until kitty advertises support
+	defer func() { kitty_payload_compressions = "" }()
+	if compressed_rc(large) != large {
+		t.Fatalf("Payload compressed before kitty advertised support")
+	}
+	var r Response
+	if err := json.Unmarshal([]byte(`{"ok":true,"accepts_payload_compression":"zlib"}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	note_payload_compressions(&r)
+	c := compressed_rc(large)
+	if c.PayloadCompression != "zlib" || large.PayloadCompression != "" {
+		t.Fatalf("Large payload was not compressed correctly: %#v", c.PayloadCompression)
+	}
+	raw, err := base64.StdEncoding.DecodeString(c.Payload.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(zr)
+	if expected, _ := json.Marshal(large.Payload); string(data) != string(expected) {
+		t.Fatalf("Decompressed payload not equal to original")
+	}
+
+	for _, algo := range []string{"zlib", "zstd"} {
+		b := bytes.Buffer{}
+		var w io.WriteCloser
+		if algo == "zlib" {
+			w = zlib.NewWriter(&b)
+		} else {
+			w, _ = zstd.NewWriter(&b)
+		}
+		json.NewEncoder(w).Encode(text)
+		w.Close()
+		r := Response{Ok: true, Compressed: algo, Data: ResponseData{as_str: base64.StdEncoding.EncodeToString(b.Bytes()), is_string: true}}
+		if err = r.decompress(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Data.as_str != text || !r.Data.is_string || r.Compressed != "" {
+			t.Fatalf("Response not decompressed correctly with %s", algo)
+		}
+	}
+}
+
+func TestScreenshotRendering(t *testing.T) {
+	// a 2x2 red image placed at the second row of a 4x2 window
+	pixels := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{255, 0, 0}, 4))
+	raw, _ := json.Marshal(map[string]any{
+		"columns": 4, "lines": 2, "cell_width": 2, "cell_height": 2, "foreground": "#ffffff", "background": "#000000",
+		"rows": [][]map[string]any{
+			{{"x": 0, "cells": []string{"a", "b"}, "fg": "#ffffff", "bg": "#0000ff"}},
+			{},
+		},
+		"placements": []map[string]any{{"image_id": 1, "start_row": 1, "start_column": 2, "src_width": 2, "src_height": 2, "num_cols": 1, "num_rows": 1}},
+		"images":     map[string]any{"1": map[string]any{"width": 2, "height": 2, "format": 24, "data": pixels}},
+	})
+	data := screenshot_data{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatal(err)
+	}
+	img := render_screenshot(&data)
+	b := img.Bounds()
+	cw, ch := b.Dx()/4, b.Dy()/2
+	if cw < 1 || ch < 1 || b.Dx() != 4*cw || b.Dy() != 2*ch {
+		t.Fatalf("Unexpected screenshot size: %v", b)
+	}
+	pixel := func(x, y int) string {
+		c := img.NRGBAAt(x, y)
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	for _, q := range []struct {
+		x, y     int
+		expected string
+	}{{cw + cw - 1, 0, "#0000ff"}, {2*cw - 1, 2*ch - 1, "#000000"}, {2*cw + cw/2, ch + ch/2, "#ff0000"}, {3 * cw, ch + ch/2, "#000000"}} {
+		if actual := pixel(q.x, q.y); actual != q.expected {
+			t.Fatalf("Pixel at (%d, %d) is %s not %s", q.x, q.y, actual, q.expected)
+		}
+	}
+}
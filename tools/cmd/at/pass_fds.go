@@ -0,0 +1,52 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+const max_fds_to_pass = 16
+
+func parse_fds_to_pass(items []string) ([]int, error) {
+	if len(items) > max_fds_to_pass {
+		return nil, fmt.Errorf("At most %d file descriptors can be passed", max_fds_to_pass)
+	}
+	ans := make([]int, 0, len(items))
+	seen := make(map[int]bool, len(items))
+	for _, x := range items {
+		fd, err := strconv.Atoi(x)
+		if err != nil || fd < 0 || fd > 200 {
+			return nil, fmt.Errorf("%s is not a valid file descriptor number", x)
+		}
+		if seen[fd] {
+			return nil, fmt.Errorf("The file descriptor %d is specified more than once", fd)
+		}
+		if _, err = unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != nil {
+			return nil, fmt.Errorf("The file descriptor %d is not open", fd)
+		}
+		seen[fd] = true
+		ans = append(ans, fd)
+	}
+	return ans, nil
+}
+
+// Write data to a UNIX socket connection, passing the specified file
+// descriptors with it using SCM_RIGHTS
+func write_with_fds(conn *net.Conn, fds []int, data []byte) error {
+	uc, ok := (*conn).(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("File descriptors can only be passed when connecting to kitty with a UNIX socket")
+	}
+	n, _, err := uc.WriteMsgUnix(data, unix.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+	return write_all_to_conn(conn, data[n:])
+}
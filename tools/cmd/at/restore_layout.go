@@ -0,0 +1,28 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+var _ = fmt.Print
+
+func read_layout_file(args []string) (escaped_string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("Only one layout file can be specified")
+	}
+	var data []byte
+	var err error
+	if len(args) == 0 || args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	return escaped_string(data), nil
+}
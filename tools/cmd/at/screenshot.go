@@ -0,0 +1,289 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+
+	"kitty/tools/tui/sgr"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+)
+
+var _ = fmt.Print
+
+// The contents of a window as sent by kitty in response to the screenshot
+// command, see kitty/rc/screenshot.py
+
+type screenshot_run struct {
+	X              int      `json:"x"`
+	Cells          []string `json:"cells"`
+	Width          int      `json:"width"`
+	Fg             string   `json:"fg"`
+	Bg             string   `json:"bg"`
+	Bold           bool     `json:"bold"`
+	Italic         bool     `json:"italic"`
+	Dim            bool     `json:"dim"`
+	Strikethrough  bool     `json:"strikethrough"`
+	Underline      int      `json:"underline"`
+	UnderlineColor string   `json:"underline_color"`
+}
+
+type screenshot_image struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format int    `json:"format"`
+	Data   string `json:"data"`
+}
+
+type screenshot_placement struct {
+	ImageId      uint64  `json:"image_id"`
+	StartRow     int     `json:"start_row"`
+	StartColumn  int     `json:"start_column"`
+	CellXOffset  int     `json:"cell_x_offset"`
+	CellYOffset  int     `json:"cell_y_offset"`
+	NumCols      int     `json:"num_cols"`
+	NumRows      int     `json:"num_rows"`
+	SrcX         float64 `json:"src_x"`
+	SrcY         float64 `json:"src_y"`
+	SrcWidth     float64 `json:"src_width"`
+	SrcHeight    float64 `json:"src_height"`
+	ZIndex       int32   `json:"z_index"`
+	decoded_data *image.NRGBA
+}
+
+type screenshot_data struct {
+	Columns    int                `json:"columns"`
+	Lines      int                `json:"lines"`
+	CellWidth  int                `json:"cell_width"`
+	CellHeight int                `json:"cell_height"`
+	Foreground string             `json:"foreground"`
+	Background string             `json:"background"`
+	Rows       [][]screenshot_run `json:"rows"`
+	Cursor     *struct {
+		X     int    `json:"x"`
+		Y     int    `json:"y"`
+		Color string `json:"color"`
+	} `json:"cursor"`
+	Placements []*screenshot_placement     `json:"placements"`
+	Images     map[string]screenshot_image `json:"images"`
+}
+
+type screenshot_renderer struct {
+	data                    *screenshot_data
+	img                     *image.NRGBA
+	faces                   [4]font.Face
+	cell_width, cell_height int
+	baseline                int
+	colors                  map[string]color.NRGBA
+}
+
+var load_screenshot_faces = utils.Once(func() (ans [4]font.Face) {
+	for i, data := range [][]byte{gomono.TTF, gomonobold.TTF, gomonoitalic.TTF, gomonobolditalic.TTF} {
+		f, err := opentype.Parse(data)
+		if err != nil {
+			panic(err)
+		}
+		if ans[i], err = opentype.NewFace(f, &opentype.FaceOptions{Size: 12, DPI: 96, Hinting: font.HintingFull}); err != nil {
+			panic(err)
+		}
+	}
+	return
+})
+
+func (self *screenshot_renderer) color(spec string) color.NRGBA {
+	if ans, found := self.colors[spec]; found {
+		return ans
+	}
+	ans := color.NRGBA{A: 255}
+	if c, err := style.ParseColor(spec); err == nil {
+		ans.R, ans.G, ans.B = c.Red, c.Green, c.Blue
+	}
+	self.colors[spec] = ans
+	return ans
+}
+
+func (self *screenshot_renderer) cell_rect(x, y, width int) image.Rectangle {
+	return image.Rect(x*self.cell_width, y*self.cell_height, (x+width)*self.cell_width, (y+1)*self.cell_height)
+}
+
+func (self *screenshot_renderer) fill(r image.Rectangle, c color.NRGBA) {
+	draw.Draw(self.img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+func (self *screenshot_renderer) decode_image(p *screenshot_placement) *image.NRGBA {
+	if p.decoded_data != nil {
+		return p.decoded_data
+	}
+	src, found := self.data.Images[fmt.Sprint(p.ImageId)]
+	if !found {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(src.Data)
+	bpp := 4
+	if src.Format == 24 {
+		bpp = 3
+	}
+	if err != nil || len(data) != bpp*src.Width*src.Height {
+		return nil
+	}
+	ans := image.NewNRGBA(image.Rect(0, 0, src.Width, src.Height))
+	if bpp == 4 {
+		copy(ans.Pix, data)
+	} else {
+		for i, j := 0, 0; i < len(data); i, j = i+3, j+4 {
+			ans.Pix[j], ans.Pix[j+1], ans.Pix[j+2], ans.Pix[j+3] = data[i], data[i+1], data[i+2], 255
+		}
+	}
+	for _, q := range self.data.Placements {
+		if q.ImageId == p.ImageId {
+			q.decoded_data = ans
+		}
+	}
+	return ans
+}
+
+func (self *screenshot_renderer) draw_placements(include func(z_index int32) bool) {
+	// kitty positions images in its own cell size, scale them to ours
+	sx, sy := 1.0, 1.0
+	if self.data.CellWidth > 0 && self.data.CellHeight > 0 {
+		sx = float64(self.cell_width) / float64(self.data.CellWidth)
+		sy = float64(self.cell_height) / float64(self.data.CellHeight)
+	}
+	for _, p := range self.data.Placements {
+		if !include(p.ZIndex) {
+			continue
+		}
+		src := self.decode_image(p)
+		if src == nil {
+			continue
+		}
+		left := p.StartColumn*self.cell_width + int(math.Round(float64(p.CellXOffset)*sx))
+		top := p.StartRow*self.cell_height + int(math.Round(float64(p.CellYOffset)*sy))
+		right := left + int(math.Round(p.SrcWidth*sx))
+		if p.NumCols > 0 {
+			right = (p.StartColumn + p.NumCols) * self.cell_width
+		}
+		bottom := top + int(math.Round(p.SrcHeight*sy))
+		if p.NumRows > 0 {
+			bottom = (p.StartRow + p.NumRows) * self.cell_height
+		}
+		sr := image.Rect(int(p.SrcX), int(p.SrcY), int(math.Round(p.SrcX+p.SrcWidth)), int(math.Round(p.SrcY+p.SrcHeight)))
+		draw.ApproxBiLinear.Scale(self.img, image.Rect(left, top, right, bottom), src, sr, draw.Over, nil)
+	}
+}
+
+func blend(a, b color.NRGBA) color.NRGBA {
+	return color.NRGBA{R: uint8((int(a.R) + int(b.R)) / 2), G: uint8((int(a.G) + int(b.G)) / 2), B: uint8((int(a.B) + int(b.B)) / 2), A: 255}
+}
+
+func (self *screenshot_renderer) draw_text(y int, run *screenshot_run) {
+	face := 0
+	if run.Bold {
+		face |= 1
+	}
+	if run.Italic {
+		face |= 2
+	}
+	fg := self.color(run.Fg)
+	if run.Dim {
+		fg = blend(fg, self.color(run.Bg))
+	}
+	width := utils.Max(1, run.Width)
+	for i, text := range run.Cells {
+		x := run.X + i*width
+		c := fg
+		if cursor := self.data.Cursor; cursor != nil && cursor.X == x && cursor.Y == y {
+			c = self.color(run.Bg)
+		}
+		d := font.Drawer{Dst: self.img, Src: image.NewUniform(c), Face: self.faces[face]}
+		d.Dot = fixed.P(x*self.cell_width, y*self.cell_height+self.baseline)
+		d.DrawString(text)
+	}
+	r := self.cell_rect(run.X, y, len(run.Cells)*width)
+	if run.Underline != int(sgr.No_underline) {
+		uc := fg
+		if run.UnderlineColor != "" {
+			uc = self.color(run.UnderlineColor)
+		}
+		uy := r.Min.Y + self.baseline + 2
+		self.fill(image.Rect(r.Min.X, uy, r.Max.X, uy+1), uc)
+		if run.Underline == int(sgr.Double_underline) {
+			self.fill(image.Rect(r.Min.X, uy+2, r.Max.X, uy+3), uc)
+		}
+	}
+	if run.Strikethrough {
+		sy := r.Min.Y + self.baseline*2/3
+		self.fill(image.Rect(r.Min.X, sy, r.Max.X, sy+1), fg)
+	}
+}
+
+func render_screenshot(data *screenshot_data) *image.NRGBA {
+	self := screenshot_renderer{data: data, faces: load_screenshot_faces(), colors: make(map[string]color.NRGBA)}
+	m := self.faces[0].Metrics()
+	advance, _ := self.faces[0].GlyphAdvance('M')
+	self.cell_width, self.cell_height = advance.Ceil(), (m.Ascent + m.Descent).Ceil()
+	self.baseline = m.Ascent.Ceil()
+	self.img = image.NewNRGBA(image.Rect(0, 0, data.Columns*self.cell_width, data.Lines*self.cell_height))
+	self.fill(self.img.Bounds(), self.color(data.Background))
+	// Draw in the same order as kitty: images below cell backgrounds, cell
+	// backgrounds, images below text, text and then images above text
+	sort.SliceStable(data.Placements, func(i, j int) bool { return data.Placements[i].ZIndex < data.Placements[j].ZIndex })
+	self.draw_placements(func(z int32) bool { return z < math.MinInt32/2 })
+	for y, runs := range data.Rows {
+		for _, run := range runs {
+			if run.Bg != data.Background {
+				self.fill(self.cell_rect(run.X, y, len(run.Cells)*utils.Max(1, run.Width)), self.color(run.Bg))
+			}
+		}
+	}
+	if c := data.Cursor; c != nil {
+		self.fill(self.cell_rect(c.X, c.Y, 1), self.color(c.Color))
+	}
+	self.draw_placements(func(z int32) bool { return z >= math.MinInt32/2 && z < 0 })
+	for y, runs := range data.Rows {
+		for i := range runs {
+			self.draw_text(y, &runs[i])
+		}
+	}
+	self.draw_placements(func(z int32) bool { return z >= 0 })
+	return self.img
+}
+
+func save_screenshot(output string) func(string) error {
+	return func(raw string) (err error) {
+		data := screenshot_data{}
+		if err = json.Unmarshal(utils.UnsafeStringToBytes(raw), &data); err != nil {
+			return fmt.Errorf("Invalid screenshot data received from kitty: %w", err)
+		}
+		img := render_screenshot(&data)
+		var dest io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			dest = f
+		}
+		return png.Encode(dest, img)
+	}
+}
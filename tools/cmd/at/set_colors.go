@@ -45,7 +45,26 @@ func set_color_in_color_map(key, val string, ans map[string]any, check_nullable,
 	return nil
 }
 
-func parse_colors_and_files(args []string) (map[string]any, error) {
+func parse_colors_file(path string, ans map[string]any) error {
+	f, err := os.Open(utils.Expanduser(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, val, found := strings.Cut(scanner.Text(), " ")
+		if found {
+			set_color_in_color_map(strings.ToLower(key), strings.ToLower(strings.TrimSpace(val)), ans, true, true)
+		}
+	}
+	return scanner.Err()
+}
+
+// Parse colors from the args, which are either key=val pairs or paths to conf
+// files. If diff_against is not empty, colors that have the same value in that
+// conf file are dropped.
+func parse_colors_and_files(args []string, diff_against string) (map[string]any, error) {
 	ans := make(map[string]any, len(args))
 	for _, arg := range args {
 		key, val, found := strings.Cut(strings.ToLower(arg), "=")
@@ -54,19 +73,18 @@ func parse_colors_and_files(args []string) (map[string]any, error) {
 			if err != nil {
 				return nil, err
 			}
-		} else {
-			path := utils.Expanduser(arg)
-			f, err := os.Open(path)
-			if err != nil {
-				return nil, err
-			}
-			defer f.Close()
-			scanner := bufio.NewScanner(f)
-			for scanner.Scan() {
-				key, val, found := strings.Cut(scanner.Text(), " ")
-				if found {
-					set_color_in_color_map(strings.ToLower(key), strings.ToLower(strings.TrimSpace(val)), ans, true, true)
-				}
+		} else if err := parse_colors_file(arg, ans); err != nil {
+			return nil, err
+		}
+	}
+	if diff_against != "" {
+		base := make(map[string]any, len(ans))
+		if err := parse_colors_file(diff_against, base); err != nil {
+			return nil, err
+		}
+		for key, val := range ans {
+			if bval, found := base[key]; found && bval == val {
+				delete(ans, key)
 			}
 		}
 	}
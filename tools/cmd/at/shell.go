@@ -203,6 +203,9 @@ func shell_main(cmd *cli.Command, args []string) (int, error) {
 	if err != nil {
 		return 1, err
 	}
+	if rc_global_opts.DescribeCommands {
+		return print_commands_description(cmd)
+	}
 	formatter = markup.New(true)
 	fmt.Println("Welcome to the kitty shell!")
 	fmt.Println("Use", formatter.Green("help"), "for assistance or", formatter.Green("exit"), "to quit.")
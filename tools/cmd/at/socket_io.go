@@ -8,8 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/sys/unix"
+
 	"kitty/tools/tui/loop"
 	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
@@ -55,7 +60,11 @@ func read_response_from_conn(conn *net.Conn, timeout time.Duration) (serialized_
 	buf := make([]byte, utils.DEFAULT_IO_BUFFER_SIZE)
 	for keep_going {
 		var n int
-		(*conn).SetDeadline(time.Now().Add(timeout))
+		if timeout > 0 {
+			(*conn).SetDeadline(time.Now().Add(timeout))
+		} else {
+			(*conn).SetDeadline(time.Time{})
+		}
 		n, err = (*conn).Read(buf)
 		if err != nil {
 			keep_going = false
@@ -125,7 +134,14 @@ func simple_socket_io(conn *net.Conn, io_data *rc_io_data) (serialized_response
 		if len(chunk) == 0 {
 			break
 		}
-		err = write_many_to_conn(conn, []byte(cmd_escape_code_prefix), chunk, []byte(cmd_escape_code_suffix))
+		if state == BEFORE_FIRST_ESCAPE_CODE_SENT && len(io_data.fds_to_pass) > 0 {
+			err = write_with_fds(conn, io_data.fds_to_pass, []byte(cmd_escape_code_prefix))
+			if err == nil {
+				err = write_many_to_conn(conn, chunk, []byte(cmd_escape_code_suffix))
+			}
+		} else {
+			err = write_many_to_conn(conn, []byte(cmd_escape_code_prefix), chunk, []byte(cmd_escape_code_suffix))
+		}
 		if err != nil {
 			return
 		}
@@ -147,11 +163,67 @@ func simple_socket_io(conn *net.Conn, io_data *rc_io_data) (serialized_response
 	if io_data.rc.NoResponse {
 		return
 	}
+	if io_data.streams_responses {
+		return read_streamed_responses_from_conn(conn, io_data.timeout, os.Stdout)
+	}
 	return read_response_from_conn(conn, io_data.timeout)
 }
 
+// Read responses, writing the text of all but the last to output, until the
+// last one is received or the user interrupts
+func read_streamed_responses_from_conn(conn *net.Conn, timeout time.Duration, output io.Writer) (serialized_response []byte, err error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	defer signal.Stop(sigs)
+	done := make(chan bool)
+	defer close(done)
+	var interrupted atomic.Bool
+	go func() {
+		select {
+		case <-sigs:
+			interrupted.Store(true)
+			// unblock the read
+			(*conn).Close()
+		case <-done:
+		}
+	}()
+	var responses [][]byte
+	p := wcswidth.EscapeCodeParser{}
+	p.HandleDCS = func(data []byte) error {
+		if bytes.HasPrefix(data, []byte("@kitty-cmd")) {
+			responses = append(responses, bytes.Clone(data[len("@kitty-cmd"):]))
+		}
+		return nil
+	}
+	buf := make([]byte, utils.DEFAULT_IO_BUFFER_SIZE)
+	for {
+		for len(responses) > 0 {
+			serialized_response, responses = responses[0], responses[1:]
+			text, is_partial := parse_partial_response(serialized_response)
+			if !is_partial {
+				return serialized_response, nil
+			}
+			if _, err = io.WriteString(output, text); err != nil {
+				return nil, err
+			}
+		}
+		if timeout > 0 {
+			(*conn).SetDeadline(time.Now().Add(timeout))
+		}
+		var n int
+		n, err = (*conn).Read(buf)
+		if interrupted.Load() {
+			return nil, interrupted_by_user
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.Parse(buf[:n])
+	}
+}
+
 func do_socket_io(io_data *rc_io_data) (serialized_response []byte, err error) {
-	conn, err := net.Dial(global_options.to_network, global_options.to_address)
+	conn, err := dial_kitty()
 	if err != nil {
 		return
 	}
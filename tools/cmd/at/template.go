@@ -83,6 +83,13 @@ func run_CMD_NAME(cmd *cli.Command, args []string) (return_code int, err error)
 		rc:                     rc,
 		timeout:                time.Duration(timeout * float64(time.Second)),
 		string_response_is_err: STRING_RESPONSE_IS_ERROR,
+		handle_response_data:   RESPONSE_HANDLER,
+	}
+	if STREAMS_RESPONSES {
+		err = enable_streamed_responses(&io_data)
+		if err != nil {
+			return
+		}
 	}
 	err = create_payload_CMD_NAME(&io_data, cmd, args)
 	if err != nil {
@@ -107,4 +114,5 @@ func setup_CMD_NAME(parent *cli.Command) *cli.Command {
 
 func init() {
 	register_at_cmd(setup_CMD_NAME)
+	protocol_descriptions["CLI_NAME"] = "PROTOCOL_DESCRIPTION"
 }
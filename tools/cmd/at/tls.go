@@ -0,0 +1,172 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package at
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"kitty/tools/cli"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+func load_cert_pool(path string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ans := x509.NewCertPool()
+	if !ans.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("No certificates found in: %s", path)
+	}
+	return ans, nil
+}
+
+// The certificate and private key are read from the same PEM file
+func load_key_pair(path string) (tls.Certificate, error) {
+	ans, err := tls.LoadX509KeyPair(path, path)
+	if err != nil {
+		err = fmt.Errorf("Failed to load the TLS certificate and private key from %s with error: %w", path, err)
+	}
+	return ans, err
+}
+
+func tls_server_config(certificate_file, client_ca_file string) (*tls.Config, error) {
+	cert, err := load_key_pair(certificate_file)
+	if err != nil {
+		return nil, err
+	}
+	ans := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if client_ca_file != "" {
+		if ans.ClientCAs, err = load_cert_pool(client_ca_file); err != nil {
+			return nil, err
+		}
+		ans.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return ans, nil
+}
+
+func tls_client_config(certificate_file, ca_file string) (*tls.Config, error) {
+	ans := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certificate_file != "" {
+		cert, err := load_key_pair(certificate_file)
+		if err != nil {
+			return nil, err
+		}
+		ans.Certificates = []tls.Certificate{cert}
+	}
+	if ca_file != "" {
+		var err error
+		if ans.RootCAs, err = load_cert_pool(ca_file); err != nil {
+			return nil, err
+		}
+	}
+	return ans, nil
+}
+
+func dial_kitty() (net.Conn, error) {
+	if global_options.to_network == "tls" {
+		cfg, err := tls_client_config(utils.Expanduser(rc_global_opts.TlsCertificate), utils.Expanduser(rc_global_opts.TlsCa))
+		if err != nil {
+			return nil, err
+		}
+		return tls.Dial("tcp", global_options.to_address, cfg)
+	}
+	return net.Dial(global_options.to_network, global_options.to_address)
+}
+
+// Forward a connection to kitty listening at upstream, returning when either
+// end closes the connection
+func proxy_connection(conn net.Conn, upstream_network, upstream_address string) {
+	defer conn.Close()
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+	upstream, err := net.Dial(upstream_network, upstream_address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect to kitty with error:", err)
+		return
+	}
+	defer upstream.Close()
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- true
+	}()
+	<-done
+}
+
+func serve_tls_proxy(listener net.Listener, upstream_network, upstream_address string) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go proxy_connection(conn, upstream_network, upstream_address)
+	}
+}
+
+// Run by kitty for remote_control_tls_listen_on, with the arguments: the
+// address to listen on, the address kitty listens on, the certificate file
+// and optionally the client CA file. Exits when kitty closes its STDIN.
+func run_tls_proxy(args []string) (err error) {
+	if len(args) < 3 {
+		return fmt.Errorf("Usage: listen_address kitty_address certificate_file [client_ca_file]")
+	}
+	upstream_network, upstream_address, err := utils.ParseSocketAddress(args[1])
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(upstream_network, "ip") {
+		upstream_network = "tcp" + upstream_network[2:]
+	}
+	client_ca_file := ""
+	if len(args) > 3 {
+		client_ca_file = args[3]
+	}
+	cfg, err := tls_server_config(args[2], client_ca_file)
+	if err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", args[0], cfg)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		listener.Close()
+	}()
+	if err = serve_tls_proxy(listener, upstream_network, upstream_address); errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return
+}
+
+func add_tls_proxy_command(root *cli.Command) {
+	root.AddSubCommand(&cli.Command{
+		Name:            "__rc_tls_proxy__",
+		Hidden:          true,
+		OnlyArgsAllowed: true,
+		Run: func(cmd *cli.Command, args []string) (rc int, err error) {
+			return 0, run_tls_proxy(args)
+		},
+	})
+}
@@ -5,8 +5,10 @@ package at
 import (
 	"encoding/json"
 	"os"
+	"strings"
 	"time"
 
+	"kitty/tools/tty"
 	"kitty/tools/tui/loop"
 )
 
@@ -41,6 +43,7 @@ func do_chunked_io(io_data *rc_io_data) (serialized_response []byte, err error)
 		WAITING_FOR_RESPONSE
 	)
 	state := BEFORE_FIRST_ESCAPE_CODE_SENT
+	output_is_terminal := tty.IsTerminal(os.Stdout.Fd())
 	var last_received_data_at time.Time
 	var check_for_timeout func(timer_id loop.IdType) error
 	wants_streaming := false
@@ -49,7 +52,7 @@ func do_chunked_io(io_data *rc_io_data) (serialized_response []byte, err error)
 		if state != WAITING_FOR_RESPONSE && state != WAITING_FOR_STREAMING_RESPONSE {
 			return nil
 		}
-		if io_data.on_key_event != nil {
+		if io_data.on_key_event != nil || io_data.timeout <= 0 {
 			return nil
 		}
 		time_since_last_received_data := time.Now().Sub(last_received_data_at)
@@ -65,7 +68,9 @@ func do_chunked_io(io_data *rc_io_data) (serialized_response []byte, err error)
 			lp.Quit(0)
 		}
 		last_received_data_at = time.Now()
-		lp.AddTimer(io_data.timeout, false, check_for_timeout)
+		if io_data.timeout > 0 {
+			lp.AddTimer(io_data.timeout, false, check_for_timeout)
+		}
 	}
 
 	lp.OnReceivedData = func(data []byte) error {
@@ -125,8 +130,17 @@ func do_chunked_io(io_data *rc_io_data) (serialized_response []byte, err error)
 		return nil
 	}
 
+	if io_data.streams_responses {
+		interrupt := func() (bool, error) { return true, interrupted_by_user }
+		lp.OnSIGINT, lp.OnSIGTERM = interrupt, interrupt
+	}
+
 	lp.OnKeyEvent = func(event *loop.KeyEvent) error {
 		if io_data.on_key_event == nil {
+			if io_data.streams_responses && event.MatchesPressOrRepeat("ctrl+c") {
+				event.Handled = true
+				return interrupted_by_user
+			}
 			return nil
 		}
 		err := io_data.on_key_event(lp, event)
@@ -153,6 +167,18 @@ func do_chunked_io(io_data *rc_io_data) (serialized_response []byte, err error)
 			state = SENDING
 			return lp.OnWriteComplete(0)
 		}
+		if io_data.streams_responses {
+			if text, is_partial := parse_partial_response(raw); is_partial {
+				if output_is_terminal {
+					// the terminal is in raw mode
+					text = strings.ReplaceAll(text, "\n", "\r\n")
+					lp.QueueWriteString(text)
+					return nil
+				}
+				_, err := os.Stdout.WriteString(text)
+				return err
+			}
+		}
 		serialized_response = raw
 		lp.Quit(0)
 		return nil
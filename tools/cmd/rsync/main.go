@@ -0,0 +1,363 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"kitty/tools/cli"
+	"kitty/tools/rsync"
+)
+
+var _ = fmt.Print
+
+type SignatureOptions struct {
+	BlockSize     int
+	StrongHash    string
+	FormatVersion int
+}
+
+type DeltaOptions struct {
+	CompressThreshold  int
+	StrongVerification bool
+}
+
+type PatchOptions struct {
+	BlockSize     int
+	StrongHash    string
+	FormatVersion int
+	InPlace       bool
+	Strict        bool
+	Sparse        bool
+}
+
+func (self *PatchOptions) signature_options() *SignatureOptions {
+	return &SignatureOptions{BlockSize: self.BlockSize, StrongHash: self.StrongHash, FormatVersion: self.FormatVersion}
+}
+
+var strong_hashes = map[string]rsync.StrongHashType{
+	"xxh3": rsync.XXH3, "xxh3-128": rsync.XXH3128, "sha256": rsync.SHA256, "blake3": rsync.BLAKE3,
+}
+
+func open_input(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+// Calls run with the output, which is stdout if path is empty or -
+func with_output(path string, run func(io.Writer) error) (err error) {
+	if path == "" || path == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err = run(w); err == nil {
+			err = w.Flush()
+		}
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = run(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return
+	}
+	return f.Close()
+}
+
+func file_size(f *os.File) int64 {
+	if s, err := f.Stat(); err == nil && s.Mode().IsRegular() {
+		return s.Size()
+	}
+	return 0
+}
+
+// Create a patcher for a file of the specified size. The patcher applying a
+// delta must be created with the same options as the one used to create the
+// signature.
+func new_patcher(size int64, opts *SignatureOptions) (*rsync.Patcher, error) {
+	ans := rsync.NewPatcher(size, rsync.BuiltinStrongHasher(strong_hashes[opts.StrongHash]))
+	if opts.BlockSize > 0 {
+		if err := ans.SetBlockSize(opts.BlockSize); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FormatVersion < 0 || opts.FormatVersion > int(rsync.MaxFormatVersion) {
+		return nil, fmt.Errorf("Unsupported format version: %d", opts.FormatVersion)
+	}
+	if err := ans.SetFormatVersion(uint16(opts.FormatVersion)); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+func run_iterator(it func() error) error {
+	for {
+		if err := it(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func signature(args []string, opts *SignatureOptions) (err error) {
+	src, err := open_input(args[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	p, err := new_patcher(file_size(src), opts)
+	if err != nil {
+		return err
+	}
+	return with_output(output_arg(args, 1), func(w io.Writer) error {
+		return run_iterator(p.CreateSignatureIterator(src, w))
+	})
+}
+
+func delta(args []string, opts *DeltaOptions) (err error) {
+	if args[0] == "-" && args[1] == "-" {
+		return fmt.Errorf("The signature and the source cannot both be read from STDIN")
+	}
+	sig, err := open_input(args[0])
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+	d := rsync.NewDiffer()
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := sig.Read(buf)
+		if n > 0 {
+			if err = d.AddSignatureData(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				return rerr
+			}
+			break
+		}
+	}
+	if err = d.FinishSignatureData(); err != nil {
+		return err
+	}
+	d.SetLiteralCompressionThreshold(opts.CompressThreshold)
+	d.SetStrongVerification(opts.StrongVerification)
+	src, err := open_input(args[1])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return with_output(output_arg(args, 2), func(w io.Writer) error {
+		return run_iterator(d.CreateDelta(src, w))
+	})
+}
+
+func apply_delta(p *rsync.Patcher, delta_path string) error {
+	delta, err := open_input(delta_path)
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := delta.Read(buf)
+		if n > 0 {
+			if err = p.UpdateDelta(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				return rerr
+			}
+			break
+		}
+	}
+	return p.FinishDelta()
+}
+
+func patch(args []string, opts *PatchOptions) (err error) {
+	if opts.InPlace {
+		if len(args) > 2 {
+			return fmt.Errorf("An output file must not be specified when patching in place")
+		}
+		basis, err := os.OpenFile(args[0], os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer basis.Close()
+		p, err := new_patcher(file_size(basis), opts.signature_options())
+		if err != nil {
+			return err
+		}
+		p.SetStrictValidation(opts.Strict)
+		if err = p.StartDeltaInPlace(basis, ""); err != nil {
+			return err
+		}
+		if err = apply_delta(p, args[1]); err != nil {
+			return err
+		}
+		return basis.Close()
+	}
+	basis, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	p, err := new_patcher(file_size(basis), opts.signature_options())
+	if err != nil {
+		return err
+	}
+	p.SetStrictValidation(opts.Strict)
+	p.SetSparseOutput(opts.Sparse)
+	return with_output(output_arg(args, 2), func(w io.Writer) error {
+		p.StartDelta(w, basis)
+		return apply_delta(p, args[1])
+	})
+}
+
+func output_arg(args []string, idx int) string {
+	if len(args) > idx {
+		return args[idx]
+	}
+	return ""
+}
+
+func check_args(args []string, min, max int) error {
+	if len(args) < min {
+		return fmt.Errorf("Too few arguments, at least %d are required", min)
+	}
+	if len(args) > max {
+		return fmt.Errorf("Too many arguments, at most %d are allowed", max)
+	}
+	return nil
+}
+
+func add_signature_options(sc *cli.Command) {
+	sc.Add(cli.OptionSpec{
+		Name:    "--block-size",
+		Type:    "int",
+		Default: "0",
+		Help:    "The block size to use for the signature. The default of zero means a block size is chosen automatically based on the size of the file.",
+	})
+	sc.Add(cli.OptionSpec{
+		Name:    "--strong-hash",
+		Choices: "xxh3, xxh3-128, sha256, blake3",
+		Default: "xxh3",
+		Help:    "The strong hash used to confirm matching blocks.",
+	})
+	sc.Add(cli.OptionSpec{
+		Name:    "--format-version",
+		Type:    "int",
+		Default: "0",
+		Help:    "The version of the serialization format to use. Version zero is understood by all versions of kitty.",
+	})
+}
+
+func EntryPoint(root *cli.Command) {
+	parent := root.AddSubCommand(&cli.Command{
+		Name:             "rsync",
+		Usage:            "command [options] [args...]",
+		ShortDescription: "Create signatures and deltas of files and apply them",
+		HelpText: "Expose the rsync algorithm used by the :doc:`transfer kitten </kittens/transfer>` for use with arbitrary transports." +
+			" First create a signature of the file to be updated, then use it to create a delta from the new version of the file, then patch the old file with the delta." +
+			" Use :code:`-` as a filename to read from STDIN or write to STDOUT. Output defaults to STDOUT.",
+	})
+	sc := parent.AddSubCommand(&cli.Command{
+		Name:             "signature",
+		Usage:            "[options] basis [signature]",
+		ShortDescription: "Create the signature of a file",
+		HelpText:         "Create the signature of the basis file, the file that is to be updated.",
+		Run: func(cmd *cli.Command, args []string) (rc int, err error) {
+			if err = check_args(args, 1, 2); err != nil {
+				return 1, err
+			}
+			opts := &SignatureOptions{}
+			if err = cmd.GetOptionValues(opts); err != nil {
+				return 1, err
+			}
+			if err = signature(args, opts); err != nil {
+				return 1, err
+			}
+			return
+		},
+	})
+	add_signature_options(sc)
+
+	sc = parent.AddSubCommand(&cli.Command{
+		Name:             "delta",
+		Usage:            "[options] signature source [delta]",
+		ShortDescription: "Create a delta from a signature and a source file",
+		HelpText:         "Create a delta that transforms the file the signature was created from into the source file.",
+		Run: func(cmd *cli.Command, args []string) (rc int, err error) {
+			if err = check_args(args, 2, 3); err != nil {
+				return 1, err
+			}
+			opts := &DeltaOptions{}
+			if err = cmd.GetOptionValues(opts); err != nil {
+				return 1, err
+			}
+			if err = delta(args, opts); err != nil {
+				return 1, err
+			}
+			return
+		},
+	})
+	sc.Add(cli.OptionSpec{
+		Name:    "--compress-threshold",
+		Type:    "int",
+		Default: "0",
+		Help:    "Compress literal data larger than this many bytes in the delta. Zero disables compression. Only use if the delta will be applied by a recent version of kitty.",
+	})
+	sc.Add(cli.OptionSpec{
+		Name: "--strong-verification",
+		Type: "bool-set",
+		Help: "Include a SHA-256 checksum of the source in the delta, so that the result of patching can be verified.",
+	})
+
+	sc = parent.AddSubCommand(&cli.Command{
+		Name:             "patch",
+		Usage:            "[options] basis delta [output]",
+		ShortDescription: "Apply a delta to a file",
+		HelpText:         "Apply the delta to the basis file, writing the result to output. The signature options must be the same as the ones used to create the signature.",
+		Run: func(cmd *cli.Command, args []string) (rc int, err error) {
+			if err = check_args(args, 2, 3); err != nil {
+				return 1, err
+			}
+			opts := &PatchOptions{}
+			if err = cmd.GetOptionValues(opts); err != nil {
+				return 1, err
+			}
+			if err = patch(args, opts); err != nil {
+				return 1, err
+			}
+			return
+		},
+	})
+	add_signature_options(sc)
+	sc.Add(cli.OptionSpec{
+		Name: "--in-place",
+		Type: "bool-set",
+		Help: "Modify the basis file in place, instead of writing a new file. If patching fails the basis file is left in an indeterminate state.",
+	})
+	sc.Add(cli.OptionSpec{
+		Name: "--strict",
+		Type: "bool-set",
+		Help: "Validate every operation in the delta before applying it. Use when the delta comes from an untrusted source.",
+	})
+	sc.Add(cli.OptionSpec{
+		Name: "--sparse",
+		Type: "bool-set",
+		Help: "Leave holes in the output file instead of writing long runs of zeros.",
+	})
+}
@@ -0,0 +1,84 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestRsyncCommands(t *testing.T) {
+	tdir := t.TempDir()
+	j := func(name string) string { return filepath.Join(tdir, name) }
+	basis := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1234)).Read(basis)
+	source := append(append([]byte("inserted"), basis[:1000]...), basis[2000:]...)
+	copy(source[100000:], "changed")
+	source = append(source, make([]byte, 64*1024)...)
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(j(name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("source", source)
+
+	for _, x := range []struct {
+		name  string
+		sig   SignatureOptions
+		delta DeltaOptions
+		patch PatchOptions
+	}{
+		{name: "defaults", sig: SignatureOptions{StrongHash: "xxh3"}},
+		{name: "options", sig: SignatureOptions{BlockSize: 1024, StrongHash: "blake3", FormatVersion: 1},
+			delta: DeltaOptions{CompressThreshold: 64, StrongVerification: true}, patch: PatchOptions{Strict: true, Sparse: true}},
+		{name: "in-place", sig: SignatureOptions{StrongHash: "sha256"}, patch: PatchOptions{InPlace: true}},
+	} {
+		write("basis", basis)
+		if err := signature([]string{j("basis"), j("signature")}, &x.sig); err != nil {
+			t.Fatalf("%s: signature failed with error: %s", x.name, err)
+		}
+		if err := delta([]string{j("signature"), j("source"), j("delta")}, &x.delta); err != nil {
+			t.Fatalf("%s: delta failed with error: %s", x.name, err)
+		}
+		if s, err := os.Stat(j("delta")); err != nil || s.Size() > int64(len(source)/4) {
+			t.Fatalf("%s: delta missing or too large: %v", x.name, err)
+		}
+		x.patch.BlockSize, x.patch.StrongHash, x.patch.FormatVersion = x.sig.BlockSize, x.sig.StrongHash, x.sig.FormatVersion
+		args, output := []string{j("basis"), j("delta"), j("output")}, j("output")
+		if x.patch.InPlace {
+			args, output = args[:2], j("basis")
+		}
+		if err := patch(args, &x.patch); err != nil {
+			t.Fatalf("%s: patch failed with error: %s", x.name, err)
+		}
+		actual, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, source) {
+			t.Fatalf("%s: patching did not reproduce the source", x.name)
+		}
+		os.Remove(j("output"))
+	}
+
+	// patching with a different block size than the signature fails
+	write("basis", basis)
+	if err := signature([]string{j("basis"), j("signature")}, &SignatureOptions{BlockSize: 1024, StrongHash: "xxh3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delta([]string{j("signature"), j("source"), j("delta")}, &DeltaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := patch([]string{j("basis"), j("delta"), j("output")}, &PatchOptions{BlockSize: 2048, StrongHash: "xxh3"}); err == nil {
+		t.Fatalf("No error when patching with the wrong block size")
+	}
+	if _, err := os.Stat(j("output")); err == nil {
+		t.Fatalf("Output left behind after patching failed")
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"kitty/tools/cmd/at"
 	"kitty/tools/cmd/edit_in_kitty"
 	"kitty/tools/cmd/pytest"
+	"kitty/tools/cmd/rsync"
 	"kitty/tools/cmd/run_shell"
 	"kitty/tools/cmd/show_error"
 	"kitty/tools/cmd/update_self"
@@ -46,6 +47,8 @@ func KittyToolEntryPoints(root *cli.Command) {
 	ssh.EntryPoint(root)
 	// transfer
 	transfer.EntryPoint(root)
+	// rsync
+	rsync.EntryPoint(root)
 	// unicode_input
 	unicode_input.EntryPoint(root)
 	// show_key
@@ -77,6 +80,28 @@ func KittyToolEntryPoints(root *cli.Command) {
 			return
 		},
 	})
+	// __generate-docs
+	root.AddSubCommand(&cli.Command{
+		Name:             "__generate-docs",
+		Hidden:           true,
+		Usage:            "[output_directory]",
+		ShortDescription: "Generate man pages and markdown documentation for all commands",
+		HelpText:         "Write a man page and a markdown file documenting every command, in the :file:`man1` and :file:`markdown` sub-directories of the output directory, which defaults to the current directory.",
+		Run: func(cmd *cli.Command, args []string) (rc int, err error) {
+			output_dir := "."
+			switch len(args) {
+			case 0:
+			case 1:
+				output_dir = args[0]
+			default:
+				return 1, fmt.Errorf("Only a single output directory can be specified")
+			}
+			if err = cmd.Root().GenerateDocs(output_dir); err != nil {
+				rc = 1
+			}
+			return
+		},
+	})
 	// __confirm_and_run_shebang__
 	root.AddSubCommand(&cli.Command{
 		Name:            "__confirm_and_run_shebang__",
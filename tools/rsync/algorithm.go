@@ -10,16 +10,22 @@ package rsync
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"hash"
 	"io"
 	"os"
+	"runtime"
 	"strconv"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/zeebo/xxh3"
 	"golang.org/x/exp/slices"
+	"lukechampine.com/blake3"
+
+	"kitty/tools/utils"
 )
 
 // If no BlockSize is specified in the rsync instance, this value is used.
@@ -28,7 +34,13 @@ const DefaultBlockSize = 1024 * 6
 // Internal constant used in rolling checksum.
 const _M = 1 << 16
 
-// Operation Types.
+// Operation Types. OpStrongChecksum carries the SHA-256 of the entire source
+// and is sent before all other operations when strong verification is enabled.
+// OpFormatVersion carries the serialization format version as a little endian
+// uint16 and is the first operation in deltas of format version one or higher.
+// OpReferenceRange copies a range of blocks from a reference file, a file
+// other than the source that is already present on the receiving side, see
+// Differ.AddReferenceSignature().
 type OpType byte // enum
 
 const (
@@ -36,12 +48,40 @@ const (
 	OpData
 	OpHash
 	OpBlockRange
+	OpStrongChecksum
+	OpFormatVersion
+	OpReferenceRange
 )
 
+// Set in the type byte of a serialized OpData operation when its payload is
+// zstd compressed
+const OpCompressedFlag byte = 0x80
+
+// Maximum size of the decompressed payload of a compressed OpData operation
+const MaxCompressedDataSize = MaxBlockSize * DataSizeMultiple
+
+var zstd_encoder = utils.Once(func() *zstd.Encoder {
+	ans, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		panic(err)
+	}
+	return ans
+})
+
+var zstd_decoder = utils.Once(func() *zstd.Decoder {
+	ans, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(MaxCompressedDataSize)), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		panic(err)
+	}
+	return ans
+})
+
 type xxh3_128 struct {
 	xxh3.Hasher
 }
 
+func (self *xxh3_128) Size() int { return 16 }
+
 func (self *xxh3_128) Sum(b []byte) []byte {
 	s := self.Sum128()
 	pos := len(b)
@@ -63,18 +103,43 @@ func new_xxh3_64() hash.Hash64 {
 	return ans
 }
 
+// The 64 bit XXH3 strong hash is serialized little endian, like the
+// other integers in signatures, for compatibility with the implementation in
+// kitty
+type xxh3_64_strong_hash struct {
+	hash.Hash64
+}
+
+func (self xxh3_64_strong_hash) Sum(b []byte) []byte {
+	return bin.AppendUint64(b, self.Sum64())
+}
+
+func new_xxh3_64_strong_hash() hash.Hash {
+	return xxh3_64_strong_hash{new_xxh3_64()}
+}
+
 func new_xxh3_128() hash.Hash {
 	ans := new(xxh3_128)
 	ans.Reset()
 	return ans
 }
 
+func new_sha256() hash.Hash {
+	return sha256.New()
+}
+
+func new_blake3() hash.Hash {
+	return blake3.New(32, nil)
+}
+
 // Instruction to mutate target to align to source.
 type Operation struct {
 	Type          OpType
 	BlockIndex    uint64
 	BlockIndexEnd uint64
 	Data          []byte
+	// The id of the reference file for OpReferenceRange
+	Reference uint32
 }
 
 func (self Operation) String() string {
@@ -84,9 +149,11 @@ func (self Operation) String() string {
 		ans += strconv.FormatUint(self.BlockIndex, 10)
 	case OpBlockRange:
 		ans += strconv.FormatUint(self.BlockIndex, 10) + " to " + strconv.FormatUint(self.BlockIndexEnd, 10)
+	case OpReferenceRange:
+		ans += strconv.FormatUint(uint64(self.Reference), 10) + ": " + strconv.FormatUint(self.BlockIndex, 10) + " to " + strconv.FormatUint(self.BlockIndexEnd, 10)
 	case OpData:
 		ans += strconv.Itoa(len(self.Data))
-	case OpHash:
+	case OpHash, OpStrongChecksum, OpFormatVersion:
 		ans += hex.EncodeToString(self.Data)
 	}
 	return ans + "}"
@@ -100,7 +167,9 @@ func (self Operation) SerializeSize() int {
 		return 9
 	case OpBlockRange:
 		return 13
-	case OpHash:
+	case OpReferenceRange:
+		return 17
+	case OpHash, OpStrongChecksum, OpFormatVersion:
 		return 3 + len(self.Data)
 	case OpData:
 		return 5 + len(self.Data)
@@ -115,7 +184,11 @@ func (self Operation) Serialize(ans []byte) {
 	case OpBlockRange:
 		bin.PutUint64(ans[1:], self.BlockIndex)
 		bin.PutUint32(ans[9:], uint32(self.BlockIndexEnd-self.BlockIndex))
-	case OpHash:
+	case OpReferenceRange:
+		bin.PutUint32(ans[1:], self.Reference)
+		bin.PutUint64(ans[5:], self.BlockIndex)
+		bin.PutUint32(ans[13:], uint32(self.BlockIndexEnd-self.BlockIndex))
+	case OpHash, OpStrongChecksum, OpFormatVersion:
 		bin.PutUint16(ans[1:], uint16(len(self.Data)))
 		copy(ans[3:], self.Data)
 	case OpData:
@@ -129,6 +202,21 @@ func (self *Operation) Unserialize(data []byte) (n int, err error) {
 	if len(data) < 1 {
 		return -1, io.ErrShortBuffer
 	}
+	if data[0] == byte(OpData)|OpCompressedFlag {
+		n = 5
+		if len(data) < n {
+			return -1, io.ErrShortBuffer
+		}
+		n += int(bin.Uint32(data[1:]))
+		if len(data) < n {
+			return -1, io.ErrShortBuffer
+		}
+		if self.Data, err = zstd_decoder().DecodeAll(data[5:n], nil); err != nil {
+			return 0, fmt.Errorf("failed to decompress data in operation: %w", err)
+		}
+		self.Type = OpData
+		return
+	}
 	switch OpType(data[0]) {
 	case OpBlock:
 		n = 9
@@ -145,7 +233,16 @@ func (self *Operation) Unserialize(data []byte) (n int, err error) {
 		self.BlockIndex = bin.Uint64(data[1:])
 		self.BlockIndexEnd = self.BlockIndex + uint64(bin.Uint32(data[9:]))
 		self.Data = nil
-	case OpHash:
+	case OpReferenceRange:
+		n = 17
+		if len(data) < n {
+			return -1, io.ErrShortBuffer
+		}
+		self.Reference = bin.Uint32(data[1:])
+		self.BlockIndex = bin.Uint64(data[5:])
+		self.BlockIndexEnd = self.BlockIndex + uint64(bin.Uint32(data[13:]))
+		self.Data = nil
+	case OpHash, OpStrongChecksum, OpFormatVersion:
 		n = 3
 		if len(data) < n {
 			return -1, io.ErrShortBuffer
@@ -178,25 +275,32 @@ func (self *Operation) Unserialize(data []byte) (n int, err error) {
 type BlockHash struct {
 	Index      uint64
 	WeakHash   uint32
-	StrongHash uint64
+	StrongHash []byte
 }
 
-const BlockHashSize = 20
+// The size of the fixed portion of a serialized BlockHash, the strong hash follows it
+const BlockHashHeaderSize = 12
+
+func (self BlockHash) SerializeSize() int {
+	return BlockHashHeaderSize + len(self.StrongHash)
+}
 
 // Put the serialization of this BlockHash to output
 func (self BlockHash) Serialize(output []byte) {
 	bin.PutUint64(output, self.Index)
 	bin.PutUint32(output[8:], self.WeakHash)
-	bin.PutUint64(output[12:], self.StrongHash)
+	copy(output[BlockHashHeaderSize:], self.StrongHash)
 }
 
+// Read a BlockHash from data, all bytes after the fixed header are
+// used as the strong hash. Note that StrongHash will point into data.
 func (self *BlockHash) Unserialize(data []byte) (err error) {
-	if len(data) < 20 {
-		return fmt.Errorf("record too small to be a BlockHash: %d < %d", len(data), 20)
+	if len(data) <= BlockHashHeaderSize {
+		return fmt.Errorf("record too small to be a BlockHash: %d <= %d", len(data), BlockHashHeaderSize)
 	}
 	self.Index = bin.Uint64(data)
 	self.WeakHash = bin.Uint32(data[8:])
-	self.StrongHash = bin.Uint64(data[12:])
+	self.StrongHash = data[BlockHashHeaderSize:]
 	return
 }
 
@@ -207,15 +311,47 @@ type rsync struct {
 	BlockSize int
 
 	// This must be non-nil before using any functions
-	hasher                  hash.Hash64
-	hasher_constructor      func() hash.Hash64
+	hasher                  hash.Hash
+	hasher_constructor      func() hash.Hash
 	checksummer_constructor func() hash.Hash
 	checksummer             hash.Hash
 	checksum_done           bool
-	buffer                  []byte
+	// Set when the delta being applied contains an OpStrongChecksum
+	strong_checksummer       hash.Hash
+	expected_strong_checksum []byte
+	buffer                   []byte
+	// OpData payloads larger than this are compressed, zero means no compression
+	literal_compression_threshold int
+	// The weak hash used when creating diffs, nil means rolling_checksum
+	rolling_hash_constructor func() rolling_hash
+	// Used to serialize operations in deltas, nil means the builtin format
+	codec OperationCodec
+	// Blocks from the signatures of reference files, used when creating diffs
+	reference_lookup map[uint32][]reference_block
+	// Reference files available when applying deltas, keyed by id
+	reference_files map[uint32]io.ReadSeeker
 }
 
-func (r *rsync) SetHasher(c func() hash.Hash64) {
+func (r *rsync) write_op(output io.Writer, op *Operation) error {
+	var b []byte
+	if r.codec != nil {
+		b = r.codec.Encode(*op, nil)
+	} else {
+		b = make([]byte, op.SerializeSize())
+		op.Serialize(b)
+	}
+	_, err := output.Write(b)
+	return err
+}
+
+func (r *rsync) read_op(data []byte, op *Operation) (int, error) {
+	if r.codec != nil {
+		return r.codec.Decode(data, op)
+	}
+	return op.Unserialize(data)
+}
+
+func (r *rsync) SetHasher(c func() hash.Hash) {
 	r.hasher_constructor = c
 	r.hasher = c()
 }
@@ -237,7 +373,7 @@ func (r *rsync) BlockHashCount(targetLength int64) (count int64) {
 }
 
 type signature_iterator struct {
-	hasher hash.Hash64
+	hasher hash.Hash
 	buffer []byte
 	src    io.Reader
 	rc     rolling_checksum
@@ -246,20 +382,26 @@ type signature_iterator struct {
 
 // ans is valid iff err == nil
 func (self *signature_iterator) next() (ans BlockHash, err error) {
-	n, err := io.ReadAtLeast(self.src, self.buffer, cap(self.buffer))
-	switch err {
-	case io.ErrUnexpectedEOF, io.EOF, nil:
-		err = nil
-	default:
-		return
+	var b []byte
+	if mf, ok := self.src.(*MappedFile); ok {
+		b = mf.remaining()
+		b = b[:min(len(b), cap(self.buffer))]
+		mf.pos += int64(len(b))
+	} else {
+		n, err := io.ReadAtLeast(self.src, self.buffer, cap(self.buffer))
+		switch err {
+		case io.ErrUnexpectedEOF, io.EOF, nil:
+		default:
+			return ans, err
+		}
+		b = self.buffer[:n]
 	}
-	if n == 0 {
+	if len(b) == 0 {
 		return ans, io.EOF
 	}
-	b := self.buffer[:n]
 	self.hasher.Reset()
 	self.hasher.Write(b)
-	ans = BlockHash{Index: self.index, WeakHash: self.rc.full(b), StrongHash: self.hasher.Sum64()}
+	ans = BlockHash{Index: self.index, WeakHash: self.rc.full(b), StrongHash: self.hasher.Sum(nil)}
 	self.index++
 	return
 
@@ -272,6 +414,284 @@ func (r *rsync) CreateSignatureIterator(target io.Reader) func() (BlockHash, err
 	}).next
 }
 
+// Target size for the amount of data hashed by a single worker at a time
+// when generating signatures concurrently
+const ConcurrentSignatureSegmentSize = 4 * 1024 * 1024
+
+type signature_segment struct {
+	data        []byte
+	first_index uint64
+	hashes      []BlockHash
+	err         error
+	done        chan struct{}
+	is_mapped   bool
+}
+
+// Calculate the signature of target using num_workers goroutines. The input
+// is read serially in segments of many blocks which are hashed concurrently,
+// the BlockHashes are still returned in order. Either the returned iterator
+// must be called till it returns an error or the returned stop function must
+// be called, otherwise goroutines are leaked.
+func (r *rsync) CreateSignatureIteratorConcurrent(target io.Reader, num_workers int) (next func() (BlockHash, error), stop func()) {
+	if num_workers < 1 {
+		num_workers = runtime.GOMAXPROCS(0)
+	}
+	block_size := r.BlockSize
+	segment_size := utils.Max(1, ConcurrentSignatureSegmentSize/block_size) * block_size
+	jobs := make(chan *signature_segment, num_workers)
+	results := make(chan *signature_segment, 2*num_workers)
+	free_buffers := make(chan []byte, 3*num_workers)
+	quit := make(chan struct{})
+	stopped := false
+	stop = func() {
+		if !stopped {
+			stopped = true
+			close(quit)
+		}
+	}
+
+	worker := func() {
+		hasher := r.hasher_constructor()
+		var rc rolling_checksum
+		for seg := range jobs {
+			seg.hashes = make([]BlockHash, 0, (len(seg.data)+block_size-1)/block_size)
+			for i, data := seg.first_index, seg.data; len(data) > 0; i++ {
+				b := data[:utils.Min(block_size, len(data))]
+				data = data[len(b):]
+				hasher.Reset()
+				hasher.Write(b)
+				seg.hashes = append(seg.hashes, BlockHash{Index: i, WeakHash: rc.full(b), StrongHash: hasher.Sum(nil)})
+			}
+			if !seg.is_mapped {
+				select {
+				case free_buffers <- seg.data[:cap(seg.data)]:
+				default:
+				}
+			}
+			seg.data = nil
+			close(seg.done)
+		}
+	}
+	for i := 0; i < num_workers; i++ {
+		go worker()
+	}
+
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		var index uint64
+		mf, is_mapped := target.(*MappedFile)
+		for {
+			var buf []byte
+			var n int
+			var err error
+			if is_mapped {
+				buf = mf.remaining()
+				n = min(len(buf), segment_size)
+				mf.pos += int64(n)
+				if n < segment_size {
+					err = io.EOF
+				}
+			} else {
+				select {
+				case buf = <-free_buffers:
+				default:
+					buf = make([]byte, segment_size)
+				}
+				n, err = io.ReadFull(target, buf)
+			}
+			switch err {
+			case nil, io.EOF, io.ErrUnexpectedEOF:
+			default:
+				seg := &signature_segment{err: err, done: make(chan struct{})}
+				close(seg.done)
+				select {
+				case results <- seg:
+				case <-quit:
+				}
+				return
+			}
+			if n > 0 {
+				seg := &signature_segment{data: buf[:n], first_index: index, done: make(chan struct{}), is_mapped: is_mapped}
+				index += uint64((n + block_size - 1) / block_size)
+				select {
+				case results <- seg:
+				case <-quit:
+					return
+				}
+				select {
+				case jobs <- seg:
+				case <-quit:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var current *signature_segment
+	pos := 0
+	finished := false
+	next = func() (BlockHash, error) {
+		if finished {
+			return BlockHash{}, io.EOF
+		}
+		for current == nil || pos >= len(current.hashes) {
+			seg, ok := <-results
+			if !ok {
+				finished = true
+				return BlockHash{}, io.EOF
+			}
+			<-seg.done
+			if seg.err != nil {
+				finished = true
+				stop()
+				return BlockHash{}, seg.err
+			}
+			current, pos = seg, 0
+		}
+		pos++
+		return current.hashes[pos-1], nil
+	}
+	return
+}
+
+// The size of the segments of the source that are diffed concurrently
+const ConcurrentDeltaSegmentSize = 4 * 1024 * 1024
+
+type delta_segment struct {
+	offset, size int64
+	delta        bytes.Buffer
+	err          error
+	done         chan struct{}
+}
+
+// Calculate the serialized delta of source against signature using
+// num_workers goroutines. The source is split into segments of many blocks
+// which are diffed independently, the deltas of the segments are written to
+// output in order. Blocks that straddle segment boundaries are not matched,
+// so the delta may be slightly larger than that from CreateDiff(). Either the
+// returned iterator must be called till it returns an error or the returned
+// stop function must be called, otherwise goroutines are leaked.
+func (r *rsync) CreateDiffConcurrent(source io.ReaderAt, size int64, signature []BlockHash, output io.Writer, num_workers int) (next func() error, stop func()) {
+	next, stop, _ = r.create_diff_concurrent(source, size, signature, output, num_workers)
+	return
+}
+
+func (r *rsync) create_diff_concurrent(source io.ReaderAt, size int64, signature []BlockHash, output io.Writer, num_workers int) (next func() error, stop func(), processed func() int64) {
+	if num_workers < 1 {
+		num_workers = runtime.GOMAXPROCS(0)
+	}
+	segment_size := int64(utils.Max(1, ConcurrentDeltaSegmentSize/r.BlockSize) * r.BlockSize)
+	hash_lookup := hash_lookup_for(signature)
+	jobs := make(chan *delta_segment, num_workers)
+	results := make(chan *delta_segment, 2*num_workers)
+	quit := make(chan struct{})
+	stopped := false
+	stop = func() {
+		if !stopped {
+			stopped = true
+			close(quit)
+		}
+	}
+	mf, is_mapped := source.(*MappedFile)
+	segment_reader := func(seg *delta_segment) io.Reader {
+		if is_mapped {
+			end := utils.Min(seg.offset+seg.size, int64(len(mf.data)))
+			return &MappedFile{data: mf.data[utils.Min(seg.offset, end):end]}
+		}
+		return io.NewSectionReader(source, seg.offset, seg.size)
+	}
+
+	worker := func() {
+		for seg := range jobs {
+			d := r.create_diff_with_lookup(segment_reader(seg), hash_lookup, &seg.delta)
+			d.omit_checksum = true
+			for {
+				if err := d.Next(); err != nil {
+					if err != io.EOF {
+						seg.err = err
+					}
+					break
+				}
+			}
+			close(seg.done)
+		}
+	}
+	for i := 0; i < num_workers; i++ {
+		go worker()
+	}
+
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		for offset := int64(0); offset < size; offset += segment_size {
+			seg := &delta_segment{offset: offset, size: utils.Min(segment_size, size-offset), done: make(chan struct{})}
+			select {
+			case results <- seg:
+			case <-quit:
+				return
+			}
+			select {
+			case jobs <- seg:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	checksummer := r.checksummer_constructor()
+	finished := false
+	var bytes_processed int64
+	processed = func() int64 { return bytes_processed }
+	next = func() error {
+		if finished {
+			return io.EOF
+		}
+		seg, ok := <-results
+		if !ok {
+			finished = true
+			err := r.write_op(output, &Operation{Type: OpHash, Data: checksummer.Sum(nil)})
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+		<-seg.done
+		err := seg.err
+		if err == nil {
+			// the segments are diffed separately, so the checksum of the
+			// whole source has to be calculated here
+			_, err = io.Copy(checksummer, segment_reader(seg))
+		}
+		if err == nil {
+			_, err = output.Write(seg.delta.Bytes())
+		}
+		bytes_processed += seg.size
+		if err != nil {
+			finished = true
+			stop()
+		}
+		return err
+	}
+	return
+}
+
+func (r *rsync) write_output(output io.Writer, b []byte) (err error) {
+	if r.checksummer == nil {
+		r.checksummer = r.checksummer_constructor()
+	}
+	if _, err = r.checksummer.Write(b); err == nil {
+		if r.strong_checksummer != nil {
+			r.strong_checksummer.Write(b)
+		}
+		_, err = output.Write(b)
+	}
+	return err
+}
+
 // Apply the difference to the target.
 func (r *rsync) ApplyDelta(output io.Writer, target io.ReadSeeker, op Operation) error {
 	var err error
@@ -283,14 +703,16 @@ func (r *rsync) ApplyDelta(output io.Writer, target io.ReadSeeker, op Operation)
 	if r.checksummer == nil {
 		r.checksummer = r.checksummer_constructor()
 	}
-
-	write := func(b []byte) (err error) {
-		if _, err = r.checksummer.Write(b); err == nil {
-			_, err = output.Write(b)
+	write := func(b []byte) error { return r.write_output(output, b) }
+	write_block := func(target io.ReadSeeker, op Operation) (err error) {
+		if mf, target_is_mapped := target.(*MappedFile); target_is_mapped {
+			// no need to copy the data into a buffer
+			start := int64(r.BlockSize) * int64(op.BlockIndex)
+			if start >= mf.Size() {
+				return io.EOF
+			}
+			return write(mf.data[start:utils.Min(start+int64(r.BlockSize), mf.Size())])
 		}
-		return err
-	}
-	write_block := func(op Operation) (err error) {
 		if _, err = target.Seek(int64(r.BlockSize*int(op.BlockIndex)), os.SEEK_SET); err != nil {
 			return err
 		}
@@ -308,15 +730,25 @@ func (r *rsync) ApplyDelta(output io.Writer, target io.ReadSeeker, op Operation)
 	switch op.Type {
 	case OpBlockRange:
 		for i := op.BlockIndex; i <= op.BlockIndexEnd; i++ {
-			if err = write_block(Operation{
+			if err = write_block(target, Operation{
 				Type:       OpBlock,
 				BlockIndex: i,
 			}); err != nil {
 				return err
 			}
 		}
+	case OpReferenceRange:
+		ref := r.reference_files[op.Reference]
+		if ref == nil {
+			return fmt.Errorf("The delta references the file: %d which is not available", op.Reference)
+		}
+		for i := op.BlockIndex; i <= op.BlockIndexEnd; i++ {
+			if err = write_block(ref, Operation{Type: OpBlock, BlockIndex: i}); err != nil {
+				return err
+			}
+		}
 	case OpBlock:
-		return write_block(op)
+		return write_block(target, op)
 	case OpData:
 		return write(op.Data)
 	case OpHash:
@@ -325,10 +757,66 @@ func (r *rsync) ApplyDelta(output io.Writer, target io.ReadSeeker, op Operation)
 			return fmt.Errorf("Failed to verify overall file checksum actual: %s != expected: %s. This usually happens if some data was corrupted in transit or one of the involved files was altered while the transfer was in progress.", hex.EncodeToString(actual), hex.EncodeToString(op.Data))
 		}
 		r.checksum_done = true
+	case OpFormatVersion:
+		// verified by the Patcher
+	case OpStrongChecksum:
+		if r.strong_checksummer != nil {
+			return fmt.Errorf("The delta contains more than one strong checksum")
+		}
+		r.strong_checksummer = sha256.New()
+		if len(op.Data) != r.strong_checksummer.Size() {
+			return fmt.Errorf("The strong checksum in the delta has incorrect size: %d != %d", len(op.Data), r.strong_checksummer.Size())
+		}
+		r.expected_strong_checksum = slices.Clone(op.Data)
 	}
 	return nil
 }
 
+// Returned by Patcher.FinishDelta() when the output does not match the strong
+// checksum sent in the delta
+type StrongVerificationError struct {
+	Expected, Actual []byte
+}
+
+func (self *StrongVerificationError) Error() string {
+	return fmt.Sprintf("Failed to verify the SHA-256 of the output actual: %s != expected: %s. Either the data was tampered with or there was a collision in the block hashes.", hex.EncodeToString(self.Actual), hex.EncodeToString(self.Expected))
+}
+
+func (r *rsync) verify_strong_checksum() error {
+	if r.strong_checksummer == nil {
+		return nil
+	}
+	if actual := r.strong_checksummer.Sum(nil); !bytes.Equal(actual, r.expected_strong_checksum) {
+		return &StrongVerificationError{Expected: r.expected_strong_checksum, Actual: actual}
+	}
+	return nil
+}
+
+// Calculate the SHA-256 of the remaining contents of source, leaving its
+// position unchanged
+func strong_checksum_of(source io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if mf, ok := source.(*MappedFile); ok {
+		h.Write(mf.remaining())
+		return h.Sum(nil), nil
+	}
+	s, ok := source.(io.ReadSeeker)
+	if !ok {
+		return nil, fmt.Errorf("Strong verification requires the source to be seekable")
+	}
+	pos, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(h, s); err != nil {
+		return nil, err
+	}
+	if _, err = s.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
 func (r *rsync) set_buffer_to_size(sz int) {
 	if cap(r.buffer) < sz {
 		r.buffer = make([]byte, sz)
@@ -337,6 +825,15 @@ func (r *rsync) set_buffer_to_size(sz int) {
 	}
 }
 
+// A rolling hash used as the weak hash to find candidate matching blocks.
+// add_one_byte() is called with the first and last bytes of the window after
+// it has moved forward by one byte.
+type rolling_hash interface {
+	full(data []byte) uint32
+	add_one_byte(first_byte, last_byte byte)
+	value() uint32
+}
+
 // see https://rsync.samba.org/tech_report/node3.html
 type rolling_checksum struct {
 	alpha, beta, val, l           uint32
@@ -357,6 +854,8 @@ func (self *rolling_checksum) full(data []byte) uint32 {
 	return self.val
 }
 
+func (self *rolling_checksum) value() uint32 { return self.val }
+
 func (self *rolling_checksum) add_one_byte(first_byte, last_byte byte) {
 	self.alpha = (self.alpha - self.first_byte_of_previous_window + uint32(last_byte)) % _M
 	self.beta = (self.beta - (self.l)*self.first_byte_of_previous_window + self.alpha) % _M
@@ -366,30 +865,58 @@ func (self *rolling_checksum) add_one_byte(first_byte, last_byte byte) {
 
 type diff struct {
 	buffer       []byte
-	op_write_buf [32]byte
+	op_write_buf [64]byte
 	// A single β hash may correlate with many unique hashes.
 	hash_lookup map[uint32][]BlockHash
 	source      io.Reader
-	hasher      hash.Hash64
-	checksummer hash.Hash
-	output      io.Writer
+	hasher      hash.Hash
+	hash_buf    []byte
+
+	compression_threshold int
+	compression_buf       []byte
+	checksummer           hash.Hash
+	output                io.Writer
 
 	window, data      struct{ pos, sz int }
 	block_size        int
 	finished, written bool
-	rc                rolling_checksum
+	rc                rolling_hash
+	// buffer is the read-only mapped contents of the source
+	source_is_mapped bool
+	// The offset in the source of the start of buffer
+	buffer_offset int64
+	// Blocks of reference files, searched when a block is not in hash_lookup
+	reference_lookup map[uint32][]reference_block
 
 	pending_op *Operation
+	// When set, operations are passed to the consumer instead of being
+	// serialized to output, with literal data referring to source_at
+	consumer  DeltaConsumer
+	source_at io.ReaderAt
+	// Used when diffing a segment of the source, the checksum of the whole
+	// source is sent separately
+	omit_checksum bool
+	codec         OperationCodec
+	codec_buf     []byte
 }
 
 func (self *diff) Next() (err error) {
 	return self.pump_till_op_written()
 }
 
-func (self *diff) hash(b []byte) uint64 {
+// The number of bytes of the source that have been processed
+func (self *diff) processed() int64 {
+	if self.finished {
+		return self.buffer_offset + int64(len(self.buffer))
+	}
+	return self.buffer_offset + int64(self.window.pos)
+}
+
+func (self *diff) hash(b []byte) []byte {
 	self.hasher.Reset()
 	self.hasher.Write(b)
-	return self.hasher.Sum64()
+	self.hash_buf = self.hasher.Sum(self.hash_buf[:0])
+	return self.hash_buf
 }
 
 // Combine OpBlock into OpBlockRange. To do this store the previous
@@ -427,6 +954,17 @@ func (self *diff) enqueue(op Operation) (err error) {
 			}
 		}
 		self.pending_op = &op
+	case OpReferenceRange:
+		if p := self.pending_op; p != nil {
+			if p.Type == OpReferenceRange && p.Reference == op.Reference && p.BlockIndexEnd+1 == op.BlockIndex {
+				p.BlockIndexEnd = op.BlockIndex
+				return
+			}
+			if err = self.send_pending(); err != nil {
+				return err
+			}
+		}
+		self.pending_op = &op
 	case OpHash:
 		if err = self.send_pending(); err != nil {
 			return
@@ -440,8 +978,18 @@ func (self *diff) enqueue(op Operation) (err error) {
 }
 
 func (self *diff) send_op(op *Operation) error {
-	b := self.op_write_buf[:op.SerializeSize()]
-	op.Serialize(b)
+	if self.consumer != nil {
+		self.written = true
+		return self.consumer.Op(*op)
+	}
+	var b []byte
+	if self.codec != nil {
+		self.codec_buf = self.codec.Encode(*op, self.codec_buf[:0])
+		b = self.codec_buf
+	} else {
+		b = self.op_write_buf[:op.SerializeSize()]
+		op.Serialize(b)
+	}
 	self.written = true
 	_, err := self.output.Write(b)
 	return err
@@ -453,10 +1001,34 @@ func (self *diff) send_data() error {
 			return err
 		}
 		self.written = true
+		if self.consumer != nil {
+			if err := self.consumer.Data(self.source_at, self.buffer_offset+int64(self.data.pos), int64(self.data.sz)); err != nil {
+				return err
+			}
+			self.data.pos += self.data.sz
+			self.data.sz = 0
+			return nil
+		}
 		data := self.buffer[self.data.pos : self.data.pos+self.data.sz]
+		if self.codec != nil {
+			self.codec_buf = self.codec.Encode(Operation{Type: OpData, Data: data}, self.codec_buf[:0])
+			if _, err := self.output.Write(self.codec_buf); err != nil {
+				return err
+			}
+			self.data.pos += self.data.sz
+			self.data.sz = 0
+			return nil
+		}
 		var buf [5]byte
-		bin.PutUint32(buf[1:], uint32(len(data)))
 		buf[0] = byte(OpData)
+		if self.compression_threshold > 0 && len(data) > self.compression_threshold {
+			self.compression_buf = zstd_encoder().EncodeAll(data, self.compression_buf[:0])
+			if len(self.compression_buf) < len(data) {
+				data = self.compression_buf
+				buf[0] |= OpCompressedFlag
+			}
+		}
+		bin.PutUint32(buf[1:], uint32(len(data)))
 		if _, err := self.output.Write(buf[:]); err != nil {
 			return err
 		}
@@ -489,6 +1061,9 @@ func (self *diff) ensure_idx_valid(idx int) (ok bool, err error) {
 	if idx < len(self.buffer) {
 		return true, nil
 	}
+	if self.source_is_mapped {
+		return false, nil
+	}
 	if idx >= cap(self.buffer) {
 		// need to wrap the buffer, so send off any data present behind the window
 		if err = self.send_data(); err != nil {
@@ -496,6 +1071,7 @@ func (self *diff) ensure_idx_valid(idx int) (ok bool, err error) {
 		}
 		// copy the window and any data present after it to the start of the buffer
 		distance_from_window_pos := idx - self.window.pos
+		self.buffer_offset += int64(self.window.pos)
 		amt_to_copy := len(self.buffer) - self.window.pos
 		copy(self.buffer, self.buffer[self.window.pos:self.window.pos+amt_to_copy])
 		self.buffer = self.buffer[:amt_to_copy]
@@ -529,7 +1105,11 @@ func (self *diff) finish_up() (err error) {
 	if err = self.send_data(); err != nil {
 		return
 	}
-	self.enqueue(Operation{Type: OpHash, Data: self.checksummer.Sum(nil)})
+	if self.omit_checksum {
+		err = self.send_pending()
+	} else {
+		err = self.enqueue(Operation{Type: OpHash, Data: self.checksummer.Sum(nil)})
+	}
 	self.finished = true
 	return
 }
@@ -545,6 +1125,12 @@ func (self *diff) read_next() (err error) {
 		}
 		self.window.pos++
 		self.data.sz++
+		if self.source_is_mapped && self.data.sz >= self.block_size*DataSizeMultiple {
+			// keep literal data operations no larger than when using a buffer
+			if err = self.send_data(); err != nil {
+				return err
+			}
+		}
 		self.rc.add_one_byte(self.buffer[self.window.pos], self.buffer[self.window.pos+self.window.sz-1])
 	} else {
 		if ok, err := self.ensure_idx_valid(self.window.pos + self.block_size - 1); !ok {
@@ -557,15 +1143,27 @@ func (self *diff) read_next() (err error) {
 		self.rc.full(self.buffer[self.window.pos : self.window.pos+self.window.sz])
 	}
 	found_hash := false
-	var block_index uint64
-	if hh, ok := self.hash_lookup[self.rc.val]; ok {
-		block_index, found_hash = find_hash(hh, self.hash(self.buffer[self.window.pos:self.window.pos+self.window.sz]))
+	op := Operation{Type: OpBlock}
+	var strong_hash []byte
+	if hh, ok := self.hash_lookup[self.rc.value()]; ok {
+		strong_hash = self.hash(self.buffer[self.window.pos : self.window.pos+self.window.sz])
+		op.BlockIndex, found_hash = find_hash(hh, strong_hash)
+	}
+	if !found_hash && self.reference_lookup != nil {
+		if rh, ok := self.reference_lookup[self.rc.value()]; ok {
+			if strong_hash == nil {
+				strong_hash = self.hash(self.buffer[self.window.pos : self.window.pos+self.window.sz])
+			}
+			op.Type = OpReferenceRange
+			op.Reference, op.BlockIndex, found_hash = find_reference_hash(rh, strong_hash)
+			op.BlockIndexEnd = op.BlockIndex
+		}
 	}
 	if found_hash {
 		if err = self.send_data(); err != nil {
 			return
 		}
-		self.enqueue(Operation{Type: OpBlock, BlockIndex: block_index})
+		self.enqueue(op)
 		self.window.pos += self.window.sz
 		self.data.pos = self.window.pos
 		self.window.sz = 0
@@ -574,19 +1172,30 @@ func (self *diff) read_next() (err error) {
 }
 
 type OperationWriter struct {
-	Operations     []Operation
-	expecting_data bool
+	Operations                []Operation
+	expecting_data            bool
+	expecting_compressed_data bool
 }
 
 func (self *OperationWriter) Write(p []byte) (n int, err error) {
 	if self.expecting_data {
 		self.expecting_data = false
-		self.Operations = append(self.Operations, Operation{Type: OpData, Data: slices.Clone(p)})
+		data := slices.Clone(p)
+		if self.expecting_compressed_data {
+			self.expecting_compressed_data = false
+			if data, err = zstd_decoder().DecodeAll(p, nil); err != nil {
+				return 0, err
+			}
+		}
+		self.Operations = append(self.Operations, Operation{Type: OpData, Data: data})
+	} else if p[0] == byte(OpData)|OpCompressedFlag {
+		self.expecting_data = true
+		self.expecting_compressed_data = true
 	} else {
 		switch OpType(p[0]) {
 		case OpData:
 			self.expecting_data = true
-		case OpBlock, OpBlockRange, OpHash:
+		case OpBlock, OpBlockRange, OpHash, OpStrongChecksum, OpFormatVersion, OpReferenceRange:
 			op := Operation{}
 			if n, err = op.Unserialize(p); err != nil {
 				return 0, err
@@ -617,25 +1226,53 @@ func (r *rsync) CreateDelta(source io.Reader, signature []BlockHash) ([]Operatio
 const DataSizeMultiple int = 8
 
 func (r *rsync) CreateDiff(source io.Reader, signature []BlockHash, output io.Writer) func() error {
+	return r.create_diff(source, signature, output).Next
+}
+
+func hash_lookup_for(signature []BlockHash) map[uint32][]BlockHash {
+	ans := make(map[uint32][]BlockHash, len(signature))
+	for _, h := range signature {
+		key := h.WeakHash
+		ans[key] = append(ans[key], h)
+	}
+	return ans
+}
+
+func (r *rsync) create_diff(source io.Reader, signature []BlockHash, output io.Writer) *diff {
+	return r.create_diff_with_lookup(source, hash_lookup_for(signature), output)
+}
+
+func (r *rsync) create_diff_with_lookup(source io.Reader, hash_lookup map[uint32][]BlockHash, output io.Writer) *diff {
 	ans := &diff{
-		block_size: r.BlockSize, buffer: make([]byte, 0, (r.BlockSize * DataSizeMultiple)),
-		hash_lookup: make(map[uint32][]BlockHash, len(signature)),
+		block_size:  r.BlockSize,
+		hash_lookup: hash_lookup,
 		source:      source, hasher: r.hasher_constructor(),
 		checksummer: r.checksummer_constructor(), output: output,
+		compression_threshold: r.literal_compression_threshold, codec: r.codec,
+		reference_lookup: r.reference_lookup,
 	}
-	for _, h := range signature {
-		key := h.WeakHash
-		ans.hash_lookup[key] = append(ans.hash_lookup[key], h)
+	if r.rolling_hash_constructor != nil {
+		ans.rc = r.rolling_hash_constructor()
+	} else {
+		ans.rc = &rolling_checksum{}
 	}
-
-	return ans.Next
+	if mf, ok := source.(*MappedFile); ok {
+		// work directly on the mapped data instead of reading it into a ring buffer
+		ans.buffer = mf.remaining()
+		mf.pos += int64(len(ans.buffer))
+		ans.source_is_mapped = true
+		ans.checksummer.Write(ans.buffer)
+	} else {
+		ans.buffer = make([]byte, 0, (r.BlockSize * DataSizeMultiple))
+	}
+	return ans
 }
 
 // Use a more unique way to identify a set of bytes.
-func (r *rsync) hash(v []byte) uint64 {
+func (r *rsync) hash(v []byte) []byte {
 	r.hasher.Reset()
 	r.hasher.Write(v)
-	return r.hasher.Sum64()
+	return r.hasher.Sum(nil)
 }
 
 func (r *rsync) HashSize() int      { return r.hasher.Size() }
@@ -643,9 +1280,9 @@ func (r *rsync) HashBlockSize() int { return r.hasher.BlockSize() }
 func (r *rsync) HasHasher() bool    { return r.hasher != nil }
 
 // Searches for a given strong hash among all strong hashes in this bucket.
-func find_hash(hh []BlockHash, hv uint64) (uint64, bool) {
+func find_hash(hh []BlockHash, hv []byte) (uint64, bool) {
 	for _, block := range hh {
-		if block.StrongHash == hv {
+		if bytes.Equal(block.StrongHash, hv) {
 			return block.Index, true
 		}
 	}
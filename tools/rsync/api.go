@@ -1,7 +1,7 @@
 // License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
 
 // First create a patcher with:
-// p = NewPatcher()
+// p = NewPatcher(expected_size, nil)
 // Create a signature for the file you want to update using
 // p.CreateSignatureIterator(file_to_update)
 // Now create a Differ with the created signature
@@ -12,14 +12,19 @@
 // Finally, apply this delta using the patcher to produce a file identical to reference_file
 // based ont he delta data and file_to_update
 // p.StartDelta(output_file, file_to_update)
+// or, to modify file_to_update directly, p.StartDeltaInPlace(file_to_update, "")
 // p.UpdateDelta(...)
 // p.FinishDelta()
 package rsync
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"math"
+	"os"
 
 	"kitty/tools/utils"
 )
@@ -34,6 +39,9 @@ type ChecksumType uint16
 
 const (
 	XXH3 StrongHashType = iota
+	XXH3128
+	SHA256
+	BLAKE3
 )
 const (
 	XXH3128Sum ChecksumType = iota
@@ -44,9 +52,41 @@ const (
 
 type GrowBufferFunction = func(slice []byte, sz int) []byte
 
+// A StrongHasher computes the per block strong hash used to confirm matches
+// found via the weak rolling checksum. Its type is recorded in the signature
+// header so that the Differ uses the same algorithm as the Patcher.
+type StrongHasher interface {
+	Type() StrongHashType
+	New() hash.Hash
+}
+
+type builtin_strong_hasher struct {
+	hash_type   StrongHashType
+	constructor func() hash.Hash
+}
+
+func (self builtin_strong_hasher) Type() StrongHashType { return self.hash_type }
+func (self builtin_strong_hasher) New() hash.Hash       { return self.constructor() }
+
+var builtin_strong_hashers = map[StrongHashType]StrongHasher{
+	XXH3:    builtin_strong_hasher{XXH3, new_xxh3_64_strong_hash},
+	XXH3128: builtin_strong_hasher{XXH3128, new_xxh3_128},
+	SHA256:  builtin_strong_hasher{SHA256, new_sha256},
+	BLAKE3:  builtin_strong_hasher{BLAKE3, new_blake3},
+}
+
+// Return the builtin StrongHasher for the specified type or nil if there is no such builtin
+func BuiltinStrongHasher(t StrongHashType) StrongHasher {
+	return builtin_strong_hashers[t]
+}
+
 type Api struct {
 	rsync     rsync
 	signature []BlockHash
+	// Custom hashers that can be used in addition to the builtin ones, when reading a signature
+	extra_strong_hashers []StrongHasher
+	progress_callback    func(bytes_processed, total int64)
+	format_version       uint16
 
 	Checksum_type    ChecksumType
 	Strong_hash_type StrongHashType
@@ -56,15 +96,112 @@ type Api struct {
 type Differ struct {
 	Api
 	unconsumed_signature_data []byte
+	strong_verification       bool
+	references                []reference_signature
 }
 
 type Patcher struct {
 	Api
 	unconsumed_delta_data                        []byte
 	expected_input_size_for_signature_generation int64
-	delta_output                                 io.Writer
+	delta_output                                 *counting_writer
 	delta_input                                  io.ReadSeeker
 	total_data_in_delta                          int
+	in_place                                     *inplace_target
+	require_strong_verification                  bool
+	sparse_output                                bool
+	sparse                                       *sparse_writer
+	format_version_verified                      bool
+	strict                                       bool
+	// The size of the source being patched, -1 if not yet known
+	source_size int64
+	// The offset in the delta of the unconsumed data
+	delta_offset int64
+	// The maximum size of incomplete operations to buffer, zero means unlimited
+	memory_budget int
+	// The number of bytes of literal data still to be written for an OpData
+	// that is being written as it arrives
+	streaming_data_remaining int64
+}
+
+type counting_writer struct {
+	w io.Writer
+	n int64
+}
+
+func (self *counting_writer) Write(p []byte) (n int, err error) {
+	n, err = self.w.Write(p)
+	self.n += int64(n)
+	return
+}
+
+type counting_reader struct {
+	r io.Reader
+	n int64
+}
+
+func (self *counting_reader) Read(p []byte) (n int, err error) {
+	n, err = self.r.Read(p)
+	self.n += int64(n)
+	return
+}
+
+// Return a reader that tracks the number of bytes read from src along with a
+// function that returns that number. When there is no progress callback, src
+// is returned unchanged.
+func (self *Api) track_bytes_read(src io.Reader) (io.Reader, func() int64) {
+	if self.progress_callback == nil {
+		return src, func() int64 { return 0 }
+	}
+	if mf, ok := src.(*MappedFile); ok {
+		start := mf.pos
+		return src, func() int64 { return mf.pos - start }
+	}
+	cr := &counting_reader{r: src}
+	return cr, func() int64 { return cr.n }
+}
+
+// Return the number of bytes remaining to be read in src or -1 if unknown
+func remaining_size(src io.Reader) int64 {
+	var sz int64 = -1
+	switch v := src.(type) {
+	case interface{ Size() int64 }:
+		sz = v.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if s, err := v.Stat(); err == nil && s.Mode().IsRegular() {
+			sz = s.Size()
+		}
+	}
+	if sz > -1 {
+		if s, ok := src.(io.Seeker); ok {
+			if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+				sz = utils.Max(0, sz-pos)
+			}
+		}
+	}
+	return sz
+}
+
+func (self *Api) report_progress(bytes_processed, total int64) {
+	if self.progress_callback != nil {
+		self.progress_callback(bytes_processed, total)
+	}
+}
+
+// Set a callback that is called periodically with the number of bytes
+// processed so far, while creating a delta. total is the size of the source
+// or -1 if it cannot be determined.
+func (self *Differ) SetProgressCallback(callback func(bytes_processed, total int64)) {
+	self.progress_callback = callback
+}
+
+// Set a callback that is called periodically with the number of bytes
+// processed so far. While creating a signature this is the number of bytes
+// read from the source and total is its size. While applying a delta this is
+// the number of bytes output and total is the expected input size this
+// Patcher was created with. total is -1 when it is unknown.
+func (self *Patcher) SetProgressCallback(callback func(bytes_processed, total int64)) {
+	self.progress_callback = callback
 }
 
 // internal implementation {{{
@@ -72,8 +209,10 @@ func (self *Api) read_signature_header(data []byte) (consumed int, err error) {
 	if len(data) < 12 {
 		return -1, io.ErrShortBuffer
 	}
-	if version := bin.Uint16(data); version != 0 {
-		return consumed, fmt.Errorf("Invalid version in signature header: %d", version)
+	if version := bin.Uint16(data); version > MaxFormatVersion {
+		return consumed, fmt.Errorf("Unsupported format version in signature header: %d > %d, the signature was probably created by a newer version of kitty", version, MaxFormatVersion)
+	} else {
+		self.format_version = version
 	}
 	switch csum := ChecksumType(bin.Uint16(data[2:])); csum {
 	case XXH3128Sum:
@@ -82,11 +221,8 @@ func (self *Api) read_signature_header(data []byte) (consumed int, err error) {
 	default:
 		return consumed, fmt.Errorf("Invalid checksum_type in signature header: %d", csum)
 	}
-	switch strong_hash := StrongHashType(bin.Uint16(data[4:])); strong_hash {
-	case XXH3:
-		self.Strong_hash_type = strong_hash
-		self.rsync.SetHasher(new_xxh3_64)
-	default:
+	strong_hash := StrongHashType(bin.Uint16(data[4:]))
+	if err = self.set_strong_hasher(self.strong_hasher_for(strong_hash)); err != nil {
 		return consumed, fmt.Errorf("Invalid strong_hash in signature header: %d", strong_hash)
 	}
 	switch weak_hash := WeakHashType(bin.Uint16(data[6:])); weak_hash {
@@ -108,11 +244,37 @@ func (self *Api) read_signature_header(data []byte) (consumed int, err error) {
 	return
 }
 
+func (self *Api) strong_hasher_for(t StrongHashType) StrongHasher {
+	for _, h := range self.extra_strong_hashers {
+		if h.Type() == t {
+			return h
+		}
+	}
+	return BuiltinStrongHasher(t)
+}
+
+func (self *Api) set_strong_hasher(h StrongHasher) error {
+	if h == nil {
+		return fmt.Errorf("No strong hasher specified")
+	}
+	self.Strong_hash_type = h.Type()
+	self.rsync.SetHasher(h.New)
+	return nil
+}
+
 func (self *Api) read_signature_blocks(data []byte) (consumed int) {
-	block_hash_size := self.rsync.HashSize() + 12
+	block_hash_size := self.rsync.HashSize() + BlockHashHeaderSize
+	num := len(data) / block_hash_size
+	if num == 0 {
+		return
+	}
+	// copy the strong hashes into a single allocation as data is re-used by the caller
+	strong_hashes := make([]byte, 0, num*self.rsync.HashSize())
 	for ; len(data) >= block_hash_size; data = data[block_hash_size:] {
 		bl := BlockHash{}
 		bl.Unserialize(data[:block_hash_size])
+		strong_hashes = append(strong_hashes, bl.StrongHash...)
+		bl.StrongHash = strong_hashes[len(strong_hashes)-len(bl.StrongHash):]
 		self.signature = append(self.signature, bl)
 		consumed += block_hash_size
 	}
@@ -127,16 +289,29 @@ func (self *Differ) FinishSignatureData() (err error) {
 	if !self.rsync.HasHasher() {
 		return fmt.Errorf("No header was found in the signature data")
 	}
-	return
+	return self.prepare_references()
 }
 
 func (self *Patcher) update_delta(data []byte) (consumed int, err error) {
 	op := Operation{}
 	for len(data) > 0 {
-		n, uerr := op.Unserialize(data)
+		if self.strict && self.rsync.codec == nil {
+			if err = self.validate_op_header(consumed, data); err != nil {
+				return
+			}
+		}
+		n, uerr := self.rsync.read_op(data, &op)
 		if uerr == nil {
+			if self.strict {
+				if err = self.validate_op(consumed, data, op); err != nil {
+					return
+				}
+			}
 			consumed += n
 			data = data[n:]
+			if err = self.verify_format_version(op); err != nil {
+				return
+			}
 			if err = self.rsync.ApplyDelta(self.delta_output, self.delta_input, op); err != nil {
 				return
 			}
@@ -147,6 +322,9 @@ func (self *Patcher) update_delta(data []byte) (consumed int, err error) {
 			if n < 0 {
 				return consumed, nil
 			}
+			if self.strict {
+				return consumed, self.invalid_delta(consumed, data, "%s", uerr)
+			}
 			return consumed, uerr
 		}
 	}
@@ -155,70 +333,234 @@ func (self *Patcher) update_delta(data []byte) (consumed int, err error) {
 
 // }}}
 
+// Make FinishDelta() fail if the delta does not contain a strong checksum of
+// the source, see Differ.SetStrongVerification()
+func (self *Patcher) RequireStrongVerification(required bool) {
+	self.require_strong_verification = required
+}
+
+// Leave holes in the output instead of writing long runs of zeros, so that
+// sparse files such as VM images and databases stay sparse. Only takes effect
+// when the output passed to StartDelta() is a seekable, truncatable file such
+// as *os.File, which must be empty.
+func (self *Patcher) SetSparseOutput(enabled bool) {
+	self.sparse_output = enabled
+}
+
+// Set the version of the serialization format used for the signature, and
+// hence for the delta, see NegotiateFormatVersion(). Defaults to zero, which
+// is understood by all versions of kitty.
+func (self *Patcher) SetFormatVersion(version uint16) error {
+	if version > MaxFormatVersion {
+		return fmt.Errorf("Unsupported format version: %d > %d", version, MaxFormatVersion)
+	}
+	self.format_version = version
+	return nil
+}
+
+func (self *Patcher) verify_format_version(op Operation) error {
+	if op.Type == OpFormatVersion {
+		v, err := op.format_version()
+		if err != nil {
+			return err
+		}
+		if self.format_version_verified || v != self.format_version {
+			return fmt.Errorf("The delta has format version %d but the signature was created with version %d", v, self.format_version)
+		}
+		self.format_version_verified = true
+	} else if !self.format_version_verified {
+		return fmt.Errorf("The delta does not start with a format version, the signature was created with version %d", self.format_version)
+	}
+	return nil
+}
+
 // Start applying serialized delta
 func (self *Patcher) StartDelta(delta_output io.Writer, delta_input io.ReadSeeker) {
-	self.delta_output = delta_output
+	self.sparse = nil
+	if sf, ok := delta_output.(sparse_file); ok && self.sparse_output {
+		self.sparse = &sparse_writer{f: sf}
+		delta_output = self.sparse
+	}
+	self.delta_output = &counting_writer{w: delta_output}
 	self.delta_input = delta_input
 	self.total_data_in_delta = 0
 	self.unconsumed_delta_data = nil
+	self.rsync.checksummer = nil
+	self.rsync.checksum_done = false
+	self.rsync.strong_checksummer = nil
+	self.rsync.expected_strong_checksum = nil
+	self.format_version_verified = self.format_version == 0
+	self.source_size = -1
+	self.delta_offset = 0
+	self.streaming_data_remaining = 0
+	if self.in_place != nil {
+		self.in_place.close()
+		self.in_place = nil
+	}
+}
+
+// Start applying serialized delta directly to target, which must be the file
+// the signature was created from, opened for reading and writing. This avoids
+// needing space for a second copy of the file. The file is modified only by
+// FinishDelta(), till then literal data from the delta is stored in a
+// temporary file in spill_dir (the default temp dir if empty). Blocks of the
+// original file that would be overwritten before a later copy is done with
+// them are saved there as well. Note that if FinishDelta() fails while writing
+// to target, it is left in an indeterminate state.
+func (self *Patcher) StartDeltaInPlace(target *os.File, spill_dir string) error {
+	ip, err := new_inplace_target(target, self.rsync.BlockSize, spill_dir)
+	if err != nil {
+		return err
+	}
+	self.StartDelta(ip, ip)
+	self.in_place = ip
+	return nil
 }
 
 // Apply a chunk of delta data
 func (self *Patcher) UpdateDelta(data []byte) (err error) {
-	self.unconsumed_delta_data = append(self.unconsumed_delta_data, data...)
-	consumed, err := self.update_delta(self.unconsumed_delta_data)
+	if data, err = self.stream_data(data); err != nil {
+		return err
+	}
+	pending, buffered := data, len(self.unconsumed_delta_data) > 0
+	if buffered {
+		self.unconsumed_delta_data = append(self.unconsumed_delta_data, data...)
+		pending = self.unconsumed_delta_data
+	}
+	consumed, err := self.update_delta(pending)
 	if err != nil {
 		return err
 	}
-	self.unconsumed_delta_data = utils.ShiftLeft(self.unconsumed_delta_data, consumed)
+	self.delta_offset += int64(consumed)
+	pending = pending[consumed:]
+	if self.memory_budget > 0 && len(pending) > self.effective_memory_budget() {
+		if pending, err = self.start_streaming_data(pending); err != nil {
+			return err
+		}
+	}
+	if buffered {
+		self.unconsumed_delta_data = utils.ShiftLeft(self.unconsumed_delta_data, len(self.unconsumed_delta_data)-len(pending))
+	} else {
+		// only copy the data that could not be applied immediately
+		self.unconsumed_delta_data = append(self.unconsumed_delta_data, pending...)
+	}
+	if self.progress_callback != nil {
+		self.report_progress(self.delta_output.n, utils.IfElse(self.expected_input_size_for_signature_generation > 0, self.expected_input_size_for_signature_generation, -1))
+	}
 	return
 }
 
-// Finish applying delta data
+// Finish applying delta data. Returns a *StrongVerificationError if the
+// delta contains a strong checksum that does not match the output.
 func (self *Patcher) FinishDelta() (err error) {
+	if self.in_place != nil {
+		defer func() {
+			self.in_place.close()
+			self.in_place = nil
+		}()
+	}
 	if err = self.UpdateDelta([]byte{}); err != nil {
 		return err
 	}
 	if len(self.unconsumed_delta_data) > 0 {
 		return fmt.Errorf("There are %d leftover bytes in the delta", len(self.unconsumed_delta_data))
 	}
+	if self.streaming_data_remaining > 0 {
+		return fmt.Errorf("The delta is truncated, %d bytes of literal data are missing", self.streaming_data_remaining)
+	}
 	self.delta_input = nil
 	self.delta_output = nil
 	self.unconsumed_delta_data = nil
 	if !self.rsync.checksum_done {
 		return fmt.Errorf("The checksum was not received at the end of the delta data")
 	}
+	if self.rsync.strong_checksummer == nil {
+		if self.require_strong_verification {
+			return fmt.Errorf("The delta does not contain a strong checksum")
+		}
+	} else if err = self.rsync.verify_strong_checksum(); err != nil {
+		return err
+	}
+	if self.in_place != nil {
+		err = self.in_place.finish()
+	}
+	if self.sparse != nil {
+		if serr := self.sparse.finish(); err == nil {
+			err = serr
+		}
+		self.sparse = nil
+	}
 	return
 }
 
 // Create a signature for the data source in src.
 func (self *Patcher) CreateSignatureIterator(src io.Reader, output io.Writer) func() error {
+	total := remaining_size(src)
+	src, bytes_read := self.track_bytes_read(src)
+	return self.create_signature_iterator(func() (func() (BlockHash, error), func()) {
+		return self.rsync.CreateSignatureIterator(src), nil
+	}, output, total, bytes_read)
+}
+
+// Create a signature for the data source in src, hashing blocks using
+// num_workers goroutines or GOMAXPROCS goroutines if num_workers < 1. Useful
+// for very large files. The returned function must be called till it returns
+// an error.
+func (self *Patcher) CreateSignatureIteratorConcurrent(src io.Reader, output io.Writer, num_workers int) func() error {
+	total := remaining_size(src)
+	src, bytes_read := self.track_bytes_read(src)
+	return self.create_signature_iterator(func() (func() (BlockHash, error), func()) {
+		return self.rsync.CreateSignatureIteratorConcurrent(src, num_workers)
+	}, output, total, bytes_read)
+}
+
+const signature_header_size = 12
+
+func (self *Patcher) serialize_signature_header(b []byte) {
+	bin.PutUint16(b[:], self.format_version)
+	bin.PutUint16(b[2:], uint16(self.Checksum_type))
+	bin.PutUint16(b[4:], uint16(self.Strong_hash_type))
+	bin.PutUint16(b[6:], uint16(self.Weak_hash_type))
+	bin.PutUint32(b[8:], uint32(self.rsync.BlockSize))
+}
+
+// bytes_read must only be called once the iterator is finished, as the source
+// may be read in other goroutines. Till then progress is computed from the
+// indices of the blocks.
+func (self *Patcher) create_signature_iterator(create_iterator func() (func() (BlockHash, error), func()), output io.Writer, total int64, bytes_read func() int64) func() error {
 	var it func() (BlockHash, error)
+	var stop func()
 	finished := false
-	var b [BlockHashSize]byte
+	b := make([]byte, BlockHashHeaderSize+self.rsync.HashSize())
 	return func() error {
 		if finished {
 			return io.EOF
 		}
 		if it == nil { // write signature header
-			it = self.rsync.CreateSignatureIterator(src)
-			bin.PutUint16(b[:], 0)
-			bin.PutUint16(b[2:], uint16(self.Checksum_type))
-			bin.PutUint16(b[4:], uint16(self.Strong_hash_type))
-			bin.PutUint16(b[6:], uint16(self.Weak_hash_type))
-			bin.PutUint32(b[8:], uint32(self.rsync.BlockSize))
-			if _, err := output.Write(b[:12]); err != nil {
+			self.serialize_signature_header(b)
+			if _, err := output.Write(b[:signature_header_size]); err != nil {
 				return err
 			}
+			it, stop = create_iterator()
 		}
 		bl, err := it()
 		switch err {
 		case io.EOF:
 			finished = true
+			self.report_progress(bytes_read(), total)
 			return io.EOF
 		case nil:
-			bl.Serialize(b[:BlockHashSize])
-			_, err = output.Write(b[:BlockHashSize])
+			if self.progress_callback != nil {
+				processed := int64(bl.Index+1) * int64(self.rsync.BlockSize)
+				if total > -1 {
+					processed = utils.Min(processed, total)
+				}
+				self.report_progress(processed, total)
+			}
+			bl.Serialize(b)
+			if _, err = output.Write(b); err != nil && stop != nil {
+				stop()
+			}
 			return err
 		default:
 			return err
@@ -228,6 +570,14 @@ func (self *Patcher) CreateSignatureIterator(src io.Reader, output io.Writer) fu
 
 // Create a serialized delta based on the previously loaded signature
 func (self *Differ) CreateDelta(src io.Reader, output io.Writer) func() error {
+	return self.create_delta(src, output, nil, nil)
+}
+
+// Create a serialized delta based on the previously loaded signature, using
+// num_workers goroutines or GOMAXPROCS goroutines if num_workers < 1. Useful
+// for very large sources, as creating a delta is CPU bound. The returned
+// function must be called till it returns an error.
+func (self *Differ) CreateDeltaConcurrent(src io.ReaderAt, size int64, output io.Writer, num_workers int) func() error {
 	if err := self.FinishSignatureData(); err != nil {
 		return func() error { return err }
 	}
@@ -236,13 +586,216 @@ func (self *Differ) CreateDelta(src io.Reader, output io.Writer) func() error {
 			return fmt.Errorf("Cannot call CreateDelta() before loading a signature")
 		}
 	}
-	return self.rsync.CreateDiff(src, self.signature, output)
+	var next func() error
+	var stop func()
+	var processed func() int64
+	return func() (err error) {
+		if next == nil {
+			if self.format_version > 0 {
+				err = self.rsync.write_op(output, format_version_op(self.format_version))
+			}
+			if err == nil && self.strong_verification {
+				var csum []byte
+				if csum, err = strong_checksum_of(io.NewSectionReader(src, 0, size)); err == nil {
+					err = self.rsync.write_op(output, &Operation{Type: OpStrongChecksum, Data: csum})
+				}
+			}
+			if err != nil {
+				return err
+			}
+			next, stop, processed = self.rsync.create_diff_concurrent(src, size, self.signature, output, num_workers)
+		}
+		if err = next(); err != nil && err != io.EOF {
+			stop()
+		}
+		self.report_progress(processed(), size)
+		return
+	}
+}
+
+// Receives the operations of a delta as they are created, see CreateDeltaOps()
+type DeltaConsumer interface {
+	// Called for every operation other than OpData
+	Op(op Operation) error
+	// Called for literal data, which is the length bytes at offset in source
+	Data(source io.ReaderAt, offset, length int64) error
+}
+
+// A DeltaConsumer that serializes the delta to a writer, exactly as
+// CreateDelta() would, except that literal data is never compressed.
+type SerializingDeltaConsumer struct {
+	Output io.Writer
+	buf    [64]byte
+}
+
+func (self *SerializingDeltaConsumer) Op(op Operation) error {
+	b := self.buf[:op.SerializeSize()]
+	op.Serialize(b)
+	_, err := self.Output.Write(b)
+	return err
+}
+
+func (self *SerializingDeltaConsumer) Data(source io.ReaderAt, offset, length int64) error {
+	if length > math.MaxUint32 {
+		return fmt.Errorf("Literal data too large for a single operation: %d", length)
+	}
+	self.buf[0] = byte(OpData)
+	bin.PutUint32(self.buf[1:], uint32(length))
+	if _, err := self.Output.Write(self.buf[:5]); err != nil {
+		return err
+	}
+	_, err := io.Copy(self.Output, io.NewSectionReader(source, offset, length))
+	return err
+}
+
+// Create a delta based on the previously loaded signature, passing the
+// operations to consumer rather than serializing them. Literal data is passed
+// as an offset and length in src, so consumers writing to a socket or file
+// can copy it directly from src rather than from intermediate buffers. The
+// returned function must be called till it returns an error.
+func (self *Differ) CreateDeltaOps(src io.ReaderAt, size int64, consumer DeltaConsumer) func() error {
+	var r io.Reader
+	if mf, ok := src.(*MappedFile); ok {
+		// use a separate position so that offsets are relative to the start of src
+		r = &MappedFile{data: mf.data[:utils.Min(size, mf.Size())]}
+	} else {
+		r = io.NewSectionReader(src, 0, size)
+	}
+	return self.create_delta(r, nil, consumer, src)
+}
+
+// An estimate of the delta for a source, see EstimateDelta()
+type DeltaEstimate struct {
+	// The number of bytes of the source that would be sent as literal data
+	LiteralBytes int64
+	// The number of bytes of the source that would be copied from the target
+	CopiedBytes int64
+	// The size of the serialized delta, without literal compression
+	DeltaSize int64
+}
+
+// The fraction of the source that does not need to be sent
+func (self DeltaEstimate) Savings() float64 {
+	total := self.LiteralBytes + self.CopiedBytes
+	if total == 0 {
+		return 0
+	}
+	return 1 - float64(self.DeltaSize)/float64(total)
+}
+
+type estimating_consumer struct {
+	ans DeltaEstimate
+}
+
+func (self *estimating_consumer) Op(op Operation) error {
+	self.ans.DeltaSize += int64(op.SerializeSize())
+	return nil
+}
+
+func (self *estimating_consumer) Data(source io.ReaderAt, offset, length int64) error {
+	self.ans.LiteralBytes += length
+	self.ans.DeltaSize += 5 + length
+	return nil
+}
+
+// Estimate the delta for src based on the previously loaded signature,
+// without creating it. This is much cheaper than CreateDelta() as no data is
+// copied, compressed or written, and can be used to decide whether sending a
+// delta is worthwhile compared to sending the whole of src.
+func (self *Differ) EstimateDelta(src io.Reader) (ans DeltaEstimate, err error) {
+	if err = self.FinishSignatureData(); err != nil {
+		return
+	}
+	if self.signature == nil {
+		return ans, fmt.Errorf("Cannot call EstimateDelta() before loading a signature")
+	}
+	c := estimating_consumer{}
+	d := self.rsync.create_diff(src, self.signature, nil)
+	d.consumer = &c
+	for {
+		if err = d.Next(); err != nil {
+			if err != io.EOF {
+				return
+			}
+			err = nil
+			break
+		}
+	}
+	ans = c.ans
+	ans.CopiedBytes = d.processed() - ans.LiteralBytes
+	if self.format_version > 0 {
+		ans.DeltaSize += int64(format_version_op(self.format_version).SerializeSize())
+	}
+	if self.strong_verification {
+		ans.DeltaSize += int64(Operation{Type: OpStrongChecksum, Data: make([]byte, sha256.Size)}.SerializeSize())
+	}
+	return
+}
+
+func (self *Differ) create_delta(src io.Reader, output io.Writer, consumer DeltaConsumer, src_at io.ReaderAt) func() error {
+	if err := self.FinishSignatureData(); err != nil {
+		return func() error { return err }
+	}
+	if self.signature == nil {
+		return func() error {
+			return fmt.Errorf("Cannot call CreateDelta() before loading a signature")
+		}
+	}
+	total := remaining_size(src)
+	var csum []byte
+	if self.strong_verification {
+		// must be done before create_diff() which consumes mapped sources
+		var err error
+		if csum, err = strong_checksum_of(src); err != nil {
+			return func() error { return err }
+		}
+	}
+	d := self.rsync.create_diff(src, self.signature, output)
+	d.consumer, d.source_at = consumer, src_at
+	header_sent := !self.strong_verification
+	version_sent := self.format_version == 0
+	return func() error {
+		if !version_sent {
+			version_sent = true
+			if err := d.send_op(format_version_op(self.format_version)); err != nil {
+				return err
+			}
+		}
+		if !header_sent {
+			header_sent = true
+			if err := d.send_op(&Operation{Type: OpStrongChecksum, Data: csum}); err != nil {
+				return err
+			}
+		}
+		err := d.Next()
+		if self.progress_callback != nil {
+			self.report_progress(d.processed(), total)
+		}
+		return err
+	}
+}
+
+// Send a SHA-256 checksum of the whole source at the start of the delta so
+// that the Patcher can verify the output independently of the block hashes.
+// This protects against collisions in the weak and strong block hashes, which
+// can be engineered when syncing untrusted data. It requires the source passed
+// to CreateDelta() to be seekable, as it is read twice. Only enable this if
+// the Patcher applying the delta understands strong checksums.
+func (self *Differ) SetStrongVerification(enabled bool) {
+	self.strong_verification = enabled
 }
 
 func (self *Differ) BlockSize() int {
 	return self.rsync.BlockSize
 }
 
+// Compress the payload of literal data operations larger than threshold bytes
+// using zstd. Use zero to disable compression, which is the default. Only
+// enable this if the Patcher applying the delta understands compressed operations.
+func (self *Differ) SetLiteralCompressionThreshold(threshold int) {
+	self.rsync.literal_compression_threshold = utils.Max(0, threshold)
+}
+
 // Add more external signature data
 func (self *Differ) AddSignatureData(data []byte) (err error) {
 	self.unconsumed_signature_data = append(self.unconsumed_signature_data, data...)
@@ -261,27 +814,50 @@ func (self *Differ) AddSignatureData(data []byte) (err error) {
 	return nil
 }
 
-// Use to calculate a delta based on a supplied signature, via AddSignatureData
-func NewDiffer() *Differ {
-	return &Differ{}
+// Use to calculate a delta based on a supplied signature, via AddSignatureData.
+// The strong hash algorithm is read from the signature header. Custom
+// StrongHasher implementations can be specified for use in addition to the builtin ones.
+func NewDiffer(strong_hashers ...StrongHasher) *Differ {
+	ans := &Differ{}
+	ans.extra_strong_hashers = strong_hashers
+	return ans
 }
 
-// Use to create a signature and possibly apply a delta
-func NewPatcher(expected_input_size int64) (ans *Patcher) {
-	bs := DefaultBlockSize
+// Use to create a signature and possibly apply a delta. The strong_hasher is
+// used when creating the signature, if nil the default XXH3 hash is used.
+func NewPatcher(expected_input_size int64, strong_hasher StrongHasher) (ans *Patcher) {
 	sz := utils.Max(0, expected_input_size)
-	if sz > 0 {
-		bs = int(math.Round(math.Sqrt(float64(sz))))
-	}
 	ans = &Patcher{}
-	ans.rsync.BlockSize = utils.Min(bs, MaxBlockSize)
-	ans.rsync.SetHasher(new_xxh3_64)
+	if strong_hasher == nil {
+		strong_hasher = BuiltinStrongHasher(XXH3)
+	}
+	ans.set_strong_hasher(strong_hasher)
 	ans.rsync.SetChecksummer(new_xxh3_128)
+	ans.set_block_size(BlockSizeFor(sz, DefaultChangeDensity))
+	ans.expected_input_size_for_signature_generation = sz
+	return
+}
 
-	if ans.rsync.HashBlockSize() > 0 && ans.rsync.HashBlockSize() < ans.rsync.BlockSize {
-		ans.rsync.BlockSize = (ans.rsync.BlockSize / ans.rsync.HashBlockSize()) * ans.rsync.HashBlockSize()
+func (self *Patcher) set_block_size(bs int) {
+	self.rsync.BlockSize = bs
+	if self.rsync.HashBlockSize() > 0 && self.rsync.HashBlockSize() < self.rsync.BlockSize {
+		self.rsync.BlockSize = (self.rsync.BlockSize / self.rsync.HashBlockSize()) * self.rsync.HashBlockSize()
 	}
+}
 
-	ans.expected_input_size_for_signature_generation = sz
-	return
+// Change the block size used for the signature, which is recorded in the
+// signature header. Must be called before creating the signature. The actual
+// block size used may be rounded down to a multiple of the block size of the
+// strong hash, see BlockSize(). Use BlockSizeFor() or SuggestBlockSize() to
+// choose a good block size.
+func (self *Patcher) SetBlockSize(bs int) error {
+	if bs < 1 || bs > MaxBlockSize {
+		return fmt.Errorf("Invalid block size: %d must be between 1 and %d", bs, MaxBlockSize)
+	}
+	self.set_block_size(bs)
+	return nil
+}
+
+func (self *Patcher) BlockSize() int {
+	return self.rsync.BlockSize
 }
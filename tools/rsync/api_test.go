@@ -5,13 +5,19 @@ package rsync
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 
 	"kitty/tools/utils"
@@ -44,7 +50,7 @@ func run_roundtrip_test(t *testing.T, src_data, changed []byte, num_of_patches,
 	}
 
 	// first try just the engine without serialization
-	p := NewPatcher(int64(len(src_data)))
+	p := NewPatcher(int64(len(src_data)), nil)
 	signature := make([]BlockHash, 0, 128)
 	s_it := p.rsync.CreateSignatureIterator(bytes.NewReader(changed))
 	for {
@@ -83,51 +89,56 @@ func run_roundtrip_test(t *testing.T, src_data, changed []byte, num_of_patches,
 		t.Fatalf("%sUnexpectedly poor delta performance: total_patch_size: %d total_delta_size: %d limit: %d", prefix_msg(), total_patch_size, total_data_in_delta, limit)
 	}
 
-	// Now try with serialization
+	// Now try with serialization, using every builtin strong hash
 	using_serialization = true
-	p = NewPatcher(int64(len(changed)))
-	signature_of_changed := bytes.Buffer{}
-	ss_it := p.CreateSignatureIterator(bytes.NewReader(changed), &signature_of_changed)
-	var err error
-	for {
-		err = ss_it()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			t.Fatal(err)
-		}
-	}
-	d := NewDiffer()
-	if err := d.AddSignatureData(signature_of_changed.Bytes()); err != nil {
-		t.Fatal(err)
-	}
-	db := bytes.Buffer{}
-	it := d.CreateDelta(bytes.NewBuffer(src_data), &db)
-	for {
-		if err := it(); err != nil {
+	for _, ht := range []StrongHashType{XXH3, XXH3128, SHA256, BLAKE3} {
+		p = NewPatcher(int64(len(changed)), BuiltinStrongHasher(ht))
+		signature_of_changed := bytes.Buffer{}
+		ss_it := p.CreateSignatureIterator(bytes.NewReader(changed), &signature_of_changed)
+		var err error
+		for {
+			err = ss_it()
 			if err == io.EOF {
 				break
+			} else if err != nil {
+				t.Fatal(err)
 			}
+		}
+		d := NewDiffer()
+		if err := d.AddSignatureData(signature_of_changed.Bytes()); err != nil {
 			t.Fatal(err)
 		}
-	}
-	deltabuf := db.Bytes()
-	outputbuf := bytes.Buffer{}
-	p.StartDelta(&outputbuf, bytes.NewReader(changed))
-	for len(deltabuf) > 0 {
-		n := utils.Min(123, len(deltabuf))
-		if err := p.UpdateDelta(deltabuf[:n]); err != nil {
+		if d.Strong_hash_type != ht {
+			t.Fatalf("%sDiffer did not use the strong hash from the signature: %d != %d", prefix_msg(), d.Strong_hash_type, ht)
+		}
+		db := bytes.Buffer{}
+		it := d.CreateDelta(bytes.NewBuffer(src_data), &db)
+		for {
+			if err := it(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+		}
+		deltabuf := db.Bytes()
+		outputbuf := bytes.Buffer{}
+		p.StartDelta(&outputbuf, bytes.NewReader(changed))
+		for len(deltabuf) > 0 {
+			n := utils.Min(123, len(deltabuf))
+			if err := p.UpdateDelta(deltabuf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			deltabuf = deltabuf[n:]
+		}
+		if err := p.FinishDelta(); err != nil {
 			t.Fatal(err)
 		}
-		deltabuf = deltabuf[n:]
-	}
-	if err := p.FinishDelta(); err != nil {
-		t.Fatal(err)
-	}
 
-	test_equal(src_data, outputbuf.Bytes())
-	if limit > -1 && p.total_data_in_delta > limit {
-		t.Fatalf("%sUnexpectedly poor delta performance: total_patch_size: %d total_delta_size: %d limit: %d", prefix_msg(), total_patch_size, p.total_data_in_delta, limit)
+		test_equal(src_data, outputbuf.Bytes())
+		if limit > -1 && p.total_data_in_delta > limit {
+			t.Fatalf("%sUnexpectedly poor delta performance with strong hash: %d total_patch_size: %d total_delta_size: %d limit: %d", prefix_msg(), ht, total_patch_size, p.total_data_in_delta, limit)
+		}
 	}
 }
 
@@ -193,4 +204,1218 @@ func TestRsyncHashers(t *testing.T) {
 	if diff := cmp.Diff(hex.EncodeToString(h2.Sum(nil)), `8d6b60383dfa90c21be79eecd1b1353d`); diff != "" {
 		t.Fatalf(diff)
 	}
+	if h2.Size() != len(h2.Sum(nil)) {
+		t.Fatalf("xxh3_128 hash has incorrect size: %d != %d", h2.Size(), len(h2.Sum(nil)))
+	}
+	// signatures must match the ones created by kitty, which serializes the
+	// 64 bit hash little endian
+	p := NewPatcher(1024*1024, nil)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader([]byte("abcd")), &sig)
+	for {
+		if err := it(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(`9098a8536fa99764`, hex.EncodeToString(sig.Bytes()[sig.Len()-8:])); diff != "" {
+		t.Fatalf("Strong hash in signature not little endian:\n%s", diff)
+	}
+}
+
+func TestRsyncConcurrentSignature(t *testing.T) {
+	data := generate_data(1000, 9*1024, "trailer")
+	p := NewPatcher(int64(len(data)), nil)
+	serial, concurrent := bytes.Buffer{}, bytes.Buffer{}
+	run := func(it func() error) {
+		for {
+			if err := it(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+		}
+	}
+	run(p.CreateSignatureIterator(bytes.NewReader(data), &serial))
+	run(p.CreateSignatureIteratorConcurrent(bytes.NewReader(data), &concurrent, 3))
+	if !bytes.Equal(serial.Bytes(), concurrent.Bytes()) {
+		t.Fatalf("Concurrently generated signature differs from serial one, sizes: %d != %d", serial.Len(), concurrent.Len())
+	}
+}
+
+func TestRsyncMappedFiles(t *testing.T) {
+	tdir := t.TempDir()
+	src_data := generate_data(16, 64, "trailer")
+	changed := slices.Clone(src_data)
+	patch_data(changed, "3:patch1", "130:ptch3", "400:patch4")
+	mapped := func(name string, data []byte) *MappedFile {
+		path := filepath.Join(tdir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		ans, err := MapFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ans.Close() })
+		return ans
+	}
+	run := func(it func() error) {
+		for {
+			if err := it(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+		}
+	}
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	run(p.CreateSignatureIterator(mapped("changed-sig", changed), &sig))
+	d := NewDiffer()
+	if err := d.AddSignatureData(sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	delta := bytes.Buffer{}
+	run(d.CreateDelta(mapped("src", src_data), &delta))
+	output := bytes.Buffer{}
+	p.StartDelta(&output, mapped("changed", changed))
+	if err := p.UpdateDelta(delta.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FinishDelta(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), src_data) {
+		t.Fatalf("Patching with mapped files failed:\n%s\n!=\n%s", output.String(), string(src_data))
+	}
+	run(d.CreateDelta(mapped("empty", nil), &bytes.Buffer{}))
+}
+
+func TestRsyncLiteralCompression(t *testing.T) {
+	src_data := []byte(strings.Repeat("some highly compressible text ", 512))
+	changed := generate_data(64, 128)
+	run := func(it func() error) {
+		for {
+			if err := it(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+		}
+	}
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	run(p.CreateSignatureIterator(bytes.NewReader(changed), &sig))
+	delta_size := func(threshold int) int {
+		d := NewDiffer()
+		d.SetLiteralCompressionThreshold(threshold)
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		delta := bytes.Buffer{}
+		run(d.CreateDelta(bytes.NewReader(src_data), &delta))
+		output := bytes.Buffer{}
+		p.StartDelta(&output, bytes.NewReader(changed))
+		if err := p.UpdateDelta(delta.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.FinishDelta(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), src_data) {
+			t.Fatalf("Patching with literal compression threshold: %d failed", threshold)
+		}
+		return delta.Len()
+	}
+	uncompressed, compressed := delta_size(0), delta_size(64)
+	if compressed*4 > uncompressed {
+		t.Fatalf("Compressing literal data did not reduce the delta size enough: %d -> %d", uncompressed, compressed)
+	}
+}
+
+func TestLibrsyncInterop(t *testing.T) {
+	data := generate_data(64, 64, "trailer")
+	for _, format := range []LibrsyncSignatureFormat{LibrsyncBlake2Signature, LibrsyncRabinKarpBlake2Signature} {
+		window := 16
+		rh := format.new_rolling_hash()
+		rh.full(data[:window])
+		for i := 1; i+window <= len(data); i++ {
+			rh.add_one_byte(data[i], data[i+window-1])
+			if rh.value() != format.new_rolling_hash().full(data[i:i+window]) {
+				t.Fatalf("Rolling %T gave incorrect value at: %d", rh, i)
+			}
+		}
+	}
+	changed := slices.Clone(data)
+	patch_data(changed, "3:patch1", "700:patch2", "2000:patch3")
+	for _, format := range []LibrsyncSignatureFormat{LibrsyncMD4Signature, LibrsyncBlake2Signature, LibrsyncRabinKarpMD4Signature, LibrsyncRabinKarpBlake2Signature} {
+		sig, delta, output := bytes.Buffer{}, bytes.Buffer{}, bytes.Buffer{}
+		if err := CreateLibrsyncSignature(bytes.NewReader(changed), &sig, format, 64, 8); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(sig.Len(), 12+(len(changed)+63)/64*(4+8)); diff != "" {
+			t.Fatalf("Signature for format 0x%x has incorrect size: %s", uint32(format), diff)
+		}
+		if err := CreateLibrsyncDelta(&sig, bytes.NewReader(data), &delta); err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() > 4*64+3*64 {
+			t.Fatalf("Delta for format 0x%x is unexpectedly large: %d", uint32(format), delta.Len())
+		}
+		if err := ApplyLibrsyncDelta(&output, bytes.NewReader(changed), &delta); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), data) {
+			t.Fatalf("Applying delta for format 0x%x failed", uint32(format))
+		}
+	}
+	// lengths that do not fit in the basis file or that overflow int64 are errors
+	for _, ops := range []string{
+		"44ffffffffffffffff", "450041", "454100",
+		"540000000000000001ffffffffffffffff", "54ffffffffffffffff0000000000000001",
+	} {
+		raw, _ := hex.DecodeString(fmt.Sprintf("%x%s00", LibrsyncDeltaMagic, ops))
+		if err := ApplyLibrsyncDelta(io.Discard, bytes.NewReader(make([]byte, 64)), bytes.NewReader(raw)); err == nil {
+			t.Fatalf("No error for invalid librsync delta: %s", ops)
+		}
+	}
+}
+
+func TestRsyncBlockSize(t *testing.T) {
+	sz := int64(1024 * 1024)
+	if diff := cmp.Diff([]int{BlockSizeFor(sz, DefaultChangeDensity), BlockSizeFor(sz, SparseChanges), BlockSizeFor(sz, DenseChanges)}, []int{1024, 4096, 256}); diff != "" {
+		t.Fatalf("Incorrect block sizes: %s", diff)
+	}
+	if bs := BlockSizeFor(100, DenseChanges); bs != 10 {
+		t.Fatalf("Block size for small file was scaled down: %d", bs)
+	}
+	random_data := make([]byte, sz)
+	rand.New(rand.NewSource(1)).Read(random_data)
+	for _, x := range []struct {
+		data     []byte
+		expected ChangeDensity
+	}{
+		{random_data, SparseChanges},
+		{[]byte(strings.Repeat("some text\n", 1024)), DefaultChangeDensity},
+		{append(make([]byte, 4096), random_data[:4096]...), DenseChanges},
+	} {
+		if d, err := GuessChangeDensity(bytes.NewReader(x.data), int64(len(x.data))); err != nil {
+			t.Fatal(err)
+		} else if d != x.expected {
+			t.Fatalf("Incorrect change density guess: %d != %d", d, x.expected)
+		}
+	}
+	p := NewPatcher(sz, nil)
+	bs, _ := SuggestBlockSize(bytes.NewReader(random_data), sz)
+	if err := p.SetBlockSize(bs); err != nil {
+		t.Fatal(err)
+	}
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(random_data), &sig)
+	for it() == nil {
+	}
+	d := NewDiffer()
+	if err := d.AddSignatureData(sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if d.BlockSize() != p.BlockSize() || d.BlockSize() != 4096 {
+		t.Fatalf("Block size not recorded in signature: %d != %d", d.BlockSize(), p.BlockSize())
+	}
+}
+
+func TestRsyncProgress(t *testing.T) {
+	src_data := generate_data(64, 256)
+	changed := slices.Clone(src_data)
+	patch_data(changed, "3:patch1", "1000:patch2")
+	type progress struct{ processed, total int64 }
+	var reports []progress
+	callback := func(processed, total int64) {
+		if len(reports) > 0 && processed < reports[len(reports)-1].processed {
+			t.Fatalf("Progress went backwards: %d -> %d", reports[len(reports)-1].processed, processed)
+		}
+		reports = append(reports, progress{processed, total})
+	}
+	check := func(which string, expected int64) {
+		if len(reports) == 0 {
+			t.Fatalf("No progress reported for %s", which)
+		}
+		if last := reports[len(reports)-1]; last != (progress{expected, expected}) {
+			t.Fatalf("Incorrect final progress for %s: %v != %d", which, last, expected)
+		}
+		reports = nil
+	}
+	p := NewPatcher(int64(len(src_data)), nil)
+	p.SetProgressCallback(callback)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	check("signature", int64(len(changed)))
+	// the source is read in a different goroutine than the one reporting progress
+	sig.Reset()
+	it = p.CreateSignatureIteratorConcurrent(io.MultiReader(bytes.NewReader(changed)), &sig, 3)
+	for it() == nil {
+	}
+	if last := reports[len(reports)-1]; last != (progress{int64(len(changed)), -1}) {
+		t.Fatalf("Incorrect final progress for concurrent signature: %v", last)
+	}
+	reports = nil
+	d := NewDiffer()
+	d.SetProgressCallback(callback)
+	if err := d.AddSignatureData(sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	delta := bytes.Buffer{}
+	it = d.CreateDelta(bytes.NewReader(src_data), &delta)
+	for it() == nil {
+	}
+	check("delta", int64(len(src_data)))
+	p.StartDelta(&bytes.Buffer{}, bytes.NewReader(changed))
+	if err := p.UpdateDelta(delta.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FinishDelta(); err != nil {
+		t.Fatal(err)
+	}
+	check("patch", int64(len(src_data)))
+}
+
+func TestRsyncInPlace(t *testing.T) {
+	tdir := t.TempDir()
+	block_size := 16
+	changed := generate_data(block_size, 64, "trailer")
+	half := len(changed) / 2
+	swapped := append(slices.Clone(changed[half:]), changed[:half]...)
+	reversed := []byte{}
+	for i := len(changed) - block_size; i >= 0; i -= block_size {
+		reversed = append(reversed, changed[i:i+block_size]...)
+	}
+	patched := slices.Clone(changed)
+	patch_data(patched, "3:patch1", "130:ptch3", "400:patch4")
+	// the number of blocks of the original file that must be saved before
+	// being overwritten
+	expected_spills := map[string]int{"identical": 0, "patched": 0, "backward": 0, "shrunk": 0, "grown": 0, "empty": 0}
+	for name, src_data := range map[string][]byte{
+		"identical": changed,
+		"patched":   patched,
+		"forward":   append([]byte("some inserted data"), changed...),
+		"backward":  changed[block_size*3+5:],
+		"swapped":   swapped,
+		"reversed":  reversed,
+		"shrunk":    changed[:half],
+		"grown":     append(slices.Clone(changed), changed...),
+		"empty":     {},
+	} {
+		path := filepath.Join(tdir, name)
+		if err := os.WriteFile(path, changed, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		p := NewPatcher(int64(len(changed)), nil)
+		if err := p.SetBlockSize(block_size); err != nil {
+			t.Fatal(err)
+		}
+		sig := bytes.Buffer{}
+		it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+		for it() == nil {
+		}
+		d := NewDiffer()
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		delta := bytes.Buffer{}
+		it = d.CreateDelta(bytes.NewReader(src_data), &delta)
+		for it() == nil {
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.StartDeltaInPlace(f, tdir); err != nil {
+			t.Fatal(err)
+		}
+		ip := p.in_place
+		if err = p.UpdateDelta(delta.Bytes()); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if err = p.FinishDelta(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		f.Close()
+		if expected, found := expected_spills[name]; found && len(ip.spilled) != expected {
+			t.Fatalf("%s: %d blocks were saved to the spill file instead of %d", name, len(ip.spilled), expected)
+		}
+		actual, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, src_data) {
+			t.Fatalf("Patching in place failed for %s:\n%s\n!=\n%s", name, string(actual), string(src_data))
+		}
+	}
+	if entries, _ := os.ReadDir(tdir); len(entries) != 9 {
+		t.Fatalf("Spill files were left behind in: %s", tdir)
+	}
+}
+
+func TestRsyncSignatureBundle(t *testing.T) {
+	files := map[string][]byte{"a": generate_data(16, 64, "trailer"), "b/c": generate_data(7, 10), "empty": {}}
+	names := maps.Keys(files)
+	slices.Sort(names)
+	mtime := time.Unix(1234, 5678)
+	bundle := bytes.Buffer{}
+	w := NewSignatureBundleWriter(&bundle)
+	patchers := make(map[string]*Patcher, len(files))
+	for _, name := range names {
+		data := files[name]
+		p := NewPatcher(int64(len(data)), nil)
+		if err := w.Add(p, name, int64(len(data)), mtime, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		patchers[name] = p
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := ReadSignatureBundle(&bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigs) != len(names) {
+		t.Fatalf("Incorrect number of signatures in bundle: %d != %d", len(sigs), len(names))
+	}
+	for i, s := range sigs {
+		name := names[i]
+		if s.Path != name || s.Size != int64(len(files[name])) || !s.ModTime.Equal(mtime) {
+			t.Fatalf("Incorrect metadata for %s in bundle: %#v", name, s)
+		}
+		src_data := slices.Clone(files[name])
+		if len(src_data) > 8 {
+			patch_data(src_data, "3:patch1")
+		}
+		d, err := s.NewDiffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta := bytes.Buffer{}
+		it := d.CreateDelta(bytes.NewReader(src_data), &delta)
+		for it() == nil {
+		}
+		output := bytes.Buffer{}
+		p := patchers[name]
+		p.StartDelta(&output, bytes.NewReader(files[name]))
+		if err = p.UpdateDelta(delta.Bytes()); err == nil {
+			err = p.FinishDelta()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), src_data) {
+			t.Fatalf("Patching using bundled signature failed for %s", name)
+		}
+	}
+	empty := bytes.Buffer{}
+	if err = NewSignatureBundleWriter(&empty).Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if sigs, err = ReadSignatureBundle(&empty); err != nil || len(sigs) != 0 {
+		t.Fatalf("Reading empty bundle failed: %v %v", sigs, err)
+	}
+	truncated := bytes.Buffer{}
+	w = NewSignatureBundleWriter(&truncated)
+	if err = w.Add(NewPatcher(64, nil), "x", 64, mtime, bytes.NewReader(generate_data(8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadSignatureBundle(bytes.NewReader(truncated.Bytes()[:truncated.Len()-1])); err == nil {
+		t.Fatalf("No error reading truncated bundle")
+	}
+}
+
+func TestRsyncStrongVerification(t *testing.T) {
+	changed := generate_data(16, 64, "trailer")
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", "400:patch4")
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	src_path := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src_path, src_data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	make_delta_from := func(strong bool, src io.Reader) []byte {
+		d := NewDiffer()
+		d.SetStrongVerification(strong)
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		delta := bytes.Buffer{}
+		it := d.CreateDelta(src, &delta)
+		for {
+			if err := it(); err != nil {
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+		return delta.Bytes()
+	}
+	make_delta := func(strong bool) []byte { return make_delta_from(strong, bytes.NewReader(src_data)) }
+	apply := func(delta []byte) error {
+		output := bytes.Buffer{}
+		p.StartDelta(&output, bytes.NewReader(changed))
+		if err := p.UpdateDelta(delta); err != nil {
+			return err
+		}
+		if err := p.FinishDelta(); err != nil {
+			return err
+		}
+		if !bytes.Equal(output.Bytes(), src_data) {
+			t.Fatalf("Patching with strong verification failed")
+		}
+		return nil
+	}
+	delta := make_delta(true)
+	if err := apply(delta); err != nil {
+		t.Fatal(err)
+	}
+	for _, mapped := range []bool{false, true} {
+		f, err := os.Open(src_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var src io.Reader = f
+		if mapped {
+			mf, err := MapFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mf.Close()
+			src = mf
+		}
+		if err := apply(make_delta_from(true, src)); err != nil {
+			t.Fatalf("Strong verification failed with mapped: %v source: %s", mapped, err)
+		}
+		f.Close()
+	}
+	// simulate a collision in the block hashes
+	delta[3] ^= 1
+	var sve *StrongVerificationError
+	if err := apply(delta); !errors.As(err, &sve) {
+		t.Fatalf("Incorrect error for tampered strong checksum: %v", err)
+	}
+	p.RequireStrongVerification(true)
+	if err := apply(make_delta(false)); err == nil {
+		t.Fatalf("No error for missing strong checksum")
+	}
+}
+
+func TestRsyncDeltaOps(t *testing.T) {
+	changed := generate_data(16, 64, "trailer")
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", "130:ptch3", "400:patch4")
+	src_data = append([]byte("prefix"), src_data...)
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	run := func(it func() error) {
+		for {
+			if err := it(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, strong := range []bool{false, true} {
+		d := NewDiffer()
+		d.SetStrongVerification(strong)
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		expected := bytes.Buffer{}
+		run(d.CreateDelta(bytes.NewReader(src_data), &expected))
+		actual := bytes.Buffer{}
+		run(d.CreateDeltaOps(bytes.NewReader(src_data), int64(len(src_data)), &SerializingDeltaConsumer{Output: &actual}))
+		if diff := cmp.Diff(expected.Bytes(), actual.Bytes()); diff != "" {
+			t.Fatalf("Delta from CreateDeltaOps() differs from CreateDelta() with strong verification: %v\n%s", strong, diff)
+		}
+	}
+}
+
+func TestRsyncSignatureCache(t *testing.T) {
+	tdir := t.TempDir()
+	path := filepath.Join(tdir, "file")
+	data := generate_data(16, 64)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewSignatureCache(filepath.Join(tdir, "cache"))
+	p := NewPatcher(int64(len(data)), nil)
+	sig, err := c.SignatureFor(path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := FileIdentityFor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, found := c.Get(id, p); !found || !bytes.Equal(cached, sig) {
+		t.Fatalf("Signature was not cached")
+	}
+	if _, found := c.Get(id, NewPatcher(int64(len(data))*4, nil)); found {
+		t.Fatalf("Signature with different block size was used from cache")
+	}
+	mtime := id.ModTime.Add(time.Second)
+	if err = os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if nid, _ := FileIdentityFor(path); nid == id {
+		t.Fatalf("File identity unchanged after changing mtime")
+	} else if _, found := c.Get(nid, p); found {
+		t.Fatalf("Signature of changed file was used from cache")
+	}
+	if err = c.Invalidate(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := c.Get(id, p); found {
+		t.Fatalf("Signature was not invalidated")
+	}
+	if err = c.Invalidate(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRsyncStreams(t *testing.T) {
+	changed := generate_data(16, 64, "trailer")
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", "130:ptch3", "400:patch4")
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	output := bytes.Buffer{}
+	w := p.NewPatchWriter(&output, bytes.NewReader(changed))
+	if _, err := io.Copy(w, NewDeltaReader(bytes.NewReader(src_data), sig.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), src_data) {
+		t.Fatalf("Patching via streams failed:\n%s\n!=\n%s", output.String(), string(src_data))
+	}
+	if _, err := io.ReadAll(NewDeltaReader(bytes.NewReader(src_data), []byte("invalid signature"))); err == nil {
+		t.Fatalf("No error reading delta with invalid signature")
+	}
+	w = p.NewPatchWriter(&output, bytes.NewReader(changed))
+	if err := w.Close(); err == nil {
+		t.Fatalf("No error closing patch writer with incomplete delta")
+	}
+}
+
+func TestRsyncSparseOutput(t *testing.T) {
+	tdir := t.TempDir()
+	changed := make([]byte, 16*SparseBlockSize)
+	copy(changed[SparseBlockSize+7:], "some data")
+	src_data := slices.Clone(changed)
+	copy(src_data[5*SparseBlockSize-3:], "more data")
+	p := NewPatcher(int64(len(changed)), nil)
+	p.SetSparseOutput(true)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	output, err := os.Create(filepath.Join(tdir, "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	w := p.NewPatchWriter(output, bytes.NewReader(changed))
+	if _, err = io.Copy(w, NewDeltaReader(bytes.NewReader(src_data), sig.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := os.ReadFile(output.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, src_data) {
+		t.Fatalf("Patching with sparse output failed")
+	}
+	sw := sparse_writer{f: output}
+	output.Truncate(0)
+	output.Seek(0, io.SeekStart)
+	for _, chunk := range [][]byte{src_data[:17], src_data[17 : 3*SparseBlockSize], src_data[3*SparseBlockSize:]} {
+		if _, err = sw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sw.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ = os.ReadFile(output.Name()); !bytes.Equal(actual, src_data) {
+		t.Fatalf("Writing sparse output in chunks failed")
+	}
+}
+
+func TestRsyncFormatVersion(t *testing.T) {
+	changed := generate_data(16, 64, "trailer")
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", "400:patch4")
+	signature := func(version uint16) (*Patcher, []byte) {
+		p := NewPatcher(int64(len(changed)), nil)
+		if err := p.SetFormatVersion(version); err != nil {
+			t.Fatal(err)
+		}
+		sig := bytes.Buffer{}
+		it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+		for it() == nil {
+		}
+		return p, sig.Bytes()
+	}
+	apply := func(p *Patcher, sig []byte) error {
+		output := bytes.Buffer{}
+		w := p.NewPatchWriter(&output, bytes.NewReader(changed))
+		if _, err := io.Copy(w, NewDeltaReader(bytes.NewReader(src_data), sig)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if !bytes.Equal(output.Bytes(), src_data) {
+			t.Fatalf("Patching with format version failed")
+		}
+		return nil
+	}
+	p0, sig0 := signature(FormatVersion0)
+	p1, sig1 := signature(FormatVersion1)
+	if err := apply(p0, sig0); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(p1, sig1); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(p1, sig0); err == nil {
+		t.Fatalf("No error applying version 0 delta with version 1 patcher")
+	}
+	if err := apply(p0, sig1); err == nil {
+		t.Fatalf("No error applying version 1 delta with version 0 patcher")
+	}
+	if err := p0.SetFormatVersion(MaxFormatVersion + 1); err == nil {
+		t.Fatalf("No error setting unsupported format version")
+	}
+	sig1 = slices.Clone(sig1)
+	bin.PutUint16(sig1, MaxFormatVersion+1)
+	if err := NewDiffer().AddSignatureData(sig1); err == nil {
+		t.Fatalf("No error reading signature with unsupported format version")
+	}
+	remote, err := ParseFormatVersions(SerializeFormatVersions(0, MaxFormatVersion+3, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint16{0, 1, MaxFormatVersion + 3}, remote); diff != "" {
+		t.Fatalf("Parsing format versions failed:\n%s", diff)
+	}
+	if v, err := NegotiateFormatVersion(remote...); err != nil || v != MaxFormatVersion {
+		t.Fatalf("Negotiating format version failed: %d %v", v, err)
+	}
+	if _, err := NegotiateFormatVersion(MaxFormatVersion + 1); err == nil {
+		t.Fatalf("No error negotiating with no common format version")
+	}
+}
+
+func TestRsyncStrictValidation(t *testing.T) {
+	tdir := t.TempDir()
+	changed := generate_data(16, 64, "trailer")
+	// completely different data so that the delta is one long literal run
+	src_data := bytes.Repeat([]byte("abcdefghijklmnopqrstuvwxyz"), 200)
+	p := NewPatcher(int64(len(changed)), nil)
+	p.SetStrictValidation(true)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	path := filepath.Join(tdir, "src")
+	if err := os.WriteFile(path, src_data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src, err := MapFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	delta, err := io.ReadAll(NewDeltaReader(src, sig.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(delta []byte) error {
+		output := bytes.Buffer{}
+		p.StartDelta(&output, bytes.NewReader(changed))
+		if err := p.UpdateDelta(delta); err != nil {
+			return err
+		}
+		if err := p.FinishDelta(); err != nil {
+			return err
+		}
+		if !bytes.Equal(output.Bytes(), src_data) {
+			t.Fatalf("Patching with strict validation failed")
+		}
+		return nil
+	}
+	if err = apply(delta); err != nil {
+		t.Fatal(err)
+	}
+	serialize := func(ops ...Operation) (ans []byte) {
+		for _, op := range ops {
+			b := make([]byte, op.SerializeSize())
+			op.Serialize(b)
+			ans = append(ans, b...)
+		}
+		return
+	}
+	huge_data := []byte{byte(OpData), 0, 0, 0, 0}
+	bin.PutUint32(huge_data[1:], 1<<31)
+	for name, delta := range map[string][]byte{
+		"block index":      serialize(Operation{Type: OpBlock, BlockIndex: 1000}),
+		"block range":      serialize(Operation{Type: OpBlockRange, BlockIndex: 1, BlockIndexEnd: 1<<32 - 1}),
+		"data size":        huge_data,
+		"checksum size":    serialize(Operation{Type: OpHash, Data: []byte{1, 2, 3}}),
+		"op after the end": append(delta, serialize(Operation{Type: OpBlock, BlockIndex: 0})...),
+		"unknown op":       {0x7f, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		err := apply(delta)
+		var ide *InvalidDeltaError
+		if !errors.Is(err, ErrInvalidDelta) || !errors.As(err, &ide) {
+			t.Fatalf("Incorrect error for invalid %s: %v", name, err)
+		}
+	}
+}
+
+func TestRsyncEstimateDelta(t *testing.T) {
+	changed := generate_data(16, 64, "trailer")
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", "130:ptch3", "400:patch4")
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	for _, strong := range []bool{false, true} {
+		d := NewDiffer()
+		d.SetStrongVerification(strong)
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		estimate, err := d.EstimateDelta(bytes.NewReader(src_data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		delta, err := io.ReadAll(NewDeltaReader(bytes.NewReader(src_data), sig.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected_size := int64(len(delta))
+		if strong {
+			expected_size += 3 + 32
+		}
+		if estimate.DeltaSize != expected_size || estimate.LiteralBytes+estimate.CopiedBytes != int64(len(src_data)) {
+			t.Fatalf("Incorrect estimate: %#v for delta of size: %d", estimate, expected_size)
+		}
+		if estimate.LiteralBytes == 0 || estimate.Savings() <= 0.5 {
+			t.Fatalf("Unexpected estimate: %#v", estimate)
+		}
+	}
+}
+
+func TestRsyncConcurrentDelta(t *testing.T) {
+	changed := make([]byte, 2*ConcurrentDeltaSegmentSize+12345)
+	rand.New(rand.NewSource(1234)).Read(changed)
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", fmt.Sprintf("%d:boundary", ConcurrentDeltaSegmentSize-4), fmt.Sprintf("%d:patch3", len(changed)-10))
+	src_data = append(src_data, "trailer"...)
+	p := NewPatcher(int64(len(changed)), nil)
+	sig := bytes.Buffer{}
+	it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+	for it() == nil {
+	}
+	d := NewDiffer()
+	d.SetStrongVerification(true)
+	if err := d.AddSignatureData(sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var last_progress int64
+	d.SetProgressCallback(func(processed, total int64) { last_progress = processed })
+	delta := bytes.Buffer{}
+	it = d.CreateDeltaConcurrent(bytes.NewReader(src_data), int64(len(src_data)), &delta, 4)
+	for {
+		if err := it(); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if last_progress != int64(len(src_data)) {
+		t.Fatalf("Incorrect final progress: %d != %d", last_progress, len(src_data))
+	}
+	if delta.Len() > len(src_data)/100 {
+		t.Fatalf("Concurrent delta too large: %d", delta.Len())
+	}
+	output := bytes.Buffer{}
+	w := p.NewPatchWriter(&output, bytes.NewReader(changed))
+	if _, err := w.Write(delta.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), src_data) {
+		t.Fatalf("Patching with concurrent delta failed")
+	}
+
+	// a mapped source smaller than the specified size, such as a file that
+	// was truncated after its size was read
+	src_path := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src_path, src_data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(src_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mf, err := MapFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	delta.Reset()
+	it = d.CreateDeltaConcurrent(mf, int64(len(src_data))+ConcurrentDeltaSegmentSize, &delta, 4)
+	for {
+		if err := it(); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	output.Reset()
+	w = p.NewPatchWriter(&output, bytes.NewReader(changed))
+	if _, err := w.Write(delta.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), src_data) {
+		t.Fatalf("Patching with concurrent delta of mapped file failed")
+	}
+}
+
+// A codec that serializes operations as lines of text
+type text_codec struct{}
+
+func (text_codec) Encode(op Operation, buf []byte) []byte {
+	return fmt.Appendf(buf, "%d %d %d %s\n", op.Type, op.BlockIndex, op.BlockIndexEnd, hex.EncodeToString(op.Data))
+}
+
+func (text_codec) Decode(data []byte, op *Operation) (n int, err error) {
+	idx := bytes.IndexByte(data, '\n')
+	if idx < 0 {
+		return -1, io.ErrShortBuffer
+	}
+	var hexdata string
+	if _, err = fmt.Sscanf(string(data[:idx]), "%d %d %d %s", &op.Type, &op.BlockIndex, &op.BlockIndexEnd, &hexdata); err != nil {
+		if _, err = fmt.Sscanf(string(data[:idx]), "%d %d %d", &op.Type, &op.BlockIndex, &op.BlockIndexEnd); err != nil {
+			return 0, err
+		}
+	}
+	op.Data, err = hex.DecodeString(hexdata)
+	return idx + 1, err
+}
+
+func TestRsyncOperationCodec(t *testing.T) {
+	changed := generate_data(16, 64, "trailer")
+	src_data := slices.Clone(changed)
+	patch_data(src_data, "3:patch1", "130:ptch3", "400:patch4")
+	for _, codec := range []OperationCodec{BuiltinOperationCodec{}, text_codec{}} {
+		p := NewPatcher(int64(len(changed)), nil)
+		p.SetOperationCodec(codec)
+		p.SetStrictValidation(true)
+		if err := p.SetFormatVersion(FormatVersion1); err != nil {
+			t.Fatal(err)
+		}
+		sig := bytes.Buffer{}
+		it := p.CreateSignatureIterator(bytes.NewReader(changed), &sig)
+		for it() == nil {
+		}
+		d := NewDiffer()
+		d.SetOperationCodec(codec)
+		d.SetStrongVerification(true)
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		delta := bytes.Buffer{}
+		it = d.CreateDelta(bytes.NewReader(src_data), &delta)
+		for it() == nil {
+		}
+		if _, is_text := codec.(text_codec); is_text && bytes.Count(delta.Bytes(), []byte{'\n'}) < 4 {
+			t.Fatalf("Delta not encoded with custom codec: %#v", delta.String())
+		}
+		output := bytes.Buffer{}
+		w := p.NewPatchWriter(&output, bytes.NewReader(changed))
+		// write byte by byte to test decoding of partial operations
+		for _, b := range delta.Bytes() {
+			if _, err := w.Write([]byte{b}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), src_data) {
+			t.Fatalf("Patching with codec %T failed", codec)
+		}
+	}
+}
+
+func TestRsyncManifest(t *testing.T) {
+	tdir := t.TempDir()
+	write_tree := func(root string, files map[string]string) {
+		for name, data := range files {
+			p := filepath.Join(root, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	src, dest := filepath.Join(tdir, "src"), filepath.Join(tdir, "dest")
+	common := map[string]string{"a/same": "same", "a/b/same": "same too", "changed": "old data", "c/d/e/f": "deep"}
+	write_tree(src, common)
+	write_tree(dest, common)
+	if err := os.Symlink("changed", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	write_tree(src, map[string]string{"changed": "new data", "a/b/new": "new", "c/d/e/g": "deep"})
+	write_tree(dest, map[string]string{"deleted": "x"})
+	sm, err := CreateManifest(src, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := CreateManifest(dest, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.Entries[0].Patcher == nil || len(dm.Entries[0].Signature) == 0 {
+		t.Fatalf("Manifest has no signatures")
+	}
+	buf := bytes.Buffer{}
+	if err = dm.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rdm, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rdm.TreeHash(), dm.TreeHash()) || len(rdm.Entries) != len(dm.Entries) {
+		t.Fatalf("Manifest did not survive serialization")
+	}
+	actions := map[string]ManifestAction{}
+	for _, c := range DiffManifests(sm, rdm) {
+		actions[c.Path] = c.Action
+	}
+	expected := map[string]ManifestAction{
+		"a/same": ManifestNothing, "a/b/same": ManifestNothing, "changed": ManifestDeltaTransfer, "c/d/e/f": ManifestNothing,
+		"a/b/new": ManifestFullTransfer, "c/d/e/g": ManifestFullTransfer, "deleted": ManifestDelete,
+	}
+	if diff := cmp.Diff(expected, actions); diff != "" {
+		t.Fatalf("Incorrect manifest diff:\n%s", diff)
+	}
+	if bytes.Equal(sm.DirHashes["a/b"], dm.DirHashes["a/b"]) || bytes.Equal(sm.TreeHash(), dm.TreeHash()) {
+		t.Fatalf("Incorrect directory hashes")
+	}
+	same, err := CreateManifest(dest, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(same.TreeHash(), dm.TreeHash()) {
+		t.Fatalf("Tree hash differs for identical trees")
+	}
+	for _, c := range DiffManifests(same, dm) {
+		if c.Action != ManifestNothing {
+			t.Fatalf("Unexpected action for identical trees: %s: %s", c.Path, c.Action)
+		}
+	}
+}
+
+func TestRsyncMemoryBudget(t *testing.T) {
+	changed := generate_data(16, 64)
+	p := NewPatcher(int64(len(changed)), nil)
+	if err := p.SetBlockSize(16); err != nil {
+		t.Fatal(err)
+	}
+	p.SetMemoryBudget(100)
+	literal := generate_data(7, 10000)
+	c := new_xxh3_128()
+	c.Write(changed[16:32])
+	c.Write(literal)
+	var delta []byte
+	for _, op := range []Operation{{Type: OpBlock, BlockIndex: 1}, {Type: OpData, Data: literal}, {Type: OpHash, Data: c.Sum(nil)}} {
+		b := make([]byte, op.SerializeSize())
+		op.Serialize(b)
+		delta = append(delta, b...)
+	}
+	for _, chunk_size := range []int{7, 1000, len(delta)} {
+		output := bytes.Buffer{}
+		p.StartDelta(&output, bytes.NewReader(changed))
+		for d := delta; len(d) > 0; {
+			chunk := d[:min(chunk_size, len(d))]
+			d = d[len(chunk):]
+			if err := p.UpdateDelta(chunk); err != nil {
+				t.Fatal(err)
+			}
+			if len(p.unconsumed_delta_data) > p.effective_memory_budget() {
+				t.Fatalf("Memory budget exceeded: %d > %d", len(p.unconsumed_delta_data), p.effective_memory_budget())
+			}
+		}
+		if err := p.FinishDelta(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), append(slices.Clone(changed[16:32]), literal...)) {
+			t.Fatalf("Patching with memory budget failed for chunk size: %d", chunk_size)
+		}
+	}
+	p.StartDelta(&bytes.Buffer{}, bytes.NewReader(changed))
+	if err := p.UpdateDelta(delta[:len(delta)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FinishDelta(); err == nil {
+		t.Fatalf("No error for truncated literal data")
+	}
+}
+
+func TestRsyncReferenceFiles(t *testing.T) {
+	r := rand.New(rand.NewSource(4321))
+	basis := make([]byte, 64*1024)
+	r.Read(basis)
+	// the source is a near copy of a reference file, as happens with renames
+	reference := make([]byte, 256*1024)
+	r.Read(reference)
+	src_data := slices.Clone(reference)
+	patch_data(src_data, "7:patch1", "100000:patch2")
+	src_data = append(src_data, basis[:10000]...)
+
+	p := NewPatcher(int64(len(basis)), nil)
+	sig, ref_sig := bytes.Buffer{}, bytes.Buffer{}
+	for _, x := range []struct {
+		src    []byte
+		output *bytes.Buffer
+	}{{basis, &sig}, {reference, &ref_sig}} {
+		it := p.CreateSignatureIterator(bytes.NewReader(x.src), x.output)
+		for it() == nil {
+		}
+	}
+	d := NewDiffer()
+	if err := d.AddSignatureData(sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddReferenceSignature(7, ref_sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	delta := bytes.Buffer{}
+	it := d.CreateDelta(bytes.NewReader(src_data), &delta)
+	for {
+		if err := it(); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	ops := []Operation{}
+	for b := delta.Bytes(); len(b) > 0; {
+		op := Operation{}
+		n, err := op.Unserialize(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+		b = b[n:]
+	}
+	has_reference := false
+	for _, op := range ops {
+		if op.Type == OpReferenceRange {
+			has_reference = true
+			if op.Reference != 7 {
+				t.Fatalf("Incorrect reference file in: %s", op)
+			}
+		}
+	}
+	if !has_reference || delta.Len() > len(src_data)/10 {
+		t.Fatalf("Delta of size: %d does not use the reference file, operations: %v", delta.Len(), ops)
+	}
+
+	apply := func(strict bool, with_reference bool) (output []byte, err error) {
+		p.SetStrictValidation(strict)
+		p.AddReferenceFile(7, utils.IfElse[io.ReadSeeker](with_reference, bytes.NewReader(reference), nil))
+		out := bytes.Buffer{}
+		p.StartDelta(&out, bytes.NewReader(basis))
+		if err = p.UpdateDelta(delta.Bytes()); err == nil {
+			err = p.FinishDelta()
+		}
+		return out.Bytes(), err
+	}
+	for _, strict := range []bool{false, true} {
+		output, err := apply(strict, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(src_data, output); diff != "" {
+			t.Fatalf("Patching with reference files failed: %s", diff)
+		}
+		if _, err = apply(strict, false); err == nil || (strict && !errors.Is(err, ErrInvalidDelta)) {
+			t.Fatalf("Unexpected error when patching without the reference file in strict mode: %v: %v", strict, err)
+		}
+	}
+
+	// reference signatures must be compatible with the main signature
+	q := NewPatcher(int64(len(reference)), nil)
+	q.SetBlockSize(p.BlockSize() * 2)
+	ref_sig.Reset()
+	it = q.CreateSignatureIterator(bytes.NewReader(reference), &ref_sig)
+	for it() == nil {
+	}
+	d = NewDiffer()
+	d.AddSignatureData(sig.Bytes())
+	d.AddReferenceSignature(1, ref_sig.Bytes())
+	if err := d.CreateDelta(bytes.NewReader(src_data), io.Discard)(); err == nil || err == io.EOF {
+		t.Fatalf("Creating a delta with an incompatible reference signature did not fail")
+	}
 }
@@ -0,0 +1,105 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// How much a file is expected to change between syncs. Files with sparse
+// changes, such as append only log files, are best served by large blocks
+// which make for small signatures. Files with many small scattered changes,
+// such as recompiled binaries, are best served by small blocks which make for
+// small deltas.
+type ChangeDensity int
+
+const (
+	DefaultChangeDensity ChangeDensity = iota
+	SparseChanges
+	DenseChanges
+)
+
+// The factor by which the block size is scaled for sparse or dense changes
+const ChangeDensityScaleFactor = 4
+
+// The smallest block size used when scaling down for dense changes
+const MinScaledBlockSize = 256
+
+// Return a block size suitable for a file of the specified size and expected
+// change density. The default is the square root of the file size.
+func BlockSizeFor(file_size int64, density ChangeDensity) int {
+	bs := DefaultBlockSize
+	if file_size > 0 {
+		bs = int(math.Round(math.Sqrt(float64(file_size))))
+	}
+	switch density {
+	case SparseChanges:
+		bs *= ChangeDensityScaleFactor
+	case DenseChanges:
+		bs = utils.Max(utils.Min(bs, MinScaledBlockSize), bs/ChangeDensityScaleFactor)
+	}
+	return utils.Max(1, utils.Min(bs, MaxBlockSize))
+}
+
+const num_of_samples = 16
+const sample_size = 4096
+
+// Guess the change density of a file by sampling its contents. Data that
+// looks compressed or encrypted is treated as having sparse changes since any
+// change to it tends to alter everything after it, so small blocks are
+// useless. Other binary data is treated as having dense changes and text as
+// having the default change density.
+func GuessChangeDensity(src io.ReaderAt, size int64) (ChangeDensity, error) {
+	if size <= 0 {
+		return DefaultChangeDensity, nil
+	}
+	var counts [256]int
+	total := 0
+	buf := make([]byte, sample_size)
+	stride := utils.Max(sample_size, size/num_of_samples)
+	for offset := int64(0); offset < size; offset += stride {
+		n, err := src.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return DefaultChangeDensity, err
+		}
+		for _, b := range buf[:n] {
+			counts[b]++
+		}
+		total += n
+	}
+	if total == 0 {
+		return DefaultChangeDensity, nil
+	}
+	entropy, text := 0., 0
+	for b, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			entropy -= p * math.Log2(p)
+			if b >= 0x20 || b == '\n' || b == '\r' || b == '\t' {
+				text += c
+			}
+		}
+	}
+	switch {
+	case entropy > 7.5:
+		return SparseChanges, nil
+	case float64(text)/float64(total) > 0.95:
+		return DefaultChangeDensity, nil
+	}
+	return DenseChanges, nil
+}
+
+// Return a block size for src chosen by sampling its contents, see GuessChangeDensity()
+func SuggestBlockSize(src io.ReaderAt, size int64) (int, error) {
+	density, err := GuessChangeDensity(src, size)
+	if err != nil {
+		return 0, err
+	}
+	return BlockSizeFor(size, density), nil
+}
@@ -0,0 +1,67 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"fmt"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Limit the amount of delta data the Patcher buffers to max_buffered_bytes.
+// Delta data is normally buffered until a complete operation is received,
+// which for literal data can be up to 4GB. With a budget, literal data larger
+// than the budget is written to the output as it arrives instead. Since
+// UpdateDelta() only returns once the data passed to it is applied, callers
+// get backpressure automatically. The budget cannot be smaller than the
+// largest compressed operation, which is DataSizeMultiple times the block
+// size, compressed operations larger than that cause an error. Zero means no
+// limit, which is the default.
+func (self *Patcher) SetMemoryBudget(max_buffered_bytes int) {
+	self.memory_budget = max_buffered_bytes
+}
+
+func (self *Patcher) effective_memory_budget() int {
+	return utils.Max(self.memory_budget, self.max_data_size()+5)
+}
+
+// Start writing the literal data of the incomplete operation in pending to
+// the output as it arrives, returning whatever must still be buffered.
+func (self *Patcher) start_streaming_data(pending []byte) ([]byte, error) {
+	if self.rsync.codec != nil || len(pending) < 5 {
+		return pending, nil
+	}
+	if pending[0] != byte(OpData) {
+		if pending[0] == byte(OpData)|OpCompressedFlag {
+			if sz := int(bin.Uint32(pending[1:])); sz > self.max_data_size() {
+				return nil, fmt.Errorf("Compressed data of size %d in the delta exceeds the memory budget", sz)
+			}
+		}
+		return pending, nil
+	}
+	if err := self.verify_format_version(Operation{Type: OpData}); err != nil {
+		return nil, err
+	}
+	self.streaming_data_remaining = int64(bin.Uint32(pending[1:]))
+	self.delta_offset += 5
+	_, err := self.stream_data(pending[5:])
+	return nil, err
+}
+
+// Write the part of data that belongs to literal data being streamed to the
+// output, returning the rest
+func (self *Patcher) stream_data(data []byte) ([]byte, error) {
+	if self.streaming_data_remaining <= 0 || len(data) == 0 {
+		return data, nil
+	}
+	n := int(utils.Min(int64(len(data)), self.streaming_data_remaining))
+	if err := self.rsync.write_output(self.delta_output, data[:n]); err != nil {
+		return nil, err
+	}
+	self.streaming_data_remaining -= int64(n)
+	self.total_data_in_delta += n
+	self.delta_offset += int64(n)
+	return data[n:], nil
+}
@@ -0,0 +1,170 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// A signature bundle holds the signatures for many files in a single stream,
+// so that syncing a directory needs only a single round trip. It consists of
+// the magic number followed by one record per file:
+// path length (uint16), path, size (int64), mtime in ns since the epoch
+// (int64), signature length (uint64), signature
+// All integers are little endian.
+const SignatureBundleMagic uint32 = 0x6b736231
+
+const bundle_record_header_size = 8 + 8 + 8
+
+type SignatureBundleWriter struct {
+	output       io.Writer
+	wrote_header bool
+	buf          bytes.Buffer
+}
+
+func NewSignatureBundleWriter(output io.Writer) *SignatureBundleWriter {
+	return &SignatureBundleWriter{output: output}
+}
+
+func (self *SignatureBundleWriter) write(data []byte) error {
+	if !self.wrote_header {
+		var b [4]byte
+		bin.PutUint32(b[:], SignatureBundleMagic)
+		if _, err := self.output.Write(b[:]); err != nil {
+			return err
+		}
+		self.wrote_header = true
+	}
+	_, err := self.output.Write(data)
+	return err
+}
+
+// Add the signature of the file at path, whose contents are read from src,
+// to the bundle. The signature is created using p, which should then be used
+// to apply the delta for this file.
+func (self *SignatureBundleWriter) Add(p *Patcher, path string, size int64, mtime time.Time, src io.Reader) (err error) {
+	if len(path) > math.MaxUint16 {
+		return fmt.Errorf("The path %#v is too long to be stored in a signature bundle", path)
+	}
+	self.buf.Reset()
+	it := p.CreateSignatureIterator(src, &self.buf)
+	for {
+		if err = it(); err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("Failed to create signature for %s with error: %w", path, err)
+			}
+			break
+		}
+	}
+	sig := self.buf.Bytes()
+	hdr := make([]byte, 2+len(path)+bundle_record_header_size)
+	bin.PutUint16(hdr, uint16(len(path)))
+	copy(hdr[2:], path)
+	b := hdr[2+len(path):]
+	bin.PutUint64(b, uint64(size))
+	bin.PutUint64(b[8:], uint64(mtime.UnixNano()))
+	bin.PutUint64(b[16:], uint64(len(sig)))
+	if err = self.write(hdr); err == nil {
+		err = self.write(sig)
+	}
+	return
+}
+
+// Must be called after all files are added, to ensure the bundle header is
+// written even when there are no files
+func (self *SignatureBundleWriter) Finish() error {
+	if !self.wrote_header {
+		return self.write(nil)
+	}
+	return nil
+}
+
+// The signature of a single file from a bundle
+type BundledSignature struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+
+	signature []byte
+}
+
+// Create a Differ that has the signature of this file loaded, ready to create a delta
+func (self *BundledSignature) NewDiffer(strong_hashers ...StrongHasher) (*Differ, error) {
+	ans := NewDiffer(strong_hashers...)
+	if err := ans.AddSignatureData(self.signature); err != nil {
+		return nil, fmt.Errorf("The signature for %s in the bundle is invalid: %w", self.Path, err)
+	}
+	if err := ans.FinishSignatureData(); err != nil {
+		return nil, fmt.Errorf("The signature for %s in the bundle is invalid: %w", self.Path, err)
+	}
+	return ans, nil
+}
+
+type SignatureBundleReader struct {
+	src        io.Reader
+	read_magic bool
+}
+
+func NewSignatureBundleReader(src io.Reader) *SignatureBundleReader {
+	return &SignatureBundleReader{src: src}
+}
+
+// Return the next file signature from the bundle, or io.EOF at the end of the bundle
+func (self *SignatureBundleReader) Next() (ans *BundledSignature, err error) {
+	if !self.read_magic {
+		var b [4]byte
+		if _, err = io.ReadFull(self.src, b[:]); err != nil {
+			return nil, fmt.Errorf("Failed to read signature bundle header with error: %w", err)
+		}
+		if m := bin.Uint32(b[:]); m != SignatureBundleMagic {
+			return nil, fmt.Errorf("Not a signature bundle, invalid magic number: %#x", m)
+		}
+		self.read_magic = true
+	}
+	var b [bundle_record_header_size]byte
+	if _, err = io.ReadFull(self.src, b[:2]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Truncated signature bundle: %w", err)
+	}
+	path := make([]byte, bin.Uint16(b[:]))
+	if _, err = io.ReadFull(self.src, path); err != nil {
+		return nil, fmt.Errorf("Truncated signature bundle: %w", io.ErrUnexpectedEOF)
+	}
+	if _, err = io.ReadFull(self.src, b[:]); err != nil {
+		return nil, fmt.Errorf("Truncated signature bundle: %w", io.ErrUnexpectedEOF)
+	}
+	ans = &BundledSignature{Path: string(path), Size: int64(bin.Uint64(b[:])), ModTime: time.Unix(0, int64(bin.Uint64(b[8:])))}
+	sz := bin.Uint64(b[16:])
+	// use a LimitReader so that corrupted sizes dont cause huge allocations up front
+	sig := bytes.Buffer{}
+	if n, err := io.Copy(&sig, io.LimitReader(self.src, int64(utils.Min(sz, math.MaxInt64)))); err != nil || uint64(n) != sz {
+		return nil, fmt.Errorf("Truncated signature bundle: %w", io.ErrUnexpectedEOF)
+	}
+	ans.signature = sig.Bytes()
+	return
+}
+
+// Read all the file signatures in the bundle
+func ReadSignatureBundle(src io.Reader) (ans []*BundledSignature, err error) {
+	r := NewSignatureBundleReader(src)
+	for {
+		s, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				return ans, nil
+			}
+			return nil, err
+		}
+		ans = append(ans, s)
+	}
+}
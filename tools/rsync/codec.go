@@ -0,0 +1,44 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"fmt"
+)
+
+var _ = fmt.Print
+
+// Serializes the operations in a delta. Use a custom codec to embed deltas in
+// other protocols, for example, as CBOR or protobuf messages. The Differ
+// creating a delta and the Patcher applying it must use the same codec.
+type OperationCodec interface {
+	// Append the serialization of op to buf, returning the result. Note that
+	// op.Data may point into internal buffers and must not be retained.
+	Encode(op Operation, buf []byte) []byte
+	// Unserialize a single operation from the start of data into op, returning
+	// the number of bytes consumed. If data does not contain a complete
+	// operation must return -1 and io.ErrShortBuffer. op.Data may point into
+	// data.
+	Decode(data []byte, op *Operation) (n int, err error)
+}
+
+// The default codec, which uses the builtin binary format. Note that it never
+// compresses literal data.
+type BuiltinOperationCodec struct{}
+
+func (BuiltinOperationCodec) Encode(op Operation, buf []byte) []byte {
+	sz := op.SerializeSize()
+	buf = append(buf, make([]byte, sz)...)
+	op.Serialize(buf[len(buf)-sz:])
+	return buf
+}
+
+func (BuiltinOperationCodec) Decode(data []byte, op *Operation) (int, error) {
+	return op.Unserialize(data)
+}
+
+// Use codec to serialize operations in deltas instead of the builtin format.
+// Use nil to restore the builtin format.
+func (self *Api) SetOperationCodec(codec OperationCodec) {
+	self.rsync.codec = codec
+}
@@ -0,0 +1,239 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Used to apply a delta directly to the file it is based on. The file serves
+// both as the output and as the source of blocks for the delta. While the delta
+// is being received the file is not modified, instead the changes are
+// recorded: copies of blocks of the file as their offsets and literal data in
+// a spill file. Writes of data identical to what is already present, the common
+// case of unchanged blocks, are not recorded at all. Once the delta is
+// complete, the changes are applied in order. Since it is then known which
+// blocks are still needed by later copies, only those blocks are saved to the
+// spill file before being overwritten.
+type inplace_target struct {
+	file          *os.File
+	block_size    int64
+	original_size int64
+	write_pos     int64
+	read_pos      int64
+	// the range of the file read since the last write, the data for copies
+	// of blocks is read from the file immediately before being written
+	read_start, read_end int64
+
+	spill      *os.File
+	spill_size int64
+	// map of block index to offset of the block in the spill file
+	spilled     map[int64]int64
+	writes      []inplace_write
+	compare_buf []byte
+}
+
+type inplace_write struct {
+	offset, size int64
+	// offset of the data in the original file or -1 if the data is in the spill file
+	src          int64
+	spill_offset int64
+}
+
+func new_inplace_target(file *os.File, block_size int, spill_dir string) (ans *inplace_target, err error) {
+	s, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !s.Mode().IsRegular() {
+		return nil, fmt.Errorf("Cannot patch %s in place as it is not a regular file", file.Name())
+	}
+	ans = &inplace_target{file: file, block_size: int64(block_size), original_size: s.Size(), spilled: make(map[int64]int64)}
+	if ans.spill, err = os.CreateTemp(spill_dir, "rsync-spill-*"); err != nil {
+		return nil, err
+	}
+	// unlink immediately so that the spill file is cleaned up automatically
+	os.Remove(ans.spill.Name())
+	return ans, nil
+}
+
+func (self *inplace_target) spill_block(b int64) error {
+	offset := b * self.block_size
+	n, err := io.Copy(self.spill, io.NewSectionReader(self.file, offset, utils.Min(self.block_size, self.original_size-offset)))
+	if err != nil {
+		return fmt.Errorf("Failed to save data from %s to spill file with error: %w", self.file.Name(), err)
+	}
+	self.spilled[b] = self.spill_size
+	self.spill_size += n
+	return nil
+}
+
+func (self *inplace_target) unchanged(p []byte) bool {
+	if self.write_pos+int64(len(p)) > self.original_size {
+		return false
+	}
+	if cap(self.compare_buf) < len(p) {
+		self.compare_buf = make([]byte, len(p))
+	}
+	b := self.compare_buf[:len(p)]
+	n, _ := self.file.ReadAt(b, self.write_pos)
+	return n == len(p) && bytes.Equal(b, p)
+}
+
+func (self *inplace_target) record(w inplace_write) {
+	if len(self.writes) > 0 {
+		prev := &self.writes[len(self.writes)-1]
+		if prev.offset+prev.size == w.offset {
+			if w.src > -1 && prev.src > -1 && prev.src+prev.size == w.src {
+				prev.size += w.size
+				return
+			}
+			if w.src < 0 && prev.src < 0 && prev.spill_offset+prev.size == w.spill_offset {
+				prev.size += w.size
+				return
+			}
+		}
+	}
+	self.writes = append(self.writes, w)
+}
+
+func (self *inplace_target) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	read_start, read_size := self.read_start, self.read_end-self.read_start
+	self.read_start, self.read_end = 0, 0
+	if !self.unchanged(p) {
+		w := inplace_write{offset: self.write_pos, size: int64(len(p)), src: -1}
+		if read_size == int64(len(p)) {
+			w.src = read_start
+		} else {
+			if _, err = self.spill.Write(p); err != nil {
+				return 0, fmt.Errorf("Failed to write data to spill file with error: %w", err)
+			}
+			w.spill_offset = self.spill_size
+			self.spill_size += w.size
+		}
+		self.record(w)
+	}
+	self.write_pos += int64(len(p))
+	return len(p), nil
+}
+
+// Read the original contents of the file
+func (self *inplace_target) Read(p []byte) (n int, err error) {
+	if self.read_pos >= self.original_size {
+		return 0, io.EOF
+	}
+	p = p[:utils.Min(int64(len(p)), self.original_size-self.read_pos)]
+	n, err = self.file.ReadAt(p, self.read_pos)
+	if self.read_pos != self.read_end || self.read_start == self.read_end {
+		self.read_start = self.read_pos
+	}
+	self.read_pos += int64(n)
+	self.read_end = self.read_pos
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (self *inplace_target) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.read_pos
+	case io.SeekEnd:
+		offset += self.original_size
+	default:
+		return self.read_pos, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return self.read_pos, fmt.Errorf("Cannot seek to negative offset: %d", offset)
+	}
+	self.read_pos = offset
+	return offset, nil
+}
+
+// Read original data from the file, or from the spill file if it has been
+// overwritten
+func (self *inplace_target) read_original(p []byte, offset int64) error {
+	for len(p) > 0 {
+		b := offset / self.block_size
+		offset_in_block := offset - b*self.block_size
+		chunk := p[:utils.Min(int64(len(p)), self.block_size-offset_in_block)]
+		var err error
+		if spill_offset, found := self.spilled[b]; found {
+			_, err = self.spill.ReadAt(chunk, spill_offset+offset_in_block)
+		} else {
+			_, err = self.file.ReadAt(chunk, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read original data from %s with error: %w", self.file.Name(), err)
+		}
+		p, offset = p[len(chunk):], offset+int64(len(chunk))
+	}
+	return nil
+}
+
+// Apply the recorded changes and truncate the file to the size of the output
+func (self *inplace_target) finish() (err error) {
+	// the index of the last write that copies each block of the original file
+	last_use := make(map[int64]int)
+	for i, w := range self.writes {
+		if w.src > -1 {
+			for b := w.src / self.block_size; b*self.block_size < w.src+w.size; b++ {
+				last_use[b] = i
+			}
+		}
+	}
+	buf := make([]byte, self.block_size)
+	next_untouched_block := int64(0)
+	for i, w := range self.writes {
+		first, last := w.offset/self.block_size, (w.offset+w.size-1)/self.block_size
+		for b := utils.Max(first, next_untouched_block); b <= last && b*self.block_size < self.original_size; b++ {
+			// a write copying data backwards reads each block of its own
+			// source before overwriting it
+			if idx, found := last_use[b]; found && (idx > i || (idx == i && w.src < w.offset)) {
+				if err = self.spill_block(b); err != nil {
+					return err
+				}
+			}
+		}
+		next_untouched_block = last + 1
+		for pos := int64(0); pos < w.size; {
+			chunk := buf[:utils.Min(int64(len(buf)), w.size-pos)]
+			if w.src > -1 {
+				err = self.read_original(chunk, w.src+pos)
+			} else if _, err = self.spill.ReadAt(chunk, w.spill_offset+pos); err != nil {
+				err = fmt.Errorf("Failed to read data from spill file with error: %w", err)
+			}
+			if err != nil {
+				return err
+			}
+			if _, err = self.file.WriteAt(chunk, w.offset+pos); err != nil {
+				return err
+			}
+			pos += int64(len(chunk))
+		}
+	}
+	self.writes = nil
+	if self.write_pos < self.original_size {
+		return self.file.Truncate(self.write_pos)
+	}
+	return nil
+}
+
+func (self *inplace_target) close() {
+	if self.spill != nil {
+		self.spill.Close()
+		self.spill = nil
+	}
+}
@@ -0,0 +1,423 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+// Interoperability with the signature and delta formats used by librsync
+// (and thus the rdiff tool). See
+// https://librsync.github.io/page_formats.html for a description of the
+// formats.
+
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+var _ = fmt.Print
+
+type LibrsyncSignatureFormat uint32
+
+const (
+	LibrsyncMD4Signature             LibrsyncSignatureFormat = 0x72730136
+	LibrsyncBlake2Signature          LibrsyncSignatureFormat = 0x72730137
+	LibrsyncRabinKarpMD4Signature    LibrsyncSignatureFormat = 0x72730146
+	LibrsyncRabinKarpBlake2Signature LibrsyncSignatureFormat = 0x72730147
+)
+
+const LibrsyncDeltaMagic uint32 = 0x72730236
+
+// The default block size used by librsync
+const LibrsyncDefaultBlockSize = 2048
+
+var be = binary.BigEndian
+
+func (self LibrsyncSignatureFormat) is_valid() bool {
+	switch self {
+	case LibrsyncMD4Signature, LibrsyncBlake2Signature, LibrsyncRabinKarpMD4Signature, LibrsyncRabinKarpBlake2Signature:
+		return true
+	}
+	return false
+}
+
+func (self LibrsyncSignatureFormat) new_strong_hash() hash.Hash {
+	switch self {
+	case LibrsyncMD4Signature, LibrsyncRabinKarpMD4Signature:
+		return md4.New()
+	}
+	ans, _ := blake2b.New256(nil)
+	return ans
+}
+
+func (self LibrsyncSignatureFormat) new_rolling_hash() rolling_hash {
+	switch self {
+	case LibrsyncRabinKarpMD4Signature, LibrsyncRabinKarpBlake2Signature:
+		return &rabinkarp{}
+	}
+	return &rollsum{}
+}
+
+// librsync truncates strong hashes to the length specified in the signature header
+type truncated_hash struct {
+	hash.Hash
+	size int
+}
+
+func (self *truncated_hash) Size() int { return self.size }
+
+func (self *truncated_hash) Sum(b []byte) []byte {
+	n := len(b)
+	return self.Hash.Sum(b)[:n+self.size]
+}
+
+// The rsync style rolling checksum used by librsync
+type rollsum struct {
+	count                         uint16
+	s1, s2                        uint16
+	first_byte_of_previous_window byte
+}
+
+const rollsum_char_offset = 31
+
+func (self *rollsum) full(data []byte) uint32 {
+	self.count, self.s1, self.s2 = 0, 0, 0
+	for _, b := range data {
+		self.s1 += uint16(b) + rollsum_char_offset
+		self.s2 += self.s1
+	}
+	self.count = uint16(len(data))
+	if len(data) > 0 {
+		self.first_byte_of_previous_window = data[0]
+	}
+	return self.value()
+}
+
+func (self *rollsum) add_one_byte(first_byte, last_byte byte) {
+	out := uint16(self.first_byte_of_previous_window)
+	self.s1 += uint16(last_byte) - out
+	self.s2 += self.s1 - self.count*(out+rollsum_char_offset)
+	self.first_byte_of_previous_window = first_byte
+}
+
+func (self *rollsum) value() uint32 { return uint32(self.s2)<<16 | uint32(self.s1) }
+
+// The RabinKarp rolling hash used by librsync >= 2.2
+type rabinkarp struct {
+	hash, mult                    uint32
+	first_byte_of_previous_window byte
+}
+
+const (
+	rabinkarp_seed = 1
+	rabinkarp_mult = 0x08104225
+	rabinkarp_adj  = 0x08104224
+)
+
+func (self *rabinkarp) full(data []byte) uint32 {
+	self.hash, self.mult = rabinkarp_seed, 1
+	for _, b := range data {
+		self.hash = self.hash*rabinkarp_mult + uint32(b)
+		self.mult *= rabinkarp_mult
+	}
+	if len(data) > 0 {
+		self.first_byte_of_previous_window = data[0]
+	}
+	return self.hash
+}
+
+func (self *rabinkarp) add_one_byte(first_byte, last_byte byte) {
+	self.hash = self.hash*rabinkarp_mult + uint32(last_byte) - self.mult*(uint32(self.first_byte_of_previous_window)+rabinkarp_adj)
+	self.first_byte_of_previous_window = first_byte
+}
+
+func (self *rabinkarp) value() uint32 { return self.hash }
+
+// Write a librsync signature for src to output. A block_size of zero means
+// use LibrsyncDefaultBlockSize and a strong_len of zero means use the full
+// length of the strong hash.
+func CreateLibrsyncSignature(src io.Reader, output io.Writer, format LibrsyncSignatureFormat, block_size, strong_len int) (err error) {
+	if !format.is_valid() {
+		return fmt.Errorf("Unknown librsync signature format: 0x%x", uint32(format))
+	}
+	if block_size <= 0 {
+		block_size = LibrsyncDefaultBlockSize
+	}
+	if block_size > MaxBlockSize {
+		return fmt.Errorf("Block size too large: %d > %d", block_size, MaxBlockSize)
+	}
+	h := format.new_strong_hash()
+	if strong_len <= 0 || strong_len > h.Size() {
+		strong_len = h.Size()
+	}
+	w := bufio.NewWriter(output)
+	var b [12]byte
+	be.PutUint32(b[:], uint32(format))
+	be.PutUint32(b[4:], uint32(block_size))
+	be.PutUint32(b[8:], uint32(strong_len))
+	if _, err = w.Write(b[:]); err != nil {
+		return
+	}
+	rc := format.new_rolling_hash()
+	buf := make([]byte, block_size)
+	var sum []byte
+	for {
+		n, rerr := io.ReadFull(src, buf)
+		if n > 0 {
+			block := buf[:n]
+			be.PutUint32(b[:], rc.full(block))
+			h.Reset()
+			h.Write(block)
+			sum = h.Sum(sum[:0])
+			if _, err = w.Write(b[:4]); err != nil {
+				return
+			}
+			if _, err = w.Write(sum[:strong_len]); err != nil {
+				return
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+				return rerr
+			}
+			break
+		}
+	}
+	return w.Flush()
+}
+
+type librsync_signature struct {
+	format     LibrsyncSignatureFormat
+	block_size int
+	strong_len int
+	blocks     []BlockHash
+}
+
+func read_librsync_signature(r io.Reader) (ans *librsync_signature, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 {
+		return nil, fmt.Errorf("librsync signature too short: %d bytes", len(data))
+	}
+	ans = &librsync_signature{format: LibrsyncSignatureFormat(be.Uint32(data)), block_size: int(be.Uint32(data[4:])), strong_len: int(be.Uint32(data[8:]))}
+	if !ans.format.is_valid() {
+		return nil, fmt.Errorf("Unknown librsync signature format: 0x%x", uint32(ans.format))
+	}
+	if ans.block_size == 0 || ans.block_size > MaxBlockSize {
+		return nil, fmt.Errorf("Invalid block size in librsync signature: %d", ans.block_size)
+	}
+	if ans.strong_len == 0 || ans.strong_len > ans.format.new_strong_hash().Size() {
+		return nil, fmt.Errorf("Invalid strong hash length in librsync signature: %d", ans.strong_len)
+	}
+	data = data[12:]
+	record_size := 4 + ans.strong_len
+	if len(data)%record_size != 0 {
+		return nil, fmt.Errorf("librsync signature has %d trailing bytes", len(data)%record_size)
+	}
+	ans.blocks = make([]BlockHash, 0, len(data)/record_size)
+	for i := uint64(0); len(data) > 0; i++ {
+		ans.blocks = append(ans.blocks, BlockHash{Index: i, WeakHash: be.Uint32(data), StrongHash: data[4:record_size]})
+		data = data[record_size:]
+	}
+	return
+}
+
+func write_netint(w *bufio.Writer, val uint64, size int) {
+	var b [8]byte
+	be.PutUint64(b[:], val)
+	w.Write(b[8-size:])
+}
+
+func netint_size(val uint64) int {
+	switch {
+	case val <= 0xff:
+		return 1
+	case val <= 0xffff:
+		return 2
+	case val <= 0xffffffff:
+		return 4
+	}
+	return 8
+}
+
+func netint_size_index(size int) byte {
+	switch size {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	}
+	return 3
+}
+
+// Converts the operations output by the diff engine into librsync delta commands
+type librsync_delta_writer struct {
+	w              *bufio.Writer
+	block_size     uint64
+	expecting_data bool
+}
+
+func (self *librsync_delta_writer) write_literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	sz := uint64(len(data))
+	if sz <= 64 {
+		self.w.WriteByte(byte(sz))
+	} else {
+		n := netint_size(sz)
+		self.w.WriteByte(0x41 + netint_size_index(n))
+		write_netint(self.w, sz, n)
+	}
+	self.w.Write(data)
+}
+
+func (self *librsync_delta_writer) write_copy(start, length uint64) {
+	s, l := netint_size(start), netint_size(length)
+	self.w.WriteByte(0x45 + 4*netint_size_index(s) + netint_size_index(l))
+	write_netint(self.w, start, s)
+	write_netint(self.w, length, l)
+}
+
+func (self *librsync_delta_writer) Write(p []byte) (n int, err error) {
+	if self.expecting_data {
+		self.expecting_data = false
+		self.write_literal(p)
+		return len(p), nil
+	}
+	op := Operation{}
+	if _, err = op.Unserialize(p); err != nil {
+		if len(p) == 5 && OpType(p[0]) == OpData {
+			self.expecting_data = true
+			return len(p), nil
+		}
+		return 0, err
+	}
+	switch op.Type {
+	case OpBlock:
+		self.write_copy(op.BlockIndex*self.block_size, self.block_size)
+	case OpBlockRange:
+		self.write_copy(op.BlockIndex*self.block_size, (op.BlockIndexEnd-op.BlockIndex+1)*self.block_size)
+	case OpData:
+		self.write_literal(op.Data)
+	}
+	return len(p), nil
+}
+
+// Create a librsync format delta that transforms the file described by the
+// librsync format signature into src.
+func CreateLibrsyncDelta(signature io.Reader, src io.Reader, output io.Writer) (err error) {
+	sig, err := read_librsync_signature(signature)
+	if err != nil {
+		return err
+	}
+	r := rsync{BlockSize: sig.block_size}
+	r.SetHasher(func() hash.Hash { return &truncated_hash{Hash: sig.format.new_strong_hash(), size: sig.strong_len} })
+	r.SetChecksummer(new_xxh3_128)
+	r.rolling_hash_constructor = sig.format.new_rolling_hash
+	w := bufio.NewWriter(output)
+	var b [4]byte
+	be.PutUint32(b[:], LibrsyncDeltaMagic)
+	if _, err = w.Write(b[:]); err != nil {
+		return
+	}
+	dw := &librsync_delta_writer{w: w, block_size: uint64(sig.block_size)}
+	it := r.CreateDiff(src, sig.blocks, dw)
+	for {
+		if err = it(); err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+	}
+	if err = w.WriteByte(0); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+func read_netint(r *bufio.Reader, size int) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[8-size:]); err != nil {
+		return 0, err
+	}
+	return be.Uint64(b[:]), nil
+}
+
+var librsync_netint_sizes = [4]int{1, 2, 4, 8}
+
+// Apply a librsync format delta to basis writing the result to output
+func ApplyLibrsyncDelta(output io.Writer, basis io.ReadSeeker, delta io.Reader) (err error) {
+	r := bufio.NewReader(delta)
+	var b [4]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return fmt.Errorf("Failed to read librsync delta header with error: %w", err)
+	}
+	if magic := be.Uint32(b[:]); magic != LibrsyncDeltaMagic {
+		return fmt.Errorf("Not a librsync delta, invalid magic number: 0x%x", magic)
+	}
+	basis_size, err := basis.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("Failed to get the size of the basis file with error: %w", err)
+	}
+	unexpected_eof := func(err error) error {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	for {
+		cmd, err := r.ReadByte()
+		if err != nil {
+			return unexpected_eof(err)
+		}
+		switch {
+		case cmd == 0:
+			return nil
+		case cmd <= 0x44:
+			length := uint64(cmd)
+			if cmd > 0x40 {
+				if length, err = read_netint(r, librsync_netint_sizes[cmd-0x41]); err != nil {
+					return unexpected_eof(err)
+				}
+			}
+			if length > math.MaxInt64 {
+				return fmt.Errorf("Literal of %d bytes in librsync delta is too large", length)
+			}
+			if _, err = io.CopyN(output, r, int64(length)); err != nil {
+				return unexpected_eof(err)
+			}
+		case cmd <= 0x54:
+			idx := cmd - 0x45
+			start, err := read_netint(r, librsync_netint_sizes[idx/4])
+			if err != nil {
+				return unexpected_eof(err)
+			}
+			length, err := read_netint(r, librsync_netint_sizes[idx%4])
+			if err != nil {
+				return unexpected_eof(err)
+			}
+			if start > uint64(basis_size) || length > uint64(basis_size)-start {
+				return fmt.Errorf("Copy of %d bytes from offset %d in librsync delta is outside the basis file of size %d", length, start, basis_size)
+			}
+			if _, err = basis.Seek(int64(start), os.SEEK_SET); err != nil {
+				return err
+			}
+			if _, err = io.CopyN(output, basis, int64(length)); err != nil {
+				return fmt.Errorf("Failed to copy %d bytes from offset %d of the basis file with error: %w", length, start, unexpected_eof(err))
+			}
+		default:
+			return fmt.Errorf("Unknown command in librsync delta: 0x%x", cmd)
+		}
+	}
+}
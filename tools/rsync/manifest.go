@@ -0,0 +1,322 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// A file in a Manifest
+type ManifestEntry struct {
+	// The path relative to the root of the tree, with / as the separator
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// The SHA-256 of the contents of the file
+	ContentHash []byte
+	// The signature of the file, empty if the manifest was created without signatures
+	Signature []byte
+	// The Patcher used to create the signature, which must be used to apply
+	// deltas to this file. Not serialized.
+	Patcher *Patcher
+}
+
+// A Merkle tree of the regular files in a directory tree. The hash of a
+// directory is calculated from the names and hashes of its children, so two
+// trees with the same hash have identical contents.
+type Manifest struct {
+	// Sorted by path
+	Entries []*ManifestEntry
+	// Hashes of all directories containing files, keyed by relative path, with
+	// the root being "."
+	DirHashes map[string][]byte
+}
+
+// The hash of the entire tree
+func (self *Manifest) TreeHash() []byte {
+	return self.DirHashes["."]
+}
+
+func (self *Manifest) calculate_hashes() {
+	slices.SortFunc(self.Entries, func(a, b *ManifestEntry) bool { return a.Path < b.Path })
+	type child struct {
+		name string
+		hash []byte
+	}
+	children := map[string][]child{".": nil}
+	for _, e := range self.Entries {
+		dir, name := path.Split(e.Path)
+		dir = strings.TrimSuffix(dir, "/")
+		if dir == "" {
+			dir = "."
+		}
+		// ensure all ancestors exist
+		for d := dir; d != "."; d = path.Dir(d) {
+			if _, found := children[d]; found {
+				break
+			}
+			children[d] = nil
+		}
+		children[dir] = append(children[dir], child{name, e.ContentHash})
+	}
+	dirs := make([]string, 0, len(children))
+	for d := range children {
+		dirs = append(dirs, d)
+	}
+	depth := func(d string) int {
+		if d == "." {
+			return 0
+		}
+		return strings.Count(d, "/") + 1
+	}
+	// process the deepest directories first so child hashes are available
+	slices.SortFunc(dirs, func(a, b string) bool { return depth(a) > depth(b) })
+	self.DirHashes = make(map[string][]byte, len(dirs))
+	for _, d := range dirs {
+		c := children[d]
+		slices.SortFunc(c, func(a, b child) bool { return a.name < b.name })
+		h := sha256.New()
+		for _, x := range c {
+			h.Write([]byte(x.name))
+			h.Write([]byte{0})
+			h.Write(x.hash)
+		}
+		self.DirHashes[d] = h.Sum(nil)
+		if d != "." {
+			parent := path.Dir(d)
+			children[parent] = append(children[parent], child{path.Base(d) + "/", self.DirHashes[d]})
+		}
+	}
+}
+
+// Create a manifest of all the regular files in the tree rooted at root.
+// Other file types, such as symlinks, are ignored. If with_signatures is
+// true, a signature is created for every file, using a Patcher from
+// new_patcher, or NewPatcher() if new_patcher is nil.
+func CreateManifest(root string, with_signatures bool, new_patcher func(rel_path string, size int64) *Patcher) (ans *Manifest, err error) {
+	if new_patcher == nil {
+		new_patcher = func(_ string, size int64) *Patcher { return NewPatcher(size, nil) }
+	}
+	ans = &Manifest{}
+	sig := bytes.Buffer{}
+	err = filepath.WalkDir(root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		s, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		e := &ManifestEntry{Path: filepath.ToSlash(rel), Size: s.Size(), ModTime: s.ModTime()}
+		h := sha256.New()
+		if with_signatures {
+			e.Patcher = new_patcher(e.Path, e.Size)
+			sig.Reset()
+			it := e.Patcher.CreateSignatureIterator(io.TeeReader(f, h), &sig)
+			for {
+				if err = it(); err != nil {
+					if err != io.EOF {
+						return fmt.Errorf("Failed to create signature for %s with error: %w", fpath, err)
+					}
+					break
+				}
+			}
+			e.Signature = slices.Clone(sig.Bytes())
+		} else if _, err = io.Copy(h, f); err != nil {
+			return err
+		}
+		e.ContentHash = h.Sum(nil)
+		ans.Entries = append(ans.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ans.calculate_hashes()
+	return
+}
+
+// Create a manifest of files that are not on the filesystem, from entries with
+// their Path and ContentHash set
+func NewManifest(entries ...*ManifestEntry) *Manifest {
+	ans := &Manifest{Entries: entries}
+	ans.calculate_hashes()
+	return ans
+}
+
+// Serialized manifests consist of this magic number followed by one record per
+// file: path length (uint16), path, size (int64), mtime in ns since the epoch
+// (int64), content hash (32 bytes), signature length (uint64), signature
+// All integers are little endian.
+const ManifestMagic uint32 = 0x6b6d6631
+
+// Serialize the manifest. The directory hashes are not serialized, they are
+// recalculated when the manifest is read.
+func (self *Manifest) Serialize(output io.Writer) (err error) {
+	var b [8]byte
+	bin.PutUint32(b[:], ManifestMagic)
+	if _, err = output.Write(b[:4]); err != nil {
+		return
+	}
+	for _, e := range self.Entries {
+		if len(e.Path) > math.MaxUint16 {
+			return fmt.Errorf("The path %#v is too long to be stored in a manifest", e.Path)
+		}
+		buf := make([]byte, 0, 2+len(e.Path)+8+8+sha256.Size+8+len(e.Signature))
+		buf = bin.AppendUint16(buf, uint16(len(e.Path)))
+		buf = append(buf, e.Path...)
+		buf = bin.AppendUint64(buf, uint64(e.Size))
+		buf = bin.AppendUint64(buf, uint64(e.ModTime.UnixNano()))
+		buf = append(buf, e.ContentHash...)
+		buf = bin.AppendUint64(buf, uint64(len(e.Signature)))
+		buf = append(buf, e.Signature...)
+		if _, err = output.Write(buf); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Read a manifest serialized by Manifest.Serialize()
+func ReadManifest(src io.Reader) (ans *Manifest, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(src, b[:4]); err != nil {
+		return nil, fmt.Errorf("Failed to read manifest header with error: %w", err)
+	}
+	if m := bin.Uint32(b[:]); m != ManifestMagic {
+		return nil, fmt.Errorf("Not a manifest, invalid magic number: %#x", m)
+	}
+	ans = &Manifest{}
+	truncated := func() (*Manifest, error) {
+		return nil, fmt.Errorf("Truncated manifest: %w", io.ErrUnexpectedEOF)
+	}
+	for {
+		if _, err = io.ReadFull(src, b[:2]); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return truncated()
+		}
+		raw := make([]byte, int(bin.Uint16(b[:]))+8+8+sha256.Size+8)
+		if _, err = io.ReadFull(src, raw); err != nil {
+			return truncated()
+		}
+		plen := len(raw) - 8 - 8 - sha256.Size - 8
+		e := &ManifestEntry{Path: string(raw[:plen])}
+		raw = raw[plen:]
+		e.Size = int64(bin.Uint64(raw))
+		e.ModTime = time.Unix(0, int64(bin.Uint64(raw[8:])))
+		e.ContentHash = raw[16 : 16+sha256.Size]
+		sz := bin.Uint64(raw[16+sha256.Size:])
+		sig := bytes.Buffer{}
+		if n, err := io.Copy(&sig, io.LimitReader(src, int64(utils.Min(sz, math.MaxInt64)))); err != nil || uint64(n) != sz {
+			return truncated()
+		}
+		e.Signature = sig.Bytes()
+		if path.IsAbs(e.Path) || e.Path != path.Clean(e.Path) || e.Path == ".." || strings.HasPrefix(e.Path, "../") {
+			return nil, fmt.Errorf("Manifest contains an invalid path: %#v", e.Path)
+		}
+		ans.Entries = append(ans.Entries, e)
+	}
+	ans.calculate_hashes()
+	return
+}
+
+// What needs to be done to a file to sync it
+type ManifestAction int // enum
+
+const (
+	ManifestNothing ManifestAction = iota
+	ManifestFullTransfer
+	ManifestDeltaTransfer
+	ManifestDelete
+)
+
+type ManifestChange struct {
+	Path   string
+	Action ManifestAction
+	// The entry in the source manifest, nil for deletions
+	Source *ManifestEntry
+	// The entry in the target manifest, nil for full transfers
+	Target *ManifestEntry
+}
+
+// Compare the manifest of the source tree, which has the new data, against
+// the manifest of the target tree, which is to be updated, returning the
+// action needed for every file, sorted by path. Files present in both are
+// transferred as deltas when the target manifest has a signature for them,
+// otherwise in full. Subtrees with identical hashes are not compared file by
+// file.
+func DiffManifests(source, target *Manifest) (ans []ManifestChange) {
+	tmap := make(map[string]*ManifestEntry, len(target.Entries))
+	for _, e := range target.Entries {
+		tmap[e.Path] = e
+	}
+	unchanged_dirs := make(map[string]bool)
+	is_in_unchanged_dir := func(p string) bool {
+		for d := path.Dir(p); ; d = path.Dir(d) {
+			unchanged, found := unchanged_dirs[d]
+			if !found {
+				sh, th := source.DirHashes[d], target.DirHashes[d]
+				unchanged = sh != nil && bytes.Equal(sh, th)
+				unchanged_dirs[d] = unchanged
+			}
+			if unchanged {
+				return true
+			}
+			if d == "." {
+				return false
+			}
+		}
+	}
+	ans = make([]ManifestChange, 0, len(source.Entries)+len(target.Entries))
+	for _, s := range source.Entries {
+		c := ManifestChange{Path: s.Path, Source: s, Target: tmap[s.Path]}
+		switch {
+		case c.Target == nil:
+			c.Action = ManifestFullTransfer
+		case is_in_unchanged_dir(s.Path) || bytes.Equal(s.ContentHash, c.Target.ContentHash):
+			c.Action = ManifestNothing
+		case len(c.Target.Signature) > 0:
+			c.Action = ManifestDeltaTransfer
+		default:
+			c.Action = ManifestFullTransfer
+		}
+		delete(tmap, s.Path)
+		ans = append(ans, c)
+	}
+	for _, t := range tmap {
+		ans = append(ans, ManifestChange{Path: t.Path, Action: ManifestDelete, Target: t})
+	}
+	slices.SortFunc(ans, func(a, b ManifestChange) bool { return a.Path < b.Path })
+	return
+}
@@ -0,0 +1,107 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+// A read-only memory mapping of a regular file. Pass it to the rsync engine
+// as the source or target instead of the *os.File and the engine will work
+// directly on the mapped memory rather than copying data through buffers.
+// Note that the file must not be truncated while it is mapped, as that
+// causes a SIGBUS on access.
+type MappedFile struct {
+	data []byte
+	pos  int64
+}
+
+// Map the contents of the regular file f into memory. The mapping remains
+// valid after f is closed.
+func MapFile(f *os.File) (ans *MappedFile, err error) {
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !s.Mode().IsRegular() {
+		return nil, fmt.Errorf("Cannot map %s as it is not a regular file", f.Name())
+	}
+	ans = &MappedFile{}
+	if s.Size() > 0 {
+		if ans.data, err = unix.Mmap(int(f.Fd()), 0, int(s.Size()), unix.PROT_READ, unix.MAP_SHARED); err != nil {
+			return nil, fmt.Errorf("Failed to mmap %s with error: %w", f.Name(), err)
+		}
+		// we will be reading the file from start to end
+		_ = unix.Madvise(ans.data, unix.MADV_SEQUENTIAL)
+	}
+	return
+}
+
+// The mapped contents of the file, must not be modified
+func (self *MappedFile) Bytes() []byte { return self.data }
+
+// The contents of the file from the current position onwards
+func (self *MappedFile) remaining() []byte {
+	if self.pos >= int64(len(self.data)) {
+		return nil
+	}
+	return self.data[self.pos:]
+}
+
+func (self *MappedFile) Size() int64 { return int64(len(self.data)) }
+
+func (self *MappedFile) Read(b []byte) (n int, err error) {
+	r := self.remaining()
+	if len(r) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(b, r)
+	self.pos += int64(n)
+	return
+}
+
+func (self *MappedFile) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset: %d", off)
+	}
+	if off >= int64(len(self.data)) {
+		return 0, io.EOF
+	}
+	n = copy(b, self.data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (self *MappedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.pos
+	case io.SeekEnd:
+		offset += int64(len(self.data))
+	default:
+		return self.pos, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return self.pos, fmt.Errorf("Cannot seek to negative offset: %d", offset)
+	}
+	self.pos = offset
+	return self.pos, nil
+}
+
+func (self *MappedFile) Close() (err error) {
+	if self.data != nil {
+		err = unix.Munmap(self.data)
+		self.data = nil
+	}
+	self.pos = 0
+	return
+}
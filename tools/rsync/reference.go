@@ -0,0 +1,102 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+var _ = fmt.Print
+
+type reference_block struct {
+	file        uint32
+	index       uint64
+	strong_hash []byte
+}
+
+type reference_signature struct {
+	file             uint32
+	block_size       int
+	strong_hash_type StrongHashType
+	blocks           []BlockHash
+}
+
+// Searches for a given strong hash among all strong hashes of reference blocks in this bucket.
+func find_reference_hash(hh []reference_block, hv []byte) (uint32, uint64, bool) {
+	for _, block := range hh {
+		if bytes.Equal(block.strong_hash, hv) {
+			return block.file, block.index, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Add the signature of a reference file, a file other than the one the main
+// signature was created from, that is already present on the receiving side,
+// for example, a file with similar contents in the same directory, or the
+// previous name of a renamed file. Blocks of the source not found in the main
+// signature are then looked up in reference signatures and sent as
+// OpReferenceRange operations, identifying the reference file by file_id. The
+// signature must be created using the same Patcher as the main signature, so
+// that it has the same block size and strong hash. Only use this if the
+// Patcher applying the delta understands reference operations, and has the
+// reference files, see Patcher.AddReferenceFile().
+func (self *Differ) AddReferenceSignature(file_id uint32, signature []byte) (err error) {
+	d := NewDiffer(self.extra_strong_hashers...)
+	if err = d.AddSignatureData(signature); err == nil {
+		err = d.FinishSignatureData()
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid signature for the reference file: %d with error: %w", file_id, err)
+	}
+	self.references = append(self.references, reference_signature{file: file_id, block_size: d.rsync.BlockSize, strong_hash_type: d.Strong_hash_type, blocks: d.signature})
+	self.rsync.reference_lookup = nil
+	return
+}
+
+// Build the lookup table for the reference signatures, once the main signature has been read
+func (self *Differ) prepare_references() error {
+	if len(self.references) == 0 || self.rsync.reference_lookup != nil {
+		return nil
+	}
+	ans := make(map[uint32][]reference_block)
+	for _, r := range self.references {
+		if r.block_size != self.rsync.BlockSize || r.strong_hash_type != self.Strong_hash_type {
+			return fmt.Errorf("The signature of the reference file: %d has block size: %d and strong hash: %d which do not match the block size: %d and strong hash: %d of the main signature", r.file, r.block_size, r.strong_hash_type, self.rsync.BlockSize, self.Strong_hash_type)
+		}
+		for _, b := range r.blocks {
+			ans[b.WeakHash] = append(ans[b.WeakHash], reference_block{file: r.file, index: b.Index, strong_hash: b.StrongHash})
+		}
+	}
+	self.rsync.reference_lookup = ans
+	return nil
+}
+
+// Make the file with the specified id available for OpReferenceRange
+// operations in deltas, see Differ.AddReferenceSignature(). Use a nil f to
+// remove a previously added file. Reference files are used for all
+// subsequent deltas applied by this Patcher.
+func (self *Patcher) AddReferenceFile(file_id uint32, f io.ReadSeeker) {
+	if f == nil {
+		delete(self.rsync.reference_files, file_id)
+		return
+	}
+	if self.rsync.reference_files == nil {
+		self.rsync.reference_files = make(map[uint32]io.ReadSeeker)
+	}
+	self.rsync.reference_files[file_id] = f
+}
+
+func (self *Patcher) reference_num_of_blocks(file_id uint32) (int64, error) {
+	f := self.rsync.reference_files[file_id]
+	if f == nil {
+		return 0, fmt.Errorf("not available")
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return self.rsync.BlockHashCount(size), nil
+}
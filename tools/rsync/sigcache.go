@@ -0,0 +1,156 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Identifies a particular version of a file. If any of these change the
+// file is assumed to have changed.
+type FileIdentity struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Inode   uint64
+}
+
+// Get the identity of the file at path, which is made absolute
+func FileIdentityFor(path string) (ans FileIdentity, err error) {
+	if path, err = filepath.Abs(path); err != nil {
+		return
+	}
+	s, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	ans = FileIdentity{Path: path, Size: s.Size(), ModTime: s.ModTime()}
+	if stat, ok := s.Sys().(*syscall.Stat_t); ok {
+		ans.Inode = uint64(stat.Ino)
+	}
+	return
+}
+
+// A persistent cache of file signatures, stored on disk, with one entry per
+// path. An entry is only used if the identity of the file and the parameters
+// of the Patcher match the ones the signature was created with.
+type SignatureCache struct {
+	dir string
+}
+
+// Create a cache that stores signatures in dir, if dir is empty, a directory
+// inside the kitty cache directory is used.
+func NewSignatureCache(dir string) *SignatureCache {
+	if dir == "" {
+		dir = filepath.Join(utils.CacheDir(), "rsync-signatures")
+	}
+	return &SignatureCache{dir: dir}
+}
+
+func (self *SignatureCache) path_for(path string) string {
+	h := sha256.Sum256(utils.UnsafeStringToBytes(path))
+	return filepath.Join(self.dir, hex.EncodeToString(h[:]))
+}
+
+const identity_header_size = 2 + 8 + 8 + 8
+
+func serialize_identity(id FileIdentity) []byte {
+	ans := make([]byte, identity_header_size+len(id.Path))
+	bin.PutUint16(ans, uint16(len(id.Path)))
+	bin.PutUint64(ans[2:], uint64(id.Size))
+	bin.PutUint64(ans[10:], uint64(id.ModTime.UnixNano()))
+	bin.PutUint64(ans[18:], id.Inode)
+	copy(ans[identity_header_size:], id.Path)
+	return ans
+}
+
+// Return the cached signature for the file with the specified identity,
+// if it was created with the same parameters as p.
+func (self *SignatureCache) Get(id FileIdentity, p *Patcher) (signature []byte, found bool) {
+	data, err := os.ReadFile(self.path_for(id.Path))
+	if err != nil {
+		return nil, false
+	}
+	prefix := serialize_identity(id)
+	if !bytes.HasPrefix(data, prefix) {
+		return nil, false
+	}
+	signature = data[len(prefix):]
+	var hdr [signature_header_size]byte
+	p.serialize_signature_header(hdr[:])
+	if !bytes.HasPrefix(signature, hdr[:]) {
+		return nil, false
+	}
+	return signature, true
+}
+
+// Store the signature for the file with the specified identity, replacing any
+// previously stored signature for that path
+func (self *SignatureCache) Set(id FileIdentity, signature []byte) (err error) {
+	if err = os.MkdirAll(self.dir, 0o700); err != nil {
+		return
+	}
+	return utils.AtomicWriteFile(self.path_for(id.Path), append(serialize_identity(id), signature...), 0o600)
+}
+
+// Remove the cached signature, if any, for path
+func (self *SignatureCache) Invalidate(path string) (err error) {
+	if path, err = filepath.Abs(path); err != nil {
+		return
+	}
+	if err = os.Remove(self.path_for(path)); errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+// Remove all cached signatures
+func (self *SignatureCache) Clear() error {
+	return os.RemoveAll(self.dir)
+}
+
+// Return the signature of the file at path created by p, using the cached
+// signature if the file is unchanged, otherwise creating the signature and
+// storing it in the cache.
+func (self *SignatureCache) SignatureFor(path string, p *Patcher) (signature []byte, err error) {
+	id, err := FileIdentityFor(path)
+	if err != nil {
+		return nil, err
+	}
+	if ans, found := self.Get(id, p); found {
+		return ans, nil
+	}
+	f, err := os.Open(id.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := bytes.Buffer{}
+	it := p.CreateSignatureIterator(f, &buf)
+	for {
+		if err = it(); err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+	}
+	signature = buf.Bytes()
+	// a failure to cache is not fatal
+	_ = self.Set(id, signature)
+	return signature, nil
+}
@@ -0,0 +1,94 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+var _ = fmt.Print
+
+// Runs of zeros of at least this size, aligned to it, are not written to
+// sparse output, leaving holes in the file instead
+const SparseBlockSize = 4096
+
+var zero_block [SparseBlockSize]byte
+
+// The output files that support being made sparse, such as *os.File
+type sparse_file interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+type sparse_writer struct {
+	f           sparse_file
+	pos         int64
+	ends_in_gap bool
+}
+
+func (self *sparse_writer) write(p []byte) (err error) {
+	if len(p) > 0 {
+		var n int
+		n, err = self.f.Write(p)
+		self.pos += int64(n)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		self.ends_in_gap = false
+	}
+	return
+}
+
+func (self *sparse_writer) skip(amt int64) (err error) {
+	if _, err = self.f.Seek(amt, io.SeekCurrent); err == nil {
+		self.pos += amt
+		self.ends_in_gap = true
+	}
+	return
+}
+
+func (self *sparse_writer) Write(p []byte) (n int, err error) {
+	n = len(p)
+	pending := 0
+	for len(p) > pending {
+		// only skip whole aligned blocks of zeros
+		offset := (self.pos + int64(pending)) % SparseBlockSize
+		chunk_size := int(SparseBlockSize - offset)
+		if chunk_size > len(p)-pending {
+			pending = len(p)
+			break
+		}
+		chunk := p[pending : pending+chunk_size]
+		if offset != 0 || !bytes.Equal(chunk, zero_block[:]) {
+			pending += chunk_size
+			continue
+		}
+		if err = self.write(p[:pending]); err != nil {
+			return 0, err
+		}
+		p = p[pending:]
+		pending = 0
+		gap := SparseBlockSize
+		for len(p) >= gap+SparseBlockSize && bytes.Equal(p[gap:gap+SparseBlockSize], zero_block[:]) {
+			gap += SparseBlockSize
+		}
+		if err = self.skip(int64(gap)); err != nil {
+			return 0, err
+		}
+		p = p[gap:]
+	}
+	if err = self.write(p); err != nil {
+		return 0, err
+	}
+	return
+}
+
+// Extend the file to its full size if it ends in a hole
+func (self *sparse_writer) finish() error {
+	if self.ends_in_gap {
+		return self.f.Truncate(self.pos)
+	}
+	return nil
+}
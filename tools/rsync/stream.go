@@ -0,0 +1,82 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+var _ = fmt.Print
+
+type delta_reader struct {
+	buf  bytes.Buffer
+	it   func() error
+	err  error
+	done bool
+}
+
+func (self *delta_reader) Read(p []byte) (n int, err error) {
+	for self.buf.Len() == 0 {
+		if self.err != nil {
+			return 0, self.err
+		}
+		if self.done {
+			return 0, io.EOF
+		}
+		if err = self.it(); err != nil {
+			if err == io.EOF {
+				self.done = true
+			} else {
+				self.err = err
+			}
+		}
+	}
+	return self.buf.Read(p)
+}
+
+// Return a reader that yields the serialized delta between src and the file
+// the signature sig was created from. The signature header determines the
+// parameters used, any errors are returned from Read().
+func NewDeltaReader(src io.Reader, sig []byte) io.Reader {
+	ans := &delta_reader{}
+	d := NewDiffer()
+	if ans.err = d.AddSignatureData(sig); ans.err == nil {
+		ans.it = d.CreateDelta(src, &ans.buf)
+	}
+	return ans
+}
+
+type patch_writer struct {
+	p      *Patcher
+	closed bool
+}
+
+func (self *patch_writer) Write(data []byte) (n int, err error) {
+	if self.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err = self.p.UpdateDelta(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (self *patch_writer) Close() error {
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	return self.p.FinishDelta()
+}
+
+// Return a writer that applies the serialized delta written to it to local,
+// writing the result to dst. The delta must have been created from a
+// signature made by this Patcher. Close() must be called after the whole delta
+// is written, it returns an error if the delta was incomplete or the output
+// failed verification.
+func (self *Patcher) NewPatchWriter(dst io.Writer, local io.ReadSeeker) io.WriteCloser {
+	self.StartDelta(dst, local)
+	return &patch_writer{p: self}
+}
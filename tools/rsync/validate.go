@@ -0,0 +1,112 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var _ = fmt.Print
+
+// Matched by all errors returned for invalid deltas in strict mode, use with errors.Is()
+var ErrInvalidDelta = errors.New("invalid rsync delta")
+
+// Returned by Patcher.UpdateDelta() in strict mode when an operation in the
+// delta is invalid
+type InvalidDeltaError struct {
+	// The offset of the invalid operation in the delta
+	Offset int64
+	// The raw type byte of the invalid operation
+	Type   byte
+	Reason string
+}
+
+func (self *InvalidDeltaError) Error() string {
+	return fmt.Sprintf("Invalid operation of type %d at offset %d in the delta: %s", self.Type, self.Offset, self.Reason)
+}
+
+func (self *InvalidDeltaError) Unwrap() error { return ErrInvalidDelta }
+
+// Validate every operation in the delta before acting on it, so that a
+// malicious delta cannot cause large allocations or reads outside the source
+// passed to StartDelta(). Use this when the delta comes from an untrusted
+// source. Invalid deltas cause UpdateDelta() to fail with an *InvalidDeltaError.
+func (self *Patcher) SetStrictValidation(enabled bool) {
+	self.strict = enabled
+}
+
+func (self *Patcher) invalid_delta(offset int, data []byte, format string, args ...any) error {
+	return &InvalidDeltaError{Offset: self.delta_offset + int64(offset), Type: data[0], Reason: fmt.Sprintf(format, args...)}
+}
+
+func (self *Patcher) source_num_of_blocks() (int64, error) {
+	if self.source_size < 0 {
+		s := self.delta_input
+		pos, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if self.source_size, err = s.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+		if _, err = s.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	return self.rsync.BlockHashCount(self.source_size), nil
+}
+
+// Check the declared size of an operation before its payload is buffered.
+// offset is the offset of data in the current chunk of delta.
+func (self *Patcher) validate_op_header(offset int, data []byte) error {
+	if (data[0] == byte(OpData) || data[0] == byte(OpData)|OpCompressedFlag) && len(data) >= 5 {
+		if sz, limit := int(bin.Uint32(data[1:])), self.max_data_size(); sz > limit {
+			return self.invalid_delta(offset, data, "data size %d larger than maximum of %d", sz, limit)
+		}
+	}
+	return nil
+}
+
+func (self *Patcher) max_data_size() int {
+	return self.rsync.BlockSize * DataSizeMultiple
+}
+
+// Check the contents of an unserialized operation
+func (self *Patcher) validate_op(offset int, data []byte, op Operation) error {
+	if self.rsync.checksum_done {
+		return self.invalid_delta(offset, data, "operation after the end of the delta")
+	}
+	switch op.Type {
+	case OpBlock, OpBlockRange:
+		num_of_blocks, err := self.source_num_of_blocks()
+		if err != nil {
+			return err
+		}
+		last := op.BlockIndex
+		if op.Type == OpBlockRange {
+			last = op.BlockIndexEnd
+		}
+		if last >= uint64(num_of_blocks) {
+			return self.invalid_delta(offset, data, "block index %d out of range for source with %d blocks", last, num_of_blocks)
+		}
+	case OpReferenceRange:
+		num_of_blocks, err := self.reference_num_of_blocks(op.Reference)
+		if err != nil {
+			return self.invalid_delta(offset, data, "reference file %d: %s", op.Reference, err)
+		}
+		if op.BlockIndexEnd >= uint64(num_of_blocks) {
+			return self.invalid_delta(offset, data, "block index %d out of range for reference file %d with %d blocks", op.BlockIndexEnd, op.Reference, num_of_blocks)
+		}
+	case OpData:
+		if len(op.Data) > self.max_data_size() {
+			return self.invalid_delta(offset, data, "decompressed data size %d larger than maximum of %d", len(op.Data), self.max_data_size())
+		}
+	case OpHash:
+		if sz := self.rsync.checksummer_constructor().Size(); len(op.Data) != sz {
+			return self.invalid_delta(offset, data, "checksum size %d != %d", len(op.Data), sz)
+		}
+	}
+	return nil
+}
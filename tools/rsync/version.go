@@ -0,0 +1,87 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package rsync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// Versions of the serialization format for signatures and deltas. The version
+// is stored in the signature header. Version zero is the original format,
+// understood by all versions of kitty. Version one adds an OpFormatVersion
+// operation at the start of every delta, so that a delta is never
+// silently applied by a Patcher expecting a different format.
+const (
+	FormatVersion0 uint16 = iota
+	FormatVersion1
+
+	MaxFormatVersion = FormatVersion1
+)
+
+// All format versions this implementation can create and read
+func SupportedFormatVersions() []uint16 {
+	ans := make([]uint16, 0, MaxFormatVersion+1)
+	for v := FormatVersion0; v <= MaxFormatVersion; v++ {
+		ans = append(ans, v)
+	}
+	return ans
+}
+
+// Return the highest format version supported by both this implementation
+// and the remote side, which supports the versions in remote_versions.
+func NegotiateFormatVersion(remote_versions ...uint16) (uint16, error) {
+	best, found := uint16(0), false
+	for _, v := range remote_versions {
+		if v <= MaxFormatVersion && (!found || v > best) {
+			best, found = v, true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("No mutually supported rsync format version, remote supports: %v and local supports: %v", remote_versions, SupportedFormatVersions())
+	}
+	return best, nil
+}
+
+// Serialize a list of format versions, for sending to the remote side during negotiation
+func SerializeFormatVersions(versions ...uint16) string {
+	parts := make([]string, len(versions))
+	for i, v := range versions {
+		parts[i] = strconv.FormatUint(uint64(v), 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Parse a list of format versions serialized by SerializeFormatVersions()
+func ParseFormatVersions(raw string) (ans []uint16, err error) {
+	for _, x := range strings.Split(raw, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(x, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rsync format version: %#v", x)
+		}
+		ans = append(ans, uint16(v))
+	}
+	slices.Sort(ans)
+	return slices.Compact(ans), nil
+}
+
+func format_version_op(version uint16) *Operation {
+	ans := Operation{Type: OpFormatVersion, Data: make([]byte, 2)}
+	bin.PutUint16(ans.Data, version)
+	return &ans
+}
+
+func (self Operation) format_version() (uint16, error) {
+	if len(self.Data) != 2 {
+		return 0, fmt.Errorf("Format version operation has incorrect size: %d != 2", len(self.Data))
+	}
+	return bin.Uint16(self.Data), nil
+}
@@ -22,13 +22,11 @@ import (
 	"kitty/tools/cli"
 	"kitty/tools/config"
 	"kitty/tools/tui/loop"
-	"kitty/tools/tui/subseq"
 	"kitty/tools/utils"
 	"kitty/tools/utils/style"
 
 	"github.com/shirou/gopsutil/v3/process"
 	"golang.org/x/exp/maps"
-	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
@@ -774,12 +772,6 @@ type Themes struct {
 	index_map []string
 }
 
-func (self *Themes) Copy() *Themes {
-	ans := &Themes{name_map: make(map[string]*Theme, len(self.name_map)), index_map: slices.Clone(self.index_map)}
-	maps.Copy(ans.name_map, self.name_map)
-	return ans
-}
-
 var camel_case_pat = utils.Once(func() *regexp.Regexp {
 	return regexp.MustCompile(`([a-z])([A-Z])`)
 })
@@ -907,43 +899,6 @@ func (self *Themes) ThemeByName(name string) *Theme {
 	return ans
 }
 
-func match(expression string, items []string) []*subseq.Match {
-	matches := subseq.ScoreItems(expression, items, subseq.Options{Level1: " "})
-	matches = utils.StableSort(matches, func(a, b *subseq.Match) bool { return a.Score > b.Score })
-	return matches
-}
-
-const (
-	MARK_BEFORE = "\033[33m"
-	MARK_AFTER  = "\033[39m"
-)
-
-func (self *Themes) ApplySearch(expression string, marks ...string) []string {
-	mark_before, mark_after := MARK_BEFORE, MARK_AFTER
-	if len(marks) == 2 {
-		mark_before, mark_after = marks[0], marks[1]
-	}
-	results := utils.Filter(match(expression, self.index_map), func(x *subseq.Match) bool { return x.Score > 0 })
-	name_map := make(map[string]*Theme, len(results))
-	for _, m := range results {
-		name_map[m.Text] = self.name_map[m.Text]
-	}
-	self.name_map = name_map
-	self.index_map = self.index_map[:0]
-	ans := make([]string, 0, len(results))
-	for _, m := range results {
-		text := m.Text
-		positions := m.Positions
-		for i := len(positions) - 1; i >= 0; i-- {
-			p := positions[i]
-			text = text[:p] + mark_before + text[p:p+1] + mark_after + text[p+1:]
-		}
-		ans = append(ans, text)
-		self.index_map = append(self.index_map, m.Text)
-	}
-	return ans
-}
-
 func LoadThemes(cache_age time.Duration) (ans *Themes, closer io.Closer, err error) {
 	zip_path, err := FetchCached(cache_age)
 	ans = &Themes{name_map: make(map[string]*Theme)}
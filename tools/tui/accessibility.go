@@ -0,0 +1,92 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// Set this environment variable to a non-empty value other than 0 to have
+// kittens produce output that works with screen readers and braille displays
+const AccessibleModeEnvVar = "KITTEN_ACCESSIBLE"
+
+var accessible_mode struct {
+	sync.Once
+	enabled bool
+}
+
+// In accessible mode widgets do not draw themselves using cursor addressed
+// redraws, which speech synthesizers and braille displays cannot follow.
+// Instead, they output announcements: lines of plain text describing changes
+// in their state, such as the current item in a list or the focused field
+// in a form. Turned on by the KITTEN_ACCESSIBLE environment variable.
+func AccessibleMode() bool {
+	accessible_mode.Do(func() {
+		val := os.Getenv(AccessibleModeEnvVar)
+		accessible_mode.enabled = val != "" && val != "0"
+	})
+	return accessible_mode.enabled
+}
+
+// Turn accessible mode on or off, overriding the environment variable, for
+// example, from a command line flag
+func SetAccessibleMode(enabled bool) {
+	accessible_mode.Do(func() {})
+	accessible_mode.enabled = enabled
+}
+
+// Tracks what has been announced so that a state is announced only when it
+// changes. The zero value is ready to use.
+type Announcer struct {
+	last map[string]string
+}
+
+// Returns text, stripped of formatting, if it differs from the text last
+// announced with the same key, otherwise the empty string
+func (self *Announcer) Announce(key, text string) string {
+	text = strings.Join(strings.Fields(wcswidth.StripEscapeCodes(text)), " ")
+	if self.last == nil {
+		self.last = make(map[string]string)
+	}
+	if prev, found := self.last[key]; found && prev == text {
+		return ""
+	}
+	self.last[key] = text
+	return text
+}
+
+// Write the announcement, if any, to the terminal as a line of its own
+func (self *Announcer) WriteTo(lp *loop.Loop, key, text string) {
+	if a := self.Announce(key, text); a != "" {
+		lp.QueueWriteString(a + "\r\n")
+	}
+}
+
+// Forget what has been announced, so that everything is announced again
+func (self *Announcer) Reset() {
+	self.last = nil
+}
+
+// Fields can implement this to describe their state in accessible mode,
+// otherwise the text of the field is used
+type DescribedFormField interface {
+	// A description of the kind of field and its value, for example:
+	// checkbox, checked
+	Description() string
+}
+
+func describe_field(f FormField) string {
+	if d, ok := f.(DescribedFormField); ok {
+		return d.Description()
+	}
+	plain := func(style string, args ...any) string { return fmt.Sprint(args...) }
+	return strings.Join(f.Lines(80, true, plain), " ")
+}
@@ -0,0 +1,91 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestAccessibility(t *testing.T) {
+	SetCurrentTheme(DefaultTheme())
+	var a Announcer
+	for _, x := range []struct{ key, text, expected string }{
+		{"a", "\x1b[1mone\x1b[m  two ", "one two"},
+		{"a", "one two", ""},
+		{"b", "one two", "one two"},
+		{"a", "three", "three"},
+	} {
+		if diff := cmp.Diff(x.expected, a.Announce(x.key, x.text)); diff != "" {
+			t.Fatalf("Unexpected announcement for %#v:\n%s", x.text, diff)
+		}
+	}
+
+	l := NewList()
+	l.MultiSelect = true
+	l.SetItems([]string{"alpha", "beta", "gamma"})
+	l.SetCurrentItem(1)
+	l.SetSelected(1, true)
+	if diff := cmp.Diff("2 of 3: beta, selected", l.Announcement()); diff != "" {
+		t.Fatalf("Unexpected list announcement:\n%s", diff)
+	}
+	l.SetQuery("xyz")
+	if diff := cmp.Diff("No matches", l.Announcement()); diff != "" {
+		t.Fatalf("Unexpected list announcement:\n%s", diff)
+	}
+
+	tb := NewTable(TableColumn{Title: "Name"}, TableColumn{Title: "Size"})
+	tb.SetRows([][]string{{"a", "1"}, {"b", "2"}})
+	tb.SetCurrentRow(1)
+	if diff := cmp.Diff("Row 2 of 2: Name: b, Size: 2", tb.Announcement()); diff != "" {
+		t.Fatalf("Unexpected table announcement:\n%s", diff)
+	}
+
+	f := NewForm("Login", NewTextInput("User", "kovid"), NewPasswordInput("Password"), NewCheckbox("", "Remember me", true))
+	if diff := cmp.Diff([]string{"Login. Enter: OK, Esc: Cancel", "User: text, kovid"}, f.Announcements()); diff != "" {
+		t.Fatalf("Unexpected form announcements:\n%s", diff)
+	}
+	f.Validator = func(*Form) error { return errors.New("Wrong password") }
+	f.MoveFocus(1)
+	f.Submit()
+	if diff := cmp.Diff([]string{"Login. Enter: OK, Esc: Cancel", "Password: password, 0 characters", "Error: Wrong password"}, f.Announcements()); diff != "" {
+		t.Fatalf("Unexpected form announcements:\n%s", diff)
+	}
+	f.MoveFocus(1)
+	if diff := cmp.Diff("checkbox, Remember me, checked", f.Announcements()[1]); diff != "" {
+		t.Fatalf("Unexpected form announcements:\n%s", diff)
+	}
+
+	now := time.Now()
+	p := NewProgress("Copying", 100)
+	p.now = func() time.Time { return now }
+	p.SetDone(47)
+	if diff := cmp.Diff("Copying: 40% done", p.Announcement()); diff != "" {
+		t.Fatalf("Unexpected progress announcement:\n%s", diff)
+	}
+
+	SetAccessibleMode(true)
+	defer SetAccessibleMode(false)
+	s := NewScreen(10, 3)
+	s.DrawText(0, 0, "\x1b[31mred\x1b[m text")
+	s.DrawText(0, 1, "second")
+	s.SetCursor(2, 2)
+	if diff := cmp.Diff("red text\r\nsecond\r\n", s.Render()); diff != "" {
+		t.Fatalf("Unexpected accessible render:\n%s", diff)
+	}
+	s.Clear()
+	s.DrawText(0, 0, "\x1b[31mred\x1b[m text")
+	s.DrawText(0, 1, "changed")
+	if diff := cmp.Diff("changed\r\n", s.Render()); diff != "" {
+		t.Fatalf("Unexpected accessible render:\n%s", diff)
+	}
+	if diff := cmp.Diff("Copying: 40% done   ", p.Render(20, func(style string, args ...any) string { return fmt.Sprint(args...) })); diff != "" {
+		t.Fatalf("Unexpected accessible progress:\n%s", diff)
+	}
+}
@@ -5,13 +5,10 @@ package tui
 import (
 	"fmt"
 	"os"
-	"strings"
 	"sync"
-	"time"
 
 	"kitty/tools/tui/loop"
 	"kitty/tools/utils"
-	"kitty/tools/utils/humanize"
 )
 
 var _ = fmt.Print
@@ -26,60 +23,14 @@ type dl_data struct {
 	temp_file_path      string
 }
 
-type render_data struct {
-	done, total  uint64
-	screen_width int
-	spinner      *Spinner
-	started_at   time.Time
-}
-
-func render_without_total(rd *render_data) string {
-	return fmt.Sprint(rd.spinner.Tick(), humanize.Bytes(rd.done), " downloaded so far. Started %s", humanize.Time(rd.started_at))
-}
-
-func format_time(d time.Duration) string {
-	d = d.Round(time.Second)
-	ans := ""
-	if d.Hours() > 1 {
-		h := d / time.Hour
-		d -= h * time.Hour
-		ans += fmt.Sprintf("%02d:", h)
-	}
-	m := d / time.Minute
-	d -= m * time.Minute
-	s := d / time.Second
-	return fmt.Sprintf("%s%02d:%02d", ans, m, s)
-}
-
-func render_progress(rd *render_data) string {
-	if rd.total == 0 {
-		return render_without_total(rd)
-	}
-	now := time.Now()
-	duration := now.Sub(rd.started_at)
-	rate := float64(rd.done) / float64(duration)
-	frac := float64(rd.done) / float64(rd.total)
-	bytes_left := rd.total - rd.done
-	time_left := time.Duration(float64(bytes_left) / rate)
-	speed := rate * float64(time.Second)
-	before := rd.spinner.Tick()
-	after := fmt.Sprintf(" %d%% %s/s %s", int(frac*100), strings.ReplaceAll(humanize.Bytes(uint64(speed)), " ", ""), format_time(time_left))
-	available_width := rd.screen_width - len("T  100% 1000 MB/s 11:11:11")
-	// fmt.Println("\r\n", frac, available_width)
-	progress_bar := ""
-	if available_width > 10 {
-		progress_bar = " " + RenderProgressBar(frac, available_width)
-	}
-	return before + progress_bar + after
-}
-
 func DownloadFileWithProgress(destpath, url string, kill_if_signaled bool) (err error) {
 	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors, loop.NoMouseTracking)
 	if err != nil {
 		return
 	}
 	dl_data := dl_data{}
-	rd := render_data{spinner: NewSpinner("dots"), started_at: time.Now()}
+	spinner := NewSpinner("dots")
+	progress := NewProgress("", 0)
 
 	register_temp_file_path := func(path string) {
 		dl_data.mutex.Lock()
@@ -124,9 +75,9 @@ func DownloadFileWithProgress(destpath, url string, kill_if_signaled bool) (err
 		lp.QueueWriteString("\r")
 		lp.ClearToEndOfLine()
 		dl_data.mutex.Lock()
-		rd.done, rd.total = dl_data.done, dl_data.total
+		done, total := dl_data.done, dl_data.total
 		dl_data.mutex.Unlock()
-		if rd.done+rd.total == 0 {
+		if done+total == 0 {
 			lp.QueueWriteString("Waiting for download to start...")
 		} else {
 			sz, err := lp.ScreenSize()
@@ -134,8 +85,9 @@ func DownloadFileWithProgress(destpath, url string, kill_if_signaled bool) (err
 			if err != nil {
 				w = 80
 			}
-			rd.screen_width = int(w)
-			lp.QueueWriteString(render_progress(&rd))
+			progress.SetTotal(int64(total))
+			progress.SetDone(int64(done))
+			lp.QueueWriteString(spinner.Tick() + progress.Render(int(w)-1, lp.SprintStyled))
 		}
 	}
 
@@ -183,7 +135,7 @@ func DownloadFileWithProgress(destpath, url string, kill_if_signaled bool) (err
 		return lp.OnWakeup()
 	}
 
-	lp.AddTimer(rd.spinner.interval, true, on_timer_tick)
+	lp.AddTimer(spinner.interval, true, on_timer_tick)
 	err = lp.Run()
 	dl_data.mutex.Lock()
 	if dl_data.temp_file_path != "" && !dl_data.download_finished {
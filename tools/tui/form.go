@@ -0,0 +1,770 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// A single field in a Form
+type FormField interface {
+	// The label displayed to the left of the field. Fields without a label
+	// take up the full width of the form.
+	FieldLabel() string
+	// The lines used to display the field, each exactly width cells wide
+	Lines(width int, focused bool, sprint_styled func(style string, args ...any) string) []string
+	// Fields that cannot be focused, such as Label, are skipped when moving between fields
+	Focusable() bool
+	// The event handlers return true if the event was handled, in which case
+	// the field needs to be redrawn. x and y are relative to the top left
+	// corner of the field.
+	OnKeyEvent(ev *loop.KeyEvent) bool
+	OnText(text string) bool
+	OnClick(x, y int) bool
+	// Return an error if the current value of the field is not valid
+	Validate() error
+}
+
+func rune_width(ch rune) int { return utils.Max(0, wcswidth.Runewidth(ch)) }
+
+// Static text, wrapped to the width of the form
+type Label struct {
+	Text string
+}
+
+func NewLabel(text string) *Label { return &Label{Text: text} }
+
+func (self *Label) FieldLabel() string                { return "" }
+func (self *Label) Focusable() bool                   { return false }
+func (self *Label) OnKeyEvent(ev *loop.KeyEvent) bool { return false }
+func (self *Label) OnText(text string) bool           { return false }
+func (self *Label) OnClick(x, y int) bool             { return false }
+func (self *Label) Validate() error                   { return nil }
+
+func (self *Label) Lines(width int, focused bool, sprint_styled func(style string, args ...any) string) []string {
+	return utils.Map(func(line string) string { return fit_to_width(line, width, false) }, style.WrapTextAsLines(self.Text, width, style.WrapOptions{Trim_whitespace: true}))
+}
+
+// A single line of editable text
+type TextInput struct {
+	Label, Value string
+	// Displayed in the field when it is empty and not focused
+	Placeholder string
+	// Display every character as an asterisk
+	Password bool
+	// Called with the current value to check it, nil means every value is valid
+	Validator func(value string) error
+	OnChange  func(value string)
+
+	// in runes
+	cursor, scroll int
+}
+
+func NewTextInput(label, value string) *TextInput {
+	return &TextInput{Label: label, Value: value, cursor: len([]rune(value))}
+}
+
+func NewPasswordInput(label string) *TextInput {
+	return &TextInput{Label: label, Password: true}
+}
+
+func (self *TextInput) FieldLabel() string { return self.Label }
+func (self *TextInput) Focusable() bool    { return true }
+
+func (self *TextInput) Validate() error {
+	if self.Validator != nil {
+		return self.Validator(self.Value)
+	}
+	return nil
+}
+
+func (self *TextInput) set_value(runes []rune, cursor int) {
+	self.Value = string(runes)
+	self.cursor = cursor
+	if self.OnChange != nil {
+		self.OnChange(self.Value)
+	}
+}
+
+func (self *TextInput) OnText(text string) bool {
+	// only a single line is allowed
+	text = strings.NewReplacer("\r", "", "\n", "").Replace(text)
+	if text == "" {
+		return false
+	}
+	runes := []rune(self.Value)
+	self.cursor = utils.Max(0, utils.Min(self.cursor, len(runes)))
+	added := []rune(text)
+	nv := make([]rune, 0, len(runes)+len(added))
+	nv = append(nv, runes[:self.cursor]...)
+	nv = append(nv, added...)
+	self.set_value(append(nv, runes[self.cursor:]...), self.cursor+len(added))
+	return true
+}
+
+func (self *TextInput) OnKeyEvent(ev *loop.KeyEvent) bool {
+	runes := []rune(self.Value)
+	self.cursor = utils.Max(0, utils.Min(self.cursor, len(runes)))
+	switch {
+	case ev.MatchesPressOrRepeat("left") || ev.MatchesPressOrRepeat("ctrl+b"):
+		self.cursor = utils.Max(0, self.cursor-1)
+	case ev.MatchesPressOrRepeat("right") || ev.MatchesPressOrRepeat("ctrl+f"):
+		self.cursor = utils.Min(len(runes), self.cursor+1)
+	case ev.MatchesPressOrRepeat("home") || ev.MatchesPressOrRepeat("ctrl+a"):
+		self.cursor = 0
+	case ev.MatchesPressOrRepeat("end") || ev.MatchesPressOrRepeat("ctrl+e"):
+		self.cursor = len(runes)
+	case ev.MatchesPressOrRepeat("backspace") || ev.MatchesPressOrRepeat("ctrl+h"):
+		if self.cursor == 0 {
+			return false
+		}
+		self.set_value(append(runes[:self.cursor-1:self.cursor-1], runes[self.cursor:]...), self.cursor-1)
+	case ev.MatchesPressOrRepeat("delete"):
+		if self.cursor >= len(runes) {
+			return false
+		}
+		self.set_value(append(runes[:self.cursor:self.cursor], runes[self.cursor+1:]...), self.cursor)
+	case ev.MatchesPressOrRepeat("ctrl+u"):
+		self.set_value(runes[self.cursor:], 0)
+	case ev.MatchesPressOrRepeat("ctrl+k"):
+		self.set_value(runes[:self.cursor], self.cursor)
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+func (self *TextInput) display_runes() []rune {
+	ans := []rune(self.Value)
+	if self.Password {
+		for i := range ans {
+			ans[i] = '*'
+		}
+	}
+	return ans
+}
+
+func (self *TextInput) Description() string {
+	switch {
+	case self.Password:
+		return fmt.Sprintf("password, %d characters", len([]rune(self.Value)))
+	case self.Value == "" && self.Placeholder != "":
+		return "text, empty, " + self.Placeholder
+	case self.Value == "":
+		return "text, empty"
+	}
+	return "text, " + self.Value
+}
+
+func (self *TextInput) OnClick(x, y int) bool {
+	runes := self.display_runes()
+	pos := 0
+	self.cursor = len(runes)
+	for i := utils.Min(self.scroll, len(runes)); i < len(runes); i++ {
+		pos += rune_width(runes[i])
+		if pos > x {
+			self.cursor = i
+			break
+		}
+	}
+	return true
+}
+
+func (self *TextInput) Lines(width int, focused bool, sprint_styled func(style string, args ...any) string) []string {
+	runes := self.display_runes()
+	if len(runes) == 0 && !focused && self.Placeholder != "" {
+		return []string{sprint_styled("dim u=straight", fit_to_width(self.Placeholder, width, false))}
+	}
+	self.cursor = utils.Max(0, utils.Min(self.cursor, len(runes)))
+	// scroll so that the cursor, and the cell after it, are visible
+	if self.cursor < self.scroll {
+		self.scroll = self.cursor
+	}
+	for self.scroll < self.cursor {
+		w := 1
+		for _, ch := range runes[self.scroll:self.cursor] {
+			w += rune_width(ch)
+		}
+		if w <= width {
+			break
+		}
+		self.scroll++
+	}
+	buf := strings.Builder{}
+	w := 0
+	for i := self.scroll; i <= len(runes) && w < width; i++ {
+		text, tw := " ", 1
+		if i < len(runes) {
+			text, tw = string(runes[i]), rune_width(runes[i])
+		} else if !focused {
+			break
+		}
+		if w+tw > width {
+			break
+		}
+		if focused && i == self.cursor {
+			text = sprint_styled("reverse=true", text)
+		}
+		buf.WriteString(text)
+		w += tw
+	}
+	buf.WriteString(strings.Repeat(" ", utils.Max(0, width-w)))
+	return []string{sprint_styled("u=straight", buf.String())}
+}
+
+// A box that can be checked and unchecked with the space key or by clicking
+type Checkbox struct {
+	Label, Text string
+	Checked     bool
+	Validator   func(checked bool) error
+	OnChange    func(checked bool)
+}
+
+func NewCheckbox(label, text string, checked bool) *Checkbox {
+	return &Checkbox{Label: label, Text: text, Checked: checked}
+}
+
+func (self *Checkbox) FieldLabel() string { return self.Label }
+func (self *Checkbox) Focusable() bool    { return true }
+
+func (self *Checkbox) Validate() error {
+	if self.Validator != nil {
+		return self.Validator(self.Checked)
+	}
+	return nil
+}
+
+func (self *Checkbox) Toggle() {
+	self.Checked = !self.Checked
+	if self.OnChange != nil {
+		self.OnChange(self.Checked)
+	}
+}
+
+func (self *Checkbox) OnText(text string) bool {
+	if text == " " {
+		self.Toggle()
+		return true
+	}
+	return false
+}
+
+func (self *Checkbox) OnKeyEvent(ev *loop.KeyEvent) bool { return false }
+
+func (self *Checkbox) OnClick(x, y int) bool {
+	self.Toggle()
+	return true
+}
+
+func (self *Checkbox) Description() string {
+	state := "not checked"
+	if self.Checked {
+		state = "checked"
+	}
+	return "checkbox, " + self.Text + ", " + state
+}
+
+func (self *Checkbox) Lines(width int, focused bool, sprint_styled func(style string, args ...any) string) []string {
+	box := "[ ]"
+	if self.Checked {
+		box = "[x]"
+	}
+	if focused {
+		box = sprint_styled("reverse=true", box)
+	}
+	return []string{fit_to_width(box+" "+self.Text, width, false)}
+}
+
+// The choices shared by RadioGroup and SelectBox
+type choices struct {
+	Choices   []string
+	Selected  int
+	Validator func(selected int) error
+	OnChange  func(selected int)
+}
+
+func (self *choices) Validate() error {
+	if self.Validator != nil {
+		return self.Validator(self.Selected)
+	}
+	return nil
+}
+
+func (self *choices) SelectedChoice() string {
+	if self.Selected > -1 && self.Selected < len(self.Choices) {
+		return self.Choices[self.Selected]
+	}
+	return ""
+}
+
+func (self *choices) Select(idx int) bool {
+	if len(self.Choices) == 0 {
+		return false
+	}
+	idx = (idx + len(self.Choices)) % len(self.Choices)
+	if idx == self.Selected {
+		return false
+	}
+	self.Selected = idx
+	if self.OnChange != nil {
+		self.OnChange(idx)
+	}
+	return true
+}
+
+func (self *choices) describe(kind string) string {
+	return fmt.Sprintf("%s, %s, %d of %d", kind, self.SelectedChoice(), self.Selected+1, len(self.Choices))
+}
+
+// Select the next choice that starts with text, ignoring case
+func (self *choices) select_by_prefix(text string) bool {
+	text = strings.ToLower(text)
+	for i := 1; i <= len(self.Choices); i++ {
+		idx := (self.Selected + i) % len(self.Choices)
+		if strings.HasPrefix(strings.ToLower(self.Choices[idx]), text) {
+			self.Select(idx)
+			return true
+		}
+	}
+	return false
+}
+
+// A group of choices, one per line, of which exactly one is selected. The
+// arrow keys change the selection.
+type RadioGroup struct {
+	Label string
+	choices
+}
+
+func NewRadioGroup(label string, selected int, choices ...string) *RadioGroup {
+	ans := &RadioGroup{Label: label}
+	ans.Choices, ans.Selected = choices, selected
+	return ans
+}
+
+func (self *RadioGroup) FieldLabel() string { return self.Label }
+func (self *RadioGroup) Focusable() bool    { return true }
+
+func (self *RadioGroup) Description() string { return self.describe("radio group") }
+
+func (self *RadioGroup) OnText(text string) bool { return self.select_by_prefix(text) }
+
+func (self *RadioGroup) OnKeyEvent(ev *loop.KeyEvent) bool {
+	switch {
+	case ev.MatchesPressOrRepeat("up") || ev.MatchesPressOrRepeat("left"):
+		if self.Selected < 1 {
+			return false
+		}
+		self.Select(self.Selected - 1)
+	case ev.MatchesPressOrRepeat("down") || ev.MatchesPressOrRepeat("right"):
+		if self.Selected >= len(self.Choices)-1 {
+			return false
+		}
+		self.Select(self.Selected + 1)
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+func (self *RadioGroup) OnClick(x, y int) bool {
+	if y < len(self.Choices) {
+		self.Select(y)
+	}
+	return true
+}
+
+func (self *RadioGroup) Lines(width int, focused bool, sprint_styled func(style string, args ...any) string) []string {
+	ans := make([]string, len(self.Choices))
+	for i, c := range self.Choices {
+		marker := "( )"
+		if i == self.Selected {
+			marker = "(•)"
+			if focused {
+				marker = sprint_styled("reverse=true", marker)
+			}
+		}
+		ans[i] = fit_to_width(marker+" "+c, width, false)
+	}
+	return ans
+}
+
+// A single line showing the selected choice. The left and right arrow keys,
+// the space key and clicking cycle through the choices.
+type SelectBox struct {
+	Label string
+	choices
+}
+
+func NewSelectBox(label string, selected int, choices ...string) *SelectBox {
+	ans := &SelectBox{Label: label}
+	ans.Choices, ans.Selected = choices, selected
+	return ans
+}
+
+func (self *SelectBox) FieldLabel() string { return self.Label }
+func (self *SelectBox) Focusable() bool    { return true }
+
+func (self *SelectBox) Description() string { return self.describe("select box") }
+
+func (self *SelectBox) OnText(text string) bool {
+	if text == " " {
+		return self.Select(self.Selected + 1)
+	}
+	return self.select_by_prefix(text)
+}
+
+func (self *SelectBox) OnKeyEvent(ev *loop.KeyEvent) bool {
+	switch {
+	case ev.MatchesPressOrRepeat("left"):
+		self.Select(self.Selected - 1)
+	case ev.MatchesPressOrRepeat("right"):
+		self.Select(self.Selected + 1)
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+func (self *SelectBox) OnClick(x, y int) bool {
+	if x < 2 {
+		return self.Select(self.Selected - 1)
+	}
+	return self.Select(self.Selected + 1)
+}
+
+func (self *SelectBox) Lines(width int, focused bool, sprint_styled func(style string, args ...any) string) []string {
+	text := "◀ " + self.SelectedChoice() + " ▶"
+	if focused {
+		text = sprint_styled("reverse=true", text)
+	}
+	return []string{fit_to_width(text, width, false)}
+}
+
+// A form made up of fields, such as text inputs, checkboxes, radio groups and
+// select boxes. The tab and arrow keys move between fields, enter submits the
+// form and esc cancels it. A form is submitted only if all its fields are
+// valid, otherwise the first invalid field is focused and its error
+// displayed. Forms can be drawn directly using Lines() or used as an Overlay.
+type Form struct {
+	Title  string
+	Fields []FormField
+	// The order in which the tab key moves between fields, as indices into
+	// Fields. Defaults to the order of Fields.
+	TabOrder                 []int
+	SubmitLabel, CancelLabel string
+	// The maximum width of the form, including its borders
+	MaxWidth int
+	// Styles, in the format used by loop.SprintStyled
+	BorderStyle, TitleStyle, LabelStyle, FocusedLabelStyle, ErrorStyle, CurrentButtonStyle string
+	// Called after all fields are valid, to check the form as a whole, for
+	// example, that two password fields match
+	Validator func(form *Form) error
+	OnSubmit  func(form *Form)
+	OnCancel  func()
+
+	focus             int
+	err               error
+	err_field         int
+	closed, submitted bool
+	rect              Rect
+	field_rows        [][2]int
+	input_x           int
+	button_row        int
+	button_ranges     [][2]int
+	focus_initialized bool
+	announcer         Announcer
+}
+
+func NewForm(title string, fields ...FormField) *Form {
+	theme := CurrentTheme()
+	return &Form{
+		Title: title, Fields: fields, SubmitLabel: "OK", CancelLabel: "Cancel", MaxWidth: 72, err_field: -1,
+		BorderStyle: theme.Accent, TitleStyle: "bold", LabelStyle: theme.Dim, FocusedLabelStyle: "bold",
+		ErrorStyle: theme.Error, CurrentButtonStyle: theme.Selection,
+	}
+}
+
+func (self *Form) tab_order() []int {
+	order := self.TabOrder
+	if len(order) == 0 {
+		order = make([]int, len(self.Fields))
+		for i := range order {
+			order[i] = i
+		}
+	}
+	return utils.Filter(order, func(i int) bool { return i > -1 && i < len(self.Fields) && self.Fields[i].Focusable() })
+}
+
+func (self *Form) ensure_focus() {
+	if !self.focus_initialized {
+		self.focus_initialized = true
+		if order := self.tab_order(); len(order) > 0 {
+			self.focus = order[0]
+		}
+	}
+}
+
+// The index of the field that has keyboard focus
+func (self *Form) Focus() int {
+	self.ensure_focus()
+	return self.focus
+}
+
+func (self *Form) SetFocus(idx int) {
+	if idx > -1 && idx < len(self.Fields) && self.Fields[idx].Focusable() {
+		self.focus, self.focus_initialized = idx, true
+	}
+}
+
+// Move focus by delta fields in tab order
+func (self *Form) MoveFocus(delta int) {
+	order := self.tab_order()
+	if len(order) == 0 {
+		return
+	}
+	pos := 0
+	for i, idx := range order {
+		if idx == self.Focus() {
+			pos = i
+			break
+		}
+	}
+	pos = ((pos+delta)%len(order) + len(order)) % len(order)
+	self.focus = order[pos]
+}
+
+// The error that prevented the form from being submitted, if any
+func (self *Form) Error() error { return self.err }
+
+func (self *Form) IsClosed() bool  { return self.closed }
+func (self *Form) Submitted() bool { return self.submitted }
+
+// Validate all fields and submit the form if they are valid. Returns false
+// if the form was not submitted, in which case Error() is the reason.
+func (self *Form) Submit() bool {
+	if self.closed {
+		return false
+	}
+	self.err, self.err_field = nil, -1
+	for i, f := range self.Fields {
+		if err := f.Validate(); err != nil {
+			self.err, self.err_field = err, i
+			self.SetFocus(i)
+			return false
+		}
+	}
+	if self.Validator != nil {
+		if err := self.Validator(self); err != nil {
+			self.err = err
+			return false
+		}
+	}
+	self.closed, self.submitted = true, true
+	if self.OnSubmit != nil {
+		self.OnSubmit(self)
+	}
+	return true
+}
+
+func (self *Form) Cancel() {
+	if self.closed {
+		return
+	}
+	self.closed = true
+	if self.OnCancel != nil {
+		self.OnCancel()
+	}
+}
+
+// Once a field has been found to be invalid, re-validate it as it is edited
+// so that the error goes away as soon as it is fixed
+func (self *Form) field_changed(idx int) {
+	if self.err_field == idx {
+		if err := self.Fields[idx].Validate(); err != nil {
+			self.err = err
+		} else {
+			self.err, self.err_field = nil, -1
+		}
+	}
+}
+
+func (self *Form) OnKeyEvent(ev *loop.KeyEvent) bool {
+	focus := self.Focus()
+	if focus < len(self.Fields) && self.Fields[focus].OnKeyEvent(ev) {
+		ev.Handled = true
+		self.field_changed(focus)
+		return true
+	}
+	switch {
+	case ev.MatchesPressOrRepeat("tab") || ev.MatchesPressOrRepeat("down"):
+		self.MoveFocus(1)
+	case ev.MatchesPressOrRepeat("shift+tab") || ev.MatchesPressOrRepeat("up"):
+		self.MoveFocus(-1)
+	case ev.MatchesPressOrRepeat("enter"):
+		self.Submit()
+	case ev.MatchesPressOrRepeat("esc"):
+		self.Cancel()
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+func (self *Form) OnText(text string) bool {
+	focus := self.Focus()
+	if focus < len(self.Fields) && self.Fields[focus].OnText(text) {
+		self.field_changed(focus)
+		return true
+	}
+	return false
+}
+
+// Clicking a field focuses it and passes the click on to the field, clicking
+// the buttons submits or cancels the form
+func (self *Form) OnMouseEvent(ev *loop.MouseEvent) bool {
+	if ev.Event_type != loop.MOUSE_CLICK {
+		return false
+	}
+	x, y := ev.Cell.X-self.rect.Left, ev.Cell.Y-self.rect.Top
+	if y == self.button_row {
+		for i, r := range self.button_ranges {
+			if x >= r[0] && x < r[1] {
+				if i == 0 {
+					self.Submit()
+				} else {
+					self.Cancel()
+				}
+				return true
+			}
+		}
+		return false
+	}
+	for i, r := range self.field_rows {
+		if y >= r[0] && y < r[1] && self.Fields[i].Focusable() {
+			self.SetFocus(i)
+			xoff := 2
+			if self.Fields[i].FieldLabel() != "" {
+				xoff = self.input_x
+			}
+			if x >= xoff {
+				self.Fields[i].OnClick(x-xoff, y-r[0])
+				self.field_changed(i)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// The lines of text that make up the form, when drawn on a screen of the specified width
+func (self *Form) Lines(screen_width int, sprint_styled func(style string, args ...any) string) []string {
+	focus := self.Focus()
+	inner := utils.Max(1, utils.Min(screen_width, utils.Max(self.MaxWidth, 5))-4)
+	label_width := 0
+	for _, f := range self.Fields {
+		if l := f.FieldLabel(); l != "" {
+			label_width = utils.Max(label_width, wcswidth.Stringwidth(l)+1)
+		}
+	}
+	label_width = utils.Min(label_width, inner/3)
+	input_width := utils.Max(1, inner-label_width-1)
+	// the first line is the top border, then the border and padding
+	self.input_x = 2 + label_width + 1
+
+	rows := []string{}
+	self.field_rows = make([][2]int, len(self.Fields))
+	for i, f := range self.Fields {
+		start := len(rows) + 1
+		is_focused := i == focus
+		if label := f.FieldLabel(); label != "" {
+			ls := self.LabelStyle
+			if is_focused {
+				ls = self.FocusedLabelStyle
+			}
+			label = sprint_styled(ls, fit_to_width(label+":", label_width, false))
+			for j, line := range f.Lines(input_width, is_focused, sprint_styled) {
+				if j > 0 {
+					label = strings.Repeat(" ", label_width)
+				}
+				rows = append(rows, label+" "+line)
+			}
+		} else {
+			rows = append(rows, f.Lines(inner, is_focused, sprint_styled)...)
+		}
+		self.field_rows[i] = [2]int{start, len(rows) + 1}
+		if i == self.err_field && self.err != nil {
+			msg := wcswidth.TruncateToVisualLength(self.err.Error(), input_width)
+			rows = append(rows, strings.Repeat(" ", label_width+1)+sprint_styled(self.ErrorStyle, msg))
+		}
+	}
+	if self.err != nil && self.err_field < 0 {
+		rows = append(rows, "")
+		for _, line := range style.WrapTextAsLines(self.err.Error(), inner, style.WrapOptions{Trim_whitespace: true}) {
+			rows = append(rows, sprint_styled(self.ErrorStyle, line))
+		}
+	}
+	rows = append(rows, "")
+	self.button_row = len(rows) + 1
+	var row string
+	row, self.button_ranges = buttons_row([]string{"[ " + self.SubmitLabel + " ]", "[ " + self.CancelLabel + " ]"}, -1, inner, self.CurrentButtonStyle, sprint_styled)
+	rows = append(rows, row)
+	return box_lines(self.Title, inner, rows, self.BorderStyle, self.TitleStyle, sprint_styled)
+}
+
+type announcement struct{ key, text string }
+
+func (self *Form) announcements() []announcement {
+	ans := []announcement{{"title", fmt.Sprintf("%s. Enter: %s, Esc: %s", self.Title, self.SubmitLabel, self.CancelLabel)}}
+	if focus := self.Focus(); focus < len(self.Fields) {
+		f := self.Fields[focus]
+		text := describe_field(f)
+		if label := f.FieldLabel(); label != "" {
+			text = label + ": " + text
+		}
+		ans = append(ans, announcement{"field", text})
+	}
+	// an empty announcement when there is no error, so that a recurrence of
+	// the same error is announced again
+	err := ""
+	if self.err != nil {
+		err = "Error: " + self.err.Error()
+	}
+	return append(ans, announcement{"error", err})
+}
+
+// Lines of plain text describing the form: its title and keys, the focused
+// field and the error, if any. Used instead of Lines() in accessible mode.
+func (self *Form) Announcements() []string {
+	ans := []string{}
+	for _, a := range self.announcements() {
+		if a.text != "" {
+			ans = append(ans, a.text)
+		}
+	}
+	return ans
+}
+
+// Draw the form centered in screen. In accessible mode, write the
+// announcements that have changed since the form was last drawn instead.
+func (self *Form) Draw(lp *loop.Loop, screen Rect) {
+	if AccessibleMode() {
+		for _, a := range self.announcements() {
+			self.announcer.WriteTo(lp, a.key, a.text)
+		}
+		return
+	}
+	self.rect = draw_centered(lp, screen, self.Lines(screen.Width, lp.SprintStyled))
+}
@@ -0,0 +1,146 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestForm(t *testing.T) {
+	SetCurrentTheme(DefaultTheme())
+	marked := func(style string, args ...any) string {
+		if style == "reverse=true" {
+			return "\x1b[7m" + fmt.Sprint(args...) + "\x1b[27m"
+		}
+		return fmt.Sprint(args...)
+	}
+	// mark reversed text without changing its width
+	unmark := strings.NewReplacer("\x1b[7m", "*", "\x1b[27m", "*").Replace
+	user := NewTextInput("User", "")
+	user.Validator = func(v string) error {
+		if v == "" {
+			return fmt.Errorf("A user name is required")
+		}
+		return nil
+	}
+	pw := NewPasswordInput("Password")
+	save := NewCheckbox("Save", "Remember me", false)
+	auth := NewRadioGroup("Auth", 0, "password", "key")
+	shell := NewSelectBox("Shell", 0, "bash", "zsh")
+	submitted := 0
+	f := NewForm("Login", NewLabel("Enter your credentials"), user, pw, save, auth, shell)
+	f.MaxWidth = 40
+	f.Validator = func(*Form) error {
+		if len(pw.Value) < 3 {
+			return fmt.Errorf("The password is too short")
+		}
+		return nil
+	}
+	f.OnSubmit = func(*Form) { submitted++ }
+
+	key := func(k string) bool { return f.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: k}) }
+	text := func(t string) bool { return f.OnText(t) }
+	check := func(expected ...string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, utils.Map(unmark, f.Lines(80, marked))); diff != "" {
+			t.Fatalf("Unexpected form rendering:\n%s", diff)
+		}
+	}
+
+	if f.Focus() != 1 {
+		t.Fatalf("The label was focused")
+	}
+	key("ENTER")
+	if f.IsClosed() || f.Error() == nil || f.Focus() != 1 {
+		t.Fatalf("An invalid form was submitted")
+	}
+	check(
+		"╭─ Login ──────────────────────────────╮",
+		"│ Enter your credentials               │",
+		"│ User:     * *                          │",
+		"│           A user name is required    │",
+		"│ Password:                            │",
+		"│ Save:     [ ] Remember me            │",
+		"│ Auth:     (•) password               │",
+		"│           ( ) key                    │",
+		"│ Shell:    ◀ bash ▶                   │",
+		"│                                      │",
+		"│          [ OK ]  [ Cancel ]          │",
+		"╰──────────────────────────────────────╯",
+	)
+	text("kovid")
+	key("LEFT")
+	if f.Error() != nil || user.Value != "kovid" {
+		t.Fatalf("Fixing the invalid field did not clear the error")
+	}
+	key("TAB")
+	text("ab")
+	key("TAB")
+	text(" ")
+	key("DOWN")
+	key("DOWN")
+	key("DOWN")
+	key("RIGHT")
+	check(
+		"╭─ Login ──────────────────────────────╮",
+		"│ Enter your credentials               │",
+		"│ User:     kovid                      │",
+		"│ Password: **                         │",
+		"│ Save:     [x] Remember me            │",
+		"│ Auth:     ( ) password               │",
+		"│           (•) key                    │",
+		"│ Shell:    *◀ zsh ▶*                    │",
+		"│                                      │",
+		"│          [ OK ]  [ Cancel ]          │",
+		"╰──────────────────────────────────────╯",
+	)
+	if !save.Checked || auth.Selected != 1 || shell.SelectedChoice() != "zsh" || f.Focus() != 5 {
+		t.Fatalf("Fields not updated by input: checked: %v auth: %d shell: %s focus: %d", save.Checked, auth.Selected, shell.SelectedChoice(), f.Focus())
+	}
+	f.TabOrder = []int{5, 2}
+	if key("TAB"); f.Focus() != 2 {
+		t.Fatalf("Tab order not respected: %d", f.Focus())
+	}
+	key("ENTER")
+	if f.IsClosed() || f.Error() == nil || f.Error().Error() != "The password is too short" {
+		t.Fatalf("Form validator not called: %v", f.Error())
+	}
+	text("c")
+	key("ENTER")
+	if !f.IsClosed() || !f.Submitted() || submitted != 1 || pw.Value != "abc" {
+		t.Fatalf("Valid form not submitted")
+	}
+
+	// mouse
+	canceled := false
+	f = NewForm("", NewCheckbox("A", "check me", false), NewRadioGroup("B", 0, "x", "y", "z"))
+	f.OnCancel = func() { canceled = true }
+	f.Lines(80, marked)
+	f.rect = Rect{Left: 3, Top: 2}
+	click := func(x, y int) bool {
+		ev := &loop.MouseEvent{Event_type: loop.MOUSE_CLICK}
+		ev.Cell.X, ev.Cell.Y = 3+x, 2+y
+		return f.OnMouseEvent(ev)
+	}
+	if !click(5, 1) || !f.Fields[0].(*Checkbox).Checked {
+		t.Fatalf("Clicking the checkbox did not check it")
+	}
+	if !click(6, 4) || f.Focus() != 1 || f.Fields[1].(*RadioGroup).Selected != 2 {
+		t.Fatalf("Clicking a radio button did not select it")
+	}
+	if click(6, 7) || !click(3, 2) || f.Fields[1].(*RadioGroup).Selected != 2 {
+		t.Fatalf("Clicking outside the radio buttons selected one")
+	}
+	if !click(40, 6) || !canceled || f.Submitted() {
+		t.Fatalf("Clicking cancel did not cancel the form")
+	}
+}
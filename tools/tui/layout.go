@@ -0,0 +1,187 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"math"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// A rectangular region of the screen in zero based cells
+type Rect struct {
+	Left, Top, Width, Height int
+}
+
+func (self Rect) Contains(x, y int) bool {
+	return x >= self.Left && x < self.Left+self.Width && y >= self.Top && y < self.Top+self.Height
+}
+
+type Insets struct {
+	Top, Right, Bottom, Left int
+}
+
+type LayoutDirection uint8
+
+const (
+	// Children are placed left to right
+	LAYOUT_ROW LayoutDirection = iota
+	// Children are placed top to bottom
+	LAYOUT_COLUMN
+)
+
+// A node in a tree of layouts, similar to CSS flexbox. Every node is assigned
+// a rectangle by Compute(), its children divide that rectangle, minus
+// padding, between themselves along the main axis, as determined by
+// Direction, and fill it completely along the cross axis. Sizes along the main
+// axis start at Basis and are then grown or shrunk to fill the available
+// space in proportion to Grow and Shrink, respecting MinSize and MaxSize.
+type Layout struct {
+	Direction LayoutDirection
+	// Sizes along the main axis of the parent. A MaxSize of zero means unlimited.
+	Basis, MinSize, MaxSize int
+	// Weights for distributing extra or missing space among siblings. Shrink
+	// is scaled by Basis, as in CSS, so that larger items shrink more.
+	Grow, Shrink float64
+	// Space between adjacent children
+	Gap     int
+	Padding Insets
+	// Hidden nodes are assigned an empty rectangle and take up no space
+	Hidden   bool
+	Children []*Layout
+	// Called whenever a rectangle is assigned to this node, before its children are laid out
+	OnLayout func(r Rect)
+
+	rect Rect
+}
+
+func NewRow(children ...*Layout) *Layout {
+	return &Layout{Direction: LAYOUT_ROW, Children: children}
+}
+
+func NewColumn(children ...*Layout) *Layout {
+	return &Layout{Direction: LAYOUT_COLUMN, Children: children}
+}
+
+// The rectangle assigned to this node by the last call to Compute()
+func (self *Layout) Rect() Rect { return self.rect }
+
+func (self *Layout) clamp(sz int) int {
+	if self.MaxSize > 0 {
+		sz = utils.Min(sz, self.MaxSize)
+	}
+	return utils.Max(0, utils.Max(sz, self.MinSize))
+}
+
+// Split amount into integer parts proportional to weights, with the parts
+// summing exactly to amount
+func distribute(amount int, weights []float64) []int {
+	total := 0.
+	for _, w := range weights {
+		total += w
+	}
+	ans := make([]int, len(weights))
+	if total <= 0 {
+		return ans
+	}
+	cumulative, prev := 0., 0
+	for i, w := range weights {
+		cumulative += w
+		cur := int(math.Round(cumulative / total * float64(amount)))
+		ans[i] = cur - prev
+		prev = cur
+	}
+	return ans
+}
+
+// Compute the sizes of children along the main axis, given the available space
+func layout_main_axis(children []*Layout, available int) []int {
+	sizes := make([]int, len(children))
+	frozen := make([]bool, len(children))
+	for i, c := range children {
+		sizes[i] = c.clamp(c.Basis)
+	}
+	weights := make([]float64, len(children))
+	for {
+		free := available
+		for _, s := range sizes {
+			free -= s
+		}
+		if free == 0 {
+			break
+		}
+		for i, c := range children {
+			switch {
+			case frozen[i]:
+				weights[i] = 0
+			case free > 0:
+				weights[i] = c.Grow
+			default:
+				weights[i] = c.Shrink * float64(utils.Max(1, c.Basis))
+			}
+		}
+		deltas := distribute(free, weights)
+		froze_some := false
+		for i, c := range children {
+			if weights[i] == 0 {
+				frozen[i] = true
+				continue
+			}
+			sz := c.clamp(sizes[i] + deltas[i])
+			if sz != sizes[i]+deltas[i] {
+				frozen[i], froze_some = true, true
+			}
+			sizes[i] = sz
+		}
+		if !froze_some {
+			break
+		}
+	}
+	return sizes
+}
+
+// Assign the rectangle r to this node and lay out its children inside it.
+// Typically called with the screen size on startup and whenever the screen
+// is resized. Children that do not fit are clipped to r.
+func (self *Layout) Compute(r Rect) {
+	r.Width, r.Height = utils.Max(0, r.Width), utils.Max(0, r.Height)
+	self.rect = r
+	if self.OnLayout != nil {
+		self.OnLayout(r)
+	}
+	visible := utils.Filter(self.Children, func(c *Layout) bool { return !c.Hidden })
+	for _, c := range self.Children {
+		if c.Hidden {
+			c.Compute(Rect{Left: r.Left, Top: r.Top})
+		}
+	}
+	if len(visible) == 0 {
+		return
+	}
+	inner := Rect{Left: r.Left + self.Padding.Left, Top: r.Top + self.Padding.Top}
+	inner.Width = utils.Max(0, r.Width-self.Padding.Left-self.Padding.Right)
+	inner.Height = utils.Max(0, r.Height-self.Padding.Top-self.Padding.Bottom)
+	main_size := inner.Width
+	if self.Direction == LAYOUT_COLUMN {
+		main_size = inner.Height
+	}
+	available := utils.Max(0, main_size-self.Gap*(len(visible)-1))
+	pos := 0
+	for i, sz := range layout_main_axis(visible, available) {
+		// clip to the inner rectangle
+		sz = utils.Max(0, utils.Min(sz, main_size-pos))
+		cr := inner
+		if self.Direction == LAYOUT_COLUMN {
+			cr.Top += pos
+			cr.Height = sz
+		} else {
+			cr.Left += pos
+			cr.Width = sz
+		}
+		visible[i].Compute(cr)
+		pos = utils.Min(main_size, pos+sz+self.Gap)
+	}
+}
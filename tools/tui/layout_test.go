@@ -0,0 +1,48 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestLayout(t *testing.T) {
+	header := &Layout{Basis: 1}
+	sidebar := &Layout{Basis: 20, MinSize: 12, Shrink: 1}
+	main := &Layout{Grow: 2, Shrink: 1, Basis: 30}
+	preview := &Layout{Grow: 1, MaxSize: 8}
+	status := &Layout{Basis: 1}
+	var status_rect Rect
+	status.OnLayout = func(r Rect) { status_rect = r }
+	body := NewRow(sidebar, main, preview)
+	body.Grow, body.Gap = 1, 1
+	root := NewColumn(header, body, status)
+	root.Padding = Insets{Left: 1, Right: 1}
+
+	check := func(width, height int, expected ...Rect) {
+		t.Helper()
+		root.Compute(Rect{Width: width, Height: height})
+		actual := []Rect{header.Rect(), body.Rect(), sidebar.Rect(), main.Rect(), preview.Rect(), status.Rect()}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Unexpected layout for %dx%d:\n%s", width, height, diff)
+		}
+		if status_rect != status.Rect() {
+			t.Fatalf("OnLayout not called with the correct rect: %v", status_rect)
+		}
+	}
+
+	// extra space is shared 2:1 with preview capped at 8 and the rest going to main
+	check(80, 24,
+		Rect{1, 0, 78, 1}, Rect{1, 1, 78, 22}, Rect{1, 1, 20, 22}, Rect{22, 1, 48, 22}, Rect{71, 1, 8, 22}, Rect{1, 23, 78, 1})
+	// missing space is taken in proportion to the basis, until sidebar hits its minimum
+	check(32, 10,
+		Rect{1, 0, 30, 1}, Rect{1, 1, 30, 8}, Rect{1, 1, 12, 8}, Rect{14, 1, 16, 8}, Rect{31, 1, 0, 8}, Rect{1, 9, 30, 1})
+	sidebar.Hidden = true
+	check(32, 2,
+		Rect{1, 0, 30, 1}, Rect{1, 1, 30, 0}, Rect{1, 1, 0, 0}, Rect{1, 1, 29, 0}, Rect{31, 1, 0, 0}, Rect{1, 1, 30, 1})
+}
@@ -0,0 +1,448 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/tui/subseq"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+type list_match struct {
+	idx       int
+	positions []int
+}
+
+// Renders the item at idx into exactly width cells. positions are the byte
+// offsets of the characters in text that matched the current query.
+type ListItemRenderer func(idx int, text string, positions []int, width int, is_current, is_selected bool, sprint_styled func(style string, args ...any) string) string
+
+// A vertical list of items, drawn in a rectangular region of the screen,
+// that can be filtered with a fuzzy query, scrolled and navigated with the
+// keyboard or mouse and optionally have multiple items selected. Only the
+// visible items are rendered, and when there is no query, drawing, scrolling
+// and navigating take time proportional to the height of the list, not the
+// number of items, so lists with millions of items can be displayed using
+// SetItemSource().
+type List struct {
+	// Allow selecting multiple items with the tab key or ctrl+click
+	MultiSelect bool
+	// Styles, in the format used by loop.SprintStyled
+	CurrentItemStyle, SelectedItemStyle, MatchStyle string
+	// Used to draw items, when nil items are drawn with the characters matching the query highlighted
+	RenderItem ListItemRenderer
+	// Options for matching items against the query
+	MatchOptions subseq.Options
+	// Called when the current item changes or the enter key is pressed on an item. Indices are into the items passed to SetItems
+	OnCurrentItemChanged, OnActivate func(idx int)
+
+	items       []string
+	item_source func(idx int) string
+	num_items   int
+	query       string
+	// nil when there is no query, in which case all items match in order
+	matches                []list_match
+	selected               map[int]bool
+	current, scroll_offset int
+	x, y, width, height    int
+	announcer              Announcer
+}
+
+func NewList() *List {
+	theme := CurrentTheme()
+	return &List{CurrentItemStyle: theme.Selection, SelectedItemStyle: theme.Success, MatchStyle: theme.Highlight, selected: make(map[int]bool)}
+}
+
+// Set the region of the screen, in zero based cells, the list is drawn into
+func (self *List) SetGeometry(x, y, width, height int) {
+	self.x, self.y, self.width, self.height = x, y, width, height
+	self.ensure_current_visible()
+}
+
+func (self *List) SetItems(items []string) {
+	self.items = items
+	self.set_source(len(items), func(idx int) string { return self.items[idx] })
+}
+
+// Display count items, calling item to get the text of an item only when it
+// is needed, typically when it becomes visible. Use this instead of
+// SetItems() for very large numbers of items.
+func (self *List) SetItemSource(count int, item func(idx int) string) {
+	self.items = nil
+	self.set_source(count, item)
+}
+
+func (self *List) set_source(count int, item func(idx int) string) {
+	self.item_source, self.num_items = item, count
+	self.selected = make(map[int]bool)
+	self.matches = nil
+	q := self.query
+	self.query = ""
+	self.filter(q, nil)
+}
+
+// The items passed to SetItems, nil if the items were set with SetItemSource()
+func (self *List) Items() []string { return self.items }
+
+func (self *List) NumItems() int { return self.num_items }
+
+// The text of the item at idx
+func (self *List) Item(idx int) string { return self.item_source(idx) }
+
+func (self *List) Query() string { return self.query }
+
+// Filter the list to only show items matching query, sorted by how well they
+// match. Returns true if the query changed.
+func (self *List) SetQuery(query string) bool {
+	if query == self.query {
+		return false
+	}
+	var candidates []list_match
+	// an item that does not match a query cannot match any extension of it
+	// so when the user is typing only the current matches need to be scored
+	if self.query != "" && strings.HasPrefix(query, self.query) {
+		candidates = self.matches
+	}
+	self.filter(query, candidates)
+	return true
+}
+
+func (self *List) filter(query string, candidates []list_match) {
+	current := self.CurrentItem()
+	self.query = query
+	if query == "" {
+		self.matches = nil
+	} else {
+		if candidates == nil {
+			candidates = make([]list_match, self.num_items)
+			for i := range candidates {
+				candidates[i].idx = i
+			}
+		}
+		texts := utils.Map(func(m list_match) string { return self.item_source(m.idx) }, candidates)
+		scores := make([]float64, self.num_items)
+		matches := make([]list_match, 0, len(candidates))
+		for i, m := range subseq.ScoreItems(query, texts, self.MatchOptions) {
+			if m.Score > 0 {
+				idx := candidates[i].idx
+				scores[idx] = m.Score
+				matches = append(matches, list_match{idx: idx, positions: m.Positions})
+			}
+		}
+		self.matches = utils.StableSort(matches, func(a, b list_match) bool { return scores[a.idx] > scores[b.idx] })
+	}
+	self.current, self.scroll_offset = 0, 0
+	if current > -1 && query == "" {
+		// keep the previously current item current when the filter is removed
+		self.SetCurrentItem(current)
+	} else if self.OnCurrentItemChanged != nil && self.CurrentItem() != current && self.NumMatches() > 0 {
+		self.OnCurrentItemChanged(self.CurrentItem())
+	}
+}
+
+func (self *List) NumMatches() int {
+	if self.matches == nil {
+		return self.num_items
+	}
+	return len(self.matches)
+}
+
+func (self *List) match_at(i int) list_match {
+	if self.matches == nil {
+		return list_match{idx: i}
+	}
+	return self.matches[i]
+}
+
+// The indices, into the items passed to SetItems, of the items matching the current query in display order
+func (self *List) Matches() []int {
+	ans := make([]int, self.NumMatches())
+	for i := range ans {
+		ans[i] = self.match_at(i).idx
+	}
+	return ans
+}
+
+// The index, into the items passed to SetItems, of the current item or -1 if no items match
+func (self *List) CurrentItem() int {
+	if self.current >= self.NumMatches() {
+		return -1
+	}
+	return self.match_at(self.current).idx
+}
+
+func (self *List) SetCurrentItem(idx int) bool {
+	if self.matches == nil {
+		if idx > -1 && idx < self.num_items {
+			self.set_current(idx)
+			return true
+		}
+		return false
+	}
+	for i, m := range self.matches {
+		if m.idx == idx {
+			self.set_current(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (self *List) IsSelected(idx int) bool { return self.selected[idx] }
+
+func (self *List) SetSelected(idx int, selected bool) {
+	if selected {
+		self.selected[idx] = true
+	} else {
+		delete(self.selected, idx)
+	}
+}
+
+func (self *List) ToggleSelection(idx int) { self.SetSelected(idx, !self.selected[idx]) }
+
+// The selected items, in the order they were passed to SetItems. When
+// MultiSelect is off, this is the current item.
+func (self *List) Selection() []int {
+	if !self.MultiSelect {
+		if c := self.CurrentItem(); c > -1 {
+			return []int{c}
+		}
+		return nil
+	}
+	ans := make([]int, 0, len(self.selected))
+	for i := range self.selected {
+		ans = append(ans, i)
+	}
+	return utils.Sort(ans, func(a, b int) bool { return a < b })
+}
+
+// Draw text into exactly width cells, truncating it if needed, with the
+// characters at the specified byte offsets in match_style. Useful for
+// implementing a ListItemRenderer.
+func HighlightPositions(text string, positions []int, width int, match_style string, sprint_styled func(style string, args ...any) string) string {
+	w := wcswidth.Stringwidth(text)
+	suffix := ""
+	if w > width {
+		text, w = wcswidth.TruncateToVisualLengthWithWidth(text, utils.Max(0, width-1))
+		suffix = style.TerminateHyperlink(text)[len(text):] + "…"
+		w++
+	}
+	if w < width {
+		suffix += strings.Repeat(" ", width-w)
+	}
+	if len(positions) == 0 || match_style == "" {
+		return text + suffix
+	}
+	buf := strings.Builder{}
+	buf.Grow(len(text) + len(suffix) + 32)
+	prev := 0
+	for _, p := range positions {
+		if p >= len(text) {
+			break
+		}
+		_, sz := utf8.DecodeRuneInString(text[p:])
+		buf.WriteString(text[prev:p])
+		buf.WriteString(sprint_styled(match_style, text[p:p+sz]))
+		prev = p + sz
+	}
+	buf.WriteString(text[prev:])
+	buf.WriteString(suffix)
+	return buf.String()
+}
+
+func (self *List) render_item(m list_match, width int, is_current bool, sprint_styled func(style string, args ...any) string) string {
+	is_selected := self.MultiSelect && self.selected[m.idx]
+	if self.RenderItem != nil {
+		return self.RenderItem(m.idx, self.item_source(m.idx), m.positions, width, is_current, is_selected, sprint_styled)
+	}
+	prefix := "  "
+	if is_selected {
+		prefix = sprint_styled(self.SelectedItemStyle, "● ")
+	}
+	if width <= 2 {
+		return fit_to_width("", width, false)
+	}
+	text := prefix + HighlightPositions(self.item_source(m.idx), m.positions, width-2, self.MatchStyle, sprint_styled)
+	if is_current {
+		text = sprint_styled(self.CurrentItemStyle, text)
+	}
+	return text
+}
+
+// The lines of text representing the visible items, each exactly as wide as
+// the list. Styles are applied using sprint_styled, typically loop.SprintStyled
+func (self *List) Lines(sprint_styled func(style string, args ...any) string) []string {
+	if self.height < 1 || self.width < 1 {
+		return nil
+	}
+	ans := make([]string, 0, self.height)
+	for i := self.scroll_offset; i < self.NumMatches() && len(ans) < self.height; i++ {
+		ans = append(ans, self.render_item(self.match_at(i), self.width, i == self.current, sprint_styled))
+	}
+	for len(ans) < self.height {
+		ans = append(ans, strings.Repeat(" ", self.width))
+	}
+	return ans
+}
+
+// A line of plain text describing the current item, its position and
+// whether it is selected. Used instead of Lines() in accessible mode.
+func (self *List) Announcement() string {
+	n := self.NumMatches()
+	switch {
+	case n == 0 && self.query != "":
+		return "No matches"
+	case n == 0:
+		return "Empty"
+	}
+	idx := self.CurrentItem()
+	ans := fmt.Sprintf("%d of %d: %s", self.current+1, n, self.item_source(idx))
+	if self.MultiSelect && self.selected[idx] {
+		ans += ", selected"
+	}
+	return ans
+}
+
+// Draw the visible items. In accessible mode, write the announcement if it
+// has changed since the list was last drawn instead.
+func (self *List) Draw(lp *loop.Loop) {
+	if AccessibleMode() {
+		self.announcer.WriteTo(lp, "current", self.Announcement())
+		return
+	}
+	for i, line := range self.Lines(lp.SprintStyled) {
+		lp.MoveCursorTo(self.x+1, self.y+i+1)
+		lp.QueueWriteString(line)
+	}
+}
+
+func (self *List) ensure_current_visible() {
+	if self.height < 1 {
+		return
+	}
+	if self.current < self.scroll_offset {
+		self.scroll_offset = self.current
+	} else if self.current >= self.scroll_offset+self.height {
+		self.scroll_offset = self.current - self.height + 1
+	}
+	self.scroll_offset = utils.Max(0, utils.Min(self.scroll_offset, self.NumMatches()-self.height))
+}
+
+func (self *List) set_current(idx int) {
+	if self.NumMatches() == 0 {
+		return
+	}
+	idx = utils.Max(0, utils.Min(idx, self.NumMatches()-1))
+	changed := idx != self.current
+	self.current = idx
+	self.ensure_current_visible()
+	if changed && self.OnCurrentItemChanged != nil {
+		self.OnCurrentItemChanged(self.match_at(idx).idx)
+	}
+}
+
+// Move the current item by delta items in display order. At the ends of the
+// list, wrap around if wrap is true, otherwise stop. Returns false if the
+// current item did not change.
+func (self *List) MoveCurrent(delta int, wrap bool) bool {
+	n := self.NumMatches()
+	if n == 0 {
+		return false
+	}
+	idx := self.current + delta
+	if wrap {
+		idx = ((idx % n) + n) % n
+	}
+	prev := self.current
+	self.set_current(idx)
+	return self.current != prev
+}
+
+func (self *List) Scroll(amt int) {
+	self.scroll_offset = utils.Max(0, utils.Min(self.scroll_offset+amt, self.NumMatches()-self.height))
+	if self.current < self.scroll_offset {
+		self.set_current(self.scroll_offset)
+	} else if self.current >= self.scroll_offset+self.height {
+		self.set_current(self.scroll_offset + self.height - 1)
+	}
+}
+
+// Add text typed by the user to the query
+func (self *List) OnText(text string) bool {
+	return self.SetQuery(self.query + text)
+}
+
+// Handle navigation, selection and query editing keys, returns true if the
+// event was handled, in which case the list should be redrawn
+func (self *List) OnKeyEvent(ev *loop.KeyEvent) bool {
+	page := utils.Max(1, self.height-1)
+	switch {
+	case ev.MatchesPressOrRepeat("up") || ev.MatchesPressOrRepeat("ctrl+k"):
+		self.set_current(self.current - 1)
+	case ev.MatchesPressOrRepeat("down") || ev.MatchesPressOrRepeat("ctrl+j"):
+		self.set_current(self.current + 1)
+	case ev.MatchesPressOrRepeat("page_up"):
+		self.set_current(self.current - page)
+	case ev.MatchesPressOrRepeat("page_down"):
+		self.set_current(self.current + page)
+	case ev.MatchesPressOrRepeat("home"):
+		self.set_current(0)
+	case ev.MatchesPressOrRepeat("end"):
+		self.set_current(self.NumMatches() - 1)
+	case ev.MatchesPressOrRepeat("tab") && self.MultiSelect:
+		if c := self.CurrentItem(); c > -1 {
+			self.ToggleSelection(c)
+			self.set_current(self.current + 1)
+		}
+	case ev.MatchesPressOrRepeat("backspace") && self.query != "":
+		runes := []rune(self.query)
+		self.SetQuery(string(runes[:len(runes)-1]))
+	case ev.MatchesPressOrRepeat("enter"):
+		if c := self.CurrentItem(); c > -1 && self.OnActivate != nil {
+			self.OnActivate(c)
+		}
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+// Handle clicks on items to make them current, ctrl+clicks to select them
+// and the mouse wheel to scroll. Returns true if the event was handled, in
+// which case the list should be redrawn
+func (self *List) OnMouseEvent(ev *loop.MouseEvent) bool {
+	if ev.Cell.X < self.x || ev.Cell.X >= self.x+self.width || ev.Cell.Y < self.y || ev.Cell.Y >= self.y+self.height {
+		return false
+	}
+	switch ev.Event_type {
+	case loop.MOUSE_PRESS:
+		if ev.Buttons&(loop.MOUSE_WHEEL_UP|loop.MOUSE_WHEEL_DOWN) != 0 {
+			amt := 3
+			if ev.Buttons&loop.MOUSE_WHEEL_UP != 0 {
+				amt = -amt
+			}
+			self.Scroll(amt)
+			return true
+		}
+	case loop.MOUSE_CLICK:
+		idx := self.scroll_offset + ev.Cell.Y - self.y
+		if idx >= self.NumMatches() {
+			return false
+		}
+		if self.MultiSelect && ev.Mods&loop.CTRL != 0 {
+			self.ToggleSelection(self.match_at(idx).idx)
+		}
+		self.set_current(idx)
+		return true
+	}
+	return false
+}
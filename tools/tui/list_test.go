@@ -0,0 +1,92 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"testing"
+
+	"kitty/tools/tui/loop"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestList(t *testing.T) {
+	SetCurrentTheme(DefaultTheme())
+	marked := func(style string, args ...any) string {
+		if style == "fg=yellow" {
+			return "[" + fmt.Sprint(args...) + "]"
+		}
+		return fmt.Sprint(args...)
+	}
+	l := NewList()
+	l.MultiSelect = true
+	l.SetItems([]string{"alpha", "beta", "gamma", "delta", "epsilon"})
+	l.SetGeometry(0, 0, 8, 3)
+	if diff := cmp.Diff([]string{"  alpha ", "  beta  ", "  gamma "}, l.Lines(marked)); diff != "" {
+		t.Fatalf("Unexpected lines:\n%s", diff)
+	}
+
+	l.OnText("e")
+	if diff := cmp.Diff([]int{4, 1, 3}, l.Matches()); diff != "" {
+		t.Fatalf("Unexpected matches for e:\n%s", diff)
+	}
+	l.OnText("l")
+	if diff := cmp.Diff([]int{3, 4}, l.Matches()); diff != "" {
+		t.Fatalf("Unexpected matches for el:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"  d[e][l]ta ", "  [e]psi[l]…", "        "}, l.Lines(marked)); diff != "" {
+		t.Fatalf("Unexpected highlighting:\n%s", diff)
+	}
+
+	l.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "TAB"})
+	if l.CurrentItem() != 4 {
+		t.Fatalf("tab did not move to the next item: %d", l.CurrentItem())
+	}
+	l.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "BACKSPACE"})
+	l.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "BACKSPACE"})
+	if l.Query() != "" || l.NumMatches() != 5 || l.CurrentItem() != 4 {
+		t.Fatalf("Clearing the query failed: %#v %d %d", l.Query(), l.NumMatches(), l.CurrentItem())
+	}
+	if diff := cmp.Diff([]string{"  gamma ", "● delta ", "  epsil…"}, l.Lines(marked)); diff != "" {
+		t.Fatalf("Current item not visible:\n%s", diff)
+	}
+	l.OnMouseEvent(&loop.MouseEvent{Event_type: loop.MOUSE_CLICK, Mods: loop.CTRL, Cell: struct{ X, Y int }{1, 0}})
+	if diff := cmp.Diff([]int{2, 3}, l.Selection()); diff != "" {
+		t.Fatalf("Unexpected selection:\n%s", diff)
+	}
+	l.SetCurrentItem(4)
+	if l.MoveCurrent(1, false) || l.CurrentItem() != 4 {
+		t.Fatalf("Moved past the end of the list: %d", l.CurrentItem())
+	}
+	if !l.MoveCurrent(1, true) || l.CurrentItem() != 0 {
+		t.Fatalf("Did not wrap to the start of the list: %d", l.CurrentItem())
+	}
+	if !l.MoveCurrent(-2, true) || l.CurrentItem() != 3 {
+		t.Fatalf("Did not wrap to the end of the list: %d", l.CurrentItem())
+	}
+	if !l.MoveCurrent(-10, false) || l.CurrentItem() != 0 {
+		t.Fatalf("Did not stop at the start of the list: %d", l.CurrentItem())
+	}
+}
+
+func TestListItemSource(t *testing.T) {
+	unstyled := func(style string, args ...any) string { return fmt.Sprint(args...) }
+	calls := 0
+	l := NewList()
+	l.SetItemSource(1000000, func(idx int) string { calls++; return fmt.Sprint("item ", idx) })
+	l.SetGeometry(0, 0, 13, 2)
+	l.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "END"})
+	if diff := cmp.Diff([]string{"  item 999998", "  item 999999"}, l.Lines(unstyled)); diff != "" {
+		t.Fatalf("Unexpected lines:\n%s", diff)
+	}
+	if !l.SetCurrentItem(500000) || l.CurrentItem() != 500000 || calls != 2 {
+		t.Fatalf("Items other than the visible ones were rendered: %d", calls)
+	}
+	l.SetQuery("")
+	if l.NumMatches() != 1000000 {
+		t.Fatalf("Unexpected number of matches after clearing query: %d", l.NumMatches())
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 
 	"kitty/tools/tty"
@@ -47,11 +48,20 @@ type Loop struct {
 	timers, timers_temp                    []*timer
 	timer_id_counter, write_msg_id_counter IdType
 	wakeup_channel                         chan byte
+	task_wakeup_channel                    chan byte
+	tasks                                  map[IdType]*Task
+	task_id_counter                        IdType
+	clipboard_size_limit                   int
+	pending_clipboard_requests             []*clipboard_request
 	pending_writes                         []*write_msg
 	pending_mouse_events                   *utils.RingBuffer[MouseEvent]
+	mouse_regions                          mouse_regions
 	on_SIGTSTP                             func() error
 	style_cache                            map[string]func(...any) string
 	style_ctx                              style.Context
+	hyperlink_ids                          *style.HyperlinkIds
+	color_scheme                           ColorScheme
+	pressed_keys                           []string
 	atomic_update_active                   bool
 
 	// Suspend the loop restoring terminal state, and run the provided function. When it returns terminal state is
@@ -99,6 +109,13 @@ type Loop struct {
 	// Called when main loop is woken up
 	OnWakeup func() error
 
+	// Called when the terminal reports that its color scheme has changed
+	// between dark and light, for example, because the OS switched
+	// appearance. Setting this makes the loop ask the terminal for such
+	// reports, and for the current color scheme on startup and when resuming
+	// from being stopped.
+	OnColorSchemeChange func(scheme ColorScheme) error
+
 	// Called on SIGINT return true if you wish to handle it yourself
 	OnSIGINT func() (bool, error)
 
@@ -153,6 +170,26 @@ func FullKeyboardProtocol(self *Loop) {
 	self.terminal_options.kitty_keyboard_mode = FULL_KEYBOARD_PROTOCOL
 }
 
+// Have the terminal report key release and repeat events in addition to
+// presses, see KeyEvent.Type. Needed for chorded shortcuts, games, etc.
+// Key events from the terminal then also update PressedKeys().
+func (self *Loop) ReportKeyEventTypes() *Loop {
+	self.terminal_options.kitty_keyboard_mode |= REPORT_KEY_EVENT_TYPES
+	return self
+}
+
+func ReportKeyEventTypes(self *Loop) {
+	self.terminal_options.kitty_keyboard_mode |= REPORT_KEY_EVENT_TYPES
+}
+
+// Set the flags of the kitty keyboard protocol to use, for example, to
+// turn off REPORT_TEXT_WITH_KEYS or REPORT_ALTERNATE_KEYS
+func KeyboardProtocolFlags(flags KeyboardStateBits) func(self *Loop) {
+	return func(self *Loop) {
+		self.terminal_options.kitty_keyboard_mode = flags
+	}
+}
+
 func (self *Loop) MouseTrackingMode(mt MouseTracking) *Loop {
 	self.terminal_options.mouse_tracking = mt
 	return self
@@ -215,6 +252,53 @@ func (self *Loop) SprintStyled(style string, args ...any) string {
 	return f(args...)
 }
 
+// The color scheme last reported by the terminal, only known if
+// OnColorSchemeChange is set
+func (self *Loop) ColorScheme() ColorScheme { return self.color_scheme }
+
+// The names of the keys that are currently held down, in the order they were
+// pressed. Only tracked if ReportKeyEventTypes is used. Modifier keys are
+// included, as LEFT_SHIFT, RIGHT_CONTROL, etc. Keys released while the
+// terminal does not have keyboard focus might not be removed.
+func (self *Loop) PressedKeys() []string {
+	return slices.Clone(self.pressed_keys)
+}
+
+// Whether the specified key, for example: a or LEFT_CONTROL is held down.
+// Only tracked if ReportKeyEventTypes is used.
+func (self *Loop) IsKeyPressed(key string) bool {
+	return slices.Contains(self.pressed_keys, ParseShortcut(key).KeyName)
+}
+
+func (self *Loop) track_pressed_keys(ev *KeyEvent) {
+	if self.terminal_options.kitty_keyboard_mode&REPORT_KEY_EVENT_TYPES == 0 || ev.Key == "" {
+		return
+	}
+	idx := slices.Index(self.pressed_keys, ev.Key)
+	switch ev.Type {
+	case PRESS, REPEAT:
+		if idx < 0 {
+			self.pressed_keys = append(self.pressed_keys, ev.Key)
+		}
+	case RELEASE:
+		if idx > -1 {
+			self.pressed_keys = slices.Delete(self.pressed_keys, idx, idx+1)
+		}
+	}
+}
+
+// Make text a hyperlink to url, links to the same url get the same id so that
+// terminals highlight all the parts of a link that is split over several lines
+func (self *Loop) SprintHyperlink(url, text string) string {
+	if !self.style_ctx.AllowEscapeCodes || url == "" {
+		return text
+	}
+	if self.hyperlink_ids == nil {
+		self.hyperlink_ids = style.NewHyperlinkIds()
+	}
+	return style.Hyperlink(url, self.hyperlink_ids.For(url), text)
+}
+
 func (self *Loop) PrintStyled(style string, args ...any) {
 	self.QueueWriteString(self.SprintStyled(style, args...))
 }
@@ -435,16 +519,12 @@ func (self *Loop) SetDefaultColor(which DefaultColor, val style.RGBA) {
 	self.QueueWriteString(fmt.Sprintf("\033]%d;%s\033\\", int(which), val.AsRGBSharp()))
 }
 
-func (self *Loop) copy_text_to(text, dest string) {
-	self.QueueWriteString("\x1b]52;" + dest + ";")
-	self.QueueWriteString(base64.StdEncoding.EncodeToString(utils.UnsafeStringToBytes(text)))
-	self.QueueWriteString("\x1b\\")
-}
-
+// Copy text to the primary selection, ignoring the clipboard size limit
 func (self *Loop) CopyTextToPrimarySelection(text string) {
-	self.copy_text_to(text, "p")
+	self.write_clipboard(utils.UnsafeStringToBytes(text), PRIMARY_SELECTION)
 }
 
+// Copy text to the clipboard, ignoring the clipboard size limit
 func (self *Loop) CopyTextToClipboard(text string) {
-	self.copy_text_to(text, "c")
+	self.write_clipboard(utils.UnsafeStringToBytes(text), CLIPBOARD)
 }
@@ -0,0 +1,145 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+type Clipboard string
+
+const (
+	CLIPBOARD         Clipboard = "c"
+	PRIMARY_SELECTION Clipboard = "p"
+)
+
+// The default maximum amount of data, before encoding, that
+// CopyToClipboard() sends. Terminals ignore or truncate OSC 52 escape codes
+// larger than their own limits.
+const DefaultClipboardSizeLimit = 8 * 1024 * 1024
+
+// The size of the chunks in which base64 encoded clipboard data is written to
+// the terminal, so that large copies do not need one huge buffer
+const clipboard_chunk_size = 4096
+
+var ErrClipboardDataTooLarge = errors.New("The data is too large to copy to the clipboard")
+var ErrClipboardReadTimedOut = errors.New("Timed out waiting for the terminal to send the clipboard contents")
+
+type ClipboardCallback func(data []byte, err error) error
+
+type clipboard_request struct {
+	callback  ClipboardCallback
+	timer_id  IdType
+	timed_out bool
+}
+
+// Set the maximum amount of data CopyToClipboard() sends, zero means no limit
+func ClipboardSizeLimit(limit int) func(self *Loop) {
+	return func(self *Loop) {
+		self.clipboard_size_limit = limit
+	}
+}
+
+type clipboard_chunk_writer struct {
+	lp  *Loop
+	buf []byte
+}
+
+func (self *clipboard_chunk_writer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		self.buf = append(self.buf, b)
+		if len(self.buf) >= clipboard_chunk_size {
+			self.flush()
+		}
+	}
+	return len(p), nil
+}
+
+func (self *clipboard_chunk_writer) flush() {
+	if len(self.buf) > 0 {
+		self.lp.QueueWriteString(string(self.buf))
+		self.buf = self.buf[:0]
+	}
+}
+
+// Copy data to the specified clipboard using the OSC 52 escape code. The
+// base64 encoded data is written in chunks. Returns ErrClipboardDataTooLarge
+// without copying anything if data is larger than the limit set with
+// ClipboardSizeLimit().
+func (self *Loop) CopyToClipboard(data []byte, which Clipboard) error {
+	if self.clipboard_size_limit > 0 && len(data) > self.clipboard_size_limit {
+		return ErrClipboardDataTooLarge
+	}
+	self.write_clipboard(data, which)
+	return nil
+}
+
+func (self *Loop) write_clipboard(data []byte, which Clipboard) {
+	self.QueueWriteString("\x1b]52;" + string(which) + ";")
+	w := clipboard_chunk_writer{lp: self, buf: make([]byte, 0, clipboard_chunk_size)}
+	enc := base64.NewEncoder(base64.StdEncoding, &w)
+	enc.Write(data)
+	enc.Close()
+	w.flush()
+	self.QueueWriteString("\x1b\\")
+}
+
+// Ask the terminal for the contents of the specified clipboard. callback is
+// called with the contents once the terminal sends them. Terminals may ask
+// the user for permission to read the clipboard first, and send no data if
+// it is denied, so callback can receive empty data. If timeout is not zero
+// and the terminal does not respond in time, callback is called with
+// ErrClipboardReadTimedOut and a late response is ignored.
+func (self *Loop) RequestClipboard(which Clipboard, timeout time.Duration, callback ClipboardCallback) error {
+	r := &clipboard_request{callback: callback}
+	if timeout > 0 {
+		id, err := self.AddTimer(timeout, false, func(IdType) error {
+			r.timed_out = true
+			return r.callback(nil, ErrClipboardReadTimedOut)
+		})
+		if err != nil {
+			return err
+		}
+		r.timer_id = id
+	}
+	self.pending_clipboard_requests = append(self.pending_clipboard_requests, r)
+	self.QueueWriteString("\x1b]52;" + string(which) + ";?\x1b\\")
+	return nil
+}
+
+// Returns true if there are requests for the clipboard that the terminal has
+// not responded to
+func (self *Loop) HasPendingClipboardRequests() bool {
+	for _, r := range self.pending_clipboard_requests {
+		if !r.timed_out {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Loop) handle_clipboard_response(payload []byte) error {
+	// terminals respond to requests in the order they were made
+	r := self.pending_clipboard_requests[0]
+	self.pending_clipboard_requests = self.pending_clipboard_requests[1:]
+	if r.timed_out {
+		return nil
+	}
+	if r.timer_id != 0 {
+		self.RemoveTimer(r.timer_id)
+	}
+	_, encoded, _ := bytes.Cut(payload, utils.UnsafeStringToBytes(";"))
+	data, err := base64.StdEncoding.DecodeString(utils.UnsafeBytesToString(encoded))
+	if err != nil {
+		return r.callback(nil, fmt.Errorf("Invalid base64 encoded clipboard data from terminal with error: %w", err))
+	}
+	return r.callback(data, nil)
+}
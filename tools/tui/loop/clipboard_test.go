@@ -0,0 +1,72 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Print
+
+func TestClipboard(t *testing.T) {
+	lp := new_loop()
+	lp.timers = make([]*timer, 0)
+	written := func() string {
+		ans := strings.Builder{}
+		for _, w := range lp.pending_writes {
+			ans.WriteString(w.str)
+		}
+		lp.pending_writes = nil
+		return ans.String()
+	}
+	data := strings.Repeat("0123456789", 1000)
+	if err := lp.CopyToClipboard([]byte(data), PRIMARY_SELECTION); err != nil {
+		t.Fatal(err)
+	}
+	if len(lp.pending_writes) < 4 {
+		t.Fatalf("Clipboard data not written in chunks: %d", len(lp.pending_writes))
+	}
+	if q, expected := written(), "\x1b]52;p;"+base64.StdEncoding.EncodeToString([]byte(data))+"\x1b\\"; q != expected {
+		t.Fatalf("Unexpected escape code: %#v", q)
+	}
+	ClipboardSizeLimit(10)(lp)
+	if err := lp.CopyToClipboard([]byte(data), CLIPBOARD); err != ErrClipboardDataTooLarge || written() != "" {
+		t.Fatalf("Size limit not respected: %v", err)
+	}
+	// the text helpers copy everything, as they did before the limit existed
+	lp.CopyTextToClipboard(data)
+	if q, expected := written(), "\x1b]52;c;"+base64.StdEncoding.EncodeToString([]byte(data))+"\x1b\\"; q != expected {
+		t.Fatalf("Text not copied ignoring the size limit: %#v", q)
+	}
+
+	var responses []string
+	cb := func(data []byte, err error) error {
+		responses = append(responses, fmt.Sprintf("%s %v", data, err))
+		return nil
+	}
+	lp.RequestClipboard(CLIPBOARD, 0, cb)
+	lp.RequestClipboard(PRIMARY_SELECTION, time.Second, cb)
+	lp.RequestClipboard(CLIPBOARD, 0, cb)
+	if q := written(); q != "\x1b]52;c;?\x1b\\\x1b]52;p;?\x1b\\\x1b]52;c;?\x1b\\" {
+		t.Fatalf("Unexpected escape codes: %#v", q)
+	}
+	if !lp.HasPendingClipboardRequests() {
+		t.Fatalf("No pending clipboard requests")
+	}
+	lp.handle_osc([]byte("52;c;" + base64.StdEncoding.EncodeToString([]byte("hello"))))
+	lp.dispatch_timers(time.Now().Add(time.Hour))
+	// the late response to the request that timed out is ignored
+	lp.handle_osc([]byte("52;p;" + base64.StdEncoding.EncodeToString([]byte("late"))))
+	lp.handle_osc([]byte("52;c;"))
+	expected := []string{"hello <nil>", " " + ErrClipboardReadTimedOut.Error(), " <nil>"}
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected responses: %#v", responses)
+	}
+	if lp.HasPendingClipboardRequests() {
+		t.Fatalf("Clipboard requests still pending")
+	}
+}
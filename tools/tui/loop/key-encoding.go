@@ -98,13 +98,20 @@ func (self KeyModifiers) HasCapsLock() bool {
 }
 
 type KeyEvent struct {
-	Type         KeyEventType
-	Mods         KeyModifiers
-	Key          string
-	ShiftedKey   string
+	// RELEASE and REPEAT are only reported if ReportKeyEventTypes is used
+	Type KeyEventType
+	Mods KeyModifiers
+	// The name of the key without modifiers, for example: a or ENTER
+	Key string
+	// The key produced when shift is held, for example: A for a
+	ShiftedKey string
+	// The key at the same position in the standard PC-101 layout, set when
+	// the keyboard uses a different layout, useful for shortcuts that work
+	// in all layouts
 	AlternateKey string
-	Text         string
-	Handled      bool
+	// The text the key event generates, not sent by terminals for RELEASE events
+	Text    string
+	Handled bool
 
 	// The CSI string this key event was decoded from. Empty if not decoded from CSI.
 	CSI string
@@ -28,3 +28,52 @@ func TestKeyEventFromCSI(t *testing.T) {
 	test_text("121;;121u", "y", "")
 	test_text("121::122;;121u", "y", "z")
 }
+
+func TestKeyEventTypes(t *testing.T) {
+	for csi, expected := range map[string]string{
+		"97;1:2u":          "REPEAT{ a }",
+		"97;6:3u":          "RELEASE{ shift+ctrl+a }",
+		"1;1:3A":           "RELEASE{ UP }",
+		"3;5:2~":           "REPEAT{ ctrl+DELETE }",
+		"1089::99;1;1089u": "PRESS{ с Text: с AlternateKey: c }",
+	} {
+		if ev := KeyEventFromCSI(csi); ev == nil {
+			t.Fatalf("Failed to parse %#v", csi)
+		} else if diff := cmp.Diff(expected, ev.String()); diff != "" {
+			t.Fatalf("Unexpected key event from %#v:\n%s", csi, diff)
+		}
+	}
+
+	lp := new_loop()
+	var text []string
+	lp.OnText = func(t string, from_key_event, in_bracketed_paste bool) error {
+		text = append(text, t)
+		return nil
+	}
+	send := func(csis ...string) {
+		for _, csi := range csis {
+			if err := lp.handle_csi([]byte(csi)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send("97;1;97u")
+	if len(lp.PressedKeys()) != 0 {
+		t.Fatalf("Pressed keys tracked without ReportKeyEventTypes: %v", lp.PressedKeys())
+	}
+	ReportKeyEventTypes(lp)
+	send("57441;2u", "97;2;65u", "98;2;66u", "98;2:2;66u")
+	if diff := cmp.Diff([]string{"LEFT_SHIFT", "a", "b"}, lp.PressedKeys()); diff != "" {
+		t.Fatalf("Unexpected pressed keys:\n%s", diff)
+	}
+	if !lp.IsKeyPressed("left_shift") || !lp.IsKeyPressed("b") || lp.IsKeyPressed("c") {
+		t.Fatalf("IsKeyPressed() failed for: %v", lp.PressedKeys())
+	}
+	send("97;2:3;65u", "57441;1:3u")
+	if diff := cmp.Diff([]string{"b"}, lp.PressedKeys()); diff != "" {
+		t.Fatalf("Unexpected pressed keys after release:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"a", "A", "B", "B"}, text); diff != "" {
+		t.Fatalf("Unexpected text from key events:\n%s", diff)
+	}
+}
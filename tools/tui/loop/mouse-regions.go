@@ -0,0 +1,194 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"fmt"
+)
+
+var _ = fmt.Print
+
+// A callback for a mouse event in a region, x and y are the zero based cell
+// co-ordinates of the event relative to the top left corner of the region.
+type MouseRegionCallback func(ev *MouseEvent, x, y int) error
+
+// A rectangular region of the screen that receives mouse events. Events in a
+// region are delivered to its callbacks instead of to Loop.OnMouseEvent,
+// unless the region has no callback for that type of event.
+type MouseRegion struct {
+	// The rectangle covered by this region, in zero based cells
+	Left, Top, Width, Height int
+	// Regions with a higher Z are above regions with a lower Z. Among regions
+	// with the same Z, the one added last is on top.
+	Z int
+
+	OnPress, OnRelease, OnClick MouseRegionCallback
+	// Called when the mouse is moved with a button held down after a press in
+	// this region, even if the mouse leaves the region. Note that x and y can
+	// be negative or outside the region in this case. Needs
+	// BUTTONS_AND_DRAG_MOUSE_TRACKING or FULL_MOUSE_TRACKING.
+	OnDrag MouseRegionCallback
+	// Called when the mouse is moved with no buttons pressed inside this
+	// region. Needs FULL_MOUSE_TRACKING.
+	OnHover MouseRegionCallback
+	// Called when the mouse enters or leaves this region. Moving onto a region
+	// above this one counts as leaving it. Needs FULL_MOUSE_TRACKING.
+	OnEnter, OnLeave func(ev *MouseEvent) error
+	// Called for the mouse wheel. dx and dy are the number of steps scrolled,
+	// negative values being left and up.
+	OnScroll func(ev *MouseEvent, dx, dy int) error
+}
+
+func (self *MouseRegion) Contains(x, y int) bool {
+	return x >= self.Left && x < self.Left+self.Width && y >= self.Top && y < self.Top+self.Height
+}
+
+type mouse_region struct {
+	MouseRegion
+	id IdType
+}
+
+func (self *MouseRegion) same_geometry(other *MouseRegion) bool {
+	return self.Left == other.Left && self.Top == other.Top && self.Width == other.Width && self.Height == other.Height && self.Z == other.Z
+}
+
+type mouse_regions struct {
+	regions    []*mouse_region
+	id_counter IdType
+	// copies of the regions under the mouse and being dragged, these are
+	// tracked by geometry rather than id so that they survive the regions
+	// being re-created when redrawing
+	hovered, dragged *MouseRegion
+}
+
+func (self *mouse_regions) add(r MouseRegion) IdType {
+	self.id_counter++
+	self.regions = append(self.regions, &mouse_region{MouseRegion: r, id: self.id_counter})
+	return self.id_counter
+}
+
+func (self *mouse_regions) remove(id IdType) bool {
+	for i, r := range self.regions {
+		if r.id == id {
+			self.regions = append(self.regions[:i], self.regions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (self *mouse_regions) clear() {
+	self.regions = nil
+}
+
+func (self *mouse_regions) at(x, y int) (ans *mouse_region) {
+	for _, r := range self.regions {
+		if r.Contains(x, y) && (ans == nil || r.Z >= ans.Z) {
+			ans = r
+		}
+	}
+	return
+}
+
+func scroll_amounts(b MouseButtonFlag) (dx, dy int) {
+	if b&MOUSE_WHEEL_UP != 0 {
+		dy--
+	}
+	if b&MOUSE_WHEEL_DOWN != 0 {
+		dy++
+	}
+	if b&MOUSE_WHEEL_LEFT != 0 {
+		dx--
+	}
+	if b&MOUSE_WHEEL_RIGHT != 0 {
+		dx++
+	}
+	return
+}
+
+const wheel_buttons = MOUSE_WHEEL_UP | MOUSE_WHEEL_DOWN | MOUSE_WHEEL_LEFT | MOUSE_WHEEL_RIGHT
+
+// Deliver ev to the region it belongs to, returning true if some region
+// callback handled it. Callbacks are called on copies of the regions, so
+// they are free to add and remove regions.
+func (self *mouse_regions) dispatch(ev *MouseEvent) (handled bool, err error) {
+	x, y := ev.Cell.X, ev.Cell.Y
+	var target *MouseRegion
+	if r := self.at(x, y); r != nil {
+		q := r.MouseRegion
+		target = &q
+	}
+	call := func(r *MouseRegion, cb MouseRegionCallback) error {
+		handled = true
+		return cb(ev, x-r.Left, y-r.Top)
+	}
+
+	hover_changed := (target == nil) != (self.hovered == nil) || (target != nil && !target.same_geometry(self.hovered))
+	if hover_changed && ev.Event_type != MOUSE_CLICK {
+		old := self.hovered
+		self.hovered = target
+		if old != nil && old.OnLeave != nil {
+			if err = old.OnLeave(ev); err != nil {
+				return
+			}
+		}
+		if target != nil && target.OnEnter != nil {
+			if err = target.OnEnter(ev); err != nil {
+				return
+			}
+		}
+	}
+
+	switch ev.Event_type {
+	case MOUSE_PRESS:
+		if ev.Buttons&wheel_buttons != 0 {
+			if target != nil && target.OnScroll != nil {
+				dx, dy := scroll_amounts(ev.Buttons)
+				handled = true
+				err = target.OnScroll(ev, dx, dy)
+			}
+			return
+		}
+		self.dragged = target
+		if target != nil && target.OnPress != nil {
+			err = call(target, target.OnPress)
+		}
+	case MOUSE_MOVE:
+		if ev.Buttons != NO_MOUSE_BUTTON {
+			if self.dragged != nil && self.dragged.OnDrag != nil {
+				err = call(self.dragged, self.dragged.OnDrag)
+			}
+		} else if target != nil && target.OnHover != nil {
+			err = call(target, target.OnHover)
+		}
+	case MOUSE_RELEASE:
+		r := self.dragged
+		self.dragged = nil
+		if r == nil {
+			r = target
+		}
+		if r != nil && r.OnRelease != nil {
+			err = call(r, r.OnRelease)
+		}
+	case MOUSE_CLICK:
+		if target != nil && target.OnClick != nil {
+			err = call(target, target.OnClick)
+		}
+	}
+	return
+}
+
+// Add a region of the screen that receives mouse events. Returns an id that
+// can be used to remove the region. Typically regions are re-created every
+// time the screen is drawn, using ClearMouseRegions().
+func (self *Loop) AddMouseRegion(r MouseRegion) IdType {
+	return self.mouse_regions.add(r)
+}
+
+func (self *Loop) RemoveMouseRegion(id IdType) bool {
+	return self.mouse_regions.remove(id)
+}
+
+func (self *Loop) ClearMouseRegions() {
+	self.mouse_regions.clear()
+}
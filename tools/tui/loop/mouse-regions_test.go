@@ -0,0 +1,85 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"fmt"
+	"testing"
+
+	"kitty/tools/utils"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestMouseRegions(t *testing.T) {
+	lp := new_loop()
+	lp.pending_mouse_events = utils.NewRingBuffer[MouseEvent](4)
+	var log []string
+	record := func(name string) MouseRegionCallback {
+		return func(ev *MouseEvent, x, y int) error {
+			log = append(log, fmt.Sprintf("%s:%d,%d", name, x, y))
+			return nil
+		}
+	}
+	lp.OnMouseEvent = func(ev *MouseEvent) error {
+		log = append(log, "unhandled:"+ev.Event_type.String())
+		return nil
+	}
+	lp.AddMouseRegion(MouseRegion{
+		Left: 0, Top: 0, Width: 10, Height: 5,
+		OnClick: record("a-click"), OnDrag: record("a-drag"), OnRelease: record("a-release"),
+		OnEnter: func(*MouseEvent) error { log = append(log, "a-enter"); return nil },
+		OnLeave: func(*MouseEvent) error { log = append(log, "a-leave"); return nil },
+		OnScroll: func(ev *MouseEvent, dx, dy int) error {
+			log = append(log, fmt.Sprintf("a-scroll:%d,%d", dx, dy))
+			return nil
+		},
+	})
+	b := lp.AddMouseRegion(MouseRegion{Left: 5, Top: 2, Width: 3, Height: 3, OnClick: record("b-click"), OnHover: record("b-hover")})
+	lp.AddMouseRegion(MouseRegion{Left: 6, Top: 2, Width: 3, Height: 3, Z: -1, OnClick: record("c-click")})
+
+	send := func(et MouseEventType, buttons MouseButtonFlag, x, y int) {
+		ev := MouseEvent{Event_type: et, Buttons: buttons}
+		ev.Cell.X, ev.Cell.Y = x, y
+		if err := lp.handle_mouse_event(&ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(expected ...string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, log); diff != "" {
+			t.Fatalf("Unexpected mouse region events:\n%s", diff)
+		}
+		log = nil
+	}
+
+	send(MOUSE_MOVE, NO_MOUSE_BUTTON, 1, 1)
+	check("a-enter", "unhandled:move")
+	send(MOUSE_MOVE, NO_MOUSE_BUTTON, 6, 3)
+	check("a-leave", "b-hover:1,1")
+	send(MOUSE_PRESS, LEFT_MOUSE_BUTTON, 6, 3)
+	send(MOUSE_RELEASE, LEFT_MOUSE_BUTTON, 6, 3)
+	check("unhandled:press", "unhandled:release", "b-click:1,1")
+	send(MOUSE_MOVE, NO_MOUSE_BUTTON, 20, 20)
+	check("unhandled:move")
+
+	send(MOUSE_PRESS, LEFT_MOUSE_BUTTON, 2, 1)
+	check("a-enter", "unhandled:press")
+	send(MOUSE_MOVE, LEFT_MOUSE_BUTTON, 12, 8)
+	send(MOUSE_RELEASE, LEFT_MOUSE_BUTTON, 12, 8)
+	check("a-leave", "a-drag:12,8", "a-release:12,8")
+
+	send(MOUSE_PRESS, MOUSE_WHEEL_DOWN, 1, 1)
+	check("a-enter", "a-scroll:0,1")
+
+	lp.RemoveMouseRegion(b)
+	send(MOUSE_PRESS, LEFT_MOUSE_BUTTON, 6, 3)
+	send(MOUSE_RELEASE, LEFT_MOUSE_BUTTON, 6, 3)
+	check("unhandled:press", "a-release:6,3", "a-click:6,3")
+
+	lp.ClearMouseRegions()
+	send(MOUSE_PRESS, LEFT_MOUSE_BUTTON, 1, 1)
+	check("a-leave", "unhandled:press")
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -33,6 +34,8 @@ func new_loop() *Loop {
 	l.escape_code_parser.HandleRune = l.handle_rune
 	l.escape_code_parser.HandleEndOfBracketedPaste = l.handle_end_of_bracketed_paste
 	l.style_cache = make(map[string]func(...any) string)
+	l.task_wakeup_channel = make(chan byte, 1)
+	l.clipboard_size_limit = DefaultClipboardSizeLimit
 	l.style_ctx.AllowEscapeCodes = true
 	return &l
 }
@@ -64,8 +67,30 @@ func (self *Loop) update_screen_size() error {
 	return nil
 }
 
+func (self *Loop) handle_color_scheme_report(csi string) error {
+	var scheme ColorScheme
+	switch csi {
+	case "?997;1n":
+		scheme = DARK_COLOR_SCHEME
+	case "?997;2n":
+		scheme = LIGHT_COLOR_SCHEME
+	default:
+		return nil
+	}
+	if scheme != self.color_scheme {
+		self.color_scheme = scheme
+		if self.OnColorSchemeChange != nil {
+			return self.OnColorSchemeChange(scheme)
+		}
+	}
+	return nil
+}
+
 func (self *Loop) handle_csi(raw []byte) error {
 	csi := string(raw)
+	if strings.HasPrefix(csi, "?997;") {
+		return self.handle_color_scheme_report(csi)
+	}
 	ke := KeyEventFromCSI(csi)
 	if ke != nil {
 		return self.handle_key_event(ke)
@@ -93,26 +118,35 @@ func is_click(a, b *MouseEvent) bool {
 
 }
 
+func (self *Loop) dispatch_mouse_event(ev *MouseEvent) error {
+	handled, err := self.mouse_regions.dispatch(ev)
+	if err == nil && !handled && self.OnMouseEvent != nil {
+		err = self.OnMouseEvent(ev)
+	}
+	return err
+}
+
 func (self *Loop) handle_mouse_event(ev *MouseEvent) error {
-	if self.OnMouseEvent != nil {
-		err := self.OnMouseEvent(ev)
-		if err != nil {
-			return err
-		}
-		switch ev.Event_type {
-		case MOUSE_PRESS:
-			self.pending_mouse_events.WriteAllAndDiscardOld(*ev)
-		case MOUSE_RELEASE:
-			self.pending_mouse_events.WriteAllAndDiscardOld(*ev)
-			if self.pending_mouse_events.Len() > 1 {
-				events := self.pending_mouse_events.ReadAll()
-				if is_click(&events[len(events)-2], &events[len(events)-1]) {
-					e := events[len(events)-1]
-					e.Event_type = MOUSE_CLICK
-					err = self.OnMouseEvent(&e)
-					if err != nil {
-						return err
-					}
+	if self.OnMouseEvent == nil && len(self.mouse_regions.regions) == 0 {
+		return nil
+	}
+	err := self.dispatch_mouse_event(ev)
+	if err != nil {
+		return err
+	}
+	switch ev.Event_type {
+	case MOUSE_PRESS:
+		self.pending_mouse_events.WriteAllAndDiscardOld(*ev)
+	case MOUSE_RELEASE:
+		self.pending_mouse_events.WriteAllAndDiscardOld(*ev)
+		if self.pending_mouse_events.Len() > 1 {
+			events := self.pending_mouse_events.ReadAll()
+			if is_click(&events[len(events)-2], &events[len(events)-1]) {
+				e := events[len(events)-1]
+				e.Event_type = MOUSE_CLICK
+				err = self.dispatch_mouse_event(&e)
+				if err != nil {
+					return err
 				}
 			}
 		}
@@ -121,6 +155,7 @@ func (self *Loop) handle_mouse_event(ev *MouseEvent) error {
 }
 
 func (self *Loop) handle_key_event(ev *KeyEvent) error {
+	self.track_pressed_keys(ev)
 	if self.OnKeyEvent != nil {
 		err := self.OnKeyEvent(ev)
 		if err != nil {
@@ -132,19 +167,25 @@ func (self *Loop) handle_key_event(ev *KeyEvent) error {
 	}
 	if ev.MatchesPressOrRepeat("ctrl+c") {
 		ev.Handled = true
+		if self.CancelAllTasks() {
+			return nil
+		}
 		return self.on_SIGINT()
 	}
 	if ev.MatchesPressOrRepeat("ctrl+z") {
 		ev.Handled = true
 		return self.on_SIGTSTP()
 	}
-	if ev.Text != "" && self.OnText != nil {
+	if ev.Text != "" && ev.Type != RELEASE && self.OnText != nil {
 		return self.OnText(ev.Text, true, false)
 	}
 	return nil
 }
 
 func (self *Loop) handle_osc(raw []byte) error {
+	if len(self.pending_clipboard_requests) > 0 && bytes.HasPrefix(raw, utils.UnsafeStringToBytes("52;")) {
+		return self.handle_clipboard_response(raw[3:])
+	}
 	if self.OnEscapeCode != nil {
 		return self.OnEscapeCode(OSC, raw)
 	}
@@ -280,6 +321,7 @@ func (self *Loop) run() (err error) {
 	}
 
 	self.keep_going = true
+	defer self.CancelAllTasks()
 	self.pending_mouse_events = utils.NewRingBuffer[MouseEvent](4)
 	tty_write_channel := make(chan *write_msg, 1) // buffered so there is no race between initial queueing and startup of writer thread
 	write_done_channel := make(chan IdType)
@@ -317,6 +359,7 @@ func (self *Loop) run() (err error) {
 		return err
 	}
 
+	self.terminal_options.color_scheme_reporting = self.OnColorSchemeChange != nil
 	self.QueueWriteString(self.terminal_options.SetStateEscapeCodes())
 	needs_reset_escape_codes := true
 
@@ -435,6 +478,10 @@ func (self *Loop) run() (err error) {
 		}
 		select {
 		case <-timeout_chan:
+		case <-self.task_wakeup_channel:
+			if err = self.dispatch_task_events(); err != nil {
+				return err
+			}
 		case <-self.wakeup_channel:
 			for len(self.wakeup_channel) > 0 {
 				<-self.wakeup_channel
@@ -0,0 +1,154 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// The work done by a background task. It is run in its own goroutine and
+// should return promptly once the task is canceled, which it can check using
+// task.Canceled() or task.Context().
+type TaskFunction func(task *Task) (result any, err error)
+
+// A task running in a background goroutine, started with Loop.RunTask(). Its
+// progress and completion are delivered to its callbacks on the main thread.
+type Task struct {
+	Label string
+	// Called on the main thread after the task has reported progress. Reports
+	// made in quick succession are coalesced.
+	OnProgress func(task *Task) error
+	// Called on the main thread once the task function has returned
+	OnDone func(task *Task) error
+
+	id               IdType
+	ctx              context.Context
+	cancel           context.CancelFunc
+	started_at       time.Time
+	mutex            sync.Mutex
+	done, total      int64
+	progress_changed bool
+	finished         bool
+	result           any
+	err              error
+	wakeup           func()
+}
+
+func (self *Task) Id() IdType               { return self.id }
+func (self *Task) StartedAt() time.Time     { return self.started_at }
+func (self *Task) Context() context.Context { return self.ctx }
+
+// Request the task to stop, safe to call from any goroutine
+func (self *Task) Cancel() { self.cancel() }
+
+func (self *Task) Canceled() bool { return self.ctx.Err() != nil }
+
+// Report that done out of total units of work are complete, use a total of
+// zero if it is not known. Safe to call from any goroutine.
+func (self *Task) ReportProgress(done, total int64) {
+	self.mutex.Lock()
+	self.done, self.total, self.progress_changed = done, total, true
+	self.mutex.Unlock()
+	self.wakeup()
+}
+
+func (self *Task) Progress() (done, total int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.done, self.total
+}
+
+func (self *Task) IsFinished() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.finished
+}
+
+// The values returned by the task function, only valid once the task is finished
+func (self *Task) Result() (any, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.result, self.err
+}
+
+func (self *Loop) wakeup_for_tasks() {
+	select {
+	case self.task_wakeup_channel <- 1:
+	default:
+	}
+}
+
+// Run f in a background goroutine. on_done, if not nil, is called on the main
+// thread once f returns. Running tasks are canceled when the loop exits and
+// when the user presses ctrl+c, in which case the loop exits only if ctrl+c is
+// pressed again and all running tasks had already been canceled.
+func (self *Loop) RunTask(label string, f TaskFunction, on_done func(task *Task) error) *Task {
+	self.task_id_counter++
+	t := &Task{Label: label, OnDone: on_done, id: self.task_id_counter, started_at: time.Now(), wakeup: self.wakeup_for_tasks}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	if self.tasks == nil {
+		self.tasks = make(map[IdType]*Task)
+	}
+	self.tasks[t.id] = t
+	go func() {
+		result, err := f(t)
+		t.mutex.Lock()
+		t.result, t.err, t.finished = result, err, true
+		t.mutex.Unlock()
+		t.wakeup()
+	}()
+	return t
+}
+
+// The tasks that have been started and whose OnDone callback has not yet been
+// called, in the order they were started
+func (self *Loop) RunningTasks() []*Task {
+	ans := make([]*Task, 0, len(self.tasks))
+	for _, t := range self.tasks {
+		ans = append(ans, t)
+	}
+	slices.SortFunc(ans, func(a, b *Task) bool { return a.id < b.id })
+	return ans
+}
+
+// Cancel all running tasks, returns false if there were none that had not
+// already been canceled
+func (self *Loop) CancelAllTasks() (canceled_some bool) {
+	for _, t := range self.tasks {
+		if !t.Canceled() {
+			t.Cancel()
+			canceled_some = true
+		}
+	}
+	return
+}
+
+func (self *Loop) dispatch_task_events() error {
+	for _, t := range self.RunningTasks() {
+		t.mutex.Lock()
+		progress_changed, finished := t.progress_changed, t.finished
+		t.progress_changed = false
+		t.mutex.Unlock()
+		if finished {
+			delete(self.tasks, t.id)
+			t.cancel() // release the resources associated with the context
+			if t.OnDone != nil {
+				if err := t.OnDone(t); err != nil {
+					return err
+				}
+			}
+		} else if progress_changed && t.OnProgress != nil {
+			if err := t.OnProgress(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
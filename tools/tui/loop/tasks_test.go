@@ -0,0 +1,84 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestTasks(t *testing.T) {
+	lp := new_loop()
+	var log []string
+	wait_for_event := func() {
+		t.Helper()
+		select {
+		case <-lp.task_wakeup_channel:
+			if err := lp.dispatch_task_events(); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for task event")
+		}
+	}
+	step := make(chan bool)
+	a := lp.RunTask("a", func(task *Task) (any, error) {
+		for i := int64(1); i <= 2; i++ {
+			<-step
+			task.ReportProgress(i, 2)
+		}
+		<-step
+		return "result", nil
+	}, func(task *Task) error {
+		r, err := task.Result()
+		log = append(log, fmt.Sprintf("%s done: %v %v", task.Label, r, err))
+		return nil
+	})
+	a.OnProgress = func(task *Task) error {
+		done, total := task.Progress()
+		log = append(log, fmt.Sprintf("%s progress: %d/%d", task.Label, done, total))
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		step <- true
+		wait_for_event()
+	}
+	if diff := cmp.Diff([]string{"a progress: 1/2", "a progress: 2/2", "a done: result <nil>"}, log); diff != "" {
+		t.Fatalf("Unexpected task events:\n%s", diff)
+	}
+	if len(lp.RunningTasks()) != 0 || !a.IsFinished() {
+		t.Fatalf("Finished task still running")
+	}
+
+	log = nil
+	started := make(chan bool)
+	b := lp.RunTask("b", func(task *Task) (any, error) {
+		started <- true
+		<-task.Context().Done()
+		return nil, task.Context().Err()
+	}, func(task *Task) error {
+		_, err := task.Result()
+		log = append(log, fmt.Sprintf("%s done: %v canceled: %v", task.Label, err, task.Canceled()))
+		return nil
+	})
+	<-started
+	if rt := lp.RunningTasks(); len(rt) != 1 || rt[0] != b {
+		t.Fatalf("Running tasks not as expected: %v", rt)
+	}
+	ctrl_c := &KeyEvent{Type: PRESS, Mods: CTRL, Key: "c"}
+	if err := lp.handle_key_event(ctrl_c); err != nil || !ctrl_c.Handled || lp.death_signal != 0 {
+		t.Fatalf("ctrl+c did not cancel the running task")
+	}
+	wait_for_event()
+	if diff := cmp.Diff([]string{"b done: context canceled canceled: true"}, log); diff != "" {
+		t.Fatalf("Unexpected task events:\n%s", diff)
+	}
+	if err := lp.handle_key_event(ctrl_c); err != nil || lp.death_signal == 0 {
+		t.Fatalf("ctrl+c did not quit with no running tasks")
+	}
+}
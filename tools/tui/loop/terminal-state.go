@@ -30,8 +30,28 @@ const (
 	RESTORE_COLORS                = "\033[#Q"
 	DECSACE_DEFAULT_REGION_SELECT = "\033[*x"
 	CLEAR_SCREEN                  = "\033[H\033[2J"
+	QUERY_COLOR_SCHEME            = "\033[?996n"
 )
 
+// The dark or light preference of the terminal, as reported by it
+type ColorScheme uint8
+
+const (
+	UNKNOWN_COLOR_SCHEME ColorScheme = iota
+	DARK_COLOR_SCHEME
+	LIGHT_COLOR_SCHEME
+)
+
+func (self ColorScheme) String() string {
+	switch self {
+	case DARK_COLOR_SCHEME:
+		return "dark"
+	case LIGHT_COLOR_SCHEME:
+		return "light"
+	}
+	return "unknown"
+}
+
 type CursorShapes uint
 
 const (
@@ -64,6 +84,7 @@ const (
 	ALTERNATE_SCREEN       Mode = 1049 | private
 	BRACKETED_PASTE        Mode = 2004 | private
 	PENDING_UPDATE         Mode = 2026 | private
+	COLOR_SCHEME_REPORTING Mode = 2031 | private
 	HANDLE_TERMIOS_SIGNALS Mode = kitty.HandleTermiosSignals | private
 )
 
@@ -98,6 +119,7 @@ type TerminalStateOptions struct {
 	alternate_screen, restore_colors bool
 	mouse_tracking                   MouseTracking
 	kitty_keyboard_mode              KeyboardStateBits
+	color_scheme_reporting           bool
 }
 
 func set_modes(sb *strings.Builder, modes ...Mode) {
@@ -148,6 +170,11 @@ func (self *TerminalStateOptions) SetStateEscapeCodes() string {
 			sb.WriteString(MOUSE_MOVE_TRACKING.EscapeCodeToSet())
 		}
 	}
+	if self.color_scheme_reporting {
+		sb.WriteString(COLOR_SCHEME_REPORTING.EscapeCodeToSet())
+		// the color scheme may have changed while the terminal was not in this state
+		sb.WriteString(QUERY_COLOR_SCHEME)
+	}
 	return sb.String()
 }
 
@@ -160,6 +187,9 @@ func (self *TerminalStateOptions) ResetStateEscapeCodes() string {
 	} else {
 		sb.WriteString(SAVE_CURSOR)
 	}
+	if self.color_scheme_reporting {
+		sb.WriteString(COLOR_SCHEME_REPORTING.EscapeCodeToReset())
+	}
 	sb.WriteString(RESTORE_PRIVATE_MODE_VALUES)
 	if self.restore_colors {
 		sb.WriteString(RESTORE_CURSOR)
@@ -0,0 +1,35 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package loop
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestColorSchemeReporting(t *testing.T) {
+	lp := new_loop()
+	var reported []ColorScheme
+	lp.OnColorSchemeChange = func(scheme ColorScheme) error {
+		reported = append(reported, scheme)
+		return nil
+	}
+	opts := TerminalStateOptions{color_scheme_reporting: true}
+	if q := opts.SetStateEscapeCodes(); !strings.HasSuffix(q, "\x1b[?2031h"+QUERY_COLOR_SCHEME) {
+		t.Fatalf("Color scheme reporting not enabled: %#v", q)
+	}
+	if q := opts.ResetStateEscapeCodes(); !strings.Contains(q, "\x1b[?2031l") {
+		t.Fatalf("Color scheme reporting not disabled: %#v", q)
+	}
+	for _, csi := range []string{"?997;2n", "?997;2n", "?997;1n", "?997;3n"} {
+		if err := lp.handle_csi([]byte(csi)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(reported) != "[light dark]" || lp.ColorScheme() != DARK_COLOR_SCHEME {
+		t.Fatalf("Unexpected color scheme changes: %v", reported)
+	}
+}
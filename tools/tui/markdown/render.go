@@ -0,0 +1,717 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package markdown
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+type Options struct {
+	// The width in cells to wrap text to, defaults to 80
+	Width            int
+	AllowEscapeCodes bool
+	// The name of a chroma style used to highlight code blocks. When empty
+	// code is colored using the terminal's own palette so that it matches
+	// the color theme.
+	CodeStyle string
+}
+
+type renderer struct {
+	opts                                       Options
+	ctx                                        style.Context
+	title, subtitle, heading, code, bold, emph func(...any) string
+	strike, dim, bullet                        func(...any) string
+	url                                        func(string, string) string
+	code_style                                 *chroma.Style
+	token_formatters                           map[chroma.TokenType]func(...any) string
+}
+
+// Render markdown as lines of text, each no wider than the specified width,
+// styled using SGR escape codes and with links as OSC 8 hyperlinks. Supports
+// headings, paragraphs, emphasis, code spans, fenced and indented code
+// blocks with syntax highlighting, block quotes, ordered, unordered and task
+// lists, pipe tables, thematic breaks and links.
+func RenderAsLines(markdown string, opts Options) []string {
+	if opts.Width < 1 {
+		opts.Width = 80
+	}
+	r := renderer{opts: opts}
+	r.ctx.AllowEscapeCodes = opts.AllowEscapeCodes
+	r.title = r.ctx.SprintFunc("bold fg=blue")
+	r.subtitle = r.ctx.SprintFunc("bold fg=blue")
+	r.heading = r.ctx.SprintFunc("bold")
+	r.code = r.ctx.SprintFunc("fg=bright-cyan")
+	r.bold = r.ctx.SprintFunc("bold")
+	r.emph = r.ctx.SprintFunc("italic")
+	r.strike = r.ctx.SprintFunc("strikethrough")
+	r.dim = r.ctx.SprintFunc("dim")
+	r.bullet = r.ctx.SprintFunc("fg=yellow")
+	r.url = r.ctx.UrlFunc("u=curly uc=cyan")
+	if opts.CodeStyle != "" {
+		r.code_style = styles.Get(opts.CodeStyle)
+	}
+	lines := utils.Splitlines(strings.ReplaceAll(markdown, "\t", "    "))
+	return r.render_blocks(lines, opts.Width, false)
+}
+
+func Render(markdown string, opts Options) string {
+	return strings.Join(RenderAsLines(markdown, opts), "\n")
+}
+
+var (
+	fence_pat            = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+	atx_heading_pat      = regexp.MustCompile(`^ {0,3}(#{1,6})(?:\s+(.*?))?(?:\s+#+)?\s*$`)
+	setext_underline_pat = regexp.MustCompile(`^ {0,3}(=+|-+)\s*$`)
+	thematic_break_pat   = regexp.MustCompile(`^ {0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	quote_pat            = regexp.MustCompile(`^ {0,3}> ?`)
+	list_item_pat        = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+	task_pat             = regexp.MustCompile(`^\[([ xX])\]\s+`)
+	table_delimiter_pat  = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	autolink_pat         = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^<>\s]*)>`)
+)
+
+func is_blank(line string) bool { return strings.TrimSpace(line) == "" }
+
+func indent_of(line string) int { return len(line) - len(strings.TrimLeft(line, " ")) }
+
+// Render block level elements, separated by blank lines, unless tight is true
+func (self *renderer) render_blocks(lines []string, width int, tight bool) (ans []string) {
+	var blocks [][]string
+	var paragraph []string
+	add := func(b []string) {
+		if len(b) > 0 {
+			blocks = append(blocks, b)
+		}
+	}
+	flush_paragraph := func() {
+		if len(paragraph) > 0 {
+			add(self.render_paragraph(paragraph, width))
+			paragraph = nil
+		}
+	}
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if is_blank(line) {
+			flush_paragraph()
+			i++
+			continue
+		}
+		if len(paragraph) > 0 {
+			if m := setext_underline_pat.FindStringSubmatch(line); m != nil {
+				level := 1
+				if m[1][0] == '-' {
+					level = 2
+				}
+				add(self.render_heading(level, strings.Join(utils.Map(strings.TrimSpace, paragraph), " "), width))
+				paragraph = nil
+				i++
+				continue
+			}
+		}
+		if m := fence_pat.FindStringSubmatch(line); m != nil {
+			flush_paragraph()
+			fence, indent := m[1], indent_of(line)
+			var code []string
+			for i++; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					i++
+					break
+				}
+				l := lines[i]
+				code = append(code, l[utils.Min(indent, indent_of(l)):])
+			}
+			add(self.render_code_block(code, m[2], width))
+			continue
+		}
+		if m := atx_heading_pat.FindStringSubmatch(line); m != nil {
+			flush_paragraph()
+			add(self.render_heading(len(m[1]), m[2], width))
+			i++
+			continue
+		}
+		if thematic_break_pat.MatchString(line) {
+			flush_paragraph()
+			add([]string{self.dim(strings.Repeat("─", width))})
+			i++
+			continue
+		}
+		if quote_pat.MatchString(line) {
+			flush_paragraph()
+			var quoted []string
+			for ; i < len(lines) && !is_blank(lines[i]); i++ {
+				quoted = append(quoted, quote_pat.ReplaceAllString(lines[i], ""))
+			}
+			add(utils.Map(func(l string) string { return self.dim("│") + " " + l }, self.render_blocks(quoted, width-2, false)))
+			continue
+		}
+		// only bulleted lists and ordered lists starting at one can interrupt a paragraph
+		if m := list_item_pat.FindStringSubmatch(line); m != nil && (len(paragraph) == 0 || len(m[2]) == 1 || m[2][:len(m[2])-1] == "1") {
+			flush_paragraph()
+			var list []string
+			list, i = self.render_list(lines, i, width)
+			add(list)
+			continue
+		}
+		if len(paragraph) == 0 && i+1 < len(lines) && strings.Contains(line, "|") && table_delimiter_pat.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-") {
+			rows := [][]string{split_table_row(line)}
+			alignments := utils.Map(func(c string) string {
+				c = strings.TrimSpace(c)
+				switch {
+				case strings.HasPrefix(c, ":") && strings.HasSuffix(c, ":"):
+					return "center"
+				case strings.HasSuffix(c, ":"):
+					return "right"
+				}
+				return "left"
+			}, split_table_row(lines[i+1]))
+			for i += 2; i < len(lines) && !is_blank(lines[i]) && strings.Contains(lines[i], "|"); i++ {
+				rows = append(rows, split_table_row(lines[i]))
+			}
+			add(self.render_table(rows, alignments, width))
+			continue
+		}
+		if len(paragraph) == 0 && indent_of(line) >= 4 {
+			var code []string
+			for ; i < len(lines) && (is_blank(lines[i]) || indent_of(lines[i]) >= 4); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			for len(code) > 0 && is_blank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			add(self.render_code_block(code, "", width))
+			continue
+		}
+		paragraph = append(paragraph, line)
+		i++
+	}
+	flush_paragraph()
+	for i, b := range blocks {
+		if i > 0 && !tight {
+			ans = append(ans, "")
+		}
+		ans = append(ans, b...)
+	}
+	return
+}
+
+func (self *renderer) wrap(text string, width int) []string {
+	return style.WrapTextAsLines(text, width, style.WrapOptions{Trim_whitespace: true})
+}
+
+func (self *renderer) render_paragraph(lines []string, width int) []string {
+	buf := strings.Builder{}
+	for i, line := range lines {
+		hard_break := strings.HasSuffix(line, "  ") || strings.HasSuffix(line, "\\")
+		line = strings.TrimSpace(line)
+		if hard_break {
+			line = strings.TrimSuffix(line, "\\")
+		}
+		buf.WriteString(line)
+		if i < len(lines)-1 {
+			if hard_break {
+				buf.WriteString("\n")
+			} else {
+				buf.WriteString(" ")
+			}
+		}
+	}
+	return self.wrap(self.render_inline(buf.String()), width)
+}
+
+func (self *renderer) render_heading(level int, text string, width int) []string {
+	text = self.render_inline(text)
+	switch level {
+	case 1, 2:
+		f, underline := self.title, "═"
+		if level == 2 {
+			f, underline = self.subtitle, "─"
+		}
+		lines := self.wrap(f(text), width)
+		w := 0
+		for _, l := range lines {
+			w = utils.Max(w, wcswidth.Stringwidth(l))
+		}
+		return append(lines, self.dim(strings.Repeat(underline, w)))
+	}
+	return self.wrap(self.heading(text), width)
+}
+
+type list_item struct {
+	marker string
+	lines  []string
+}
+
+func (self *renderer) render_list(lines []string, i, width int) (ans []string, next int) {
+	var items []list_item
+	loose := false
+	first := list_item_pat.FindStringSubmatch(lines[i])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	num := 1
+	if ordered {
+		num, _ = strconv.Atoi(first[2][:len(first[2])-1])
+	}
+	for i < len(lines) {
+		m := list_item_pat.FindStringSubmatch(lines[i])
+		if m == nil || (m[2][0] >= '0' && m[2][0] <= '9') != ordered {
+			break
+		}
+		content_indent := len(m[0])
+		if m[3] == "" || len(m[3]) > 4 {
+			content_indent = len(m[1]) + len(m[2]) + 1
+		}
+		item := list_item{lines: []string{lines[i][utils.Min(len(lines[i]), content_indent):]}}
+		if ordered {
+			item.marker = strconv.Itoa(num) + m[2][len(m[2])-1:]
+			num++
+		} else {
+			item.marker = "•"
+		}
+		i++
+		prev_blank := false
+		for ; i < len(lines); i++ {
+			l := lines[i]
+			if is_blank(l) {
+				prev_blank = true
+				item.lines = append(item.lines, "")
+				continue
+			}
+			if indent_of(l) >= content_indent {
+				if prev_blank {
+					loose = true
+				}
+				item.lines = append(item.lines, l[content_indent:])
+			} else if !prev_blank && !list_item_pat.MatchString(l) && !thematic_break_pat.MatchString(l) && !quote_pat.MatchString(l) && !fence_pat.MatchString(l) && !atx_heading_pat.MatchString(l) {
+				// lazy continuation of the paragraph
+				item.lines = append(item.lines, strings.TrimSpace(l))
+			} else {
+				break
+			}
+			prev_blank = false
+		}
+		for len(item.lines) > 0 && is_blank(item.lines[len(item.lines)-1]) {
+			item.lines = item.lines[:len(item.lines)-1]
+		}
+		items = append(items, item)
+		if prev_blank && i < len(lines) && list_item_pat.MatchString(lines[i]) {
+			loose = true
+		}
+	}
+	marker_width := 0
+	for _, item := range items {
+		marker_width = utils.Max(marker_width, wcswidth.Stringwidth(item.marker))
+	}
+	for n, item := range items {
+		if n > 0 && loose {
+			ans = append(ans, "")
+		}
+		marker := item.marker
+		if len(item.lines) > 0 {
+			if m := task_pat.FindStringSubmatch(item.lines[0]); m != nil && !ordered {
+				marker = "☐"
+				if m[1] != " " {
+					marker = "☑"
+				}
+				item.lines[0] = item.lines[0][len(m[0]):]
+			}
+		}
+		marker += strings.Repeat(" ", marker_width-wcswidth.Stringwidth(marker)+1)
+		indent := strings.Repeat(" ", marker_width+1)
+		for j, l := range self.render_blocks(item.lines, width-len(indent), !loose) {
+			switch {
+			case j == 0:
+				ans = append(ans, self.bullet(marker)+l)
+			case l == "":
+				ans = append(ans, l)
+			default:
+				ans = append(ans, indent+l)
+			}
+		}
+		if len(item.lines) == 0 {
+			ans = append(ans, self.bullet(marker))
+		}
+	}
+	return ans, i
+}
+
+func split_table_row(line string) (ans []string) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, "\\|") {
+		line = line[:len(line)-1]
+	}
+	start, in_code := 0, false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '`':
+			in_code = !in_code
+		case '|':
+			if !in_code {
+				ans = append(ans, strings.ReplaceAll(strings.TrimSpace(line[start:i]), "\\|", "|"))
+				start = i + 1
+			}
+		}
+	}
+	return append(ans, strings.ReplaceAll(strings.TrimSpace(line[start:]), "\\|", "|"))
+}
+
+func (self *renderer) render_table(rows [][]string, alignments []string, width int) (ans []string) {
+	num_cols := len(alignments)
+	cells := make([][]string, len(rows))
+	widths := make([]int, num_cols)
+	for r, row := range rows {
+		cells[r] = make([]string, num_cols)
+		for c := 0; c < num_cols && c < len(row); c++ {
+			cells[r][c] = self.render_inline(row[c])
+			if r == 0 {
+				cells[r][c] = self.bold(cells[r][c])
+			}
+			widths[c] = utils.Max(widths[c], wcswidth.Stringwidth(cells[r][c]))
+		}
+	}
+	const sep = " │ "
+	available := width - (num_cols-1)*wcswidth.Stringwidth(sep)
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+	for total > available {
+		widest := 0
+		for c, w := range widths {
+			if w > widths[widest] {
+				widest = c
+			}
+		}
+		if widths[widest] <= 1 {
+			break
+		}
+		widths[widest]--
+		total--
+	}
+	pad := func(text string, w int, alignment string) string {
+		extra := utils.Max(0, w-wcswidth.Stringwidth(text))
+		switch alignment {
+		case "right":
+			return strings.Repeat(" ", extra) + text
+		case "center":
+			return strings.Repeat(" ", extra/2) + text + strings.Repeat(" ", extra-extra/2)
+		}
+		return text + strings.Repeat(" ", extra)
+	}
+	for r, row := range cells {
+		wrapped := make([][]string, num_cols)
+		height := 1
+		for c, text := range row {
+			wrapped[c] = self.wrap(text, widths[c])
+			height = utils.Max(height, len(wrapped[c]))
+		}
+		for y := 0; y < height; y++ {
+			parts := make([]string, num_cols)
+			for c := range row {
+				text := ""
+				if y < len(wrapped[c]) {
+					text = wrapped[c][y]
+				}
+				parts[c] = pad(text, widths[c], alignments[c])
+			}
+			ans = append(ans, strings.TrimRight(strings.Join(parts, self.dim(sep)), " "))
+		}
+		if r == 0 {
+			ans = append(ans, self.dim(strings.Join(utils.Map(func(w int) string { return strings.Repeat("─", w) }, widths), "─┼─")))
+		}
+	}
+	return
+}
+
+func (self *renderer) token_formatter(t chroma.TokenType) func(...any) string {
+	if self.token_formatters == nil {
+		self.token_formatters = make(map[chroma.TokenType]func(...any) string)
+	}
+	if f, found := self.token_formatters[t]; found {
+		return f
+	}
+	spec := ""
+	if self.code_style != nil {
+		e := self.code_style.Get(t)
+		if e.Colour.IsSet() {
+			spec += fmt.Sprintf("fg=#%02x%02x%02x ", e.Colour.Red(), e.Colour.Green(), e.Colour.Blue())
+		}
+		if e.Bold == chroma.Yes {
+			spec += "bold "
+		}
+		if e.Italic == chroma.Yes {
+			spec += "italic "
+		}
+		if e.Underline == chroma.Yes {
+			spec += "underline "
+		}
+	} else {
+		palette := map[chroma.TokenType]string{
+			chroma.Keyword: "fg=magenta", chroma.KeywordType: "fg=yellow", chroma.KeywordConstant: "fg=cyan",
+			chroma.NameFunction: "fg=blue", chroma.NameClass: "fg=blue bold", chroma.NameBuiltin: "fg=cyan",
+			chroma.NameDecorator: "fg=yellow", chroma.NameTag: "fg=blue", chroma.NameAttribute: "fg=yellow",
+			chroma.LiteralString: "fg=green", chroma.LiteralNumber: "fg=cyan", chroma.Comment: "dim italic",
+			chroma.GenericDeleted: "fg=red", chroma.GenericInserted: "fg=green", chroma.GenericHeading: "bold",
+			chroma.GenericSubheading: "fg=magenta", chroma.GenericPrompt: "bold", chroma.GenericEmph: "italic",
+			chroma.GenericStrong: "bold", chroma.Error: "fg=red",
+		}
+		for _, q := range []chroma.TokenType{t, t.SubCategory(), t.Category()} {
+			if s, found := palette[q]; found {
+				spec = s
+				break
+			}
+		}
+	}
+	var f func(...any) string
+	if spec = strings.TrimSpace(spec); spec != "" {
+		f = self.ctx.SprintFunc(spec)
+	}
+	self.token_formatters[t] = f
+	return f
+}
+
+func (self *renderer) highlight(code, language string) []string {
+	var lexer chroma.Lexer
+	if language != "" {
+		lexer = lexers.Get(language)
+	}
+	if lexer == nil || !self.opts.AllowEscapeCodes {
+		return utils.Splitlines(code)
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return utils.Splitlines(code)
+	}
+	lines := []string{}
+	current := strings.Builder{}
+	write := func(t chroma.TokenType, text string) {
+		if text == "" {
+			return
+		}
+		if f := self.token_formatter(t); f != nil {
+			text = f(text)
+		}
+		current.WriteString(text)
+	}
+	for token := it(); token != chroma.EOF; token = it() {
+		text := token.Value
+		for {
+			idx := strings.IndexByte(text, '\n')
+			if idx < 0 {
+				write(token.Type, text)
+				break
+			}
+			write(token.Type, text[:idx])
+			lines = append(lines, current.String())
+			current.Reset()
+			text = text[idx+1:]
+		}
+	}
+	if current.Len() > 0 {
+		lines = append(lines, current.String())
+	}
+	return lines
+}
+
+func (self *renderer) render_code_block(code []string, language string, width int) (ans []string) {
+	const indent = "  "
+	for _, line := range self.highlight(strings.Join(code, "\n"), language) {
+		if wcswidth.Stringwidth(line) <= width-len(indent) {
+			ans = append(ans, indent+line)
+		} else {
+			ans = append(ans, style.WrapTextAsLines(line, width, style.WrapOptions{Indent: indent})...)
+		}
+	}
+	return
+}
+
+func is_punct(ch byte) bool {
+	return ch < utf8.RuneSelf && (unicode.IsPunct(rune(ch)) || unicode.IsSymbol(rune(ch)))
+}
+
+func is_alnum(ch rune) bool { return unicode.IsLetter(ch) || unicode.IsDigit(ch) }
+
+func alnum_at(text string, i int) bool {
+	if i >= len(text) {
+		return false
+	}
+	ch, _ := utf8.DecodeRuneInString(text[i:])
+	return is_alnum(ch)
+}
+
+func alnum_before(text string, i int) bool {
+	if i <= 0 {
+		return false
+	}
+	ch, _ := utf8.DecodeLastRuneInString(text[:i])
+	return is_alnum(ch)
+}
+
+// Find the closing delimiter for emphasis starting at start, it must not be
+// preceded by whitespace
+func find_closing_delimiter(text, delim string, start int) int {
+	for i := start; i < len(text); {
+		idx := strings.Index(text[i:], delim)
+		if idx < 0 {
+			return -1
+		}
+		pos := i + idx
+		run_end := pos + len(delim)
+		for run_end < len(text) && text[run_end] == delim[0] {
+			run_end++
+		}
+		run := run_end - pos
+		// a single delimiter cannot be closed by a double one, so that *a **b** c* works
+		if pos > start && text[pos-1] != ' ' && text[pos-1] != '\\' && (run == len(delim) || (run > len(delim) && (len(delim) > 1 || run > 2))) {
+			if delim[0] != '_' || !alnum_at(text, run_end) {
+				// use the end of a run of delimiters, so that ***x*** closes correctly
+				return run_end - len(delim)
+			}
+		}
+		i = run_end
+	}
+	return -1
+}
+
+func (self *renderer) try_link(text string, i int) (rendered string, end int) {
+	// [label](destination "title") with nested brackets in label
+	depth := 0
+	label_end := -1
+	for j := i; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				label_end = j
+			}
+		}
+		if label_end > -1 {
+			break
+		}
+	}
+	if label_end < 0 || label_end+1 >= len(text) || text[label_end+1] != '(' {
+		return "", -1
+	}
+	close_paren := strings.IndexByte(text[label_end+1:], ')')
+	if close_paren < 0 {
+		return "", -1
+	}
+	close_paren += label_end + 1
+	dest := strings.TrimSpace(text[label_end+2 : close_paren])
+	if idx := strings.IndexAny(dest, " \t"); idx > -1 {
+		dest = dest[:idx] // remove the title
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	label := self.render_inline(text[i+1 : label_end])
+	if label == "" {
+		label = dest
+	}
+	return self.url(dest, label), close_paren + 1
+}
+
+func (self *renderer) render_inline(text string) string {
+	buf := strings.Builder{}
+	buf.Grow(len(text) + 64)
+	for i := 0; i < len(text); {
+		ch := text[i]
+		switch {
+		case ch == '\\' && i+1 < len(text) && is_punct(text[i+1]):
+			buf.WriteByte(text[i+1])
+			i += 2
+			continue
+		case ch == '`':
+			n := 1
+			for i+n < len(text) && text[i+n] == '`' {
+				n++
+			}
+			delim := text[i : i+n]
+			end := -1
+			for j := i + n; j < len(text); {
+				idx := strings.Index(text[j:], delim)
+				if idx < 0 {
+					break
+				}
+				k := j + idx
+				if k+n < len(text) && text[k+n] == '`' {
+					j = k + n
+					for j < len(text) && text[j] == '`' {
+						j++
+					}
+					continue
+				}
+				end = k
+				break
+			}
+			if end < 0 {
+				buf.WriteString(delim)
+				i += n
+				continue
+			}
+			code := text[i+n : end]
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			buf.WriteString(self.code(code))
+			i = end + n
+			continue
+		case ch == '!' && i+1 < len(text) && text[i+1] == '[':
+			if r, end := self.try_link(text, i+1); end > -1 {
+				buf.WriteString(r)
+				i = end
+				continue
+			}
+		case ch == '[':
+			if r, end := self.try_link(text, i); end > -1 {
+				buf.WriteString(r)
+				i = end
+				continue
+			}
+		case ch == '<':
+			if m := autolink_pat.FindStringSubmatch(text[i:]); m != nil {
+				buf.WriteString(self.url(m[1], m[1]))
+				i += len(m[0])
+				continue
+			}
+		case ch == '~' && strings.HasPrefix(text[i:], "~~"):
+			if end := find_closing_delimiter(text, "~~", i+2); end > -1 {
+				buf.WriteString(self.strike(self.render_inline(text[i+2 : end])))
+				i = end + 2
+				continue
+			}
+		case (ch == '*' || ch == '_') && i+1 < len(text) && text[i+1] != ' ' && (ch == '*' || !alnum_before(text, i)):
+			delim := text[i : i+1]
+			f := self.emph
+			if i+2 < len(text) && text[i+1] == ch && text[i+2] != ' ' {
+				delim, f = text[i:i+2], self.bold
+			}
+			if end := find_closing_delimiter(text, delim, i+len(delim)); end > -1 {
+				buf.WriteString(f(self.render_inline(text[i+len(delim) : end])))
+				i = end + len(delim)
+				continue
+			}
+		}
+		buf.WriteByte(ch)
+		i++
+	}
+	return buf.String()
+}
@@ -0,0 +1,100 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package markdown
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestMarkdownRendering(t *testing.T) {
+	src := `# Title
+
+Some *emphasised* and **strong** text with ` + "`code`" + ` and a
+[link](https://example.com "title") that wraps.
+
+- one
+- two
+  continued
+  1. nested
+- [x] done
+
+| Name | Size |
+|:-----|-----:|
+| a \| b | 10 |
+
+> quoted
+> text
+
+` + "```go\nfunc main() {}\n```" + `
+
+---
+`
+	actual := RenderAsLines(src, Options{Width: 30})
+	expected := []string{
+		"Title",
+		"═════",
+		"",
+		"Some emphasised and strong",
+		"text with code and a link that",
+		"wraps.",
+		"",
+		"• one",
+		"• two continued",
+		"  1. nested",
+		"☑ done",
+		"",
+		"Name  │ Size",
+		"──────┼─────",
+		"a | b │   10",
+		"",
+		"│ quoted text",
+		"",
+		"  func main() {}",
+		"",
+		strings.Repeat("─", 30),
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatalf("Unexpected rendering:\n%s", diff)
+	}
+
+	styled := RenderAsLines(src, Options{Width: 30, AllowEscapeCodes: true})
+	if len(styled) != len(expected) {
+		t.Fatalf("Styled rendering has %d lines not %d", len(styled), len(expected))
+	}
+	for _, line := range styled {
+		if w := wcswidth.Stringwidth(line); w > 30 {
+			t.Fatalf("Line wider than 30 cells: %#v", line)
+		}
+	}
+	if !strings.Contains(styled[4], "\x1b]8;;https://example.com\x1b\\") {
+		t.Fatalf("Link not rendered as a hyperlink: %#v", styled[4])
+	}
+	if !strings.Contains(styled[18], "\x1b[") {
+		t.Fatalf("Code block not highlighted: %#v", styled[18])
+	}
+}
+
+func TestMarkdownEmphasis(t *testing.T) {
+	ctx := style.Context{AllowEscapeCodes: true}
+	bold, italic := ctx.SprintFunc("bold"), ctx.SprintFunc("italic")
+	for src, expected := range map[string]string{
+		"***both***":     bold(italic("both")),
+		"*a **b** c*":    italic("a " + bold("b") + " c"),
+		"snake_case_var": "snake_case_var",
+		"2 * 3 * 4":      "2 * 3 * 4",
+		`\*not\*`:        "*not*",
+	} {
+		if actual := Render(src, Options{AllowEscapeCodes: true}); actual != expected {
+			t.Fatalf("Rendering of %#v not as expected: %#v != %#v", src, expected, actual)
+		}
+	}
+}
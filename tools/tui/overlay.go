@@ -0,0 +1,336 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// Something drawn above the rest of the UI that captures all input while it
+// is on top of the stack of overlays
+type Overlay interface {
+	// Draw the overlay, screen is the area available for drawing
+	Draw(lp *loop.Loop, screen Rect)
+	// The event handlers return true if the overlay needs to be redrawn
+	OnKeyEvent(ev *loop.KeyEvent) bool
+	OnText(text string) bool
+	OnMouseEvent(ev *loop.MouseEvent) bool
+	// Should return true once the overlay is done, it is then removed from the stack
+	IsClosed() bool
+}
+
+// A stack of modal overlays. While any overlays are active, kittens should
+// send all input events to the stack rather than processing them, and draw
+// the stack after drawing the rest of their UI. For example:
+//
+//	lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
+//		if overlays.IsActive() {
+//			if overlays.OnKeyEvent(ev) {
+//				draw_screen()
+//			}
+//			return nil
+//		}
+//		...
+//	}
+type Overlays struct {
+	// Dim everything below the topmost overlay
+	DimBackground bool
+
+	stack []Overlay
+}
+
+func NewOverlays() *Overlays {
+	return &Overlays{DimBackground: true}
+}
+
+func (self *Overlays) Push(o Overlay) { self.stack = append(self.stack, o) }
+
+func (self *Overlays) Pop() Overlay {
+	if len(self.stack) == 0 {
+		return nil
+	}
+	ans := self.stack[len(self.stack)-1]
+	self.stack = self.stack[:len(self.stack)-1]
+	return ans
+}
+
+func (self *Overlays) Top() Overlay {
+	if len(self.stack) == 0 {
+		return nil
+	}
+	return self.stack[len(self.stack)-1]
+}
+
+func (self *Overlays) IsActive() bool { return len(self.stack) > 0 }
+
+func (self *Overlays) remove_closed() {
+	self.stack = utils.Filter(self.stack, func(o Overlay) bool { return !o.IsClosed() })
+}
+
+// Draw all overlays, bottom first
+func (self *Overlays) Draw(lp *loop.Loop, screen Rect) {
+	for _, o := range self.stack {
+		if self.DimBackground {
+			// DECCARA to dim everything drawn so far
+			lp.QueueWriteString(fmt.Sprintf("\x1b[%d;%d;%d;%d;2$r", screen.Top+1, screen.Left+1, screen.Top+screen.Height, screen.Left+screen.Width))
+		}
+		o.Draw(lp, screen)
+	}
+}
+
+func (self *Overlays) dispatch(handler func(Overlay) bool) bool {
+	top := self.Top()
+	if top == nil {
+		return false
+	}
+	ans := handler(top)
+	if top.IsClosed() {
+		self.remove_closed()
+		ans = true
+	}
+	return ans
+}
+
+// Send the event to the topmost overlay, returns true if the screen needs to be redrawn
+func (self *Overlays) OnKeyEvent(ev *loop.KeyEvent) bool {
+	return self.dispatch(func(o Overlay) bool { return o.OnKeyEvent(ev) })
+}
+
+func (self *Overlays) OnText(text string) bool {
+	return self.dispatch(func(o Overlay) bool { return o.OnText(text) })
+}
+
+func (self *Overlays) OnMouseEvent(ev *loop.MouseEvent) bool {
+	return self.dispatch(func(o Overlay) bool { return o.OnMouseEvent(ev) })
+}
+
+type DialogButton struct {
+	Label string
+	// A shortcut that activates this button, such as "y" or "ctrl+s"
+	Shortcut string
+}
+
+// The result of a dialog that was dismissed without activating a button
+const DIALOG_CANCELED = -1
+
+// A modal dialog with a message and some buttons. The buttons can be
+// activated by clicking, with their shortcuts, or by selecting them with the
+// arrow or tab keys and pressing enter. Pressing esc dismisses the dialog.
+type Dialog struct {
+	Title, Message string
+	Buttons        []DialogButton
+	// The maximum width of the dialog, including its borders
+	MaxWidth int
+	// Styles, in the format used by loop.SprintStyled
+	BorderStyle, TitleStyle, CurrentButtonStyle string
+	// Called with the index of the activated button, or DIALOG_CANCELED
+	OnClose func(result int)
+
+	current, result int
+	closed          bool
+	rect            Rect
+	button_row      int
+	button_ranges   [][2]int
+}
+
+func NewDialog(title, message string, buttons ...DialogButton) *Dialog {
+	theme := CurrentTheme()
+	return &Dialog{
+		Title: title, Message: message, Buttons: buttons, MaxWidth: 60, result: DIALOG_CANCELED,
+		BorderStyle: theme.Accent, TitleStyle: "bold", CurrentButtonStyle: theme.Selection,
+	}
+}
+
+// A dialog with Yes and No buttons, on_close is called with true if Yes was activated
+func NewConfirmDialog(title, message string, on_close func(confirmed bool)) *Dialog {
+	ans := NewDialog(title, message, DialogButton{Label: "Yes", Shortcut: "y"}, DialogButton{Label: "No", Shortcut: "n"})
+	ans.OnClose = func(result int) {
+		if on_close != nil {
+			on_close(result == 0)
+		}
+	}
+	return ans
+}
+
+func (self *Dialog) IsClosed() bool { return self.closed }
+
+// The index of the button that was activated, or DIALOG_CANCELED
+func (self *Dialog) Result() int { return self.result }
+
+// The index of the button that is activated by pressing enter
+func (self *Dialog) CurrentButton() int { return self.current }
+
+func (self *Dialog) SetCurrentButton(idx int) {
+	if len(self.Buttons) > 0 {
+		self.current = (idx + len(self.Buttons)) % len(self.Buttons)
+	}
+}
+
+func (self *Dialog) Close(result int) {
+	if self.closed {
+		return
+	}
+	self.closed, self.result = true, result
+	if self.OnClose != nil {
+		self.OnClose(result)
+	}
+}
+
+// The lines of text that make up the dialog, when drawn on a screen of the specified width
+func (self *Dialog) Lines(screen_width int, sprint_styled func(style string, args ...any) string) []string {
+	buttons := utils.Map(func(b DialogButton) string { return "[ " + b.Label + " ]" }, self.Buttons)
+	buttons_width := buttons_row_width(buttons)
+	// two cells for the border and two for padding
+	max_inner := utils.Max(1, utils.Min(screen_width, utils.Max(self.MaxWidth, 5))-4)
+	inner := utils.Max(buttons_width, wcswidth.Stringwidth(self.Title)+2)
+	for _, line := range utils.Splitlines(self.Message) {
+		inner = utils.Max(inner, wcswidth.Stringwidth(line))
+	}
+	inner = utils.Min(inner, max_inner)
+	rows := style.WrapTextAsLines(self.Message, inner, style.WrapOptions{Trim_whitespace: true})
+	if len(self.Buttons) > 0 {
+		rows = append(rows, "")
+		// the first line is the top border
+		self.button_row = len(rows) + 1
+		var row string
+		row, self.button_ranges = buttons_row(buttons, self.current, inner, self.CurrentButtonStyle, sprint_styled)
+		rows = append(rows, row)
+	}
+	return box_lines(self.Title, inner, rows, self.BorderStyle, self.TitleStyle, sprint_styled)
+}
+
+func buttons_row_width(buttons []string) int {
+	ans := 0
+	for i, b := range buttons {
+		if i > 0 {
+			ans += 2
+		}
+		ans += wcswidth.Stringwidth(b)
+	}
+	return ans
+}
+
+// Center buttons in a row inner cells wide. Also returns the range of cells
+// occupied by each button, counting the border and padding of a box.
+func buttons_row(buttons []string, current, inner int, current_style string, sprint_styled func(style string, args ...any) string) (string, [][2]int) {
+	ranges := make([][2]int, len(buttons))
+	x := 2 + utils.Max(0, inner-buttons_row_width(buttons))/2
+	buf := strings.Builder{}
+	buf.WriteString(strings.Repeat(" ", x-2))
+	for i, text := range buttons {
+		if i > 0 {
+			buf.WriteString("  ")
+			x += 2
+		}
+		w := wcswidth.Stringwidth(text)
+		ranges[i] = [2]int{x, x + w}
+		x += w
+		if i == current {
+			text = sprint_styled(current_style, text)
+		}
+		buf.WriteString(text)
+	}
+	return buf.String(), ranges
+}
+
+// Surround rows with a border with rounded corners and one cell of padding on
+// the left and right. Rows are padded or truncated to inner cells. The title,
+// if any, is embedded in the top border.
+func box_lines(title string, inner int, rows []string, border_style, title_style string, sprint_styled func(style string, args ...any) string) []string {
+	border := func(text string) string { return sprint_styled(border_style, text) }
+	ans := make([]string, 0, len(rows)+2)
+	if title != "" {
+		title = " " + wcswidth.TruncateToVisualLength(title, utils.Max(0, inner-2)) + " "
+	}
+	ans = append(ans, border("╭─")+sprint_styled(title_style, title)+border(strings.Repeat("─", inner+1-wcswidth.Stringwidth(title))+"╮"))
+	for _, text := range rows {
+		ans = append(ans, border("│")+" "+fit_to_width(text, inner, false)+" "+border("│"))
+	}
+	ans = append(ans, border("╰"+strings.Repeat("─", inner+2)+"╯"))
+	return ans
+}
+
+// Draw the dialog centered in screen
+func (self *Dialog) Draw(lp *loop.Loop, screen Rect) {
+	self.rect = draw_centered(lp, screen, self.Lines(screen.Width, lp.SprintStyled))
+}
+
+// Draw lines, all of the same width, centered in screen, returning the area drawn into
+func draw_centered(lp *loop.Loop, screen Rect, lines []string) Rect {
+	width := wcswidth.Stringwidth(lines[0])
+	ans := Rect{Left: screen.Left + (screen.Width-width)/2, Top: screen.Top + utils.Max(0, screen.Height-len(lines))/2, Width: width, Height: len(lines)}
+	for i, line := range lines {
+		lp.MoveCursorTo(ans.Left+1, ans.Top+i+1)
+		lp.QueueWriteString(line)
+	}
+	return ans
+}
+
+func (self *Dialog) OnKeyEvent(ev *loop.KeyEvent) bool {
+	for i, b := range self.Buttons {
+		if b.Shortcut != "" && ev.MatchesPressOrRepeat(b.Shortcut) {
+			ev.Handled = true
+			self.Close(i)
+			return true
+		}
+	}
+	switch {
+	case ev.MatchesPressOrRepeat("esc"):
+		self.Close(DIALOG_CANCELED)
+	case ev.MatchesPressOrRepeat("enter"):
+		if len(self.Buttons) > 0 {
+			self.Close(self.current)
+		} else {
+			self.Close(DIALOG_CANCELED)
+		}
+	case ev.MatchesPressOrRepeat("left") || ev.MatchesPressOrRepeat("shift+tab"):
+		self.SetCurrentButton(self.current - 1)
+	case ev.MatchesPressOrRepeat("right") || ev.MatchesPressOrRepeat("tab"):
+		self.SetCurrentButton(self.current + 1)
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+func (self *Dialog) OnText(text string) bool { return false }
+
+func (self *Dialog) button_at(x, y int) int {
+	if y-self.rect.Top == self.button_row {
+		x -= self.rect.Left
+		for i, r := range self.button_ranges {
+			if x >= r[0] && x < r[1] {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Clicking a button activates it, hovering over it makes it current
+func (self *Dialog) OnMouseEvent(ev *loop.MouseEvent) bool {
+	idx := self.button_at(ev.Cell.X, ev.Cell.Y)
+	if idx < 0 {
+		return false
+	}
+	switch ev.Event_type {
+	case loop.MOUSE_CLICK:
+		self.Close(idx)
+		return true
+	case loop.MOUSE_MOVE:
+		if idx != self.current {
+			self.current = idx
+			return true
+		}
+	}
+	return false
+}
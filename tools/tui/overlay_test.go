@@ -0,0 +1,64 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"testing"
+
+	"kitty/tools/tui/loop"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDialog(t *testing.T) {
+	SetCurrentTheme(DefaultTheme())
+	marked := func(style string, args ...any) string {
+		if style == "reverse=true" {
+			return "*" + fmt.Sprint(args...) + "*"
+		}
+		return fmt.Sprint(args...)
+	}
+	results := []bool{}
+	overlays := NewOverlays()
+	d := NewConfirmDialog("Quit", "There are unsaved changes, quit anyway?", func(confirmed bool) { results = append(results, confirmed) })
+	d.MaxWidth = 30
+	overlays.Push(d)
+	lines := d.Lines(80, marked)
+	if diff := cmp.Diff([]string{
+		"╭─ Quit ─────────────────────╮",
+		"│ There are unsaved changes, │",
+		"│ quit anyway?               │",
+		"│                            │",
+		"│      *[ Yes ]*  [ No ]     │",
+		"╰────────────────────────────╯",
+	}, lines); diff != "" {
+		t.Fatalf("Unexpected dialog rendering:\n%s", diff)
+	}
+
+	key := func(k string) bool { return overlays.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: k}) }
+	if !key("TAB") || d.CurrentButton() != 1 || !key("TAB") || d.CurrentButton() != 0 {
+		t.Fatalf("Tab did not cycle through buttons: %d", d.CurrentButton())
+	}
+	if key("x") || !overlays.IsActive() {
+		t.Fatalf("Unhandled key closed dialog")
+	}
+	nested := NewDialog("", "Really?", DialogButton{Label: "OK"})
+	overlays.Push(nested)
+	key("ESCAPE")
+	if overlays.Top() != d || nested.Result() != DIALOG_CANCELED {
+		t.Fatalf("Escape did not close the topmost dialog")
+	}
+
+	d.rect = Rect{Left: 10, Top: 5, Width: 30, Height: 6}
+	click := &loop.MouseEvent{Event_type: loop.MOUSE_CLICK}
+	click.Cell.X, click.Cell.Y = 10+17, 5+4
+	if !overlays.OnMouseEvent(click) || overlays.IsActive() || d.Result() != 1 {
+		t.Fatalf("Clicking No did not close the dialog: %d", d.Result())
+	}
+	if diff := cmp.Diff([]bool{false}, results); diff != "" {
+		t.Fatalf("Unexpected results:\n%s", diff)
+	}
+}
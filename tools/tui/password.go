@@ -51,6 +51,10 @@ func ReadPassword(prompt string, kill_if_signaled bool) (password string, err er
 	}
 
 	lp.OnText = func(text string, from_key_event bool, in_bracketed_paste bool) error {
+		if in_bracketed_paste {
+			// pasted passwords often have a trailing newline
+			text = strings.NewReplacer("\r", "", "\n", "").Replace(text)
+		}
 		old_width := wcswidth.Stringwidth(password)
 		password += text
 		new_width := wcswidth.Stringwidth(password)
@@ -0,0 +1,294 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// Tracks and renders the progress of a task. A task can have sub-tasks, in
+// which case its progress is the sum of the progress of its sub-tasks, for
+// example, an overall progress for a transfer with one child per file. A task
+// whose total is unknown is indeterminate and is rendered with an animated
+// bar and no ETA.
+type Progress struct {
+	Label string
+	// Used to format amounts of work, defaults to formatting as a number of bytes.
+	FormatAmount func(amt int64) string
+	// The rate is an exponential moving average with this time constant.
+	// Larger values give a smoother rate that reacts more slowly to changes.
+	SmoothingWindow time.Duration
+	// Do not render sub-tasks that have finished
+	HideFinishedChildren bool
+
+	total, done             int64
+	rate                    float64
+	has_rate                bool
+	started_at, last_update time.Time
+	finished_at             time.Time
+	parent                  *Progress
+	children                []*Progress
+	now                     func() time.Time
+}
+
+func format_bytes(amt int64) string { return humanize.Size(amt) }
+
+// Create a new task with the specified total amount of work, use a total of
+// zero for indeterminate tasks
+func NewProgress(label string, total int64) *Progress {
+	ans := &Progress{Label: label, FormatAmount: format_bytes, SmoothingWindow: 3 * time.Second, total: total, now: time.Now}
+	ans.started_at = ans.now()
+	ans.last_update = ans.started_at
+	return ans
+}
+
+// Add a sub-task. Its total and progress are added to those of this task and
+// all its ancestors.
+func (self *Progress) AddChild(label string, total int64) *Progress {
+	ans := NewProgress(label, total)
+	ans.FormatAmount, ans.SmoothingWindow, ans.now = self.FormatAmount, self.SmoothingWindow, self.now
+	ans.started_at = ans.now()
+	ans.last_update = ans.started_at
+	ans.parent = self
+	self.children = append(self.children, ans)
+	for p := self; p != nil; p = p.parent {
+		p.total += total
+	}
+	return ans
+}
+
+func (self *Progress) Children() []*Progress { return self.children }
+
+func (self *Progress) Total() int64 { return self.total }
+func (self *Progress) Done() int64  { return self.done }
+
+func (self *Progress) SetTotal(total int64) {
+	delta := total - self.total
+	for p := self; p != nil; p = p.parent {
+		p.total += delta
+	}
+}
+
+// A task is indeterminate if its total, or the total of any of its sub-tasks, is unknown
+func (self *Progress) IsIndeterminate() bool {
+	if self.total <= 0 {
+		return true
+	}
+	for _, c := range self.children {
+		if c.IsIndeterminate() {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Progress) update_rate(amt int64, now time.Time) {
+	dt := now.Sub(self.last_update)
+	if dt <= 0 {
+		// accumulate updates that happen at the same instant
+		if !self.has_rate {
+			return
+		}
+		dt = time.Millisecond
+	}
+	self.last_update = now
+	current := float64(amt) / dt.Seconds()
+	if !self.has_rate {
+		self.rate, self.has_rate = current, true
+		return
+	}
+	alpha := 1.
+	if self.SmoothingWindow > 0 {
+		alpha = 1 - math.Exp(-dt.Seconds()/self.SmoothingWindow.Seconds())
+	}
+	self.rate += alpha * (current - self.rate)
+}
+
+// Record that amt units of work have been done, since the last update
+func (self *Progress) Add(amt int64) {
+	now := self.now()
+	for p := self; p != nil; p = p.parent {
+		p.done += amt
+		p.update_rate(amt, now)
+	}
+}
+
+// Set the total amount of work done so far
+func (self *Progress) SetDone(done int64) {
+	if done != self.done {
+		self.Add(done - self.done)
+	}
+}
+
+// Mark the task as finished, this also marks all its sub-tasks as finished
+func (self *Progress) Finish() {
+	if self.IsFinished() {
+		return
+	}
+	for _, c := range self.children {
+		c.Finish()
+	}
+	if self.total > self.done && len(self.children) == 0 {
+		self.Add(self.total - self.done)
+	}
+	self.finished_at = self.now()
+}
+
+func (self *Progress) IsFinished() bool { return !self.finished_at.IsZero() }
+
+func (self *Progress) Elapsed() time.Duration {
+	if self.IsFinished() {
+		return self.finished_at.Sub(self.started_at)
+	}
+	return self.now().Sub(self.started_at)
+}
+
+// The fraction of work done, between zero and one. Zero for indeterminate tasks.
+func (self *Progress) Fraction() float64 {
+	if self.IsFinished() {
+		return 1
+	}
+	if self.IsIndeterminate() {
+		return 0
+	}
+	return utils.Min(1, float64(self.done)/float64(self.total))
+}
+
+// The smoothed rate at which work is being done, in units per second. For
+// finished tasks this is the average rate.
+func (self *Progress) Rate() float64 {
+	if self.IsFinished() {
+		if e := self.Elapsed().Seconds(); e > 0 {
+			return float64(self.done) / e
+		}
+		return 0
+	}
+	return self.rate
+}
+
+// The estimated time to completion, ok is false if it is not known
+func (self *Progress) ETA() (eta time.Duration, ok bool) {
+	if self.IsFinished() {
+		return 0, true
+	}
+	if self.IsIndeterminate() || self.rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(self.total-self.done) / self.rate * float64(time.Second)), true
+}
+
+func (self *Progress) indeterminate_bar(width int, sprint_styled func(style string, args ...any) string) string {
+	theme := CurrentTheme()
+	sz := utils.Max(1, width/5)
+	span := width - sz
+	if span <= 0 {
+		return sprint_styled(theme.Accent, RepeatChar("🬋", width))
+	}
+	// bounce back and forth, moving one cell every tenth of a second
+	step := int(self.Elapsed()/(100*time.Millisecond)) % (2 * span)
+	if step > span {
+		step = 2*span - step
+	}
+	ans := ""
+	if step > 0 {
+		ans += sprint_styled(theme.Dim, RepeatChar("🬋", step))
+	}
+	ans += sprint_styled(theme.Accent, RepeatChar("🬋", sz))
+	if rest := width - step - sz; rest > 0 {
+		ans += sprint_styled(theme.Dim, RepeatChar("🬋", rest))
+	}
+	return ans
+}
+
+// A line of plain text describing the progress of the task. The percentage
+// done is rounded down to a multiple of ten, so that it changes rarely enough
+// to be announced every time it changes. Used instead of the progress bar in
+// accessible mode.
+func (self *Progress) Announcement() string {
+	switch {
+	case self.IsFinished():
+		return fmt.Sprintf("%s: finished, %s in %s", self.Label, self.FormatAmount(self.done), humanize.ShortDuration(self.Elapsed()))
+	case self.IsIndeterminate():
+		return self.Label + ": in progress"
+	}
+	return fmt.Sprintf("%s: %d%% done", self.Label, int(self.Fraction()*10)*10)
+}
+
+func (self *Progress) render_line(width, indent, label_width int, sprint_styled func(style string, args ...any) string) string {
+	if AccessibleMode() {
+		return fit_to_width(strings.Repeat(" ", indent)+self.Announcement(), width, false)
+	}
+	var stats string
+	rate := self.FormatAmount(int64(self.Rate())) + "/s"
+	switch {
+	case self.IsFinished():
+		stats = fmt.Sprintf("%s @ %s %s", self.FormatAmount(self.done), rate, sprint_styled(CurrentTheme().Success, humanize.ShortDuration(self.Elapsed())))
+	case self.IsIndeterminate():
+		stats = fmt.Sprintf("%s @ %s", self.FormatAmount(self.done), rate)
+	default:
+		eta, ok := self.ETA()
+		es := strings.Repeat(" ", 8)
+		if ok {
+			es = humanize.ShortDuration(eta)
+		}
+		stats = fmt.Sprintf("%3d%% %s/%s @ %s %s", int(self.Fraction()*100), self.FormatAmount(self.done), self.FormatAmount(self.total), rate, es)
+	}
+	stats = " " + stats
+	label := fit_to_width(strings.Repeat(" ", indent)+self.Label, label_width, false)
+	bar_width := width - label_width - wcswidth.Stringwidth(stats) - 1
+	if bar_width < 5 {
+		return fit_to_width(label+stats, width, false)
+	}
+	bar := ""
+	if self.IsIndeterminate() && !self.IsFinished() {
+		bar = self.indeterminate_bar(bar_width, sprint_styled)
+	} else {
+		bar = RenderProgressBar(self.Fraction(), bar_width)
+	}
+	return label + " " + bar + stats
+}
+
+func label_width(width, needed int) int {
+	return utils.Max(0, utils.Min(width/3, needed))
+}
+
+// Render this task as a single line exactly width cells wide, consisting of
+// the label, a progress bar and statistics
+func (self *Progress) Render(width int, sprint_styled func(style string, args ...any) string) string {
+	return self.render_line(width, 0, label_width(width, wcswidth.Stringwidth(self.Label)), sprint_styled)
+}
+
+// Render this task and its sub-tasks, one per line, with sub-tasks indented
+// below their parents and all the bars aligned
+func (self *Progress) Lines(width int, sprint_styled func(style string, args ...any) string) []string {
+	type entry struct {
+		p      *Progress
+		indent int
+	}
+	entries := []entry{}
+	var walk func(p *Progress, indent int)
+	walk = func(p *Progress, indent int) {
+		entries = append(entries, entry{p, indent})
+		for _, c := range p.children {
+			if !(self.HideFinishedChildren && c.IsFinished()) {
+				walk(c, indent+2)
+			}
+		}
+	}
+	walk(self, 0)
+	needed := 0
+	for _, e := range entries {
+		needed = utils.Max(needed, e.indent+wcswidth.Stringwidth(e.p.Label))
+	}
+	lw := label_width(width, needed)
+	return utils.Map(func(e entry) string { return e.p.render_line(width, e.indent, lw, sprint_styled) }, entries)
+}
@@ -0,0 +1,93 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"kitty/tools/wcswidth"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestProgress(t *testing.T) {
+	unstyled := func(style string, args ...any) string { return fmt.Sprint(args...) }
+	now := time.Now()
+	root := NewProgress("Total", 0)
+	root.now = func() time.Time { return now }
+	root.started_at, root.last_update = now, now
+	root.FormatAmount = func(amt int64) string { return strconv.FormatInt(amt, 10) }
+	root.SmoothingWindow = 0
+	a := root.AddChild("a", 100)
+	b := root.AddChild("b", 300)
+	if root.Total() != 400 || root.IsIndeterminate() {
+		t.Fatalf("Totals of children not added to parent: %d", root.Total())
+	}
+
+	now = now.Add(time.Second)
+	a.Add(50)
+	now = now.Add(time.Second)
+	b.SetDone(150)
+	if root.Done() != 200 || root.Fraction() != 0.5 {
+		t.Fatalf("Progress of children not added to parent: %d %v", root.Done(), root.Fraction())
+	}
+	if r := root.Rate(); r != 150 {
+		t.Fatalf("Unexpected rate: %v", r)
+	}
+	if eta, ok := root.ETA(); !ok || eta.Round(time.Millisecond) != 1333*time.Millisecond {
+		t.Fatalf("Unexpected ETA: %v %v", eta, ok)
+	}
+	root.SmoothingWindow, b.SmoothingWindow = 2*time.Second, 2*time.Second
+	now = now.Add(time.Second)
+	b.Add(50)
+	// the smoothed rate moves towards the current rate of 50/s
+	if r := root.Rate(); r <= 50 || r >= 150 {
+		t.Fatalf("Rate not smoothed: %v", r)
+	}
+
+	b.SetTotal(0)
+	if !root.IsIndeterminate() || root.Fraction() != 0 {
+		t.Fatalf("Parent of indeterminate child is not indeterminate")
+	}
+	if _, ok := root.ETA(); ok {
+		t.Fatalf("Indeterminate task has an ETA")
+	}
+	b.SetTotal(300)
+
+	a.Finish()
+	if a.Done() != 100 || root.Done() != 300 || !a.IsFinished() || root.IsFinished() {
+		t.Fatalf("Finishing child failed: %d %d", a.Done(), root.Done())
+	}
+	lines := root.Lines(80, unstyled)
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected lines: %#v", lines)
+	}
+	for _, line := range lines {
+		if w := wcswidth.Stringwidth(line); w != 80 {
+			t.Fatalf("Line %#v has width %d", line, w)
+		}
+	}
+	root.HideFinishedChildren = true
+	if diff := cmp.Diff(lines[0:1], root.Lines(80, unstyled)[0:1]); diff != "" {
+		t.Fatalf("Unexpected lines:\n%s", diff)
+	}
+	if len(root.Lines(80, unstyled)) != 2 {
+		t.Fatalf("Finished children not hidden")
+	}
+
+	now = now.Add(time.Second)
+	root.Finish()
+	if !b.IsFinished() || root.Done() != 400 || root.Rate() != 100 {
+		t.Fatalf("Finishing parent failed: %d %v", root.Done(), root.Rate())
+	}
+	for _, w := range []int{10, 40} {
+		if line := root.Render(w, unstyled); wcswidth.Stringwidth(line) != w {
+			t.Fatalf("Line %#v does not have width %d", line, w)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
+
+	"golang.org/x/exp/slices"
 )
 
 var _ = fmt.Print
@@ -494,6 +496,47 @@ func (self *Readline) history_next(repeat_count uint) bool {
 	return self.history_matches.next(repeat_count, self)
 }
 
+const max_undo_states = 1024
+
+func (self *Readline) record_undo_state(before InputState, ac Action, starts_word bool) {
+	if slices.Equal(before.lines, self.input_state.lines) {
+		// cursor movement ends a run of typing or deleting
+		self.last_edit_action = ActionNil
+		return
+	}
+	// runs of typing or deleting characters are undone together, typing a
+	// word at a time
+	coalesce := ac == self.last_edit_action && (ac == ActionBackspace || ac == ActionDelete || (ac == ActionAddText && !starts_word))
+	if !coalesce || len(self.undo_stack) == 0 {
+		if len(self.undo_stack) >= max_undo_states {
+			self.undo_stack = self.undo_stack[1:]
+		}
+		self.undo_stack = append(self.undo_stack, before)
+	}
+	self.redo_stack = self.redo_stack[:0]
+	self.last_edit_action = ac
+}
+
+func (self *Readline) undo(repeat_count uint) (num_undone uint) {
+	for ; num_undone < repeat_count && len(self.undo_stack) > 0; num_undone++ {
+		self.redo_stack = append(self.redo_stack, self.input_state)
+		self.input_state = self.undo_stack[len(self.undo_stack)-1]
+		self.undo_stack = self.undo_stack[:len(self.undo_stack)-1]
+	}
+	self.last_edit_action = ActionNil
+	return
+}
+
+func (self *Readline) redo(repeat_count uint) (num_redone uint) {
+	for ; num_redone < repeat_count && len(self.redo_stack) > 0; num_redone++ {
+		self.undo_stack = append(self.undo_stack, self.input_state)
+		self.input_state = self.redo_stack[len(self.redo_stack)-1]
+		self.redo_stack = self.redo_stack[:len(self.redo_stack)-1]
+	}
+	self.last_edit_action = ActionNil
+	return
+}
+
 func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error, dont_set_last_action bool) {
 	switch ac {
 	case ActionBackspace:
@@ -653,6 +696,19 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 			self.add_text(text)
 		}
 		return
+	case ActionInsertNewline:
+		if self.history_search == nil {
+			self.add_text(strings.Repeat("\n", int(repeat_count)))
+			return
+		}
+	case ActionUndo:
+		if self.history_search == nil && self.undo(repeat_count) > 0 {
+			return
+		}
+	case ActionRedo:
+		if self.history_search == nil && self.redo(repeat_count) > 0 {
+			return
+		}
 	case ActionTerminateHistorySearchAndRestore:
 		if self.history_search != nil {
 			self.end_history_search(false)
@@ -671,6 +727,22 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.complete(false, repeat_count) {
 			return
 		}
+	case ActionCompleteDown:
+		if self.move_in_completion_menu(true, repeat_count) {
+			return
+		}
+	case ActionCompleteUp:
+		if self.move_in_completion_menu(false, repeat_count) {
+			return
+		}
+	case ActionAcceptCompletion:
+		if self.accept_completion() {
+			return
+		}
+	case ActionCancelCompletion:
+		if self.cancel_completion() {
+			return
+		}
 	}
 	err = ErrCouldNotPerformAction
 	return
@@ -680,7 +752,7 @@ func (self *Readline) perform_action(ac Action, repeat_count uint) error {
 	err, dont_set_last_action := self._perform_action(ac, repeat_count)
 	if err == nil && !dont_set_last_action {
 		self.last_action = ac
-		if self.completions.current.results != nil && ac != ActionCompleteForward && ac != ActionCompleteBackward {
+		if self.completions.current.results != nil && !is_completion_action(ac) {
 			self.completions.current = completion{}
 		}
 	}
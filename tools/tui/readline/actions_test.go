@@ -19,7 +19,7 @@ var _ = fmt.Print
 
 func new_rl() *Readline {
 	lp, _ := loop.New()
-	rl := New(lp, RlInit{Prompt: "$$ "})
+	rl := New(lp, RlInit{Prompt: "$$ ", EditingMode: "emacs"})
 	rl.screen_width = 10
 	rl.screen_height = 100
 	return rl
@@ -538,7 +538,8 @@ func TestReadlineCompletion(t *testing.T) {
 	rl := new_rl()
 	rl.completions.completer = completer
 
-	ah := func(before_cursor, after_cursor string) {
+	ah := func(before_cursor, after_cursor string, expected ...string) {
+		t.Helper()
 		ab := rl.text_upto_cursor_pos()
 		aa := rl.text_after_cursor_pos()
 		if diff := cmp.Diff(before_cursor, ab); diff != "" {
@@ -548,20 +549,178 @@ func TestReadlineCompletion(t *testing.T) {
 			t.Fatalf("Text after cursor not as expected:\n%s", diff)
 		}
 		actual, _ := rl.completion_screen_lines()
-		expected := []string{"a1 a11 a2 "}
 		if diff := cmp.Diff(expected, actual[1:]); diff != "" {
 			t.Fatalf("Completion screen lines not as expected:\n%s", diff)
 		}
 	}
+	hl := rl.highlight_match
 	rl.add_text("a")
 	rl.perform_action(ActionCompleteForward, 1)
-	ah("a", "")
+	ah("a", "", "a1 a11 a2 ")
 	rl.perform_action(ActionCompleteForward, 1)
-	ah("a1 ", "")
+	ah("a1 ", "", hl("a1")+" a11 a2 ")
 	rl.perform_action(ActionCompleteForward, 1)
-	ah("a11 ", "")
+	ah("a11 ", "", "a1 "+hl("a11")+" a2 ")
 	rl.perform_action(ActionCompleteForward, 1)
-	ah("a2 ", "")
+	ah("a2 ", "", "a1 a11 "+hl("a2")+" ")
 	rl.perform_action(ActionCompleteBackward, 1)
-	ah("a11 ", "")
+	ah("a11 ", "", "a1 "+hl("a11")+" a2 ")
+
+	// the completion menu
+	press := func(key string) {
+		t.Helper()
+		ev := loop.KeyEvent{Type: loop.PRESS, Key: key}
+		if err := rl.handle_key_event(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if !ev.Handled {
+			t.Fatalf("The key %s was not handled", key)
+		}
+	}
+	press("LEFT")
+	ah("a1 ", "", hl("a1")+" a11 a2 ")
+	press("UP")
+	ah("a2 ", "", "a1 a11 "+hl("a2")+" ")
+	press("DOWN")
+	ah("a1 ", "", hl("a1")+" a11 a2 ")
+	press("ESCAPE")
+	if !(rl.all_text() == "a" && rl.completions.current.results == nil) {
+		t.Fatalf("Canceling completion did not restore the text: %#v", rl.all_text())
+	}
+	rl.perform_action(ActionCompleteForward, 1)
+	press("RIGHT")
+	press("RIGHT")
+	press("ENTER")
+	if !(rl.all_text() == "a11 " && rl.completions.current.results == nil) {
+		t.Fatalf("Accepting completion did not keep the match: %#v", rl.all_text())
+	}
+	// with the menu inactive, keys have their usual meaning
+	press("LEFT")
+	if rl.input_state.cursor.X != 3 {
+		t.Fatalf("The left arrow key did not move the cursor")
+	}
+
+	c := completion{num_of_matches: 7, group_columns: []int{3, 1}}
+	c.results = &cli.Completions{Groups: []*cli.MatchGroup{{Matches: make([]*cli.Match, 5)}, {Matches: make([]*cli.Match, 2)}}}
+	for _, x := range [][3]int{{-1, 0, 6}, {0, 3, 6}, {1, 4, 6}, {2, 5, 6}, {4, 5, 1}, {5, 6, 4}, {6, 0, 5}} {
+		c.current_match = x[0]
+		if down, up := c.match_in_adjacent_row(true), c.match_in_adjacent_row(false); down != x[1] || up != x[2] {
+			t.Fatalf("Moving from match %d: down: %d up: %d, expected: %v", x[0], down, up, x[1:])
+		}
+	}
+}
+
+func TestUndo(t *testing.T) {
+	rl := new_rl()
+	type_text := func(text string) {
+		for _, ch := range text {
+			if err := rl.OnText(string(ch), true, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ac := func(ac Action, expected string) {
+		rl.dispatch_key_action(ac)
+		if actual := rl.all_text(); actual != expected {
+			t.Fatalf("Text after %s not as expected: %#v != %#v", ac, expected, actual)
+		}
+	}
+	type_text("one two")
+	ac(ActionInsertNewline, "one two\n")
+	type_text("three")
+	ac(ActionBackspace, "one two\nthre")
+	ac(ActionBackspace, "one two\nthr")
+	ac(ActionUndo, "one two\nthree")
+	ac(ActionUndo, "one two\n")
+	ac(ActionUndo, "one two")
+	ac(ActionUndo, "one")
+	ac(ActionRedo, "one two")
+	ac(ActionCursorLeft, "one two")
+	ac(ActionBackspace, "one to")
+	if len(rl.redo_stack) != 0 {
+		t.Fatalf("Redo stack not cleared by an edit")
+	}
+	ac(ActionUndo, "one two")
+	if rl.text_upto_cursor_pos() != "one tw" {
+		t.Fatalf("Cursor position not restored by undo: %#v", rl.text_upto_cursor_pos())
+	}
+
+	rl = New(rl.loop, RlInit{MultiLine: true, EditingMode: "emacs"})
+	enter := loop.KeyEvent{Type: loop.PRESS, Key: "ENTER"}
+	type_text("a")
+	if err := rl.OnKeyEvent(&enter); err != nil || rl.all_text() != "a\n" {
+		t.Fatalf("Enter did not insert a new line in multi-line mode: %v %#v", err, rl.all_text())
+	}
+	enter.Mods = loop.ALT
+	if err := rl.OnKeyEvent(&enter); err != ErrAcceptInput {
+		t.Fatalf("alt+enter did not accept the input in multi-line mode: %v", err)
+	}
+}
+
+func TestViMode(t *testing.T) {
+	rl := New(nil, RlInit{EditingMode: "vi"})
+	rl.loop, _ = loop.New()
+	key := func(k string) {
+		t.Helper()
+		if err := rl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: k}); err != nil {
+			t.Fatalf("Key %s failed with error: %s", k, err)
+		}
+	}
+	vi := func(keys string, expected_text string, expected_cursor int) {
+		t.Helper()
+		if !rl.vi.normal_mode {
+			key("ESCAPE")
+		}
+		if !rl.handle_vi_text(keys) {
+			t.Fatalf("The vi command %#v failed", keys)
+		}
+		if actual := rl.all_text(); actual != expected_text {
+			t.Fatalf("Text after %#v not as expected: %#v != %#v", keys, expected_text, actual)
+		}
+		if actual := len(rl.text_upto_cursor_pos()); actual != expected_cursor {
+			t.Fatalf("Cursor position after %#v not as expected: %d != %d", keys, expected_cursor, actual)
+		}
+	}
+	rl.OnText("one two.three  four", true, false)
+	key("ESCAPE")
+	if !rl.vi.normal_mode || rl.input_state.cursor.X != 18 {
+		t.Fatalf("Escape did not switch to normal mode: %d", rl.input_state.cursor.X)
+	}
+	vi("0", "one two.three  four", 0)
+	vi("w", "one two.three  four", 4)
+	vi("2w", "one two.three  four", 8)
+	vi("b", "one two.three  four", 7)
+	vi("0W", "one two.three  four", 4)
+	vi("E", "one two.three  four", 12)
+	vi("$", "one two.three  four", 18)
+	vi("0fe", "one two.three  four", 2)
+	vi(";", "one two.three  four", 11)
+	vi("0dw", "two.three  four", 0)
+	vi("d2e", "three  four", 0)
+	vi("ediw", "  four", 0)
+	vi("u", "three  four", 4)
+	vi("daw", "four", 0)
+	vi("\"ayiw", "four", 0)
+	vi("0\"ap", "ffourour", 4)
+	vi("x", "ffouour", 4)
+	vi("cwab", "ffouab", 6)
+	vi("~", "ffouaB", 5)
+	vi("0r-", "-fouaB", 0)
+	vi("ccnew", "new", 3)
+
+	rl.SetText("a\nb\nc")
+	vi("ggyyjp", "a\nb\na\nc", 4)
+	vi("2ddk", "a\nb", 0)
+	vi("P", "a\nc\na\nb", 0)
+	vi("3x", "\nc\na\nb", 0)
+	vi("Oz", "z\n\nc\na\nb", 1)
+	key("ESCAPE")
+	rl.OnText("2dd", true, false)
+	if rl.all_text() != "c\na\nb" {
+		t.Fatalf("Typed vi command failed: %#v", rl.all_text())
+	}
+	rl.ResetText()
+	if rl.vi.normal_mode {
+		t.Fatalf("Resetting text did not switch to insert mode")
+	}
 }
@@ -30,6 +30,10 @@ type RlInit struct {
 	DontMarkPrompts         bool
 	SyntaxHighlighter       SyntaxHighlightFunction
 	Completer               CompleterFunction
+	// When true, the enter key inserts a new line and ctrl+enter or alt+enter accepts the input
+	MultiLine bool
+	// Either "emacs" or "vi", defaults to the editing-mode set in the inputrc file of GNU readline
+	EditingMode string
 }
 
 type Position struct {
@@ -131,6 +135,10 @@ type Readline struct {
 	text_to_be_added       string
 	syntax_highlighted     syntax_highlighted
 	completions            completions
+	multiline              bool
+	undo_stack, redo_stack []InputState
+	last_edit_action       Action
+	vi                     *vi_state
 }
 
 func (self *Readline) make_prompt(text string, is_secondary bool) Prompt {
@@ -155,6 +163,10 @@ func New(loop *loop.Loop, r RlInit) *Readline {
 		syntax_highlighted: syntax_highlighted{highlighter: r.SyntaxHighlighter},
 		completions:        completions{completer: r.Completer},
 		kill_ring:          kill_ring{items: list.New().Init()},
+		multiline:          r.MultiLine,
+	}
+	if mode := r.EditingMode; mode == "vi" || (mode == "" && InputrcEditingMode() == "vi") {
+		ans.vi = &vi_state{registers: make(map[rune]vi_register)}
 	}
 	if ans.completions.completer == nil && r.HistoryPath != "" {
 		ans.completions.completer = ans.HistoryCompleter
@@ -175,6 +187,16 @@ func (self *Readline) HistoryCompleter(before_cursor, after_cursor string) *cli.
 	return self.history_completer(before_cursor, after_cursor)
 }
 
+// Change the function used to syntax highlight the input text, nil means no highlighting
+func (self *Readline) SetSyntaxHighlighter(f SyntaxHighlightFunction) {
+	self.syntax_highlighted = syntax_highlighted{highlighter: f}
+}
+
+// Change the function used to generate completions, nil means no completion
+func (self *Readline) SetCompleter(f CompleterFunction) {
+	self.completions = completions{completer: f}
+}
+
 func (self *Readline) SetPrompt(prompt string) {
 	self.prompt = self.make_prompt(prompt, false)
 }
@@ -194,6 +216,10 @@ func (self *Readline) ResetText() {
 	self.history_search = nil
 	self.completions.current = completion{}
 	self.cursor_y = 0
+	self.undo_stack, self.redo_stack, self.last_edit_action = nil, nil, ActionNil
+	if self.vi != nil {
+		self.vi.normal_mode, self.vi.pending = false, nil
+	}
 }
 
 func (self *Readline) ChangeLoopAndResetText(lp *loop.Loop) {
@@ -244,10 +270,18 @@ func (self *Readline) OnText(text string, from_key_event bool, in_bracketed_past
 		self.bracketed_paste_buffer.WriteString(text)
 		return nil
 	}
+	pasted := false
 	if self.bracketed_paste_buffer.Len() > 0 {
 		self.bracketed_paste_buffer.WriteString(text)
 		text = self.bracketed_paste_buffer.String()
 		self.bracketed_paste_buffer.Reset()
+		pasted = true
+	}
+	if self.vi != nil && self.vi.normal_mode && self.history_search == nil && !pasted {
+		if !self.handle_vi_text(text) {
+			self.loop.Beep()
+		}
+		return nil
 	}
 	self.text_to_be_added = text
 	return self.dispatch_key_action(ActionAddText)
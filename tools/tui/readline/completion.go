@@ -8,6 +8,7 @@ import (
 
 	"kitty/tools/cli"
 	"kitty/tools/utils"
+	"kitty/tools/utils/style"
 	"kitty/tools/wcswidth"
 )
 
@@ -19,8 +20,11 @@ type completion struct {
 	results_displayed, forwards   bool
 	num_of_matches, current_match int
 	rendered_at_screen_width      int
+	rendered_for_match            int
 	rendered_lines                []string
 	last_rendered_above           bool
+	// The number of columns the matches in each group are laid out in
+	group_columns []int
 }
 
 func (self *completion) initialize() {
@@ -58,17 +62,81 @@ func (self *completion) current_match_text() string {
 	return ""
 }
 
+// The match in the row above or below the current match, as laid out on
+// screen, moving into the adjacent group at the first or last row of a group
+func (self *completion) match_in_adjacent_row(down bool) int {
+	if self.current_match < 0 || self.current_match >= self.num_of_matches {
+		if down {
+			return 0
+		}
+		return self.num_of_matches - 1
+	}
+	start := 0
+	for i, g := range self.results.Groups {
+		end := start + len(g.Matches)
+		if self.current_match < end {
+			ncols := 1
+			if i < len(self.group_columns) {
+				ncols = self.group_columns[i]
+			}
+			if down {
+				if self.current_match+ncols < end {
+					return self.current_match + ncols
+				}
+				return end % self.num_of_matches
+			}
+			if self.current_match-ncols >= start {
+				return self.current_match - ncols
+			}
+			return (start - 1 + self.num_of_matches) % self.num_of_matches
+		}
+		start = end
+	}
+	return self.current_match
+}
+
 type completions struct {
 	completer CompleterFunction
 	current   completion
 }
 
+func is_completion_action(ac Action) bool {
+	switch ac {
+	case ActionCompleteForward, ActionCompleteBackward, ActionCompleteDown, ActionCompleteUp:
+		return true
+	}
+	return false
+}
+
+// The completion menu is active while the list of matches is displayed
+// following a completion action. While it is active, the arrow keys move
+// between matches, enter accepts the current match and esc restores the
+// text from before completion.
+func (self *Readline) completion_menu_is_active() bool {
+	c := &self.completions.current
+	return c.results != nil && c.num_of_matches > 1 && is_completion_action(self.last_action)
+}
+
+func (self *Readline) replace_text_around_cursor(before, after string) {
+	self.input_state.lines = utils.Splitlines(before)
+	if len(self.input_state.lines) == 0 {
+		self.input_state.lines = []string{""}
+	}
+	self.input_state.cursor.Y = len(self.input_state.lines) - 1
+	self.input_state.cursor.X = len(self.input_state.lines[self.input_state.cursor.Y])
+	al := utils.Splitlines(after)
+	if len(al) > 0 {
+		self.input_state.lines[self.input_state.cursor.Y] += al[0]
+		self.input_state.lines = append(self.input_state.lines, al[1:]...)
+	}
+}
+
 func (self *Readline) complete(forwards bool, repeat_count uint) bool {
 	c := &self.completions
 	if c.completer == nil {
 		return false
 	}
-	if self.last_action == ActionCompleteForward || self.last_action == ActionCompleteBackward {
+	if is_completion_action(self.last_action) {
 		if c.current.num_of_matches == 0 {
 			return false
 		}
@@ -100,19 +168,7 @@ func (self *Readline) complete(forwards bool, repeat_count uint) bool {
 	ct := c.current.current_match_text()
 	if ct != "" {
 		all_text_before_completion := self.AllText()
-		before := c.current.before_cursor[:c.current.results.CurrentWordIdx] + ct
-		after := c.current.after_cursor
-		self.input_state.lines = utils.Splitlines(before)
-		if len(self.input_state.lines) == 0 {
-			self.input_state.lines = []string{""}
-		}
-		self.input_state.cursor.Y = len(self.input_state.lines) - 1
-		self.input_state.cursor.X = len(self.input_state.lines[self.input_state.cursor.Y])
-		al := utils.Splitlines(after)
-		if len(al) > 0 {
-			self.input_state.lines[self.input_state.cursor.Y] += al[0]
-			self.input_state.lines = append(self.input_state.lines, al[1:]...)
-		}
+		self.replace_text_around_cursor(c.current.before_cursor[:c.current.results.CurrentWordIdx]+ct, c.current.after_cursor)
 		if c.current.num_of_matches == 1 && self.AllText() == all_text_before_completion {
 			// when there is only a single match and it has already been inserted there is no point iterating over current completions
 			orig := self.last_action
@@ -127,7 +183,50 @@ func (self *Readline) complete(forwards bool, repeat_count uint) bool {
 	return true
 }
 
-func (self *Readline) screen_lines_for_match_group_with_descriptions(g *cli.MatchGroup, lines []string) []string {
+func (self *Readline) move_in_completion_menu(down bool, repeat_count uint) bool {
+	if !self.completion_menu_is_active() {
+		return false
+	}
+	c := &self.completions.current
+	// ensure the number of columns in each group is known
+	self.completion_screen_lines()
+	for ; repeat_count > 0; repeat_count-- {
+		c.current_match = c.match_in_adjacent_row(down)
+	}
+	self.replace_text_around_cursor(c.before_cursor[:c.results.CurrentWordIdx]+c.current_match_text(), c.after_cursor)
+	return true
+}
+
+func (self *Readline) accept_completion() bool {
+	if !self.completion_menu_is_active() {
+		return false
+	}
+	self.completions.current = completion{}
+	return true
+}
+
+func (self *Readline) cancel_completion() bool {
+	if !self.completion_menu_is_active() {
+		return false
+	}
+	self.replace_text_around_cursor(self.completions.current.before_cursor, self.completions.current.after_cursor)
+	self.completions.current = completion{}
+	return true
+}
+
+var highlight_current_match = utils.Once(func() func(args ...any) string {
+	ctx := style.Context{AllowEscapeCodes: true}
+	return ctx.SprintFunc("reverse=true")
+})
+
+func (self *Readline) highlight_match(text string) string {
+	if !self.fmt_ctx.EscapeCodesAllowed() {
+		return text
+	}
+	return highlight_current_match()(text)
+}
+
+func (self *Readline) screen_lines_for_match_group_with_descriptions(g *cli.MatchGroup, lines []string, current int) []string {
 	maxw := 0
 	for _, m := range g.Matches {
 		l := wcswidth.Stringwidth(m.Word)
@@ -139,8 +238,12 @@ func (self *Readline) screen_lines_for_match_group_with_descriptions(g *cli.Matc
 			maxw = l
 		}
 	}
-	for _, m := range g.Matches {
-		lines = append(lines, utils.Splitlines(m.FormatForCompletionList(maxw, self.fmt_ctx, self.screen_width))...)
+	for i, m := range g.Matches {
+		ml := utils.Splitlines(m.FormatForCompletionList(maxw, self.fmt_ctx, self.screen_width))
+		if i == current && len(ml) > 0 && strings.HasPrefix(ml[0], m.Word) {
+			ml[0] = self.highlight_match(m.Word) + ml[0][len(m.Word):]
+		}
+		lines = append(lines, ml...)
 	}
 	return lines
 }
@@ -199,7 +302,7 @@ func layout_words_in_table(words []string, lengths map[string]int, num_cols int)
 	return cols, total_length
 }
 
-func (self *Readline) screen_lines_for_match_group_without_descriptions(g *cli.MatchGroup, lines []string) []string {
+func (self *Readline) screen_lines_for_match_group_without_descriptions(g *cli.MatchGroup, lines []string, current int) ([]string, int) {
 	words := make([]string, len(g.Matches))
 	lengths := make(map[string]int, len(words))
 	max_length := 0
@@ -222,39 +325,54 @@ func (self *Readline) screen_lines_for_match_group_without_descriptions(g *cli.M
 		ncols++
 	}
 	if ans == nil {
-		for _, w := range words {
+		for i, w := range words {
 			if lengths[w] > self.screen_width {
-				lines = append(lines, wcswidth.TruncateToVisualLength(w, self.screen_width))
-			} else {
-				lines = append(lines, w)
+				w = wcswidth.TruncateToVisualLength(w, self.screen_width)
+			}
+			if i == current {
+				w = self.highlight_match(w)
 			}
+			lines = append(lines, w)
 		}
-	} else {
-		for r := 0; r < len(ans[0].cells); r++ {
-			w := strings.Builder{}
-			w.Grow(self.screen_width)
-			for c := 0; c < len(ans); c++ {
-				cell := ans[c].cells[r]
+		return lines, 1
+	}
+	for r := 0; r < len(ans[0].cells); r++ {
+		w := strings.Builder{}
+		w.Grow(self.screen_width)
+		for c := 0; c < len(ans); c++ {
+			cell := ans[c].cells[r]
+			if r*len(ans)+c == current {
+				w.WriteString(self.highlight_match(cell.text))
+			} else {
 				w.WriteString(cell.text)
-				if !ans[c].is_last {
-					w.WriteString(cell.whitespace(ans[c].length))
-				}
 			}
-			lines = append(lines, w.String())
+			if !ans[c].is_last {
+				w.WriteString(cell.whitespace(ans[c].length))
+			}
 		}
+		lines = append(lines, w.String())
 	}
-	return lines
+	return lines, len(ans)
 }
 
 func (self *Readline) completion_screen_lines() ([]string, bool) {
 	if self.completions.current.results == nil || self.completions.current.num_of_matches < 2 {
 		return []string{}, false
 	}
-	if len(self.completions.current.rendered_lines) > 0 && self.completions.current.rendered_at_screen_width == self.screen_width {
-		return self.completions.current.rendered_lines, true
+	c := &self.completions.current
+	if len(c.rendered_lines) > 0 && c.rendered_at_screen_width == self.screen_width && c.rendered_for_match == c.current_match {
+		return c.rendered_lines, true
 	}
-	lines := make([]string, 0, self.completions.current.num_of_matches)
-	for _, g := range self.completions.current.results.Groups {
+	lines := make([]string, 0, c.num_of_matches)
+	c.group_columns = make([]int, len(c.results.Groups))
+	first_match := 0
+	for i, g := range c.results.Groups {
+		c.group_columns[i] = 1
+		current := c.current_match - first_match
+		if current >= len(g.Matches) {
+			current = -1
+		}
+		first_match += len(g.Matches)
 		if len(g.Matches) == 0 {
 			continue
 		}
@@ -269,12 +387,13 @@ func (self *Readline) completion_screen_lines() ([]string, bool) {
 			}
 		}
 		if has_descriptions {
-			lines = self.screen_lines_for_match_group_with_descriptions(g, lines)
+			lines = self.screen_lines_for_match_group_with_descriptions(g, lines, current)
 		} else {
-			lines = self.screen_lines_for_match_group_without_descriptions(g, lines)
+			lines, c.group_columns[i] = self.screen_lines_for_match_group_without_descriptions(g, lines, current)
 		}
 	}
-	self.completions.current.rendered_lines = lines
-	self.completions.current.rendered_at_screen_width = self.screen_width
+	c.rendered_lines = lines
+	c.rendered_at_screen_width = self.screen_width
+	c.rendered_for_match = c.current_match
 	return lines, false
 }
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"kitty/tools/tui/loop"
 	"kitty/tools/tui/shortcuts"
@@ -21,82 +23,102 @@ type KeyboardState struct {
 	current_numeric_argument string
 }
 
-var _default_shortcuts *ShortcutMap
+var _default_shortcuts, _multiline_shortcuts *ShortcutMap
 
 func default_shortcuts() *ShortcutMap {
 	if _default_shortcuts == nil {
-		sm := shortcuts.New[Action]()
-		sm.AddOrPanic(ActionBackspace, "backspace")
-		sm.AddOrPanic(ActionBackspace, "ctrl+h")
-		sm.AddOrPanic(ActionDelete, "delete")
-
-		sm.AddOrPanic(ActionMoveToStartOfLine, "home")
-		sm.AddOrPanic(ActionMoveToStartOfLine, "ctrl+a")
-
-		sm.AddOrPanic(ActionMoveToEndOfLine, "end")
-		sm.AddOrPanic(ActionMoveToEndOfLine, "ctrl+e")
-
-		sm.AddOrPanic(ActionMoveToStartOfDocument, "ctrl+home")
-		sm.AddOrPanic(ActionMoveToEndOfDocument, "ctrl+end")
-
-		sm.AddOrPanic(ActionMoveToEndOfWord, "alt+f")
-		sm.AddOrPanic(ActionMoveToEndOfWord, "ctrl+right")
-		sm.AddOrPanic(ActionMoveToEndOfWord, "alt+right")
-		sm.AddOrPanic(ActionMoveToStartOfWord, "ctrl+left")
-		sm.AddOrPanic(ActionMoveToStartOfWord, "alt+left")
-		sm.AddOrPanic(ActionMoveToStartOfWord, "alt+b")
-
-		sm.AddOrPanic(ActionCursorLeft, "left")
-		sm.AddOrPanic(ActionCursorLeft, "ctrl+b")
-		sm.AddOrPanic(ActionCursorRight, "right")
-		sm.AddOrPanic(ActionCursorRight, "ctrl+f")
-
-		sm.AddOrPanic(ActionClearScreen, "ctrl+l")
-		sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+c")
-		sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+g")
-
-		sm.AddOrPanic(ActionEndInput, "ctrl+d")
-		sm.AddOrPanic(ActionAcceptInput, "enter")
-
-		sm.AddOrPanic(ActionKillToEndOfLine, "ctrl+k")
-		sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+x")
-		sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+u")
-		sm.AddOrPanic(ActionKillNextWord, "alt+d")
-		sm.AddOrPanic(ActionKillPreviousWord, "alt+backspace")
-		sm.AddOrPanic(ActionKillPreviousSpaceDelimitedWord, "ctrl+w")
-		sm.AddOrPanic(ActionYank, "ctrl+y")
-		sm.AddOrPanic(ActionPopYank, "alt+y")
-
-		sm.AddOrPanic(ActionHistoryPreviousOrCursorUp, "up")
-		sm.AddOrPanic(ActionHistoryNextOrCursorDown, "down")
-		sm.AddOrPanic(ActionHistoryPrevious, "ctrl+p")
-		sm.AddOrPanic(ActionHistoryNext, "ctrl+n")
-		sm.AddOrPanic(ActionHistoryFirst, "alt+<")
-		sm.AddOrPanic(ActionHistoryLast, "alt+>")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+r")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+?")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+s")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+/")
-
-		sm.AddOrPanic(ActionNumericArgumentDigit0, "alt+0")
-		sm.AddOrPanic(ActionNumericArgumentDigit1, "alt+1")
-		sm.AddOrPanic(ActionNumericArgumentDigit2, "alt+2")
-		sm.AddOrPanic(ActionNumericArgumentDigit3, "alt+3")
-		sm.AddOrPanic(ActionNumericArgumentDigit4, "alt+4")
-		sm.AddOrPanic(ActionNumericArgumentDigit5, "alt+5")
-		sm.AddOrPanic(ActionNumericArgumentDigit6, "alt+6")
-		sm.AddOrPanic(ActionNumericArgumentDigit7, "alt+7")
-		sm.AddOrPanic(ActionNumericArgumentDigit8, "alt+8")
-		sm.AddOrPanic(ActionNumericArgumentDigit9, "alt+9")
-		sm.AddOrPanic(ActionNumericArgumentDigitMinus, "alt+-")
-
-		sm.AddOrPanic(ActionCompleteForward, "Tab")
-		sm.AddOrPanic(ActionCompleteBackward, "Shift+Tab")
-		_default_shortcuts = sm
+		_default_shortcuts = shortcuts.New[Action]()
+		add_default_shortcuts(_default_shortcuts)
 	}
 	return _default_shortcuts
 }
 
+func multiline_shortcuts() *ShortcutMap {
+	if _multiline_shortcuts == nil {
+		sm := shortcuts.New[Action]()
+		add_default_shortcuts(sm)
+		sm.Add(ActionInsertNewline, "enter")
+		sm.AddOrPanic(ActionAcceptInput, "ctrl+enter")
+		sm.AddOrPanic(ActionAcceptInput, "alt+enter")
+		_multiline_shortcuts = sm
+	}
+	return _multiline_shortcuts
+}
+
+func add_default_shortcuts(sm *ShortcutMap) {
+	sm.AddOrPanic(ActionBackspace, "backspace")
+	sm.AddOrPanic(ActionBackspace, "ctrl+h")
+	sm.AddOrPanic(ActionDelete, "delete")
+
+	sm.AddOrPanic(ActionMoveToStartOfLine, "home")
+	sm.AddOrPanic(ActionMoveToStartOfLine, "ctrl+a")
+
+	sm.AddOrPanic(ActionMoveToEndOfLine, "end")
+	sm.AddOrPanic(ActionMoveToEndOfLine, "ctrl+e")
+
+	sm.AddOrPanic(ActionMoveToStartOfDocument, "ctrl+home")
+	sm.AddOrPanic(ActionMoveToEndOfDocument, "ctrl+end")
+
+	sm.AddOrPanic(ActionMoveToEndOfWord, "alt+f")
+	sm.AddOrPanic(ActionMoveToEndOfWord, "ctrl+right")
+	sm.AddOrPanic(ActionMoveToEndOfWord, "alt+right")
+	sm.AddOrPanic(ActionMoveToStartOfWord, "ctrl+left")
+	sm.AddOrPanic(ActionMoveToStartOfWord, "alt+left")
+	sm.AddOrPanic(ActionMoveToStartOfWord, "alt+b")
+
+	sm.AddOrPanic(ActionCursorLeft, "left")
+	sm.AddOrPanic(ActionCursorLeft, "ctrl+b")
+	sm.AddOrPanic(ActionCursorRight, "right")
+	sm.AddOrPanic(ActionCursorRight, "ctrl+f")
+
+	sm.AddOrPanic(ActionClearScreen, "ctrl+l")
+	sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+c")
+	sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+g")
+
+	sm.AddOrPanic(ActionEndInput, "ctrl+d")
+	sm.AddOrPanic(ActionAcceptInput, "enter")
+	sm.AddOrPanic(ActionInsertNewline, "shift+enter")
+
+	sm.AddOrPanic(ActionKillToEndOfLine, "ctrl+k")
+	sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+x")
+	sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+u")
+	sm.AddOrPanic(ActionKillNextWord, "alt+d")
+	sm.AddOrPanic(ActionKillPreviousWord, "alt+backspace")
+	sm.AddOrPanic(ActionKillPreviousSpaceDelimitedWord, "ctrl+w")
+	sm.AddOrPanic(ActionYank, "ctrl+y")
+	sm.AddOrPanic(ActionPopYank, "alt+y")
+
+	sm.AddOrPanic(ActionHistoryPreviousOrCursorUp, "up")
+	sm.AddOrPanic(ActionHistoryNextOrCursorDown, "down")
+	sm.AddOrPanic(ActionHistoryPrevious, "ctrl+p")
+	sm.AddOrPanic(ActionHistoryNext, "ctrl+n")
+	sm.AddOrPanic(ActionHistoryFirst, "alt+<")
+	sm.AddOrPanic(ActionHistoryLast, "alt+>")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+r")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+?")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+s")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+/")
+
+	sm.AddOrPanic(ActionNumericArgumentDigit0, "alt+0")
+	sm.AddOrPanic(ActionNumericArgumentDigit1, "alt+1")
+	sm.AddOrPanic(ActionNumericArgumentDigit2, "alt+2")
+	sm.AddOrPanic(ActionNumericArgumentDigit3, "alt+3")
+	sm.AddOrPanic(ActionNumericArgumentDigit4, "alt+4")
+	sm.AddOrPanic(ActionNumericArgumentDigit5, "alt+5")
+	sm.AddOrPanic(ActionNumericArgumentDigit6, "alt+6")
+	sm.AddOrPanic(ActionNumericArgumentDigit7, "alt+7")
+	sm.AddOrPanic(ActionNumericArgumentDigit8, "alt+8")
+	sm.AddOrPanic(ActionNumericArgumentDigit9, "alt+9")
+	sm.AddOrPanic(ActionNumericArgumentDigitMinus, "alt+-")
+
+	sm.AddOrPanic(ActionCompleteForward, "Tab")
+	sm.AddOrPanic(ActionCompleteBackward, "Shift+Tab")
+
+	sm.AddOrPanic(ActionUndo, "ctrl+_")
+	sm.AddOrPanic(ActionRedo, "alt+_")
+	sm.AddOrPanic(ActionRedo, "ctrl+shift+z")
+}
+
 var _history_search_shortcuts *shortcuts.ShortcutMap[Action]
 
 func history_search_shortcuts() *shortcuts.ShortcutMap[Action] {
@@ -139,6 +161,23 @@ func history_search_shortcuts() *shortcuts.ShortcutMap[Action] {
 	return _history_search_shortcuts
 }
 
+var _completion_menu_shortcuts *ShortcutMap
+
+// Shortcuts that take precedence over the normal ones while the completion menu is active
+func completion_menu_shortcuts() *ShortcutMap {
+	if _completion_menu_shortcuts == nil {
+		sm := shortcuts.New[Action]()
+		sm.AddOrPanic(ActionCompleteForward, "right")
+		sm.AddOrPanic(ActionCompleteBackward, "left")
+		sm.AddOrPanic(ActionCompleteDown, "down")
+		sm.AddOrPanic(ActionCompleteUp, "up")
+		sm.AddOrPanic(ActionAcceptCompletion, "enter")
+		sm.AddOrPanic(ActionCancelCompletion, "escape")
+		_completion_menu_shortcuts = sm
+	}
+	return _completion_menu_shortcuts
+}
+
 var ErrCouldNotPerformAction = errors.New("Could not perform the specified action")
 var ErrAcceptInput = errors.New("Accept input")
 
@@ -195,14 +234,36 @@ func (self *Readline) dispatch_key_action(ac Action) error {
 	if err != nil || repeat_count <= 0 {
 		repeat_count = 1
 	}
-	return self.perform_action(ac, uint(repeat_count))
+	if ac == ActionUndo || ac == ActionRedo {
+		return self.perform_action(ac, uint(repeat_count))
+	}
+	before := self.input_state.copy()
+	starts_word := ac == ActionAddText && strings.IndexFunc(self.text_to_be_added, unicode.IsSpace) == 0
+	if err = self.perform_action(ac, uint(repeat_count)); err == nil {
+		self.record_undo_state(before, ac, starts_word)
+	}
+	return err
 }
 
 func (self *Readline) handle_key_event(event *loop.KeyEvent) error {
+	if len(self.keyboard_state.current_pending_keys) == 0 && self.completion_menu_is_active() {
+		if ac, _ := completion_menu_shortcuts().ResolveKeyEvent(event); ac != ActionNil {
+			event.Handled = true
+			return self.dispatch_key_action(ac)
+		}
+	}
+	if self.vi != nil {
+		if handled, err := self.handle_vi_key_event(event); handled {
+			return err
+		}
+	}
 	if event.Text != "" {
 		return nil
 	}
 	sm := default_shortcuts()
+	if self.multiline {
+		sm = multiline_shortcuts()
+	}
 	if len(self.keyboard_state.active_shortcut_maps) > 0 {
 		sm = self.keyboard_state.active_shortcut_maps[len(self.keyboard_state.active_shortcut_maps)-1]
 	}
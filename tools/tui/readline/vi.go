@@ -0,0 +1,768 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The editing mode set in the inputrc file used by GNU readline, either
+// "emacs" or "vi"
+var InputrcEditingMode = utils.Once(func() string {
+	ans := "emacs"
+	path := os.Getenv("INPUTRC")
+	if path == "" {
+		path = utils.Expanduser("~/.inputrc")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if f, err = os.Open("/etc/inputrc"); err != nil {
+			return ans
+		}
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "set" && strings.ToLower(fields[1]) == "editing-mode" {
+			if q := strings.ToLower(fields[2]); q == "vi" || q == "emacs" {
+				ans = q
+			}
+		}
+	}
+	return ans
+})
+
+type vi_register struct {
+	text     string
+	linewise bool
+}
+
+type vi_state struct {
+	normal_mode bool
+	// the keys of the normal mode command being typed
+	pending   []rune
+	registers map[rune]vi_register
+	last_find struct{ motion, arg string }
+}
+
+type vi_command struct {
+	register            rune
+	op, motion, arg     string
+	count, motion_count int
+}
+
+const vi_motions = "hl0^$wWbBeEfFtT;,jkG"
+const vi_commands = "iaIAoOxXDCsSYpP~u/"
+
+// Parse the keys of a normal mode command, complete is false if more keys are needed
+func parse_vi_command(keys []rune) (ans vi_command, complete bool, err error) {
+	i := 0
+	next := func() (string, bool) {
+		if i >= len(keys) {
+			return "", false
+		}
+		i++
+		return string(keys[i-1]), true
+	}
+	count := func() int {
+		n := 0
+		for i < len(keys) && (('1' <= keys[i] && keys[i] <= '9') || (n > 0 && keys[i] == '0')) {
+			n = n*10 + int(keys[i]-'0')
+			i++
+		}
+		return n
+	}
+	invalid := func(k string) (vi_command, bool, error) {
+		return ans, false, fmt.Errorf("Unknown vi command: %s", k)
+	}
+	// parses a motion, including the second key of motions such as f and gg
+	motion := func(allow_text_objects bool) (bool, error) {
+		m, ok := next()
+		if !ok {
+			return false, nil
+		}
+		switch {
+		case m == "g":
+			if k, ok := next(); !ok {
+				return false, nil
+			} else if k != "g" {
+				_, _, err = invalid(m + k)
+				return false, err
+			}
+			ans.motion = "gg"
+		case strings.Contains("fFtT", m):
+			if ans.arg, ok = next(); !ok {
+				return false, nil
+			}
+			ans.motion = m
+		case allow_text_objects && (m == "i" || m == "a"):
+			k, ok := next()
+			if !ok {
+				return false, nil
+			}
+			if k != "w" && k != "W" {
+				_, _, err = invalid(m + k)
+				return false, err
+			}
+			ans.motion = m + k
+		case strings.Contains(vi_motions, m):
+			ans.motion = m
+		default:
+			_, _, err = invalid(m)
+			return false, err
+		}
+		return true, nil
+	}
+
+	if i < len(keys) && keys[i] == '"' {
+		i++
+		if i >= len(keys) {
+			return
+		}
+		ans.register = keys[i]
+		if !(ans.register == '"' || ans.register == '_' || unicode.IsDigit(ans.register) || ('a' <= ans.register && ans.register <= 'z') || ('A' <= ans.register && ans.register <= 'Z')) {
+			return invalid(`"` + string(ans.register))
+		}
+		i++
+	}
+	ans.count = count()
+	c, ok := next()
+	if !ok {
+		return
+	}
+	switch {
+	case c == "d" || c == "c" || c == "y":
+		ans.op = c
+		ans.motion_count = count()
+		if i < len(keys) && string(keys[i]) == c {
+			i++
+			ans.motion = c
+			return ans, true, nil
+		}
+		complete, err = motion(true)
+		return
+	case c == "r":
+		if ans.arg, ok = next(); !ok {
+			return
+		}
+		ans.motion = c
+		return ans, true, nil
+	case c == "g" || strings.Contains(vi_motions, c):
+		i--
+		complete, err = motion(false)
+		return
+	case strings.Contains(vi_commands, c):
+		ans.motion = c
+		return ans, true, nil
+	}
+	return invalid(c)
+}
+
+func vi_char_class(r rune, big bool) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case big || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return 1
+	}
+	return 2
+}
+
+func next_char(text string, pos int) int {
+	if pos >= len(text) {
+		return len(text)
+	}
+	_, sz := utf8.DecodeRuneInString(text[pos:])
+	return pos + sz
+}
+
+func prev_char(text string, pos int) int {
+	if pos <= 0 {
+		return 0
+	}
+	_, sz := utf8.DecodeLastRuneInString(text[:pos])
+	return pos - sz
+}
+
+func class_at(text string, pos int, big bool) int {
+	if pos >= len(text) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(text[pos:])
+	return vi_char_class(r, big)
+}
+
+func line_start(text string, pos int) int {
+	return strings.LastIndexByte(text[:pos], '\n') + 1
+}
+
+func line_end(text string, pos int) int {
+	if idx := strings.IndexByte(text[pos:], '\n'); idx > -1 {
+		return pos + idx
+	}
+	return len(text)
+}
+
+func word_forward(text string, pos int, big bool) int {
+	if c := class_at(text, pos, big); c != 0 {
+		for pos < len(text) && class_at(text, pos, big) == c {
+			pos = next_char(text, pos)
+		}
+	}
+	for pos < len(text) && class_at(text, pos, big) == 0 {
+		pos = next_char(text, pos)
+	}
+	return pos
+}
+
+func word_end(text string, pos int, big bool) int {
+	pos = next_char(text, pos)
+	for pos < len(text) && class_at(text, pos, big) == 0 {
+		pos = next_char(text, pos)
+	}
+	if pos >= len(text) {
+		return prev_char(text, len(text))
+	}
+	c := class_at(text, pos, big)
+	for n := next_char(text, pos); n < len(text) && class_at(text, n, big) == c; n = next_char(text, n) {
+		pos = n
+	}
+	return pos
+}
+
+func word_backward(text string, pos int, big bool) int {
+	pos = prev_char(text, pos)
+	for pos > 0 && class_at(text, pos, big) == 0 {
+		pos = prev_char(text, pos)
+	}
+	c := class_at(text, pos, big)
+	for pos > 0 && class_at(text, prev_char(text, pos), big) == c {
+		pos = prev_char(text, pos)
+	}
+	return pos
+}
+
+// The range covered by the iw, aw, iW and aW text objects at pos
+func word_text_object(text string, pos, count int, big, around bool) (start, end int) {
+	ls, le := line_start(text, pos), line_end(text, pos)
+	run_end := func(p int) int {
+		c := class_at(text, p, big)
+		for p < le && class_at(text, p, big) == c {
+			p = next_char(text, p)
+		}
+		return p
+	}
+	start = pos
+	c := class_at(text, pos, big)
+	for start > ls && class_at(text, prev_char(text, start), big) == c {
+		start = prev_char(text, start)
+	}
+	end = pos
+	for i := 0; i < count && end < le; i++ {
+		end = run_end(end)
+	}
+	if around {
+		if c == 0 {
+			end = run_end(end)
+		} else if end < le && class_at(text, end, big) == 0 {
+			end = run_end(end)
+		} else {
+			for start > ls && class_at(text, prev_char(text, start), big) == 0 {
+				start = prev_char(text, start)
+			}
+		}
+	}
+	return
+}
+
+func find_in_line(text string, pos int, motion, arg string, count int) (int, bool) {
+	ls, le := line_start(text, pos), line_end(text, pos)
+	found := pos
+	switch motion {
+	case "f", "t":
+		for i := 0; i < count; i++ {
+			from := next_char(text, found)
+			idx := strings.Index(text[utils.Min(from, le):le], arg)
+			if idx < 0 {
+				return pos, false
+			}
+			found = utils.Min(from, le) + idx
+		}
+		if motion == "t" {
+			found = prev_char(text, found)
+		}
+	case "F", "T":
+		for i := 0; i < count; i++ {
+			idx := strings.LastIndex(text[ls:utils.Max(ls, found)], arg)
+			if idx < 0 {
+				return pos, false
+			}
+			found = ls + idx
+		}
+		if motion == "T" {
+			found = next_char(text, found)
+		}
+	}
+	return found, found != pos
+}
+
+func (self *Readline) offset_of(pos Position) int {
+	ans := pos.X
+	for i := 0; i < pos.Y; i++ {
+		ans += len(self.input_state.lines[i]) + 1
+	}
+	return ans
+}
+
+func (self *Readline) position_of(offset int) Position {
+	for i, line := range self.input_state.lines {
+		if offset <= len(line) || i == len(self.input_state.lines)-1 {
+			return Position{X: utils.Min(offset, len(line)), Y: i}
+		}
+		offset -= len(line) + 1
+	}
+	return Position{}
+}
+
+// Compute the target of a motion. Exclusive motions cover the text between
+// the cursor and target, inclusive ones also the character at target.
+func (self *Readline) vi_motion(text string, cur int, motion, arg string, count int, for_operator bool) (target int, inclusive, ok bool) {
+	target = cur
+	ls, le := line_start(text, cur), line_end(text, cur)
+	switch motion {
+	case "h":
+		for i := 0; i < count && target > ls; i++ {
+			target = prev_char(text, target)
+		}
+	case "l":
+		limit := le
+		if !for_operator {
+			limit = prev_char(text, le)
+		}
+		for i := 0; i < count && target < limit; i++ {
+			target = next_char(text, target)
+		}
+	case "0":
+		return ls, false, true
+	case "^":
+		target = ls
+		for target < le && class_at(text, target, false) == 0 {
+			target = next_char(text, target)
+		}
+		return target, false, true
+	case "$":
+		for i := 1; i < count && le < len(text); i++ {
+			le = line_end(text, le+1)
+		}
+		target = le
+		return target, false, true
+	case "w", "W":
+		for i := 0; i < count && target < len(text); i++ {
+			target = word_forward(text, target, motion == "W")
+		}
+		if for_operator && target > le {
+			// dw on the last word of a line does not join lines
+			target = le
+		}
+	case "e", "E":
+		for i := 0; i < count && target < len(text); i++ {
+			target = word_end(text, target, motion == "E")
+		}
+		return target, true, cur < len(text)
+	case "b", "B":
+		for i := 0; i < count && target > 0; i++ {
+			target = word_backward(text, target, motion == "B")
+		}
+	case "f", "F", "t", "T":
+		self.vi.last_find.motion, self.vi.last_find.arg = motion, arg
+		target, ok = find_in_line(text, cur, motion, arg, count)
+		return target, motion == "f" || motion == "t", ok
+	case ";", ",":
+		m := self.vi.last_find.motion
+		if m == "" {
+			return
+		}
+		if motion == "," {
+			m = map[string]string{"f": "F", "F": "f", "t": "T", "T": "t"}[m]
+		}
+		target, ok = find_in_line(text, cur, m, self.vi.last_find.arg, count)
+		return target, m == "f" || m == "t", ok
+	}
+	return target, inclusive, target != cur
+}
+
+func (self *Readline) set_vi_normal_mode(normal bool) {
+	self.vi.normal_mode = normal
+	self.vi.pending = self.vi.pending[:0]
+	if self.loop != nil {
+		if normal {
+			self.loop.SetCursorShape(loop.BLOCK_CURSOR, true)
+		} else {
+			self.loop.SetCursorShape(loop.BAR_CURSOR, true)
+		}
+	}
+}
+
+// In normal mode the cursor is always on a character, never after the last one
+func (self *Readline) clamp_vi_cursor() {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	if self.input_state.cursor.X >= len(line) && len(line) > 0 {
+		_, sz := utf8.DecodeLastRuneInString(line)
+		self.input_state.cursor.X = len(line) - sz
+	}
+}
+
+func (self *Readline) store_in_vi_register(reg rune, text string, linewise, is_yank bool) {
+	if reg == '_' {
+		return
+	}
+	r := vi_register{text: text, linewise: linewise}
+	if 'A' <= reg && reg <= 'Z' {
+		reg = unicode.ToLower(reg)
+		if existing, found := self.vi.registers[reg]; found {
+			sep := ""
+			if existing.linewise || linewise {
+				sep = "\n"
+			}
+			r = vi_register{text: existing.text + sep + text, linewise: existing.linewise || linewise}
+		}
+	}
+	if reg != 0 && reg != '"' {
+		self.vi.registers[reg] = r
+	}
+	if is_yank {
+		self.vi.registers['0'] = r
+	}
+	self.vi.registers['"'] = r
+}
+
+func (self *Readline) vi_operate_on_lines(c vi_command, y1, y2 int) {
+	lines := self.input_state.lines
+	y1, y2 = utils.Max(0, utils.Min(y1, y2)), utils.Min(len(lines)-1, utils.Max(y1, y2))
+	self.store_in_vi_register(c.register, strings.Join(lines[y1:y2+1], "\n"), true, c.op == "y")
+	new_lines := make([]string, 0, len(lines))
+	new_lines = append(new_lines, lines[:y1]...)
+	switch c.op {
+	case "y":
+		return
+	case "c":
+		new_lines = append(new_lines, "")
+	}
+	new_lines = append(new_lines, lines[y2+1:]...)
+	if len(new_lines) == 0 {
+		new_lines = append(new_lines, "")
+	}
+	self.input_state.lines = new_lines
+	self.input_state.cursor = Position{Y: utils.Min(y1, len(new_lines)-1)}
+	if c.op == "c" {
+		self.set_vi_normal_mode(false)
+	} else {
+		text := self.all_text()
+		target, _, _ := self.vi_motion(text, self.offset_of(self.input_state.cursor), "^", "", 1, false)
+		self.input_state.cursor = self.position_of(target)
+	}
+}
+
+func (self *Readline) vi_operate(c vi_command, count int) bool {
+	text := self.all_text()
+	cur := self.offset_of(self.input_state.cursor)
+	y := self.input_state.cursor.Y
+	var start, end int
+	switch c.motion {
+	case c.op:
+		self.vi_operate_on_lines(c, y, y+count-1)
+		return true
+	case "j", "k":
+		delta := count
+		if c.motion == "k" {
+			delta = -count
+		}
+		if y+delta < 0 || y+delta >= len(self.input_state.lines) {
+			return false
+		}
+		self.vi_operate_on_lines(c, y, y+delta)
+		return true
+	case "gg", "G":
+		target := 0
+		if c.motion == "G" {
+			target = len(self.input_state.lines) - 1
+		}
+		if c.count > 0 || c.motion_count > 0 {
+			target = count - 1
+		}
+		self.vi_operate_on_lines(c, y, target)
+		return true
+	case "iw", "aw", "iW", "aW":
+		start, end = word_text_object(text, cur, count, c.motion[1] == 'W', c.motion[0] == 'a')
+	default:
+		motion := c.motion
+		if c.op == "c" && (motion == "w" || motion == "W") && class_at(text, cur, false) != 0 {
+			// cw behaves like ce, except that on the last character of a
+			// word it changes only that character
+			big := motion == "W"
+			motion = "e"
+			if big {
+				motion = "E"
+			}
+			if count == 1 && class_at(text, next_char(text, cur), big) != class_at(text, cur, big) {
+				start, end = cur, next_char(text, cur)
+				break
+			}
+		}
+		target, inclusive, ok := self.vi_motion(text, cur, motion, c.arg, count, true)
+		if !ok {
+			return false
+		}
+		start, end = utils.Min(cur, target), utils.Max(cur, target)
+		if inclusive {
+			end = next_char(text, end)
+		}
+	}
+	if start >= end {
+		return false
+	}
+	self.store_in_vi_register(c.register, text[start:end], false, c.op == "y")
+	start_pos := self.position_of(start)
+	if c.op != "y" {
+		self.erase_between(start_pos, self.position_of(end))
+	}
+	self.input_state.cursor = start_pos
+	if c.op == "c" {
+		self.set_vi_normal_mode(false)
+	}
+	return true
+}
+
+func (self *Readline) vi_put(c vi_command, count int) bool {
+	reg := c.register
+	if reg == 0 {
+		reg = '"'
+	}
+	r, found := self.vi.registers[unicode.ToLower(reg)]
+	if !found || (r.text == "" && !r.linewise) {
+		return false
+	}
+	if r.linewise {
+		block := strings.Split(strings.TrimSuffix(strings.Repeat(r.text+"\n", count), "\n"), "\n")
+		y := self.input_state.cursor.Y
+		if c.motion == "p" {
+			y++
+		}
+		lines := make([]string, 0, len(self.input_state.lines)+len(block))
+		lines = append(lines, self.input_state.lines[:y]...)
+		lines = append(lines, block...)
+		lines = append(lines, self.input_state.lines[y:]...)
+		self.input_state.lines = lines
+		self.input_state.cursor = Position{Y: y}
+		return true
+	}
+	if c.motion == "p" && self.input_state.lines[self.input_state.cursor.Y] != "" {
+		self.move_cursor_right(1, false)
+	}
+	self.add_text(strings.Repeat(r.text, count))
+	self.move_cursor_left(1, false)
+	return true
+}
+
+func (self *Readline) vi_replace_chars(count int, replacement string, transform func(rune) rune) bool {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	x := self.input_state.cursor.X
+	buf := strings.Builder{}
+	n, consumed, last := 0, 0, x
+	for i, r := range line[x:] {
+		if n == count {
+			break
+		}
+		last = x + buf.Len()
+		if transform != nil {
+			buf.WriteRune(transform(r))
+		} else {
+			buf.WriteString(replacement)
+		}
+		consumed = i + utf8.RuneLen(r)
+		n++
+	}
+	if n == 0 || (transform == nil && n < count) {
+		return false
+	}
+	self.input_state.lines[self.input_state.cursor.Y] = line[:x] + buf.String() + line[x+consumed:]
+	self.input_state.cursor.X = last
+	return true
+}
+
+func toggle_case(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+func (self *Readline) vi_execute(c vi_command) bool {
+	count := utils.Max(1, c.count) * utils.Max(1, c.motion_count)
+	alias := func(keys string) bool {
+		q, _, _ := parse_vi_command([]rune(keys))
+		q.register, q.count = c.register, c.count
+		return self.vi_execute(q)
+	}
+	if c.op != "" {
+		return self.vi_operate(c, count)
+	}
+	text := self.all_text()
+	cur := self.offset_of(self.input_state.cursor)
+	switch c.motion {
+	case "i":
+		self.set_vi_normal_mode(false)
+	case "a":
+		self.move_cursor_right(1, false)
+		self.set_vi_normal_mode(false)
+	case "I":
+		target, _, _ := self.vi_motion(text, cur, "^", "", 1, false)
+		self.input_state.cursor = self.position_of(target)
+		self.set_vi_normal_mode(false)
+	case "A":
+		self.move_to_end_of_line()
+		self.set_vi_normal_mode(false)
+	case "o":
+		self.move_to_end_of_line()
+		self.add_text("\n")
+		self.set_vi_normal_mode(false)
+	case "O":
+		self.move_to_start_of_line()
+		self.add_text("\n")
+		self.input_state.cursor.Y--
+		self.set_vi_normal_mode(false)
+	case "x":
+		return alias("dl")
+	case "X":
+		return alias("dh")
+	case "D":
+		return alias("d$")
+	case "C":
+		return alias("c$")
+	case "s":
+		return alias("cl")
+	case "S":
+		return alias("cc")
+	case "Y":
+		return alias("yy")
+	case "p", "P":
+		return self.vi_put(c, count)
+	case "r":
+		return self.vi_replace_chars(count, c.arg, nil)
+	case "~":
+		if !self.vi_replace_chars(count, "", toggle_case) {
+			return false
+		}
+		self.move_cursor_right(1, false)
+	case "u":
+		return self.undo(uint(count)) > 0
+	case "/":
+		return self.perform_action(ActionHistoryIncrementalSearchBackwards, 1) == nil
+	case "j":
+		return self.perform_action(ActionHistoryNextOrCursorDown, uint(count)) == nil
+	case "k":
+		return self.perform_action(ActionHistoryPreviousOrCursorUp, uint(count)) == nil
+	case "gg", "G":
+		y := 0
+		if c.motion == "G" {
+			y = len(self.input_state.lines) - 1
+		}
+		if c.count > 0 {
+			y = utils.Min(c.count-1, len(self.input_state.lines)-1)
+		}
+		self.input_state.cursor = Position{Y: y}
+	default:
+		target, _, ok := self.vi_motion(text, cur, c.motion, c.arg, count, false)
+		if !ok {
+			return false
+		}
+		self.input_state.cursor = self.position_of(target)
+	}
+	return true
+}
+
+// Handle text typed in normal mode, returns false if the text was not a valid command
+func (self *Readline) handle_vi_text(text string) bool {
+	ok := true
+	for i, r := range text {
+		if !self.vi.normal_mode {
+			// a command switched to insert mode, the rest of the text is inserted
+			self.add_text(text[i:])
+			break
+		}
+		self.vi.pending = append(self.vi.pending, r)
+		c, complete, err := parse_vi_command(self.vi.pending)
+		if err != nil {
+			self.vi.pending = self.vi.pending[:0]
+			ok = false
+			continue
+		}
+		if !complete {
+			continue
+		}
+		self.vi.pending = self.vi.pending[:0]
+		if c.motion == "u" {
+			ok = self.vi_execute(c) && ok
+		} else {
+			before := self.input_state.copy()
+			if self.vi_execute(c) {
+				self.record_undo_state(before, ActionNil, false)
+			} else {
+				ok = false
+			}
+		}
+		if self.vi.normal_mode {
+			self.clamp_vi_cursor()
+		}
+	}
+	return ok
+}
+
+// Handle key events in vi mode, returns true if the event was consumed
+func (self *Readline) handle_vi_key_event(event *loop.KeyEvent) (bool, error) {
+	if self.history_search != nil {
+		return false, nil
+	}
+	if !self.vi.normal_mode {
+		if event.MatchesPressOrRepeat("escape") {
+			event.Handled = true
+			self.move_cursor_left(1, false)
+			self.last_edit_action = ActionNil
+			self.set_vi_normal_mode(true)
+			return true, nil
+		}
+		return false, nil
+	}
+	switch {
+	case event.MatchesPressOrRepeat("escape"):
+		self.vi.pending = self.vi.pending[:0]
+	case event.MatchesPressOrRepeat("ctrl+r"):
+		self.vi.pending = self.vi.pending[:0]
+		if self.redo(1) == 0 {
+			event.Handled = true
+			return true, ErrCouldNotPerformAction
+		}
+		self.clamp_vi_cursor()
+	case event.MatchesPressOrRepeat("backspace"):
+		self.vi.pending = self.vi.pending[:0]
+		self.move_cursor_left(1, false)
+	default:
+		if event.Text == "" && (event.Type == loop.PRESS || event.Type == loop.REPEAT) {
+			self.vi.pending = self.vi.pending[:0]
+		}
+		return false, nil
+	}
+	event.Handled = true
+	return true, nil
+}
@@ -0,0 +1,376 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/tui/sgr"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+type screen_cell struct {
+	// The characters in the cell, empty for the second cell of a wide character
+	text string
+	// 2 for wide characters, 0 for the second cell of a wide character
+	width int
+	// Only the attributes that differ from the defaults are set
+	sgr sgr.SGR
+	// The parameters and URL of the OSC 8 hyperlink the cell is part of
+	hyperlink string
+}
+
+var blank_cell = screen_cell{text: " ", width: 1}
+
+// A double buffer for the contents of the screen. Each frame is drawn into the
+// buffer, and Render() outputs only the escape codes needed to change what is
+// on the screen into the new frame: the changed cells, the cursor movements to
+// reach them and the changes in formatting between them. This uses much less
+// bandwidth than redrawing whole lines, which avoids flicker over slow
+// connections. Hyperlinks in drawn text are preserved.
+type Screen struct {
+	// Render only the text of the rows that changed, as lines of plain text,
+	// without moving the cursor. Defaults to AccessibleMode().
+	Accessible bool
+
+	width, height     int
+	current, previous []screen_cell
+	// The previous frame is not what is on the screen, so the screen must be
+	// cleared and everything drawn
+	full_redraw        bool
+	cursor_x, cursor_y int
+	cursor_visible     bool
+}
+
+func NewScreen(width, height int) *Screen {
+	ans := &Screen{Accessible: AccessibleMode()}
+	ans.Resize(width, height)
+	return ans
+}
+
+func (self *Screen) Size() (width, height int) { return self.width, self.height }
+
+// Change the size of the screen, clearing it. The next Render() redraws everything.
+func (self *Screen) Resize(width, height int) {
+	self.width, self.height = utils.Max(0, width), utils.Max(0, height)
+	self.current = make([]screen_cell, self.width*self.height)
+	self.previous = make([]screen_cell, self.width*self.height)
+	self.Clear()
+	self.Invalidate()
+}
+
+// Make the next Render() redraw everything, needed when something else has
+// drawn on the screen, for example, after resuming from being stopped
+func (self *Screen) Invalidate() {
+	self.full_redraw = true
+	for i := range self.previous {
+		self.previous[i] = blank_cell
+	}
+}
+
+// Clear the frame being drawn
+func (self *Screen) Clear() {
+	for i := range self.current {
+		self.current[i] = blank_cell
+	}
+	self.cursor_visible = false
+}
+
+// Place the cursor at the specified zero based cell once the frame is rendered
+func (self *Screen) SetCursor(x, y int) {
+	self.cursor_x, self.cursor_y, self.cursor_visible = x, y, true
+}
+
+func normalize_sgr(s sgr.SGR) sgr.SGR {
+	ans := s
+	for _, b := range []*sgr.BoolVal{&ans.Italic, &ans.Reverse, &ans.Bold, &ans.Dim, &ans.Strikethrough} {
+		if !b.Val {
+			b.Is_set = false
+		}
+	}
+	if ans.Underline_style.Val == sgr.No_underline {
+		ans.Underline_style.Is_set = false
+	}
+	for _, c := range []*sgr.ColorVal{&ans.Foreground, &ans.Background, &ans.Underline_color} {
+		if c.Is_default {
+			*c = sgr.ColorVal{}
+		}
+	}
+	return ans
+}
+
+func (self *Screen) set_cell(x, y int, c screen_cell) {
+	row := self.current[y*self.width : (y+1)*self.width]
+	// do not leave behind half of a wide character
+	if row[x].width == 0 && x > 0 {
+		row[x-1] = screen_cell{text: " ", width: 1, sgr: row[x-1].sgr}
+	}
+	if row[x].width == 2 && x+1 < self.width && c.width != 2 {
+		row[x+1] = screen_cell{text: " ", width: 1, sgr: row[x+1].sgr}
+	}
+	row[x] = c
+	if c.width == 2 {
+		if x+2 < self.width && row[x+1].width == 2 {
+			row[x+2] = screen_cell{text: " ", width: 1, sgr: row[x+2].sgr}
+		}
+		row[x+1] = screen_cell{width: 0, sgr: c.sgr, hyperlink: c.hyperlink}
+	}
+}
+
+// Draw text, which can contain SGR formatting and OSC 8 hyperlink escape
+// codes, starting at the specified zero based cell. Text that does not fit on
+// the line is clipped and other escape codes are ignored. Returns the x
+// co-ordinate of the cell after the drawn text.
+func (self *Screen) DrawText(x, y int, text string) int {
+	if y < 0 || y >= self.height {
+		return x
+	}
+	var current sgr.SGR
+	current_link := ""
+	draw := func(segment string) {
+		for it := wcswidth.NewCellIterator(segment).GotoStart(); it.Forward() && x < self.width; {
+			ch := it.Current()
+			w := wcswidth.Stringwidth(ch)
+			switch {
+			case w < 1:
+				// a combining character at the start of text
+				continue
+			case w > 2:
+				w = 2
+			}
+			if w == 2 && x+1 >= self.width {
+				// a wide character that does not fit
+				ch, w = " ", 1
+			}
+			if x >= 0 {
+				self.set_cell(x, y, screen_cell{text: ch, width: w, sgr: current, hyperlink: current_link})
+			}
+			x += w
+		}
+	}
+	segment := strings.Builder{}
+	p := wcswidth.EscapeCodeParser{
+		HandleRune: func(ch rune) error {
+			switch ch {
+			case '\n', '\r', '\t':
+				ch = ' '
+			}
+			segment.WriteRune(ch)
+			return nil
+		},
+		HandleCSI: func(csi []byte) error {
+			if len(csi) > 0 && csi[len(csi)-1] == 'm' {
+				draw(segment.String())
+				segment.Reset()
+				q := string(csi)
+				s := current
+				if q == "m" || q == "0m" || strings.HasPrefix(q, "0;") {
+					s = sgr.SGR{}
+				}
+				s.ApplySGR(sgr.SGRFromCSI(q))
+				current = normalize_sgr(s)
+			}
+			return nil
+		},
+		HandleOSC: func(osc []byte) error {
+			if body, found := strings.CutPrefix(string(osc), "8;"); found {
+				draw(segment.String())
+				segment.Reset()
+				if _, url, _ := strings.Cut(body, ";"); url == "" {
+					body = ""
+				}
+				current_link = body
+			}
+			return nil
+		},
+	}
+	_ = p.ParseString(text)
+	draw(segment.String())
+	return x
+}
+
+// Draw lines of text, one per row, starting at the specified zero based cell
+func (self *Screen) DrawLines(x, y int, lines []string) {
+	for i, line := range lines {
+		self.DrawText(x, y+i, line)
+	}
+}
+
+// The escape codes to change the formatting of the terminal from a to b
+func sgr_transition(a, b sgr.SGR) string {
+	if a == b {
+		return ""
+	}
+	if b.IsEmpty() {
+		return "\x1b[m"
+	}
+	var d sgr.SGR
+	bool_delta := func(dest *sgr.BoolVal, a, b sgr.BoolVal) {
+		if a != b {
+			*dest = sgr.BoolVal{Is_set: true, Val: b.Val}
+		}
+	}
+	color_delta := func(dest *sgr.ColorVal, a, b sgr.ColorVal) {
+		if a != b {
+			if b.Is_set {
+				*dest = b
+			} else {
+				*dest = sgr.ColorVal{Is_set: true, Is_default: true}
+			}
+		}
+	}
+	bool_delta(&d.Italic, a.Italic, b.Italic)
+	bool_delta(&d.Reverse, a.Reverse, b.Reverse)
+	bool_delta(&d.Strikethrough, a.Strikethrough, b.Strikethrough)
+	if a.Bold != b.Bold || a.Dim != b.Dim {
+		// 22 resets both bold and dim and is understood by all terminals
+		if (a.Bold.Val && !b.Bold.Val) || (a.Dim.Val && !b.Dim.Val) {
+			ans := "\x1b[22m"
+			a.Bold, a.Dim = sgr.BoolVal{}, sgr.BoolVal{}
+			return ans + sgr_transition(a, b)
+		}
+		bool_delta(&d.Bold, a.Bold, b.Bold)
+		bool_delta(&d.Dim, a.Dim, b.Dim)
+	}
+	if a.Underline_style != b.Underline_style {
+		d.Underline_style = sgr.UnderlineStyleVal{Is_set: true, Val: b.Underline_style.Val}
+	}
+	color_delta(&d.Foreground, a.Foreground, b.Foreground)
+	color_delta(&d.Background, a.Background, b.Background)
+	color_delta(&d.Underline_color, a.Underline_color, b.Underline_color)
+	return "\x1b[" + d.AsCSI()
+}
+
+// The escape codes needed to change the screen from the previously rendered
+// frame to the current one. Afterwards the current frame becomes the previous
+// one and a new frame can be drawn, typically after calling Clear(). The
+// formatting of the terminal is reset at the end. If Accessible is set, the
+// plain text of the rows that changed is returned instead, one per line.
+func (self *Screen) Render() string {
+	buf := strings.Builder{}
+	if self.Accessible {
+		self.render_accessible(&buf)
+		return buf.String()
+	}
+	var state sgr.SGR
+	link := ""
+	set_link := func(x string) {
+		if x != link {
+			if x == "" {
+				buf.WriteString(style.HyperlinkEnd)
+			} else {
+				buf.WriteString("\x1b]8;" + x + "\x1b\\")
+			}
+			link = x
+		}
+	}
+	if self.full_redraw {
+		buf.WriteString("\x1b[m\x1b[H\x1b[2J")
+		self.full_redraw = false
+	}
+	// the cursor position is unknown, something else may have moved it
+	cx, cy := -1, -1
+	move_to := func(x, y int) {
+		switch {
+		case x == cx && y == cy:
+		case y == cy && x > cx && cx > -1:
+			buf.WriteString("\x1b[")
+			if x-cx > 1 {
+				buf.WriteString(strconv.Itoa(x - cx))
+			}
+			buf.WriteString("C")
+		default:
+			fmt.Fprintf(&buf, loop.MoveCursorToTemplate, y+1, x+1)
+		}
+		cx, cy = x, y
+	}
+	for y := 0; y < self.height; y++ {
+		row := self.current[y*self.width : (y+1)*self.width]
+		prev := self.previous[y*self.width : (y+1)*self.width]
+		for x := 0; x < self.width; x++ {
+			c := row[x]
+			changed := c != prev[x]
+			if !changed && c.width == 2 && x+1 < self.width {
+				changed = row[x+1] != prev[x+1]
+			}
+			if !changed || c.width == 0 {
+				if changed && x > 0 && row[x-1].width == 2 {
+					// redraw the wide character this cell is part of
+					x--
+					c = row[x]
+				} else {
+					continue
+				}
+			}
+			if cy == y && cx > -1 && x > cx && x-cx < 4 {
+				// rewriting a few unchanged cells is shorter than moving the cursor
+				gap := row[cx:x]
+				if !slices.ContainsFunc(gap, func(g screen_cell) bool { return g.width != 1 || g.sgr != state || g.hyperlink != link }) {
+					for _, g := range gap {
+						buf.WriteString(g.text)
+					}
+					cx = x
+				}
+			}
+			move_to(x, y)
+			buf.WriteString(sgr_transition(state, c.sgr))
+			state = c.sgr
+			set_link(c.hyperlink)
+			buf.WriteString(c.text)
+			cx += c.width
+			if cx >= self.width {
+				// the cursor position at the right edge depends on the line wrapping mode
+				cx, cy = -1, -1
+			}
+			if c.width == 2 {
+				x++
+			}
+		}
+	}
+	buf.WriteString(sgr_transition(state, sgr.SGR{}))
+	set_link("")
+	if self.cursor_visible {
+		move_to(utils.Max(0, utils.Min(self.cursor_x, self.width-1)), utils.Max(0, utils.Min(self.cursor_y, self.height-1)))
+	}
+	self.current, self.previous = self.previous, self.current
+	copy(self.current, self.previous)
+	return buf.String()
+}
+
+func (self *Screen) render_accessible(buf *strings.Builder) {
+	self.full_redraw = false
+	for y := 0; y < self.height; y++ {
+		row := self.current[y*self.width : (y+1)*self.width]
+		if slices.Equal(row, self.previous[y*self.width:(y+1)*self.width]) {
+			continue
+		}
+		line := strings.Builder{}
+		for _, c := range row {
+			line.WriteString(c.text)
+		}
+		if text := strings.TrimRight(line.String(), " "); text != "" {
+			buf.WriteString(text)
+			buf.WriteString("\r\n")
+		}
+	}
+	self.current, self.previous = self.previous, self.current
+	copy(self.current, self.previous)
+}
+
+// Render the frame to the terminal as a single atomic update
+func (self *Screen) Flush(lp *loop.Loop) {
+	if q := self.Render(); q != "" {
+		lp.StartAtomicUpdate()
+		lp.QueueWriteString(q)
+		lp.EndAtomicUpdate()
+	}
+}
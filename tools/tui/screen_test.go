@@ -0,0 +1,63 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestScreen(t *testing.T) {
+	s := NewScreen(6, 3)
+	render := func(expected string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, s.Render()); diff != "" {
+			t.Fatalf("Unexpected render output:\n%s", diff)
+		}
+	}
+	s.DrawLines(0, 0, []string{"abc", "x\x1b[1;31myz\x1b[m"})
+	render("\x1b[m\x1b[H\x1b[2J\x1b[1;1Habc\x1b[2;1Hx\x1b[1;31myz\x1b[m")
+	render("")
+
+	// only changed cells are drawn
+	s.DrawText(2, 0, "d")
+	s.DrawText(5, 0, "e")
+	render("\x1b[1;3Hd  e")
+	s.DrawText(1, 1, "\x1b[1;31mY")
+	s.DrawText(2, 1, "\x1b[32mZ")
+	render("\x1b[2;2H\x1b[1;31mY\x1b[22m\x1b[32mZ\x1b[m")
+	s.DrawText(1, 1, "\x1b[31mY")
+	render("\x1b[2;2H\x1b[31mY\x1b[m")
+	s.DrawText(1, 1, "\x1b[2;31mY")
+	render("\x1b[2;2H\x1b[2;31mY\x1b[m")
+
+	// wide characters
+	s.Clear()
+	s.DrawText(0, 0, "日本x")
+	render("\x1b[1;1H日本x \x1b[2;1H   ")
+	s.DrawText(3, 0, "ab")
+	render("\x1b[1;3H ab")
+	s.DrawText(4, 2, "日本")
+	render("\x1b[3;5H日")
+
+	s.SetCursor(1, 2)
+	s.Invalidate()
+	render("\x1b[m\x1b[H\x1b[2J\x1b[1;1H日 ab\x1b[3;5H日\x1b[3;2H")
+	s.DrawText(0, 1, "a")
+	s.DrawText(5, 1, "b")
+	render("\x1b[2;1Ha\x1b[4Cb\x1b[3;2H")
+
+	// hyperlinks
+	s = NewScreen(6, 1)
+	s.Render()
+	s.DrawText(0, 0, "a\x1b]8;id=1;http://x.com\x1b\\bc\x1b]8;;\x1b\\d")
+	render("\x1b[1;1Ha\x1b]8;id=1;http://x.com\x1b\\bc\x1b]8;;\x1b\\d")
+	s.DrawText(2, 0, "C")
+	render("\x1b[1;3HC")
+	s.DrawText(1, 0, "\x1b]8;;http://y.com\x1b\\B")
+	render("\x1b[1;2H\x1b]8;;http://y.com\x1b\\B\x1b]8;;\x1b\\")
+}
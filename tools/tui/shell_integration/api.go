@@ -50,7 +50,16 @@ func extract_shell_integration_for(shell_name string, dest_dir string) (err erro
 	return
 }
 
+// The name of the directory containing the shell integration files for the shell
+func integration_dir_name(shell_name string) string {
+	if shell_name == "nu" {
+		return "nushell"
+	}
+	return shell_name
+}
+
 func EnsureShellIntegrationFilesFor(shell_name string) (shell_integration_dir_for_shell string, err error) {
+	shell_name = integration_dir_name(shell_name)
 	if kid := os.Getenv("KITTY_INSTALLATION_DIR"); kid != "" {
 		if s, e := os.Stat(kid); e == nil && s.IsDir() {
 			q := filepath.Join(kid, "shell-integration", shell_name)
@@ -142,6 +151,38 @@ func fish_setup_func(shell_integration_dir string, argv []string, env map[string
 	return argv, env, nil
 }
 
+func nu_setup_func(shell_integration_dir string, argv []string, env map[string]string) (final_argv []string, final_env map[string]string, err error) {
+	// nushell loads vendor autoload scripts from XDG_DATA_DIRS/nushell/vendor/autoload
+	shell_integration_dir = filepath.Dir(shell_integration_dir)
+	env[`KITTY_NU_XDG_DATA_DIR`] = shell_integration_dir
+	dirs := utils.Filter(strings.Split(env[`XDG_DATA_DIRS`], string(filepath.ListSeparator)), func(x string) bool { return x != "" })
+	env[`XDG_DATA_DIRS`] = strings.Join(append([]string{shell_integration_dir}, dirs...), string(filepath.ListSeparator))
+	return argv, env, nil
+}
+
+func xonsh_setup_func(shell_integration_dir string, argv []string, env map[string]string) (final_argv []string, final_env map[string]string, err error) {
+	// xonsh runs the scripts in XONSHRC_DIR after the rc files
+	var dirs []string
+	if val, found := env[`XONSHRC_DIR`]; found {
+		env[`KITTY_XONSH_ORIG_XONSHRC_DIR`] = val
+		dirs = utils.Filter(strings.Split(val, string(filepath.ListSeparator)), func(x string) bool { return x != "" })
+	} else {
+		// the default value used by xonsh
+		xdg_config_home := env[`XDG_CONFIG_HOME`]
+		if xdg_config_home == "" {
+			home := env[`HOME`]
+			if home == "" {
+				home = utils.Expanduser("~")
+			}
+			xdg_config_home = filepath.Join(home, ".config")
+		}
+		dirs = []string{"/etc/xonsh/rc.d", filepath.Join(xdg_config_home, "xonsh", "rc.d")}
+	}
+	env[`XONSHRC_DIR`] = strings.Join(append(dirs, shell_integration_dir), string(filepath.ListSeparator))
+	env[`KITTY_XONSH_RC_DIR`] = shell_integration_dir
+	return argv, env, nil
+}
+
 func bash_setup_func(shell_integration_dir string, argv []string, env map[string]string) ([]string, map[string]string, error) {
 	inject := utils.NewSetWithItems(`1`)
 	var posix_env, rcfile string
@@ -251,6 +292,10 @@ func setup_func_for_shell(shell_name string) integration_setup_func {
 		return fish_setup_func
 	case "bash":
 		return bash_setup_func
+	case "nu":
+		return nu_setup_func
+	case "xonsh":
+		return xonsh_setup_func
 	}
 	return nil
 }
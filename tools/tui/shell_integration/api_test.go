@@ -40,3 +40,28 @@ func TestExtractShellIntegration(t *testing.T) {
 		t.Fatalf("Failed to update shell integration file")
 	}
 }
+
+func TestNuAndXonshSetup(t *testing.T) {
+	_, env, _ := setup_func_for_shell("nu")("/ksi/nushell", nil, map[string]string{"XDG_DATA_DIRS": "/a:/b"})
+	if env["XDG_DATA_DIRS"] != "/ksi:/a:/b" || env["KITTY_NU_XDG_DATA_DIR"] != "/ksi" {
+		t.Fatalf("Unexpected env for nu: %#v", env)
+	}
+	_, env, _ = setup_func_for_shell("xonsh")("/ksi/xonsh", nil, map[string]string{"HOME": "/h"})
+	if env["XONSHRC_DIR"] != "/etc/xonsh/rc.d:/h/.config/xonsh/rc.d:/ksi/xonsh" || env["KITTY_XONSH_RC_DIR"] != "/ksi/xonsh" {
+		t.Fatalf("Unexpected env for xonsh: %#v", env)
+	}
+	if _, found := env["KITTY_XONSH_ORIG_XONSHRC_DIR"]; found {
+		t.Fatalf("Unexpected env for xonsh: %#v", env)
+	}
+	_, env, _ = setup_func_for_shell("xonsh")("/ksi/xonsh", nil, map[string]string{"XONSHRC_DIR": "/x"})
+	if env["XONSHRC_DIR"] != "/x:/ksi/xonsh" || env["KITTY_XONSH_ORIG_XONSHRC_DIR"] != "/x" {
+		t.Fatalf("Unexpected env for xonsh: %#v", env)
+	}
+	tdir := t.TempDir()
+	if err := extract_shell_integration_for(integration_dir_name("nu"), tdir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tdir, "shell-integration", "nushell", "vendor", "autoload", "kitty.nu")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,538 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+type TableColumn struct {
+	Title string
+	// Limits on the width of the column in cells, zero means no limit
+	MinWidth, MaxWidth int
+	// Give this column any space left over after all columns are at their natural width
+	Expand     bool
+	AlignRight bool
+	Sortable   bool
+	// Used for sorting, defaults to comparing numerically if both values are
+	// numbers and as strings otherwise
+	Less func(a, b string) bool
+}
+
+// A table of text cells with a header row, drawn in a rectangular region of
+// the screen. Rows can be sorted by clicking on column headers, navigated
+// with the keyboard or mouse and selected. Only the visible rows are
+// formatted, and when the table is not sorted, drawing, scrolling and
+// navigating take time proportional to the height of the table, not the
+// number of rows, so tables with millions of rows can be displayed using
+// SetRowSource().
+type Table struct {
+	Columns []TableColumn
+	// Placed between adjacent columns
+	Separator string
+	// The natural widths of columns are computed from at most this many
+	// rows, zero means all rows
+	MaxRowsForWidths int
+	// Styles, in the format used by loop.SprintStyled
+	HeaderStyle, CurrentRowStyle, SelectedRowStyle string
+	// Called when the current row changes or the enter key is pressed on a row. Indices are into the rows passed to SetRows
+	OnCurrentRowChanged, OnActivate func(row int)
+
+	rows       [][]string
+	row_source func(idx int) []string
+	num_rows   int
+	// nil when the rows are in their original order
+	order                  []int
+	selected               map[int]bool
+	current, scroll_offset int
+	sort_column            int
+	sort_descending        bool
+	x, y, width, height    int
+	widths                 []int
+	widths_for_width       int
+	announcer              Announcer
+}
+
+func NewTable(columns ...TableColumn) *Table {
+	theme := CurrentTheme()
+	return &Table{
+		Columns: columns, Separator: "  ", HeaderStyle: "bold=true", CurrentRowStyle: theme.Selection, SelectedRowStyle: theme.Success,
+		MaxRowsForWidths: 1000, selected: make(map[int]bool), sort_column: -1, widths_for_width: -1,
+		row_source: func(int) []string { return nil },
+	}
+}
+
+// Set the region of the screen, in zero based cells, the table is drawn into
+func (self *Table) SetGeometry(x, y, width, height int) {
+	if width != self.width {
+		self.widths_for_width = -1
+	}
+	self.x, self.y, self.width, self.height = x, y, width, height
+	self.ensure_current_visible()
+}
+
+func (self *Table) SetRows(rows [][]string) {
+	self.rows = rows
+	self.set_source(len(rows), func(idx int) []string { return self.rows[idx] })
+}
+
+// Display count rows, calling row to get the cells of a row only when they
+// are needed, typically when the row becomes visible. Use this instead of
+// SetRows() for very large numbers of rows.
+func (self *Table) SetRowSource(count int, row func(idx int) []string) {
+	self.rows = nil
+	self.set_source(count, row)
+}
+
+func (self *Table) set_source(count int, row func(idx int) []string) {
+	self.row_source, self.num_rows, self.order = row, count, nil
+	self.selected = make(map[int]bool)
+	self.current, self.scroll_offset, self.widths_for_width = 0, 0, -1
+	self.sort()
+	self.current = 0
+}
+
+func (self *Table) AppendRow(cells ...string) {
+	if self.rows == nil && self.num_rows > 0 {
+		prev, n := self.row_source, self.num_rows
+		self.row_source = func(idx int) []string {
+			if idx == n {
+				return cells
+			}
+			return prev(idx)
+		}
+	} else {
+		self.rows = append(self.rows, cells)
+		self.row_source = func(idx int) []string { return self.rows[idx] }
+	}
+	self.num_rows++
+	if self.order != nil {
+		self.order = append(self.order, self.num_rows-1)
+	}
+	self.widths_for_width = -1
+	self.sort()
+}
+
+func (self *Table) NumRows() int { return self.num_rows }
+
+func (self *Table) Row(idx int) []string { return self.row_source(idx) }
+
+// The row displayed at position i
+func (self *Table) row_at(i int) int {
+	if self.order == nil {
+		return i
+	}
+	return self.order[i]
+}
+
+// The index, into the rows passed to SetRows, of the current row or -1 if there are no rows
+func (self *Table) CurrentRow() int {
+	if self.num_rows == 0 {
+		return -1
+	}
+	return self.row_at(self.current)
+}
+
+func (self *Table) SetCurrentRow(row int) {
+	if self.order == nil {
+		if row > -1 && row < self.num_rows {
+			self.set_current(row)
+		}
+		return
+	}
+	for i, r := range self.order {
+		if r == row {
+			self.set_current(i)
+			break
+		}
+	}
+}
+
+func (self *Table) IsSelected(row int) bool { return self.selected[row] }
+
+func (self *Table) SetSelected(row int, selected bool) {
+	if selected {
+		self.selected[row] = true
+	} else {
+		delete(self.selected, row)
+	}
+}
+
+func (self *Table) ToggleSelection(row int) { self.SetSelected(row, !self.selected[row]) }
+
+// The selected rows in display order
+func (self *Table) Selection() []int {
+	ans := make([]int, 0, len(self.selected))
+	if self.order == nil {
+		for r := range self.selected {
+			ans = append(ans, r)
+		}
+		return utils.Sort(ans, func(a, b int) bool { return a < b })
+	}
+	for _, r := range self.order {
+		if self.selected[r] {
+			ans = append(ans, r)
+		}
+	}
+	return ans
+}
+
+// Sort the rows by the specified column, use -1 for the original order
+func (self *Table) SortBy(column int, descending bool) {
+	self.sort_column, self.sort_descending = column, descending
+	self.sort()
+}
+
+func (self *Table) SortColumn() (column int, descending bool) {
+	return self.sort_column, self.sort_descending
+}
+
+func compare_table_cells(a, b string) bool {
+	if x, err := strconv.ParseFloat(strings.TrimSpace(a), 64); err == nil {
+		if y, err := strconv.ParseFloat(strings.TrimSpace(b), 64); err == nil {
+			return x < y
+		}
+	}
+	return a < b
+}
+
+func (self *Table) cell(row, column int) string {
+	if r := self.row_source(row); column < len(r) {
+		return r[column]
+	}
+	return ""
+}
+
+func (self *Table) sort() {
+	current := self.CurrentRow()
+	c := self.sort_column
+	if c < 0 || c >= len(self.Columns) {
+		// the original order needs no storage, keeping large tables cheap
+		self.order = nil
+		if current > -1 {
+			self.current = current
+			self.ensure_current_visible()
+		}
+		return
+	}
+	if self.order == nil {
+		self.order = make([]int, self.num_rows)
+		for i := range self.order {
+			self.order[i] = i
+		}
+	}
+	less := self.Columns[c].Less
+	if less == nil {
+		less = compare_table_cells
+	}
+	utils.StableSort(self.order, func(a, b int) bool {
+		x, y := self.cell(a, c), self.cell(b, c)
+		if self.sort_descending {
+			return less(y, x)
+		}
+		return less(x, y)
+	})
+	// keep the same row current, it is not a change of the current row
+	for i, r := range self.order {
+		if r == current {
+			self.current = i
+			self.ensure_current_visible()
+			break
+		}
+	}
+}
+
+func (self *Table) header_text(c int) string {
+	ans := self.Columns[c].Title
+	if c == self.sort_column {
+		if self.sort_descending {
+			ans += " ▼"
+		} else {
+			ans += " ▲"
+		}
+	}
+	return ans
+}
+
+// The widths of the columns when the table is drawn in the specified number of cells
+func (self *Table) ColumnWidths(width int) []int {
+	if self.widths_for_width == width && len(self.widths) == len(self.Columns) {
+		return self.widths
+	}
+	widths := make([]int, len(self.Columns))
+	for c, col := range self.Columns {
+		w := wcswidth.Stringwidth(col.Title)
+		if col.Sortable {
+			w += 2
+		}
+		for r := 0; r < self.num_rows && (self.MaxRowsForWidths <= 0 || r < self.MaxRowsForWidths); r++ {
+			if row := self.row_source(r); c < len(row) {
+				w = utils.Max(w, wcswidth.Stringwidth(row[c]))
+			}
+		}
+		if col.MaxWidth > 0 {
+			w = utils.Min(w, col.MaxWidth)
+		}
+		widths[c] = utils.Max(w, col.MinWidth)
+	}
+	available := width - wcswidth.Stringwidth(self.Separator)*utils.Max(0, len(widths)-1)
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+	// shrink the widest columns till everything fits
+	for total > available {
+		widest := -1
+		for c, w := range widths {
+			if w > utils.Max(1, self.Columns[c].MinWidth) && (widest < 0 || w > widths[widest]) {
+				widest = c
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		widths[widest]--
+		total--
+	}
+	if total < available {
+		var expandable []int
+		for c, col := range self.Columns {
+			if col.Expand {
+				expandable = append(expandable, c)
+			}
+		}
+		for i, c := range expandable {
+			extra := (available - total) / (len(expandable) - i)
+			if mw := self.Columns[c].MaxWidth; mw > 0 {
+				extra = utils.Max(0, utils.Min(extra, mw-widths[c]))
+			}
+			widths[c] += extra
+			total += extra
+		}
+	}
+	self.widths, self.widths_for_width = widths, width
+	return widths
+}
+
+func fit_to_width(text string, width int, align_right bool) string {
+	w := wcswidth.Stringwidth(text)
+	if w > width {
+		if width < 1 {
+			return ""
+		}
+		text, w = wcswidth.TruncateToVisualLengthWithWidth(text, width-1)
+		text = style.TerminateHyperlink(text) + "…"
+		w++
+	}
+	if w < width {
+		if align_right {
+			return strings.Repeat(" ", width-w) + text
+		}
+		return text + strings.Repeat(" ", width-w)
+	}
+	return text
+}
+
+func (self *Table) format_row(cells func(int) string) string {
+	widths := self.ColumnWidths(self.width)
+	parts := make([]string, len(widths))
+	for c, w := range widths {
+		parts[c] = fit_to_width(cells(c), w, self.Columns[c].AlignRight)
+	}
+	return fit_to_width(strings.Join(parts, self.Separator), self.width, false)
+}
+
+func (self *Table) num_visible_rows() int { return utils.Max(0, self.height-1) }
+
+// The lines of text representing the table, each exactly as wide as the
+// table. Styles are applied using sprint_styled, typically loop.SprintStyled
+func (self *Table) Lines(sprint_styled func(style string, args ...any) string) []string {
+	if self.height < 1 || self.width < 1 {
+		return nil
+	}
+	ans := make([]string, 0, self.height)
+	ans = append(ans, sprint_styled(self.HeaderStyle, self.format_row(self.header_text)))
+	for i := self.scroll_offset; i < self.num_rows && len(ans) < self.height; i++ {
+		row := self.row_at(i)
+		text := self.format_row(func(c int) string { return self.cell(row, c) })
+		var styles []string
+		if self.selected[row] {
+			styles = append(styles, self.SelectedRowStyle)
+		}
+		if i == self.current {
+			styles = append(styles, self.CurrentRowStyle)
+		}
+		if len(styles) > 0 {
+			text = sprint_styled(strings.Join(styles, " "), text)
+		}
+		ans = append(ans, text)
+	}
+	for len(ans) < self.height {
+		ans = append(ans, strings.Repeat(" ", self.width))
+	}
+	return ans
+}
+
+// A line of plain text describing the current row, with each cell labelled
+// by the title of its column. Used instead of Lines() in accessible mode.
+func (self *Table) Announcement() string {
+	if self.num_rows == 0 {
+		return "Empty"
+	}
+	row := self.CurrentRow()
+	cells := make([]string, len(self.Columns))
+	for c, col := range self.Columns {
+		cells[c] = self.cell(row, c)
+		if col.Title != "" {
+			cells[c] = col.Title + ": " + cells[c]
+		}
+	}
+	ans := fmt.Sprintf("Row %d of %d: %s", self.current+1, self.num_rows, strings.Join(cells, ", "))
+	if self.selected[row] {
+		ans += ", selected"
+	}
+	return ans
+}
+
+// Draw the header and the visible rows. In accessible mode, write the
+// announcement if it has changed since the table was last drawn instead.
+func (self *Table) Draw(lp *loop.Loop) {
+	if AccessibleMode() {
+		self.announcer.WriteTo(lp, "current", self.Announcement())
+		return
+	}
+	for i, line := range self.Lines(lp.SprintStyled) {
+		lp.MoveCursorTo(self.x+1, self.y+i+1)
+		lp.QueueWriteString(line)
+	}
+}
+
+func (self *Table) ensure_current_visible() {
+	n := self.num_visible_rows()
+	if n < 1 {
+		return
+	}
+	if self.current < self.scroll_offset {
+		self.scroll_offset = self.current
+	} else if self.current >= self.scroll_offset+n {
+		self.scroll_offset = self.current - n + 1
+	}
+	self.scroll_offset = utils.Max(0, utils.Min(self.scroll_offset, self.num_rows-n))
+}
+
+func (self *Table) set_current(idx int) {
+	if self.num_rows == 0 {
+		return
+	}
+	idx = utils.Max(0, utils.Min(idx, self.num_rows-1))
+	changed := idx != self.current
+	self.current = idx
+	self.ensure_current_visible()
+	if changed && self.OnCurrentRowChanged != nil {
+		self.OnCurrentRowChanged(self.row_at(idx))
+	}
+}
+
+func (self *Table) Scroll(amt int) {
+	n := self.num_visible_rows()
+	self.scroll_offset = utils.Max(0, utils.Min(self.scroll_offset+amt, self.num_rows-n))
+	if self.current < self.scroll_offset {
+		self.set_current(self.scroll_offset)
+	} else if self.current >= self.scroll_offset+n {
+		self.set_current(self.scroll_offset + n - 1)
+	}
+}
+
+// Handle navigation and selection keys, returns true if the event was
+// handled, in which case the table should be redrawn
+func (self *Table) OnKeyEvent(ev *loop.KeyEvent) bool {
+	page := utils.Max(1, self.num_visible_rows()-1)
+	switch {
+	case ev.MatchesPressOrRepeat("up") || ev.MatchesPressOrRepeat("k"):
+		self.set_current(self.current - 1)
+	case ev.MatchesPressOrRepeat("down") || ev.MatchesPressOrRepeat("j"):
+		self.set_current(self.current + 1)
+	case ev.MatchesPressOrRepeat("page_up"):
+		self.set_current(self.current - page)
+	case ev.MatchesPressOrRepeat("page_down"):
+		self.set_current(self.current + page)
+	case ev.MatchesPressOrRepeat("home"):
+		self.set_current(0)
+	case ev.MatchesPressOrRepeat("end"):
+		self.set_current(self.num_rows - 1)
+	case ev.MatchesPressOrRepeat("space"):
+		if r := self.CurrentRow(); r > -1 {
+			self.ToggleSelection(r)
+			self.set_current(self.current + 1)
+		}
+	case ev.MatchesPressOrRepeat("enter"):
+		if r := self.CurrentRow(); r > -1 && self.OnActivate != nil {
+			self.OnActivate(r)
+		}
+	default:
+		return false
+	}
+	ev.Handled = true
+	return true
+}
+
+// The index of the column at the specified x co-ordinate or -1
+func (self *Table) column_at(x int) int {
+	pos := self.x
+	sep := wcswidth.Stringwidth(self.Separator)
+	for c, w := range self.ColumnWidths(self.width) {
+		if x >= pos && x < pos+w {
+			return c
+		}
+		pos += w + sep
+	}
+	return -1
+}
+
+// Handle clicks on headers to sort, clicks on rows to make them current,
+// ctrl+clicks to select them, and the mouse wheel to scroll. Returns true if
+// the event was handled, in which case the table should be redrawn
+func (self *Table) OnMouseEvent(ev *loop.MouseEvent) bool {
+	if ev.Cell.X < self.x || ev.Cell.X >= self.x+self.width || ev.Cell.Y < self.y || ev.Cell.Y >= self.y+self.height {
+		return false
+	}
+	switch ev.Event_type {
+	case loop.MOUSE_PRESS:
+		if ev.Buttons&(loop.MOUSE_WHEEL_UP|loop.MOUSE_WHEEL_DOWN) != 0 {
+			amt := 3
+			if ev.Buttons&loop.MOUSE_WHEEL_UP != 0 {
+				amt = -amt
+			}
+			self.Scroll(amt)
+			return true
+		}
+	case loop.MOUSE_CLICK:
+		if ev.Cell.Y == self.y {
+			c := self.column_at(ev.Cell.X)
+			if c < 0 || !self.Columns[c].Sortable {
+				return false
+			}
+			self.SortBy(c, c == self.sort_column && !self.sort_descending)
+			return true
+		}
+		idx := self.scroll_offset + ev.Cell.Y - self.y - 1
+		if idx >= self.num_rows {
+			return false
+		}
+		if ev.Mods&loop.CTRL != 0 {
+			self.ToggleSelection(self.row_at(idx))
+		}
+		self.set_current(idx)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"testing"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/wcswidth"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestTable(t *testing.T) {
+	unstyled := func(style string, args ...any) string { return fmt.Sprint(args...) }
+	tbl := NewTable(TableColumn{Title: "Name", Sortable: true}, TableColumn{Title: "Size", AlignRight: true, Sortable: true})
+	tbl.SetRows([][]string{{"b", "10"}, {"a very long name", "9"}, {"日本", "100"}})
+	tbl.SetGeometry(0, 0, 14, 3)
+
+	if diff := cmp.Diff([]int{6, 6}, tbl.ColumnWidths(14)); diff != "" {
+		t.Fatalf("Unexpected column widths:\n%s", diff)
+	}
+	lines := tbl.Lines(unstyled)
+	if diff := cmp.Diff([]string{"Name      Size", "b           10", "a ver…       9"}, lines); diff != "" {
+		t.Fatalf("Unexpected table lines:\n%s", diff)
+	}
+	for _, line := range lines {
+		if w := wcswidth.Stringwidth(line); w != 14 {
+			t.Fatalf("Line %#v has width %d", line, w)
+		}
+	}
+
+	tbl.SortBy(1, false)
+	if diff := cmp.Diff([]string{"Name    Size ▲", "a ver…       9", "b           10"}, tbl.Lines(unstyled)); diff != "" {
+		t.Fatalf("Numeric sort failed:\n%s", diff)
+	}
+	if tbl.CurrentRow() != 0 {
+		t.Fatalf("Current row not preserved by sort: %d", tbl.CurrentRow())
+	}
+	tbl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "END"})
+	if tbl.CurrentRow() != 2 {
+		t.Fatalf("end key did not move to last row: %d", tbl.CurrentRow())
+	}
+	if diff := cmp.Diff("日本       100", tbl.Lines(unstyled)[2]); diff != "" {
+		t.Fatalf("Table not scrolled to current row:\n%s", diff)
+	}
+
+	click := func(x, y int) {
+		tbl.OnMouseEvent(&loop.MouseEvent{Event_type: loop.MOUSE_CLICK, Cell: struct{ X, Y int }{x, y}})
+	}
+	click(10, 0)
+	if c, desc := tbl.SortColumn(); c != 1 || !desc {
+		t.Fatalf("Clicking on sorted header did not reverse sort: %d %v", c, desc)
+	}
+	click(0, 1)
+	tbl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: " "})
+	if diff := cmp.Diff([]int{2}, tbl.Selection()); diff != "" {
+		t.Fatalf("Selection failed:\n%s", diff)
+	}
+}
+
+func TestTableRowSource(t *testing.T) {
+	unstyled := func(style string, args ...any) string { return fmt.Sprint(args...) }
+	calls := 0
+	tbl := NewTable(TableColumn{Title: "N", AlignRight: true, Sortable: true}, TableColumn{Title: "Name", Expand: true})
+	tbl.MaxRowsForWidths = 10
+	tbl.SetRowSource(1000000, func(idx int) []string { calls++; return []string{fmt.Sprint(idx), fmt.Sprint("row ", idx)} })
+	tbl.SetGeometry(0, 0, 14, 3)
+	tbl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "END"})
+	tbl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "UP"})
+	if diff := cmp.Diff([]string{"  N  Name     ", "99…  row 9999…", "99…  row 9999…"}, tbl.Lines(unstyled)); diff != "" {
+		t.Fatalf("Unexpected lines:\n%s", diff)
+	}
+	// the cells of 10 rows are used for the column widths and those of 2 rows are drawn
+	if tbl.CurrentRow() != 999998 || calls != 2*10+2*2 {
+		t.Fatalf("Rows other than the visible ones were formatted: %d", calls)
+	}
+	tbl.AppendRow("x", "y")
+	if tbl.NumRows() != 1000001 || tbl.CurrentRow() != 999998 || tbl.Row(1000000)[1] != "y" {
+		t.Fatalf("Appending a row failed")
+	}
+
+	tbl.SetRowSource(5, func(idx int) []string { return []string{fmt.Sprint(idx)} })
+	tbl.SetCurrentRow(3)
+	tbl.SortBy(0, true)
+	if tbl.CurrentRow() != 3 || tbl.Lines(unstyled)[1] != "  3           " {
+		t.Fatalf("Sorting rows from a source failed: %#v", tbl.Lines(unstyled))
+	}
+	tbl.SortBy(-1, false)
+	if tbl.CurrentRow() != 3 || tbl.Lines(unstyled)[2] != "  3           " {
+		t.Fatalf("Current row not preserved by unsorting: %d", tbl.CurrentRow())
+	}
+}
@@ -0,0 +1,92 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// Renders the status of the background tasks started with loop.RunTask(),
+// one line per task, consisting of a spinner followed by the progress of the
+// task.
+type TaskStatus struct {
+	// Used to format the amounts of work reported by tasks, defaults to
+	// formatting as a number of bytes
+	FormatAmount func(amt int64) string
+
+	spinner  *Spinner
+	progress map[loop.IdType]*Progress
+	timer_id loop.IdType
+}
+
+func NewTaskStatus() *TaskStatus {
+	return &TaskStatus{FormatAmount: format_bytes, spinner: NewSpinner("dots"), progress: make(map[loop.IdType]*Progress)}
+}
+
+func (self *TaskStatus) progress_for(task *loop.Task) *Progress {
+	p := self.progress[task.Id()]
+	if p == nil {
+		p = NewProgress(task.Label, 0)
+		p.FormatAmount = self.FormatAmount
+		p.started_at, p.last_update = task.StartedAt(), task.StartedAt()
+		self.progress[task.Id()] = p
+	}
+	done, total := task.Progress()
+	p.SetTotal(total)
+	p.SetDone(done)
+	return p
+}
+
+// Render the status of tasks, each line is exactly width cells wide. Tasks no
+// longer present in tasks are forgotten.
+func (self *TaskStatus) Lines(tasks []*loop.Task, width int, sprint_styled func(style string, args ...any) string) []string {
+	seen := utils.NewSet[loop.IdType](len(tasks))
+	ans := make([]string, 0, len(tasks))
+	frame := ""
+	if len(tasks) > 0 && !AccessibleMode() {
+		frame = self.spinner.Tick() + " "
+	}
+	fw := wcswidth.Stringwidth(frame)
+	for _, t := range tasks {
+		seen.Add(t.Id())
+		p := self.progress_for(t)
+		ans = append(ans, sprint_styled(CurrentTheme().Accent, frame)+p.Render(utils.Max(0, width-fw), sprint_styled))
+	}
+	for id := range self.progress {
+		if !seen.Has(id) {
+			delete(self.progress, id)
+		}
+	}
+	return ans
+}
+
+// Call redraw at the interval of the spinner while lp has running tasks. Call
+// this after starting tasks and after tasks finish, typically from the
+// OnDone callbacks of tasks.
+func (self *TaskStatus) Animate(lp *loop.Loop, redraw func() error) error {
+	running := len(lp.RunningTasks()) > 0
+	switch {
+	case running && self.timer_id == 0:
+		id, err := lp.AddTimer(self.spinner.Interval(), true, func(loop.IdType) error {
+			if len(lp.RunningTasks()) == 0 {
+				lp.RemoveTimer(self.timer_id)
+				self.timer_id = 0
+			}
+			return redraw()
+		})
+		if err != nil {
+			return err
+		}
+		self.timer_id = id
+	case !running && self.timer_id != 0:
+		lp.RemoveTimer(self.timer_id)
+		self.timer_id = 0
+	}
+	return nil
+}
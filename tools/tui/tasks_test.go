@@ -0,0 +1,53 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+func TestTaskStatus(t *testing.T) {
+	SetCurrentTheme(DefaultTheme())
+	unstyled := func(style string, args ...any) string { return fmt.Sprint(args...) }
+	lp, err := loop.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reported, release := make(chan bool), make(chan bool)
+	f := func(task *loop.Task) (any, error) {
+		task.ReportProgress(25, 100)
+		reported <- true
+		<-release
+		return nil, nil
+	}
+	a, b := lp.RunTask("first", f, nil), lp.RunTask("second", f, nil)
+	<-reported
+	<-reported
+	defer close(release)
+	ts := NewTaskStatus()
+	ts.FormatAmount = func(amt int64) string { return strconv.FormatInt(amt, 10) }
+	lines := ts.Lines([]*loop.Task{a, b}, 60, unstyled)
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected number of lines: %#v", lines)
+	}
+	for i, q := range []string{"first", "second"} {
+		if w := wcswidth.Stringwidth(lines[i]); w != 60 {
+			t.Fatalf("Line %d has width %d instead of 60: %#v", i, w, lines[i])
+		}
+		if !strings.Contains(lines[i], q) || !strings.Contains(lines[i], " 25% 25/100") {
+			t.Fatalf("Task status not rendered: %#v", lines[i])
+		}
+	}
+	ts.Lines([]*loop.Task{b}, 60, unstyled)
+	if _, found := ts.progress[a.Id()]; found || len(ts.progress) != 1 {
+		t.Fatalf("Progress of removed task not forgotten")
+	}
+}
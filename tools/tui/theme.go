@@ -0,0 +1,179 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kitty/tools/config"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+)
+
+var _ = fmt.Print
+
+// Semantic styles used by widgets, in the format used by loop.SprintStyled.
+// Widgets get their default styles from CurrentTheme() so that kittens match
+// the colors the user has configured in kitty.
+type Theme struct {
+	// Borders, progress bars and other decorations
+	Accent string
+	// The current item in lists, tables, menus and buttons
+	Selection string
+	// Text matching a search query
+	Highlight string
+	// Selected items, finished tasks
+	Success string
+	Warning string
+	// Error messages
+	Error string
+	// Less important text, such as labels
+	Dim string
+}
+
+// A theme that uses only the standard colors from the terminal's palette
+func DefaultTheme() Theme {
+	return Theme{
+		Accent: "fg=blue", Selection: "reverse=true", Highlight: "fg=yellow", Success: "fg=green",
+		Warning: "fg=yellow", Error: "fg=red", Dim: "dim",
+	}
+}
+
+// Create a theme from kitty color settings such as color1 and
+// selection_background. Styles whose colors are not present in colors are
+// the same as in DefaultTheme().
+func ThemeFromKittyColors(colors map[string]style.RGBA) Theme {
+	ans := DefaultTheme()
+	fg := func(dest *string, key string) {
+		if c, found := colors[key]; found {
+			*dest = "fg=" + c.AsRGBSharp()
+		}
+	}
+	fg(&ans.Accent, "color4")
+	fg(&ans.Highlight, "color3")
+	fg(&ans.Success, "color2")
+	fg(&ans.Warning, "color3")
+	fg(&ans.Error, "color1")
+	fg(&ans.Dim, "color8")
+	if bg, found := colors["selection_background"]; found {
+		ans.Selection = "bg=" + bg.AsRGBSharp()
+		sfg, found := colors["selection_foreground"]
+		if !found {
+			// kitty uses the background color when selection_foreground is none
+			sfg, found = colors["background"]
+		}
+		if found {
+			ans.Selection = "fg=" + sfg.AsRGBSharp() + " " + ans.Selection
+		}
+	}
+	return ans
+}
+
+func is_color_setting(key string) bool {
+	switch key {
+	case "foreground", "background", "selection_foreground", "selection_background":
+		return true
+	}
+	if rest, found := strings.CutPrefix(key, "color"); found {
+		n, err := strconv.Atoi(rest)
+		return err == nil && n > -1 && n < 256
+	}
+	return false
+}
+
+func parse_kitty_colors(load func(cp *config.ConfigParser) error) (map[string]style.RGBA, error) {
+	ans := make(map[string]style.RGBA)
+	cp := config.ConfigParser{LineHandler: func(key, val string) error {
+		if is_color_setting(key) {
+			// values such as none are ignored
+			if c, err := style.ParseColor(val); err == nil {
+				ans[key] = c
+			}
+		}
+		return nil
+	}}
+	if err := load(&cp); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+// Read the color settings from kitty.conf files, including any files they include
+func ReadKittyColors(paths ...string) (map[string]style.RGBA, error) {
+	return parse_kitty_colors(func(cp *config.ConfigParser) error { return cp.ParseFiles(paths...) })
+}
+
+// Query the colors of the kitty instance the kitten is running in, using
+// remote control. Fails if remote control is not available.
+func QueryKittyColors() (map[string]style.RGBA, error) {
+	if os.Getenv("KITTY_LISTEN_ON") == "" {
+		return nil, fmt.Errorf("Not running in a kitty instance with remote control enabled")
+	}
+	kitty_exe := utils.KittyExe()
+	if kitty_exe == "" {
+		return nil, fmt.Errorf("Could not find the kitty executable")
+	}
+	kitten := filepath.Join(filepath.Dir(kitty_exe), "kitten")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, kitten, "@", "get-colors").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query colors from kitty with error: %w", err)
+	}
+	lines := utils.Splitlines(string(bytes.TrimSpace(output)))
+	return parse_kitty_colors(func(cp *config.ConfigParser) error { return cp.ParseOverrides(lines...) })
+}
+
+// The theme matching the colors of the running kitty, if they can be queried,
+// otherwise those configured in kitty.conf, otherwise DefaultTheme()
+func KittyTheme() Theme {
+	colors, err := QueryKittyColors()
+	if err != nil {
+		if colors, err = ReadKittyColors(filepath.Join(utils.ConfigDir(), "kitty.conf")); err != nil {
+			return DefaultTheme()
+		}
+	}
+	return ThemeFromKittyColors(colors)
+}
+
+var current_theme struct {
+	sync.Mutex
+	theme *Theme
+}
+
+// The theme used for the default styles of widgets. Loaded using
+// KittyTheme() the first time it is needed, unless SetCurrentTheme() was
+// called before that.
+func CurrentTheme() Theme {
+	current_theme.Lock()
+	defer current_theme.Unlock()
+	if current_theme.theme == nil {
+		t := KittyTheme()
+		current_theme.theme = &t
+	}
+	return *current_theme.theme
+}
+
+// Load the theme again using KittyTheme(), for example, when the terminal
+// reports that its color scheme has changed. Widgets created after this use
+// the new theme.
+func ReloadCurrentTheme() Theme {
+	t := KittyTheme()
+	SetCurrentTheme(t)
+	return t
+}
+
+func SetCurrentTheme(t Theme) {
+	current_theme.Lock()
+	defer current_theme.Unlock()
+	current_theme.theme = &t
+}
@@ -0,0 +1,42 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestTheme(t *testing.T) {
+	tdir := t.TempDir()
+	conf := filepath.Join(tdir, "kitty.conf")
+	os.WriteFile(conf, []byte("font_size 12\ncolor1 #ff0000\nselection_foreground none\ninclude theme.conf\n"), 0600)
+	os.WriteFile(filepath.Join(tdir, "theme.conf"), []byte("color4 #0000ee\nbackground #111111\nselection_background #333333\ncolor300 #000000\n"), 0600)
+	colors, err := ReadKittyColors(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theme := ThemeFromKittyColors(colors)
+	expected := DefaultTheme()
+	expected.Error = "fg=#ff0000"
+	expected.Accent = "fg=#0000ee"
+	expected.Selection = "fg=#111111 bg=#333333"
+	if diff := cmp.Diff(expected, theme); diff != "" {
+		t.Fatalf("Unexpected theme:\n%s", diff)
+	}
+	if _, err = ReadKittyColors(filepath.Join(tdir, "missing.conf")); err == nil {
+		t.Fatalf("No error reading non-existent config file")
+	}
+
+	SetCurrentTheme(theme)
+	if NewList().CurrentItemStyle != "fg=#111111 bg=#333333" {
+		t.Fatalf("List does not use the current theme")
+	}
+	SetCurrentTheme(DefaultTheme())
+}
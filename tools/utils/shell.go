@@ -25,6 +25,29 @@ func QuoteStringForFish(x string) string {
 	return "'" + x + "'"
 }
 
+// Quotes strings for PowerShell, if they contain characters special to it
+func QuoteStringForPowerShell(x string) string {
+	if x != "" && !strings.ContainsAny(x, " \t\n'\"`$;|&(){}@,<>#") {
+		return x
+	}
+	return "'" + strings.ReplaceAll(x, "'", "''") + "'"
+}
+
+// Quotes strings for nushell, if they contain characters special to it
+func QuoteStringForNushell(x string) string {
+	if x != "" && !strings.ContainsAny(x, " \t\n'\"`$;|(){}[]#") {
+		return x
+	}
+	if !strings.Contains(x, "'") {
+		// single quoted strings have no escapes
+		return "'" + x + "'"
+	}
+	x = strings.ReplaceAll(x, "\\", "\\\\")
+	x = strings.ReplaceAll(x, "\"", "\\\"")
+	x = strings.ReplaceAll(x, "\n", "\\n")
+	return "\"" + x + "\""
+}
+
 // Escapes common shell meta characters
 func EscapeSHMetaCharacters(x string) string {
 	ans := strings.Builder{}
@@ -4,6 +4,7 @@ package utils
 
 import (
 	"fmt"
+	"net"
 	"runtime"
 	"strings"
 
@@ -30,6 +31,12 @@ func ParseSocketAddress(spec string) (network string, addr string, err error) {
 		}
 		return
 	}
+	if network == "tls" {
+		if _, _, serr := net.SplitHostPort(addr); serr != nil {
+			err = fmt.Errorf("Not a valid host:port address: %#v. Cannot use: %s", addr, spec)
+		}
+		return
+	}
 	if network == "ip" || network == "ip6" || network == "ip4" {
 		host := ipaddr.NewHostName(addr)
 		if !host.IsAddress() {
@@ -53,6 +53,8 @@ func TestParseSocketAddress(t *testing.T) {
 	testf("tcp:localhost:123", "tcp", "localhost:123")
 	testf("tcp:1.1.1.1:123", "ip", "1.1.1.1:123")
 	testf("tcp:fe80::1", "ip", "fe80::1")
+	testf("tls:example.com:8443", "tls", "example.com:8443")
+	teste("tls:example.com", "bad kitty")
 	teste("xxx", "bad kitty")
 	teste("xxx:yyy", "bad kitty")
 	teste(":yyy", "bad kitty")
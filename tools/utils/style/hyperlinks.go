@@ -0,0 +1,98 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package style
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var _ = fmt.Print
+
+// The escape code that ends a hyperlink
+const HyperlinkEnd = "\x1b]8;;\x1b\\"
+
+// OSC 8 allows only printable ASCII in URLs and ids, percent encode everything else
+func sanitize_for_osc8(x string, also_escape string) string {
+	needs_escape := func(b byte) bool { return b < 32 || b > 126 || strings.IndexByte(also_escape, b) > -1 }
+	i := 0
+	for ; i < len(x) && !needs_escape(x[i]); i++ {
+	}
+	if i == len(x) {
+		return x
+	}
+	ans := strings.Builder{}
+	ans.Grow(len(x) + 16)
+	ans.WriteString(x[:i])
+	for ; i < len(x); i++ {
+		if b := x[i]; needs_escape(b) {
+			fmt.Fprintf(&ans, "%%%02X", b)
+		} else {
+			ans.WriteByte(b)
+		}
+	}
+	return ans.String()
+}
+
+// The escape code that starts a hyperlink to url. Terminals treat links with
+// the same non-empty id as a single link, which is needed for links split
+// over several lines to be highlighted as one.
+func HyperlinkStart(url, id string) string {
+	params := ""
+	if id != "" {
+		params = "id=" + sanitize_for_osc8(id, ":;=")
+	}
+	return "\x1b]8;" + params + ";" + sanitize_for_osc8(url, "") + "\x1b\\"
+}
+
+// Make text a hyperlink to url
+func Hyperlink(url, id, text string) string {
+	if url == "" {
+		return text
+	}
+	return HyperlinkStart(url, id) + text + HyperlinkEnd
+}
+
+// Return text with HyperlinkEnd appended if it ends inside a hyperlink, for
+// example, because it was truncated
+func TerminateHyperlink(text string) string {
+	idx := strings.LastIndex(text, "\x1b]8;")
+	if idx < 0 {
+		return text
+	}
+	body := text[idx+4:]
+	if end := strings.IndexAny(body, "\x1b\a"); end > -1 {
+		body = body[:end]
+	}
+	if _, url, found := strings.Cut(body, ";"); found && url != "" {
+		return text + HyperlinkEnd
+	}
+	return text
+}
+
+// Generates ids for hyperlinks, the same URL always gets the same id. Ids
+// include the process id so that they do not clash with the ids of links
+// output by other programs. Safe to use from multiple goroutines.
+type HyperlinkIds struct {
+	mutex  sync.Mutex
+	prefix string
+	ids    map[string]string
+}
+
+func NewHyperlinkIds() *HyperlinkIds {
+	return &HyperlinkIds{prefix: strconv.Itoa(os.Getpid()) + "-", ids: make(map[string]string)}
+}
+
+func (self *HyperlinkIds) For(url string) string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	ans, found := self.ids[url]
+	if !found {
+		ans = self.prefix + strconv.Itoa(len(self.ids)+1)
+		self.ids[url] = ans
+	}
+	return ans
+}
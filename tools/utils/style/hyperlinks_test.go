@@ -0,0 +1,37 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package style
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestHyperlinks(t *testing.T) {
+	if q := HyperlinkStart("file:///a b\x1b\\é", "x;y"); q != "\x1b]8;id=x%3By;file:///a b%1B\\%C3%A9\x1b\\" {
+		t.Fatalf("URL not sanitized: %#v", q)
+	}
+	link := Hyperlink("http://a.com", "1", "text")
+	for text, expected := range map[string]string{
+		"plain":                 "plain",
+		link:                    link,
+		link[:len(link)-5]:      link[:len(link)-5] + HyperlinkEnd,
+		HyperlinkStart("u", ""): HyperlinkStart("u", "") + HyperlinkEnd,
+	} {
+		if q := TerminateHyperlink(text); q != expected {
+			t.Fatalf("Hyperlink in %#v not terminated correctly: %#v", text, q)
+		}
+	}
+	ids := NewHyperlinkIds()
+	a, b := ids.For("a"), ids.For("b")
+	if a == b || ids.For("a") != a || !strings.HasSuffix(b, "-2") {
+		t.Fatalf("Unexpected hyperlink ids: %#v %#v", a, b)
+	}
+	lines := WrapTextAsLines("see "+Hyperlink("http://a.com", "x", "a long link"), 8, WrapOptions{})
+	if len(lines) != 3 || !strings.Contains(lines[2], "\x1b]8;id=x;http://a.com\x1b\\link") {
+		t.Fatalf("Hyperlink not continued on wrapped lines: %#v", lines)
+	}
+}
@@ -297,11 +297,11 @@ type url_code struct {
 }
 
 func (self url_code) prefix() string {
-	return fmt.Sprintf("\x1b]8;;%s\x1b\\", self.url)
+	return HyperlinkStart(self.url, "")
 }
 
 func (self url_code) suffix() string {
-	return "\x1b]8;;\x1b\\"
+	return HyperlinkEnd
 }
 
 func (self url_code) is_empty() bool {
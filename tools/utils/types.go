@@ -13,7 +13,11 @@ type RemoteControlCmd struct {
 	Stream        bool   `json:"stream,omitempty"`
 	StreamId      string `json:"stream_id,omitempty"`
 	KittyWindowId uint   `json:"kitty_window_id,omitempty"`
-	Payload       any    `json:"payload,omitempty"`
+	// The compression algorithms the client accepts for large responses
+	Compression string `json:"compression,omitempty"`
+	// The compression used for the payload, which is then base64 encoded
+	PayloadCompression string `json:"payload_compression,omitempty"`
+	Payload            any    `json:"payload,omitempty"`
 }
 
 type EncryptedRemoteControlCmd struct {